@@ -0,0 +1,111 @@
+// Command bitshare-relay runs a relay server for BitShare nodes that can't
+// reach each other directly. Nodes use it once it is listed in relay_servers
+// in their config.json.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"fileshare/internal/relay"
+	"fileshare/internal/utils"
+)
+
+func main() {
+	listen := flag.String("listen", ":9100", "TCP address to serve nodes on")
+	tokens := flag.String("tokens", "", "Comma separated tokens nodes must present, every node is served when empty (or set BITSHARE_RELAY_TOKENS)")
+	maxNodes := flag.Int("max-nodes", 10000, "Nodes registered at once, 0 for no limit")
+	maxSessions := flag.Int("max-sessions", 1000, "Sessions relayed at once, 0 for no limit")
+	maxBytes := flag.String("max-session-bytes", "0", "Bytes one session may relay, such as 10GB, 0 for no limit")
+	maxDuration := flag.Duration("max-session-time", 0, "How long a session may last, 0 for no limit")
+	idleTimeout := flag.Duration("idle-timeout", 5*time.Minute, "Close sessions without traffic for this long, 0 to keep them")
+	metrics := flag.String("metrics", "", "Address to serve the counters on as JSON at /metrics, such as 127.0.0.1:9101")
+	statsInterval := flag.Duration("stats-interval", 10*time.Minute, "How often to log the counters, 0 to not log them")
+	flag.Parse()
+
+	sessionBytes, err := utils.ParseBytes(*maxBytes)
+	if err != nil {
+		fmt.Printf("Error: --max-session-bytes: %v\n", err)
+		os.Exit(2)
+	}
+	if *tokens == "" {
+		*tokens = os.Getenv("BITSHARE_RELAY_TOKENS")
+	}
+	accepted := splitTokens(*tokens)
+
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	server := relay.NewServer(relay.Config{
+		Tokens:             accepted,
+		MaxNodes:           *maxNodes,
+		MaxSessions:        *maxSessions,
+		MaxSessionBytes:    sessionBytes,
+		MaxSessionDuration: *maxDuration,
+		IdleTimeout:        *idleTimeout,
+		Logger:             logger,
+	})
+
+	if *metrics != "" {
+		go serveMetrics(server, *metrics, logger)
+	}
+	if *statsInterval > 0 {
+		go func() {
+			for range time.Tick(*statsInterval) {
+				logStats(logger, server.Stats())
+			}
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		server.Close()
+	}()
+
+	if len(accepted) == 0 {
+		logger.Printf("⚠️ No tokens set, relaying for any node")
+	}
+	logger.Printf("BitShare relay listening on %s", *listen)
+	if err := server.ListenAndServe(*listen); err != nil && !errors.Is(err, relay.ErrServerClosed) {
+		logger.Printf("Error: %v", err)
+		os.Exit(1)
+	}
+	logStats(logger, server.Stats())
+}
+
+// serveMetrics serves the server's counters as JSON
+func serveMetrics(server *relay.Server, addr string, logger *log.Logger) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(server.Stats())
+	})
+	logger.Printf("Serving metrics on http://%s/metrics", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logger.Printf("⚠️ Metrics: %v", err)
+	}
+}
+
+func logStats(logger *log.Logger, stats relay.Stats) {
+	logger.Printf("%d nodes, %d sessions now, %d in all, %d refused, %s relayed",
+		stats.Nodes, stats.ActiveSessions, stats.Sessions, stats.Refused, utils.FormatBytes(stats.BytesRelayed))
+}
+
+func splitTokens(list string) []string {
+	var tokens []string
+	for _, token := range strings.Split(list, ",") {
+		if token = strings.TrimSpace(token); token != "" {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
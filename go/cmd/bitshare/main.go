@@ -2,13 +2,16 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
+	"fileshare/internal/config"
 	"fileshare/internal/mesh"
 	"fileshare/internal/p2p"
 	"fileshare/internal/transfer"
@@ -49,11 +52,16 @@ func main() {
 		connectToPeer(os.Args[2])
 
 	case "send":
-		if len(os.Args) < 4 {
-			fmt.Println("Usage: bitshare send <peer_id> <file_path>")
+		if len(os.Args) < 5 {
+			fmt.Println("Usage: bitshare send <peer_id_or_ip> <port_no> <file_path>")
 			os.Exit(1)
 		}
-		sendFile(os.Args[2], os.Args[3])
+		port, err := strconv.Atoi(os.Args[3])
+		if err != nil {
+			fmt.Printf("Invalid port number: %v\n", err)
+			os.Exit(1)
+		}
+		sendFile(os.Args[2], port, os.Args[4])
 
 	case "receive":
 		if len(os.Args) < 3 {
@@ -95,18 +103,18 @@ func startInteractiveMode() {
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
 	// Start mesh node
-	config := mesh.Config{
-		NodeName:         utils.GenerateNodeName(),
-		ListenPort:       9000,
-		EnableWiFiDirect: true,
-		EnableBluetooth:  true,
-		EnableTCP:        true,
+	settings, err := config.Load()
+	if err != nil {
+		fmt.Println(err)
+		termUI.Stop()
+		os.Exit(1)
 	}
 
 	fmt.Println("Starting BitShare mesh node in interactive mode...")
-	err = mesh.StartMeshNode(config)
+	err = mesh.StartMeshNode(settings.MeshConfig())
 	if err != nil {
 		fmt.Printf("Failed to start mesh node: %v\n", err)
+		explainStartFailure(err)
 		termUI.Stop()
 		os.Exit(1)
 	}
@@ -177,26 +185,31 @@ func startMeshNode(args []string) {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
-	// Parse options from args if any
-	config := mesh.Config{
-		NodeName:         utils.GenerateNodeName(),
-		ListenPort:       9000, // Default port
-		EnableWiFiDirect: true,
-		EnableBluetooth:  true,
-		EnableTCP:        true,
+	// config.json, overridden by the options in args
+	settings, err := config.Load()
+	if err != nil {
+		fmt.Printf("❌ %v\n", err)
+		os.Exit(1)
 	}
-
-	// TODO: Parse additional options from args
-	// This would handle flags like --port, --name, etc.
+	rest, err := settings.ApplyFlags(args)
+	if err == nil && len(rest) > 0 {
+		err = fmt.Errorf("unknown argument %q", rest[0])
+	}
+	if err != nil {
+		fmt.Printf("❌ %v\n", err)
+		os.Exit(1)
+	}
+	meshConfig := settings.MeshConfig()
 
 	fmt.Println("🌐 Starting BitShare mesh node...")
-	err := mesh.StartMeshNode(config)
+	err = mesh.StartMeshNode(meshConfig)
 	if err != nil {
 		fmt.Printf("❌ Failed to start mesh node: %v\n", err)
+		explainStartFailure(err)
 		os.Exit(1)
 	}
 
-	fmt.Printf("✅ Node started successfully as '%s'\n", config.NodeName)
+	fmt.Printf("✅ Node started successfully as '%s'\n", meshConfig.NodeName)
 	fmt.Println("📡 Listening for connections...")
 	fmt.Println("Press Ctrl+C to stop")
 
@@ -226,60 +239,158 @@ func scanForPeers(args []string) {
 		return
 	}
 
+	targets := make([]mesh.HandleTarget, len(peers))
+	for i, peer := range peers {
+		targets[i] = mesh.HandleTarget{ID: peer.ID, Name: peer.Name, Address: peer.Address}
+	}
+	handles := mesh.AssignHandles(targets)
+
 	fmt.Printf("Found %d peers:\n", len(peers))
 	for i, peer := range peers {
-		fmt.Printf("%d. %s (%s) - Protocol: %s, Signal: %d%%\n",
-			i+1, peer.Name, peer.ID, peer.Protocol, peer.SignalStrength)
+		protocols := []string{peer.Protocol}
+		if len(peer.Transports) > 0 {
+			protocols = protocols[:0]
+			for _, t := range peer.Transports {
+				protocols = append(protocols, t.Protocol)
+			}
+		}
+		fmt.Printf("%-4s %s (%s) - Protocol: %s, Signal: %d%%\n",
+			handles[i], peer.Name, peer.ID, strings.Join(protocols, ", "), peer.SignalStrength)
 	}
 }
 
 func listPeers() {
-	peers, err := mesh.GetKnownPeers()
+	snapshot, source, err := mesh.GetNodeSnapshot()
 	if err != nil {
 		fmt.Printf("❌ Error retrieving peers: %v\n", err)
 		os.Exit(1)
 	}
+	peers := snapshot.Peers
+
+	if source == mesh.SourceCache {
+		fmt.Printf("(cached, node not running - last updated %s)\n", utils.FormatTime(snapshot.UpdatedAt))
+	}
 
 	if len(peers) == 0 {
 		fmt.Println("No known peers. Run 'scan' to discover peers.")
 		return
 	}
 
+	targets := make([]mesh.HandleTarget, len(peers))
+	for i, peer := range peers {
+		targets[i] = mesh.HandleTarget{ID: peer.ID, Name: peer.Name, Address: peer.Address}
+	}
+	handles := mesh.AssignHandles(targets)
+
 	fmt.Println("Known peers in the mesh network:")
 	fmt.Println("--------------------------------")
 	for i, peer := range peers {
 		status := "⚫ Offline"
 		if peer.IsOnline {
 			status = "🟢 Online"
+		} else if !peer.LastSeen.IsZero() {
+			status += ", last seen " + utils.FormatTime(peer.LastSeen)
+		}
+		fmt.Printf("%-4s %s — %s (%s) - %s\n", handles[i], peer.Name, strings.Join(peer.Protocols(), ", "), peer.ID, status)
+		version := peer.Version
+		if version == "" {
+			version = "unknown"
+		}
+		quality := peer.ConnectionQuality
+		if quality == "" {
+			quality = "not measured"
+		}
+		fmt.Printf("     Routes: %d, Quality: %s, Version: %s\n",
+			len(peer.Routes), quality, version)
+		if fingerprint := peer.Fingerprint(); fingerprint != "" {
+			fmt.Printf("     Key: %s\n", fingerprint)
 		}
-		fmt.Printf("%d. %s (%s) - %s\n", i+1, peer.Name, peer.ID, status)
-		fmt.Printf("   Routes: %d, Connection Quality: %s\n",
-			len(peer.Routes), peer.ConnectionQuality)
 	}
 }
 
+// explainStartFailure suggests what to do about a node that didn't start
+// because another process runs one on the same data directory
+func explainStartFailure(err error) {
+	var locked *mesh.InstanceLockedError
+	if errors.As(err, &locked) {
+		fmt.Println("Use the BitShare terminal that is already running, or stop it first.")
+	}
+}
+
+// connectToPeer connects to a peer the best way there is, through a mesh
+// node of its own, and shows how it got there and that the peer answers
 func connectToPeer(peerID string) {
 	fmt.Printf("Connecting to peer: %s\n", peerID)
 
-	// This would use the mesh coordinator to establish a connection
-	// For now, just print a message
-	fmt.Println("Connection functionality not fully implemented")
+	settings, err := config.Load()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := mesh.StartMeshNode(settings.MeshConfig()); err != nil {
+		fmt.Printf("Failed to start mesh node: %v\n", err)
+		explainStartFailure(err)
+		os.Exit(1)
+	}
+	defer mesh.StopMeshNode()
+
+	conn, err := mesh.ConnectToPeer(peerID)
+	if err != nil {
+		fmt.Printf("❌ %v\n", err)
+		return
+	}
+	defer conn.Close()
+
+	fmt.Printf("Connected to %s (%s) over %s", conn.Identity.Name, conn.Identity.NodeID, conn.Protocol)
+	if conn.Via != "" {
+		fmt.Printf(" via %s", conn.Via)
+	}
+	fmt.Println()
+	if fingerprint := conn.Fingerprint(); fingerprint != "" {
+		fmt.Printf("Key: %s (verified)\n", fingerprint)
+	} else {
+		fmt.Println("Key: none, the peer runs a release without node keys")
+	}
+
+	started := time.Now()
+	if err := p2p.Ping(conn, 5*time.Second); err != nil {
+		fmt.Printf("❌ The peer didn't answer a ping: %v\n", err)
+		return
+	}
+	fmt.Printf("Round trip: %s\n", time.Since(started).Round(time.Millisecond))
 }
 
-func sendFile(peerID, filePath string) {
+// sendFile sends a file to a 'receive' on the given port, using the same
+// protocol as the main bitshare binary so either can talk to the other
+func sendFile(peerID string, port int, filePath string) {
 	// Validate file exists
 	if !utils.FileExists(filePath) {
 		fmt.Printf("File not found: %s\n", filePath)
 		os.Exit(1)
 	}
 
+	address, isIP := utils.ParseIPHost(peerID)
+	if !isIP {
+		peer, err := mesh.FindPeerByIdOrName(peerID)
+		if err != nil || peer == nil || peer.Address == "" {
+			fmt.Printf("Could not find an address for peer %s, run 'bitshare scan' or use its IP address\n", peerID)
+			os.Exit(1)
+		}
+		address = peer.Address
+	}
+
 	fmt.Printf("Sending file %s to peer %s\n", filePath, peerID)
 
-	// Create transfer options
-	options := transfer.DefaultTransferOptions()
+	// Create transfer options, as config.json sets them
+	settings, err := config.Load()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	options := settings.TransferOptions()
+	options.PeerName = peerID
 
-	// Start chunked transfer
-	err := transfer.SendFileChunked(filePath, peerID, options)
+	err = transfer.SendFilesWithOptions([]string{filePath}, address, port, options)
 	if err != nil {
 		fmt.Printf("Error sending file: %v\n", err)
 		os.Exit(1)
@@ -350,6 +461,10 @@ func printDetailedHelp() {
 	fmt.Println("    Options:")
 	fmt.Println("      --port <number>    Port to listen on (default: 9000)")
 	fmt.Println("      --name <name>      Node name (default: hostname)")
+	fmt.Println("      --data-dir <dir>   Where the node keeps its state")
+	fmt.Println("      --relay, --no-relay  Whether to reach peers through relay servers")
+	fmt.Println("      --offline          Skip the lookups of the public address on the internet")
+	fmt.Println("    Defaults come from config.json in the BitShare data directory, see 'bitshare config init'")
 	fmt.Println("    Usage: bitshare start --port 9000 --name MyLaptop")
 
 	fmt.Println("\n  scan")
@@ -364,9 +479,9 @@ func printDetailedHelp() {
 	fmt.Println("    Connect to a specific peer")
 	fmt.Println("    Usage: bitshare connect bob-laptop")
 
-	fmt.Println("\n  send <peer_id> <file_path>")
-	fmt.Println("    Send a file to a peer")
-	fmt.Println("    Usage: bitshare send bob-laptop \"C:\\Users\\Alice\\Documents\\report.pdf\"")
+	fmt.Println("\n  send <peer_id_or_ip> <port_no> <file_path>")
+	fmt.Println("    Send a file to a peer that is running 'receive' on the port")
+	fmt.Println("    Usage: bitshare send bob-laptop 9000 \"C:\\Users\\Alice\\Documents\\report.pdf\"")
 
 	fmt.Println("\n  receive <port_no> [destination_directory]")
 	fmt.Println("    Receive files on the specified port")
@@ -0,0 +1,180 @@
+package access
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"fileshare/internal/utils"
+)
+
+// Connection access lists
+//
+// A receiver can be limited to known addresses with an allow list and a deny
+// list of IP addresses and CIDR ranges. They are kept in access.json in the
+// data directory and receivers can add to them with flags. A connection from
+// an address on the deny list is refused; when the allow list has entries,
+// so is one from any address not on it. Connections are checked as soon as
+// they are accepted, before anything is read from them.
+
+const accessFile = "access.json"
+
+// Rules are the allow and deny lists. Entries are IP addresses or CIDR ranges.
+type Rules struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+// Load reads the rules from the data directory. No file means no rules.
+func Load() (Rules, error) {
+	var rules Rules
+	path, err := rulesPath()
+	if err != nil {
+		return rules, err
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return rules, nil
+	}
+	if err != nil {
+		return rules, err
+	}
+
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return rules, fmt.Errorf("invalid %s: %v", path, err)
+	}
+	if err := rules.Validate(); err != nil {
+		return rules, fmt.Errorf("invalid %s: %v", path, err)
+	}
+	return rules, nil
+}
+
+// Save writes the rules to the data directory
+func Save(rules Rules) error {
+	path, err := rulesPath()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(rules, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// ParseEntry parses an IP address or CIDR range into the network it covers
+func ParseEntry(entry string) (*net.IPNet, error) {
+	entry = strings.TrimSpace(entry)
+	if strings.Contains(entry, "/") {
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a valid CIDR range, e.g. 192.168.1.0/24", entry)
+		}
+		return network, nil
+	}
+
+	ip := net.ParseIP(entry)
+	if ip == nil {
+		return nil, fmt.Errorf("%q is not a valid IP address or CIDR range", entry)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// ParseList splits a comma separated list of entries, checking each of them
+func ParseList(list string) ([]string, error) {
+	var entries []string
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if _, err := ParseEntry(entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Validate checks every entry is an IP address or CIDR range
+func (r Rules) Validate() error {
+	for _, entry := range append(append([]string{}, r.Allow...), r.Deny...) {
+		if _, err := ParseEntry(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Empty reports whether the rules let every address in
+func (r Rules) Empty() bool {
+	return len(r.Allow) == 0 && len(r.Deny) == 0
+}
+
+// Merge returns the rules with the entries of other added
+func (r Rules) Merge(other Rules) Rules {
+	return Rules{
+		Allow: append(append([]string{}, r.Allow...), other.Allow...),
+		Deny:  append(append([]string{}, r.Deny...), other.Deny...),
+	}
+}
+
+// Check returns why a connection from addr is refused, or nil if it may connect.
+// The deny list wins over the allow list.
+func (r Rules) Check(addr net.Addr) error {
+	if r.Empty() {
+		return nil
+	}
+
+	ip := addrIP(addr)
+	if ip == nil {
+		return fmt.Errorf("unknown address")
+	}
+
+	if entry, ok := match(ip, r.Deny); ok {
+		return fmt.Errorf("on the deny list (%s)", entry)
+	}
+	if len(r.Allow) > 0 {
+		if _, ok := match(ip, r.Allow); !ok {
+			return fmt.Errorf("not on the allow list")
+		}
+	}
+	return nil
+}
+
+// match returns the first entry covering ip
+func match(ip net.IP, entries []string) (string, bool) {
+	for _, entry := range entries {
+		if network, err := ParseEntry(entry); err == nil && network.Contains(ip) {
+			return entry, true
+		}
+	}
+	return "", false
+}
+
+// addrIP returns the IP address of addr, or nil if it has none
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+func rulesPath() (string, error) {
+	dir, err := utils.DataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, accessFile), nil
+}
@@ -0,0 +1,238 @@
+package access
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"fileshare/internal/utils"
+)
+
+// Blocklist
+//
+// Blocking a peer ignores it entirely. blocklist.json in the data directory
+// lists blocked node IDs, IP addresses and CIDR ranges; the mesh node drops
+// blocked peers when it discovers or hears of them and won't connect to
+// them, and the TCP service and receivers refuse connections from blocked
+// addresses, counting the attempts. A blocked node ID also blocks the
+// addresses the node was seen at, which the mesh keeps with its entry as it
+// sees the node move. The file is read for each check, so blocking applies
+// at once to a node running in another process.
+
+const blocklistFile = "blocklist.json"
+
+// maxBlockedAddresses bounds how many addresses are kept per blocked node ID
+const maxBlockedAddresses = 4
+
+// Block is a blocked peer
+type Block struct {
+	Peer        string    `json:"peer"`                // Node ID, IP address or CIDR range
+	Name        string    `json:"name,omitempty"`      // What the peer was called when it was blocked
+	Addresses   []string  `json:"addresses,omitempty"` // Where a blocked node ID was seen, most recent first
+	Added       time.Time `json:"added"`
+	Attempts    int       `json:"attempts"` // Connections refused since it was blocked
+	LastAttempt time.Time `json:"last_attempt,omitempty"`
+}
+
+// Blocklist is the blocked peers
+type Blocklist []Block
+
+// blocklistMutex keeps the updates of this process from interleaving
+var blocklistMutex sync.Mutex
+
+// LoadBlocklist reads the blocklist from the data directory. No file means
+// nobody is blocked.
+func LoadBlocklist() (Blocklist, error) {
+	path, err := blocklistPath()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list Blocklist
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", path, err)
+	}
+	return list, nil
+}
+
+func saveBlocklist(list Blocklist) error {
+	path, err := blocklistPath()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// AddBlock blocks a peer, block.Peer being its node ID, IP address or CIDR
+// range
+func AddBlock(block Block) error {
+	block.Peer = strings.TrimSpace(block.Peer)
+	if block.Peer == "" {
+		return errors.New("nothing to block")
+	}
+	blocklistMutex.Lock()
+	defer blocklistMutex.Unlock()
+	list, err := LoadBlocklist()
+	if err != nil {
+		return err
+	}
+	for _, blocked := range list {
+		if strings.EqualFold(blocked.Peer, block.Peer) {
+			return fmt.Errorf("%s is already blocked", block.Peer)
+		}
+	}
+	if block.Added.IsZero() {
+		block.Added = time.Now()
+	}
+	return saveBlocklist(append(list, block))
+}
+
+// RemoveBlock unblocks the peer blocked as peer, a node ID, IP address or
+// CIDR range, or one whose node ID was blocked under the name peer
+func RemoveBlock(peer string) (Block, error) {
+	blocklistMutex.Lock()
+	defer blocklistMutex.Unlock()
+	list, err := LoadBlocklist()
+	if err != nil {
+		return Block{}, err
+	}
+	for i, blocked := range list {
+		if strings.EqualFold(blocked.Peer, peer) || (blocked.Name != "" && strings.EqualFold(blocked.Name, peer)) {
+			return blocked, saveBlocklist(append(list[:i], list[i+1:]...))
+		}
+	}
+	return Block{}, fmt.Errorf("%s is not blocked", peer)
+}
+
+// Match returns the entry blocking the node nodeID at address, either of
+// which may be empty, or nil when it isn't blocked
+func (l Blocklist) Match(nodeID, address string) *Block {
+	ip := parseHost(address)
+	for i, blocked := range l {
+		if nodeID != "" && blocked.Peer == nodeID {
+			return &l[i]
+		}
+		if ip == nil {
+			continue
+		}
+		if network, err := ParseEntry(blocked.Peer); err == nil {
+			if network.Contains(ip) {
+				return &l[i]
+			}
+			continue
+		}
+		for _, seen := range blocked.Addresses {
+			if seenIP := parseHost(seen); seenIP != nil && seenIP.Equal(ip) {
+				return &l[i]
+			}
+		}
+	}
+	return nil
+}
+
+// IsBlocked reports whether the node nodeID at address is blocked, either
+// of which may be empty. A blocked node ID seen at a new address has the
+// address added to its entry.
+func IsBlocked(nodeID, address string) bool {
+	list, err := LoadBlocklist()
+	if err != nil || len(list) == 0 {
+		return false
+	}
+	blocked := list.Match(nodeID, address)
+	if blocked == nil {
+		return false
+	}
+	if blocked.Peer == nodeID && parseHost(address) != nil && !slices.Contains(blocked.Addresses, address) {
+		noteBlockedAddress(nodeID, address)
+	}
+	return true
+}
+
+// RefuseBlocked returns why a connection from addr is refused when it is
+// blocked, counting the attempt, or nil if it isn't
+func RefuseBlocked(addr net.Addr) error {
+	ip := addrIP(addr)
+	if ip == nil {
+		return nil
+	}
+	return refuseBlocked("", ip.String())
+}
+
+// RefuseBlockedNode is RefuseBlocked for a connection from the node nodeID,
+// such as a session through a relay
+func RefuseBlockedNode(nodeID string) error {
+	return refuseBlocked(nodeID, "")
+}
+
+func refuseBlocked(nodeID, address string) error {
+	blocklistMutex.Lock()
+	defer blocklistMutex.Unlock()
+	list, err := LoadBlocklist()
+	if err != nil || len(list) == 0 {
+		return nil
+	}
+	blocked := list.Match(nodeID, address)
+	if blocked == nil {
+		return nil
+	}
+	blocked.Attempts++
+	blocked.LastAttempt = time.Now()
+	saveBlocklist(list)
+	return fmt.Errorf("blocked (%s)", blocked.Peer)
+}
+
+// noteBlockedAddress remembers that the blocked node nodeID was seen at address
+func noteBlockedAddress(nodeID, address string) {
+	blocklistMutex.Lock()
+	defer blocklistMutex.Unlock()
+	list, err := LoadBlocklist()
+	if err != nil {
+		return
+	}
+	for i := range list {
+		if list[i].Peer == nodeID {
+			addresses := []string{address}
+			for _, seen := range list[i].Addresses {
+				if seen != address && len(addresses) < maxBlockedAddresses {
+					addresses = append(addresses, seen)
+				}
+			}
+			list[i].Addresses = addresses
+			saveBlocklist(list)
+			return
+		}
+	}
+}
+
+// parseHost returns the IP address of a host, an IPv6 zone left out, or nil
+func parseHost(host string) net.IP {
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		host = host[:i]
+	}
+	return net.ParseIP(host)
+}
+
+func blocklistPath() (string, error) {
+	dir, err := utils.DataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, blocklistFile), nil
+}
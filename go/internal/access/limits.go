@@ -0,0 +1,76 @@
+package access
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// Connection limits
+//
+// Listeners take a bounded number of connections at once, in total and from
+// any one address, so a misbehaving peer or a port scan can't make them
+// start goroutines and open file handles without end. A connection over a
+// limit is turned away as soon as it is accepted.
+
+// Errors Limiter.Acquire returns for a connection over a limit
+var (
+	ErrTooManyConnections = errors.New("too many connections, try again later")
+	ErrTooManyFromAddress = errors.New("too many connections from your address, try again later")
+)
+
+// Limiter counts the open connections of a listener against its limits
+type Limiter struct {
+	mutex    sync.Mutex
+	max      int // 0 for no limit
+	maxPerIP int // 0 for no limit
+	open     int
+	perIP    map[string]int
+}
+
+// NewLimiter returns a Limiter allowing max connections at once and maxPerIP
+// from any one address. Zero means no limit.
+func NewLimiter(max, maxPerIP int) *Limiter {
+	return &Limiter{max: max, maxPerIP: maxPerIP, perIP: make(map[string]int)}
+}
+
+// Acquire counts a connection from addr, returning a function that stops
+// counting it once it is closed, or an error if it would go over a limit
+func (l *Limiter) Acquire(addr net.Addr) (func(), error) {
+	key := addr.String()
+	if ip := addrIP(addr); ip != nil {
+		key = ip.String()
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.max > 0 && l.open >= l.max {
+		return nil, ErrTooManyConnections
+	}
+	if l.maxPerIP > 0 && l.perIP[key] >= l.maxPerIP {
+		return nil, ErrTooManyFromAddress
+	}
+	l.open++
+	l.perIP[key]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mutex.Lock()
+			defer l.mutex.Unlock()
+			l.open--
+			if l.perIP[key]--; l.perIP[key] <= 0 {
+				delete(l.perIP, key)
+			}
+		})
+	}, nil
+}
+
+// Stats returns how many connections are open and how many are allowed at
+// once, 0 for no limit
+func (l *Limiter) Stats() (open, max int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.open, l.max
+}
@@ -0,0 +1,496 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"fileshare/internal/mesh"
+	"fileshare/internal/p2p"
+	"fileshare/internal/transfer"
+	"fileshare/internal/utils"
+)
+
+// Configuration file
+//
+// config.json in the data directory sets what the mesh node starts with and
+// the defaults of transfers. It is JSON where lines starting with // are
+// comments, as in the template 'config init' writes. Settings left out keep
+// their built-in defaults, and command-line flags override the file. Sizes
+// are written like "10GB" and durations like "5m".
+
+const fileName = "config.json"
+
+// Settings is everything config.json can set
+type Settings struct {
+	NodeName          string   `json:"node_name"`
+	ListenPort        int      `json:"listen_port"`
+	WiFiDirect        bool     `json:"wifi_direct"`
+	Bluetooth         bool     `json:"bluetooth"`
+	TCP               bool     `json:"tcp"`
+	MDNS              bool     `json:"mdns"`
+	Discovery         string   `json:"discovery"`
+	MulticastTTL      int      `json:"multicast_ttl"`
+	Relay             bool     `json:"relay"`
+	PeerExchange      bool     `json:"peer_exchange"`
+	Network           string   `json:"network"`
+	NetworkPassphrase string   `json:"network_passphrase"`
+	RelayServers      []string `json:"relay_servers"`
+	RelayToken        string   `json:"relay_token"`
+	STUNServers       []string `json:"stun_servers"`
+	PublicIPServices  []string `json:"public_ip_services"`
+	Offline           bool     `json:"offline"`
+	DataDir           string   `json:"data_dir"`
+	OfflineAfter      Duration `json:"offline_after"`
+	ForgetAfter       Duration `json:"forget_after"`
+	HeartbeatInterval Duration `json:"heartbeat_interval"`
+	HeartbeatMisses   int      `json:"heartbeat_misses"`
+	KeepaliveInterval Duration `json:"keepalive_interval"`
+	KeepaliveMisses   int      `json:"keepalive_misses"`
+	ReconnectAttempts int      `json:"reconnect_attempts"`
+	PlaintextPeers    bool     `json:"plaintext_peers"`
+
+	Transfer TransferSettings `json:"transfer"`
+}
+
+// TransferSettings are the defaults of sends and receivers
+type TransferSettings struct {
+	MaxFileSize      Size   `json:"max_file_size"` // 0 for unlimited
+	OnExists         string `json:"on_exists"`     // One of the transfer.Collision policies
+	ChunkSize        Size   `json:"chunk_size"`
+	Parallelism      int    `json:"parallelism"`
+	Compress         bool   `json:"compress"`
+	PreserveMetadata bool   `json:"preserve_metadata"`
+	Resume           bool   `json:"resume"`
+	TLS              bool   `json:"tls"`
+}
+
+// Defaults returns the settings used when there is no config.json
+func Defaults() Settings {
+	options := transfer.DefaultTransferOptions()
+	return Settings{
+		NodeName:          utils.GenerateNodeName(),
+		ListenPort:        9000,
+		WiFiDirect:        true,
+		Bluetooth:         true,
+		TCP:               true,
+		MDNS:              true,
+		Discovery:         p2p.DiscoveryBoth,
+		MulticastTTL:      p2p.DefaultMulticastTTL,
+		Relay:             true,
+		PeerExchange:      true,
+		OfflineAfter:      Duration(mesh.DefaultOfflineAfter),
+		ForgetAfter:       Duration(mesh.DefaultForgetAfter),
+		HeartbeatInterval: Duration(mesh.DefaultHeartbeatInterval),
+		HeartbeatMisses:   mesh.DefaultHeartbeatMisses,
+		KeepaliveInterval: Duration(p2p.DefaultKeepaliveInterval),
+		KeepaliveMisses:   p2p.DefaultKeepaliveMisses,
+		ReconnectAttempts: p2p.DefaultReconnectAttempts,
+		Transfer: TransferSettings{
+			MaxFileSize:      Size(options.MaxFileSize),
+			OnExists:         options.CollisionPolicy,
+			ChunkSize:        Size(options.ChunkSize),
+			Parallelism:      options.Parallelism,
+			Compress:         options.CompressData,
+			PreserveMetadata: options.PreserveMetadata,
+			Resume:           options.Resume,
+			TLS:              options.TLS,
+		},
+	}
+}
+
+// Path returns where config.json is
+func Path() (string, error) {
+	dir, err := utils.DataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, fileName), nil
+}
+
+// Load reads config.json over the defaults. No file means the defaults.
+func Load() (Settings, error) {
+	settings := Defaults()
+	path, err := Path()
+	if err != nil {
+		return settings, err
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return settings, nil
+	}
+	if err != nil {
+		return settings, err
+	}
+
+	data = stripComments(data)
+	if err := json.Unmarshal(data, &settings); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			return settings, fmt.Errorf("invalid %s, line %d: %v", path, lineAt(data, syntaxErr.Offset), err)
+		}
+		return settings, fmt.Errorf("invalid %s: %v", path, err)
+	}
+	if err := settings.Validate(); err != nil {
+		return settings, fmt.Errorf("invalid %s: %v", path, err)
+	}
+	return settings, nil
+}
+
+// Validate rejects settings the node can't start or transfer with
+func (s Settings) Validate() error {
+	if strings.TrimSpace(s.NodeName) == "" {
+		return errors.New("node_name can't be empty, leave it out to use the computer's name")
+	}
+	// The TCP service and its discovery channel take ports above it
+	maxListenPort := 65535 - mesh.ServicePort(0) - 1
+	if s.ListenPort < 1 || s.ListenPort > maxListenPort {
+		return fmt.Errorf("listen_port must be between 1 and %d, not %d", maxListenPort, s.ListenPort)
+	}
+	switch s.Discovery {
+	case p2p.DiscoveryBroadcast, p2p.DiscoveryMulticast, p2p.DiscoveryBoth:
+	default:
+		return fmt.Errorf("discovery must be broadcast, multicast or both, not %q", s.Discovery)
+	}
+	if s.MulticastTTL < 1 || s.MulticastTTL > p2p.MaxMulticastTTL {
+		return fmt.Errorf("multicast_ttl must be between 1 and %d, not %d", p2p.MaxMulticastTTL, s.MulticastTTL)
+	}
+	for _, server := range s.RelayServers {
+		if _, port, err := net.SplitHostPort(server); err != nil || port == "" {
+			return fmt.Errorf("relay server %q needs a host and port, e.g. relay.example.com:9100", server)
+		}
+	}
+	for _, server := range s.STUNServers {
+		if _, port, err := net.SplitHostPort(server); err != nil || port == "" {
+			return fmt.Errorf("STUN server %q needs a host and port, e.g. stun.example.com:3478", server)
+		}
+	}
+	for _, service := range s.PublicIPServices {
+		if u, err := url.Parse(service); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("public IP service %q needs to be an http or https URL, e.g. https://api.ipify.org", service)
+		}
+	}
+	if s.Network != "" && s.NetworkPassphrase == "" {
+		return fmt.Errorf("network %q needs a network_passphrase", s.Network)
+	}
+	if s.OfflineAfter > 0 && s.ForgetAfter > 0 && s.ForgetAfter < s.OfflineAfter {
+		return fmt.Errorf("forget_after (%v) can't be shorter than offline_after (%v)", time.Duration(s.ForgetAfter), time.Duration(s.OfflineAfter))
+	}
+	if s.HeartbeatMisses < 1 {
+		return fmt.Errorf("heartbeat_misses must be at least 1, not %d", s.HeartbeatMisses)
+	}
+	if s.KeepaliveMisses < 1 {
+		return fmt.Errorf("keepalive_misses must be at least 1, not %d", s.KeepaliveMisses)
+	}
+	if s.ReconnectAttempts == 0 || s.ReconnectAttempts < -1 {
+		return fmt.Errorf("reconnect_attempts must be at least 1, or -1 for never, not %d", s.ReconnectAttempts)
+	}
+
+	t := s.Transfer
+	if t.MaxFileSize < 0 {
+		return errors.New("transfer.max_file_size can't be negative, use 0 for unlimited")
+	}
+	if !transfer.ValidCollisionPolicy(t.OnExists) {
+		return fmt.Errorf("transfer.on_exists must be overwrite, rename, skip or fail, not %q", t.OnExists)
+	}
+	if t.ChunkSize < 1 {
+		return errors.New("transfer.chunk_size must be at least 1 byte")
+	}
+	if t.Parallelism < 1 {
+		return fmt.Errorf("transfer.parallelism must be at least 1, not %d", t.Parallelism)
+	}
+	return nil
+}
+
+// MeshConfig returns the mesh node configuration the settings describe
+func (s Settings) MeshConfig() mesh.Config {
+	return mesh.Config{
+		NodeName:            s.NodeName,
+		ListenPort:          s.ListenPort,
+		EnableWiFiDirect:    s.WiFiDirect,
+		EnableBluetooth:     s.Bluetooth,
+		EnableTCP:           s.TCP,
+		EnableMDNS:          s.MDNS,
+		DiscoveryMode:       s.Discovery,
+		MulticastTTL:        s.MulticastTTL,
+		EnableRelay:         s.Relay,
+		EnablePeerExchange:  s.PeerExchange,
+		Network:             s.Network,
+		NetworkPassphrase:   s.NetworkPassphrase,
+		RelayServers:        s.RelayServers,
+		RelayToken:          s.RelayToken,
+		STUNServers:         s.STUNServers,
+		PublicIPServices:    s.PublicIPServices,
+		Offline:             s.Offline,
+		DataDir:             s.DataDir,
+		OfflineAfter:        time.Duration(s.OfflineAfter),
+		ForgetAfter:         time.Duration(s.ForgetAfter),
+		HeartbeatInterval:   time.Duration(s.HeartbeatInterval),
+		HeartbeatMisses:     s.HeartbeatMisses,
+		KeepaliveInterval:   time.Duration(s.KeepaliveInterval),
+		KeepaliveMisses:     s.KeepaliveMisses,
+		ReconnectAttempts:   s.ReconnectAttempts,
+		AllowPlaintextPeers: s.PlaintextPeers,
+	}
+}
+
+// TransferOptions returns the default transfer options with the settings applied
+func (s Settings) TransferOptions() transfer.TransferOptions {
+	options := transfer.DefaultTransferOptions()
+	options.MaxFileSize = int64(s.Transfer.MaxFileSize)
+	options.CollisionPolicy = s.Transfer.OnExists
+	options.ChunkSize = int64(s.Transfer.ChunkSize)
+	options.Parallelism = s.Transfer.Parallelism
+	options.CompressData = s.Transfer.Compress
+	options.PreserveMetadata = s.Transfer.PreserveMetadata
+	options.Resume = s.Transfer.Resume
+	options.TLS = s.Transfer.TLS
+	return options
+}
+
+// ApplyFlags sets what the node flags in args say, overriding the file, and
+// returns the other arguments: --name <name>, --port <port>, --data-dir <dir>,
+// --relay, --no-relay and --offline
+func (s *Settings) ApplyFlags(args []string) ([]string, error) {
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch arg {
+		case "--relay", "--no-relay":
+			s.Relay = arg == "--relay"
+			continue
+		case "--offline":
+			s.Offline = true
+			continue
+		case "--allow-plaintext":
+			s.PlaintextPeers = true
+			continue
+		case "--name", "--port", "--data-dir":
+		default:
+			rest = append(rest, arg)
+			continue
+		}
+
+		if i+1 >= len(args) {
+			return nil, fmt.Errorf("%s needs a value", arg)
+		}
+		i++
+		value := args[i]
+		switch arg {
+		case "--name":
+			s.NodeName = value
+		case "--port":
+			port, err := strconv.Atoi(value)
+			if err != nil || port < 1 || port > 65535 {
+				return nil, fmt.Errorf("--port needs a number between 1 and 65535, got %q", value)
+			}
+			s.ListenPort = port
+		case "--data-dir":
+			s.DataDir = value
+		}
+	}
+	return rest, s.Validate()
+}
+
+// WriteTemplate writes a commented config.json holding the defaults and
+// returns its path. An existing file is only replaced when overwrite is set.
+func WriteTemplate(overwrite bool) (string, error) {
+	path, err := Path()
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(path); err == nil && !overwrite {
+		return path, fmt.Errorf("%s already exists", path)
+	}
+
+	d := Defaults()
+	template := fmt.Sprintf(`// BitShare configuration. Lines starting with // are comments.
+// Remove a setting to use its default; command-line flags override them.
+{
+  // Name other peers see, the computer's name when left out
+  // "node_name": %q,
+
+  // Port of the mesh node; its TCP service takes the two ports above it
+  "listen_port": %d,
+
+  // Ways to reach peers
+  "wifi_direct": %t,
+  "bluetooth": %t,
+  "tcp": %t,
+
+  // Find peers with multicast DNS as well as UDP broadcast, which many
+  // enterprise and guest networks block
+  "mdns": %t,
+
+  // How UDP discovery goes out: "broadcast", "multicast" to a group the
+  // nodes join, which gets through networks that filter broadcasts, or
+  // "both". multicast_ttl is how many routers it may cross, 1 to 4.
+  "discovery": %q,
+  "multicast_ttl": %d,
+
+  // Relay servers reach peers that can't be reached directly, as host:port.
+  // Empty means the public BitShare relays. relay_token is presented to
+  // relays that only serve known nodes.
+  "relay": %t,
+  "relay_servers": [],
+  "relay_token": "",
+
+  // Share the peers this node has seen with the nodes it is connected to,
+  // and learn theirs, so nodes far apart in the mesh find each other. Turn
+  // it off to keep who this node has seen private.
+  "peer_exchange": %t,
+
+  // A private network: only nodes with the same name and passphrase see
+  // each other. Leave the name empty for the public network.
+  "network": "",
+  "network_passphrase": "",
+
+  // STUN servers tell the node its public address and the kind of NAT it is
+  // behind, as host:port. Empty means the public servers BitShare knows.
+  "stun_servers": [],
+
+  // Web services that answer with the public address, tried in order. Empty
+  // means api.ipify.org and icanhazip.com.
+  "public_ip_services": [],
+
+  // Offline mode skips the STUN and public IP lookups, for networks without
+  // internet access or when the node shouldn't contact outside services
+  "offline": false,
+
+  // Where the node keeps its state, empty for the default directory
+  "data_dir": "",
+
+  // How long a peer may go unseen before it is marked offline and before it
+  // is forgotten unless pinned, e.g. "90s", "5m", "24h"; "-1s" means never
+  "offline_after": %q,
+  "forget_after": %q,
+
+  // How often online peers are checked on, "-1s" for never, and how many
+  // checks in a row they may miss before they are marked offline
+  "heartbeat_interval": %q,
+  "heartbeat_misses": %d,
+
+  // How long a connection between nodes may stay quiet before it is
+  // pinged, "-1s" for never, and how many of those intervals in a row it
+  // may go unanswered before it is closed
+  "keepalive_interval": %q,
+  "keepalive_misses": %d,
+
+  // How many times a dropped connection to another node is tried again,
+  // waiting longer each time, up to 30 seconds; -1 for never
+  "reconnect_attempts": %d,
+
+  // Connections between nodes are encrypted. Releases before encryption
+  // can't, and are only talked to while this is on, or with --allow-plaintext;
+  // a node that has encrypted once is never talked to in plain again.
+  "plaintext_peers": %t,
+
+  // Defaults of sends and receivers
+  "transfer": {
+    // Largest file a receiver takes, e.g. "50GB"; "0" for unlimited
+    "max_file_size": %q,
+
+    // What a receiver does with a file that already exists: overwrite,
+    // rename, skip or fail
+    "on_exists": %q,
+
+    "chunk_size": %q,
+    "parallelism": %d,
+    "compress": %t,
+    "preserve_metadata": %t,
+    "resume": %t,
+    "tls": %t
+  }
+}
+`, d.NodeName, d.ListenPort, d.WiFiDirect, d.Bluetooth, d.TCP, d.MDNS, d.Discovery, d.MulticastTTL, d.Relay, d.PeerExchange,
+		d.OfflineAfter, d.ForgetAfter, d.HeartbeatInterval, d.HeartbeatMisses, d.KeepaliveInterval, d.KeepaliveMisses, d.ReconnectAttempts, d.PlaintextPeers,
+		d.Transfer.MaxFileSize, d.Transfer.OnExists, d.Transfer.ChunkSize, d.Transfer.Parallelism,
+		d.Transfer.Compress, d.Transfer.PreserveMetadata, d.Transfer.Resume, d.Transfer.TLS)
+
+	return path, os.WriteFile(path, []byte(template), 0644)
+}
+
+// stripComments blanks the comment lines, keeping the line count so errors
+// point at the right line
+func stripComments(data []byte) []byte {
+	lines := bytes.Split(data, []byte("\n"))
+	for i, line := range lines {
+		if bytes.HasPrefix(bytes.TrimSpace(line), []byte("//")) {
+			lines[i] = nil
+		}
+	}
+	return bytes.Join(lines, []byte("\n"))
+}
+
+// lineAt returns the line of data that offset falls on
+func lineAt(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+// Duration is a time.Duration written like "5m"
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return fmt.Errorf("durations are written like \"5m\" or \"24h\", got %s", data)
+	}
+	value, err := time.ParseDuration(text)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q, e.g. \"90s\", \"5m\" or \"24h\"", text)
+	}
+	*d = Duration(value)
+	return nil
+}
+
+// Size is a number of bytes written like "10GB"
+type Size int64
+
+func (s Size) String() string {
+	if s == 0 {
+		return "0"
+	}
+	return utils.FormatBytes(int64(s))
+}
+
+func (s Size) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+func (s *Size) UnmarshalJSON(data []byte) error {
+	var number int64
+	if err := json.Unmarshal(data, &number); err == nil {
+		*s = Size(number)
+		return nil
+	}
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return fmt.Errorf("sizes are written like \"700MB\" or \"10GB\", got %s", data)
+	}
+	value, err := utils.ParseBytes(text)
+	if err != nil {
+		return err
+	}
+	*s = Size(value)
+	return nil
+}
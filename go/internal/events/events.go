@@ -0,0 +1,160 @@
+// Package events writes a machine-readable stream of what BitShare is doing,
+// one JSON object per line, for programs that wrap the command line tool.
+//
+// Every event carries the schema version "v" and a "type":
+//
+//	progress  bytes_done, total, rate, average_rate, eta_seconds, label, peer
+//	state     state, file, peer, error - see the transfer.State constants
+//	prompt    id, kind, message, options - answered on stdin with {"id": ..., "answer": ...}
+//	result    command, state ("ok", "failed" or "cancelled"), error
+//	peer      state ("online", "offline" or "forgotten"), peer (its ID), name
+//
+// Fields are only added within a schema version; renaming or removing one
+// bumps SchemaVersion.
+package events
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SchemaVersion is the version of the event format
+const SchemaVersion = 1
+
+// Event types
+const (
+	TypeProgress = "progress"
+	TypeState    = "state"
+	TypePrompt   = "prompt"
+	TypeResult   = "result"
+	TypePeer     = "peer"
+)
+
+// Event is one line of the stream. Only the fields relevant to the type are set.
+type Event struct {
+	V    int       `json:"v"`
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+
+	// progress
+	Label       string  `json:"label,omitempty"`
+	BytesDone   int64   `json:"bytes_done,omitempty"`
+	Total       int64   `json:"total,omitempty"`
+	Rate        int64   `json:"rate,omitempty"`
+	AverageRate int64   `json:"average_rate,omitempty"`
+	ETASeconds  float64 `json:"eta_seconds,omitempty"`
+
+	// state and result
+	Command string `json:"command,omitempty"`
+	State   string `json:"state,omitempty"`
+	File    string `json:"file,omitempty"`
+	Peer    string `json:"peer,omitempty"`
+	Error   string `json:"error,omitempty"`
+
+	// peer
+	Name string `json:"name,omitempty"`
+
+	// prompt
+	ID      string   `json:"id,omitempty"`
+	Kind    string   `json:"kind,omitempty"`
+	Message string   `json:"message,omitempty"`
+	Options []string `json:"options,omitempty"`
+}
+
+// Response answers a prompt. Answer is one of the prompt's options; Value
+// carries extra input such as the new name for a "rename" answer.
+type Response struct {
+	ID     string `json:"id"`
+	Answer string `json:"answer"`
+	Value  string `json:"value,omitempty"`
+}
+
+var (
+	output      io.Writer
+	outputMutex sync.Mutex
+
+	responses    *bufio.Reader
+	promptMutex  sync.Mutex
+	nextPromptID = 1
+)
+
+// Enable starts writing events to w and reading prompt answers from stdin
+func Enable(w io.Writer) {
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+
+	output = w
+	responses = bufio.NewReader(os.Stdin)
+}
+
+// Enabled reports whether an event stream has been requested
+func Enabled() bool {
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+
+	return output != nil
+}
+
+// Emit writes an event, filling in the version and time. It does nothing
+// unless the stream is enabled.
+func Emit(event Event) {
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+
+	if output == nil {
+		return
+	}
+
+	event.V = SchemaVersion
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	output.Write(append(data, '\n'))
+}
+
+// Prompt emits a prompt event and waits for its answer on stdin. Lines that
+// are not valid responses, or answer another prompt, are skipped. If stdin
+// closes, the first option is taken as the answer.
+func Prompt(kind, message string, options []string) (Response, error) {
+	promptMutex.Lock()
+	defer promptMutex.Unlock()
+
+	if !Enabled() {
+		return Response{}, fmt.Errorf("no event stream to prompt on")
+	}
+	if len(options) == 0 {
+		return Response{}, fmt.Errorf("prompt %q has no options", kind)
+	}
+
+	id := strconv.Itoa(nextPromptID)
+	nextPromptID++
+	Emit(Event{Type: TypePrompt, ID: id, Kind: kind, Message: message, Options: options})
+
+	for {
+		line, err := responses.ReadBytes('\n')
+		if err != nil {
+			return Response{ID: id, Answer: options[0]}, nil
+		}
+
+		var response Response
+		if json.Unmarshal(line, &response) != nil || response.ID != id {
+			continue
+		}
+		for _, option := range options {
+			if response.Answer == option {
+				return response, nil
+			}
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package events
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// eventTime is the time of every event in the golden files
+var eventTime = time.Date(2026, 10, 16, 14, 30, 0, 0, time.UTC)
+
+// capture sends the event stream to a buffer for the rest of the test
+func capture(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buffer bytes.Buffer
+	Enable(&buffer)
+	t.Cleanup(func() {
+		outputMutex.Lock()
+		output, responses = nil, nil
+		outputMutex.Unlock()
+	})
+	return &buffer
+}
+
+// checkGolden compares got with testdata/<name>.golden
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name+".golden")
+	if *update {
+		if err := os.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run go test -update to create it)", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("events differ from %s\ngot:\n%s\nwant:\n%s", path, got, want)
+	}
+}
+
+func TestEmitGolden(t *testing.T) {
+	tests := []struct {
+		name   string
+		events []Event
+	}{
+		{"progress", []Event{
+			{Type: TypeProgress, Label: "video.mp4", Peer: "192.168.1.20:8080", BytesDone: 1 << 20, Total: 4 << 20, Rate: 524288, AverageRate: 400000, ETASeconds: 6.5},
+			{Type: TypeProgress, Label: "video.mp4", Peer: "192.168.1.20:8080", BytesDone: 4 << 20, Total: 4 << 20, Rate: 600000, AverageRate: 450000},
+		}},
+		{"state", []Event{
+			{Type: TypeState, State: "sending", File: "notes.txt", Peer: "192.168.1.20:8080"},
+			{Type: TypeState, State: "file_failed", File: "notes.txt", Peer: "192.168.1.20:8080", Error: "connection reset by peer"},
+		}},
+		{"result", []Event{
+			{Type: TypeResult, Command: "send", State: "ok"},
+			{Type: TypeResult, Command: "receive", State: "cancelled"},
+		}},
+		{"peer", []Event{
+			{Type: TypePeer, State: "online", Peer: "a1b2c3d4e5f6", Name: "laptop"},
+		}},
+		{"unicode and escapes", []Event{
+			{Type: TypeState, State: "file_done", File: "résumé \"final\"<1>.pdf"},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buffer := capture(t)
+			for _, event := range test.events {
+				event.Time = eventTime
+				Emit(event)
+			}
+			checkGolden(t, strings.ReplaceAll(test.name, " ", "_"), buffer.Bytes())
+
+			// Every line stands alone and carries the schema version
+			for _, line := range bytes.Split(bytes.TrimSuffix(buffer.Bytes(), []byte("\n")), []byte("\n")) {
+				var decoded map[string]interface{}
+				if err := json.Unmarshal(line, &decoded); err != nil {
+					t.Fatalf("line %q: %v", line, err)
+				}
+				if decoded["v"] != float64(SchemaVersion) {
+					t.Errorf("line %q has version %v, want %d", line, decoded["v"], SchemaVersion)
+				}
+			}
+		})
+	}
+}
+
+func TestEmitDisabled(t *testing.T) {
+	Emit(Event{Type: TypeProgress, BytesDone: 1, Total: 2})
+	if Enabled() {
+		t.Fatal("stream enabled without Enable")
+	}
+}
+
+func TestPromptGolden(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  Response
+	}{
+		{"answered", `{"id": "1", "answer": "reject"}` + "\n", Response{ID: "1", Answer: "reject"}},
+		{"renamed", `{"id": "1", "answer": "rename", "value": "other.txt"}` + "\n", Response{ID: "1", Answer: "rename", Value: "other.txt"}},
+		{"skips other prompts and bad lines", "not json\n" + `{"id": "7", "answer": "reject"}` + "\n" + `{"id": "1", "answer": "maybe"}` + "\n" + `{"id": "1", "answer": "accept"}` + "\n", Response{ID: "1", Answer: "accept"}},
+		{"stdin closed", "", Response{ID: "1", Answer: "accept"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buffer := capture(t)
+			responses = bufio.NewReader(strings.NewReader(test.input))
+			promptMutex.Lock()
+			nextPromptID = 1
+			promptMutex.Unlock()
+
+			response, err := Prompt("accept", "Accept notes.txt (2.0 KB) from 192.168.1.20:8080?", []string{"accept", "reject", "rename"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response != test.want {
+				t.Errorf("got %+v, want %+v", response, test.want)
+			}
+
+			// The time is the only field that changes between runs
+			var event Event
+			if err := json.Unmarshal(buffer.Bytes(), &event); err != nil {
+				t.Fatal(err)
+			}
+			event.Time = eventTime
+			golden, _ := json.Marshal(event)
+			checkGolden(t, "prompt", append(golden, '\n'))
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package mesh
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"fileshare/internal/utils"
+)
+
+// Peer aliases
+//
+// Peers are named after their hostnames, which are often meaningless. An
+// alias is a local name for a peer, kept by ID in aliases.json in the data
+// directory so it survives restarts and follows the peer to new addresses.
+// FindPeerByIdOrName tries aliases before IDs and names, so an alias wins
+// over a peer that happens to be named the same. Each peer has at most one
+// alias; giving it another replaces the first.
+
+const aliasesFile = "aliases.json"
+
+var (
+	aliases      map[string]string // Peer ID by alias, nil until loaded
+	aliasesMutex sync.Mutex
+)
+
+// SetAlias gives the peer idOrName refers to the local name alias. It also
+// returns the other known peers whose name or ID is alias, which the alias
+// now shadows.
+func SetAlias(idOrName, alias string) (peer Peer, shadowed []Peer, err error) {
+	alias = strings.TrimSpace(alias)
+	if err := validAlias(alias); err != nil {
+		return Peer{}, nil, err
+	}
+	found, err := FindPeerByIdOrName(idOrName)
+	if err != nil {
+		return Peer{}, nil, err
+	}
+
+	peersMutex.RLock()
+	peer = *found
+	for _, known := range knownPeers {
+		if known.ID != peer.ID && (strings.EqualFold(known.Name, alias) || strings.EqualFold(known.ID, alias)) {
+			shadowed = append(shadowed, *known)
+		}
+	}
+	peersMutex.RUnlock()
+
+	aliasesMutex.Lock()
+	defer aliasesMutex.Unlock()
+	loadAliasesLocked()
+	for name, id := range aliases {
+		if id == peer.ID || strings.EqualFold(name, alias) {
+			delete(aliases, name)
+		}
+	}
+	aliases[alias] = peer.ID
+	return peer, shadowed, saveAliasesLocked()
+}
+
+// DeleteAlias removes an alias, the peer goes by its own name again
+func DeleteAlias(alias string) error {
+	aliasesMutex.Lock()
+	defer aliasesMutex.Unlock()
+	loadAliasesLocked()
+	for name := range aliases {
+		if strings.EqualFold(name, alias) {
+			delete(aliases, name)
+			return saveAliasesLocked()
+		}
+	}
+	return fmt.Errorf("no alias named '%s'", alias)
+}
+
+// Aliases returns the peer IDs by alias
+func Aliases() map[string]string {
+	aliasesMutex.Lock()
+	defer aliasesMutex.Unlock()
+	loadAliasesLocked()
+	result := make(map[string]string, len(aliases))
+	for name, id := range aliases {
+		result[name] = id
+	}
+	return result
+}
+
+// AliasOf returns the alias of the peer with the given ID, or "" when it has none
+func AliasOf(id string) string {
+	aliasesMutex.Lock()
+	defer aliasesMutex.Unlock()
+	loadAliasesLocked()
+	for name, aliasedID := range aliases {
+		if aliasedID == id {
+			return name
+		}
+	}
+	return ""
+}
+
+// aliasedID returns the ID of the peer alias refers to
+func aliasedID(alias string) (string, bool) {
+	aliasesMutex.Lock()
+	defer aliasesMutex.Unlock()
+	loadAliasesLocked()
+	for name, id := range aliases {
+		if strings.EqualFold(name, alias) {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// moveAlias hands the alias of a peer that came back under a new ID to
+// that ID
+func moveAlias(oldID, newID string) {
+	aliasesMutex.Lock()
+	defer aliasesMutex.Unlock()
+	loadAliasesLocked()
+	for name, id := range aliases {
+		if id == oldID {
+			aliases[name] = newID
+			if err := saveAliasesLocked(); err != nil {
+				fmt.Printf("⚠️ Could not save aliases: %v\n", err)
+			}
+			return
+		}
+	}
+}
+
+// validAlias rejects aliases that would be read as something else
+func validAlias(alias string) error {
+	switch {
+	case alias == "":
+		return errors.New("alias is empty")
+	case strings.ContainsAny(alias, " \t"):
+		return fmt.Errorf("alias '%s' has spaces", alias)
+	case IsHandle(alias):
+		return fmt.Errorf("alias '%s' would be read as a display handle", alias)
+	}
+	if _, isIP := utils.ParseIPHost(alias); isIP {
+		return fmt.Errorf("alias '%s' would be read as an IP address", alias)
+	}
+	return nil
+}
+
+// reloadAliases drops the aliases in memory so they are read again, from
+// the node's data directory once it is configured
+func reloadAliases() {
+	aliasesMutex.Lock()
+	defer aliasesMutex.Unlock()
+	aliases = nil
+	loadAliasesLocked()
+}
+
+// loadAliasesLocked reads the aliases unless they are already loaded, with
+// aliasesMutex held
+func loadAliasesLocked() {
+	if aliases != nil {
+		return
+	}
+	aliases = make(map[string]string)
+	dir, err := dataDir()
+	if err != nil {
+		return
+	}
+	path := filepath.Join(dir, aliasesFile)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Printf("⚠️ Could not read aliases: %v\n", err)
+		}
+		return
+	}
+	if err := json.Unmarshal(data, &aliases); err != nil {
+		fmt.Printf("⚠️ Aliases file is corrupt, starting without it (%v)\n", err)
+		os.Rename(path, path+".corrupt")
+		aliases = make(map[string]string)
+	}
+}
+
+// saveAliasesLocked writes the aliases, with aliasesMutex held
+func saveAliasesLocked() error {
+	dir, err := dataDir()
+	if err != nil {
+		return err
+	}
+	return writeJSONFile(filepath.Join(dir, aliasesFile), aliases)
+}
@@ -0,0 +1,99 @@
+package mesh
+
+import (
+	"fmt"
+
+	"fileshare/internal/access"
+)
+
+// Blocked peers
+//
+// BlockPeer keeps a peer out of the mesh, see access.Blocklist: it is
+// forgotten at once, and from then on dropped whenever discovery, an
+// announcement, a peer exchange or the routing brings it up again.
+// ConnectToPeer refuses it, and sessions it starts through a relay are
+// turned away.
+
+// BlockPeer blocks peer, a known peer or an IP address or CIDR range, and
+// returns what was blocked
+func BlockPeer(peer string) (access.Block, error) {
+	block := access.Block{Peer: peer}
+	var blocked []*Peer
+	if _, err := access.ParseEntry(peer); err != nil {
+		found, err := FindPeerByIdOrName(peer)
+		if err != nil {
+			return access.Block{}, err
+		}
+		peersMutex.RLock()
+		block = access.Block{Peer: found.ID, Name: found.Name}
+		if found.Address != "" {
+			block.Addresses = append([]string{found.Address}, found.Addresses...)
+		}
+		peersMutex.RUnlock()
+	}
+	if err := access.AddBlock(block); err != nil {
+		return access.Block{}, err
+	}
+
+	list := access.Blocklist{block}
+	peersMutex.Lock()
+	for _, known := range knownPeers {
+		if list.Match(known.ID, known.Address) != nil {
+			blocked = append(blocked, known)
+		}
+	}
+	var changes []peerChange
+	var rerouted []Peer
+	for _, known := range blocked {
+		delete(knownPeers, known.ID)
+		rerouted = append(rerouted, dropRoutesVia(known)...)
+		changes = append(changes, peerChange{*known, PeerForgotten})
+	}
+	peersMutex.Unlock()
+
+	for _, known := range blocked {
+		forgetNeighbors(known.ID)
+	}
+	if len(changes) > 0 {
+		saveKnownPeers()
+	}
+	notifyPeerStates(changes)
+	publishRoutes(rerouted)
+	return block, nil
+}
+
+// UnblockPeer lets a peer blocked as peer, or under that name, back in
+func UnblockPeer(peer string) (access.Block, error) {
+	return access.RemoveBlock(peer)
+}
+
+// Blocklist returns the blocked peers
+func Blocklist() (access.Blocklist, error) {
+	return access.LoadBlocklist()
+}
+
+// dropBlocked returns peers without the blocked ones
+func dropBlocked(peers []Peer) []Peer {
+	list, err := access.LoadBlocklist()
+	if err != nil || len(list) == 0 {
+		return peers
+	}
+	kept := peers[:0:0]
+	for _, peer := range peers {
+		if list.Match(peer.ID, peer.Address) != nil {
+			// Also keeps the address a blocked ID was seen at
+			access.IsBlocked(peer.ID, peer.Address)
+			continue
+		}
+		kept = append(kept, peer)
+	}
+	return kept
+}
+
+// refuseBlockedPeer returns an error when peer is blocked
+func refuseBlockedPeer(peer *Peer) error {
+	if access.IsBlocked(peer.ID, peer.Address) {
+		return fmt.Errorf("%s (%s) is blocked, unblock it first", peer.Name, peer.ID)
+	}
+	return nil
+}
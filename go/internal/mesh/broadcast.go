@@ -0,0 +1,194 @@
+package mesh
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fileshare/internal/p2p"
+)
+
+// Broadcasts
+//
+// Broadcast sends a message to every online peer this node reaches
+// directly, over its TCP service. With a TTL, each of them passes it on to
+// the peers it reaches directly, and so on until the TTL runs out, except
+// back to where it came from. Every broadcast has a random ID and a node
+// remembers the IDs it has seen for broadcastSeenTTL, so a broadcast that
+// comes around again through another peer is dropped instead of starting a
+// storm. Applications register a handler per message type with
+// HandleBroadcast; types without one are still passed on. The sender is
+// whoever the message says it is, nothing checks it.
+
+const (
+	// DefaultBroadcastTTL passes a broadcast on one hop past the peers this node reaches
+	DefaultBroadcastTTL = 1
+
+	// MaxBroadcastTTL bounds how far a broadcast travels
+	MaxBroadcastTTL = maxRouteHops - 1
+
+	// MaxBroadcastPayload bounds the size of a broadcast's payload
+	MaxBroadcastPayload = 64 * 1024
+
+	// broadcastSeenTTL is how long the ID of a broadcast is remembered
+	broadcastSeenTTL = 10 * time.Minute
+
+	// broadcastTimeout bounds sending a broadcast to one peer
+	broadcastTimeout = 3 * time.Second
+)
+
+// BroadcastMessage is a broadcast as handlers get it
+type BroadcastMessage struct {
+	ID       string
+	From     string // Node ID of the sender
+	FromName string
+	Type     string
+	Payload  []byte
+	Hops     int // How many nodes passed it on before this one got it
+}
+
+var broadcasts = struct {
+	sync.Mutex
+	handlers map[string]func(BroadcastMessage)
+	seen     map[string]time.Time
+}{handlers: make(map[string]func(BroadcastMessage)), seen: make(map[string]time.Time)}
+
+// HandleBroadcast sets what gets the broadcasts of msgType. A nil handler
+// stops taking them.
+func HandleBroadcast(msgType string, handler func(msg BroadcastMessage)) {
+	broadcasts.Lock()
+	defer broadcasts.Unlock()
+	if handler == nil {
+		delete(broadcasts.handlers, msgType)
+		return
+	}
+	broadcasts.handlers[msgType] = handler
+}
+
+// Broadcast sends a message of msgType to all peers, passed on
+// DefaultBroadcastTTL hops past the peers this node reaches directly. It
+// returns how many peers it was sent to.
+func Broadcast(msgType string, payload []byte) (int, error) {
+	return BroadcastTTL(msgType, payload, DefaultBroadcastTTL)
+}
+
+// BroadcastTTL is Broadcast passing the message on ttl hops, 0 for only the
+// peers this node reaches directly
+func BroadcastTTL(msgType string, payload []byte, ttl int) (int, error) {
+	if !isRunning() {
+		return 0, errors.New("mesh node is not running")
+	}
+	if msgType == "" {
+		return 0, errors.New("broadcast needs a message type")
+	}
+	if len(payload) > MaxBroadcastPayload {
+		return 0, fmt.Errorf("broadcast payload of %d bytes is over the %d byte limit", len(payload), MaxBroadcastPayload)
+	}
+	if ttl < 0 || ttl > MaxBroadcastTTL {
+		return 0, fmt.Errorf("broadcast TTL must be between 0 and %d", MaxBroadcastTTL)
+	}
+
+	id := make([]byte, 16)
+	rand.Read(id)
+	msg := p2p.BroadcastMessage{
+		ID:         hex.EncodeToString(id),
+		Origin:     GetNodeID(),
+		OriginName: currentConfig().NodeName,
+		Kind:       msgType,
+		Payload:    payload,
+		TTL:        ttl,
+	}
+	firstSeen(msg.ID)
+
+	sent := sendBroadcast(msg, "")
+	if sent == 0 {
+		return 0, errors.New("no peer reachable directly to broadcast to")
+	}
+	return sent, nil
+}
+
+// broadcastReceived delivers a broadcast a peer sent, the first time it
+// arrives, and passes it on while its TTL lasts
+func broadcastReceived(msg p2p.BroadcastMessage, address string) {
+	if msg.Origin == GetNodeID() || !firstSeen(msg.ID) {
+		return
+	}
+
+	broadcasts.Lock()
+	handler := broadcasts.handlers[msg.Kind]
+	broadcasts.Unlock()
+	if handler != nil {
+		go handler(BroadcastMessage{
+			ID:       msg.ID,
+			From:     msg.Origin,
+			FromName: msg.OriginName,
+			Type:     msg.Kind,
+			Payload:  msg.Payload,
+			Hops:     msg.Hops,
+		})
+	}
+
+	if msg.TTL > 0 {
+		msg.TTL = min(msg.TTL, MaxBroadcastTTL) - 1
+		msg.Hops++
+		go sendBroadcast(msg, address)
+	}
+}
+
+// firstSeen remembers a broadcast ID and reports whether it is new
+func firstSeen(id string) bool {
+	now := time.Now()
+	broadcasts.Lock()
+	defer broadcasts.Unlock()
+	for seenID, seen := range broadcasts.seen {
+		if now.Sub(seen) > broadcastSeenTTL {
+			delete(broadcasts.seen, seenID)
+		}
+	}
+	if _, seen := broadcasts.seen[id]; seen {
+		return false
+	}
+	broadcasts.seen[id] = now
+	return true
+}
+
+// sendBroadcast sends msg to the online peers reached directly, except the
+// origin and the one at the address it came from, and returns to how many
+func sendBroadcast(msg p2p.BroadcastMessage, from string) int {
+	peersMutex.RLock()
+	var addresses []string
+	for _, peer := range knownPeers {
+		if !peer.IsOnline || peer.Address == "" || peer.GossipOrigin != "" || peer.Protocol != "tcp" ||
+			peer.ID == msg.Origin || (from != "" && peerHost(peer.Address) == from) {
+			continue
+		}
+		addresses = append(addresses, tcpServiceAddress(peer))
+	}
+	peersMutex.RUnlock()
+
+	var wg sync.WaitGroup
+	var sent atomic.Int32
+	for _, address := range addresses {
+		wg.Add(1)
+		go func(address string) {
+			defer wg.Done()
+			conn, err := p2p.GetTCPManager().Secure(func() (net.Conn, error) {
+				return net.DialTimeout("tcp", address, broadcastTimeout)
+			}, broadcastTimeout)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			if p2p.SendBroadcast(conn, msg, broadcastTimeout) == nil {
+				sent.Add(1)
+			}
+		}(address)
+	}
+	wg.Wait()
+	return int(sent.Load())
+}
@@ -0,0 +1,232 @@
+package mesh
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"fileshare/internal/transfer"
+	"fileshare/internal/utils"
+)
+
+// A running node listens on a loopback control port so that one-shot commands
+// started from other terminals can ask it for its state. The port is published
+// in node.json in the data directory, and the last known state is cached in
+// peers.json so it can still be shown after the node has stopped.
+
+// Where a NodeSnapshot came from
+const (
+	SourceLocal = "local" // The node runs in this process
+	SourceNode  = "node"  // Fetched from a node running in another process
+	SourceCache = "cache" // Read from the cache, no node is running
+)
+
+const (
+	controlInfoFile   = "node.json"
+	snapshotCacheFile = "peers.json"
+	controlTimeout    = 2 * time.Second
+)
+
+// NodeSnapshot is the state of a node as seen by one-shot commands
+type NodeSnapshot struct {
+	NodeName        string         `json:"node_name"`
+	NodeID          string         `json:"node_id"`
+	NodeFingerprint string         `json:"node_fingerprint,omitempty"` // Of the key the node proves its ID with
+	Network         string         `json:"network,omitempty"`          // Private network the node is on, empty for the public one
+	Connection      ConnectionInfo `json:"connection"`
+	Peers           []Peer         `json:"peers"`
+	Power           PowerStatus    `json:"power"`
+	Topology        Topology       `json:"topology"`
+	UpdatedAt       time.Time      `json:"updated_at"`
+
+	// Receivers lists the connection cards of receivers running on this machine
+	Receivers []transfer.ConnectionCard `json:"receivers,omitempty"`
+}
+
+// controlInfo tells other processes how to reach the running node
+type controlInfo struct {
+	PID    int    `json:"pid"`
+	Port   int    `json:"port"`
+	NodeID string `json:"node_id"`
+}
+
+var controlListener net.Listener
+
+// GetNodeSnapshot returns the node's state from this process, from a node
+// running in another process, or from the cache, in that order of preference
+func GetNodeSnapshot() (NodeSnapshot, string, error) {
+	if isRunning() {
+		return currentSnapshot(), SourceLocal, nil
+	}
+
+	if snapshot, err := queryRunningNode(); err == nil {
+		return snapshot, SourceNode, nil
+	}
+
+	snapshot, err := loadSnapshotCache()
+	if err != nil {
+		return NodeSnapshot{}, "", errors.New("mesh node is not running and no cached state is available. Run 'start' first")
+	}
+	return snapshot, SourceCache, nil
+}
+
+func currentSnapshot() NodeSnapshot {
+	peers, _ := GetKnownPeers()
+	topology, _ := GetNetworkTopology()
+	return NodeSnapshot{
+		NodeName:        GetNodeName(),
+		NodeID:          GetNodeID(),
+		NodeFingerprint: GetNodeFingerprint(),
+		Network:         GetConfig().Network,
+		Connection:      GetConnectionInfo(),
+		Peers:           peers,
+		Power:           GetPowerStatus(),
+		Topology:        topology,
+		UpdatedAt:       time.Now(),
+		Receivers:       transfer.ConnectionCards(),
+	}
+}
+
+// startControlServer opens the loopback control port and publishes it
+func startControlServer() error {
+	dir, err := dataDir()
+	if err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("failed to open control port: %v", err)
+	}
+
+	info := controlInfo{
+		PID:    os.Getpid(),
+		Port:   listener.Addr().(*net.TCPAddr).Port,
+		NodeID: GetNodeID(),
+	}
+	if err := writeJSONFile(filepath.Join(dir, controlInfoFile), info); err != nil {
+		listener.Close()
+		return err
+	}
+
+	controlListener = listener
+	go serveControl(listener)
+	return nil
+}
+
+// stopControlServer closes the control port and removes its published address
+func stopControlServer() {
+	if controlListener == nil {
+		return
+	}
+	controlListener.Close()
+	controlListener = nil
+
+	dir, err := dataDir()
+	if err != nil {
+		return
+	}
+
+	// Another node may have started since and published its own port
+	path := filepath.Join(dir, controlInfoFile)
+	var info controlInfo
+	if data, err := os.ReadFile(path); err == nil && json.Unmarshal(data, &info) == nil && info.PID == os.Getpid() {
+		os.Remove(path)
+	}
+}
+
+func serveControl(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func(conn net.Conn) {
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(controlTimeout))
+			json.NewEncoder(conn).Encode(currentSnapshot())
+		}(conn)
+	}
+}
+
+// queryRunningNode asks a node running in another process for its state
+func queryRunningNode() (NodeSnapshot, error) {
+	var snapshot NodeSnapshot
+
+	dir, err := dataDir()
+	if err != nil {
+		return snapshot, err
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, controlInfoFile))
+	if err != nil {
+		return snapshot, err
+	}
+
+	var info controlInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return snapshot, err
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", fmt.Sprintf("%d", info.Port)), controlTimeout)
+	if err != nil {
+		return snapshot, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(controlTimeout))
+	err = json.NewDecoder(conn).Decode(&snapshot)
+	return snapshot, err
+}
+
+// saveSnapshotCache stores the node's current state for use when it is not running
+func saveSnapshotCache() {
+	dir, err := dataDir()
+	if err != nil {
+		return
+	}
+	writeJSONFile(filepath.Join(dir, snapshotCacheFile), currentSnapshot())
+}
+
+func loadSnapshotCache() (NodeSnapshot, error) {
+	var snapshot NodeSnapshot
+
+	dir, err := dataDir()
+	if err != nil {
+		return snapshot, err
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, snapshotCacheFile))
+	if err != nil {
+		return snapshot, err
+	}
+
+	err = json.Unmarshal(data, &snapshot)
+	return snapshot, err
+}
+
+func dataDir() (string, error) {
+	if dir := currentConfig().DataDir; dir != "" {
+		return dir, os.MkdirAll(dir, 0755)
+	}
+	return utils.DataDir()
+}
+
+// writeJSONFile writes a file atomically so readers never see it half written
+func writeJSONFile(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
@@ -1,25 +1,75 @@
 package mesh
 
 import (
+	"crypto/ed25519"
 	"errors"
 	"fmt"
 	"net"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+
+	"fileshare/internal/p2p"
+	"fileshare/internal/stun"
 )
 
 // Config stores mesh network configuration
 type Config struct {
-	NodeName         string
-	NodeID           string // Will be generated if empty
-	ListenPort       int
-	EnableWiFiDirect bool
-	EnableBluetooth  bool
-	EnableTCP        bool
-	EnableRelay      bool     // Whether to use relay servers when direct connection fails
-	RelayServers     []string // List of relay servers to use
-	DataDir          string   // Directory to store mesh data
+	NodeName           string
+	NodeID             string // The saved identity is used if empty (see identity.go)
+	ListenPort         int    // Receivers keep it, the TCP service listens at ServicePort(ListenPort)
+	EnableWiFiDirect   bool
+	EnableBluetooth    bool
+	EnableTCP          bool
+	EnableMDNS         bool     // Whether to advertise and browse with multicast DNS, next to the UDP broadcast
+	DiscoveryMode      string   // How UDP discovery goes out: p2p.DiscoveryBroadcast, DiscoveryMulticast or DiscoveryBoth, the default
+	MulticastTTL       int      // How many routers multicast discovery may cross, p2p.DefaultMulticastTTL if zero
+	EnableRelay        bool     // Whether to use relay servers when direct connection fails
+	EnablePeerExchange bool     // Whether to share the peer table with connected nodes and take theirs, see gossip.go
+	Network            string   // Name of the private network the node is on, empty for the public one (see p2p/network.go)
+	NetworkPassphrase  string   // What the nodes of Network prove they know
+	RelayServers       []string // List of relay servers to use
+	RelayToken         string   // Presented to relay servers that only serve known nodes
+	STUNServers        []string // Asked for the public address and NAT type, stun.DefaultServers if empty
+	PublicIPServices   []string // URLs answering with the public address, DefaultPublicIPServices if empty
+	Offline            bool     // Skip the STUN and public IP lookups, which go out to the internet
+	DataDir            string   // Directory to store mesh data
+
+	// OfflineAfter and ForgetAfter are how long a peer may go unseen before
+	// it is marked offline and before it is forgotten unless pinned; zero
+	// means the default and a negative value never (see prune.go)
+	OfflineAfter time.Duration
+	ForgetAfter  time.Duration
+
+	// HeartbeatInterval is how often online peers are checked on, and
+	// HeartbeatMisses how many checks in a row they may miss before they
+	// go offline; zero means the default and a negative interval never
+	// (see heartbeat.go)
+	HeartbeatInterval time.Duration
+	HeartbeatMisses   int
+
+	// KeepaliveInterval is how long a connection of the TCP service may stay
+	// quiet before it gets a PING, and KeepaliveMisses how many intervals in
+	// a row it may stay so before it is closed; zero means the default and a
+	// negative interval never (see p2p/keepalive.go)
+	KeepaliveInterval time.Duration
+	KeepaliveMisses   int
+
+	// ReconnectAttempts is how many times a dropped connection of the TCP
+	// service is tried again; zero means the default and a negative number
+	// never (see p2p/reconnect.go)
+	ReconnectAttempts int
+
+	// AllowPlaintextPeers takes and connects to peers that don't encrypt
+	// connections, as releases before encryption can't; they are turned
+	// away unless set (see p2p/secure.go)
+	AllowPlaintextPeers bool
+
+	// PeerStateFunc is told when a peer comes online, goes offline or is
+	// forgotten, with PeerOnline, PeerOffline or PeerForgotten
+	PeerStateFunc func(peer Peer, state string)
 }
 
 // NetworkMode indicates how peers can connect in the current network
@@ -35,9 +85,12 @@ const (
 type ConnectionInfo struct {
 	Mode                  NetworkMode
 	ClientIsolation       bool
+	IsolationConfidence   string // IsolationUnknown, IsolationLow or IsolationHigh, see isolation.go
 	NATType               string
 	PublicIP              string
-	RelayAvailable        bool
+	RelayAvailable        bool        // Whether any relay can be reached
+	Relay                 RelayStatus // See relayselect.go
+	PortMapping           PortMapping // See portmapping.go
 	LastConnectivityCheck time.Time
 }
 
@@ -46,12 +99,30 @@ type Peer struct {
 	ID                string
 	Name              string
 	Address           string
+	Addresses         []string // Where the peer was seen before Address, most recent first
 	Protocol          string
 	IsOnline          bool
 	LastSeen          time.Time
 	SignalStrength    int // 0-100%
 	ConnectionQuality string
 	Routes            []Route
+	Version           string // BitShare release the peer reported, empty if unknown
+	Pinned            bool   // Kept however long it goes unseen
+	Port              int    // Where the peer said its TCP service listens, 0 if it didn't, see ServicePort
+
+	// PublicKey is the key the peer proved its ID with, nil until it has,
+	// see keys.go. KeyConflict is the ID of a peer seen before under the
+	// same name with another key.
+	PublicKey   ed25519.PublicKey
+	KeyConflict string
+
+	// GossipOrigin is set while the peer is only known from a peer
+	// exchange, to the node that saw it, see gossip.go
+	GossipOrigin string
+
+	// Transports are the ways the peer was seen, best first; Address,
+	// Protocol and SignalStrength are the best one's, see transports.go
+	Transports []p2p.Transport
 }
 
 // Route represents a path to a peer
@@ -63,87 +134,169 @@ type Route struct {
 }
 
 var (
+	nodeMutex      sync.RWMutex // Guards meshConfig, nodeID, nodeKey, connectionInfo and run
 	meshConfig     Config
-	isRunning      bool
 	nodeID         string
-	knownPeers     = make(map[string]*Peer)
-	peersMutex     sync.RWMutex
+	nodeKey        ed25519.PrivateKey // Nil when Config.NodeID was set
 	connectionInfo ConnectionInfo
+	run            *nodeRun // Nil while the node is stopped
+
+	knownPeers = make(map[string]*Peer)
+	peersMutex sync.RWMutex
 )
 
+// lifecycleMutex keeps starting and stopping the node from overlapping
+var lifecycleMutex sync.Mutex
+
+// nodeRun is one run of the node, from StartMeshNode to StopMeshNode. The
+// background loops of a run end with it, even when the node is started again
+// before they notice.
+type nodeRun struct {
+	stopped chan struct{}
+}
+
+// active reports whether the run is still going
+func (r *nodeRun) active() bool {
+	select {
+	case <-r.stopped:
+		return false
+	default:
+		return true
+	}
+}
+
+// departureTimeout bounds how long a stopping node spends telling peers it leaves
+const departureTimeout = 2 * time.Second
+
+// discoveryTimeout is how long a discovery round waits for answers
+const discoveryTimeout = 3 * time.Second
+
+// stunTimeout bounds how long each STUN request of the NAT detection waits
+const stunTimeout = 1500 * time.Millisecond
+
 // StartMeshNode initializes and starts the mesh network node
 func StartMeshNode(config Config) error {
-	if isRunning {
+	lifecycleMutex.Lock()
+	defer lifecycleMutex.Unlock()
+
+	if isRunning() {
 		return errors.New("mesh node is already running")
 	}
 
-	// Initialize node ID if not provided
-	if config.NodeID == "" {
-		config.NodeID = generateNodeID()
+	if err := configDefaults(&config); err != nil {
+		return err
 	}
 
-	// Set default relay settings if not provided
-	if config.EnableRelay && len(config.RelayServers) == 0 {
-		config.RelayServers = []string{"relay1.bitshare.net:9100", "relay2.bitshare.net:9100"}
+	nodeMutex.Lock()
+	meshConfig = config
+	nodeMutex.Unlock()
+
+	// The data directory is this node's alone until it stops, see lock.go
+	if err := acquireInstanceLock(); err != nil {
+		return err
 	}
 
-	meshConfig = config
+	// The saved identity lives in the data directory, so it is read once
+	// the configuration is in place
+	var key ed25519.PrivateKey
+	if config.NodeID == "" {
+		id, saved, err := loadIdentity()
+		if err != nil {
+			releaseInstanceLock()
+			return err
+		}
+		config.NodeID, key = id, saved
+	}
+	nodeMutex.Lock()
+	meshConfig.NodeID = config.NodeID
 	nodeID = config.NodeID
+	nodeKey = key
+	nodeMutex.Unlock()
+
+	settings, err := LoadPowerSettings()
+	if err != nil {
+		fmt.Printf("⚠️ Using default idle settings: %v\n", err)
+	}
+	applyPowerSettings(settings)
+
+	// Peers from the last run stay offline until they are seen again
+	loadKnownPeers()
+	reloadAliases()
+	p2p.GetTCPManager().OnDeparture(peerDeparted)
+	p2p.GetTCPManager().OnConnectionLost(peerConnectionLost)
+	p2p.GetTCPManager().OnReconnect(peerReconnected)
+	p2p.GetTCPManager().OnNeighbors(learnNeighbors)
+	p2p.GetTCPManager().OnAnnounce(peerAnnounced)
+	p2p.GetTCPManager().OnHandshake(peerAnnounced)
+	p2p.GetTCPManager().OnPeerExchange(learnPeers)
+	p2p.GetTCPManager().OnBroadcast(broadcastReceived)
 
 	// Detect network conditions before starting protocol handlers
 	detectNetworkConditions()
+	r := &nodeRun{stopped: make(chan struct{})}
 
 	// Start protocol handlers based on configuration
 	if config.EnableWiFiDirect {
-		go startWiFiDirectHandler(config.ListenPort)
+		go startWiFiDirectHandler()
 	}
 
 	if config.EnableBluetooth {
 		go startBluetoothHandler()
 	}
 
+	// Started before this returns, so a stop right after finds it running
 	if config.EnableTCP {
-		go startTCPHandler(config.ListenPort)
-	}
-
-	// If client isolation detected, notify user
-	if connectionInfo.ClientIsolation {
-		fmt.Println("⚠️ Client isolation detected in your network")
-		fmt.Println("→ Direct peer connections may be restricted")
-
-		if config.EnableWiFiDirect {
-			fmt.Println("→ Will attempt WiFi Direct for direct connections")
-		}
-
-		if config.EnableRelay {
-			fmt.Println("→ Using relay servers for restricted connections")
-		} else {
-			fmt.Println("⚠️ Relay mode is disabled. Some peers may be unreachable")
-			fmt.Println("→ Enable relay with --enable-relay flag to improve connectivity")
-		}
+		startTCPHandler()
 	}
 
 	// Start relay connection handler if enabled
 	if config.EnableRelay {
-		go startRelayHandler(config.RelayServers)
+		startRelayHandler(config.RelayServers)
 	}
 
 	// Start the discovery service
-	go startDiscoveryService()
+	go startDiscoveryService(r)
 
 	// Start the routing table maintenance
-	go maintainRoutingTable()
+	go maintainRoutingTable(r)
+
+	// Measure the links to the peers reached directly
+	go maintainLinkQuality(r)
+
+	// Share the peer table with the nodes this one is connected to
+	go maintainPeerExchange(r)
+
+	// Check the online peers are still there
+	go maintainHeartbeats(r)
 
 	// Periodically check network conditions
-	go monitorNetworkConditions()
+	go monitorNetworkConditions(r)
+
+	// Ask the router to forward the TCP service's port
+	startPortMapping(ServicePort(config.ListenPort))
+
+	nodeMutex.Lock()
+	run = r
+	nodeMutex.Unlock()
 
-	isRunning = true
+	// Slow everything down when nothing happens for a while
+	go monitorIdle(r)
+
+	// Let commands started from other terminals reach this node
+	if err := startControlServer(); err != nil {
+		fmt.Printf("⚠️ Control port unavailable, other terminals won't see this node: %v\n", err)
+	}
+
+	publish(Event{Type: EventNodeStarted})
 	return nil
 }
 
 // StopMeshNode gracefully shuts down the mesh node
 func StopMeshNode() {
-	if !isRunning {
+	lifecycleMutex.Lock()
+	defer lifecycleMutex.Unlock()
+
+	if !isRunning() {
 		return
 	}
 
@@ -154,13 +307,25 @@ func StopMeshNode() {
 	stopWiFiDirectHandler()
 	stopBluetoothHandler()
 	stopTCPHandler()
+	stopRelayHandler()
+	removePortMapping()
+
+	saveKnownPeers()
+	saveSnapshotCache()
+	stopControlServer()
 
-	isRunning = false
+	nodeMutex.Lock()
+	close(run.stopped)
+	run = nil
+	nodeMutex.Unlock()
+	releaseInstanceLock()
+
+	publish(Event{Type: EventNodeStopped})
 }
 
 // GetKnownPeers returns the list of known peers in the network
 func GetKnownPeers() ([]Peer, error) {
-	if !isRunning {
+	if !isRunning() {
 		return nil, errors.New("mesh node is not running")
 	}
 
@@ -171,16 +336,36 @@ func GetKnownPeers() ([]Peer, error) {
 	for _, peer := range knownPeers {
 		peers = append(peers, *peer)
 	}
+	SortPeers(peers)
 
 	return peers, nil
 }
 
-// FindPeerByIdOrName locates a peer by either ID or name
+// FindPeerByIdOrName locates a peer by alias, ID, name or the start of its ID
 func FindPeerByIdOrName(idOrName string) (*Peer, error) {
-	if !isRunning {
+	if !isRunning() {
 		return nil, errors.New("mesh node is not running")
 	}
 
+	// Display handles like "#2" refer to a peer by ID
+	if IsHandle(idOrName) {
+		target, err := ResolveHandle(idOrName)
+		if err != nil {
+			return nil, err
+		}
+		idOrName = target.ID
+	}
+
+	// Aliases come first, they are what the user has chosen to call peers
+	if id, ok := aliasedID(idOrName); ok {
+		peersMutex.RLock()
+		peer, exists := knownPeers[id]
+		peersMutex.RUnlock()
+		if exists {
+			return peer, nil
+		}
+	}
+
 	peersMutex.RLock()
 	defer peersMutex.RUnlock()
 
@@ -196,11 +381,19 @@ func FindPeerByIdOrName(idOrName string) (*Peer, error) {
 		}
 	}
 
-	// Finally, try name match (which might not be unique)
-	var matchedPeer *Peer
+	// Finally, try name match (which might not be unique). Peers that took
+	// the name of a peer seen before with another key don't answer to it.
+	var matchedPeer, suspect *Peer
 	matchCount := 0
 
 	for _, peer := range knownPeers {
+		if conflicting(peer) {
+			if strings.EqualFold(peer.Name, idOrName) {
+				suspect = peer
+			}
+			continue
+		}
+
 		// Exact name match
 		if peer.Name == idOrName {
 			return peer, nil
@@ -218,276 +411,497 @@ func FindPeerByIdOrName(idOrName string) (*Peer, error) {
 	} else if matchCount > 1 {
 		return nil, fmt.Errorf("multiple peers found with name '%s'. Please use a specific ID", idOrName)
 	}
+	if suspect != nil {
+		return nil, fmt.Errorf("%s (%s) presents a different key than the %s seen before (fingerprint %s), use its ID if you trust it",
+			suspect.Name, suspect.ID, suspect.Name, knownPeers[suspect.KeyConflict].Fingerprint())
+	}
+
+	// Then the start of an ID, see lookup.go
+	switch matches := peersWithIDPrefix(idOrName); len(matches) {
+	case 0:
+	case 1:
+		return matches[0], nil
+	default:
+		return nil, ambiguousPrefixError(idOrName, matches)
+	}
+
+	return nil, notFoundError(idOrName)
+}
+
+// SetPeerVersion records the BitShare release reported by the peer at an address
+func SetPeerVersion(address, version string) {
+	peersMutex.Lock()
+	changed := false
+	for _, peer := range knownPeers {
+		if peerHost(peer.Address) == peerHost(address) && peer.Version != version {
+			peer.Version = version
+			changed = true
+		}
+	}
+	peersMutex.Unlock()
+
+	if changed {
+		saveKnownPeers()
+	}
+}
+
+// FindPeerByAddress returns the known peer at an address, ignoring the port
+func FindPeerByAddress(address string) (*Peer, bool) {
+	peersMutex.RLock()
+	defer peersMutex.RUnlock()
+
+	for _, peer := range knownPeers {
+		if peerHost(peer.Address) == peerHost(address) {
+			return peer, true
+		}
+	}
+	return nil, false
+}
 
-	return nil, fmt.Errorf("no peer found with ID or name '%s'", idOrName)
+func peerHost(address string) string {
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return host
+	}
+	return address
 }
 
 // Helper functions
-func generateNodeID() string {
-	// Generate a unique node ID based on hardware and timestamp
-	return fmt.Sprintf("node-%x", time.Now().UnixNano())
+func startWiFiDirectHandler() {
+	// Devices without WiFi Direct go on without it, see p2p/wifi_direct.go
+	wifiDirect := p2p.GetWiFiDirectManager()
+	wifiDirect.SetIdentity(GetNodeID())
+	wifiDirect.OnLinked(wifiDirectLinked)
+	if err := wifiDirect.Start(); err != nil {
+		fmt.Printf("⚠️ Could not start WiFi Direct handler: %v\n", err)
+		return
+	}
+	fmt.Println("Starting WiFi Direct handler")
 }
 
-func startWiFiDirectHandler(port int) {
-	// Initialize WiFi Direct service
-	// This is a placeholder for the actual implementation
-	fmt.Println("Starting WiFi Direct handler on port", port)
+// wifiDirectLinked remembers the node at the other end of a WiFi Direct
+// link, at its address on the group, and connects to its TCP service
+func wifiDirectLinked(address string) {
+	tcp := p2p.GetTCPManager()
+	info, err := tcp.QueryPeer(address, p2p.DefaultTCPPort, discoveryTimeout)
+	if err != nil {
+		fmt.Printf("WiFi Direct: no node answered at %s: %v\n", address, err)
+		return
+	}
+	peer := peerFromInfo(info)
+	peer.Address, peer.Protocol = address, ProtocolWiFiDirect
+	peer.Transports = []p2p.Transport{{
+		Protocol: ProtocolWiFiDirect,
+		Address:  address,
+		LastSeen: time.Now(),
+	}}
+	RememberPeers(peer)
+	if err := tcp.Connect(address, peer.servicePort()); err != nil {
+		fmt.Printf("WiFi Direct: could not connect to %s: %v\n", peer.Name, err)
+	}
 }
 
 func startBluetoothHandler() {
-	// Initialize Bluetooth service
-	// This is a placeholder for the actual implementation
+	// Devices without a Bluetooth adapter go on without it, see
+	// p2p/bluetooth.go
+	bluetooth := p2p.GetBluetoothManager()
+	bluetooth.SetName(GetNodeName())
+	if err := bluetooth.Start(); err != nil {
+		fmt.Printf("⚠️ Could not start Bluetooth handler: %v\n", err)
+		return
+	}
 	fmt.Println("Starting Bluetooth handler")
 }
 
-func startTCPHandler(port int) {
-	// Initialize TCP service for fallback
-	// This is a placeholder for the actual implementation
+func startTCPHandler() {
+	// The TCP service carries the mesh's own messages, including routed
+	// streams, on a port of its own so receivers keep ListenPort
+	tcp := p2p.GetTCPManager()
+	tcp.SetIdentity(GetNodeID(), GetNodeName())
+	tcp.SetCapabilities(nodeCapabilities(currentConfig()))
+	nodeMutex.RLock()
+	tcp.SetKey(nodeKey)
+	nodeMutex.RUnlock()
+	tcp.SetKeyCheck(hasKey)
+	tcp.SetMDNS(currentConfig().EnableMDNS)
+	tcp.SetAllowPlaintext(currentConfig().AllowPlaintextPeers)
+	tcp.SetKeepalive(currentConfig().KeepaliveInterval, currentConfig().KeepaliveMisses)
+	tcp.SetReconnect(currentConfig().ReconnectAttempts)
+	tcp.SetReconnectCheck(keepReconnecting)
+	if err := tcp.SetDiscoveryMode(currentConfig().DiscoveryMode, currentConfig().MulticastTTL); err != nil {
+		fmt.Printf("⚠️ %v, discovering with the defaults\n", err)
+	}
+	tcp.SetNetwork(currentConfig().Network, currentConfig().NetworkPassphrase)
+	tcp.SetRouting(nextHop)
+	tcp.OnRoutedConnection(acceptRoutedConnection)
+	HandleRelayedConnections(tcp.ServeConn)
+	port := ServicePort(currentConfig().ListenPort)
+	if err := tcp.Start(port); err != nil {
+		fmt.Printf("⚠️ Could not start TCP handler: %v\n", err)
+		return
+	}
 	fmt.Println("Starting TCP handler on port", port)
 }
 
+// ServicePort is where the TCP service of a node listens when its receivers
+// listen at listenPort: two ports above, as the one above the service is
+// its discovery channel's, so nodes sharing a host can run side by side
+func ServicePort(listenPort int) int {
+	return listenPort + 2
+}
+
+// servicePort is where the peer's TCP service listens, p2p.DefaultTCPPort
+// for peers that didn't say
+func (p *Peer) servicePort() int {
+	if p.Port == 0 {
+		return p2p.DefaultTCPPort
+	}
+	return p.Port
+}
+
+// nodeCapabilities is what the node tells others it can do with config:
+// transfers and mesh routing, sharing its peers and being reached through
+// relays
+func nodeCapabilities(config Config) []string {
+	capabilities := append([]string(nil), p2p.DefaultCapabilities...)
+	if config.EnablePeerExchange {
+		capabilities = append(capabilities, "peer-exchange")
+	}
+	if config.EnableRelay {
+		capabilities = append(capabilities, ProtocolRelay)
+	}
+	return capabilities
+}
+
 func stopWiFiDirectHandler() {
-	// Clean up WiFi Direct resources
+	p2p.GetWiFiDirectManager().Stop()
 }
 
 func stopBluetoothHandler() {
-	// Clean up Bluetooth resources
+	p2p.GetBluetoothManager().Stop()
 }
 
 func stopTCPHandler() {
-	// Clean up TCP resources
+	p2p.GetTCPManager().Stop()
 }
 
-func startDiscoveryService() {
+func startDiscoveryService(r *nodeRun) {
 	// Periodically discover new peers
-	for isRunning {
+	for r.active() {
 		// Discover peers using available protocols
 		discoverPeers()
-		time.Sleep(60 * time.Second)
+		powerSleep(discoveryInterval)
 	}
 }
 
+// discoverPeers asks the local network for nodes, with the broadcast and
+// mDNS (see p2p.TCPManager.Discover), and remembers those that answer
 func discoverPeers() {
-	// Implementation for peer discovery
+	if !currentConfig().EnableTCP {
+		return
+	}
+	found, err := p2p.GetTCPManager().Discover(discoveryTimeout)
+	if err != nil || len(found) == 0 {
+		return
+	}
+
+	peers := make([]Peer, len(found))
+	for i, info := range found {
+		peers[i] = peerFromInfo(info)
+	}
+	RememberPeers(peers...)
+	probeIsolation(found)
+}
+
+// peerAnnounced remembers what a peer announced about itself, or said in
+// the handshake of a connection, see p2p.TCPManager.Announce and
+// OnHandshake
+func peerAnnounced(info p2p.PeerInfo) {
+	RememberPeers(peerFromInfo(info))
+}
+
+// peerFromInfo is the peer discovery found
+func peerFromInfo(info p2p.PeerInfo) Peer {
+	return Peer{
+		ID:             info.ID,
+		Name:           info.Name,
+		Address:        info.Address,
+		Protocol:       info.Protocol,
+		LastSeen:       info.LastSeen,
+		SignalStrength: info.SignalStrength,
+		Version:        info.Version,
+		Port:           info.Port,
+		PublicKey:      info.PublicKey,
+		Transports:     info.Transports,
+	}
 }
 
-func maintainRoutingTable() {
+func maintainRoutingTable(r *nodeRun) {
 	// Periodically update routing information
-	for isRunning {
+	for r.active() {
 		// Update routes
 		updateRoutes()
-		time.Sleep(30 * time.Second)
+		prunePeers()
+		saveSnapshotCache()
+		powerSleep(routingInterval)
 	}
 }
 
-func updateRoutes() {
-	// Implementation for route maintenance
+func broadcastDeparture() {
+	// Let peers know we're leaving the network, without holding up shutdown
+	p2p.GetTCPManager().BroadcastDeparture(GetNodeID(), departureTimeout)
 }
 
-func broadcastDeparture() {
-	// Let peers know we're leaving the network
+// peerDeparted marks a peer that announced it is leaving offline and drops
+// the routes that went through it
+func peerDeparted(id, address string) {
+	if id == GetNodeID() {
+		return
+	}
+
+	peersMutex.Lock()
+	departed := knownPeers[id]
+	for _, peer := range knownPeers {
+		if departed == nil && peerHost(peer.Address) == peerHost(address) {
+			departed = peer
+		}
+	}
+	if departed == nil {
+		peersMutex.Unlock()
+		return
+	}
+	wasOnline := departed.IsOnline
+	departed.IsOnline = false
+	departed.LastSeen = time.Now()
+	rerouted := dropRoutesVia(departed)
+	change := peerChange{*departed, PeerOffline}
+	peersMutex.Unlock()
+	publishRoutes(rerouted)
+	forgetNeighbors(change.peer.ID)
+
+	fmt.Printf("👋 %s left the network\n", change.peer.Name)
+	saveKnownPeers()
+	if wasOnline {
+		notifyPeerStates([]peerChange{change})
+	}
 }
 
 func IsClientIsolated() bool {
-	return connectionInfo.ClientIsolation
+	return GetConnectionInfo().ClientIsolation
 }
 
 // GetConnectionInfo returns current network connection information
 func GetConnectionInfo() ConnectionInfo {
+	nodeMutex.RLock()
+	defer nodeMutex.RUnlock()
 	return connectionInfo
 }
 
 // GetNetworkMode returns the current networking mode
 func GetNetworkMode() NetworkMode {
-	return connectionInfo.Mode
+	return GetConnectionInfo().Mode
+}
+
+// ConnectToPeer establishes the best possible connection to a peer, see
+// PeerConn, and registers it for the next transfer to the peer
+func ConnectToPeer(peerID string) (*PeerConn, error) {
+	conn, err := connectToPeer(peerID)
+	if err != nil {
+		return nil, err
+	}
+	switch conn.Protocol {
+	case ProtocolMesh:
+		fmt.Printf("Mesh connection established to %s (%s) via %s\n", conn.Peer.Name, conn.Peer.ID, conn.Via)
+	case ProtocolWiFiDirect:
+		fmt.Printf("WiFi Direct connection established to %s (%s)\n", conn.Peer.Name, conn.Peer.ID)
+	case ProtocolRelay:
+		fmt.Printf("Relay connection established to %s (%s)\n", conn.Peer.Name, conn.Peer.ID)
+	default:
+		fmt.Printf("Direct connection established to %s (%s)\n", conn.Peer.Name, conn.Peer.ID)
+	}
+	conn.register()
+	return conn, nil
 }
 
-// ConnectToPeer attempts to establish the best possible connection to a peer
-func ConnectToPeer(peerID string) error {
+// connectToPeer is ConnectToPeer without telling the user or registering
+// the connection
+func connectToPeer(peerID string) (*PeerConn, error) {
 	peer, err := FindPeerByIdOrName(peerID)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if err := refuseBlockedPeer(peer); err != nil {
+		return nil, err
+	}
+	peersMutex.RLock()
+	suspect := conflicting(peer)
+	peersMutex.RUnlock()
+	if suspect {
+		fmt.Printf("🚨 %s (%s) took the name of a peer seen before with another key, connecting only because it was asked for by ID\n", peer.Name, peer.ID)
 	}
 
-	// Try direct connection first
-	directErr := connectDirectly(peer)
+	// Try the ways the peer was seen first, best first, see transports.go
+	conn, directErr := connectOverTransports(peer)
+	if directErr == nil && conn != nil {
+		peerContacted(peer.ID)
+		return conn, nil
+	}
 	if directErr == nil {
-		fmt.Printf("Direct connection established to %s (%s)\n", peer.Name, peer.ID)
-		return nil
+		directErr = errors.New("no known address")
+	}
+
+	// Peers out of reach may be reached through other nodes
+	if len(peer.Routes) > 0 {
+		conn, meshErr := openPeerConn(peer, ProtocolMesh, peer.Routes[0].NextHop, meshConnectTimeout, connectViaMesh)
+		if meshErr == nil {
+			return conn, nil
+		}
+		fmt.Printf("Mesh connection to %s failed: %v\n", peer.Name, meshErr)
 	}
 
 	// If direct fails and client isolation is detected, try WiFi Direct
-	if connectionInfo.ClientIsolation && meshConfig.EnableWiFiDirect {
-		wifiErr := connectViaWiFiDirect(peer)
+	// unless the transports did
+	config := currentConfig()
+	if IsClientIsolated() && config.EnableWiFiDirect && !slices.Contains(peer.Protocols(), ProtocolWiFiDirect) {
+		conn, wifiErr := openPeerConn(peer, ProtocolWiFiDirect, "", directConnectTimeout, connectViaWiFiDirect)
 		if wifiErr == nil {
-			fmt.Printf("WiFi Direct connection established to %s (%s)\n", peer.Name, peer.ID)
-			return nil
+			return conn, nil
 		}
 	}
 
 	// If all direct methods fail, try relay if enabled
-	if meshConfig.EnableRelay {
-		relayErr := connectViaRelay(peer)
+	if config.EnableRelay {
+		conn, relayErr := openPeerConn(peer, ProtocolRelay, "", relaySessionTimeout, connectViaRelay)
 		if relayErr == nil {
-			fmt.Printf("Relay connection established to %s (%s)\n", peer.Name, peer.ID)
-			return nil
+			if relayConn, ok := conn.Conn.(*relayConn); ok {
+				conn.Via = relayConn.remote.server
+			}
+			return conn, nil
 		}
-		return fmt.Errorf("failed to connect via relay: %v", relayErr)
+		return nil, fmt.Errorf("failed to connect via relay: %v", relayErr)
 	}
 
 	// If we get here, all connection attempts failed
-	return fmt.Errorf("failed to connect: direct connection error: %v", directErr)
+	return nil, fmt.Errorf("failed to connect: direct connection error: %v", directErr)
 }
 
 // Helper functions for client isolation handling
 
 func detectNetworkConditions() {
-	connectionInfo.LastConnectivityCheck = time.Now()
-
-	// Get public IP if possible
-	publicIP, _ := getPublicIP()
-	if publicIP != "" {
-		connectionInfo.PublicIP = publicIP
-	}
-
-	// Check for client isolation
-	isolated := detectClientIsolation()
-	connectionInfo.ClientIsolation = isolated
-
-	// Determine NAT type
-	natType, _ := detectNATType()
-	connectionInfo.NATType = natType
-
-	// Set network mode based on conditions
-	if isolated {
-		if meshConfig.EnableRelay {
-			connectionInfo.Mode = RelayMode
-		} else if meshConfig.EnableWiFiDirect {
-			connectionInfo.Mode = MixedMode
-		} else {
-			connectionInfo.Mode = RelayMode // Fallback to relay even if disabled
+	// The checks take a while, so they work on a copy that replaces the
+	// current information at the end
+	info := GetConnectionInfo()
+	config := currentConfig()
+	info.LastConnectivityCheck = time.Now()
+
+	// Determine NAT type and the public IP it maps this node to, see publicip.go
+	info.NATType, info.PublicIP = "", ""
+	if !config.Offline {
+		nat, natErr := stun.DetectNAT(config.STUNServers, stunTimeout)
+		info.NATType = nat.NATType
+		if ip, err := publicIP(config.PublicIPServices); err == nil {
+			info.PublicIP = ip
+		} else if natErr == nil && nat.MappedAddr != nil {
+			info.PublicIP = nat.MappedAddr.IP.String()
 		}
-	} else {
-		connectionInfo.Mode = DirectMode
 	}
 
-	// Check relay connectivity
-	if meshConfig.EnableRelay && len(meshConfig.RelayServers) > 0 {
-		connectionInfo.RelayAvailable = checkRelayConnectivity(meshConfig.RelayServers[0])
+	// Client isolation is found out after discovery, see isolation.go, and
+	// holds until the network interfaces change
+	interfaces := localInterfaces()
+	nodeMutex.Lock()
+	previous := connectionInfo.Mode
+	// Kept up by maintainPortMapping and maintainRelays meanwhile
+	info.PortMapping = connectionInfo.PortMapping
+	info.RelayAvailable, info.Relay = connectionInfo.RelayAvailable, connectionInfo.Relay
+	info.ClientIsolation, info.IsolationConfidence = connectionInfo.ClientIsolation, connectionInfo.IsolationConfidence
+	resetIsolation(&info, interfaces)
+	info.Mode = isolationMode(info, config)
+	connectionInfo = info
+	nodeMutex.Unlock()
+
+	if info.Mode != previous {
+		publish(Event{Type: EventNetworkModeChanged, Mode: info.Mode})
 	}
 }
 
-func detectClientIsolation() bool {
-	// Try to detect client isolation by:
-	// 1. Find other devices on local network via multicast
-	// 2. Try to establish direct TCP connections to them
-	// 3. If all connection attempts fail, likely client isolation
-
-	// Simplified implementation for now:
-	// Try to make a connection to a common local IP
-	conn, err := net.DialTimeout("tcp", "239.255.255.250:1900", 500*time.Millisecond)
-	if err == nil {
-		conn.Close()
-		return false
-	}
-
-	// Try to connect to common gateway IP addresses
-	for _, ip := range []string{"192.168.1.1", "192.168.0.1", "10.0.0.1"} {
-		conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:80", ip), 500*time.Millisecond)
-		if err == nil {
-			conn.Close()
-			// We can reach gateway but not peers - likely isolation
-			return true
+func monitorNetworkConditions(r *nodeRun) {
+	// Checked fully every networkCheckInterval, and as soon as the node
+	// moves to another network, which is then searched for peers again
+	rounds := 0
+	for r.active() {
+		powerSleep(interfaceCheckInterval)
+		rounds++
+		if moved := interfacesChanged(); moved || time.Duration(rounds)*interfaceCheckInterval >= networkCheckInterval {
+			rounds = 0
+			detectNetworkConditions()
+			if moved {
+				discoverPeers()
+			}
 		}
 	}
-
-	// If unsure, assume no isolation
-	return false
-}
-
-func getPublicIP() (string, error) {
-	// Connect to external service to get public IP
-	// This is a simplified implementation
-	conn, err := net.DialTimeout("tcp", "api.ipify.org:80", 5*time.Second)
-	if err != nil {
-		return "", err
-	}
-	defer conn.Close()
-
-	// Use local IP as fallback
-	localAddr := conn.LocalAddr().(*net.TCPAddr)
-	return localAddr.IP.String(), nil
-}
-
-func detectNATType() (string, error) {
-	// In a real implementation, this would use STUN protocol
-	// to determine NAT type (Full Cone, Restricted, etc.)
-	return "Unknown", nil
 }
 
-func checkRelayConnectivity(relayServer string) bool {
-	// Check if we can connect to the relay server
-	conn, err := net.DialTimeout("tcp", relayServer, 5*time.Second)
-	if err != nil {
-		return false
+// connectViaWiFiDirect connects to the TCP service of peer at its address
+// on a WiFi Direct group this node is in, see wifiDirectLinked
+func connectViaWiFiDirect(peer *Peer) (net.Conn, error) {
+	if !p2p.GetWiFiDirectManager().IsRunning() {
+		return nil, errors.New("not in a WiFi Direct group")
 	}
-	conn.Close()
-	return true
-}
-
-func monitorNetworkConditions() {
-	for isRunning {
-		time.Sleep(5 * time.Minute)
-		detectNetworkConditions()
+	if net.ParseIP(peer.Address) == nil {
+		return nil, errors.New("no address on the WiFi Direct group")
 	}
+	return net.DialTimeout("tcp", net.JoinHostPort(peer.Address, strconv.Itoa(peer.servicePort())), directConnectTimeout)
 }
 
-func startRelayHandler(relayServers []string) {
-	// Connect to relay servers and listen for relay requests
-	fmt.Println("Starting relay connection handler")
-
-	for _, server := range relayServers {
-		go connectToRelayServer(server)
-	}
+// connectViaRelay opens a session with peer through a relay, see
+// DialRelay. It ends up at the peer's TCP service.
+func connectViaRelay(peer *Peer) (net.Conn, error) {
+	return DialRelay(peer.ID)
 }
 
-func connectToRelayServer(server string) {
-	// Connect to relay server and maintain connection
-	fmt.Printf("Connecting to relay server: %s\n", server)
-
-	// In a real implementation, this would:
-	// 1. Establish and maintain a WebSocket or TCP connection to the relay server
-	// 2. Register this node with its nodeID
-	// 3. Listen for incoming connection requests via the relay
-	// 4. Handle relay protocol for NAT traversal
+// IsNodeRunning checks if the mesh node is currently running
+func IsNodeRunning() bool {
+	return isRunning()
 }
 
-func connectDirectly(peer *Peer) error {
-	// Try to establish a direct TCP connection
-	return errors.New("not implemented")
+// GetConfig returns the configuration the node runs with, as StartMeshNode
+// or Reconfigure completed it
+func GetConfig() Config {
+	return currentConfig()
 }
 
-func connectViaWiFiDirect(peer *Peer) error {
-	// Try to establish a WiFi Direct connection
-	return errors.New("not implemented")
+// GetNodeName returns the name of the current node
+func GetNodeName() string {
+	return currentConfig().NodeName
 }
 
-func connectViaRelay(peer *Peer) error {
-	// Try to establish a connection via relay server
-	return errors.New("not implemented")
+// GetNodeID returns the ID of the current node
+func GetNodeID() string {
+	nodeMutex.RLock()
+	defer nodeMutex.RUnlock()
+	return nodeID
 }
 
-// IsNodeRunning checks if the mesh node is currently running
-func IsNodeRunning() bool {
-	return isRunning
+// GetNodeFingerprint returns the fingerprint of the key the node proves its
+// ID with, or "" when it has none
+func GetNodeFingerprint() string {
+	nodeMutex.RLock()
+	defer nodeMutex.RUnlock()
+	if nodeKey == nil {
+		return ""
+	}
+	return p2p.Fingerprint(nodeKey.Public().(ed25519.PublicKey))
 }
 
-// GetNodeName returns the name of the current node
-func GetNodeName() string {
-	return meshConfig.NodeName
+func isRunning() bool {
+	nodeMutex.RLock()
+	defer nodeMutex.RUnlock()
+	return run != nil
 }
 
-// GetNodeID returns the ID of the current node
-func GetNodeID() string {
-	return nodeID
+// currentConfig returns a copy of the configuration the node was started with
+func currentConfig() Config {
+	nodeMutex.RLock()
+	defer nodeMutex.RUnlock()
+	return meshConfig
 }
@@ -0,0 +1,120 @@
+package mesh
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"fileshare/internal/p2p"
+)
+
+// testConfig is a node on loopback that stays off the internet, with its
+// data in a directory of the test's
+func testConfig(t *testing.T) Config {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	return Config{
+		NodeName:   "test",
+		ListenPort: port,
+		EnableTCP:  true,
+		Offline:    true,
+		DataDir:    t.TempDir(),
+	}
+}
+
+// TestConcurrentStartStop starts, stops and queries the node from many
+// goroutines at once, for the race detector
+func TestConcurrentStartStop(t *testing.T) {
+	config := testConfig(t)
+	defer StopMeshNode()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			StartMeshNode(config)
+		}()
+		go func() {
+			defer wg.Done()
+			StopMeshNode()
+		}()
+		go func() {
+			defer wg.Done()
+			GetNodeID()
+			GetConfig()
+			GetNetworkMode()
+			GetKnownPeers()
+			isRunning()
+		}()
+	}
+	wg.Wait()
+
+	// Whatever order they ran in, the node ends up stopped or running
+	// consistently and starts and stops again
+	StopMeshNode()
+	if isRunning() {
+		t.Fatal("node still running after StopMeshNode")
+	}
+	if err := StartMeshNode(config); err != nil {
+		t.Fatalf("StartMeshNode after the concurrent runs: %v", err)
+	}
+	if !isRunning() || GetNodeID() == "" {
+		t.Fatal("node isn't running with an ID after StartMeshNode")
+	}
+	if err := StartMeshNode(config); err == nil {
+		t.Error("a second StartMeshNode succeeded")
+	}
+	StopMeshNode()
+	if isRunning() {
+		t.Fatal("node still running after StopMeshNode")
+	}
+}
+
+// TestServicePortFollowsListenPort checks the TCP service listens where
+// the node's listen port puts it
+func TestServicePortFollowsListenPort(t *testing.T) {
+	config := testConfig(t)
+	if err := StartMeshNode(config); err != nil {
+		t.Fatal(err)
+	}
+	defer StopMeshNode()
+
+	address := net.JoinHostPort("127.0.0.1", strconv.Itoa(ServicePort(config.ListenPort)))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", address)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("nothing listens at %s: %v", address, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestTCPServiceAddress(t *testing.T) {
+	tests := []struct {
+		peer Peer
+		want string
+	}{
+		{Peer{Address: "10.0.0.5"}, net.JoinHostPort("10.0.0.5", strconv.Itoa(p2p.DefaultTCPPort))},
+		{Peer{Address: "10.0.0.5", Port: 9102}, "10.0.0.5:9102"},
+		{Peer{Address: "10.0.0.5:9000", Port: 9102}, "10.0.0.5:9102"},
+		{Peer{Address: "fe80::1%eth0", Port: 9102}, "[fe80::1%eth0]:9102"},
+	}
+	for _, test := range tests {
+		if got := tcpServiceAddress(&test.peer); got != test.want {
+			t.Errorf("tcpServiceAddress(%+v) = %s, want %s", test.peer, got, test.want)
+		}
+	}
+}
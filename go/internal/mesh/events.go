@@ -0,0 +1,103 @@
+package mesh
+
+import (
+	"sync"
+	"time"
+)
+
+// Events
+//
+// Subscribe lets the terminal UI and applications embedding the mesh follow
+// what happens to it instead of polling GetKnownPeers. Every subscriber has
+// a buffer of eventBuffer events; events that arrive while it is full are
+// dropped for that subscriber, so a slow subscriber never holds up the node.
+
+// EventType is what an Event reports
+type EventType string
+
+const (
+	EventPeerDiscovered     EventType = "peer_discovered"      // A peer became known
+	EventPeerOnline         EventType = "peer_online"          // A known peer was seen again
+	EventPeerOffline        EventType = "peer_offline"         // A peer went quiet or left
+	EventPeerForgotten      EventType = "peer_forgotten"       // A peer was silent long enough to be forgotten
+	EventRouteChanged       EventType = "route_changed"        // The routes to a peer changed
+	EventNetworkModeChanged EventType = "network_mode_changed" // See GetNetworkMode
+	EventNodeStarted        EventType = "node_started"
+	EventNodeStopped        EventType = "node_stopped"
+)
+
+// eventBuffer is how many events a subscriber may fall behind by
+const eventBuffer = 64
+
+// Event is a change to the mesh. Peer is set for peer and route events and
+// Mode for network mode changes.
+type Event struct {
+	Type EventType
+	Time time.Time
+	Peer *Peer
+	Mode NetworkMode
+}
+
+var subscribers = struct {
+	sync.Mutex
+	channels map[chan Event]struct{}
+}{channels: make(map[chan Event]struct{})}
+
+// Subscribe returns a channel of the events from now on and a function that
+// ends the subscription and closes the channel
+func Subscribe() (<-chan Event, func()) {
+	events := make(chan Event, eventBuffer)
+	subscribers.Lock()
+	subscribers.channels[events] = struct{}{}
+	subscribers.Unlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			subscribers.Lock()
+			delete(subscribers.channels, events)
+			subscribers.Unlock()
+			close(events)
+		})
+	}
+	return events, cancel
+}
+
+// publish hands an event to every subscriber with room for it
+func publish(event Event) {
+	event.Time = time.Now()
+
+	subscribers.Lock()
+	defer subscribers.Unlock()
+	for events := range subscribers.channels {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
+
+// publishPeer publishes a peer event with a copy of peer
+func publishPeer(eventType EventType, peer Peer) {
+	publish(Event{Type: eventType, Peer: &peer})
+}
+
+// peerStateEvents are the events of the states passed to Config.PeerStateFunc
+var peerStateEvents = map[string]EventType{
+	PeerOnline:    EventPeerOnline,
+	PeerOffline:   EventPeerOffline,
+	PeerForgotten: EventPeerForgotten,
+}
+
+// sameRoutes reports whether two route lists are the same, in the same order
+func sameRoutes(a, b []Route) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,106 @@
+package mesh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"fileshare/internal/p2p"
+)
+
+// Forwarding
+//
+// Peers only reachable through others are connected to with a routed stream
+// of the TCP service (see p2p.TCPManager.DialRoute). Every node on the way
+// sends the stream to the destination when it reaches it directly, or else
+// to the next hop of its best route there. The destination connects the
+// stream to the local port the sender asked for, typically a receiver's.
+// Routed addresses name the peer by node ID in place of a host, as in
+// node-5f0c2a9e81d34b7a96e2d10c4fa8b3e7:9000.
+
+// localDialTimeout bounds how long connecting a routed stream to a local port may take
+const localDialTimeout = 5 * time.Second
+
+// DialRoute connects to a routed address through the nodes on the way. It
+// suits transfer.TransferOptions.Dial.
+func DialRoute(ctx context.Context, address string) (net.Conn, error) {
+	if !isRunning() {
+		return nil, errors.New("mesh node is not running")
+	}
+	peerID, portText, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portText)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in %s", address)
+	}
+	return p2p.GetTCPManager().DialRoute(ctx, peerID, port)
+}
+
+// nextHop gives the address of the TCP service a stream to destination goes
+// to next
+func nextHop(destination string) (string, error) {
+	peersMutex.RLock()
+	defer peersMutex.RUnlock()
+
+	peer := knownPeers[destination]
+	if peer == nil {
+		return "", fmt.Errorf("%s is not a known peer", destination)
+	}
+	if peer.IsOnline && peer.Address != "" && peer.GossipOrigin == "" {
+		return tcpServiceAddress(peer), nil
+	}
+	// Routes are best first
+	for _, route := range peer.Routes {
+		if hop := knownPeers[route.NextHop]; hop != nil && hop.IsOnline && hop.Address != "" && hop.GossipOrigin == "" {
+			return tcpServiceAddress(hop), nil
+		}
+	}
+	return "", fmt.Errorf("no route to %s", peer.Name)
+}
+
+// tcpServiceAddress is where a peer's TCP service listens
+func tcpServiceAddress(peer *Peer) string {
+	return net.JoinHostPort(peerHost(peer.Address), strconv.Itoa(peer.servicePort()))
+}
+
+// acceptRoutedConnection connects a stream another node opened to this one
+// to the local port it asked for
+func acceptRoutedConnection(conn net.Conn, port int) error {
+	if port == 0 {
+		// Port 0 is the TCP service, see ConnectToPeer
+		go p2p.GetTCPManager().ServeConn(conn)
+		return nil
+	}
+
+	local, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), localDialTimeout)
+	if err != nil {
+		return fmt.Errorf("nothing is listening on port %d", port)
+	}
+	go func() {
+		done := make(chan struct{}, 2)
+		go func() {
+			io.Copy(local, conn)
+			done <- struct{}{}
+		}()
+		go func() {
+			io.Copy(conn, local)
+			done <- struct{}{}
+		}()
+		<-done
+		conn.Close()
+		local.Close()
+	}()
+	return nil
+}
+
+// connectViaMesh opens a stream to the TCP service of peer through the
+// nodes on the way, see acceptRoutedConnection
+func connectViaMesh(peer *Peer) (net.Conn, error) {
+	return p2p.GetTCPManager().DialRoute(context.Background(), peer.ID, 0)
+}
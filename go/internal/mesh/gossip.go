@@ -0,0 +1,172 @@
+package mesh
+
+import (
+	"sort"
+	"time"
+
+	"fileshare/internal/access"
+	"fileshare/internal/p2p"
+)
+
+// Peer exchange
+//
+// Discovery only finds peers on the local network, so every
+// peerExchangeInterval a node shares with the nodes it is connected to the
+// maxExchangedPeers peers it saw most recently that it has an address for,
+// with those addresses. Receivers add the peers they don't know, or know
+// no address for, as unverified: GossipOrigin names the node that saw them,
+// they don't count as reached directly and they are shared on with that
+// origin until the node sees or contacts them itself.
+//
+// Records age as they travel, since a peer's LastSeen isn't refreshed by
+// hearing of it, and records last seen more than peerExchangeMaxAge ago are
+// neither shared nor taken, so they die out instead of circling the mesh.
+// Records about the receiver or that it originated are dropped. Peers that
+// took another's name (see keys.go) are left out both ways.
+//
+// Config.EnablePeerExchange turns it off in both directions, for nodes that
+// shouldn't tell others who they have seen.
+
+const (
+	// maxExchangedPeers bounds how many peers one exchange shares
+	maxExchangedPeers = 32
+
+	// peerExchangeMaxAge is how long ago a peer may have been seen to be shared
+	peerExchangeMaxAge = 30 * time.Minute
+
+	// peerExchangeTimeout bounds how long sharing the peers may take
+	peerExchangeTimeout = 2 * time.Second
+)
+
+func maintainPeerExchange(r *nodeRun) {
+	for r.active() {
+		powerSleep(peerExchangeInterval)
+		if r.active() && currentConfig().EnablePeerExchange {
+			sharePeers()
+		}
+	}
+}
+
+// sharePeers sends the most recently seen peers to the connected nodes
+func sharePeers() {
+	self := GetNodeID()
+	now := time.Now()
+
+	peersMutex.RLock()
+	var candidates []*Peer
+	for _, peer := range knownPeers {
+		if peer.Address == "" || (peer.Protocol != "tcp" && peer.Protocol != ProtocolMesh) ||
+			now.Sub(peer.LastSeen) > peerExchangeMaxAge || conflicting(peer) {
+			continue
+		}
+		candidates = append(candidates, peer)
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].LastSeen.After(candidates[j].LastSeen) })
+	if len(candidates) > maxExchangedPeers {
+		candidates = candidates[:maxExchangedPeers]
+	}
+	records := make([]p2p.PeerRecord, len(candidates))
+	for i, peer := range candidates {
+		origin := peer.GossipOrigin
+		if origin == "" {
+			origin = self
+		}
+		records[i] = p2p.PeerRecord{
+			ID:        peer.ID,
+			Name:      peer.Name,
+			Addresses: append([]string{peer.Address}, peer.Addresses...),
+			Age:       int(now.Sub(peer.LastSeen).Seconds()),
+			Origin:    origin,
+		}
+	}
+	peersMutex.RUnlock()
+
+	if len(records) > 0 {
+		p2p.GetTCPManager().SharePeers(self, records, peerExchangeTimeout)
+	}
+}
+
+// learnPeers adds the peers a connected node shared that this node doesn't
+// know, as unverified
+func learnPeers(from string, records []p2p.PeerRecord) {
+	if !currentConfig().EnablePeerExchange {
+		return
+	}
+	self := GetNodeID()
+	now := time.Now()
+	blocked, _ := access.LoadBlocklist()
+
+	var discovered []Peer
+	changed := false
+	peersMutex.Lock()
+	for _, record := range records {
+		age := time.Duration(record.Age) * time.Second
+		if record.ID == "" || record.ID == self || record.Origin == self || len(record.Addresses) == 0 ||
+			record.Age < 0 || age > peerExchangeMaxAge || blocked.Match(record.ID, record.Addresses[0]) != nil {
+			continue
+		}
+		if record.Origin == "" {
+			record.Origin = from
+		}
+		lastSeen := now.Add(-age)
+
+		known, exists := knownPeers[record.ID]
+		switch {
+		case !exists:
+			peer := Peer{ID: record.ID, Name: record.Name, Protocol: "tcp"}
+			if keyConflict(peer) != nil {
+				continue
+			}
+			known = &peer
+			knownPeers[record.ID] = known
+		case known.GossipOrigin != "" && lastSeen.After(known.LastSeen):
+			// Fresher news of a peer still unverified
+		case known.Address == "" && known.GossipOrigin == "":
+			// Reached through the mesh, now with an address
+		default:
+			continue
+		}
+		if known.Name == "" {
+			known.Name = record.Name
+		}
+		known.Address = record.Addresses[0]
+		known.Addresses = pastAddresses(known.Address, record.Addresses[1:])
+		known.GossipOrigin = record.Origin
+		if lastSeen.After(known.LastSeen) {
+			known.LastSeen = lastSeen
+		}
+		if !exists {
+			discovered = append(discovered, *known)
+		}
+		changed = true
+	}
+	peersMutex.Unlock()
+
+	if changed {
+		saveKnownPeers()
+	}
+	for _, peer := range discovered {
+		publishPeer(EventPeerDiscovered, peer)
+	}
+}
+
+// peerContacted marks a peer this node connected to as verified and online
+func peerContacted(id string) {
+	peersMutex.Lock()
+	peer := knownPeers[id]
+	if peer == nil {
+		peersMutex.Unlock()
+		return
+	}
+	peer.GossipOrigin = ""
+	peer.LastSeen = time.Now()
+	wasOnline := peer.IsOnline
+	peer.IsOnline = true
+	change := peerChange{*peer, PeerOnline}
+	peersMutex.Unlock()
+
+	saveKnownPeers()
+	if !wasOnline {
+		notifyPeerStates([]peerChange{change})
+	}
+}
@@ -0,0 +1,105 @@
+package mesh
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Display handles give peers short names (#1, #2, ...) that stay the same for
+// the whole session, so a row printed by 'list' or 'scan' can be referred to
+// in a follow-up command. Numbers are never reused: when a peer disappears
+// from a listing its handle is invalidated instead of moving to another peer.
+
+// HandleTarget is what a display handle refers to
+type HandleTarget struct {
+	ID      string
+	Name    string
+	Address string
+}
+
+type handleEntry struct {
+	target HandleTarget
+	valid  bool
+}
+
+var (
+	handleByID   = make(map[string]int)
+	handleTable  = make(map[int]*handleEntry)
+	nextHandle   = 1
+	handlesMutex sync.Mutex
+)
+
+// AssignHandles gives every peer in a listing a handle, keeping existing ones,
+// and invalidates the handles of peers that are no longer listed
+func AssignHandles(targets []HandleTarget) []string {
+	handlesMutex.Lock()
+	defer handlesMutex.Unlock()
+
+	listed := make(map[int]bool, len(targets))
+	result := make([]string, len(targets))
+
+	for i, target := range targets {
+		n, exists := handleByID[target.ID]
+		if !exists {
+			n = nextHandle
+			nextHandle++
+			handleByID[target.ID] = n
+		}
+
+		handleTable[n] = &handleEntry{target: target, valid: true}
+		listed[n] = true
+		result[i] = "#" + strconv.Itoa(n)
+	}
+
+	for n, entry := range handleTable {
+		if !listed[n] {
+			entry.valid = false
+		}
+	}
+
+	return result
+}
+
+// IsHandle reports whether a peer identifier is a display handle like "#2"
+func IsHandle(ref string) bool {
+	return strings.HasPrefix(ref, "#") && len(ref) > 1
+}
+
+// ResolveHandle returns the peer a display handle refers to
+func ResolveHandle(handle string) (HandleTarget, error) {
+	n, err := strconv.Atoi(strings.TrimPrefix(handle, "#"))
+	if err != nil {
+		return HandleTarget{}, fmt.Errorf("invalid peer handle: %s", handle)
+	}
+
+	handlesMutex.Lock()
+	defer handlesMutex.Unlock()
+
+	entry, exists := handleTable[n]
+	if !exists {
+		return HandleTarget{}, fmt.Errorf("unknown peer handle %s. Run 'list' or 'scan' to see current handles", handle)
+	}
+	if !entry.valid {
+		return HandleTarget{}, fmt.Errorf("peer handle %s referred to %s, which is no longer in the peer list. Run 'list' or 'scan' again",
+			handle, entry.target.Name)
+	}
+
+	return entry.target, nil
+}
+
+// SortPeers orders peers online first, then by name, then by ID
+func SortPeers(peers []Peer) {
+	sort.SliceStable(peers, func(i, j int) bool {
+		if peers[i].IsOnline != peers[j].IsOnline {
+			return peers[i].IsOnline
+		}
+		nameI, nameJ := strings.ToLower(peers[i].Name), strings.ToLower(peers[j].Name)
+		if nameI != nameJ {
+			return nameI < nameJ
+		}
+		return peers[i].ID < peers[j].ID
+	})
+}
@@ -0,0 +1,257 @@
+package mesh
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"fileshare/internal/p2p"
+)
+
+// Heartbeats
+//
+// A peer that goes away without a DEPART would stay online until prune.go
+// finds it silent for Config.OfflineAfter. Every Config.HeartbeatInterval the
+// node checks on the online peers it reaches: peers reached directly over
+// TCP get a PING on their TCP service, and those that don't answer it, such
+// as nodes only seen by discovery whose TCP service can't be reached, a
+// discovery query sent to them alone. Peers only reachable through a relay
+// are pinged through it only while a session with them is open, so
+// heartbeats never keep relays busy on their own; peers reached through
+// other nodes are left to the routing. A peer that answers is seen again,
+// and one that misses Config.HeartbeatMisses heartbeats in a row goes
+// offline, which subscribers learn as EventPeerOffline.
+
+const (
+	// DefaultHeartbeatInterval is how often peers are checked on unless
+	// Config.HeartbeatInterval says otherwise
+	DefaultHeartbeatInterval = 30 * time.Second
+
+	// DefaultHeartbeatMisses is how many heartbeats in a row a peer may miss
+	// unless Config.HeartbeatMisses says otherwise
+	DefaultHeartbeatMisses = 3
+
+	// heartbeatTimeout bounds waiting for a discovery answer or a PING
+	// through a relay
+	heartbeatTimeout = 2 * time.Second
+)
+
+var heartbeats = struct {
+	sync.Mutex
+	misses map[string]int // Heartbeats missed in a row per peer
+}{misses: make(map[string]int)}
+
+// heartbeatTarget is a peer to check on and how
+type heartbeatTarget struct {
+	id      string
+	address string // Of the peer's TCP service
+	relayed bool
+}
+
+func maintainHeartbeats(r *nodeRun) {
+	for r.active() {
+		interval := currentConfig().HeartbeatInterval
+		if interval < 0 {
+			// Off, until Reconfigure turns them on
+			powerSleep(DefaultHeartbeatInterval)
+			continue
+		}
+		powerSleep(interval)
+		if r.active() && sendHeartbeats() {
+			updateRoutes()
+		}
+	}
+}
+
+// sendHeartbeats checks on the online peers and reports whether any went
+// offline
+func sendHeartbeats() bool {
+	var targets []heartbeatTarget
+	peersMutex.RLock()
+	for id, peer := range knownPeers {
+		if !peer.IsOnline || peer.GossipOrigin != "" {
+			continue
+		}
+		target := heartbeatTarget{id: id, address: tcpServiceAddress(peer)}
+		if peer.Address == "" || peer.Protocol != "tcp" {
+			target.relayed = true
+		}
+		targets = append(targets, target)
+	}
+	peersMutex.RUnlock()
+
+	var wg sync.WaitGroup
+	answered := make([]bool, len(targets))
+	checked := make([]bool, len(targets))
+	for i, target := range targets {
+		if target.relayed && (!currentConfig().EnableRelay || !relaySessionActive(target.id)) {
+			continue
+		}
+		checked[i] = true
+		wg.Add(1)
+		go func(i int, target heartbeatTarget) {
+			defer wg.Done()
+			answered[i] = heartbeat(target)
+		}(i, target)
+	}
+	wg.Wait()
+
+	limit := currentConfig().HeartbeatMisses
+	var seen, gone []string
+	heartbeats.Lock()
+	misses := make(map[string]int, len(targets))
+	for i, target := range targets {
+		switch {
+		case !checked[i]:
+		case answered[i]:
+			seen = append(seen, target.id)
+		default:
+			misses[target.id] = heartbeats.misses[target.id] + 1
+			if misses[target.id] >= limit {
+				gone = append(gone, target.id)
+				delete(misses, target.id)
+			}
+		}
+	}
+	heartbeats.misses = misses
+	heartbeats.Unlock()
+
+	now := time.Now()
+	var changes []peerChange
+	peersMutex.Lock()
+	for _, id := range seen {
+		if peer := knownPeers[id]; peer != nil {
+			peer.LastSeen = now
+		}
+	}
+	for _, id := range gone {
+		if peer := knownPeers[id]; peer != nil && peer.IsOnline {
+			peer.IsOnline = false
+			changes = append(changes, peerChange{*peer, PeerOffline})
+		}
+	}
+	peersMutex.Unlock()
+
+	if len(changes) > 0 {
+		saveKnownPeers()
+	}
+	notifyPeerStates(changes)
+	return len(changes) > 0
+}
+
+// heartbeat reports whether the peer answered
+func heartbeat(target heartbeatTarget) bool {
+	if target.relayed {
+		conn, err := p2p.GetTCPManager().Secure(func() (net.Conn, error) {
+			return DialRelay(target.id)
+		}, heartbeatTimeout)
+		if err != nil {
+			return false
+		}
+		defer conn.Close()
+		return p2p.Ping(conn, heartbeatTimeout) == nil
+	}
+
+	if _, err := pingPeer(target.address); err == nil {
+		return true
+	}
+	host, port, err := net.SplitHostPort(target.address)
+	if err != nil {
+		return false
+	}
+	portNumber, _ := strconv.Atoi(port)
+	peer, err := p2p.GetTCPManager().QueryPeer(host, portNumber, heartbeatTimeout)
+	return err == nil && peer.ID == target.id
+}
+
+// peerConnectionLost checks on the peers at address at once when the TCP
+// service closed a connection with them for not answering keepalives, and
+// takes those that don't answer a heartbeat either offline
+func peerConnectionLost(peerID, address string) {
+	host := peerHost(address)
+	var targets []heartbeatTarget
+	peersMutex.RLock()
+	for id, peer := range knownPeers {
+		if peer.IsOnline && peer.GossipOrigin == "" && peer.Protocol == "tcp" && peerHost(peer.Address) == host {
+			targets = append(targets, heartbeatTarget{id: id, address: tcpServiceAddress(peer)})
+		}
+	}
+	peersMutex.RUnlock()
+
+	var gone []string
+	for _, target := range targets {
+		if !heartbeat(target) {
+			gone = append(gone, target.id)
+		}
+	}
+	if len(gone) == 0 {
+		return
+	}
+
+	var changes []peerChange
+	heartbeats.Lock()
+	peersMutex.Lock()
+	for _, id := range gone {
+		delete(heartbeats.misses, id)
+		if peer := knownPeers[id]; peer != nil && peer.IsOnline {
+			peer.IsOnline = false
+			changes = append(changes, peerChange{*peer, PeerOffline})
+		}
+	}
+	peersMutex.Unlock()
+	heartbeats.Unlock()
+
+	if len(changes) > 0 {
+		saveKnownPeers()
+		notifyPeerStates(changes)
+		updateRoutes()
+	}
+}
+
+// keepReconnecting tells the TCP service whether a dropped connection to the
+// peer with peerID, or any at host when it never said who it is, is worth
+// opening again: while the peer is online, or not known yet (see
+// p2p/reconnect.go)
+func keepReconnecting(peerID, host string) bool {
+	peersMutex.RLock()
+	defer peersMutex.RUnlock()
+	if peer := knownPeers[peerID]; peer != nil {
+		return peer.IsOnline
+	}
+	known := false
+	for _, peer := range knownPeers {
+		if peer.GossipOrigin != "" || peerHost(peer.Address) != host {
+			continue
+		}
+		if peer.IsOnline {
+			return true
+		}
+		known = true
+	}
+	return !known
+}
+
+// peerReconnected takes the peers at host back online when the TCP service
+// connected to them again, and routes through them again
+func peerReconnected(peerID, host string) {
+	var changes []peerChange
+	peersMutex.Lock()
+	for id, peer := range knownPeers {
+		if id != peerID && (peer.GossipOrigin != "" || peerHost(peer.Address) != host) {
+			continue
+		}
+		peer.LastSeen = time.Now()
+		if !peer.IsOnline {
+			peer.IsOnline = true
+			changes = append(changes, peerChange{*peer, PeerOnline})
+		}
+	}
+	peersMutex.Unlock()
+
+	if len(changes) > 0 {
+		saveKnownPeers()
+		notifyPeerStates(changes)
+	}
+	updateRoutes()
+}
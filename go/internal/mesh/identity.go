@@ -0,0 +1,155 @@
+package mesh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"fileshare/internal/p2p"
+)
+
+// Node identity
+//
+// A node is known to its peers by an ID derived from its Ed25519 public key,
+// see p2p/identity.go, so that it can prove the ID is its own. The key pair
+// is generated the first time the node starts and kept in node_key.pem in
+// the data directory, readable only by its owner, with the ID in
+// identity.json; nodes from releases before keys get a key pair, and with
+// it a new ID, the first time they start. Config.NodeID, when set, is used
+// instead and not saved, and peers can't verify it. ResetIdentity generates
+// a new key pair for the next start, after which peers see a new node.
+
+const (
+	identityFile = "identity.json"
+	nodeKeyFile  = "node_key.pem"
+)
+
+// storedIdentity is what identity.json holds
+type storedIdentity struct {
+	NodeID  string    `json:"node_id"`
+	Created time.Time `json:"created"`
+}
+
+// NodeIdentity returns the ID this node starts with, generating and saving
+// a key pair and the ID the first time
+func NodeIdentity() (string, error) {
+	id, _, err := loadIdentity()
+	return id, err
+}
+
+// NodeKey returns the key pair the node proves its ID with, generating and
+// saving it the first time
+func NodeKey() (ed25519.PrivateKey, error) {
+	_, key, err := loadIdentity()
+	return key, err
+}
+
+// ResetIdentity replaces the saved key pair and node ID with new ones and
+// returns the ID. The node uses it from the next time it starts.
+func ResetIdentity() (string, error) {
+	dir, err := dataDir()
+	if err != nil {
+		return "", err
+	}
+	id, _, err := saveNewIdentity(dir)
+	return id, err
+}
+
+func loadIdentity() (string, ed25519.PrivateKey, error) {
+	dir, err := dataDir()
+	if err != nil {
+		return "", nil, err
+	}
+	path := filepath.Join(dir, identityFile)
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return saveNewIdentity(dir)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	var stored storedIdentity
+	if err := json.Unmarshal(data, &stored); err != nil || !validNodeID(stored.NodeID) {
+		return "", nil, fmt.Errorf("%s is corrupt, run 'bitshare id --reset' to make a new identity", path)
+	}
+
+	key, err := readNodeKey(filepath.Join(dir, nodeKeyFile))
+	if os.IsNotExist(err) {
+		// Saved by a release before node keys
+		return saveNewIdentity(dir)
+	}
+	if err != nil || p2p.NodeIDForKey(key.Public().(ed25519.PublicKey)) != stored.NodeID {
+		return "", nil, fmt.Errorf("%s doesn't match %s, run 'bitshare id --reset' to make a new identity", nodeKeyFile, path)
+	}
+	return stored.NodeID, key, nil
+}
+
+func saveNewIdentity(dir string) (string, ed25519.PrivateKey, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", nil, fmt.Errorf("could not generate a node key: %v", err)
+	}
+	if err := writeNodeKey(filepath.Join(dir, nodeKeyFile), key); err != nil {
+		return "", nil, fmt.Errorf("could not save the node key: %v", err)
+	}
+	id := p2p.NodeIDForKey(key.Public().(ed25519.PublicKey))
+	if err := writeJSONFile(filepath.Join(dir, identityFile), storedIdentity{NodeID: id, Created: time.Now()}); err != nil {
+		return "", nil, fmt.Errorf("could not save the node identity: %v", err)
+	}
+	return id, key, nil
+}
+
+func readNodeKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, errors.New("not a PEM private key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an Ed25519 key")
+	}
+	return key, nil
+}
+
+// writeNodeKey writes the key where only its owner can read it, atomically
+// like writeJSONFile
+func writeNodeKey(path string, key ed25519.PrivateKey) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// validNodeID reports whether id looks like a node ID: "node-" and 128 bits
+// in hex
+func validNodeID(id string) bool {
+	digits, ok := strings.CutPrefix(id, "node-")
+	if !ok || len(digits) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(digits)
+	return err == nil
+}
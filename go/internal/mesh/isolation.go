@@ -0,0 +1,186 @@
+package mesh
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"fileshare/internal/p2p"
+	"fileshare/internal/utils"
+)
+
+// Client isolation
+//
+// Networks with client isolation, common on public WiFi, let devices reach
+// the router but not each other. Discovery still works through the router's
+// broadcast and multicast, so peers that answer it but take no TCP
+// connection are the sign of it. After a discovery round up to
+// isolationProbes of the peers that answered are dialed on the port they
+// advertised, and the network is taken to isolate clients when none of them
+// takes the connection.
+//
+// The verdict is kept with how far it can be trusted: high when a connection
+// worked or several peers refused, low when a single peer could be tried,
+// unknown before any peer answered. Peers are probed again after discovery
+// rounds until the verdict is of high confidence, and the verdict starts
+// over when the network interfaces change. Only isolation known with high
+// confidence is reported and switches the node to relay mode.
+
+// Confidence in the client isolation verdict, ConnectionInfo.IsolationConfidence
+const (
+	IsolationUnknown = "unknown"
+	IsolationLow     = "low"
+	IsolationHigh    = "high"
+)
+
+const (
+	// isolationProbes is how many discovered peers are dialed at most
+	isolationProbes = 3
+
+	// isolationProbeTimeout bounds each connection attempt
+	isolationProbeTimeout = time.Second
+)
+
+// isolationInterfaces are the local addresses the verdict was reached
+// with, guarded by nodeMutex
+var isolationInterfaces string
+
+// probeIsolation tries connecting to peers discovery found, unless the
+// verdict is already of high confidence
+func probeIsolation(found []p2p.PeerInfo) {
+	interfaces := localInterfaces()
+	nodeMutex.RLock()
+	settled := connectionInfo.IsolationConfidence == IsolationHigh && interfaces == isolationInterfaces
+	nodeMutex.RUnlock()
+	if settled {
+		return
+	}
+
+	isolated, confidence := detectClientIsolation(found)
+	if confidence == IsolationUnknown {
+		return
+	}
+	config := currentConfig()
+
+	nodeMutex.Lock()
+	wasWarned := connectionInfo.ClientIsolation && connectionInfo.IsolationConfidence == IsolationHigh
+	previous := connectionInfo.Mode
+	connectionInfo.ClientIsolation, connectionInfo.IsolationConfidence = isolated, confidence
+	connectionInfo.Mode = isolationMode(connectionInfo, config)
+	isolationInterfaces = interfaces
+	mode := connectionInfo.Mode
+	nodeMutex.Unlock()
+
+	if mode != previous {
+		publish(Event{Type: EventNetworkModeChanged, Mode: mode})
+	}
+	if isolated && confidence == IsolationHigh && !wasWarned {
+		warnIsolation(config)
+	}
+}
+
+// detectClientIsolation dials up to isolationProbes of the TCP peers
+// discovery found and returns whether the network isolates clients, and
+// how sure that is
+func detectClientIsolation(found []p2p.PeerInfo) (bool, string) {
+	self := GetNodeID()
+	var candidates []p2p.PeerInfo
+	for _, peer := range found {
+		if peer.Protocol == "tcp" && peer.Address != "" && peer.ID != self {
+			candidates = append(candidates, peer)
+		}
+	}
+	if len(candidates) == 0 {
+		return false, IsolationUnknown
+	}
+	if len(candidates) > isolationProbes {
+		candidates = candidates[:isolationProbes]
+	}
+
+	reached := make(chan bool, len(candidates))
+	for _, peer := range candidates {
+		go func(peer p2p.PeerInfo) {
+			port := peer.Port
+			if port == 0 {
+				port = p2p.DefaultTCPPort
+			}
+			conn, err := net.DialTimeout("tcp", net.JoinHostPort(peer.Address, strconv.Itoa(port)), isolationProbeTimeout)
+			if err == nil {
+				conn.Close()
+			}
+			reached <- err == nil
+		}(peer)
+	}
+	for range candidates {
+		if <-reached {
+			return false, IsolationHigh
+		}
+	}
+	if len(candidates) == 1 {
+		return true, IsolationLow
+	}
+	return true, IsolationHigh
+}
+
+// isolationMode is the network mode the isolation verdict in info calls for
+func isolationMode(info ConnectionInfo, config Config) NetworkMode {
+	switch {
+	case !info.ClientIsolation:
+		return DirectMode
+	case info.IsolationConfidence != IsolationHigh:
+		// Some peers may still be reached directly
+		return MixedMode
+	case !config.EnableRelay && config.EnableWiFiDirect:
+		return MixedMode
+	default:
+		return RelayMode // Even with relaying disabled, nothing else works
+	}
+}
+
+// resetIsolation forgets the verdict when the network interfaces changed
+// since it was reached, with nodeMutex held
+func resetIsolation(info *ConnectionInfo, interfaces string) {
+	if interfaces == isolationInterfaces {
+		return
+	}
+	info.ClientIsolation, info.IsolationConfidence = false, IsolationUnknown
+	isolationInterfaces = interfaces
+}
+
+// interfacesChanged reports whether the network interfaces changed since
+// the isolation verdict was reached
+func interfacesChanged() bool {
+	interfaces := localInterfaces()
+	nodeMutex.RLock()
+	defer nodeMutex.RUnlock()
+	return interfaces != isolationInterfaces
+}
+
+// localInterfaces sums up the local addresses, to notice the node moving
+// to another network
+func localInterfaces() string {
+	ips, _ := utils.GetAllLocalIPs()
+	sort.Strings(ips)
+	return strings.Join(ips, ",")
+}
+
+// warnIsolation tells the user the network isolates clients, and what the
+// node does about it
+func warnIsolation(config Config) {
+	fmt.Println("⚠️ Client isolation detected in your network")
+	fmt.Println("→ Direct peer connections may be restricted")
+
+	if config.EnableWiFiDirect {
+		fmt.Println("→ Will attempt WiFi Direct for direct connections")
+	}
+
+	if config.EnableRelay {
+		fmt.Println("→ Using relay servers for restricted connections")
+	} else {
+		fmt.Println("⚠️ Relay mode is disabled. Some peers may be unreachable")
+		fmt.Println("→ Enable relay with --enable-relay flag to improve connectivity")
+	}
+}
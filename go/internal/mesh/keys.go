@@ -0,0 +1,129 @@
+package mesh
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"fileshare/internal/p2p"
+)
+
+// Peer keys
+//
+// A peer's public key is remembered the first time it proves its ID with
+// it, see p2p/identity.go. As IDs derive from keys, a node claiming the name
+// of a peer seen before with a key can only do so under another ID: it is
+// kept as a separate peer marked with KeyConflict, reported loudly, and not
+// found by that name, only by its ID or an alias. Connections check that
+// the node at the other end is the peer they were made for.
+
+// directConnectTimeout bounds connecting to a peer's TCP service and
+// asking it who it is
+const directConnectTimeout = 5 * time.Second
+
+// Fingerprint returns the fingerprint of the peer's key, or "" when it
+// hasn't proved one
+func (p Peer) Fingerprint() string {
+	return p2p.Fingerprint(p.PublicKey)
+}
+
+// hasKey reports whether the peer with nodeID proved a key, so the TCP
+// service refuses nodes claiming its ID without proving it
+func hasKey(nodeID string) bool {
+	peersMutex.RLock()
+	defer peersMutex.RUnlock()
+	peer := knownPeers[nodeID]
+	return peer != nil && peer.PublicKey != nil
+}
+
+// keyConflict returns the peer seen before with a key under the name of
+// peer, when peer has another ID, with peersMutex held
+func keyConflict(peer Peer) *Peer {
+	if peer.Name == "" {
+		return nil
+	}
+	for _, known := range knownPeers {
+		if known.ID != peer.ID && known.PublicKey != nil && known.Name == peer.Name && !bytes.Equal(known.PublicKey, peer.PublicKey) {
+			return known
+		}
+	}
+	return nil
+}
+
+// conflicting reports whether peer took the name of a peer that is still
+// known, with peersMutex held
+func conflicting(peer *Peer) bool {
+	return peer.KeyConflict != "" && knownPeers[peer.KeyConflict] != nil
+}
+
+// warnKeyConflict tells the user a new node took the name of a peer seen
+// before with another key
+func warnKeyConflict(peer, previous Peer) {
+	fingerprint := peer.Fingerprint()
+	if fingerprint == "" {
+		fingerprint = "none"
+	}
+	fmt.Printf("🚨 A node at %s calls itself %s but its key (fingerprint %s) is not the one %s (%s) had before (fingerprint %s).\n",
+		peer.Address, peer.Name, fingerprint, previous.Name, previous.ID, previous.Fingerprint())
+	fmt.Printf("   It may be impersonating %s, or be another machine with the same name. It is only reachable by its ID, %s.\n",
+		previous.Name, peer.ID)
+}
+
+// authenticatePeer checks that the node at the other end of conn, a
+// connection to its TCP service, is peer, remembers the key it proves its
+// ID with, and returns who it proved to be
+func authenticatePeer(conn net.Conn, peer *Peer, timeout time.Duration) (p2p.Identity, error) {
+	if err := p2p.Ping(conn, timeout); err != nil {
+		return p2p.Identity{}, err
+	}
+
+	identity, err := p2p.Authenticate(conn, timeout)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() && peer.PublicKey == nil && currentConfig().Network == "" {
+		// Releases before node keys don't answer, and never had one, nor
+		// private networks
+		return p2p.Identity{NodeID: peer.ID, Name: peer.Name}, nil
+	}
+	if err != nil {
+		return p2p.Identity{}, fmt.Errorf("could not verify %s: %w", peer.Name, err)
+	}
+
+	if identity.NodeID != peer.ID {
+		return p2p.Identity{}, fmt.Errorf("%s at %s answered as another node, %s (fingerprint %s), refusing to connect",
+			peer.Name, peer.Address, identity.NodeID, fingerprintOrNone(identity.PublicKey))
+	}
+	if identity.PublicKey == nil {
+		if peer.PublicKey != nil {
+			return p2p.Identity{}, fmt.Errorf("%s didn't prove its identity though it did before (fingerprint %s), refusing to connect",
+				peer.Name, peer.Fingerprint())
+		}
+		return identity, nil
+	}
+
+	if peer.PublicKey == nil {
+		peersMutex.Lock()
+		if known := knownPeers[peer.ID]; known != nil {
+			known.PublicKey = identity.PublicKey
+		}
+		peersMutex.Unlock()
+		saveKnownPeers()
+	}
+	return identity, nil
+}
+
+func fingerprintOrNone(key []byte) string {
+	if fingerprint := p2p.Fingerprint(key); fingerprint != "" {
+		return fingerprint
+	}
+	return "none"
+}
+
+// connectDirectly connects to the TCP service of peer
+func connectDirectly(peer *Peer) (net.Conn, error) {
+	if peer.Address == "" {
+		return nil, errors.New("no known address")
+	}
+	return net.DialTimeout("tcp", tcpServiceAddress(peer), directConnectTimeout)
+}
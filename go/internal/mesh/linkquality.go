@@ -0,0 +1,200 @@
+package mesh
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"fileshare/internal/p2p"
+)
+
+// Link quality
+//
+// Every linkProbeInterval the node pings each online peer it reaches over
+// TCP and keeps a smoothed round trip time and share of pings lost per peer,
+// the way TCP smooths its RTT. A lossless link with an RTT of halfQualityRTT
+// has quality 50%, faster links more and slower ones less, and losses take
+// their share off: this is the quality of the direct links routes are
+// computed from, and what Peer.ConnectionQuality shows. Peers not measured
+// yet count as perfect links, as before. When a link's quality moves by
+// qualityChangeThreshold from what the routes were computed with, they are
+// computed again without waiting for the next routing pass.
+
+const (
+	// linkProbeTimeout bounds connecting to a peer and waiting for its pong
+	linkProbeTimeout = 2 * time.Second
+
+	// rttGain and lossGain are the weights of a new sample in the estimates
+	rttGain  = 1.0 / 8
+	lossGain = 1.0 / 4
+
+	// halfQualityRTT is the round trip time of a lossless link of quality 50%
+	halfQualityRTT = 100 * time.Millisecond
+
+	// qualityChangeThreshold is how many points a link's quality moves
+	// before routes are computed again
+	qualityChangeThreshold = 10
+)
+
+// linkEstimate is what is known about the link to a peer
+type linkEstimate struct {
+	rtt     time.Duration // Smoothed, zero until a ping was answered
+	loss    float64       // Smoothed share of pings that went unanswered
+	quality int           // 1-100%
+	routed  int           // The quality routes were last computed with, 0 if none
+}
+
+var linkTable = struct {
+	sync.Mutex
+	links map[string]*linkEstimate
+}{links: make(map[string]*linkEstimate)}
+
+func maintainLinkQuality(r *nodeRun) {
+	for r.active() {
+		if probeLinks() {
+			updateRoutes()
+		}
+		powerSleep(linkProbeInterval)
+	}
+}
+
+// probeLinks pings the peers reached over TCP and updates their link
+// estimates, and reports whether a quality moved enough to recompute routes
+func probeLinks() bool {
+	peersMutex.RLock()
+	addresses := make(map[string]string)
+	for id, peer := range knownPeers {
+		if peer.IsOnline && peer.Address != "" && peer.Protocol == "tcp" && peer.GossipOrigin == "" {
+			addresses[id] = tcpServiceAddress(peer)
+		}
+	}
+	peersMutex.RUnlock()
+
+	var wg sync.WaitGroup
+	var samplesMutex sync.Mutex
+	samples := make(map[string]time.Duration, len(addresses)) // Zero when lost
+	for id, address := range addresses {
+		wg.Add(1)
+		go func(id, address string) {
+			defer wg.Done()
+			rtt, err := pingPeer(address)
+			if err != nil {
+				rtt = 0
+			}
+			samplesMutex.Lock()
+			samples[id] = rtt
+			samplesMutex.Unlock()
+		}(id, address)
+	}
+	wg.Wait()
+
+	descriptions := make(map[string]string, len(samples))
+	reroute := false
+	linkTable.Lock()
+	for id := range linkTable.links {
+		if _, probed := samples[id]; !probed {
+			delete(linkTable.links, id)
+		}
+	}
+	for id, rtt := range samples {
+		link := linkTable.links[id]
+		if link == nil {
+			link = &linkEstimate{}
+			linkTable.links[id] = link
+		}
+		link.add(rtt)
+		if link.routed != 0 && abs(link.quality-link.routed) >= qualityChangeThreshold {
+			reroute = true
+		}
+		descriptions[id] = link.String()
+	}
+	linkTable.Unlock()
+
+	peersMutex.Lock()
+	for id, peer := range knownPeers {
+		peer.ConnectionQuality = descriptions[id]
+	}
+	peersMutex.Unlock()
+	return reroute
+}
+
+// pingPeer returns how long the peer whose TCP service is at address takes
+// to answer a ping over it, not counting the connection setup
+func pingPeer(address string) (time.Duration, error) {
+	conn, err := p2p.GetTCPManager().Secure(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", address, linkProbeTimeout)
+	}, linkProbeTimeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	if err := p2p.Ping(conn, linkProbeTimeout); err != nil {
+		return 0, err
+	}
+	return max(time.Since(start), time.Microsecond), nil
+}
+
+// add folds a ping into the estimate, an rtt of zero for a lost one
+func (l *linkEstimate) add(rtt time.Duration) {
+	lost := 0.0
+	if rtt == 0 {
+		lost = 1
+	}
+	switch {
+	case l.quality == 0:
+		l.rtt, l.loss = rtt, lost
+	case rtt == 0:
+		l.loss += lossGain * (lost - l.loss)
+	case l.rtt == 0:
+		l.rtt = rtt
+		l.loss += lossGain * (lost - l.loss)
+	default:
+		l.rtt += time.Duration(rttGain * float64(rtt-l.rtt))
+		l.loss += lossGain * (lost - l.loss)
+	}
+
+	quality := 0.0
+	if l.rtt > 0 {
+		quality = 100 * float64(halfQualityRTT) / float64(halfQualityRTT+l.rtt) * (1 - l.loss)
+	}
+	l.quality = min(max(int(math.Round(quality)), 1), 100)
+}
+
+// String describes the link for Peer.ConnectionQuality
+func (l *linkEstimate) String() string {
+	if l.rtt == 0 {
+		return fmt.Sprintf("%d%% (not answering)", l.quality)
+	}
+	rtt := fmt.Sprintf("%dms", l.rtt.Milliseconds())
+	if l.rtt < time.Millisecond {
+		rtt = "<1ms"
+	}
+	if l.loss >= 0.01 {
+		return fmt.Sprintf("%d%% (RTT %s, %.0f%% lost)", l.quality, rtt, 100*l.loss)
+	}
+	return fmt.Sprintf("%d%% (RTT %s)", l.quality, rtt)
+}
+
+// routedLinkQualities returns the measured quality of the links to peers,
+// which routes are about to be computed with
+func routedLinkQualities() map[string]int {
+	linkTable.Lock()
+	defer linkTable.Unlock()
+	qualities := make(map[string]int, len(linkTable.links))
+	for id, link := range linkTable.links {
+		link.routed = link.quality
+		qualities[id] = link.quality
+	}
+	return qualities
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,113 @@
+package mesh
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Instance lock
+//
+// Only one node runs on a data directory at a time, since two would fight
+// over the ports and overwrite each other's files. StartMeshNode takes an
+// exclusive lock on node.lock in the data directory, which holds the
+// process ID of the node, and StopMeshNode empties the file and gives the
+// lock back. The operating system drops the lock of a process that ends
+// without stopping its node, so a lock file left behind by a crash is taken
+// over by the next node to start.
+
+const instanceLockFile = "node.lock"
+
+// InstanceLockedError is returned by StartMeshNode when another process
+// runs a node on the same data directory
+type InstanceLockedError struct {
+	PID     int // Of the other process, 0 if it couldn't be read
+	DataDir string
+}
+
+func (e *InstanceLockedError) Error() string {
+	if e.PID == 0 {
+		return fmt.Sprintf("another BitShare node is running on %s", e.DataDir)
+	}
+	return fmt.Sprintf("another BitShare node is running on %s (process %d)", e.DataDir, e.PID)
+}
+
+// errLocked is returned by lockFile when another process holds the lock
+var errLocked = errors.New("locked by another process")
+
+var (
+	lockMutex    sync.Mutex
+	instanceLock *os.File // Nil while the node holds no lock
+)
+
+// acquireInstanceLock takes the lock on the data directory for this process
+func acquireInstanceLock() error {
+	dir, err := dataDir()
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, instanceLockFile)
+
+	lockMutex.Lock()
+	defer lockMutex.Unlock()
+	if instanceLock != nil {
+		return nil
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open the instance lock: %v", err)
+	}
+	if err := lockFile(file); err != nil {
+		file.Close()
+		if err == errLocked {
+			return &InstanceLockedError{PID: readLockPID(path), DataDir: dir}
+		}
+		return fmt.Errorf("failed to lock %s: %v", path, err)
+	}
+
+	// A process ID still in the file is from a node that didn't stop
+	if pid := readLockPID(path); pid != 0 && pid != os.Getpid() {
+		fmt.Printf("Taking over the data directory from process %d, which didn't shut down cleanly\n", pid)
+	}
+	if err := file.Truncate(0); err == nil {
+		file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+		file.Sync()
+	}
+	instanceLock = file
+	return nil
+}
+
+// releaseInstanceLock gives the lock on the data directory back
+func releaseInstanceLock() {
+	lockMutex.Lock()
+	defer lockMutex.Unlock()
+	if instanceLock == nil {
+		return
+	}
+
+	// Emptied before unlocking, so the next node doesn't think this one
+	// crashed. The file stays, as removing it could pull it from under a
+	// node that just locked it.
+	instanceLock.Truncate(0)
+	unlockFile(instanceLock)
+	instanceLock.Close()
+	instanceLock = nil
+}
+
+// readLockPID returns the process ID in the lock file at path, or 0
+func readLockPID(path string) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
@@ -0,0 +1,15 @@
+//go:build !unix && !windows
+
+package mesh
+
+import "os"
+
+// lockFile is only implemented on Unix and Windows; elsewhere nodes aren't
+// kept from sharing a data directory
+func lockFile(file *os.File) error {
+	return nil
+}
+
+func unlockFile(file *os.File) error {
+	return nil
+}
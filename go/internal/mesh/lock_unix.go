@@ -0,0 +1,21 @@
+//go:build unix
+
+package mesh
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive flock on file without waiting for it
+func lockFile(file *os.File) error {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return errLocked
+	}
+	return err
+}
+
+func unlockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
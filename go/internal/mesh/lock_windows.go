@@ -0,0 +1,45 @@
+package mesh
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	lockFileEx   = syscall.NewLazyDLL("kernel32.dll").NewProc("LockFileEx")
+	unlockFileEx = syscall.NewLazyDLL("kernel32.dll").NewProc("UnlockFileEx")
+)
+
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+	errorLockViolation      = syscall.Errno(33)
+
+	// lockOffset is where the locked byte lies, past the process ID so
+	// other processes can still read it
+	lockOffset = 1 << 30
+)
+
+// lockFile locks a byte of file with LockFileEx without waiting for it
+func lockFile(file *os.File) error {
+	overlapped := syscall.Overlapped{Offset: lockOffset}
+	ok, _, err := lockFileEx.Call(file.Fd(), lockfileExclusiveLock|lockfileFailImmediately, 0, 1, 0,
+		uintptr(unsafe.Pointer(&overlapped)))
+	if ok != 0 {
+		return nil
+	}
+	if err == errorLockViolation {
+		return errLocked
+	}
+	return err
+}
+
+func unlockFile(file *os.File) error {
+	overlapped := syscall.Overlapped{Offset: lockOffset}
+	ok, _, err := unlockFileEx.Call(file.Fd(), 0, 1, 0, uintptr(unsafe.Pointer(&overlapped)))
+	if ok == 0 {
+		return err
+	}
+	return nil
+}
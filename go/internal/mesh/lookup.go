@@ -0,0 +1,107 @@
+package mesh
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"fileshare/internal/utils"
+)
+
+// Peer lookup
+//
+// Besides aliases, IDs and names, FindPeerByIdOrName takes the start of a
+// peer's ID, like a git short hash: "node-18f3" or just "18f3", at least
+// minIDPrefix characters after "node-" so that a stray letter doesn't pick
+// a peer. A prefix that fits several peers lists them instead of picking
+// one. When nothing fits, the error suggests the aliases, names and IDs
+// closest to what was typed.
+
+// minIDPrefix is the shortest ID prefix that refers to a peer
+const minIDPrefix = 4
+
+// maxSuggestions is how many close matches a failed lookup suggests
+const maxSuggestions = 3
+
+// peersWithIDPrefix returns the peers whose ID starts with prefix, with or
+// without "node-", sorted by ID, with peersMutex held
+func peersWithIDPrefix(prefix string) []*Peer {
+	prefix = strings.ToLower(prefix)
+	if len(strings.TrimPrefix(prefix, "node-")) < minIDPrefix {
+		return nil
+	}
+
+	var matches []*Peer
+	for id, peer := range knownPeers {
+		id = strings.ToLower(id)
+		if strings.HasPrefix(id, prefix) || strings.HasPrefix(id, "node-"+prefix) {
+			matches = append(matches, peer)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].ID < matches[j].ID })
+	return matches
+}
+
+// ambiguousPrefixError lists the peers a prefix fits
+func ambiguousPrefixError(prefix string, matches []*Peer) error {
+	candidates := make([]string, len(matches))
+	for i, peer := range matches {
+		candidates[i] = fmt.Sprintf("%s (%s)", peer.ID, peer.Name)
+	}
+	return fmt.Errorf("'%s' is the start of %d peer IDs, type more of it: %s",
+		prefix, len(matches), strings.Join(candidates, ", "))
+}
+
+// suggestPeers returns the aliases, names and IDs closest to idOrName by
+// edit distance, closest first, leaving out those too far off to be a typo.
+// peersMutex must be held.
+func suggestPeers(idOrName string) []string {
+	distances := make(map[string]int)
+	consider := func(candidate string) {
+		if candidate == "" {
+			return
+		}
+		// A third of the longer string, so short names need a near hit
+		limit := max(1, max(len(candidate), len(idOrName))/3)
+		if distance := utils.EditDistance(idOrName, candidate); distance <= limit {
+			distances[candidate] = distance
+		}
+	}
+
+	for alias, id := range Aliases() {
+		if knownPeers[id] != nil {
+			consider(alias)
+		}
+	}
+	for id, peer := range knownPeers {
+		consider(peer.Name)
+		consider(id)
+	}
+
+	suggestions := make([]string, 0, len(distances))
+	for candidate := range distances {
+		suggestions = append(suggestions, candidate)
+	}
+	sort.Slice(suggestions, func(i, j int) bool {
+		a, b := suggestions[i], suggestions[j]
+		if distances[a] != distances[b] {
+			return distances[a] < distances[b]
+		}
+		return a < b
+	})
+	if len(suggestions) > maxSuggestions {
+		suggestions = suggestions[:maxSuggestions]
+	}
+	return suggestions
+}
+
+// notFoundError says no peer is idOrName, with the closest matches if any,
+// with peersMutex held
+func notFoundError(idOrName string) error {
+	suggestions := suggestPeers(idOrName)
+	if len(suggestions) == 0 {
+		return fmt.Errorf("no peer found with ID or name '%s'", idOrName)
+	}
+	return fmt.Errorf("no peer found with ID or name '%s', did you mean '%s'?",
+		idOrName, strings.Join(suggestions, "' or '"))
+}
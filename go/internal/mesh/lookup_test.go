@@ -0,0 +1,145 @@
+package mesh
+
+import (
+	"strings"
+	"testing"
+)
+
+// seedPeers stands in for a running node that knows peers and aliases, for
+// the rest of the test
+func seedPeers(t *testing.T, peers []Peer, seeded map[string]string) {
+	t.Helper()
+	nodeMutex.Lock()
+	if run != nil {
+		nodeMutex.Unlock()
+		t.Fatal("a node is already running")
+	}
+	run = &nodeRun{}
+	nodeMutex.Unlock()
+
+	peersMutex.Lock()
+	savedPeers := knownPeers
+	knownPeers = make(map[string]*Peer)
+	for i := range peers {
+		knownPeers[peers[i].ID] = &peers[i]
+	}
+	peersMutex.Unlock()
+
+	aliasesMutex.Lock()
+	savedAliases := aliases
+	aliases = seeded
+	aliasesMutex.Unlock()
+
+	t.Cleanup(func() {
+		nodeMutex.Lock()
+		run = nil
+		nodeMutex.Unlock()
+		peersMutex.Lock()
+		knownPeers = savedPeers
+		peersMutex.Unlock()
+		aliasesMutex.Lock()
+		aliases = savedAliases
+		aliasesMutex.Unlock()
+	})
+}
+
+func TestFindPeerByIdOrName(t *testing.T) {
+	seedPeers(t, []Peer{
+		{ID: "node-18f3a1c2d4e5", Name: "laptop"},
+		{ID: "node-18f3b2d3e4f5", Name: "desktop"},
+		{ID: "node-9c0d77e1aa42", Name: "nas"},
+		{ID: "node-ab12cd34ef56", Name: "phone"},
+		{ID: "node-ab99cd34ef56", Name: "Phone"},
+	}, map[string]string{
+		"work": "node-9c0d77e1aa42",
+		"old":  "node-gone",
+	})
+
+	tests := []struct {
+		lookup string
+		want   string // ID found, empty when the lookup fails
+		err    string // Part of the error when it does
+	}{
+		{"node-9c0d77e1aa42", "node-9c0d77e1aa42", ""},
+		{"NODE-9C0D77E1AA42", "node-9c0d77e1aa42", ""},
+		{"work", "node-9c0d77e1aa42", ""},
+		{"Work", "node-9c0d77e1aa42", ""},
+		{"desktop", "node-18f3b2d3e4f5", ""},
+		{"DESKTOP", "node-18f3b2d3e4f5", ""},
+		{"phone", "node-ab12cd34ef56", ""},
+		{"PHONE", "", "multiple peers"},
+
+		// The start of an ID, with or without "node-"
+		{"9c0d", "node-9c0d77e1aa42", ""},
+		{"node-9c0d", "node-9c0d77e1aa42", ""},
+		{"9C0D77", "node-9c0d77e1aa42", ""},
+		{"18f3a", "node-18f3a1c2d4e5", ""},
+		{"18f3", "", "start of 2 peer IDs, type more of it: node-18f3a1c2d4e5 (laptop), node-18f3b2d3e4f5 (desktop)"},
+		{"node-18f3", "", "start of 2 peer IDs"},
+		{"9c0", "", "no peer found"},
+		{"node-9c0", "", "no peer found"},
+		{"d77e", "", "no peer found"},
+
+		// Suggestions for typos
+		{"lpatop", "", "did you mean 'laptop'?"},
+		{"desktp", "", "did you mean 'desktop'?"},
+		{"worj", "", "did you mean 'work'?"},
+		{"olt", "", "no peer found with ID or name 'olt'"},
+		{"toaster", "", "no peer found with ID or name 'toaster'"},
+	}
+	for _, test := range tests {
+		t.Run(test.lookup, func(t *testing.T) {
+			peer, err := FindPeerByIdOrName(test.lookup)
+			if test.want != "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if peer.ID != test.want {
+					t.Fatalf("found %s, want %s", peer.ID, test.want)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("found %s, want an error", peer.ID)
+			}
+			if !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("got %q, want it to contain %q", err, test.err)
+			}
+			if strings.Contains(test.err, "no peer found") && strings.Contains(err.Error(), "did you mean") {
+				t.Errorf("suggested matches for %q: %v", test.lookup, err)
+			}
+		})
+	}
+}
+
+func TestSuggestPeers(t *testing.T) {
+	seedPeers(t, []Peer{
+		{ID: "node-0001", Name: "box1"},
+		{ID: "node-0002", Name: "box2"},
+		{ID: "node-0003", Name: "box3"},
+		{ID: "node-0004", Name: "boxes"},
+		{ID: "node-0005", Name: "kitchen"},
+	}, map[string]string{"bob": "node-0005"})
+
+	tests := []struct {
+		typed string
+		want  []string
+	}{
+		{"box", []string{"bob", "box1", "box2"}},
+		{"box4", []string{"box1", "box2", "box3"}},
+		{"kitchin", []string{"kitchen"}},
+		{"KITCHEN", []string{"kitchen"}},
+		{"node-0009", []string{"node-0001", "node-0002", "node-0003"}},
+		{"garage", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.typed, func(t *testing.T) {
+			peersMutex.RLock()
+			got := suggestPeers(test.typed)
+			peersMutex.RUnlock()
+			if strings.Join(got, ",") != strings.Join(test.want, ",") {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
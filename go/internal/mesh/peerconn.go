@@ -0,0 +1,182 @@
+package mesh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"fileshare/internal/p2p"
+)
+
+// Peer connections
+//
+// ConnectToPeer reaches a peer the best way there is and returns the
+// connection to its TCP service as a PeerConn, once the peer said who it
+// is. The connection is registered under the peer's ID until it is used,
+// closed or left idle for peerConnIdleTimeout: DialPeer, which transfers
+// dial with, takes it and has the peer hand it over to the receiver's port
+// (see p2p.Splice), so a send doesn't connect to the peer twice. Later
+// connections of the same transfer get new ones. Releases before splicing
+// ignore the request, and are then connected to as before, directly or by
+// a routed stream.
+
+// Ways a PeerConn reaches its peer, besides ProtocolMesh
+const (
+	ProtocolTCP        = "tcp"         // Directly, at the peer's address
+	ProtocolWiFiDirect = "wifi-direct" // Over a WiFi Direct link
+	ProtocolRelay      = "relay"       // Through a session with a relay server
+)
+
+const (
+	// meshConnectTimeout bounds asking a peer reached through other nodes
+	// who it is
+	meshConnectTimeout = 10 * time.Second
+
+	// spliceTimeout bounds how long a peer may take to hand a connection
+	// over to a port, which includes connecting to it
+	spliceTimeout = 10 * time.Second
+
+	// peerConnIdleTimeout is how long a registered connection waits for a
+	// transfer to take it before it is closed
+	peerConnIdleTimeout = time.Minute
+)
+
+// PeerConn is a connection to a peer's TCP service. Reads and writes go to
+// the TCP service until DialPeer hands it over to a port.
+type PeerConn struct {
+	net.Conn
+	Protocol string       // How the peer is reached, ProtocolTCP etc.
+	Via      string       // The next hop's node ID or the relay server, if any
+	Peer     Peer         // The peer as known when connecting
+	Identity p2p.Identity // Who the peer proved to be, without a PublicKey for releases before node keys
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+var peerConns = struct {
+	sync.Mutex
+	idle map[string]*PeerConn // Registered connections per peer ID
+}{idle: make(map[string]*PeerConn)}
+
+// Close closes the connection, and takes it out of the registry
+func (c *PeerConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.unregister()
+		c.closeErr = c.Conn.Close()
+	})
+	return c.closeErr
+}
+
+// Fingerprint returns the fingerprint of the key the peer proved its ID
+// with, or "" when it didn't
+func (c *PeerConn) Fingerprint() string {
+	return p2p.Fingerprint(c.Identity.PublicKey)
+}
+
+// register makes the connection the one DialPeer takes for its peer
+func (c *PeerConn) register() {
+	peerConns.Lock()
+	peerConns.idle[c.Peer.ID] = c
+	peerConns.Unlock()
+
+	time.AfterFunc(peerConnIdleTimeout, func() {
+		if claimPeerConn(c.Peer.ID, c) != nil {
+			c.Close()
+		}
+	})
+}
+
+func (c *PeerConn) unregister() {
+	claimPeerConn(c.Peer.ID, c)
+}
+
+// claimPeerConn takes the connection registered for peerID out of the
+// registry, only if it is want when want is set
+func claimPeerConn(peerID string, want *PeerConn) *PeerConn {
+	peerConns.Lock()
+	defer peerConns.Unlock()
+	conn := peerConns.idle[peerID]
+	if conn == nil || (want != nil && conn != want) {
+		return nil
+	}
+	delete(peerConns.idle, peerID)
+	return conn
+}
+
+// openPeerConn connects to peer with connect, encrypted where the peer can
+// (see p2p.TCPManager.Secure), and checks who answers
+func openPeerConn(peer *Peer, protocol, via string, timeout time.Duration, connect func(*Peer) (net.Conn, error)) (*PeerConn, error) {
+	conn, err := p2p.GetTCPManager().Secure(func() (net.Conn, error) {
+		return connect(peer)
+	}, timeout)
+	if err != nil {
+		return nil, err
+	}
+	identity, err := authenticatePeer(conn, peer, timeout)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	peersMutex.RLock()
+	known := *peer
+	peersMutex.RUnlock()
+	return &PeerConn{Conn: conn, Protocol: protocol, Via: via, Peer: known, Identity: identity}, nil
+}
+
+// DialPeer connects to a port of a peer, address naming the peer by node
+// ID as routed addresses do, over the connection ConnectToPeer registered
+// for it if there is one. It suits transfer.TransferOptions.Dial.
+func DialPeer(ctx context.Context, address string) (net.Conn, error) {
+	if !isRunning() {
+		return nil, errors.New("mesh node is not running")
+	}
+	peerID, portText, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portText)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in %s", address)
+	}
+	if err := contextOrBackground(ctx).Err(); err != nil {
+		return nil, err
+	}
+
+	conn := claimPeerConn(peerID, nil)
+	if conn == nil {
+		if conn, err = connectToPeer(peerID); err != nil {
+			return nil, err
+		}
+	}
+	err = p2p.Splice(conn, port, spliceTimeout)
+	if err == nil {
+		return conn, nil
+	}
+	conn.Close()
+
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		return nil, err
+	}
+	// Releases before splicing don't answer
+	switch conn.Protocol {
+	case ProtocolTCP:
+		var dialer net.Dialer
+		return dialer.DialContext(contextOrBackground(ctx), "tcp", net.JoinHostPort(conn.Peer.Address, portText))
+	case ProtocolMesh:
+		return p2p.GetTCPManager().DialRoute(ctx, conn.Peer.ID, port)
+	}
+	return nil, fmt.Errorf("%s can't take connections through a %s: %w", conn.Peer.Name, conn.Protocol, err)
+}
+
+func contextOrBackground(ctx context.Context) context.Context {
+	if ctx == nil {
+		return context.Background()
+	}
+	return ctx
+}
@@ -0,0 +1,278 @@
+package mesh
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"fileshare/internal/p2p"
+)
+
+// Known peers are kept in known_peers.json in the data directory, written
+// whenever a peer is added or changes and when the node stops, and read back
+// when it starts. Peers read back are offline until they are seen again. Only
+// the most recently seen maxStoredPeers are kept. A file that can't be read
+// is set aside as known_peers.json.corrupt and the node starts without peers.
+
+const (
+	knownPeersFile = "known_peers.json"
+	maxStoredPeers = 500
+)
+
+// storedPeer is what is kept of a Peer between runs
+type storedPeer struct {
+	ID           string          `json:"id"`
+	Name         string          `json:"name"`
+	Addresses    []string        `json:"addresses,omitempty"` // Most recent first
+	Protocol     string          `json:"protocol,omitempty"`
+	LastSeen     time.Time       `json:"last_seen"`
+	Routes       []Route         `json:"routes,omitempty"`
+	Version      string          `json:"version,omitempty"`
+	Pinned       bool            `json:"pinned,omitempty"`
+	Port         int             `json:"port,omitempty"`
+	PublicKey    []byte          `json:"public_key,omitempty"`
+	KeyConflict  string          `json:"key_conflict,omitempty"`
+	GossipOrigin string          `json:"gossip_origin,omitempty"`
+	Transports   []p2p.Transport `json:"transports,omitempty"`
+}
+
+// maxPeerAddresses bounds how many past addresses are remembered per peer
+const maxPeerAddresses = 4
+
+// peerStoreMutex keeps saves from interleaving
+var peerStoreMutex sync.Mutex
+
+// RememberPeers adds peers that were just seen to the known peers, or
+// updates those with the same IDs, and saves them. A new ID seen with the
+// name and address of an offline peer is that peer with a new identity, so
+// it takes over its record and alias, unless the peer had proved a key: then
+// it is a conflict, see keys.go. A sighting without the key of a peer that
+// proved one doesn't move it: anyone can claim its ID, so only its address
+// and transports from sightings with the key are kept. Blocked peers are
+// left out.
+func RememberPeers(peers ...Peer) {
+	peers = dropBlocked(peers)
+	var changes []peerChange
+	var discovered []Peer
+	renamed := make(map[string]string) // New ID by old
+	var conflicts [][2]Peer            // New peer and the one whose name it took
+	offlineAfter := currentConfig().OfflineAfter
+
+	peersMutex.Lock()
+	for _, peer := range peers {
+		known, exists := knownPeers[peer.ID]
+		if !exists {
+			known = &Peer{ID: peer.ID}
+			if previous := keyConflict(peer); previous != nil {
+				peer.KeyConflict = previous.ID
+				conflicts = append(conflicts, [2]Peer{peer, *previous})
+			} else if previous := previousIdentity(peer); previous != nil {
+				delete(knownPeers, previous.ID)
+				renamed[previous.ID] = peer.ID
+				known.Addresses = previous.Addresses
+				known.Pinned = previous.Pinned
+			}
+			knownPeers[peer.ID] = known
+		}
+		wasOnline := known.IsOnline
+		unsigned := peer.PublicKey == nil && known.PublicKey != nil
+		addresses := known.Addresses
+		if known.Address != "" {
+			addresses = append([]string{known.Address}, addresses...)
+		}
+		if peer.Version == "" {
+			peer.Version = known.Version
+		}
+		if peer.Port == 0 || unsigned {
+			peer.Port = known.Port
+		}
+		if peer.PublicKey == nil {
+			peer.PublicKey = known.PublicKey
+		}
+		if peer.ConnectionQuality == "" {
+			peer.ConnectionQuality = known.ConnectionQuality
+		}
+		if exists {
+			peer.KeyConflict = known.KeyConflict
+		}
+		peer.Pinned = known.Pinned
+		transports := known.Transports
+		if unsigned {
+			peer.Address, peer.Protocol, peer.SignalStrength = known.Address, known.Protocol, known.SignalStrength
+		} else {
+			transports = p2p.MergeTransports(known.Transports, offlineAfter, sightings(peer)...)
+		}
+		*known = peer
+		known.Transports = transports
+		useBestTransport(known)
+		known.Addresses = pastAddresses(known.Address, addresses)
+		known.IsOnline = true
+		if known.LastSeen.IsZero() {
+			known.LastSeen = time.Now()
+		}
+		if !exists {
+			discovered = append(discovered, *known)
+		}
+		if !wasOnline {
+			changes = append(changes, peerChange{*known, PeerOnline})
+		}
+	}
+	peersMutex.Unlock()
+
+	saveKnownPeers()
+	for _, conflict := range conflicts {
+		warnKeyConflict(conflict[0], conflict[1])
+	}
+	for oldID, newID := range renamed {
+		moveAlias(oldID, newID)
+	}
+	for _, peer := range discovered {
+		publishPeer(EventPeerDiscovered, peer)
+	}
+	notifyPeerStates(changes)
+}
+
+// previousIdentity finds the offline record of the peer under another ID,
+// with peersMutex held
+func previousIdentity(peer Peer) *Peer {
+	if peer.Name == "" || peer.Address == "" {
+		return nil
+	}
+	for _, known := range knownPeers {
+		if known.ID != peer.ID && !known.IsOnline && known.Name == peer.Name && known.Address != "" && peerHost(known.Address) == peerHost(peer.Address) {
+			return known
+		}
+	}
+	return nil
+}
+
+// pastAddresses returns the addresses a peer now at current was seen at
+// before, most recent first and without current
+func pastAddresses(current string, addresses []string) []string {
+	var past []string
+	for _, address := range addresses {
+		if address == current || address == "" || containsAddress(past, address) {
+			continue
+		}
+		if len(past) == maxPeerAddresses-1 {
+			break
+		}
+		past = append(past, address)
+	}
+	return past
+}
+
+func containsAddress(addresses []string, address string) bool {
+	for _, a := range addresses {
+		if a == address {
+			return true
+		}
+	}
+	return false
+}
+
+// saveKnownPeers writes the known peers, most recently seen first
+func saveKnownPeers() {
+	dir, err := dataDir()
+	if err != nil {
+		return
+	}
+
+	peersMutex.RLock()
+	stored := make([]storedPeer, 0, len(knownPeers))
+	for _, peer := range knownPeers {
+		addresses := []string{}
+		if peer.Address != "" {
+			addresses = append(addresses, peer.Address)
+		}
+		stored = append(stored, storedPeer{
+			ID:           peer.ID,
+			Name:         peer.Name,
+			Addresses:    append(addresses, peer.Addresses...),
+			Protocol:     peer.Protocol,
+			LastSeen:     peer.LastSeen,
+			Routes:       peer.Routes,
+			Version:      peer.Version,
+			Pinned:       peer.Pinned,
+			Port:         peer.Port,
+			PublicKey:    peer.PublicKey,
+			KeyConflict:  peer.KeyConflict,
+			GossipOrigin: peer.GossipOrigin,
+			Transports:   peer.Transports,
+		})
+	}
+	peersMutex.RUnlock()
+
+	sort.Slice(stored, func(i, j int) bool { return stored[i].LastSeen.After(stored[j].LastSeen) })
+	if len(stored) > maxStoredPeers {
+		stored = stored[:maxStoredPeers]
+	}
+
+	peerStoreMutex.Lock()
+	defer peerStoreMutex.Unlock()
+	if err := writeJSONFile(filepath.Join(dir, knownPeersFile), stored); err != nil {
+		fmt.Printf("⚠️ Could not save known peers: %v\n", err)
+	}
+}
+
+// loadKnownPeers adds the peers saved by an earlier run, offline
+func loadKnownPeers() {
+	dir, err := dataDir()
+	if err != nil {
+		return
+	}
+	path := filepath.Join(dir, knownPeersFile)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Printf("⚠️ Could not read known peers: %v\n", err)
+		}
+		return
+	}
+
+	var stored []storedPeer
+	if err := json.Unmarshal(data, &stored); err != nil {
+		fmt.Printf("⚠️ Known peers file is corrupt, starting without it (%v)\n", err)
+		os.Rename(path, path+".corrupt")
+		return
+	}
+
+	if len(stored) > maxStoredPeers {
+		stored = stored[:maxStoredPeers]
+	}
+
+	peersMutex.Lock()
+	defer peersMutex.Unlock()
+	for _, s := range stored {
+		if s.ID == "" || knownPeers[s.ID] != nil {
+			continue
+		}
+		peer := &Peer{
+			ID:           s.ID,
+			Name:         s.Name,
+			Protocol:     s.Protocol,
+			LastSeen:     s.LastSeen,
+			Routes:       s.Routes,
+			Version:      s.Version,
+			Pinned:       s.Pinned,
+			Port:         s.Port,
+			KeyConflict:  s.KeyConflict,
+			GossipOrigin: s.GossipOrigin,
+			Transports:   s.Transports,
+		}
+		if len(s.PublicKey) == ed25519.PublicKeySize && p2p.NodeIDForKey(s.PublicKey) == s.ID {
+			peer.PublicKey = s.PublicKey
+		}
+		if len(s.Addresses) > 0 {
+			peer.Address = s.Addresses[0]
+			peer.Addresses = pastAddresses(peer.Address, s.Addresses[1:])
+		}
+		knownPeers[s.ID] = peer
+	}
+}
@@ -0,0 +1,52 @@
+package mesh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"fileshare/internal/p2p"
+)
+
+// TestRememberUnsignedSighting checks a sighting without the key of a peer
+// that proved one doesn't change where the peer is reached
+func TestRememberUnsignedSighting(t *testing.T) {
+	if err := StartMeshNode(testConfig(t)); err != nil {
+		t.Fatal(err)
+	}
+	defer StopMeshNode()
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := p2p.NodeIDForKey(public)
+	RememberPeers(Peer{ID: id, Name: "keyed", Address: "10.0.0.5", Protocol: ProtocolTCP, PublicKey: public})
+
+	tests := []struct {
+		name    string
+		sighted Peer
+		want    string // Address afterwards
+	}{
+		{"without the key", Peer{ID: id, Name: "keyed", Address: "10.0.0.66", Protocol: ProtocolTCP}, "10.0.0.5"},
+		{"with the key", Peer{ID: id, Name: "keyed", Address: "10.0.0.7", Protocol: ProtocolTCP, PublicKey: public}, "10.0.0.7"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			RememberPeers(test.sighted)
+			peersMutex.RLock()
+			known := *knownPeers[id]
+			peersMutex.RUnlock()
+			if known.Address != test.want {
+				t.Errorf("peer is at %s, want %s", known.Address, test.want)
+			}
+			for _, transport := range known.Transports {
+				if transport.Address == "10.0.0.66" {
+					t.Errorf("peer has a transport at the address sighted without its key: %+v", known.Transports)
+				}
+			}
+			if known.PublicKey == nil {
+				t.Error("peer lost its key")
+			}
+		})
+	}
+}
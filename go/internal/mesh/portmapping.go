@@ -0,0 +1,113 @@
+package mesh
+
+import (
+	"fmt"
+	"time"
+
+	"fileshare/internal/portmap"
+)
+
+// Port mapping
+//
+// When the node starts it asks the router to forward the port of the TCP
+// service from its public address (see portmap.Map), so peers on other
+// networks can connect without a relay, renews the lease at half its
+// lifetime and gives the mapping back when the node stops or ListenPort
+// changes. A router that can't or won't map the port is mentioned once; the
+// node works the same without a mapping.
+
+// permanentMappingCheck is how often a mapping that doesn't expire is made
+// again, in case the router restarted and lost it
+const permanentMappingCheck = 30 * time.Minute
+
+// PortMapping is the public address a router forwards to the TCP service
+type PortMapping struct {
+	External string // host:port, empty without a mapping
+	Method   string // How it was made, portmap.MethodUPnP, MethodPCP or MethodNATPMP
+}
+
+// portMapping is the current mapping and mappingRun the run of the
+// maintainPortMapping that keeps it, both guarded by nodeMutex
+var (
+	portMapping *portmap.Mapping
+	mappingRun  *nodeRun
+)
+
+// startPortMapping has the router forward port until removePortMapping
+func startPortMapping(port int) {
+	r := &nodeRun{stopped: make(chan struct{})}
+	nodeMutex.Lock()
+	mappingRun = r
+	nodeMutex.Unlock()
+	go maintainPortMapping(r, port)
+}
+
+// maintainPortMapping maps port and keeps the mapping until the run ends
+func maintainPortMapping(r *nodeRun, port int) {
+	mapping, err := portmap.Map(port, portmap.DefaultLifetime)
+	if err != nil {
+		fmt.Printf("⚠️ The router didn't forward port %d, peers on other networks connect through relays (%v)\n", port, err)
+		return
+	}
+	if !setPortMapping(r, mapping) {
+		// The node stopped while the router was asked
+		mapping.Remove()
+		return
+	}
+
+	failing := false
+	for {
+		wait := mapping.Lifetime / 2
+		if wait <= 0 {
+			wait = permanentMappingCheck
+		}
+		select {
+		case <-r.stopped:
+			return
+		case <-time.After(wait):
+		}
+
+		if err := mapping.Refresh(portmap.DefaultLifetime); err != nil {
+			if !failing {
+				fmt.Printf("⚠️ Could not renew the %s mapping of port %d: %v\n", mapping.Method, port, err)
+			}
+			failing = true
+			continue
+		}
+		failing = false
+		setPortMapping(r, mapping)
+	}
+}
+
+// setPortMapping records mapping in the connection information, unless the
+// run already ended
+func setPortMapping(r *nodeRun, mapping *portmap.Mapping) bool {
+	nodeMutex.Lock()
+	defer nodeMutex.Unlock()
+	if mappingRun != r {
+		return false
+	}
+	portMapping = mapping
+	connectionInfo.PortMapping = PortMapping{External: mapping.External(), Method: mapping.Method}
+	return true
+}
+
+// removePortMapping ends the run keeping the mapping and gives the mapping
+// back to the router
+func removePortMapping() {
+	nodeMutex.Lock()
+	if mappingRun != nil {
+		close(mappingRun.stopped)
+		mappingRun = nil
+	}
+	mapping := portMapping
+	portMapping = nil
+	connectionInfo.PortMapping = PortMapping{}
+	nodeMutex.Unlock()
+
+	if mapping != nil {
+		if err := mapping.Remove(); err != nil {
+			fmt.Printf("⚠️ Could not remove the %s mapping of port %d: %v\n", mapping.Method, mapping.InternalPort, err)
+		}
+	}
+}
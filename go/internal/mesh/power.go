@@ -0,0 +1,216 @@
+package mesh
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"fileshare/internal/relay"
+)
+
+// Idle mode
+//
+// A node left running with nothing to do slows down. After IdleAfter without
+// transfers or terminal input, discovery, routing, link probes, heartbeats
+// and network checks run IdleSlowdown times less often, relay keepalives
+// drop to the slowest rate that keeps the registration alive, and the
+// terminal UI stops redrawing.
+// NoteActivity brings everything back to the normal cadence at once.
+
+// Power states shown in 'status'
+const (
+	PowerNormal = "normal"
+	PowerIdle   = "idle"
+)
+
+const (
+	// DefaultIdleAfter is how long a node waits without activity before going idle
+	DefaultIdleAfter = 10 * time.Minute
+
+	// DefaultIdleSlowdown is how many times longer the background intervals get while idle
+	DefaultIdleSlowdown = 10
+
+	// Normal intervals of the background loops
+	discoveryInterval      = 60 * time.Second
+	routingInterval        = 30 * time.Second
+	linkProbeInterval      = 15 * time.Second
+	peerExchangeInterval   = 2 * time.Minute
+	networkCheckInterval   = 5 * time.Minute
+	interfaceCheckInterval = 30 * time.Second
+	relayKeepaliveInterval = 30 * time.Second
+
+	// relayRegistrationTTL is how long a relay keeps a registration without a keepalive
+	relayRegistrationTTL = relay.RegistrationTTL
+
+	// powerSettingsFile holds the idle thresholds in DataDir
+	powerSettingsFile = "power.json"
+)
+
+// PowerSettings are the configurable idle thresholds
+type PowerSettings struct {
+	IdleAfter    time.Duration `json:"idle_after"`    // Zero or less never goes idle
+	IdleSlowdown int           `json:"idle_slowdown"` // Factor applied to background intervals while idle
+}
+
+// PowerStatus describes the node's power state for 'status'
+type PowerStatus struct {
+	State        string        `json:"state"`
+	LastActivity time.Time     `json:"last_activity"`
+	IdleAfter    time.Duration `json:"idle_after"`
+}
+
+var (
+	powerSettings = PowerSettings{IdleAfter: DefaultIdleAfter, IdleSlowdown: DefaultIdleSlowdown}
+	lastActivity  = time.Now()
+	idle          bool
+	wake          = make(chan struct{})
+	powerMutex    sync.Mutex
+)
+
+// DefaultPowerSettings returns the thresholds used when none are configured
+func DefaultPowerSettings() PowerSettings {
+	return PowerSettings{IdleAfter: DefaultIdleAfter, IdleSlowdown: DefaultIdleSlowdown}
+}
+
+// LoadPowerSettings reads the idle thresholds from the data directory
+func LoadPowerSettings() (PowerSettings, error) {
+	settings := DefaultPowerSettings()
+
+	dir, err := dataDir()
+	if err != nil {
+		return settings, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, powerSettingsFile))
+	if os.IsNotExist(err) {
+		return settings, nil
+	}
+	if err != nil {
+		return settings, err
+	}
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return DefaultPowerSettings(), fmt.Errorf("invalid %s: %v", powerSettingsFile, err)
+	}
+	if settings.IdleSlowdown < 1 {
+		settings.IdleSlowdown = 1
+	}
+	return settings, nil
+}
+
+// SavePowerSettings stores the idle thresholds and applies them to a running node
+func SavePowerSettings(settings PowerSettings) error {
+	dir, err := dataDir()
+	if err != nil {
+		return err
+	}
+	if err := writeJSONFile(filepath.Join(dir, powerSettingsFile), settings); err != nil {
+		return err
+	}
+
+	applyPowerSettings(settings)
+	return nil
+}
+
+// applyPowerSettings switches to new thresholds, re-evaluating the state
+func applyPowerSettings(settings PowerSettings) {
+	powerMutex.Lock()
+	powerSettings = settings
+	powerMutex.Unlock()
+
+	NoteActivity()
+}
+
+// NoteActivity records a transfer or user interaction, leaving idle mode if needed
+func NoteActivity() {
+	powerMutex.Lock()
+	defer powerMutex.Unlock()
+
+	lastActivity = time.Now()
+	if idle {
+		idle = false
+		close(wake)
+		wake = make(chan struct{})
+	}
+}
+
+// IsIdle reports whether the node is in idle mode
+func IsIdle() bool {
+	powerMutex.Lock()
+	defer powerMutex.Unlock()
+
+	return idle
+}
+
+// WaitForActivity blocks until the node leaves idle mode, returning at once if it isn't idle
+func WaitForActivity() {
+	powerMutex.Lock()
+	if !idle {
+		powerMutex.Unlock()
+		return
+	}
+	woken := wake
+	powerMutex.Unlock()
+
+	<-woken
+}
+
+// GetPowerStatus returns the current power state
+func GetPowerStatus() PowerStatus {
+	powerMutex.Lock()
+	defer powerMutex.Unlock()
+
+	status := PowerStatus{State: PowerNormal, LastActivity: lastActivity, IdleAfter: powerSettings.IdleAfter}
+	if idle {
+		status.State = PowerIdle
+	}
+	return status
+}
+
+// monitorIdle moves the node into idle mode once nothing has happened for a while
+func monitorIdle(r *nodeRun) {
+	for r.active() {
+		powerMutex.Lock()
+		after := powerSettings.IdleAfter
+		if !idle && after > 0 && time.Since(lastActivity) >= after {
+			idle = true
+		}
+		powerMutex.Unlock()
+
+		time.Sleep(time.Minute)
+	}
+}
+
+// powerSleep waits for a background loop's interval, stretched while idle.
+// Activity cuts an idle wait short so the loop runs again right away.
+func powerSleep(interval time.Duration) {
+	powerMutex.Lock()
+	idleInterval := interval * time.Duration(powerSettings.IdleSlowdown)
+	powerMutex.Unlock()
+
+	sleepUntilWoken(interval, idleInterval)
+}
+
+// relaySleep waits between relay keepalives. While idle they are only sent
+// often enough for the relay to keep the registration.
+func relaySleep() {
+	sleepUntilWoken(relayKeepaliveInterval, relayRegistrationTTL/2)
+}
+
+func sleepUntilWoken(interval, idleInterval time.Duration) {
+	powerMutex.Lock()
+	woken := wake
+	if idle {
+		interval = idleInterval
+	}
+	powerMutex.Unlock()
+
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-woken:
+	}
+}
@@ -0,0 +1,131 @@
+package mesh
+
+import (
+	"fmt"
+	"time"
+)
+
+// Stale peers
+//
+// Peers that go quiet are marked offline after Config.OfflineAfter without
+// being seen and forgotten after Config.ForgetAfter, along with the routes
+// through them, unless they are pinned. The check runs with the routing
+// table maintenance. Config.PeerStateFunc is told of every peer that comes
+// online, goes offline or is forgotten.
+
+// Default silence windows of Config.OfflineAfter and Config.ForgetAfter
+const (
+	DefaultOfflineAfter = 5 * time.Minute
+	DefaultForgetAfter  = 24 * time.Hour
+)
+
+// States passed to Config.PeerStateFunc
+const (
+	PeerOnline    = "online"
+	PeerOffline   = "offline"
+	PeerForgotten = "forgotten"
+)
+
+// peerChange is a state change to report once the peers are unlocked
+type peerChange struct {
+	peer  Peer
+	state string
+}
+
+// PinPeer keeps a peer from being forgotten however long it is silent, or
+// lets it be forgotten again
+func PinPeer(idOrName string, pinned bool) (Peer, error) {
+	peer, err := FindPeerByIdOrName(idOrName)
+	if err != nil {
+		return Peer{}, err
+	}
+
+	peersMutex.Lock()
+	peer.Pinned = pinned
+	pinnedPeer := *peer
+	peersMutex.Unlock()
+
+	saveKnownPeers()
+	return pinnedPeer, nil
+}
+
+// prunePeers marks peers offline and forgets them once they have been silent
+// long enough
+func prunePeers() {
+	now := time.Now()
+	config := currentConfig()
+	var changes []peerChange
+	var rerouted []Peer
+
+	peersMutex.Lock()
+	for id, peer := range knownPeers {
+		silence := now.Sub(peer.LastSeen)
+		switch {
+		case !peer.Pinned && config.ForgetAfter > 0 && silence >= config.ForgetAfter:
+			delete(knownPeers, id)
+			rerouted = append(rerouted, dropRoutesVia(peer)...)
+			changes = append(changes, peerChange{*peer, PeerForgotten})
+		case peer.IsOnline && config.OfflineAfter > 0 && silence >= config.OfflineAfter:
+			peer.IsOnline = false
+			changes = append(changes, peerChange{*peer, PeerOffline})
+		}
+	}
+	peersMutex.Unlock()
+
+	if len(changes) > 0 {
+		saveKnownPeers()
+	}
+	notifyPeerStates(changes)
+	publishRoutes(rerouted)
+}
+
+// dropRoutesVia removes the routes that go through peer and returns the
+// peers whose routes changed. The caller must hold peersMutex.
+func dropRoutesVia(peer *Peer) []Peer {
+	var changed []Peer
+	for _, other := range knownPeers {
+		var routes []Route
+		for _, route := range other.Routes {
+			if route.NextHop != peer.ID && route.NextHop != peer.Address {
+				routes = append(routes, route)
+			}
+		}
+		if len(routes) != len(other.Routes) {
+			other.Routes = routes
+			changed = append(changed, *other)
+		}
+	}
+	return changed
+}
+
+// notifyPeerStates tells Config.PeerStateFunc and the subscribers about changes
+func notifyPeerStates(changes []peerChange) {
+	notify := currentConfig().PeerStateFunc
+	for _, change := range changes {
+		publishPeer(peerStateEvents[change.state], change.peer)
+		if notify != nil {
+			notify(change.peer, change.state)
+		}
+	}
+}
+
+// publishRoutes tells the subscribers the routes to peers changed
+func publishRoutes(peers []Peer) {
+	for _, peer := range peers {
+		publishPeer(EventRouteChanged, peer)
+	}
+}
+
+// silenceWindows fills in the default silence windows and checks they make sense
+func silenceWindows(config *Config) error {
+	if config.OfflineAfter == 0 {
+		config.OfflineAfter = DefaultOfflineAfter
+	}
+	if config.ForgetAfter == 0 {
+		config.ForgetAfter = DefaultForgetAfter
+	}
+	if config.OfflineAfter > 0 && config.ForgetAfter > 0 && config.ForgetAfter < config.OfflineAfter {
+		return fmt.Errorf("peers can't be forgotten after %v, before they go offline after %v", config.ForgetAfter, config.OfflineAfter)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package mesh
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Public IP
+//
+// The public address of the node is asked of web services that answer a GET
+// with the caller's address as plain text. They are tried in order, each
+// with a short timeout, and the answer is kept until the next network check
+// so the services aren't asked more often than that. When none answer, the
+// address STUN saw is used instead. In offline mode nothing is asked.
+
+// DefaultPublicIPServices are asked when Config.PublicIPServices is empty
+var DefaultPublicIPServices = []string{
+	"https://api.ipify.org",
+	"https://icanhazip.com",
+}
+
+const (
+	publicIPTimeout = 3 * time.Second
+
+	// maxPublicIPAnswer bounds what is read of an answer, an address is far shorter
+	maxPublicIPAnswer = 256
+)
+
+var publicIPCache struct {
+	sync.Mutex
+	ip       string
+	services string // The services ip came from, so a config change asks again
+	checked  time.Time
+}
+
+// publicIP returns the public address of the node as services report it,
+// looked up at most once per networkCheckInterval
+func publicIP(services []string) (string, error) {
+	if len(services) == 0 {
+		services = DefaultPublicIPServices
+	}
+	key := strings.Join(services, " ")
+
+	publicIPCache.Lock()
+	defer publicIPCache.Unlock()
+	if publicIPCache.ip != "" && publicIPCache.services == key && time.Since(publicIPCache.checked) < networkCheckInterval {
+		return publicIPCache.ip, nil
+	}
+
+	ip, err := lookupPublicIP(services)
+	if err != nil {
+		return "", err
+	}
+	publicIPCache.ip, publicIPCache.services, publicIPCache.checked = ip, key, time.Now()
+	return ip, nil
+}
+
+// lookupPublicIP asks services in order until one answers with an address
+func lookupPublicIP(services []string) (string, error) {
+	client := &http.Client{Timeout: publicIPTimeout}
+	var errs []error
+	for _, service := range services {
+		ip, err := askPublicIP(client, service)
+		if err == nil {
+			return ip, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", service, err))
+	}
+	return "", errors.Join(errs...)
+}
+
+func askPublicIP(client *http.Client, service string) (string, error) {
+	response, err := client.Get(service)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", errors.New(response.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(response.Body, maxPublicIPAnswer))
+	if err != nil {
+		return "", err
+	}
+	answer := strings.TrimSpace(string(body))
+	ip := net.ParseIP(answer)
+	if ip == nil {
+		return "", fmt.Errorf("answer %q is not an IP address", answer)
+	}
+	return ip.String(), nil
+}
@@ -0,0 +1,140 @@
+package mesh
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"fileshare/internal/p2p"
+)
+
+// Reconfiguration
+//
+// Reconfigure changes the configuration of the running node. What can
+// change while it runs does so without dropping peer connections: a new
+// name is announced to the local network, relaying starts, stops or
+// registers with the new relays, a new ListenPort moves the TCP service and
+// its discovery service to the ports that go with it, which are mapped on
+// the router in place of the old ones and announced, and network conditions
+// are checked again when what they depend on changed. The rest, such as the
+// node ID, data directory or protocols, only applies when the node starts,
+// and asking to change it fails without changing anything.
+
+// DefaultRelayServers are used when relaying is on and Config.RelayServers is empty
+var DefaultRelayServers = []string{"relay1.bitshare.net:9100", "relay2.bitshare.net:9100"}
+
+// ErrRestartRequired is wrapped by Reconfigure's error for changes that
+// only apply when the node starts
+var ErrRestartRequired = errors.New("the node has to be restarted")
+
+// configDefaults fills in what config leaves to the defaults and checks it
+func configDefaults(config *Config) error {
+	if config.EnableRelay && len(config.RelayServers) == 0 {
+		config.RelayServers = DefaultRelayServers
+	}
+	if config.HeartbeatInterval == 0 {
+		config.HeartbeatInterval = DefaultHeartbeatInterval
+	}
+	if config.HeartbeatMisses <= 0 {
+		config.HeartbeatMisses = DefaultHeartbeatMisses
+	}
+	if config.Network != "" && config.NetworkPassphrase == "" {
+		return fmt.Errorf("network %s needs a passphrase", config.Network)
+	}
+	switch config.DiscoveryMode {
+	case "", p2p.DiscoveryBroadcast, p2p.DiscoveryMulticast, p2p.DiscoveryBoth:
+	default:
+		return fmt.Errorf("unknown discovery mode %q, use broadcast, multicast or both", config.DiscoveryMode)
+	}
+	if config.MulticastTTL < 0 || config.MulticastTTL > p2p.MaxMulticastTTL {
+		return fmt.Errorf("multicast TTL must be between 1 and %d", p2p.MaxMulticastTTL)
+	}
+	return silenceWindows(config)
+}
+
+// Reconfigure applies config to the running node, see above. An empty
+// NodeID keeps the node's ID.
+func Reconfigure(config Config) error {
+	lifecycleMutex.Lock()
+	defer lifecycleMutex.Unlock()
+
+	if !isRunning() {
+		return errors.New("mesh node is not running")
+	}
+	if err := configDefaults(&config); err != nil {
+		return err
+	}
+	current := currentConfig()
+	if config.NodeID == "" {
+		config.NodeID = current.NodeID
+	}
+
+	var restart []string
+	for _, change := range []struct {
+		changed bool
+		what    string
+	}{
+		{config.NodeID != current.NodeID, "node ID"},
+		{config.DataDir != current.DataDir, "data directory"},
+		{config.EnableTCP != current.EnableTCP, "TCP service"},
+		{config.EnableMDNS != current.EnableMDNS, "mDNS setting"},
+		{config.DiscoveryMode != current.DiscoveryMode || config.MulticastTTL != current.MulticastTTL, "discovery mode"},
+		{config.Network != current.Network || config.NetworkPassphrase != current.NetworkPassphrase, "network"},
+		{config.EnableWiFiDirect != current.EnableWiFiDirect, "WiFi Direct setting"},
+		{config.EnableBluetooth != current.EnableBluetooth, "Bluetooth setting"},
+	} {
+		if change.changed {
+			restart = append(restart, change.what)
+		}
+	}
+	if len(restart) > 0 {
+		return fmt.Errorf("%w to change the %s", ErrRestartRequired, strings.Join(restart, ", "))
+	}
+
+	// Moving the TCP service is the one change that can fail, so it goes
+	// before anything else changes
+	moved := config.ListenPort != current.ListenPort
+	if moved && config.EnableTCP {
+		if err := p2p.GetTCPManager().Rebind(ServicePort(config.ListenPort)); err != nil {
+			return err
+		}
+	}
+
+	nodeMutex.Lock()
+	meshConfig = config
+	nodeMutex.Unlock()
+
+	renamed := config.NodeName != current.NodeName
+	relayChanged := config.EnableRelay != current.EnableRelay ||
+		config.EnableRelay && (!slices.Equal(config.RelayServers, current.RelayServers) || config.RelayToken != current.RelayToken)
+	networkChanged := relayChanged || config.Offline != current.Offline ||
+		!slices.Equal(config.STUNServers, current.STUNServers) || !slices.Equal(config.PublicIPServices, current.PublicIPServices)
+
+	if renamed {
+		p2p.GetTCPManager().SetIdentity(config.NodeID, config.NodeName)
+	}
+	p2p.GetTCPManager().SetCapabilities(nodeCapabilities(config))
+	p2p.GetTCPManager().SetKeepalive(config.KeepaliveInterval, config.KeepaliveMisses)
+	p2p.GetTCPManager().SetReconnect(config.ReconnectAttempts)
+	p2p.GetTCPManager().SetAllowPlaintext(config.AllowPlaintextPeers)
+	if moved {
+		removePortMapping()
+		startPortMapping(ServicePort(config.ListenPort))
+	}
+	if relayChanged {
+		stopRelayHandler()
+		if config.EnableRelay {
+			startRelayHandler(config.RelayServers)
+		}
+	}
+	if networkChanged {
+		go detectNetworkConditions()
+	}
+	if (renamed || moved) && config.EnableTCP {
+		if err := p2p.GetTCPManager().Announce(); err != nil {
+			fmt.Printf("⚠️ Could not announce the change to the local network, peers see it when they next discover: %v\n", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package mesh
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestReconfigure(t *testing.T) {
+	config := testConfig(t)
+	if err := StartMeshNode(config); err != nil {
+		t.Fatal(err)
+	}
+	defer StopMeshNode()
+
+	tests := []struct {
+		name    string
+		change  func(c *Config)
+		restart bool
+	}{
+		{"name", func(c *Config) { c.NodeName = "renamed" }, false},
+		{"mDNS", func(c *Config) { c.EnableMDNS = !c.EnableMDNS }, true},
+		{"listen port", func(c *Config) { c.ListenPort = testConfig(t).ListenPort }, false},
+		{"data directory", func(c *Config) { c.DataDir = t.TempDir() }, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			before := GetConfig()
+			changed := before
+			test.change(&changed)
+
+			err := Reconfigure(changed)
+			if !test.restart {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if after := GetConfig(); after.NodeName != changed.NodeName || after.ListenPort != changed.ListenPort {
+					t.Errorf("change wasn't applied: %+v", after)
+				}
+				address := net.JoinHostPort("127.0.0.1", strconv.Itoa(ServicePort(changed.ListenPort)))
+				conn, err := net.DialTimeout("tcp", address, time.Second)
+				if err != nil {
+					t.Fatalf("nothing listens at %s after the change: %v", address, err)
+				}
+				conn.Close()
+				if changed.ListenPort != before.ListenPort {
+					old := net.JoinHostPort("127.0.0.1", strconv.Itoa(ServicePort(before.ListenPort)))
+					if conn, err := net.DialTimeout("tcp", old, time.Second); err == nil {
+						conn.Close()
+						t.Errorf("the TCP service still listens at %s", old)
+					}
+				}
+				return
+			}
+			if !errors.Is(err, ErrRestartRequired) {
+				t.Fatalf("got %v, want %v", err, ErrRestartRequired)
+			}
+			if after := GetConfig(); after.ListenPort != before.ListenPort || after.DataDir != before.DataDir || after.EnableMDNS != before.EnableMDNS {
+				t.Errorf("refused change was applied: %+v", after)
+			}
+		})
+	}
+}
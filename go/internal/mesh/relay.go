@@ -0,0 +1,326 @@
+package mesh
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"fileshare/internal/access"
+	"fileshare/internal/relay"
+)
+
+// Relay client
+//
+// A node keeps a connection open to the relays it selected among
+// Config.RelayServers (see relayselect.go), registered under its node ID
+// and kept alive with pings, and opens sessions with peers through them as
+// the relay package describes. Either side uses its session like any other
+// net.Conn. A relay that can't be reached, doesn't know the target or
+// refuses the node's token is skipped for the next one.
+
+const (
+	relayDialTimeout = 5 * time.Second
+
+	// relaySessionTimeout bounds how long the relay may take to set up a
+	// session, which includes the target connecting back
+	relaySessionTimeout = 15 * time.Second
+
+	// relayRetryDelay is how long a node waits before registering again
+	// after losing a relay, multiplied by the failures in a row up to
+	// relayMaxBackoff times
+	relayRetryDelay = 10 * time.Second
+	relayMaxBackoff = 30
+)
+
+var (
+	// ErrNoRelay is returned when relaying is wanted but no relay server is configured
+	ErrNoRelay = errors.New("no relay servers configured")
+
+	// ErrRelayTargetOffline is wrapped by errors from a relay the target is not registered with
+	ErrRelayTargetOffline = errors.New("peer is not connected to the relay")
+
+	// ErrRelayAuth is wrapped by errors from a relay that refused this node's token
+	ErrRelayAuth = errors.New("relay refused this node")
+)
+
+var relayState = struct {
+	sync.Mutex
+	handler       func(net.Conn)
+	registrations map[net.Conn]string // The relay of each registration
+	selection     *relaySelection     // Of the registrations, nil while the relay handler is stopped
+	sessions      map[string]int      // Open sessions per node at the other end
+}{registrations: make(map[net.Conn]string), sessions: make(map[string]int)}
+
+// HandleRelayedConnections sets what takes the sessions other nodes start
+// with this one through a relay. Without a handler they are ignored.
+func HandleRelayedConnections(handler func(conn net.Conn)) {
+	relayState.Lock()
+	defer relayState.Unlock()
+	relayState.handler = handler
+}
+
+// DialRelay opens a session with the node targetID through the first
+// configured relay that can reach it, the fastest first
+func DialRelay(targetID string) (net.Conn, error) {
+	servers := currentConfig().RelayServers
+	if len(servers) == 0 {
+		return nil, ErrNoRelay
+	}
+
+	var errs []error
+	for _, server := range relayOrder(servers) {
+		conn, err := openRelaySession(server, relay.Message{Type: relay.TypeConnect, Target: targetID})
+		if err == nil {
+			return newRelayConn(conn, server, targetID), nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", server, err))
+	}
+	return nil, fmt.Errorf("no relay could reach %s: %w", targetID, errors.Join(errs...))
+}
+
+// openRelaySession connects to server and makes the request that turns the
+// connection into a session
+func openRelaySession(server string, request relay.Message) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", server, relayDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(relaySessionTimeout))
+	request.NodeID, request.Token = GetNodeID(), currentConfig().RelayToken
+	reply, err := relay.Exchange(conn, request)
+	if err == nil && reply.Type != relay.TypeConnected {
+		err = relayReplyError(reply)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// connectToRelayServer keeps this node registered with server while the
+// selection wants it to, see relaySelection
+func connectToRelayServer(s *relaySelection, server string) {
+	fmt.Printf("Connecting to relay server: %s\n", server)
+
+	failures := 0
+	for s.keepRegistering(server) {
+		registered, err := serveRelayRegistration(s, server)
+		if !s.run.active() {
+			continue
+		}
+		if errors.Is(err, ErrRelayAuth) {
+			fmt.Printf("⚠️ Relay server %s: %v\n", server, err)
+		}
+
+		s.setRegistered(server, false, !registered)
+		if registered {
+			failures = 0
+		}
+		failures = min(failures+1, relayMaxBackoff)
+		select {
+		case <-s.run.stopped:
+		case <-time.After(relayRetryDelay * time.Duration(failures)):
+		}
+	}
+}
+
+// serveRelayRegistration registers with server and handles what the relay
+// sends until the connection is lost, reporting whether it got registered
+func serveRelayRegistration(s *relaySelection, server string) (bool, error) {
+	conn, err := net.DialTimeout("tcp", server, relayDialTimeout)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(relaySessionTimeout))
+	nodeID := GetNodeID()
+	reply, err := relay.Exchange(conn, relay.Message{Type: relay.TypeRegister, NodeID: nodeID, Token: currentConfig().RelayToken})
+	if err == nil && reply.Type == relay.TypeChallenge {
+		nodeMutex.RLock()
+		key := nodeKey
+		nodeMutex.RUnlock()
+		if key == nil {
+			return false, errors.New("relays only register nodes that prove their ID, and this node's ID was set without a key")
+		}
+		reply, err = relay.Exchange(conn, relay.Message{
+			Type:      relay.TypeProve,
+			PublicKey: key.Public().(ed25519.PublicKey),
+			Signature: relay.SignRegistration(key, nodeID, reply.Challenge),
+		})
+	}
+	if err != nil {
+		return false, err
+	}
+	if reply.Type != relay.TypeRegistered {
+		return false, relayReplyError(reply)
+	}
+	conn.SetDeadline(time.Time{})
+
+	relayState.Lock()
+	if !s.wanted(server) {
+		// Passed over while registering
+		relayState.Unlock()
+		return true, nil
+	}
+	relayState.registrations[conn] = server
+	relayState.Unlock()
+	fmt.Printf("✅ Registered with relay server %s\n", server)
+	s.setRegistered(server, true, false)
+	defer func() {
+		relayState.Lock()
+		delete(relayState.registrations, conn)
+		relayState.Unlock()
+	}()
+
+	// Pings go out from here while the requests are read below
+	go func() {
+		for s.run.active() {
+			relaySleep()
+			conn.SetWriteDeadline(time.Now().Add(relaySessionTimeout))
+			if err := relay.WriteMessage(conn, relay.Message{Type: relay.TypePing}); err != nil {
+				break
+			}
+		}
+		conn.Close()
+	}()
+
+	for {
+		// The relay answers every ping, so silence means it's gone
+		conn.SetReadDeadline(time.Now().Add(relayRegistrationTTL))
+		var message relay.Message
+		if err := relay.ReadMessage(conn, &message); err != nil {
+			return true, err
+		}
+
+		switch message.Type {
+		case relay.TypeIncoming:
+			go acceptRelaySession(server, message)
+		case relay.TypeError:
+			return true, relayReplyError(message)
+		}
+	}
+}
+
+// acceptRelaySession takes a session another node asked the relay for
+func acceptRelaySession(server string, request relay.Message) {
+	relayState.Lock()
+	handler := relayState.handler
+	relayState.Unlock()
+	if handler == nil || access.RefuseBlockedNode(request.From) != nil {
+		return
+	}
+
+	conn, err := openRelaySession(server, relay.Message{Type: relay.TypeAccept, Session: request.Session})
+	if err != nil {
+		fmt.Printf("⚠️ Could not accept relayed connection from %s: %v\n", request.From, err)
+		return
+	}
+	handler(newRelayConn(conn, server, request.From))
+}
+
+// startRelayHandler registers with the fastest relays in servers and takes
+// the sessions they bring until stopRelayHandler
+func startRelayHandler(servers []string) {
+	fmt.Println("Starting relay connection handler")
+
+	s := newRelaySelection(servers)
+	relayState.Lock()
+	relayState.selection = s
+	relayState.Unlock()
+	go maintainRelays(s)
+}
+
+// stopRelayHandler drops the registrations with every relay
+func stopRelayHandler() {
+	relayState.Lock()
+	defer relayState.Unlock()
+	if relayState.selection != nil {
+		close(relayState.selection.run.stopped)
+		relayState.selection = nil
+	}
+	for conn := range relayState.registrations {
+		conn.Close()
+	}
+
+	nodeMutex.Lock()
+	connectionInfo.Relay = RelayStatus{}
+	connectionInfo.RelayAvailable = false
+	nodeMutex.Unlock()
+}
+
+// relayReplyError turns what a relay answered instead of going ahead into an error
+func relayReplyError(reply relay.Message) error {
+	if reply.Type != relay.TypeError {
+		return fmt.Errorf("unexpected %q from the relay", reply.Type)
+	}
+	switch reply.Code {
+	case relay.CodeOffline:
+		return ErrRelayTargetOffline
+	case relay.CodeAuth:
+		if reply.Error != "" {
+			return fmt.Errorf("%w: %s", ErrRelayAuth, reply.Error)
+		}
+		return ErrRelayAuth
+	}
+	return fmt.Errorf("relay error: %s", reply.Error)
+}
+
+// relayConn is a session through a relay, addressed as the node at the other end
+type relayConn struct {
+	net.Conn
+	remote relayAddr
+	closed sync.Once
+}
+
+// newRelayConn counts the session with node through server as open until it
+// is closed
+func newRelayConn(conn net.Conn, server, node string) *relayConn {
+	relayState.Lock()
+	relayState.sessions[node]++
+	relayState.Unlock()
+	return &relayConn{Conn: conn, remote: relayAddr{server: server, node: node}}
+}
+
+func (c *relayConn) Close() error {
+	c.closed.Do(func() {
+		relayState.Lock()
+		defer relayState.Unlock()
+		if relayState.sessions[c.remote.node]--; relayState.sessions[c.remote.node] <= 0 {
+			delete(relayState.sessions, c.remote.node)
+		}
+	})
+	return c.Conn.Close()
+}
+
+// relaySessionActive reports whether a session with the node nodeID is open
+// through a relay
+func relaySessionActive(nodeID string) bool {
+	relayState.Lock()
+	defer relayState.Unlock()
+	return relayState.sessions[nodeID] > 0
+}
+
+func (c *relayConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// relayAddr is the address of a node reached through a relay
+type relayAddr struct {
+	server string
+	node   string
+}
+
+func (a relayAddr) Network() string {
+	return "relay"
+}
+
+func (a relayAddr) String() string {
+	return a.node + " via " + a.server
+}
@@ -0,0 +1,284 @@
+package mesh
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Relay selection
+//
+// Of the relays in Config.RelayServers the node registers with the one it
+// connects to fastest, the primary, and keeps the next fastest registered as
+// a backup, so it stays reachable while the primary reconnects or is
+// replaced. The relays are measured when relaying starts, every
+// relayEvaluateInterval after and whenever a registration is lost. A relay
+// that can't be connected to, or refused to register the node, is passed
+// over until the next periodic measurement. Sessions with other nodes try
+// the relays in the same order, see DialRelay.
+
+const (
+	// relayEvaluateInterval is how often the relays are measured again
+	relayEvaluateInterval = 5 * time.Minute
+
+	// relaySwitchMargin is how much faster another relay has to be to
+	// replace a primary that still works, so close relays don't take turns
+	relaySwitchMargin = 20 * time.Millisecond
+)
+
+// RelayStatus is the relays the node is registered with
+type RelayStatus struct {
+	Active        string        // host:port of the primary relay, empty without a reachable relay
+	Latency       time.Duration // Of connecting to Active, when last measured
+	Registered    bool          // Whether Active has the node registered right now
+	Backup        string        // host:port of the backup relay, if any
+	BackupLatency time.Duration
+}
+
+// relaySelection is one run of the relay handler, from startRelayHandler to
+// stopRelayHandler. Its fields are guarded by relayState.
+type relaySelection struct {
+	run        *nodeRun
+	servers    []string
+	latencies  map[string]time.Duration // Of the relays that could be connected to when last measured
+	failing    map[string]bool          // Relays that refused to register the node since
+	registered map[string]bool
+	loops      map[string]bool // Relays a connectToRelayServer is running for
+	primary    string
+	backup     string
+	evaluate   chan struct{}
+}
+
+func newRelaySelection(servers []string) *relaySelection {
+	return &relaySelection{
+		run:        &nodeRun{stopped: make(chan struct{})},
+		servers:    slices.Clone(servers),
+		latencies:  make(map[string]time.Duration),
+		failing:    make(map[string]bool),
+		registered: make(map[string]bool),
+		loops:      make(map[string]bool),
+		evaluate:   make(chan struct{}, 1),
+	}
+}
+
+// maintainRelays keeps the selection up to date until the run ends
+func maintainRelays(s *relaySelection) {
+	s.selectRelays()
+	for {
+		timer := time.NewTimer(relayEvaluateInterval)
+		select {
+		case <-s.run.stopped:
+			timer.Stop()
+			return
+		case <-s.evaluate:
+			timer.Stop()
+		case <-timer.C:
+			// Relays that refused the node get another chance
+			relayState.Lock()
+			clear(s.failing)
+			relayState.Unlock()
+		}
+		s.selectRelays()
+	}
+}
+
+// reevaluate has the relays measured and selected again soon
+func (s *relaySelection) reevaluate() {
+	select {
+	case s.evaluate <- struct{}{}:
+	default:
+	}
+}
+
+// selectRelays measures the relays, picks the primary and the backup,
+// registers with them and drops the registrations with the others
+func (s *relaySelection) selectRelays() {
+	latencies := measureRelays(s.servers)
+
+	relayState.Lock()
+	if !s.run.active() {
+		relayState.Unlock()
+		return
+	}
+	s.latencies = latencies
+	previous := s.primary
+	s.primary, s.backup = rankRelays(s.servers, latencies, s.failing, previous)
+	for _, server := range []string{s.primary, s.backup} {
+		if server != "" && !s.loops[server] {
+			s.loops[server] = true
+			go connectToRelayServer(s, server)
+		}
+	}
+	for conn, server := range relayState.registrations {
+		if !s.wanted(server) {
+			conn.Close()
+		}
+	}
+	primary, latency := s.primary, latencies[s.primary]
+	relayState.Unlock()
+	s.publishStatus()
+
+	switch {
+	case primary == previous:
+	case primary == "":
+		fmt.Println("⚠️ No relay server can be reached, peers behind other networks can't connect through one")
+	default:
+		fmt.Printf("Using relay server %s (%s)\n", primary, latency.Round(time.Millisecond))
+	}
+}
+
+// rankRelays picks the primary and backup among servers, the fastest of
+// those that could be connected to and didn't refuse the node. The current
+// primary is kept unless another relay is faster by relaySwitchMargin.
+func rankRelays(servers []string, latencies map[string]time.Duration, failing map[string]bool, current string) (primary, backup string) {
+	var healthy []string
+	for _, server := range servers {
+		if _, ok := latencies[server]; ok && !failing[server] {
+			healthy = append(healthy, server)
+		}
+	}
+	slices.SortStableFunc(healthy, func(a, b string) int {
+		return int(latencies[a] - latencies[b])
+	})
+	if len(healthy) == 0 {
+		return "", ""
+	}
+
+	primary = healthy[0]
+	if i := slices.Index(healthy, current); i > 0 && latencies[current]-latencies[primary] < relaySwitchMargin {
+		healthy[0], healthy[i] = healthy[i], healthy[0]
+		primary = current
+	}
+	if len(healthy) > 1 {
+		backup = healthy[1]
+	}
+	return primary, backup
+}
+
+// measureRelays connects to every server at once and returns how long it
+// took for those that could be connected to
+func measureRelays(servers []string) map[string]time.Duration {
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	latencies := make(map[string]time.Duration)
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server string) {
+			defer wg.Done()
+			started := time.Now()
+			conn, err := net.DialTimeout("tcp", server, relayDialTimeout)
+			if err != nil {
+				return
+			}
+			latency := time.Since(started)
+			conn.Close()
+			mutex.Lock()
+			latencies[server] = latency
+			mutex.Unlock()
+		}(server)
+	}
+	wg.Wait()
+	return latencies
+}
+
+// wanted reports whether the node should stay registered with server
+func (s *relaySelection) wanted(server string) bool {
+	return s.run.active() && relayState.selection == s && (server == s.primary || server == s.backup)
+}
+
+// keepRegistering reports whether the connectToRelayServer for server goes
+// on, taking it off the running loops when it doesn't
+func (s *relaySelection) keepRegistering(server string) bool {
+	relayState.Lock()
+	defer relayState.Unlock()
+	if s.wanted(server) {
+		return true
+	}
+	delete(s.loops, server)
+	return false
+}
+
+// setRegistered records whether server has the node registered, and has the
+// relays measured again when a registration was refused or lost
+func (s *relaySelection) setRegistered(server string, registered bool, refused bool) {
+	relayState.Lock()
+	lost := s.registered[server] && !registered && s.wanted(server)
+	s.registered[server] = registered
+	if refused {
+		s.failing[server] = true
+	} else if registered {
+		delete(s.failing, server)
+	}
+	relayState.Unlock()
+
+	s.publishStatus()
+	if lost || refused {
+		s.reevaluate()
+	}
+}
+
+// ordered returns servers with the primary first, then the backup, then the
+// others from the fastest, and those that couldn't be connected to last
+func (s *relaySelection) ordered(servers []string) []string {
+	relayState.Lock()
+	defer relayState.Unlock()
+	rank := func(server string) (int, time.Duration) {
+		latency, reachable := s.latencies[server]
+		switch {
+		case server == s.primary:
+			return 0, 0
+		case server == s.backup:
+			return 1, 0
+		case reachable && !s.failing[server]:
+			return 2, latency
+		}
+		return 3, 0
+	}
+	ordered := slices.Clone(servers)
+	slices.SortStableFunc(ordered, func(a, b string) int {
+		groupA, latencyA := rank(a)
+		groupB, latencyB := rank(b)
+		if groupA != groupB {
+			return groupA - groupB
+		}
+		return int(latencyA - latencyB)
+	})
+	return ordered
+}
+
+// publishStatus records the selection in the connection information, unless
+// the run already ended
+func (s *relaySelection) publishStatus() {
+	relayState.Lock()
+	defer relayState.Unlock()
+	if relayState.selection != s || !s.run.active() {
+		return
+	}
+	status := RelayStatus{
+		Active:     s.primary,
+		Latency:    s.latencies[s.primary],
+		Registered: s.registered[s.primary],
+		Backup:     s.backup,
+	}
+	if s.backup != "" {
+		status.BackupLatency = s.latencies[s.backup]
+	}
+
+	nodeMutex.Lock()
+	connectionInfo.Relay = status
+	connectionInfo.RelayAvailable = s.primary != ""
+	nodeMutex.Unlock()
+}
+
+// relayOrder returns servers in the order sessions try them, see ordered
+func relayOrder(servers []string) []string {
+	relayState.Lock()
+	s := relayState.selection
+	relayState.Unlock()
+	if s == nil {
+		return servers
+	}
+	return s.ordered(servers)
+}
@@ -0,0 +1,286 @@
+package mesh
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"fileshare/internal/access"
+	"fileshare/internal/p2p"
+)
+
+// Routing
+//
+// Every routing pass a node shares its neighbor list, the online peers it
+// reaches directly, with the peers it is connected to, together with the
+// lists it learned from others, so every list spreads through the mesh. From
+// them it works out, for each peer, the best route through each of its
+// direct neighbors. A link of quality q (0-100%) counts as 100/q hops, so a
+// good link wins over a slightly shorter poor one, and no route is longer
+// than maxRouteHops. A route's quality is that of its links multiplied.
+//
+// Lists not refreshed within neighborListTTL are dropped, direct neighbors
+// that are offline are left out and a peer that announced its departure is
+// left out everywhere, so routes through a peer that went away are gone by
+// the next pass. Nodes only reachable through others become known peers
+// without an address.
+
+const (
+	// maxRouteHops bounds how many links a route may have
+	maxRouteHops = 4
+
+	// neighborListTTL is how long a neighbor list counts without being refreshed
+	neighborListTTL = 3 * routingInterval
+
+	// neighborsTimeout bounds how long sharing the neighbor lists may take
+	neighborsTimeout = 2 * time.Second
+
+	// ProtocolMesh is the protocol of peers only reachable through other peers
+	ProtocolMesh = "mesh"
+)
+
+// learnedList is a neighbor list received from another node
+type learnedList struct {
+	neighbors []p2p.Neighbor
+	updated   time.Time // When its node reported it
+}
+
+var neighborTable = struct {
+	sync.Mutex
+	lists    map[string]learnedList
+	departed map[string]time.Time // Nodes that announced they left, kept for neighborListTTL
+	own      []p2p.Neighbor       // This node's list, as of the last routing pass
+}{lists: make(map[string]learnedList), departed: make(map[string]time.Time)}
+
+// learnNeighbors keeps the neighbor lists from a connected peer that are
+// newer than those already known
+func learnNeighbors(from string, lists []p2p.NeighborList) {
+	now := time.Now()
+	self := GetNodeID()
+	blocked, _ := access.LoadBlocklist()
+
+	neighborTable.Lock()
+	defer neighborTable.Unlock()
+	for _, list := range lists {
+		if list.NodeID == "" || list.NodeID == self || blocked.Match(list.NodeID, "") != nil {
+			continue
+		}
+		updated := now.Add(-time.Duration(list.Age) * time.Second)
+		if known, ok := neighborTable.lists[list.NodeID]; ok && !updated.After(known.updated) {
+			continue
+		}
+		if departed, ok := neighborTable.departed[list.NodeID]; ok && !updated.After(departed) {
+			continue
+		}
+		neighborTable.lists[list.NodeID] = learnedList{neighbors: list.Neighbors, updated: updated}
+	}
+}
+
+// forgetNeighbors drops what is known about the links of a node that left
+func forgetNeighbors(id string) {
+	neighborTable.Lock()
+	defer neighborTable.Unlock()
+	delete(neighborTable.lists, id)
+	neighborTable.departed[id] = time.Now()
+}
+
+// updateRoutes recomputes the routes to every peer and shares this node's
+// neighbor lists
+func updateRoutes() {
+	now := time.Now()
+	self := GetNodeID()
+
+	// The peers this node reaches itself, with the quality measured for
+	// their links where there is one (see linkquality.go)
+	measured := routedLinkQualities()
+	peersMutex.RLock()
+	var own []p2p.Neighbor
+	direct := make(map[string]int)
+	for _, peer := range knownPeers {
+		if peer.IsOnline && peer.Address != "" && peer.GossipOrigin == "" {
+			quality, ok := measured[peer.ID]
+			if !ok {
+				quality = linkQuality(peer.SignalStrength)
+			}
+			own = append(own, p2p.Neighbor{ID: peer.ID, Name: peer.Name, Quality: quality})
+			direct[peer.ID] = quality
+		}
+	}
+	peersMutex.RUnlock()
+
+	// What others reach, as far as it is still current
+	neighborTable.Lock()
+	neighborTable.own = own
+	for id, departed := range neighborTable.departed {
+		if now.Sub(departed) > neighborListTTL {
+			delete(neighborTable.departed, id)
+		}
+	}
+	shared := []p2p.NeighborList{{NodeID: self, Neighbors: own}}
+	lists := make(map[string][]p2p.Neighbor)
+	names := make(map[string]string)
+	for id, list := range neighborTable.lists {
+		if now.Sub(list.updated) > neighborListTTL {
+			delete(neighborTable.lists, id)
+			continue
+		}
+		shared = append(shared, p2p.NeighborList{NodeID: id, Neighbors: list.neighbors, Age: int(now.Sub(list.updated).Seconds())})
+
+		var neighbors []p2p.Neighbor
+		for _, neighbor := range list.neighbors {
+			if _, departed := neighborTable.departed[neighbor.ID]; !departed {
+				neighbors = append(neighbors, neighbor)
+				names[neighbor.ID] = neighbor.Name
+			}
+		}
+		lists[id] = neighbors
+	}
+	neighborTable.Unlock()
+
+	routes := computeRoutes(self, direct, lists, maxRouteHops)
+	applyRoutes(self, routes, names)
+
+	p2p.GetTCPManager().BroadcastNeighbors(self, shared, neighborsTimeout)
+}
+
+// applyRoutes gives every peer its routes, adding the nodes only reachable
+// through others as peers
+func applyRoutes(self string, routes map[string][]Route, names map[string]string) {
+	var changes []peerChange
+	var rerouted, discovered []Peer
+	blocked, _ := access.LoadBlocklist()
+
+	peersMutex.Lock()
+	for id, peer := range knownPeers {
+		if !sameRoutes(peer.Routes, routes[id]) {
+			peer.Routes = routes[id]
+			rerouted = append(rerouted, *peer)
+		}
+		if (peer.Address == "" || peer.GossipOrigin != "") && len(peer.Routes) > 0 {
+			// Seen again, through the mesh
+			peer.LastSeen = time.Now()
+			if !peer.IsOnline {
+				peer.IsOnline = true
+				changes = append(changes, peerChange{*peer, PeerOnline})
+			}
+		}
+	}
+	for id, peerRoutes := range routes {
+		if _, known := knownPeers[id]; known || id == self || blocked.Match(id, "") != nil {
+			continue
+		}
+		peer := &Peer{
+			ID:       id,
+			Name:     names[id],
+			Protocol: ProtocolMesh,
+			IsOnline: true,
+			LastSeen: time.Now(),
+			Routes:   peerRoutes,
+		}
+		knownPeers[id] = peer
+		discovered = append(discovered, *peer)
+		changes = append(changes, peerChange{*peer, PeerOnline})
+	}
+	peersMutex.Unlock()
+
+	if len(changes) > 0 {
+		saveKnownPeers()
+	}
+	for _, peer := range discovered {
+		publishPeer(EventPeerDiscovered, peer)
+	}
+	notifyPeerStates(changes)
+	publishRoutes(rerouted)
+}
+
+// computeRoutes finds the best route from self to every node through each of
+// self's direct neighbors, given the quality of the links to those neighbors
+// and the neighbor lists of other nodes. Links are taken to work both ways.
+func computeRoutes(self string, direct map[string]int, lists map[string][]p2p.Neighbor, maxHops int) map[string][]Route {
+	links := make(map[string]map[string]int)
+	addLink := func(from, to string, quality int) {
+		if links[from] == nil {
+			links[from] = make(map[string]int)
+		}
+		links[from][to] = max(links[from][to], quality)
+	}
+	for node, neighbors := range lists {
+		for _, neighbor := range neighbors {
+			addLink(node, neighbor.ID, linkQuality(neighbor.Quality))
+			addLink(neighbor.ID, node, linkQuality(neighbor.Quality))
+		}
+	}
+
+	// From each direct neighbor, the cheapest way to every node within
+	// maxHops, extending the paths improved in the last round by one link
+	type path struct {
+		cost    float64
+		hops    int
+		quality float64
+	}
+	routes := make(map[string][]Route)
+	for first, quality := range direct {
+		quality = linkQuality(quality)
+		best := map[string]path{first: {cost: linkCost(quality), hops: 1, quality: float64(quality) / 100}}
+		frontier := map[string]path{first: best[first]}
+		for hops := 2; hops <= maxHops && len(frontier) > 0; hops++ {
+			next := make(map[string]path)
+			for node, p := range frontier {
+				for neighbor, quality := range links[node] {
+					if neighbor == self {
+						continue
+					}
+					extended := path{cost: p.cost + linkCost(quality), hops: hops, quality: p.quality * float64(quality) / 100}
+					if known, ok := best[neighbor]; ok && known.cost <= extended.cost {
+						continue
+					}
+					if known, ok := next[neighbor]; ok && known.cost <= extended.cost {
+						continue
+					}
+					next[neighbor] = extended
+				}
+			}
+			for node, p := range next {
+				best[node] = p
+			}
+			frontier = next
+		}
+
+		for destination, p := range best {
+			routes[destination] = append(routes[destination], Route{
+				DestinationID: destination,
+				NextHop:       first,
+				HopCount:      p.hops,
+				Quality:       int(math.Round(p.quality * 100)),
+			})
+		}
+	}
+
+	// Best routes first
+	for _, destinationRoutes := range routes {
+		sort.Slice(destinationRoutes, func(i, j int) bool {
+			if destinationRoutes[i].Quality != destinationRoutes[j].Quality {
+				return destinationRoutes[i].Quality > destinationRoutes[j].Quality
+			}
+			if destinationRoutes[i].HopCount != destinationRoutes[j].HopCount {
+				return destinationRoutes[i].HopCount < destinationRoutes[j].HopCount
+			}
+			return destinationRoutes[i].NextHop < destinationRoutes[j].NextHop
+		})
+	}
+	return routes
+}
+
+// linkQuality treats an unknown quality as a perfect link
+func linkQuality(quality int) int {
+	if quality <= 0 || quality > 100 {
+		return 100
+	}
+	return quality
+}
+
+// linkCost is what a link of quality counts as in hops
+func linkCost(quality int) float64 {
+	return 100 / float64(linkQuality(quality))
+}
@@ -0,0 +1,211 @@
+package mesh
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"fileshare/internal/p2p"
+)
+
+// topology builds neighbor lists from links written "a-b" or "a-b:quality"
+func topology(links ...string) map[string][]p2p.Neighbor {
+	lists := make(map[string][]p2p.Neighbor)
+	for _, link := range links {
+		ends, qualityText, _ := strings.Cut(link, ":")
+		from, to, _ := strings.Cut(ends, "-")
+		quality, _ := strconv.Atoi(qualityText)
+		lists[from] = append(lists[from], p2p.Neighbor{ID: to, Quality: quality})
+	}
+	return lists
+}
+
+// describeRoutes writes each route as "next hop/hops/quality"
+func describeRoutes(routes map[string][]Route) map[string][]string {
+	described := make(map[string][]string)
+	for destination, destinationRoutes := range routes {
+		for _, route := range destinationRoutes {
+			if route.DestinationID != destination {
+				described[destination] = append(described[destination], "wrong destination "+route.DestinationID)
+			}
+			described[destination] = append(described[destination], fmt.Sprintf("%s/%d/%d", route.NextHop, route.HopCount, route.Quality))
+		}
+	}
+	return described
+}
+
+func TestComputeRoutes(t *testing.T) {
+	tests := []struct {
+		name   string
+		direct map[string]int
+		links  []string
+		want   map[string][]string
+	}{
+		{
+			name:   "alone",
+			direct: nil,
+			links:  []string{"x-y"},
+			want:   map[string][]string{},
+		},
+		{
+			name:   "chain past the hop bound",
+			direct: map[string]int{"a": 100},
+			links:  []string{"a-b", "b-c", "c-d", "d-e"},
+			want: map[string][]string{
+				"a": {"a/1/100"},
+				"b": {"a/2/100"},
+				"c": {"a/3/100"},
+				"d": {"a/4/100"},
+			},
+		},
+		{
+			name:   "qualities multiply",
+			direct: map[string]int{"a": 50},
+			links:  []string{"a-b:50", "b-c:80"},
+			want: map[string][]string{
+				"a": {"a/1/50"},
+				"b": {"a/2/25"},
+				"c": {"a/3/20"},
+			},
+		},
+		{
+			name:   "unknown quality counts as perfect",
+			direct: map[string]int{"a": 0},
+			links:  []string{"a-b:0", "b-c:150"},
+			want: map[string][]string{
+				"a": {"a/1/100"},
+				"b": {"a/2/100"},
+				"c": {"a/3/100"},
+			},
+		},
+		{
+			name:   "quality over hop count",
+			direct: map[string]int{"a": 100},
+			links:  []string{"a-b:20", "b-d", "a-c", "c-e", "e-d"},
+			want: map[string][]string{
+				"a": {"a/1/100"},
+				"b": {"a/2/20"},
+				"c": {"a/2/100"},
+				"d": {"a/4/100"},
+				"e": {"a/3/100"},
+			},
+		},
+		{
+			name:   "a route through each neighbor, best first",
+			direct: map[string]int{"a": 100, "b": 30},
+			links:  []string{"a-c", "c-d", "b-d"},
+			want: map[string][]string{
+				"a": {"a/1/100", "b/4/30"},
+				"b": {"a/4/100", "b/1/30"},
+				"c": {"a/2/100", "b/3/30"},
+				"d": {"a/3/100", "b/2/30"},
+			},
+		},
+		{
+			name:   "ties broken by hop count, then next hop",
+			direct: map[string]int{"b": 100, "a": 100},
+			links:  []string{"a-c", "b-c"},
+			want: map[string][]string{
+				"a": {"a/1/100", "b/3/100"},
+				"b": {"b/1/100", "a/3/100"},
+				"c": {"a/2/100", "b/2/100"},
+			},
+		},
+		{
+			name:   "links back to self are ignored",
+			direct: map[string]int{"a": 100},
+			links:  []string{"a-s", "b-s", "a-b"},
+			want: map[string][]string{
+				"a": {"a/1/100"},
+				"b": {"a/2/100"},
+			},
+		},
+		{
+			name:   "links reported by one end work both ways",
+			direct: map[string]int{"a": 100},
+			links:  []string{"b-a:50", "c-b"},
+			want: map[string][]string{
+				"a": {"a/1/100"},
+				"b": {"a/2/50"},
+				"c": {"a/3/50"},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := describeRoutes(computeRoutes("s", test.direct, topology(test.links...), maxRouteHops))
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLearnNeighbors(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	nodeMutex.Lock()
+	nodeID = "self"
+	nodeMutex.Unlock()
+	defer func() {
+		nodeMutex.Lock()
+		nodeID = ""
+		nodeMutex.Unlock()
+	}()
+
+	list := func(id string, age int, neighbors ...string) p2p.NeighborList {
+		l := p2p.NeighborList{NodeID: id, Age: age}
+		for _, neighbor := range neighbors {
+			l.Neighbors = append(l.Neighbors, p2p.Neighbor{ID: neighbor})
+		}
+		return l
+	}
+	tests := []struct {
+		name   string
+		before func()
+		lists  []p2p.NeighborList
+		want   []string // Neighbors known for "x" afterwards, nil if none
+	}{
+		{"new list", nil, []p2p.NeighborList{list("x", 5, "a")}, []string{"a"}},
+		{"newer list replaces", nil, []p2p.NeighborList{list("x", 10, "a"), list("x", 1, "b")}, []string{"b"}},
+		{"older list is ignored", nil, []p2p.NeighborList{list("x", 1, "b"), list("x", 10, "a")}, []string{"b"}},
+		{"own list is ignored", nil, []p2p.NeighborList{list("self", 0, "a")}, nil},
+		{"list without a node is ignored", nil, []p2p.NeighborList{list("", 0, "a")}, nil},
+		{"list from before a departure is ignored", func() { forgetNeighbors("x") }, []p2p.NeighborList{list("x", 5, "a")}, nil},
+		{"list from after a departure counts", func() {
+			forgetNeighbors("x")
+			neighborTable.Lock()
+			neighborTable.departed["x"] = time.Now().Add(-time.Minute)
+			neighborTable.Unlock()
+		}, []p2p.NeighborList{list("x", 5, "a")}, []string{"a"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			neighborTable.Lock()
+			neighborTable.lists = make(map[string]learnedList)
+			neighborTable.departed = make(map[string]time.Time)
+			neighborTable.Unlock()
+			if test.before != nil {
+				test.before()
+			}
+
+			learnNeighbors("peer", test.lists)
+
+			neighborTable.Lock()
+			defer neighborTable.Unlock()
+			if _, ok := neighborTable.lists["self"]; ok {
+				t.Error("learned this node's own list")
+			}
+			var got []string
+			for _, neighbor := range neighborTable.lists["x"].neighbors {
+				got = append(got, neighbor.ID)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("neighbors of x are %v, want %v", got, test.want)
+			}
+		})
+	}
+}
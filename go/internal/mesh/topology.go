@@ -0,0 +1,183 @@
+package mesh
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// Network topology
+//
+// GetNetworkTopology describes the mesh as a graph, for network maps: this
+// node, every known peer and the links between them. This node's links are
+// those to the peers it reaches directly, as of the last routing pass, and
+// to the peers it has a session with through a relay. The links of other
+// nodes come from the neighbor lists they share (see routing.go), so peers
+// only heard of from a peer exchange (see gossip.go) have none until a list
+// mentions them. Links work both ways, so each appears once.
+
+// TopologyNode is a node of the mesh
+type TopologyNode struct {
+	ID        string   `json:"id"`
+	Name      string   `json:"name"`
+	Online    bool     `json:"online"`
+	Local     bool     `json:"local,omitempty"`     // Whether it is this node
+	Protocols []string `json:"protocols,omitempty"` // How this node reaches it: "tcp", ProtocolMesh or ProtocolRelay
+	HopCount  int      `json:"hop_count"`           // Of the shortest route to it, 0 for this node and -1 without a route
+}
+
+// TopologyEdge is a link between two nodes of the mesh
+type TopologyEdge struct {
+	From     string `json:"from"` // Node IDs, From the one closer to this node
+	To       string `json:"to"`
+	Quality  int    `json:"quality"`           // 0-100%
+	HopCount int    `json:"hop_count"`         // How far from this node the link ends, 1 for its own links
+	Relayed  bool   `json:"relayed,omitempty"` // Through a relay server rather than a direct link
+}
+
+// Topology is the graph of the mesh as this node knows it
+type Topology struct {
+	LocalID string         `json:"local_id"`
+	Nodes   []TopologyNode `json:"nodes"` // This node first, then by hop count and name
+	Edges   []TopologyEdge `json:"edges"` // By hop count
+}
+
+// GetNetworkTopology returns the graph of the mesh, see above
+func GetNetworkTopology() (Topology, error) {
+	if !isRunning() {
+		return Topology{}, errors.New("mesh node is not running")
+	}
+	self := GetNodeID()
+	now := time.Now()
+
+	// The links, keyed by their ends in order so each is kept once
+	type ends struct{ a, b string }
+	links := make(map[ends]TopologyEdge)
+	addLink := func(from, to string, quality int, relayed bool) {
+		key := ends{from, to}
+		if to < from {
+			key = ends{to, from}
+		}
+		quality = linkQuality(quality)
+		if known, ok := links[key]; ok {
+			// Direct links win over relayed ones, then better ones
+			if !known.Relayed && relayed || known.Relayed == relayed && known.Quality >= quality {
+				return
+			}
+		}
+		links[key] = TopologyEdge{From: from, To: to, Quality: quality, Relayed: relayed}
+	}
+
+	names := make(map[string]string)
+	neighborTable.Lock()
+	for _, neighbor := range neighborTable.own {
+		addLink(self, neighbor.ID, neighbor.Quality, false)
+	}
+	for id, list := range neighborTable.lists {
+		if now.Sub(list.updated) > neighborListTTL {
+			continue
+		}
+		if _, departed := neighborTable.departed[id]; departed {
+			continue
+		}
+		for _, neighbor := range list.neighbors {
+			if _, departed := neighborTable.departed[neighbor.ID]; !departed {
+				addLink(id, neighbor.ID, neighbor.Quality, false)
+				names[neighbor.ID] = neighbor.Name
+			}
+		}
+	}
+	neighborTable.Unlock()
+
+	topology := Topology{LocalID: self}
+	hops := map[string]int{self: 0}
+	topology.Nodes = append(topology.Nodes, TopologyNode{ID: self, Name: GetNodeName(), Online: true, Local: true})
+
+	peersMutex.RLock()
+	for id, peer := range knownPeers {
+		node := TopologyNode{ID: id, Name: peer.Name, Online: peer.IsOnline, HopCount: -1}
+		if peer.IsOnline && peer.Address != "" && peer.GossipOrigin == "" {
+			node.Protocols = append(node.Protocols, "tcp")
+		}
+		routed := false
+		for _, route := range peer.Routes {
+			if node.HopCount < 0 || route.HopCount < node.HopCount {
+				node.HopCount = route.HopCount
+			}
+			routed = routed || route.HopCount > 1
+		}
+		if routed {
+			node.Protocols = append(node.Protocols, ProtocolMesh)
+		}
+		if relaySessionActive(id) {
+			node.Protocols = append(node.Protocols, ProtocolRelay)
+			addLink(self, id, 0, true)
+			if node.HopCount < 0 {
+				node.HopCount = 1
+			}
+		}
+		hops[id] = node.HopCount
+		topology.Nodes = append(topology.Nodes, node)
+		delete(names, id)
+	}
+	peersMutex.RUnlock()
+
+	// Nodes other lists mention that aren't peers, such as blocked ones
+	for id, name := range names {
+		if id == self {
+			continue
+		}
+		hops[id] = -1
+		topology.Nodes = append(topology.Nodes, TopologyNode{ID: id, Name: name, Online: true, HopCount: -1})
+	}
+
+	for _, edge := range links {
+		// From the end closer to this node
+		if distance(hops, edge.To) < distance(hops, edge.From) {
+			edge.From, edge.To = edge.To, edge.From
+		}
+		if edge.From == self {
+			edge.HopCount = 1
+		} else if hop := hops[edge.From]; hop >= 0 {
+			edge.HopCount = hop + 1
+		} else {
+			edge.HopCount = -1
+		}
+		topology.Edges = append(topology.Edges, edge)
+	}
+
+	others := topology.Nodes[1:]
+	sort.Slice(others, func(i, j int) bool {
+		a, b := others[i], others[j]
+		if distance(hops, a.ID) != distance(hops, b.ID) {
+			return distance(hops, a.ID) < distance(hops, b.ID)
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.ID < b.ID
+	})
+	sort.Slice(topology.Edges, func(i, j int) bool {
+		a, b := topology.Edges[i], topology.Edges[j]
+		if a.HopCount != b.HopCount {
+			// Links of unreachable nodes, at -1, last
+			return b.HopCount < 0 || a.HopCount >= 0 && a.HopCount < b.HopCount
+		}
+		if a.From != b.From {
+			return a.From < b.From
+		}
+		return a.To < b.To
+	})
+	if topology.Edges == nil {
+		topology.Edges = []TopologyEdge{}
+	}
+	return topology, nil
+}
+
+// distance is the hop count of id in hops, with unreachable nodes farthest
+func distance(hops map[string]int, id string) int {
+	if hop, ok := hops[id]; ok && hop >= 0 {
+		return hop
+	}
+	return maxRouteHops + 1
+}
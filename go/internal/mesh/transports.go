@@ -0,0 +1,94 @@
+package mesh
+
+import (
+	"net"
+
+	"fileshare/internal/p2p"
+)
+
+// Transports
+//
+// A node seen over several protocols is one peer, filed under the node ID
+// its handshakes and discovery answers prove, with a transport for each
+// protocol it was seen on (see p2p.Transport). Address, Protocol and
+// SignalStrength of the peer are those of its best transport, seen within
+// Config.OfflineAfter; connectToPeer tries the transports best first before
+// going through other nodes or a relay.
+
+// Protocols lists the protocols the peer was seen on, best first
+func (p Peer) Protocols() []string {
+	if len(p.Transports) == 0 {
+		if p.Protocol == "" {
+			return nil
+		}
+		return []string{p.Protocol}
+	}
+	protocols := make([]string, len(p.Transports))
+	for i, t := range p.Transports {
+		protocols[i] = t.Protocol
+	}
+	return protocols
+}
+
+// sightings is how peer, as just seen, was seen
+func sightings(peer Peer) []p2p.Transport {
+	if len(peer.Transports) > 0 {
+		return peer.Transports
+	}
+	if peer.Address == "" || peer.Protocol == ProtocolMesh {
+		return nil
+	}
+	return []p2p.Transport{{
+		Protocol:       peer.Protocol,
+		Address:        peer.Address,
+		SignalStrength: peer.SignalStrength,
+		LastSeen:       peer.LastSeen,
+	}}
+}
+
+// useBestTransport sets the address, protocol and signal of peer from its
+// best transport
+func useBestTransport(peer *Peer) {
+	if len(peer.Transports) == 0 {
+		return
+	}
+	best := peer.Transports[0]
+	peer.Address, peer.Protocol, peer.SignalStrength = best.Address, best.Protocol, best.SignalStrength
+}
+
+// transportConnectors are how connectToPeer reaches a peer over each
+// protocol it may have a transport on; the peer it is given has the
+// transport's address
+var transportConnectors = map[string]func(*Peer) (net.Conn, error){
+	ProtocolTCP:        connectDirectly,
+	ProtocolWiFiDirect: connectViaWiFiDirect,
+}
+
+// connectOverTransports connects to peer over its transports, best first,
+// leaving out WiFi Direct unless enabled. It returns the error of the best
+// one when all fail, or nil and nil without a transport to try.
+func connectOverTransports(peer *Peer) (*PeerConn, error) {
+	transports := peer.Transports
+	if len(transports) == 0 && peer.Protocol == ProtocolTCP && peer.Address != "" {
+		// Known from before transports were kept
+		transports = []p2p.Transport{{Protocol: ProtocolTCP, Address: peer.Address}}
+	}
+
+	var firstErr error
+	for _, t := range transports {
+		connect, ok := transportConnectors[t.Protocol]
+		if !ok || (t.Protocol == ProtocolWiFiDirect && !currentConfig().EnableWiFiDirect) {
+			continue
+		}
+		at := *peer
+		at.Address = t.Address
+		conn, err := openPeerConn(&at, t.Protocol, "", directConnectTimeout, connect)
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
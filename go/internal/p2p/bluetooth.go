@@ -7,6 +7,37 @@ import (
 	"time"
 )
 
+// Bluetooth LE
+//
+// Nodes find each other over Bluetooth LE: each advertises the BitShare
+// service UUID, with its node name in the scan response where the OS lets
+// it set the name (see bluetooth_windows.go), and Discover scans
+// for advertisements carrying the UUID for its timeout. Devices found are
+// filed under their Bluetooth address, with the strongest signal they were
+// heard at. The OS runs Bluetooth: BlueZ on Linux, through bluetoothctl, and
+// WinRT on Windows, each behind a bluetoothDriver.
+//
+// Bluetooth is supported when the OS has an adapter; Start fails without one.
+
+// bluetoothDriver runs Bluetooth LE on an OS
+type bluetoothDriver interface {
+	// advertise starts advertising serviceUUID, with name in the scan
+	// response, until close
+	advertise(serviceUUID, name string) error
+
+	// scan returns the devices found advertising serviceUUID within timeout
+	scan(serviceUUID string, timeout time.Duration) ([]bluetoothDevice, error)
+
+	close() error
+}
+
+// bluetoothDevice is a device a scan found
+type bluetoothDevice struct {
+	Address string
+	Name    string
+	RSSI    int // In dBm
+}
+
 // BluetoothManager handles Bluetooth connections
 type BluetoothManager struct {
 	isRunning      bool
@@ -14,6 +45,8 @@ type BluetoothManager struct {
 	mutex          sync.RWMutex
 	serviceName    string
 	serviceUUID    string
+	nodeName       string          // Set by SetName
+	driver         bluetoothDriver // While running
 }
 
 // BluetoothPeer represents a peer connected via Bluetooth
@@ -44,6 +77,13 @@ func GetBluetoothManager() *BluetoothManager {
 	return bluetoothManager
 }
 
+// SetName sets the node name advertised, the service name until set
+func (bm *BluetoothManager) SetName(name string) {
+	bm.mutex.Lock()
+	defer bm.mutex.Unlock()
+	bm.nodeName = name
+}
+
 // Start initializes and starts the Bluetooth service
 func (bm *BluetoothManager) Start() error {
 	bm.mutex.Lock()
@@ -59,23 +99,25 @@ func (bm *BluetoothManager) Start() error {
 		return fmt.Errorf("failed to check Bluetooth support: %w", err)
 	}
 	if !supported {
-		return errors.New("Bluetooth is not supported or not available on this device")
+		return errors.New("no Bluetooth adapter found on this device")
 	}
 
-	// Initialize Bluetooth service
-	err = bm.initializeService()
+	bm.driver, err = newBluetoothDriver()
 	if err != nil {
-		return fmt.Errorf("failed to initialize Bluetooth service: %w", err)
+		return fmt.Errorf("failed to start Bluetooth: %w", err)
 	}
 
-	bm.isRunning = true
-
-	// Start advertising service
-	go bm.advertiseService()
-
-	// Start scanning for other devices
-	go bm.scanForDevices()
+	name := bm.nodeName
+	if name == "" {
+		name = bm.serviceName
+	}
+	if err := bm.driver.advertise(bm.serviceUUID, name); err != nil {
+		bm.driver.close()
+		bm.driver = nil
+		return fmt.Errorf("failed to advertise over Bluetooth: %w", err)
+	}
 
+	bm.isRunning = true
 	return nil
 }
 
@@ -88,9 +130,9 @@ func (bm *BluetoothManager) Stop() error {
 		return nil
 	}
 
-	// Stop advertising and scanning
-	bm.stopAdvertising()
-	bm.stopScanning()
+	// Stop advertising
+	bm.driver.close()
+	bm.driver = nil
 
 	// Disconnect from all peers
 	for _, peer := range bm.connectedPeers {
@@ -105,33 +147,33 @@ func (bm *BluetoothManager) Stop() error {
 func (bm *BluetoothManager) Discover(timeout time.Duration) ([]PeerInfo, error) {
 	// Check if Bluetooth is running
 	bm.mutex.RLock()
-	running := bm.isRunning
+	running, driver := bm.isRunning, bm.driver
 	bm.mutex.RUnlock()
 
 	if !running {
-		return nil, errors.New("Bluetooth service is not running")
+		return nil, fmt.Errorf("Bluetooth %w", ErrNotRunning)
 	}
 
-	// In a real implementation, this would:
-	// 1. Start a Bluetooth scan
-	// 2. Collect results for the duration of the timeout
-	// 3. Filter results to find devices advertising the BitShare service
-
-	// Placeholder implementation returning sample data
-	time.Sleep(timeout / 2) // Simulate scan time
-
-	peers := []PeerInfo{
-		{
-			ID:             "bt-abc123",
-			Name:           "Phone-BT",
-			Address:        "00:11:22:33:44:55",
+	devices, err := driver.scan(bm.serviceUUID, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	peers := make([]PeerInfo, 0, len(devices))
+	for _, device := range devices {
+		name := device.Name
+		if name == "" {
+			name = device.Address
+		}
+		peers = append(peers, PeerInfo{
+			ID:             fmt.Sprintf("bt-%s", device.Address),
+			Name:           name,
+			Address:        device.Address,
 			Protocol:       "bluetooth",
-			SignalStrength: 50, // Typically lower than WiFi
+			SignalStrength: signalPercent(device.RSSI),
 			LastSeen:       time.Now(),
-			Capabilities:   []string{"transfer"},
-		},
+		})
 	}
-
 	return peers, nil
 }
 
@@ -179,55 +221,7 @@ func (bm *BluetoothManager) SendData(peerID string, data []byte) error {
 }
 
 // Helper methods
-func (bm *BluetoothManager) initializeService() error {
-	// In a real implementation, this would initialize the Bluetooth stack
-	// and prepare for connections
-	fmt.Println("Initializing Bluetooth service")
-	return nil
-}
-
-func (bm *BluetoothManager) advertiseService() {
-	// In a real implementation, this would advertise the BitShare service
-	// using platform-specific Bluetooth APIs
-	fmt.Printf("Advertising Bluetooth service: %s\n", bm.serviceName)
-}
-
-func (bm *BluetoothManager) scanForDevices() {
-	// In a real implementation, this would periodically scan for other
-	// Bluetooth devices advertising the BitShare service
-	for bm.isRunning {
-		fmt.Println("Scanning for Bluetooth devices...")
-		time.Sleep(30 * time.Second)
-	}
-}
-
-func (bm *BluetoothManager) stopAdvertising() {
-	// In a real implementation, this would stop advertising the service
-	fmt.Println("Stopping Bluetooth advertising")
-}
-
-func (bm *BluetoothManager) stopScanning() {
-	// In a real implementation, this would stop scanning for devices
-	fmt.Println("Stopping Bluetooth scanning")
-}
-
 func (bm *BluetoothManager) disconnect(peer *BluetoothPeer) {
 	// In a real implementation, this would close the Bluetooth connection
 	fmt.Printf("Disconnecting from Bluetooth peer: %s\n", peer.MacAddress)
 }
-
-// Helper functions
-func isBluetoothSupported() (bool, error) {
-	// In a real implementation, this would check if Bluetooth is supported
-	// and available on the current device
-
-	// This is platform-dependent:
-	// - Windows: Use Windows.Devices.Bluetooth or Win32 Bluetooth APIs
-	// - Linux: Check for BlueZ availability
-	// - macOS: Use IOBluetooth framework
-	// - Android: Use BluetoothAdapter
-	// - iOS: Use CoreBluetooth framework
-
-	// For this placeholder, assume Bluetooth is available
-	return true, nil
-}
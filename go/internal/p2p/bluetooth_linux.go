@@ -0,0 +1,385 @@
+package p2p
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Bluetooth on Linux
+//
+// BlueZ runs Bluetooth on Linux, and the driver talks to it through
+// bluetoothctl, its command line client, feeding it commands and reading
+// what it prints. The advertisement is registered by a bluetoothctl that
+// keeps running, as BlueZ drops it when the client goes; BlueZ puts the
+// local name of an advertisement in its scan response. A scan is another
+// one, which sets a discovery filter for the service UUID and runs until the
+// timeout. BlueZ reports the devices of every client's discovery to all of
+// them, so each device heard is looked up with info and kept if it
+// advertises the UUID.
+//
+// Bluetooth is supported when the kernel has an adapter, under
+// /sys/class/bluetooth, and bluetoothctl is installed.
+
+const (
+	// bluetoothAdapters lists the adapters the kernel has
+	bluetoothAdapters = "/sys/class/bluetooth"
+
+	// advertiseTimeout bounds how long registering the advertisement may take
+	advertiseTimeout = 10 * time.Second
+)
+
+func isBluetoothSupported() (bool, error) {
+	entries, err := os.ReadDir(bluetoothAdapters)
+	if err != nil {
+		// No Bluetooth in the kernel
+		return false, nil
+	}
+	found := false
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), "hci") {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return false, nil
+	}
+	if _, err := exec.LookPath("bluetoothctl"); err != nil {
+		return false, errors.New("bluetoothctl not found, BlueZ must be installed")
+	}
+	return true, nil
+}
+
+func newBluetoothDriver() (bluetoothDriver, error) {
+	return &bluezDriver{}, nil
+}
+
+// bluezDriver drives Bluetooth LE through bluetoothctl, see above
+type bluezDriver struct {
+	mutex      sync.Mutex
+	advertiser *bluetoothctl // Holding the advertisement
+}
+
+func (d *bluezDriver) advertise(serviceUUID, name string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.advertiser != nil {
+		return errors.New("already advertising")
+	}
+
+	ctl, err := startBluetoothctl(context.Background(),
+		"power on",
+		"menu advertise",
+		"uuids "+serviceUUID,
+		"name "+bluetoothctlQuote(name),
+		"discoverable on",
+		"back",
+		"advertise on")
+	if err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(advertiseTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case line, ok := <-ctl.lines:
+			switch {
+			case !ok:
+				ctl.stop()
+				return errors.New("bluetoothctl ended")
+			case bluetoothctlFailed(line):
+				ctl.stop()
+				return errors.New(line)
+			case strings.Contains(line, "Advertising object registered"):
+				d.advertiser = ctl
+				// Nothing more to read, but it must not block printing
+				go func() {
+					for range ctl.lines {
+					}
+				}()
+				return nil
+			}
+		case <-timer.C:
+			ctl.stop()
+			return errors.New("BlueZ didn't register the advertisement in time")
+		}
+	}
+}
+
+func (d *bluezDriver) scan(serviceUUID string, timeout time.Duration) ([]bluetoothDevice, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	ctl, err := startBluetoothctl(ctx,
+		"menu scan",
+		"uuids "+serviceUUID,
+		"transport le",
+		"back",
+		"scan on")
+	if err != nil {
+		return nil, err
+	}
+	defer ctl.stop()
+
+	found := newBluezScan(serviceUUID)
+	for line := range ctl.lines {
+		lookup, err := found.read(line)
+		if err != nil {
+			return nil, fmt.Errorf("Bluetooth scan failed: %w", err)
+		}
+		if lookup != "" {
+			ctl.send("info " + lookup)
+		}
+	}
+	// Ended by the timeout
+	return found.devices(), nil
+}
+
+func (d *bluezDriver) close() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.advertiser != nil {
+		// BlueZ unregisters the advertisement of a client that goes
+		d.advertiser.stop()
+		d.advertiser = nil
+	}
+	return nil
+}
+
+// bluezScan reads the devices a scan finds off what bluetoothctl prints
+type bluezScan struct {
+	serviceUUID string
+	started     bool              // Since "Discovery started"
+	names       map[string]string // Device names by address
+	heard       map[string]int    // Strongest RSSI by address
+	matched     map[string]bool   // Advertising the UUID, by info
+	order       []string          // Addresses as first heard
+	info        string            // Address of the info block being printed
+	lookedUp    map[string]bool   // Addresses info was asked for
+}
+
+func newBluezScan(serviceUUID string) *bluezScan {
+	return &bluezScan{
+		serviceUUID: strings.ToLower(serviceUUID),
+		names:       make(map[string]string),
+		heard:       make(map[string]int),
+		matched:     make(map[string]bool),
+		lookedUp:    make(map[string]bool),
+	}
+}
+
+var (
+	// bluezDeviceLine is a line about a device, [NEW], [CHG] or [DEL]
+	bluezDeviceLine = regexp.MustCompile(`^\[(NEW|CHG|DEL)\] Device ([0-9A-Fa-f:]{17})\s*(.*)$`)
+
+	// bluezInfoHeader starts the block info prints about a device
+	bluezInfoHeader = regexp.MustCompile(`^Device ([0-9A-Fa-f:]{17})`)
+)
+
+// read takes in a line bluetoothctl printed, returning the address of a
+// device to look up with info when it is first heard
+func (s *bluezScan) read(line string) (string, error) {
+	if bluetoothctlFailed(line) {
+		return "", errors.New(line)
+	}
+	if line == "Discovery started" {
+		s.started = true
+		return "", nil
+	}
+
+	if match := bluezDeviceLine.FindStringSubmatch(line); match != nil {
+		s.info = ""
+		kind, address, rest := match[1], strings.ToUpper(match[2]), match[3]
+		switch {
+		case kind == "NEW":
+			// Devices BlueZ knows are listed on starting too
+			if rest != strings.ReplaceAll(address, ":", "-") {
+				s.names[address] = rest
+			}
+		case strings.HasPrefix(rest, "Name: "):
+			s.names[address] = strings.TrimPrefix(rest, "Name: ")
+		case strings.HasPrefix(rest, "RSSI: "):
+			if rssi, ok := parseBluezRSSI(strings.TrimPrefix(rest, "RSSI: ")); ok && s.started {
+				s.hear(address, rssi)
+			}
+		}
+		if kind == "DEL" || !s.started || s.lookedUp[address] {
+			return "", nil
+		}
+		s.lookedUp[address] = true
+		return address, nil
+	}
+
+	if match := bluezInfoHeader.FindStringSubmatch(line); match != nil {
+		s.info = strings.ToUpper(match[1])
+		return "", nil
+	}
+	if s.info == "" || !strings.HasPrefix(line, "\t") {
+		return "", nil
+	}
+	field, value, _ := strings.Cut(strings.TrimSpace(line), ": ")
+	value = strings.TrimSpace(value)
+	switch field {
+	case "Name":
+		s.names[s.info] = value
+	case "RSSI":
+		if rssi, ok := parseBluezRSSI(value); ok {
+			s.hear(s.info, rssi)
+		}
+	case "UUID":
+		if strings.Contains(strings.ToLower(value), s.serviceUUID) {
+			s.matched[s.info] = true
+		}
+	}
+	return "", nil
+}
+
+// hear notes a device heard at rssi
+func (s *bluezScan) hear(address string, rssi int) {
+	previous, ok := s.heard[address]
+	if !ok {
+		s.order = append(s.order, address)
+	}
+	if !ok || rssi > previous {
+		s.heard[address] = rssi
+	}
+}
+
+// devices returns the devices heard that advertise the service UUID
+func (s *bluezScan) devices() []bluetoothDevice {
+	var devices []bluetoothDevice
+	for _, address := range s.order {
+		if s.matched[address] {
+			devices = append(devices, bluetoothDevice{
+				Address: address,
+				Name:    s.names[address],
+				RSSI:    s.heard[address],
+			})
+		}
+	}
+	return devices
+}
+
+// parseBluezRSSI parses an RSSI as bluetoothctl prints it, -67 or, in later
+// versions, 0xffffffbd (-67)
+func parseBluezRSSI(value string) (int, bool) {
+	if open := strings.Index(value, "("); open >= 0 {
+		value = strings.TrimSuffix(value[open+1:], ")")
+	}
+	if hex, ok := strings.CutPrefix(value, "0x"); ok {
+		raw, err := strconv.ParseUint(hex, 16, 32)
+		return int(int32(raw)), err == nil
+	}
+	rssi, err := strconv.Atoi(value)
+	return rssi, err == nil
+}
+
+// bluetoothctl is a running bluetoothctl
+type bluetoothctl struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	lines chan string // What it prints, without colors and prompts, until it ends
+}
+
+// startBluetoothctl runs bluetoothctl, until ctx is done, and sends it
+// commands
+func startBluetoothctl(ctx context.Context, commands ...string) (*bluetoothctl, error) {
+	cmd := exec.CommandContext(ctx, "bluetoothctl")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("could not run bluetoothctl: %w", err)
+	}
+
+	ctl := &bluetoothctl{cmd: cmd, stdin: stdin, lines: make(chan string)}
+	go ctl.read(stdout)
+	if err := ctl.send(commands...); err != nil {
+		ctl.stop()
+		return nil, err
+	}
+	return ctl, nil
+}
+
+// send sends commands, one per line
+func (ctl *bluetoothctl) send(commands ...string) error {
+	for _, command := range commands {
+		if _, err := io.WriteString(ctl.stdin, command+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stop ends bluetoothctl
+func (ctl *bluetoothctl) stop() {
+	ctl.cmd.Process.Kill()
+	for range ctl.lines {
+	}
+	ctl.cmd.Wait()
+}
+
+var (
+	// bluetoothctlColor is a terminal escape bluetoothctl colors with
+	bluetoothctlColor = regexp.MustCompile("\x1b\\[[0-9;]*[A-Za-z]")
+
+	// bluetoothctlPrompt is the prompt it prints ahead of lines
+	bluetoothctlPrompt = regexp.MustCompile(`^(\[[^\]]*\][#>] ?)+`)
+)
+
+// read hands on the lines bluetoothctl prints until it ends
+func (ctl *bluetoothctl) read(stdout io.Reader) {
+	defer close(ctl.lines)
+	lines := bufio.NewScanner(stdout)
+	// It redraws the prompt after carriage returns
+	lines.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+			return i + 1, data[:i], nil
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	})
+	for lines.Scan() {
+		line := bluetoothctlColor.ReplaceAllString(lines.Text(), "")
+		line = strings.TrimRightFunc(bluetoothctlPrompt.ReplaceAllString(line, ""), unicode.IsSpace)
+		if line != "" {
+			ctl.lines <- line
+		}
+	}
+}
+
+// bluetoothctlFailed reports whether line says a command failed
+func bluetoothctlFailed(line string) bool {
+	return strings.HasPrefix(line, "Failed to") || line == "No default controller available"
+}
+
+// bluetoothctlQuote quotes name as one argument to a command, leaving out
+// what bluetoothctl would expand
+func bluetoothctlQuote(name string) string {
+	safe := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune(" -_.", r) {
+			return r
+		}
+		return -1
+	}, name)
+	return `"` + safe + `"`
+}
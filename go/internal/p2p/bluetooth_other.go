@@ -0,0 +1,13 @@
+//go:build !linux && !windows
+
+package p2p
+
+import "errors"
+
+func isBluetoothSupported() (bool, error) {
+	return false, nil
+}
+
+func newBluetoothDriver() (bluetoothDriver, error) {
+	return nil, errors.New("Bluetooth is not supported on this OS")
+}
@@ -0,0 +1,223 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bluetooth on Windows
+//
+// Windows runs Bluetooth LE through the WinRT API in Windows.Devices.Bluetooth.
+// The driver calls it from PowerShell, see winrt_windows.go.
+//
+// A script that keeps running advertises the service UUID through a
+// GattServiceProvider, which is how Windows lets apps advertise a service.
+// Apps can't set the name advertised: Windows puts the computer's Bluetooth
+// name in the scan response. A scan runs a BluetoothLEAdvertisementWatcher,
+// scanning actively for the scan responses, and reports each advertisement
+// of a device that carried the UUID until the timeout kills it.
+//
+// Bluetooth is supported when there is a default adapter with Bluetooth LE,
+// and its radio is on.
+
+// advertiseTimeout bounds how long starting the advertisement may take
+const advertiseTimeout = 20 * time.Second
+
+// bluetoothPrelude is winrtPrelude with the WinRT types the scripts use
+const bluetoothPrelude = winrtPrelude + `
+$null = [Windows.Devices.Bluetooth.BluetoothAdapter, Windows.Devices.Bluetooth, ContentType = WindowsRuntime]
+$null = [Windows.Devices.Radios.Radio, Windows.Devices.Radios, ContentType = WindowsRuntime]
+$null = [Windows.Devices.Bluetooth.GenericAttributeProfile.GattServiceProvider, Windows.Devices.Bluetooth, ContentType = WindowsRuntime]
+$null = [Windows.Devices.Bluetooth.GenericAttributeProfile.GattServiceProviderAdvertisingParameters, Windows.Devices.Bluetooth, ContentType = WindowsRuntime]
+$null = [Windows.Devices.Bluetooth.Advertisement.BluetoothLEAdvertisementWatcher, Windows.Devices.Bluetooth, ContentType = WindowsRuntime]
+`
+
+// bluetoothSupportScript prints yes when Bluetooth LE can be used, off when
+// the radio is off, or no
+const bluetoothSupportScript = `
+$adapter = Await ([Windows.Devices.Bluetooth.BluetoothAdapter]::GetDefaultAsync()) ([Windows.Devices.Bluetooth.BluetoothAdapter])
+if (-not $adapter -or -not $adapter.IsLowEnergySupported) { 'no'; exit }
+$radio = Await ($adapter.GetRadioAsync()) ([Windows.Devices.Radios.Radio])
+if ($radio.State -ne [Windows.Devices.Radios.RadioState]::On) { 'off'; exit }
+'yes'
+`
+
+// bluetoothPublishScript advertises $uuid, see above
+const bluetoothPublishScript = `
+$adapter = Await ([Windows.Devices.Bluetooth.BluetoothAdapter]::GetDefaultAsync()) ([Windows.Devices.Bluetooth.BluetoothAdapter])
+if (-not $adapter.IsPeripheralRoleSupported) {
+	Emit @{ event = 'error'; error = 'the Bluetooth adapter cannot advertise' }
+	exit 1
+}
+$result = Await ([Windows.Devices.Bluetooth.GenericAttributeProfile.GattServiceProvider]::CreateAsync([Guid]$uuid)) ([Windows.Devices.Bluetooth.GenericAttributeProfile.GattServiceProviderResult])
+if ($result.Error -ne [Windows.Devices.Bluetooth.BluetoothError]::Success) {
+	Emit @{ event = 'error'; error = "could not provide the service: $($result.Error)" }
+	exit 1
+}
+$provider = $result.ServiceProvider
+$parameters = [Windows.Devices.Bluetooth.GenericAttributeProfile.GattServiceProviderAdvertisingParameters]::new()
+$parameters.IsDiscoverable = $true
+$parameters.IsConnectable = $true
+$provider.StartAdvertising($parameters)
+for ($i = 0; $i -lt 100 -and "$($provider.AdvertisementStatus)" -notlike 'Started*' -and "$($provider.AdvertisementStatus)" -ne 'Aborted'; $i++) {
+	Start-Sleep -Milliseconds 100
+}
+if ("$($provider.AdvertisementStatus)" -notlike 'Started*') {
+	Emit @{ event = 'error'; error = "advertisement is $($provider.AdvertisementStatus)" }
+	exit 1
+}
+Emit @{ event = 'started' }
+while ($true) {
+	Start-Sleep -Seconds 60
+}
+`
+
+// bluetoothWatchScript reports the advertisements of the devices that
+// carried $uuid, with their names from any of them, until it is killed
+const bluetoothWatchScript = `
+$service = [Guid]$uuid
+$watcher = [Windows.Devices.Bluetooth.Advertisement.BluetoothLEAdvertisementWatcher]::new()
+$watcher.ScanningMode = [Windows.Devices.Bluetooth.Advertisement.BluetoothLEScanningMode]::Active
+$null = Register-ObjectEvent -InputObject $watcher -EventName Received -SourceIdentifier Received
+$null = Register-ObjectEvent -InputObject $watcher -EventName Stopped -SourceIdentifier Stopped
+$watcher.Start()
+
+$matched = @{}
+$names = @{}
+while ($true) {
+	$raised = Wait-Event
+	Remove-Event -EventIdentifier $raised.EventIdentifier
+	if ($raised.SourceIdentifier -eq 'Stopped') {
+		Emit @{ event = 'error'; error = "scan stopped: $($raised.SourceEventArgs.Error)" }
+		exit 1
+	}
+
+	$received = $raised.SourceEventArgs
+	$address = $received.BluetoothAddress.ToString('X12') -replace '(..)(?!$)', '$1:'
+	if ($received.Advertisement.ServiceUuids -contains $service) {
+		$matched[$address] = $true
+	}
+	if ($received.Advertisement.LocalName) {
+		$names[$address] = $received.Advertisement.LocalName
+	}
+	if ($matched[$address]) {
+		Emit @{ event = 'found'; address = $address; name = $names[$address]; signal = [int]$received.RawSignalStrengthInDBm }
+	}
+}
+`
+
+func isBluetoothSupported() (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), scriptStartSlack)
+	defer cancel()
+	out, err := powershell(ctx, bluetoothPrelude+bluetoothSupportScript).Output()
+	if err != nil {
+		// No PowerShell or no WinRT
+		return false, nil
+	}
+	switch strings.TrimSpace(string(out)) {
+	case "yes":
+		return true, nil
+	case "off":
+		return false, errors.New("Bluetooth is turned off")
+	}
+	return false, nil
+}
+
+func newBluetoothDriver() (bluetoothDriver, error) {
+	return &winrtBluetoothDriver{}, nil
+}
+
+// winrtBluetoothDriver drives Bluetooth LE through WinRT, see above
+type winrtBluetoothDriver struct {
+	mutex     sync.Mutex
+	publisher *exec.Cmd // The script advertising the service
+}
+
+func (d *winrtBluetoothDriver) advertise(serviceUUID, name string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.publisher != nil {
+		return errors.New("already advertising")
+	}
+
+	// Windows names the advertisement itself, see above
+	script := fmt.Sprintf("$uuid = %s\n", psQuote(serviceUUID)) + bluetoothPrelude + bluetoothPublishScript
+	cmd, events, err := startScript(script, "started", advertiseTimeout)
+	if err != nil {
+		return fmt.Errorf("advertisement didn't start: %w", err)
+	}
+	d.publisher = cmd
+	go func() {
+		for event := range events {
+			if event.Event == "error" {
+				fmt.Printf("Bluetooth: %s\n", event.Error)
+			}
+		}
+		cmd.Wait()
+		d.mutex.Lock()
+		if d.publisher == cmd {
+			d.publisher = nil
+			fmt.Println("Bluetooth advertisement stopped")
+		}
+		d.mutex.Unlock()
+	}()
+	return nil
+}
+
+func (d *winrtBluetoothDriver) scan(serviceUUID string, timeout time.Duration) ([]bluetoothDevice, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	script := fmt.Sprintf("$uuid = %s\n", psQuote(serviceUUID)) + bluetoothPrelude + bluetoothWatchScript
+	cmd := powershell(ctx, script)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("could not run PowerShell: %w", err)
+	}
+
+	events := make(chan winrtEvent)
+	go readEvents(stdout, events)
+	var devices []bluetoothDevice
+	index := make(map[string]int) // Into devices, by address
+	var failure error
+	for event := range events {
+		switch {
+		case event.Event == "error":
+			failure = errors.New(event.Error)
+		case event.Event == "found" && event.Signal != nil:
+			i, ok := index[event.Address]
+			if !ok {
+				i = len(devices)
+				index[event.Address] = i
+				devices = append(devices, bluetoothDevice{Address: event.Address, RSSI: *event.Signal})
+			}
+			if event.Name != "" {
+				devices[i].Name = event.Name
+			}
+			devices[i].RSSI = max(devices[i].RSSI, *event.Signal)
+		}
+	}
+	// Ended by the timeout, unless the scan failed
+	cmd.Wait()
+	if failure != nil && len(devices) == 0 {
+		return nil, fmt.Errorf("Bluetooth scan failed: %w", failure)
+	}
+	return devices, nil
+}
+
+func (d *winrtBluetoothDriver) close() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.publisher != nil {
+		d.publisher.Process.Kill()
+		d.publisher = nil
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package p2p
+
+import (
+	"encoding/json"
+	"net"
+	"time"
+)
+
+// Broadcast messages
+//
+// A broadcast is a message for every node, sent over the TCP service of
+// each peer a node reaches directly and passed on by them while its TTL
+// lasts. Nodes tell broadcasts apart by ID; what is delivered and passed on
+// is up to the handler, see mesh/broadcast.go.
+
+// BroadcastMessage is one broadcast as it travels
+type BroadcastMessage struct {
+	Type       string `json:"type"` // "BROADCAST"
+	ID         string `json:"id"`
+	Origin     string `json:"origin"` // Node ID of the sender, as it claims
+	OriginName string `json:"origin_name,omitempty"`
+	Kind       string `json:"kind"` // What the payload is, for handlers to pick theirs
+	Payload    []byte `json:"payload,omitempty"`
+	TTL        int    `json:"ttl"`  // How many more times it may be passed on
+	Hops       int    `json:"hops"` // How many times it was passed on
+}
+
+// OnBroadcast sets what is given the broadcasts peers send, with the
+// address of the peer that sent it
+func (tm *TCPManager) OnBroadcast(handler func(msg BroadcastMessage, address string)) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	tm.onBroadcast = handler
+}
+
+// SendBroadcast sends msg to the node at the other end of conn, a
+// connection to its TCP service, giving up after timeout
+func SendBroadcast(conn net.Conn, msg BroadcastMessage, timeout time.Duration) error {
+	msg.Type = "BROADCAST"
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	conn.SetWriteDeadline(time.Now().Add(timeout))
+	defer conn.SetWriteDeadline(time.Time{})
+	_, err = conn.Write(packMessage(data))
+	return err
+}
+
+// broadcastReceived passes a broadcast from peer on to the OnBroadcast handler
+func (tm *TCPManager) broadcastReceived(peer *TCPPeer, message []byte) error {
+	var msg BroadcastMessage
+	if err := json.Unmarshal(message, &msg); err != nil {
+		return err
+	}
+	tm.mutex.RLock()
+	handler := tm.onBroadcast
+	tm.mutex.RUnlock()
+	if handler != nil && msg.ID != "" && msg.Origin != "" {
+		host, _, err := net.SplitHostPort(peer.Address)
+		if err != nil {
+			host = peer.Address
+		}
+		handler(msg, host)
+	}
+	return nil
+}
@@ -1,7 +1,12 @@
 package p2p
 
 import (
+	"context"
+	"crypto/ed25519"
+	"errors"
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -11,11 +16,29 @@ type PeerInfo struct {
 	Name           string
 	Address        string
 	Protocol       string // "wifi-direct", "bluetooth", "tcp"
+	Port           int    // TCP service port the peer advertised, 0 if unknown
 	SignalStrength int    // 0-100%
 	LastSeen       time.Time
 	Capabilities   []string
+	Version        string // BitShare release the peer advertised, empty if unknown
+
+	// PublicKey is set when the peer proved its ID is derived from it,
+	// see identity.go
+	PublicKey ed25519.PublicKey
+
+	// Transports are the ways a scan found the peer, best first, see
+	// transports.go
+	Transports []Transport
 }
 
+// ErrNotRunning is wrapped by the errors of protocol managers asked to
+// discover before they were started
+var ErrNotRunning = errors.New("service is not running")
+
+// protocolScanTimeout is how long each protocol looks for peers in a scan,
+// unless the scan's timeout is shorter
+const protocolScanTimeout = 3 * time.Second
+
 // ScanOptions configures the peer scan behavior
 type ScanOptions struct {
 	Timeout      time.Duration
@@ -45,70 +68,101 @@ func ScanForPeers() ([]PeerInfo, error) {
 
 // ScanForPeersWithOptions searches for peers with custom options
 func ScanForPeersWithOptions(options ScanOptions) ([]PeerInfo, error) {
-	results := make([]PeerInfo, 0)
-	errorsCh := make(chan error, 3)
-	resultsCh := make(chan []PeerInfo, 3)
+	return ScanForPeersContext(context.Background(), options)
+}
 
-	// Create a timeout context
-	doneCh := make(chan struct{})
-	defer close(doneCh)
+// scanResult is what the scan of one protocol found
+type scanResult struct {
+	protocol string
+	peers    []PeerInfo
+	err      error
+}
+
+// scanGrace is how long a scan waits past its deadline for protocols to
+// hand in what they found
+const scanGrace = 200 * time.Millisecond
+
+// ScanForPeersContext searches for peers with custom options until
+// options.Timeout passes or ctx is done, each protocol for at most
+// protocolScanTimeout. What was found by then is returned; when the caller
+// cancels, with ctx's error.
+func ScanForPeersContext(ctx context.Context, options ScanOptions) ([]PeerInfo, error) {
+	scanCtx := ctx
+	if options.Timeout > 0 {
+		var cancel context.CancelFunc
+		scanCtx, cancel = context.WithTimeout(ctx, options.Timeout)
+		defer cancel()
+	}
+	protocolCtx, cancel := context.WithTimeout(scanCtx, protocolScanTimeout)
+	defer cancel()
 
 	// Launch scans for each protocol in parallel
+	resultsCh := make(chan scanResult, 3)
 	activeScanners := 0
-
-	if options.WifiDirect {
+	launch := func(protocol string, scan func(context.Context) ([]PeerInfo, error)) {
 		activeScanners++
 		go func() {
-			peers, err := scanWifiDirect(doneCh)
-			if err != nil {
-				errorsCh <- fmt.Errorf("WiFi Direct scan error: %w", err)
-			} else {
-				resultsCh <- peers
-			}
+			peers, err := scan(protocolCtx)
+			resultsCh <- scanResult{protocol, peers, err}
 		}()
 	}
 
+	if options.WifiDirect {
+		launch("WiFi Direct", scanWifiDirect)
+	}
 	if options.Bluetooth {
-		activeScanners++
-		go func() {
-			peers, err := scanBluetooth(doneCh)
-			if err != nil {
-				errorsCh <- fmt.Errorf("Bluetooth scan error: %w", err)
-			} else {
-				resultsCh <- peers
-			}
-		}()
+		launch("Bluetooth", scanBluetooth)
 	}
-
 	if options.TCP {
-		activeScanners++
-		go func() {
-			peers, err := scanTCP(doneCh)
-			if err != nil {
-				errorsCh <- fmt.Errorf("TCP scan error: %w", err)
-			} else {
-				resultsCh <- peers
-			}
-		}()
+		launch("TCP", scanTCP)
 	}
+	scanners := activeScanners
 
-	// Wait for results with timeout
-	timer := time.NewTimer(options.Timeout)
-	defer timer.Stop()
-
-	var errors []error
-	for activeScanners > 0 {
+	// The scanners stop when protocolCtx is done; the grace is for one that
+	// is slow to
+	results := make([]PeerInfo, 0)
+	var failures []error
+	completed := 0
+	done := protocolCtx.Done()
+	var grace <-chan time.Time
+	for activeScanners > 0 && (done != nil || grace != nil) {
 		select {
-		case err := <-errorsCh:
-			errors = append(errors, err)
+		case result := <-resultsCh:
 			activeScanners--
-		case peers := <-resultsCh:
-			results = append(results, peers...)
-			activeScanners--
-		case <-timer.C:
-			return results, fmt.Errorf("scan timeout, partial results returned (errors: %v)", errors)
+			switch {
+			case errors.Is(result.err, ErrNotRunning):
+				// Not in use on this node, which isn't an error
+				completed++
+			case errors.Is(result.err, context.DeadlineExceeded), errors.Is(result.err, context.Canceled):
+				// Stopped before it was done
+			case result.err != nil:
+				failures = append(failures, fmt.Errorf("%s scan error: %w", result.protocol, result.err))
+			default:
+				completed++
+				results = append(results, result.peers...)
+			}
+		case <-done:
+			done = nil
+			timer := time.NewTimer(scanGrace)
+			defer timer.Stop()
+			grace = timer.C
+		case <-grace:
+			grace = nil
 		}
 	}
+	results = mergePeerInfos(results)
+
+	if err := ctx.Err(); err != nil {
+		sortPeerInfos(results)
+		return results, err
+	}
+	if scanners > 0 && len(failures) == scanners {
+		// Every protocol failed
+		return nil, errors.Join(failures...)
+	}
+	if scanners > 0 && completed == 0 && len(results) == 0 {
+		return nil, fmt.Errorf("scan timed out before any protocol finished (errors: %v)", failures)
+	}
 
 	// Include cached peers if requested
 	if options.IncludeCache {
@@ -129,56 +183,51 @@ func ScanForPeersWithOptions(options ScanOptions) ([]PeerInfo, error) {
 		}
 	}
 
+	sortPeerInfos(results)
 	return results, nil
 }
 
-// Protocol-specific scan implementations
-func scanWifiDirect(done <-chan struct{}) ([]PeerInfo, error) {
-	// Implementation for WiFi Direct discovery
-	// This is a placeholder for the actual implementation
-	return []PeerInfo{
-		{
-			ID:             "wfd-1234",
-			Name:           "Laptop-WFD",
-			Address:        "192.168.49.1",
-			Protocol:       "wifi-direct",
-			SignalStrength: 80,
-			LastSeen:       time.Now(),
-			Capabilities:   []string{"transfer", "mesh"},
-		},
-	}, nil
+// sortPeerInfos orders scan results by name, then ID, so consecutive scans print the same rows
+func sortPeerInfos(peers []PeerInfo) {
+	sort.SliceStable(peers, func(i, j int) bool {
+		nameI, nameJ := strings.ToLower(peers[i].Name), strings.ToLower(peers[j].Name)
+		if nameI != nameJ {
+			return nameI < nameJ
+		}
+		return peers[i].ID < peers[j].ID
+	})
 }
 
-func scanBluetooth(done <-chan struct{}) ([]PeerInfo, error) {
-	// Implementation for Bluetooth discovery
-	// This is a placeholder for the actual implementation
-	return []PeerInfo{
-		{
-			ID:             "bt-5678",
-			Name:           "Phone-BT",
-			Address:        "00:11:22:33:44:55",
-			Protocol:       "bluetooth",
-			SignalStrength: 60,
-			LastSeen:       time.Now(),
-			Capabilities:   []string{"transfer"},
-		},
-	}, nil
+// Protocol-specific scans, each asking the protocol's manager. A manager
+// that isn't running fails with ErrNotRunning, which the scan takes as
+// nothing found.
+func scanWifiDirect(ctx context.Context) ([]PeerInfo, error) {
+	return discoverUntil(ctx, GetWiFiDirectManager().Discover)
 }
 
-func scanTCP(done <-chan struct{}) ([]PeerInfo, error) {
-	// Implementation for TCP/IP discovery
-	// This is a placeholder for the actual implementation
-	return []PeerInfo{
-		{
-			ID:             "tcp-9012",
-			Name:           "Desktop-TCP",
-			Address:        "192.168.1.100",
-			Protocol:       "tcp",
-			SignalStrength: 100,
-			LastSeen:       time.Now(),
-			Capabilities:   []string{"transfer", "mesh", "relay"},
-		},
-	}, nil
+func scanBluetooth(ctx context.Context) ([]PeerInfo, error) {
+	return discoverUntil(ctx, GetBluetoothManager().Discover)
+}
+
+func scanTCP(ctx context.Context) ([]PeerInfo, error) {
+	return GetTCPManager().DiscoverContext(ctx)
+}
+
+// discoverUntil runs discover, which takes a timeout, for the time ctx has
+// left, giving up on it when ctx is done first
+func discoverUntil(ctx context.Context, discover func(timeout time.Duration) ([]PeerInfo, error)) ([]PeerInfo, error) {
+	deadline, _ := ctx.Deadline()
+	found := make(chan scanResult, 1)
+	go func() {
+		peers, err := discover(time.Until(deadline))
+		found <- scanResult{peers: peers, err: err}
+	}()
+	select {
+	case result := <-found:
+		return result.peers, result.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 }
 
 func getCachedPeers() []PeerInfo {
@@ -0,0 +1,65 @@
+package p2p
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// useTCPManager makes tm the manager GetTCPManager returns for the rest of the test
+func useTCPManager(t *testing.T, tm *TCPManager) {
+	t.Helper()
+	tcpOnce.Do(func() {})
+	saved := tcpManager
+	tcpManager = tm
+	t.Cleanup(func() { tcpManager = saved })
+}
+
+// TestScanTCPOnly scans with Bluetooth and WiFi Direct not running, as on
+// any machine without them, and checks the TCP results come through
+func TestScanTCPOnly(t *testing.T) {
+	scanner, found := startTestNode(t, "scanner"), startTestNode(t, "found")
+	useTCPManager(t, scanner.TCPManager)
+
+	// Machines without a broadcast network ask the other node's discovery
+	// service directly
+	scanner.mutex.Lock()
+	scanner.discoveryAddr = net.JoinHostPort("127.0.0.1", strconv.Itoa(found.listenPort+1))
+	scanner.mutex.Unlock()
+
+	tests := []struct {
+		name    string
+		options ScanOptions
+		stop    bool // Stop the other node first
+		found   bool
+	}{
+		{"TCP only", ScanOptions{TCP: true}, false, true},
+		{"every protocol, only TCP running", ScanOptions{TCP: true, Bluetooth: true, WifiDirect: true}, false, true},
+		{"no protocol running", ScanOptions{Bluetooth: true, WifiDirect: true}, false, false},
+		{"TCP finds nobody", ScanOptions{TCP: true, Bluetooth: true, WifiDirect: true}, true, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.stop {
+				found.Stop()
+			}
+
+			test.options.Timeout = 500 * time.Millisecond
+			peers, err := ScanForPeersContext(context.Background(), test.options)
+			if err != nil {
+				t.Fatalf("scan failed: %v", err)
+			}
+			if !test.found {
+				if len(peers) != 0 {
+					t.Fatalf("found %+v, want nobody", peers)
+				}
+				return
+			}
+			if len(peers) != 1 || peers[0].ID != found.id || peers[0].Protocol != "tcp" {
+				t.Fatalf("found %+v, want only %s over TCP", peers, found.id)
+			}
+		})
+	}
+}
@@ -0,0 +1,219 @@
+package p2p
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"fileshare/internal/version"
+)
+
+// Handshake
+//
+// When the TCP service connects to another node (see Connect), both ends
+// say who they are before anything else. The connecting end sends a HELLO
+// with its protocol version, node ID, name and capabilities and a challenge,
+// which the other end answers with an IDENTITY proving its ID (see
+// identity.go) and its own HELLO, which the connecting end answers the same
+// way. Each end then files the connection under the node ID the other
+// proved, in place of the made-up one it started with, and tells the
+// OnHandshake handler about the node. A node that answers without a key
+// (see identity.go) keeps the made-up ID, as nothing backs the one it
+// claims, and is refused if it claims the ID of a node with a key.
+//
+// A HELLO from a protocol version this node doesn't speak, or one asking
+// for a newer version than it speaks, is answered with INCOMPATIBLE, which
+// says why, and the connection is closed. Releases before the handshake
+// send no version and are taken as version 1. They answer a HELLO but
+// don't send one, so connections they open keep a made-up ID. A HELLO
+// without a node ID, as Authenticate sends, gets only the IDENTITY.
+
+// Protocol versions of the TCP service. ProtocolVersion is the one this
+// node speaks and MinProtocolVersion the oldest it still takes; a change
+// to the messages that older nodes can't follow bumps ProtocolVersion, and
+// code for newer messages checks TCPPeer.Version before sending them.
+const (
+	ProtocolVersion    = 1
+	MinProtocolVersion = 1
+)
+
+// ErrIncompatibleVersion is wrapped by the errors of handshakes with nodes
+// whose protocol version this node doesn't speak
+var ErrIncompatibleVersion = errors.New("incompatible protocol version")
+
+// errHandshake ends the connection of a peer whose handshake failed
+var errHandshake = errors.New("handshake failed")
+
+// OnHandshake sets what is told about the nodes connections of the TCP
+// service proved to be, see above
+func (tm *TCPManager) OnHandshake(handler func(peer PeerInfo)) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	tm.onHandshake = handler
+}
+
+// checkProtocolVersion returns ErrIncompatibleVersion when a node speaking
+// protocol v, and taking min and newer, can't talk with this one
+func checkProtocolVersion(v, min int) error {
+	if v == 0 {
+		// Releases before the handshake
+		v = 1
+	}
+	if v < MinProtocolVersion {
+		return fmt.Errorf("%w: the peer speaks protocol version %d and this node needs at least %d, the peer has to update BitShare", ErrIncompatibleVersion, v, MinProtocolVersion)
+	}
+	if min > ProtocolVersion {
+		return fmt.Errorf("%w: the peer needs protocol version %d or newer and this node speaks %d, update BitShare to talk to it", ErrIncompatibleVersion, min, ProtocolVersion)
+	}
+	return nil
+}
+
+// sendHello starts the handshake on the connection of peer
+func (tm *TCPManager) sendHello(peer *TCPPeer) error {
+	nodeID, nodeName := tm.identity()
+	tm.mutex.RLock()
+	port := tm.listenPort
+	tm.mutex.RUnlock()
+
+	peer.challenge = newChallenge()
+	hello, err := json.Marshal(helloMessage{
+		Type:         "HELLO",
+		Challenge:    peer.challenge,
+		NodeID:       nodeID,
+		NodeName:     nodeName,
+		Network:      tm.currentNetwork().id,
+		Version:      ProtocolVersion,
+		MinVersion:   MinProtocolVersion,
+		Release:      version.Current,
+		Port:         port,
+		Capabilities: tm.currentCapabilities(),
+	})
+	if err != nil {
+		return err
+	}
+	return peer.send(hello)
+}
+
+// helloReceived answers a HELLO on the connection of peer, and introduces
+// this node in turn to a node opening a session
+func (tm *TCPManager) helloReceived(peer *TCPPeer, hello helloMessage) error {
+	if err := checkProtocolVersion(hello.Version, hello.MinVersion); err != nil {
+		tm.sendIncompatible(peer, err)
+		return fmt.Errorf("%w: %v", errHandshake, err)
+	}
+	if err := tm.sendIdentity(peer, hello); err != nil {
+		return err
+	}
+	if hello.NodeID != "" && peer.challenge == "" {
+		return tm.sendHello(peer)
+	}
+	return nil
+}
+
+// sendIncompatible tells the peer why its protocol version is refused
+func (tm *TCPManager) sendIncompatible(peer *TCPPeer, reason error) {
+	answer, err := json.Marshal(helloMessage{
+		Type:       "INCOMPATIBLE",
+		Version:    ProtocolVersion,
+		MinVersion: MinProtocolVersion,
+		Error:      reason.Error(),
+	})
+	if err != nil {
+		return
+	}
+	peer.send(answer)
+}
+
+// identified checks the IDENTITY answering this node's HELLO on the
+// connection of peer, and files the connection under the node's ID
+func (tm *TCPManager) identified(peer *TCPPeer, message []byte) error {
+	if peer.challenge == "" || peer.Version != 0 {
+		// Not asked for here, or already answered
+		return nil
+	}
+	var hello helloMessage
+	if err := json.Unmarshal(message, &hello); err != nil {
+		return err
+	}
+	if err := checkProtocolVersion(hello.Version, hello.MinVersion); err != nil {
+		return fmt.Errorf("%w: %v", errHandshake, err)
+	}
+	n := tm.currentNetwork()
+	if hello.NodeID == "" && hello.Network == n.id {
+		return fmt.Errorf("%w: the peer didn't say who it is", errHandshake)
+	}
+	if err := n.check(hello.Network, hello.NetworkProof, peer.challenge, hello.NodeID); err != nil {
+		if errors.Is(err, ErrNetworkAuth) {
+			n.warnNetworkAuth(peer.Address, hello.NodeName)
+		}
+		return fmt.Errorf("%w: %v", errHandshake, err)
+	}
+	var key ed25519.PublicKey
+	if hello.PublicKey != nil {
+		var err error
+		if key, err = verifyIdentity(hello.NodeID, hello.PublicKey, hello.Signature, peer.challenge); err != nil {
+			return fmt.Errorf("%w: %s claims to be %s: %v", errHandshake, peer.Address, hello.NodeID, err)
+		}
+		if certKey := certificateKey(peer.Conn); certKey != nil && !certKey.Equal(key) {
+			return fmt.Errorf("%w: %s proved its ID with another key than its certificate's", errHandshake, peer.Address)
+		}
+		tm.noteKey(hello.NodeID)
+	} else if hello.NodeID != "" && tm.keyKnown(hello.NodeID) {
+		return fmt.Errorf("%w: %s claims to be %s without proving it holds that node's key", errHandshake, peer.Address, hello.NodeID)
+	}
+	if peer.Security == SecurityTLS {
+		if key != nil {
+			tm.noteTLS(hello.NodeID)
+		}
+	} else if err := tm.checkPlaintext(hello.NodeID); err != nil {
+		return fmt.Errorf("%w: %s: %v", errHandshake, hello.NodeID, err)
+	}
+
+	tm.mutex.Lock()
+	peer.Version = min(max(hello.Version, 1), ProtocolVersion)
+	peer.Capabilities = hello.Capabilities
+	peer.Name = hello.NodeName
+	if key != nil {
+		if current := tm.connectedPeers[peer.ID]; current == peer {
+			delete(tm.connectedPeers, peer.ID)
+		}
+		peer.ID = hello.NodeID
+		tm.connectedPeers[peer.ID] = peer
+	}
+	handler := tm.onHandshake
+	tm.mutex.Unlock()
+
+	if handler != nil && key != nil {
+		host, _, err := net.SplitHostPort(peer.Address)
+		if err != nil {
+			host = peer.Address
+		}
+		handler(PeerInfo{
+			ID:             hello.NodeID,
+			Name:           hello.NodeName,
+			Address:        host,
+			Protocol:       "tcp",
+			Port:           hello.Port,
+			SignalStrength: 100,
+			LastSeen:       time.Now(),
+			Capabilities:   hello.Capabilities,
+			Version:        hello.Release,
+			PublicKey:      key,
+		})
+	}
+	return nil
+}
+
+// incompatible reports the INCOMPATIBLE answer to this node's HELLO
+func incompatible(message []byte) error {
+	var answer helloMessage
+	json.Unmarshal(message, &answer)
+	if answer.Version == 0 {
+		return fmt.Errorf("%w: %w: %s", errHandshake, ErrIncompatibleVersion, answer.Error)
+	}
+	return fmt.Errorf("%w: %w: the peer speaks protocol versions %d to %d and this node %d to %d, the older one has to update BitShare",
+		errHandshake, ErrIncompatibleVersion, answer.MinVersion, answer.Version, MinProtocolVersion, ProtocolVersion)
+}
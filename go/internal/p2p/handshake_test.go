@@ -0,0 +1,108 @@
+package p2p
+
+import (
+	"strings"
+	"testing"
+)
+
+// startUnprovenNode starts a node that claims nodeID, which its key doesn't
+// back, so it answers HELLO without a key like a release before keys
+func startUnprovenNode(t *testing.T, nodeID, name string) *testNode {
+	t.Helper()
+	node := startTestNode(t, name)
+	node.SetIdentity(nodeID, name)
+	node.id = nodeID
+	return node
+}
+
+// handshaken returns the peer named name whose handshake a finished
+func (n *testNode) handshaken(name string) *TCPPeer {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	for _, peer := range n.connectedPeers {
+		if peer.Name == name && peer.Version != 0 {
+			return peer
+		}
+	}
+	return nil
+}
+
+// TestUnprovenPeerIsProvisional checks a node that doesn't prove its ID
+// keeps the made-up one its connection started with
+func TestUnprovenPeerIsProvisional(t *testing.T) {
+	a, plain := startTestNode(t, "a"), startUnprovenNode(t, "plain-node", "plain")
+
+	if err := plain.dial("127.0.0.1", a.listenPort); err != nil {
+		t.Fatal(err)
+	}
+	var id string
+	waitFor(t, "a to finish the handshake with plain", func() bool {
+		if peer := a.handshaken("plain"); peer != nil {
+			a.mutex.RLock()
+			id = peer.ID
+			a.mutex.RUnlock()
+			return true
+		}
+		return false
+	})
+	if !strings.HasPrefix(id, "tcp-") {
+		t.Errorf("plain is known by %q, want its provisional tcp- ID", id)
+	}
+	a.mutex.RLock()
+	claimed := a.connectedPeers[plain.id]
+	a.mutex.RUnlock()
+	if claimed != nil {
+		t.Errorf("plain is filed under the ID it claimed without proof")
+	}
+}
+
+// TestUnprovenClaimToKeyedID checks a node claiming the ID of a node with a
+// key, without proving it holds that key, is refused
+func TestUnprovenClaimToKeyedID(t *testing.T) {
+	tests := []struct {
+		name  string
+		known func(t *testing.T, a, b *testNode) // Makes b's key known to a
+	}{
+		{"key proved here", func(t *testing.T, a, b *testNode) {
+			if err := b.dial("127.0.0.1", a.listenPort); err != nil {
+				t.Fatal(err)
+			}
+			waitFor(t, "a to learn who b is", func() bool {
+				a.mutex.RLock()
+				defer a.mutex.RUnlock()
+				return a.connectedPeers[b.id] != nil
+			})
+			b.Stop()
+			waitFor(t, "a to drop b", func() bool {
+				a.mutex.RLock()
+				defer a.mutex.RUnlock()
+				return a.connectedPeers[b.id] == nil
+			})
+		}},
+		{"key from the check", func(t *testing.T, a, b *testNode) {
+			a.SetKeyCheck(func(nodeID string) bool { return nodeID == b.id })
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, b := startTestNode(t, "a"), startTestNode(t, "b")
+			test.known(t, a, b)
+			impostor := startUnprovenNode(t, b.id, "impostor")
+
+			if err := impostor.dial("127.0.0.1", a.listenPort); err != nil {
+				t.Fatal(err)
+			}
+			waitFor(t, "a to hang up on the impostor", func() bool {
+				impostor.mutex.RLock()
+				defer impostor.mutex.RUnlock()
+				return len(impostor.connectedPeers) == 0
+			})
+			a.mutex.RLock()
+			claimed := a.connectedPeers[b.id]
+			a.mutex.RUnlock()
+			if claimed != nil {
+				t.Errorf("a filed the impostor under b's ID")
+			}
+		})
+	}
+}
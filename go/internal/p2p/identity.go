@@ -0,0 +1,252 @@
+package p2p
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"fileshare/internal/version"
+)
+
+// Node keys
+//
+// Every node has an Ed25519 key pair and its ID is derived from the public
+// key: "node-" and the first 128 bits of the key's SHA-256 in hex. A node
+// proves the ID is its own by signing a challenge the asking node chose.
+// Discovery requests carry one and answers come with the public key and the
+// signature; over the TCP service, HELLO asks for the same. Answers without
+// a key come from releases before keys, or nodes with a configured ID, and
+// are taken as they are but not verified: a connection to such a node keeps
+// the made-up ID it started with (see handshake.go). Once a node proved a
+// key for its ID, here or as far as the check set with SetKeyCheck knows,
+// claims to that ID without the proof are refused.
+
+// ErrIdentityMismatch is returned when a node's signature or key doesn't
+// match the ID it claims
+var ErrIdentityMismatch = errors.New("the node's key doesn't match the ID it claims")
+
+// Identity is who a node proved to be
+type Identity struct {
+	NodeID    string
+	Name      string
+	PublicKey ed25519.PublicKey
+}
+
+// helloMessage asks for a node's identity over the TCP service, and answers
+type helloMessage struct {
+	Type      string `json:"type"` // HELLO, IDENTITY or INCOMPATIBLE
+	Challenge string `json:"challenge,omitempty"`
+	NodeID    string `json:"node_id,omitempty"`
+	NodeName  string `json:"node_name,omitempty"`
+	PublicKey []byte `json:"public_key,omitempty"`
+	Signature []byte `json:"signature,omitempty"`
+
+	// The network the node is on and its proof, see network.go
+	Network      string `json:"network,omitempty"`
+	NetworkProof []byte `json:"network_proof,omitempty"`
+
+	// What the node speaks and can do, see handshake.go; INCOMPATIBLE
+	// answers say why in Error
+	Version      int      `json:"version,omitempty"`
+	MinVersion   int      `json:"min_version,omitempty"`
+	Release      string   `json:"release,omitempty"`
+	Port         int      `json:"port,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+	Error        string   `json:"error,omitempty"`
+}
+
+// NodeIDForKey returns the node ID that belongs to a public key
+func NodeIDForKey(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return "node-" + hex.EncodeToString(sum[:16])
+}
+
+// Fingerprint returns a short form of a public key for people to compare,
+// the first 64 bits of its SHA-256 in colon separated pairs
+func Fingerprint(key ed25519.PublicKey) string {
+	if len(key) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(key)
+	parts := make([]string, 8)
+	for i, b := range sum[:8] {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// SetKey sets the key this node proves its ID with. Without one, or when
+// the ID wasn't derived from it, answers carry no key.
+func (tm *TCPManager) SetKey(key ed25519.PrivateKey) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	tm.key = key
+	tm.cert = nil
+}
+
+// SetKeyCheck sets how to tell whether a node ID is known to have a key,
+// besides having proved one to this manager since it started
+func (tm *TCPManager) SetKeyCheck(check func(nodeID string) bool) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	tm.keyCheck = check
+}
+
+// noteKey remembers that nodeID proved a key
+func (tm *TCPManager) noteKey(nodeID string) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	if tm.provenIDs == nil {
+		tm.provenIDs = make(map[string]bool)
+	}
+	tm.provenIDs[nodeID] = true
+}
+
+// keyKnown reports whether nodeID has a key, so claims to it must prove it
+func (tm *TCPManager) keyKnown(nodeID string) bool {
+	tm.mutex.RLock()
+	proven, check := tm.provenIDs[nodeID], tm.keyCheck
+	tm.mutex.RUnlock()
+	return proven || (check != nil && check(nodeID))
+}
+
+// prove returns the public key and the signature over challenge that show
+// this node holds the key behind its ID, or nothing when it can't
+func (tm *TCPManager) prove(challenge string) ([]byte, []byte) {
+	nodeID, _ := tm.identity()
+	tm.mutex.RLock()
+	key := tm.key
+	tm.mutex.RUnlock()
+	if key == nil || challenge == "" {
+		return nil, nil
+	}
+	public := key.Public().(ed25519.PublicKey)
+	if NodeIDForKey(public) != nodeID {
+		return nil, nil
+	}
+	return public, ed25519.Sign(key, signedChallenge(challenge, nodeID))
+}
+
+// newChallenge returns a random challenge for a node to sign
+func newChallenge() string {
+	challenge := make([]byte, 16)
+	rand.Read(challenge)
+	return base64.RawStdEncoding.EncodeToString(challenge)
+}
+
+// signedChallenge is what a node signs for a challenge, with its ID so the
+// signature can't be passed off as another node's
+func signedChallenge(challenge, nodeID string) []byte {
+	return []byte("bitshare-identity\x00" + challenge + "\x00" + nodeID)
+}
+
+// verifyIdentity checks that nodeID belongs to key and signature is the
+// key's over challenge
+func verifyIdentity(nodeID string, key, signature []byte, challenge string) (ed25519.PublicKey, error) {
+	if len(key) != ed25519.PublicKeySize || NodeIDForKey(key) != nodeID {
+		return nil, ErrIdentityMismatch
+	}
+	if !ed25519.Verify(key, signedChallenge(challenge, nodeID), signature) {
+		return nil, ErrIdentityMismatch
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// sendIdentity answers a HELLO on a connection to the TCP service. Nodes
+// of other networks only learn that it is another network.
+func (tm *TCPManager) sendIdentity(peer *TCPPeer, hello helloMessage) error {
+	n := tm.currentNetwork()
+	answer := helloMessage{Type: "IDENTITY", Network: n.id, Version: ProtocolVersion, MinVersion: MinProtocolVersion}
+	if hello.Network == n.id {
+		answer.NodeID, answer.NodeName = tm.identity()
+		answer.PublicKey, answer.Signature = tm.prove(hello.Challenge)
+		answer.NetworkProof = n.proof(hello.Challenge, answer.NodeID)
+		answer.Release = version.Current
+		answer.Capabilities = tm.currentCapabilities()
+		tm.mutex.RLock()
+		answer.Port = tm.listenPort
+		tm.mutex.RUnlock()
+	}
+	response, err := json.Marshal(answer)
+	if err != nil {
+		return err
+	}
+	return peer.send(response)
+}
+
+// Authenticate asks the node at the other end of conn, a connection to its
+// TCP service, who it is and waits up to timeout for the answer. The
+// identity has a PublicKey only when the node proved it holds the key its
+// ID derives from; it is ErrIdentityMismatch when the proof is wrong. A node
+// on another network than this one is ErrOtherNetwork, and one on this
+// private network that doesn't know its passphrase ErrNetworkAuth.
+func Authenticate(conn net.Conn, timeout time.Duration) (Identity, error) {
+	return authenticate(conn, GetTCPManager().currentNetwork(), timeout)
+}
+
+// authenticate is Authenticate as a node of network n
+func authenticate(conn net.Conn, n network, timeout time.Duration) (Identity, error) {
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	challenge := newChallenge()
+	request, err := json.Marshal(helloMessage{
+		Type:       "HELLO",
+		Challenge:  challenge,
+		Network:    n.id,
+		Version:    ProtocolVersion,
+		MinVersion: MinProtocolVersion,
+	})
+	if err != nil {
+		return Identity{}, err
+	}
+	if _, err := conn.Write(packMessage(request)); err != nil {
+		return Identity{}, err
+	}
+
+	answer, err := readAnswer(conn, 64*1024)
+	if err != nil {
+		return Identity{}, err
+	}
+	var hello helloMessage
+	if err := json.Unmarshal(answer, &hello); err == nil && hello.Type == "INCOMPATIBLE" {
+		return Identity{}, incompatible(answer)
+	}
+	if err != nil || hello.Type != "IDENTITY" {
+		return Identity{}, errors.New("peer didn't say who it is")
+	}
+	if err := checkProtocolVersion(hello.Version, hello.MinVersion); err != nil {
+		return Identity{}, err
+	}
+	if hello.Network != n.id {
+		return Identity{}, ErrOtherNetwork
+	}
+	if hello.NodeID == "" {
+		return Identity{}, errors.New("peer didn't say who it is")
+	}
+	if err := n.check(hello.Network, hello.NetworkProof, challenge, hello.NodeID); err != nil {
+		return Identity{}, err
+	}
+
+	identity := Identity{NodeID: hello.NodeID, Name: hello.NodeName}
+	if hello.PublicKey == nil {
+		return identity, nil
+	}
+	identity.PublicKey, err = verifyIdentity(hello.NodeID, hello.PublicKey, hello.Signature, challenge)
+	if err != nil {
+		return identity, err
+	}
+	// Over TLS, the node has to be the one the channel ends at
+	if key := certificateKey(conn); key != nil && !key.Equal(identity.PublicKey) {
+		return Identity{}, ErrIdentityMismatch
+	}
+	return identity, nil
+}
@@ -0,0 +1,217 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Keepalives
+//
+// A connection whose other end went away without closing it, because the
+// peer slept or lost its network, would stay among the connected peers until
+// a write to it failed. Whenever nothing arrived on a connection of the TCP
+// service for the keepalive interval, a PING goes out on it; one that brings
+// nothing back, not even a PONG, for as many intervals as SetKeepalive
+// allows is closed, its peer dropped and the OnConnectionLost handler told.
+// Connections that carry data get no PINGs, and bytes of a message still
+// arriving count as data.
+//
+// The other end may get a PING while it waits for the answer to a request
+// of its own, so Ping and Splice read past them, see readAnswer.
+
+// Keepalive settings unless SetKeepalive says otherwise
+const (
+	DefaultKeepaliveInterval = 30 * time.Second
+	DefaultKeepaliveMisses   = 3
+)
+
+// keepalive is the keepalive state of a connection
+type keepalive struct {
+	lastRead atomic.Int64 // Unix nanoseconds of the last bytes read
+	mutex    sync.Mutex   // Held while a PING is queued, so end waits for it
+	ended    bool
+	stopped  chan struct{}
+}
+
+func newKeepalive() *keepalive {
+	k := &keepalive{stopped: make(chan struct{})}
+	k.touch()
+	return k
+}
+
+func (k *keepalive) touch() {
+	k.lastRead.Store(time.Now().UnixNano())
+}
+
+func (k *keepalive) idle() time.Duration {
+	return time.Since(time.Unix(0, k.lastRead.Load()))
+}
+
+// end stops the PINGs, waiting for one being written, once the connection
+// is closed or handed over
+func (k *keepalive) end() {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if !k.ended {
+		k.ended = true
+		close(k.stopped)
+	}
+}
+
+// ping sends a PING to peer unless the keepalive ended
+func (k *keepalive) ping(peer *TCPPeer) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if k.ended {
+		return nil
+	}
+	return peer.send([]byte(`{"type":"PING"}`))
+}
+
+// activityReader records when bytes were read from a connection
+type activityReader struct {
+	conn      net.Conn
+	keepalive *keepalive
+}
+
+func (r activityReader) Read(p []byte) (int, error) {
+	n, err := r.conn.Read(p)
+	if n > 0 {
+		r.keepalive.touch()
+	}
+	return n, err
+}
+
+// SetKeepalive sets how long a connection may go without bringing anything
+// before it gets a PING, and how many of those intervals in a row it may
+// stay silent before it is closed. Zero means the default and a negative
+// interval never. It applies to open connections as well.
+func (tm *TCPManager) SetKeepalive(interval time.Duration, misses int) {
+	if interval == 0 {
+		interval = DefaultKeepaliveInterval
+	}
+	if misses <= 0 {
+		misses = DefaultKeepaliveMisses
+	}
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	tm.keepaliveInterval = interval
+	tm.keepaliveMisses = misses
+}
+
+// keepaliveSettings returns the keepalive interval and misses in effect
+func (tm *TCPManager) keepaliveSettings() (time.Duration, int) {
+	tm.mutex.RLock()
+	defer tm.mutex.RUnlock()
+	interval, misses := tm.keepaliveInterval, tm.keepaliveMisses
+	if interval == 0 {
+		interval = DefaultKeepaliveInterval
+	}
+	if misses <= 0 {
+		misses = DefaultKeepaliveMisses
+	}
+	return interval, misses
+}
+
+// OnConnectionLost sets the handler told about connections closed for not
+// answering keepalives, with the peer's ID and address as the TCP service
+// knew them
+func (tm *TCPManager) OnConnectionLost(handler func(peerID, address string)) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	tm.onConnectionLost = handler
+}
+
+// keepAlive sends PINGs to peer while its connection stays quiet, see
+// above, until the keepalive ends
+func (tm *TCPManager) keepAlive(peer *TCPPeer) {
+	k := peer.keepalive
+	misses := 0
+	for {
+		interval, limit := tm.keepaliveSettings()
+		wait := interval
+		if interval < 0 {
+			// Off, until SetKeepalive turns it on
+			wait = DefaultKeepaliveInterval
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-k.stopped:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		if interval < 0 || k.idle() < interval {
+			misses = 0
+			continue
+		}
+		if misses >= limit {
+			tm.connectionLost(peer, fmt.Sprintf("no answer to %d keepalives", misses))
+			return
+		}
+		if err := k.ping(peer); err != nil {
+			tm.connectionLost(peer, fmt.Sprintf("keepalive failed: %v", err))
+			return
+		}
+		misses++
+	}
+}
+
+// connectionLost closes the connection of peer, which handlePeer then drops,
+// and tells the OnConnectionLost handler
+func (tm *TCPManager) connectionLost(peer *TCPPeer, reason string) {
+	// The handshake may rename the peer meanwhile
+	tm.mutex.RLock()
+	id, handler := peer.ID, tm.onConnectionLost
+	tm.mutex.RUnlock()
+
+	fmt.Printf("[TCP:%s] Closing the connection to %s, %s\n", id, peer.Address, reason)
+	peer.keepalive.end()
+	peer.Conn.Close()
+	if handler != nil {
+		handler(id, peer.Address)
+	}
+}
+
+// readAnswer reads the next message from conn, a connection to another
+// node's TCP service, answering and skipping the PINGs of its keepalive.
+// Messages over limit bytes are refused, and a refusal of the plain
+// connection is ErrEncryptionRequired (see secure.go).
+func readAnswer(conn net.Conn, limit uint32) ([]byte, error) {
+	for {
+		var length [4]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return nil, err
+		}
+		size := binary.BigEndian.Uint32(length[:])
+		if size > limit {
+			return nil, fmt.Errorf("answer of %d bytes", size)
+		}
+		message := make([]byte, size)
+		if _, err := io.ReadFull(conn, message); err != nil {
+			return nil, err
+		}
+
+		var header struct {
+			Type string `json:"type"`
+		}
+		json.Unmarshal(message, &header)
+		switch header.Type {
+		case "PING":
+		case "ENCRYPTION_REQUIRED":
+			return nil, ErrEncryptionRequired
+		default:
+			return message, nil
+		}
+		if _, err := conn.Write(packMessage([]byte(`{"type":"PONG"}`))); err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,729 @@
+package p2p
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"fileshare/internal/version"
+)
+
+// mDNS discovery
+//
+// UDP broadcasts are dropped on many enterprise and guest networks where
+// multicast DNS still gets through. While the TCP service runs it advertises
+// the _bitshare._tcp.local service (DNS-SD, RFC 6763) on every interface
+// that does multicast: a PTR record naming the node's instance, SRV with the
+// TCP service's port, TXT with the node ID, name and capabilities, and A
+// records with the interface's addresses. Discover browses for the service
+// with one-shot queries (RFC 6762 section 5.1) sent from each interface,
+// which responders answer directly.
+//
+// Each interface only answers queries from its own networks and with its
+// own addresses, so a machine on two networks tells each the address that
+// reaches it.
+//
+// On a private network (see network.go) TXT also has the network ID, and
+// not the node's name, and browsing skips nodes of other networks.
+
+const (
+	mdnsPort    = 5353
+	mdnsService = "_bitshare._tcp.local."
+	mdnsBrowse  = "_services._dns-sd._udp.local." // Lists the services on a network
+	mdnsTTL     = 120                             // Seconds, as RFC 6762 suggests for records with host names
+	legacyTTL   = 10                              // Seconds, for answers to one-shot queries
+
+	// mdnsInterfaceCheck is how often the responder looks for interfaces
+	// that came up or went away
+	mdnsInterfaceCheck = time.Minute
+
+	// mdnsRequery is how long Discover waits before asking again, in case
+	// the first query or its answers were lost
+	mdnsRequery = time.Second
+
+	dnsTypeA    = 1
+	dnsTypePTR  = 12
+	dnsTypeTXT  = 16
+	dnsTypeSRV  = 33
+	dnsTypeANY  = 255
+	dnsClassIN  = 1
+	dnsResponse = 0x8400 // QR and AA
+
+	// The top bit of the class asks for a unicast answer in questions and
+	// tells caches to drop older records in answers
+	dnsUnicastResponse = 0x8000
+	dnsCacheFlush      = 0x8000
+)
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: mdnsPort}
+
+// SetMDNS sets whether the TCP service advertises itself and Discover
+// browses with multicast DNS. It applies from the next Start; it is on
+// unless turned off.
+func (tm *TCPManager) SetMDNS(enabled bool) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	tm.mdnsDisabled = !enabled
+}
+
+// mdnsResponder answers queries for this node's service on every interface
+type mdnsResponder struct {
+	tm         *TCPManager
+	mutex      sync.Mutex
+	interfaces map[string]*mdnsInterface // By interface name
+	stopped    chan struct{}
+}
+
+// mdnsInterface is the socket the responder listens on for one interface
+type mdnsInterface struct {
+	ifi  net.Interface
+	conn *net.UDPConn
+}
+
+// startMDNSResponder joins the mDNS group on every interface that does
+// multicast and answers for tm until stop
+func startMDNSResponder(tm *TCPManager) *mdnsResponder {
+	r := &mdnsResponder{tm: tm, interfaces: make(map[string]*mdnsInterface), stopped: make(chan struct{})}
+	r.joinInterfaces()
+	go func() {
+		ticker := time.NewTicker(mdnsInterfaceCheck)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.stopped:
+				return
+			case <-ticker.C:
+				r.joinInterfaces()
+			}
+		}
+	}()
+	return r
+}
+
+func (r *mdnsResponder) stop() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	select {
+	case <-r.stopped:
+		return
+	default:
+	}
+	close(r.stopped)
+	for name, mi := range r.interfaces {
+		mi.conn.Close()
+		delete(r.interfaces, name)
+	}
+}
+
+// joinInterfaces listens on the interfaces that came up since the last
+// check and drops those that went away
+func (r *mdnsResponder) joinInterfaces() {
+	current := make(map[string]net.Interface)
+	for _, ifi := range multicastInterfaces() {
+		if len(interfaceNetworks(ifi)) > 0 {
+			current[ifi.Name] = ifi
+		}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	select {
+	case <-r.stopped:
+		return
+	default:
+	}
+
+	for name, mi := range r.interfaces {
+		if _, up := current[name]; !up {
+			mi.conn.Close()
+			delete(r.interfaces, name)
+		}
+	}
+	for name, ifi := range current {
+		if r.interfaces[name] != nil {
+			continue
+		}
+		ifi := ifi
+		conn, err := net.ListenMulticastUDP("udp4", &ifi, mdnsGroup)
+		if err != nil {
+			continue
+		}
+		mi := &mdnsInterface{ifi: ifi, conn: conn}
+		r.interfaces[name] = mi
+		go r.serve(mi)
+	}
+}
+
+// serve answers the queries that arrive on one interface's socket
+func (r *mdnsResponder) serve(mi *mdnsInterface) {
+	buffer := make([]byte, 9000)
+	for {
+		n, from, err := mi.conn.ReadFromUDP(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			continue
+		}
+		query, err := parseDNSMessage(buffer[:n])
+		if err != nil || query.flags&0x8000 != 0 {
+			// Not a query
+			continue
+		}
+
+		// Sockets can get what arrives on other interfaces too, only
+		// queries from this interface's networks are its to answer
+		networks := interfaceNetworks(mi.ifi)
+		if !onNetworks(from.IP, networks) {
+			continue
+		}
+
+		legacy := from.Port != mdnsPort
+		answer, unicast := r.answer(query, networks, legacy)
+		if answer == nil {
+			continue
+		}
+		if legacy || unicast {
+			mi.conn.WriteToUDP(answer, from)
+		} else {
+			mi.conn.WriteToUDP(answer, mdnsGroup)
+		}
+	}
+}
+
+// answer returns the response to query, or nil when it doesn't ask about
+// this node, and whether it was asked for by unicast. Answers to one-shot
+// (legacy) queries repeat the question and ID, with short TTLs.
+func (r *mdnsResponder) answer(query *dnsMessage, networks []*net.IPNet, legacy bool) ([]byte, bool) {
+	nodeID, nodeName := r.tm.identity()
+	if nodeID == "" {
+		return nil, false
+	}
+	r.tm.mutex.RLock()
+	port := r.tm.listenPort
+	r.tm.mutex.RUnlock()
+
+	txt := []string{"txtvers=1", "id=" + nodeID}
+	if n := r.tm.currentNetwork(); n.id != "" {
+		txt = append(txt, "net="+n.id)
+	} else {
+		txt = append(txt, "name="+nodeName)
+	}
+	txt = append(txt, "caps="+strings.Join(r.tm.currentCapabilities(), ","), "version="+version.Current)
+
+	instance := mdnsLabel(nodeID) + "." + mdnsService
+	host := mdnsLabel(nodeID) + ".local."
+	ttl, flush := uint32(mdnsTTL), uint16(dnsCacheFlush)
+	if legacy {
+		ttl, flush = legacyTTL, 0
+	}
+
+	records := map[string]dnsRecord{
+		"ptr": {name: mdnsService, rtype: dnsTypePTR, class: dnsClassIN, ttl: ttl, target: instance},
+		"srv": {name: instance, rtype: dnsTypeSRV, class: dnsClassIN | flush, ttl: ttl, target: host, port: uint16(port)},
+		"txt": {name: instance, rtype: dnsTypeTXT, class: dnsClassIN | flush, ttl: ttl, txt: txt},
+	}
+	var addresses []dnsRecord
+	for _, network := range networks {
+		addresses = append(addresses, dnsRecord{name: host, rtype: dnsTypeA, class: dnsClassIN | flush, ttl: ttl, ip: network.IP})
+	}
+
+	var answers, additional []dnsRecord
+	unicast := false
+	for _, q := range query.questions {
+		asks := func(rtype uint16) bool { return q.qtype == rtype || q.qtype == dnsTypeANY }
+		var found bool
+		switch {
+		case strings.EqualFold(q.name, mdnsBrowse) && asks(dnsTypePTR):
+			answers = append(answers, dnsRecord{name: mdnsBrowse, rtype: dnsTypePTR, class: dnsClassIN, ttl: ttl, target: mdnsService})
+			found = true
+		case strings.EqualFold(q.name, mdnsService) && asks(dnsTypePTR):
+			answers = append(answers, records["ptr"])
+			additional = append(additional, records["srv"], records["txt"])
+			additional = append(additional, addresses...)
+			found = true
+		case strings.EqualFold(q.name, instance):
+			if asks(dnsTypeSRV) {
+				answers = append(answers, records["srv"])
+				found = true
+			}
+			if asks(dnsTypeTXT) {
+				answers = append(answers, records["txt"])
+				found = true
+			}
+			additional = append(additional, addresses...)
+		case strings.EqualFold(q.name, host) && asks(dnsTypeA):
+			answers = append(answers, addresses...)
+			found = len(addresses) > 0
+		}
+		if found && q.class&dnsUnicastResponse != 0 {
+			unicast = true
+		}
+	}
+	if len(answers) == 0 {
+		return nil, false
+	}
+
+	response := &dnsMessage{flags: dnsResponse, answers: answers, additional: additional}
+	if legacy {
+		response.id = query.id
+		response.questions = query.questions
+	}
+	return response.pack(), unicast
+}
+
+// browseMDNS asks every interface's network for BitShare nodes of the
+// network with ID netID until ctx, which has a deadline, is done
+func browseMDNS(ctx context.Context, netID string) ([]PeerInfo, error) {
+	var conns []*net.UDPConn
+	for _, ifi := range multicastInterfaces() {
+		for _, network := range interfaceNetworks(ifi) {
+			// Bound to the interface's address, queries go out that interface
+			conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: network.IP})
+			if err != nil {
+				continue
+			}
+			defer conn.Close()
+			conns = append(conns, conn)
+		}
+	}
+	if len(conns) == 0 {
+		return nil, errors.New("no network interface does multicast")
+	}
+
+	id := make([]byte, 2)
+	rand.Read(id)
+	query := (&dnsMessage{
+		id:        binary.BigEndian.Uint16(id),
+		questions: []dnsQuestion{{name: mdnsService, qtype: dnsTypePTR, class: dnsClassIN}},
+	}).pack()
+
+	results := newMDNSResults()
+	var wg sync.WaitGroup
+	deadline, _ := ctx.Deadline()
+	for _, conn := range conns {
+		wg.Add(1)
+		go func(conn *net.UDPConn) {
+			defer wg.Done()
+			stop := context.AfterFunc(ctx, func() {
+				conn.SetReadDeadline(time.Now())
+			})
+			defer stop()
+			conn.WriteToUDP(query, mdnsGroup)
+			requery := time.Now().Add(mdnsRequery)
+			buffer := make([]byte, 9000)
+			for {
+				wait := deadline
+				if !requery.IsZero() && requery.Before(wait) {
+					wait = requery
+				}
+				conn.SetReadDeadline(wait)
+				n, from, err := conn.ReadFromUDP(buffer)
+				if err != nil {
+					var netErr net.Error
+					if !errors.As(err, &netErr) || !netErr.Timeout() || ctx.Err() != nil || !time.Now().Before(deadline) {
+						return
+					}
+					if !requery.IsZero() && !time.Now().Before(requery) {
+						conn.WriteToUDP(query, mdnsGroup)
+						requery = time.Time{}
+					}
+					continue
+				}
+				if message, err := parseDNSMessage(buffer[:n]); err == nil && message.flags&0x8000 != 0 {
+					results.add(message, from.IP)
+				}
+			}
+		}(conn)
+	}
+	wg.Wait()
+	return results.peers(netID), nil
+}
+
+// mdnsResults gathers the records of the answers Discover gets
+type mdnsResults struct {
+	mutex     sync.Mutex
+	instances map[string]*mdnsInstance
+	hosts     map[string][]net.IP
+}
+
+// mdnsInstance is what is known of one advertised node
+type mdnsInstance struct {
+	host string
+	port int
+	txt  map[string]string
+	from net.IP // Where the answer came from, if the host has no A record
+	seen time.Time
+}
+
+func newMDNSResults() *mdnsResults {
+	return &mdnsResults{instances: make(map[string]*mdnsInstance), hosts: make(map[string][]net.IP)}
+}
+
+func (res *mdnsResults) add(message *dnsMessage, from net.IP) {
+	res.mutex.Lock()
+	defer res.mutex.Unlock()
+
+	instance := func(name string) *mdnsInstance {
+		key := strings.ToLower(name)
+		in := res.instances[key]
+		if in == nil {
+			in = &mdnsInstance{txt: make(map[string]string), from: from, seen: time.Now()}
+			res.instances[key] = in
+		}
+		return in
+	}
+	for _, record := range append(message.answers, message.additional...) {
+		switch record.rtype {
+		case dnsTypePTR:
+			if strings.EqualFold(record.name, mdnsService) {
+				instance(record.target)
+			}
+		case dnsTypeSRV:
+			in := instance(record.name)
+			in.host, in.port = strings.ToLower(record.target), int(record.port)
+		case dnsTypeTXT:
+			in := instance(record.name)
+			for _, entry := range record.txt {
+				if key, value, ok := strings.Cut(entry, "="); ok {
+					in.txt[strings.ToLower(key)] = value
+				}
+			}
+		case dnsTypeA:
+			host := strings.ToLower(record.name)
+			if !containsIP(res.hosts[host], record.ip) {
+				res.hosts[host] = append(res.hosts[host], record.ip)
+			}
+		}
+	}
+}
+
+// peers returns the nodes of the network with ID netID whose answers named
+// their ID
+func (res *mdnsResults) peers(netID string) []PeerInfo {
+	res.mutex.Lock()
+	defer res.mutex.Unlock()
+
+	var peers []PeerInfo
+	for _, in := range res.instances {
+		id := in.txt["id"]
+		if id == "" || in.txt["net"] != netID {
+			continue
+		}
+		address := in.from
+		if ips := res.hosts[in.host]; len(ips) > 0 {
+			address = ips[0]
+			// Prefer the address the node answered from when it has several
+			if containsIP(ips, in.from) {
+				address = in.from
+			}
+		}
+		var capabilities []string
+		if caps := in.txt["caps"]; caps != "" {
+			capabilities = strings.Split(caps, ",")
+		}
+		peers = append(peers, PeerInfo{
+			ID:             id,
+			Name:           in.txt["name"],
+			Address:        address.String(),
+			Protocol:       "tcp",
+			Port:           in.port,
+			SignalStrength: 100,
+			LastSeen:       in.seen,
+			Capabilities:   capabilities,
+			Version:        in.txt["version"],
+		})
+	}
+	return peers
+}
+
+// multicastInterfaces returns the interfaces that are up and do multicast,
+// other than loopback
+func multicastInterfaces() []net.Interface {
+	all, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	var interfaces []net.Interface
+	for _, ifi := range all {
+		if ifi.Flags&net.FlagUp != 0 && ifi.Flags&net.FlagMulticast != 0 && ifi.Flags&net.FlagLoopback == 0 {
+			interfaces = append(interfaces, ifi)
+		}
+	}
+	return interfaces
+}
+
+// hasIPv6 reports whether ifi has an IPv6 address, link-local included
+func hasIPv6(ifi net.Interface) bool {
+	addresses, err := ifi.Addrs()
+	if err != nil {
+		return false
+	}
+	for _, address := range addresses {
+		if network, ok := address.(*net.IPNet); ok && network.IP.To4() == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// interfaceNetworks returns the IPv4 networks of ifi, with the interface's
+// address in each
+func interfaceNetworks(ifi net.Interface) []*net.IPNet {
+	addresses, err := ifi.Addrs()
+	if err != nil {
+		return nil
+	}
+	var networks []*net.IPNet
+	for _, address := range addresses {
+		if network, ok := address.(*net.IPNet); ok && network.IP.To4() != nil {
+			networks = append(networks, &net.IPNet{IP: network.IP.To4(), Mask: network.Mask[len(network.Mask)-net.IPv4len:]})
+		}
+	}
+	return networks
+}
+
+func onNetworks(ip net.IP, networks []*net.IPNet) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, known := range ips {
+		if known.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// mdnsLabel turns s into a DNS label: at most 63 bytes and without dots
+func mdnsLabel(s string) string {
+	s = strings.ReplaceAll(s, ".", "-")
+	if len(s) > 63 {
+		s = s[:63]
+	}
+	return s
+}
+
+// The few parts of DNS messages (RFC 1035) mDNS discovery needs
+
+type dnsQuestion struct {
+	name  string
+	qtype uint16
+	class uint16
+}
+
+// dnsRecord is a resource record, with the data of the types used here
+// decoded
+type dnsRecord struct {
+	name   string
+	rtype  uint16
+	class  uint16
+	ttl    uint32
+	target string   // PTR and SRV
+	port   uint16   // SRV
+	txt    []string // TXT
+	ip     net.IP   // A
+}
+
+type dnsMessage struct {
+	id         uint16
+	flags      uint16
+	questions  []dnsQuestion
+	answers    []dnsRecord
+	additional []dnsRecord // Authority and additional records when parsed
+}
+
+func (m *dnsMessage) pack() []byte {
+	b := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(b[0:], m.id)
+	binary.BigEndian.PutUint16(b[2:], m.flags)
+	binary.BigEndian.PutUint16(b[4:], uint16(len(m.questions)))
+	binary.BigEndian.PutUint16(b[6:], uint16(len(m.answers)))
+	binary.BigEndian.PutUint16(b[10:], uint16(len(m.additional)))
+	for _, q := range m.questions {
+		b = appendDNSName(b, q.name)
+		b = binary.BigEndian.AppendUint16(b, q.qtype)
+		b = binary.BigEndian.AppendUint16(b, q.class)
+	}
+	for _, record := range append(m.answers[:len(m.answers):len(m.answers)], m.additional...) {
+		b = appendDNSRecord(b, record)
+	}
+	return b
+}
+
+func appendDNSRecord(b []byte, record dnsRecord) []byte {
+	var data []byte
+	switch record.rtype {
+	case dnsTypePTR:
+		data = appendDNSName(nil, record.target)
+	case dnsTypeSRV:
+		data = []byte{0, 0, 0, 0} // Priority and weight
+		data = binary.BigEndian.AppendUint16(data, record.port)
+		data = appendDNSName(data, record.target)
+	case dnsTypeTXT:
+		for _, entry := range record.txt {
+			if len(entry) > 255 {
+				entry = entry[:255]
+			}
+			data = append(data, byte(len(entry)))
+			data = append(data, entry...)
+		}
+	case dnsTypeA:
+		data = record.ip.To4()
+	}
+
+	b = appendDNSName(b, record.name)
+	b = binary.BigEndian.AppendUint16(b, record.rtype)
+	b = binary.BigEndian.AppendUint16(b, record.class)
+	b = binary.BigEndian.AppendUint32(b, record.ttl)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(data)))
+	return append(b, data...)
+}
+
+func appendDNSName(b []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		label = mdnsLabel(label)
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+var errShortDNS = errors.New("truncated DNS message")
+
+func parseDNSMessage(b []byte) (*dnsMessage, error) {
+	if len(b) < 12 {
+		return nil, errShortDNS
+	}
+	m := &dnsMessage{id: binary.BigEndian.Uint16(b[0:]), flags: binary.BigEndian.Uint16(b[2:])}
+	counts := []int{int(binary.BigEndian.Uint16(b[4:])), int(binary.BigEndian.Uint16(b[6:])), int(binary.BigEndian.Uint16(b[8:])), int(binary.BigEndian.Uint16(b[10:]))}
+
+	offset := 12
+	for i := 0; i < counts[0]; i++ {
+		name, next, err := readDNSName(b, offset)
+		if err != nil {
+			return nil, err
+		}
+		if next+4 > len(b) {
+			return nil, errShortDNS
+		}
+		m.questions = append(m.questions, dnsQuestion{name: name, qtype: binary.BigEndian.Uint16(b[next:]), class: binary.BigEndian.Uint16(b[next+2:])})
+		offset = next + 4
+	}
+	for section := 1; section < 4; section++ {
+		for i := 0; i < counts[section]; i++ {
+			record, next, err := readDNSRecord(b, offset)
+			if err != nil {
+				return nil, err
+			}
+			if section == 1 {
+				m.answers = append(m.answers, record)
+			} else {
+				m.additional = append(m.additional, record)
+			}
+			offset = next
+		}
+	}
+	return m, nil
+}
+
+func readDNSRecord(b []byte, offset int) (dnsRecord, int, error) {
+	var record dnsRecord
+	name, next, err := readDNSName(b, offset)
+	if err != nil {
+		return record, 0, err
+	}
+	if next+10 > len(b) {
+		return record, 0, errShortDNS
+	}
+	record.name = name
+	record.rtype = binary.BigEndian.Uint16(b[next:])
+	record.class = binary.BigEndian.Uint16(b[next+2:])
+	record.ttl = binary.BigEndian.Uint32(b[next+4:])
+	length := int(binary.BigEndian.Uint16(b[next+8:]))
+	start := next + 10
+	end := start + length
+	if end > len(b) {
+		return record, 0, errShortDNS
+	}
+	data := b[start:end]
+
+	switch record.rtype {
+	case dnsTypePTR:
+		record.target, _, err = readDNSName(b, start)
+	case dnsTypeSRV:
+		if len(data) < 7 {
+			return record, 0, errShortDNS
+		}
+		record.port = binary.BigEndian.Uint16(data[4:])
+		record.target, _, err = readDNSName(b, start+6)
+	case dnsTypeTXT:
+		for len(data) > 0 {
+			size := int(data[0])
+			if 1+size > len(data) {
+				return record, 0, errShortDNS
+			}
+			record.txt = append(record.txt, string(data[1:1+size]))
+			data = data[1+size:]
+		}
+	case dnsTypeA:
+		if len(data) == net.IPv4len {
+			record.ip = net.IP(append([]byte(nil), data...))
+		}
+	}
+	return record, end, err
+}
+
+// readDNSName reads the name at offset, following compression pointers, and
+// returns it with the offset after it
+func readDNSName(b []byte, offset int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; {
+		if offset >= len(b) {
+			return "", 0, errShortDNS
+		}
+		size := int(b[offset])
+		switch {
+		case size == 0:
+			if next < 0 {
+				next = offset + 1
+			}
+			return strings.Join(labels, ".") + ".", next, nil
+		case size&0xC0 == 0xC0:
+			if offset+1 >= len(b) {
+				return "", 0, errShortDNS
+			}
+			if jumps++; jumps > 32 {
+				return "", 0, errors.New("DNS name pointers loop")
+			}
+			if next < 0 {
+				next = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(b[offset:]) & 0x3FFF)
+		case size > 63:
+			return "", 0, fmt.Errorf("bad DNS label length %d", size)
+		default:
+			if offset+1+size > len(b) {
+				return "", 0, errShortDNS
+			}
+			labels = append(labels, string(b[offset+1:offset+1+size]))
+			offset += 1 + size
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package p2p
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Messages
+//
+// Everything on a connection of the TCP service is a message: its length as
+// four bytes, big-endian, then that many bytes. A message that is a JSON
+// object with a "type" goes to the handler of its type, and anything else is
+// raw data for the OnData handler. The messages of the TCP service itself,
+// such as PING, HELLO and SPLICE, have handlers of their own (see
+// builtinHandlers); the rest of the program sends its messages with
+// SendMessage, which wraps them as {"type": ..., "payload": ...}, and takes
+// them with RegisterHandler. Bulk data such as file chunks goes raw with
+// SendData, without JSON around it.
+//
+// Messages sent to a peer go through its send queue, which writes them whole,
+// one at a time, so ones sent at the same time don't interleave on the
+// connection (see sendqueue.go).
+
+// MessageHandler handles a message another node sent with SendMessage, with
+// the connection it came on and the payload as sent. It runs on the
+// connection's reader, so the next message waits for it.
+type MessageHandler func(peer ConnectedPeer, payload json.RawMessage)
+
+// envelope is how SendMessage wraps a payload
+type envelope struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+const (
+	// messageWriteTimeout is how long writing a message may go without
+	// getting any of it out before the connection is given up
+	messageWriteTimeout = 10 * time.Second
+
+	// writeChunk is how much of a message is written at once, so large ones
+	// get a fresh messageWriteTimeout as they make progress
+	writeChunk = 64 * 1024
+)
+
+// builtinHandlers handle the messages of the TCP service itself by type,
+// with the whole message; set in init, since they lead back to handlePeer
+var builtinHandlers map[string]func(tm *TCPManager, peer *TCPPeer, message []byte) error
+
+func init() {
+	builtinHandlers = map[string]func(tm *TCPManager, peer *TCPPeer, message []byte) error{
+		"PING": func(tm *TCPManager, peer *TCPPeer, _ []byte) error {
+			return tm.sendPong(peer)
+		},
+		"PONG": func(*TCPManager, *TCPPeer, []byte) error {
+			// Answers a keepalive, which reading it already counted
+			return nil
+		},
+		"HELLO": func(tm *TCPManager, peer *TCPPeer, message []byte) error {
+			var hello helloMessage
+			if err := json.Unmarshal(message, &hello); err != nil {
+				return err
+			}
+			return tm.helloReceived(peer, hello)
+		},
+		"IDENTITY": (*TCPManager).identified,
+		"INCOMPATIBLE": func(_ *TCPManager, _ *TCPPeer, message []byte) error {
+			return incompatible(message)
+		},
+		"SPLICE": (*TCPManager).splice,
+		"DATA_TRANSFER": func(tm *TCPManager, peer *TCPPeer, message []byte) error {
+			return tm.routeMessage(peer, "DATA_TRANSFER", message)
+		},
+		"MESH_ROUTE": func(tm *TCPManager, peer *TCPPeer, message []byte) error {
+			return tm.routeMessage(peer, "MESH_ROUTE", message)
+		},
+		"DEPART": func(tm *TCPManager, peer *TCPPeer, message []byte) error {
+			var departure departureMessage
+			if err := json.Unmarshal(message, &departure); err != nil {
+				return err
+			}
+			// Only the node at the other end, as the handshake proved it, can
+			// say it is leaving
+			tm.mutex.RLock()
+			id := peer.ID
+			tm.mutex.RUnlock()
+			if departure.NodeID != id {
+				fmt.Printf("⚠️ Ignored a departure of %s sent by %s\n", departure.NodeID, id)
+				return nil
+			}
+			tm.departed(id, peer.Address)
+			return nil
+		},
+		"NEIGHBORS": func(tm *TCPManager, _ *TCPPeer, message []byte) error {
+			var neighbors neighborsMessage
+			if err := json.Unmarshal(message, &neighbors); err != nil {
+				return err
+			}
+			tm.mutex.RLock()
+			handler := tm.onNeighbors
+			tm.mutex.RUnlock()
+			if handler != nil && neighbors.NodeID != "" {
+				handler(neighbors.NodeID, neighbors.Lists)
+			}
+			return nil
+		},
+		"BROADCAST": (*TCPManager).broadcastReceived,
+		"PEER_EXCHANGE": func(tm *TCPManager, _ *TCPPeer, message []byte) error {
+			var exchange peerExchangeMessage
+			if err := json.Unmarshal(message, &exchange); err != nil {
+				return err
+			}
+			tm.mutex.RLock()
+			handler := tm.onPeerExchange
+			tm.mutex.RUnlock()
+			if handler != nil && exchange.NodeID != "" {
+				handler(exchange.NodeID, exchange.Peers)
+			}
+			return nil
+		},
+	}
+}
+
+// reservedType returns an error for message types the TCP service uses
+// itself, or the empty one
+func reservedType(msgType string) error {
+	if msgType == "" {
+		return errors.New("message type is empty")
+	}
+	if _, ok := builtinHandlers[msgType]; ok {
+		return fmt.Errorf("%s is a message of the TCP service itself", msgType)
+	}
+	return nil
+}
+
+// RegisterHandler sets the handler of the messages of msgType that other
+// nodes send with SendMessage; a nil handler removes it. Messages without a
+// handler are dropped.
+func (tm *TCPManager) RegisterHandler(msgType string, handler MessageHandler) error {
+	if err := reservedType(msgType); err != nil {
+		return err
+	}
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	if handler == nil {
+		delete(tm.handlers, msgType)
+		return nil
+	}
+	if tm.handlers == nil {
+		tm.handlers = make(map[string]MessageHandler)
+	}
+	tm.handlers[msgType] = handler
+	return nil
+}
+
+// OnData sets the handler of raw data other nodes send with SendData
+func (tm *TCPManager) OnData(handler func(peer ConnectedPeer, data []byte)) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	tm.onData = handler
+}
+
+// SendMessage sends payload, as JSON, to a connected peer as a message of
+// msgType, for the handler the peer registered for it. It returns once the
+// message is queued, or with ErrSendQueueFull when the peer falls behind.
+func (tm *TCPManager) SendMessage(peerID, msgType string, payload any) error {
+	if err := reservedType(msgType); err != nil {
+		return err
+	}
+	message := envelope{Type: msgType}
+	if payload != nil {
+		var err error
+		if message.Payload, err = json.Marshal(payload); err != nil {
+			return fmt.Errorf("failed to encode %s message: %w", msgType, err)
+		}
+	}
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	peer, err := tm.connectedPeer(peerID)
+	if err != nil {
+		return err
+	}
+	return peer.send(data)
+}
+
+// SendData sends raw data to a connected peer, for its OnData handler. Data
+// that happens to be a JSON object with a type would be taken for a
+// message, so JSON goes with SendMessage.
+func (tm *TCPManager) SendData(peerID string, data []byte) error {
+	if len(data) == 0 {
+		return errors.New("no data to send")
+	}
+	peer, err := tm.connectedPeer(peerID)
+	if err != nil {
+		return err
+	}
+	return peer.send(data)
+}
+
+// connectedPeer returns the connection to the peer with peerID
+func (tm *TCPManager) connectedPeer(peerID string) (*TCPPeer, error) {
+	tm.mutex.RLock()
+	defer tm.mutex.RUnlock()
+	peer, ok := tm.connectedPeers[peerID]
+	if !ok {
+		return nil, fmt.Errorf("peer not connected: %s", peerID)
+	}
+	return peer, nil
+}
+
+// writeMessage frames data and writes it whole to the connection of peer,
+// for the writer of its send queue
+func (peer *TCPPeer) writeMessage(data []byte) error {
+	frame := packMessage(data)
+
+	defer peer.Conn.SetWriteDeadline(time.Time{})
+	for len(frame) > 0 {
+		peer.Conn.SetWriteDeadline(time.Now().Add(messageWriteTimeout))
+		n, err := peer.Conn.Write(frame[:min(len(frame), writeChunk)])
+		if err != nil {
+			return err
+		}
+		frame = frame[n:]
+	}
+	return nil
+}
+
+// dispatch hands a JSON message of msgType to its handler, dropping it if
+// there is none
+func (tm *TCPManager) dispatch(peer *TCPPeer, msgType string, message []byte) error {
+	if builtin, ok := builtinHandlers[msgType]; ok {
+		return builtin(tm, peer, message)
+	}
+
+	tm.mutex.RLock()
+	handler, ok := tm.handlers[msgType]
+	info := peer.info()
+	tm.mutex.RUnlock()
+	if !ok {
+		return nil
+	}
+	var received envelope
+	if err := json.Unmarshal(message, &received); err != nil {
+		return err
+	}
+	handler(info, received.Payload)
+	return nil
+}
@@ -0,0 +1,155 @@
+package p2p
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// Multicast discovery
+//
+// Many managed networks filter broadcasts but pass multicast to groups that
+// hosts joined. Besides the broadcasts, or instead of them, discovery
+// messages go over IPv4 to discoveryGroup4 on every interface that does
+// multicast, and the discovery service joins the group on each of them.
+// The TTL of what is sent keeps it within a few routers of the node, one
+// unless SetDiscoveryMode says otherwise. SetDiscoveryMode picks between
+// the two; IPv6, which has no broadcast, always uses its own group (see
+// discoveryGroup6).
+//
+// A node on several interfaces of one network hears a query once on each
+// of them, and once more if it also came as a broadcast, but answers it
+// once, see firstQuery.
+
+// Discovery modes, see SetDiscoveryMode
+const (
+	DiscoveryBroadcast = "broadcast"
+	DiscoveryMulticast = "multicast"
+	DiscoveryBoth      = "both"
+)
+
+// Hops multicast discovery goes unless SetDiscoveryMode says otherwise, and
+// the most it may go
+const (
+	DefaultMulticastTTL = 1
+	MaxMulticastTTL     = 4
+)
+
+// discoveryGroup4 is the group multicast discovery goes to over IPv4, in the
+// organization-local scope; the group ID spells "bs". Nodes meet there
+// whatever their TCP ports.
+var discoveryGroup4 = &net.UDPAddr{IP: net.IPv4(239, 255, 98, 115), Port: 9876}
+
+// queryMemory is how long the discovery service remembers the queries it
+// answered, so copies arriving another way aren't answered again
+const queryMemory = 5 * time.Second
+
+// SetDiscoveryMode sets whether discovery goes out as broadcasts, to the
+// multicast group or both, and how many routers multicast may cross. It
+// applies from the next Start; unless set, it is both with a TTL of
+// DefaultMulticastTTL.
+func (tm *TCPManager) SetDiscoveryMode(mode string, ttl int) error {
+	switch mode {
+	case "":
+		mode = DiscoveryBoth
+	case DiscoveryBroadcast, DiscoveryMulticast, DiscoveryBoth:
+	default:
+		return fmt.Errorf("unknown discovery mode %q", mode)
+	}
+	if ttl == 0 {
+		ttl = DefaultMulticastTTL
+	}
+	if ttl < 1 || ttl > MaxMulticastTTL {
+		return fmt.Errorf("multicast TTL must be between 1 and %d", MaxMulticastTTL)
+	}
+
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	tm.discoveryMode = mode
+	tm.multicastTTL = ttl
+	return nil
+}
+
+// discoverySettings returns the discovery mode and multicast TTL in effect
+func (tm *TCPManager) discoverySettings() (mode string, ttl int) {
+	tm.mutex.RLock()
+	defer tm.mutex.RUnlock()
+	mode, ttl = tm.discoveryMode, tm.multicastTTL
+	if mode == "" {
+		mode = DiscoveryBoth
+	}
+	if ttl == 0 {
+		ttl = DefaultMulticastTTL
+	}
+	return mode, ttl
+}
+
+// joinDiscoveryGroup has the discovery service listen to discoveryGroup4 on
+// every interface that does multicast over IPv4. The caller holds tm.mutex.
+func (tm *TCPManager) joinDiscoveryGroup() {
+	for _, ifi := range multicastInterfaces() {
+		if len(interfaceNetworks(ifi)) == 0 {
+			continue
+		}
+		ifi := ifi
+		conn, err := net.ListenMulticastUDP("udp4", &ifi, discoveryGroup4)
+		if err != nil {
+			continue
+		}
+		tm.discoveryConns = append(tm.discoveryConns, conn)
+		go tm.startDiscoveryService(conn)
+	}
+}
+
+// sendMulticast sends data to discoveryGroup4 out of every interface that
+// does multicast over IPv4, at most ttl routers far. It returns the sockets
+// it went out from and the interfaces, for logBroadcastInterfaces.
+func sendMulticast(data []byte, ttl int) (conns []*net.UDPConn, used []string, sendErr error) {
+	for _, ifi := range multicastInterfaces() {
+		networks := interfaceNetworks(ifi)
+		if len(networks) == 0 {
+			continue
+		}
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: networks[0].IP})
+		if err != nil {
+			sendErr = err
+			continue
+		}
+		if err := setMulticastOptions(conn, networks[0].IP, ttl); err != nil {
+			conn.Close()
+			sendErr = err
+			continue
+		}
+		if _, err := conn.WriteToUDP(data, discoveryGroup4); err != nil {
+			conn.Close()
+			sendErr = err
+			continue
+		}
+		conns = append(conns, conn)
+		used = append(used, fmt.Sprintf("%s (%s)", ifi.Name, discoveryGroup4.IP))
+	}
+	return conns, used, sendErr
+}
+
+// firstQuery reports whether the discovery query from nodeID with challenge
+// wasn't answered yet, and remembers it for queryMemory
+func (tm *TCPManager) firstQuery(nodeID, challenge string) bool {
+	key := nodeID + "/" + challenge
+	now := time.Now()
+
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	for query, seen := range tm.answered {
+		if now.Sub(seen) > queryMemory {
+			delete(tm.answered, query)
+		}
+	}
+	if _, ok := tm.answered[key]; ok {
+		return false
+	}
+	if tm.answered == nil {
+		tm.answered = make(map[string]time.Time)
+	}
+	tm.answered[key] = now
+	return true
+}
@@ -0,0 +1,11 @@
+//go:build !unix && !windows
+
+package p2p
+
+import "net"
+
+// setMulticastOptions is only implemented on Unix and Windows; elsewhere
+// multicast goes out of the default interface with the system's TTL
+func setMulticastOptions(conn *net.UDPConn, ip net.IP, ttl int) error {
+	return nil
+}
@@ -0,0 +1,28 @@
+package p2p
+
+import (
+	"net"
+	"syscall"
+)
+
+// setMulticastOptions sends conn's multicast out of the interface with the
+// address ip, at most ttl routers far
+func setMulticastOptions(conn *net.UDPConn, ip net.IP, ttl int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var address [4]byte
+	copy(address[:], ip.To4())
+	var optErr error
+	err = raw.Control(func(fd uintptr) {
+		optErr = syscall.SetsockoptInet4Addr(syscall.Handle(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, address)
+		if optErr == nil {
+			optErr = syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, ttl)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return optErr
+}
@@ -0,0 +1,208 @@
+package p2p
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Private networks
+//
+// Nodes on a private network only see each other. A network has a name and
+// a passphrase, and its ID is an HMAC of the name. Discovery requests and
+// answers, announcements, mDNS advertisements and HELLOs carry the ID, and
+// nodes ignore those of other networks without a word. Answers,
+// announcements and IDENTITYs also carry a proof that the sender knows the
+// passphrase: an HMAC, with a key derived from the name and passphrase,
+// over the challenge it was given and its node ID. A node with the right
+// name but the wrong passphrase fails that check, and is told so with
+// ErrNetworkAuth rather than finding nobody. mDNS can't carry a challenge,
+// so on a private network the nodes it finds are asked for their proof over
+// the TCP service. The public network, with no name, has no ID and no proof.
+
+// ErrNetworkAuth is returned when a node of this node's network doesn't
+// prove it knows the passphrase
+var ErrNetworkAuth = errors.New("authentication failed, one side has the wrong network passphrase")
+
+// ErrOtherNetwork is returned when a node is on another network
+var ErrOtherNetwork = errors.New("the node is on another network")
+
+// network is the mesh network a node is on
+type network struct {
+	name string
+	id   string // Empty for the public network
+	key  []byte
+}
+
+// NetworkID returns the ID of the network called name, "" for the public one
+func NetworkID(name string) string {
+	if name == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte("bitshare-network-id"))
+	mac.Write([]byte(name))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+func newNetwork(name, passphrase string) network {
+	if name == "" {
+		return network{}
+	}
+	mac := hmac.New(sha256.New, []byte(passphrase))
+	mac.Write([]byte("bitshare-network\x00" + name))
+	return network{name: name, id: NetworkID(name), key: mac.Sum(nil)}
+}
+
+// SetNetwork puts the node on the private network name, or on the public
+// network when name is empty
+func (tm *TCPManager) SetNetwork(name, passphrase string) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	tm.network = newNetwork(name, passphrase)
+}
+
+// currentNetwork returns what SetNetwork set
+func (tm *TCPManager) currentNetwork() network {
+	tm.mutex.RLock()
+	defer tm.mutex.RUnlock()
+	return tm.network
+}
+
+// proof shows that nodeID knows the network's passphrase, nil on the
+// public network
+func (n network) proof(challenge, nodeID string) []byte {
+	if n.id == "" {
+		return nil
+	}
+	mac := hmac.New(sha256.New, n.key)
+	mac.Write([]byte("bitshare-network-proof\x00" + challenge + "\x00" + nodeID))
+	return mac.Sum(nil)
+}
+
+// check returns ErrOtherNetwork when id isn't the network's, and
+// ErrNetworkAuth when proof isn't nodeID's for challenge
+func (n network) check(id string, proof []byte, challenge, nodeID string) error {
+	if id != n.id {
+		return ErrOtherNetwork
+	}
+	if n.id != "" && !hmac.Equal(proof, n.proof(challenge, nodeID)) {
+		return ErrNetworkAuth
+	}
+	return nil
+}
+
+// authFailures collects the nodes that failed to prove they know the
+// passphrase during a discovery
+type authFailures struct {
+	sync.Mutex
+	nodes map[string]bool
+}
+
+func (f *authFailures) add(nodeID string) {
+	f.Lock()
+	defer f.Unlock()
+	if f.nodes == nil {
+		f.nodes = make(map[string]bool)
+	}
+	f.nodes[nodeID] = true
+}
+
+func (f *authFailures) count() int {
+	f.Lock()
+	defer f.Unlock()
+	return len(f.nodes)
+}
+
+// networkAuthWarnEvery is how often the same node's failed authentication
+// is reported, as it fails again every discovery round
+const networkAuthWarnEvery = 10 * time.Minute
+
+var authWarnings = struct {
+	sync.Mutex
+	last map[string]time.Time
+}{last: make(map[string]time.Time)}
+
+// warnNetworkAuth tells the user a node of this network failed to prove it
+// knows the passphrase, which is either side's passphrase being wrong
+func (n network) warnNetworkAuth(address, nodeName string) {
+	authWarnings.Lock()
+	key := n.id + " " + address
+	if time.Since(authWarnings.last[key]) < networkAuthWarnEvery {
+		authWarnings.Unlock()
+		return
+	}
+	authWarnings.last[key] = time.Now()
+	authWarnings.Unlock()
+
+	fmt.Printf("🔒 Authentication failed with %s at %s on network '%s': one of you has the wrong passphrase\n",
+		nodeName, address, n.name)
+}
+
+// verifyMDNSPeers returns the peers mDNS found that prove they know network
+// n's passphrase, asking them all at once, with the names they didn't
+// advertise, until ctx is done
+func (tm *TCPManager) verifyMDNSPeers(ctx context.Context, peers []PeerInfo, n network, failed *authFailures) []PeerInfo {
+	var wg sync.WaitGroup
+	verified := make([]bool, len(peers))
+	for i := range peers {
+		wg.Add(1)
+		go func(peer *PeerInfo, verified *bool) {
+			defer wg.Done()
+			identity, err := tm.verifyNetwork(ctx, *peer, n)
+			if errors.Is(err, ErrNetworkAuth) {
+				failed.add(peer.ID)
+				n.warnNetworkAuth(peer.Address, peer.ID)
+			}
+			if err == nil {
+				peer.Name, peer.PublicKey = identity.Name, identity.PublicKey
+				*verified = true
+			}
+		}(&peers[i], &verified[i])
+	}
+	wg.Wait()
+
+	var results []PeerInfo
+	for i, peer := range peers {
+		if verified[i] {
+			results = append(results, peer)
+		}
+	}
+	return results
+}
+
+// verifyNetwork asks a peer mDNS found for its proof over the TCP service,
+// until ctx, which has a deadline, is done
+func (tm *TCPManager) verifyNetwork(ctx context.Context, peer PeerInfo, n network) (Identity, error) {
+	port := peer.Port
+	if port == 0 {
+		port = DefaultTCPPort
+	}
+	deadline, _ := ctx.Deadline()
+	conn, err := tm.Secure(func() (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "tcp", net.JoinHostPort(peer.Address, strconv.Itoa(port)))
+	}, time.Until(deadline))
+	if err != nil {
+		return Identity{}, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+	identity, err := authenticate(conn, n, time.Until(deadline))
+	if err != nil {
+		return Identity{}, err
+	}
+	if identity.NodeID != peer.ID {
+		return Identity{}, fmt.Errorf("%s answered as %s", peer.ID, identity.NodeID)
+	}
+	return identity, nil
+}
@@ -0,0 +1,46 @@
+package p2p
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Peer exchange
+//
+// Connected nodes share part of their peer tables so that nodes far apart
+// in the mesh learn of each other. What is done with the records, and which
+// are shared, is up to the handler and the caller, see mesh/gossip.go.
+
+// PeerRecord is what a peer exchange says about one peer
+type PeerRecord struct {
+	ID        string   `json:"id"`
+	Name      string   `json:"name,omitempty"`
+	Addresses []string `json:"addresses,omitempty"` // Most recent first
+	Age       int      `json:"age"`                 // Seconds since the peer was last seen
+	Origin    string   `json:"origin"`              // Node that saw the peer itself
+}
+
+// peerExchangeMessage carries the records a node shares
+type peerExchangeMessage struct {
+	Type   string       `json:"type"` // "PEER_EXCHANGE"
+	NodeID string       `json:"node_id"`
+	Peers  []PeerRecord `json:"peers"`
+}
+
+// OnPeerExchange sets what is given the peer records connected peers share,
+// with the node ID of the peer that sent them
+func (tm *TCPManager) OnPeerExchange(handler func(from string, peers []PeerRecord)) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	tm.onPeerExchange = handler
+}
+
+// SharePeers sends peer records to every connected peer. Peers that don't
+// take them within timeout are skipped.
+func (tm *TCPManager) SharePeers(nodeID string, peers []PeerRecord, timeout time.Duration) {
+	data, err := json.Marshal(peerExchangeMessage{Type: "PEER_EXCHANGE", NodeID: nodeID, Peers: peers})
+	if err != nil {
+		return
+	}
+	tm.sendToConnected(data, timeout)
+}
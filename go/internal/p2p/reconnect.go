@@ -0,0 +1,132 @@
+package p2p
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"time"
+
+	"fileshare/internal/access"
+)
+
+// Reconnecting
+//
+// A connection Connect opened that drops, because of a moment without WiFi
+// say, or one it failed to open, is tried again in the background: after a
+// second, then twice as long each time up to MaxReconnectDelay, each wait
+// shortened by a random part of up to half so peers that lost each other
+// at once don't retry in step. It is given up after as many attempts as
+// SetReconnect allows, when the peer is blocked, and when the check set
+// with SetReconnectCheck says the peer isn't worth it any more, as when it
+// went offline. Once connected again the handshake names the peer as
+// always, and the OnReconnect handler is told.
+//
+// Connections other nodes opened are theirs to open again, and ones whose
+// handshake failed aren't tried again.
+
+// Reconnect settings unless SetReconnect says otherwise
+const (
+	DefaultReconnectAttempts = 10
+	MaxReconnectDelay        = 30 * time.Second
+	firstReconnectDelay      = time.Second
+)
+
+// SetReconnect sets how many times a connection is tried again, see above.
+// Zero means DefaultReconnectAttempts and a negative number never.
+func (tm *TCPManager) SetReconnect(attempts int) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	tm.reconnectAttempts = attempts
+}
+
+// SetReconnectCheck sets what is asked before each attempt whether the peer,
+// with its node ID if known and its host, is still worth connecting to
+func (tm *TCPManager) SetReconnectCheck(check func(peerID, host string) bool) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	tm.reconnectCheck = check
+}
+
+// OnReconnect sets the handler told about peers connected to again
+func (tm *TCPManager) OnReconnect(handler func(peerID, address string)) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	tm.onReconnect = handler
+}
+
+// reconnectDelay is how long to wait before attempt, counting from 1
+func reconnectDelay(attempt int) time.Duration {
+	delay := MaxReconnectDelay
+	if attempt <= 5 {
+		delay = min(firstReconnectDelay<<(attempt-1), MaxReconnectDelay)
+	}
+	return delay - time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// reconnect tries connecting to the TCP service at host and port again, see
+// above, unless it already is being tried; peerID is empty when the peer
+// never answered
+func (tm *TCPManager) reconnect(peerID, host string, port int) {
+	address := net.JoinHostPort(host, strconv.Itoa(port))
+	tm.mutex.Lock()
+	attempts, stopped := tm.reconnectAttempts, tm.stopped
+	if attempts == 0 {
+		attempts = DefaultReconnectAttempts
+	}
+	if !tm.isRunning || attempts < 0 || tm.reconnecting[address] {
+		tm.mutex.Unlock()
+		return
+	}
+	if tm.reconnecting == nil {
+		tm.reconnecting = make(map[string]bool)
+	}
+	tm.reconnecting[address] = true
+	tm.mutex.Unlock()
+
+	go func() {
+		defer func() {
+			tm.mutex.Lock()
+			delete(tm.reconnecting, address)
+			tm.mutex.Unlock()
+		}()
+
+		for attempt := 1; attempt <= attempts; attempt++ {
+			timer := time.NewTimer(reconnectDelay(attempt))
+			select {
+			case <-stopped:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			if !tm.keepReconnecting(peerID, host) || tm.dialedConn(address) != nil {
+				return
+			}
+
+			if err := tm.dial(host, port); err != nil {
+				continue
+			}
+			fmt.Printf("🔄 Connected to %s again after %d attempt(s)\n", address, attempt)
+			tm.mutex.RLock()
+			handler := tm.onReconnect
+			tm.mutex.RUnlock()
+			if handler != nil {
+				handler(peerID, host)
+			}
+			return
+		}
+		fmt.Printf("Gave up connecting to %s again after %d attempts\n", address, attempts)
+	}()
+}
+
+// keepReconnecting reports whether the peer with peerID at host is still
+// worth connecting to, see above
+func (tm *TCPManager) keepReconnecting(peerID, host string) bool {
+	tm.mutex.RLock()
+	running, check := tm.isRunning, tm.reconnectCheck
+	tm.mutex.RUnlock()
+	if !running || access.IsBlocked(peerID, host) {
+		return false
+	}
+	return check == nil || check(peerID, host)
+}
@@ -0,0 +1,564 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Routed streams
+//
+// A node reaches a peer it has no connection to through the nodes between
+// them. It opens a stream by sending a MESH_ROUTE open frame, naming the
+// destination node, to the first node on the way. Every node the frame comes
+// to looks up its own next hop for the destination, passes the frame on and
+// remembers which two connections the stream runs over, so the frames after
+// it go both ways without looking up routes again. The destination answers
+// with an opened frame and from then on both ends send data frames until one
+// closes the stream.
+//
+// A stream crosses at most MaxRouteHops links. A node that can't pass an
+// open frame on, or loses a connection a stream runs over, sends an error
+// frame with its node ID back toward the end of the stream, so the sender
+// learns which hop failed and why.
+
+// MaxRouteHops bounds how many links a routed stream may cross
+const MaxRouteHops = 8
+
+// Kinds of routeFrame
+const (
+	routeOpen   = "open"   // Open a stream to Destination
+	routeOpened = "opened" // The destination took the stream
+	routeData   = "data"   // Bytes on the stream
+	routeClose  = "close"  // One end closed the stream
+	routeError  = "error"  // The stream failed at Node
+	routeSend   = "send"   // A message for Destination, see routed.go
+)
+
+const (
+	// routeOpenTimeout bounds how long opening a stream may take
+	routeOpenTimeout = 15 * time.Second
+
+	// maxRouteFrameData bounds how many bytes of a stream go in one frame
+	maxRouteFrameData = 32 * 1024
+)
+
+// ErrNoRouting is returned when streams are opened before SetRouting
+var ErrNoRouting = errors.New("routing is not set up")
+
+// RouteError is why a routed stream failed, as reported by the node it failed at
+type RouteError struct {
+	Node   string // Node ID of the node that reported it
+	Reason string
+}
+
+func (e *RouteError) Error() string {
+	return fmt.Sprintf("node %s: %s", e.Node, e.Reason)
+}
+
+// routeFrame is a MESH_ROUTE message, carrying part of a routed stream
+type routeFrame struct {
+	Type        string `json:"type"` // "MESH_ROUTE"
+	Kind        string `json:"kind"`
+	Stream      string `json:"stream"`
+	Source      string `json:"source,omitempty"`      // For open
+	Destination string `json:"destination,omitempty"` // For open
+	Port        int    `json:"port,omitempty"`        // For open, the local port the destination connects the stream to
+	Hops        int    `json:"hops,omitempty"`        // For open, the links it crossed
+	Data        []byte `json:"data,omitempty"`        // For data
+	Node        string `json:"node,omitempty"`        // For error
+	Error       string `json:"error,omitempty"`       // For error
+
+	MessageType string          `json:"message_type,omitempty"` // For send
+	Payload     json.RawMessage `json:"payload,omitempty"`      // For send
+	TTL         int             `json:"ttl,omitempty"`          // For send, how many more links it may cross
+}
+
+// routedStream is where the frames of a stream go on this node
+type routedStream struct {
+	back    net.Conn   // Toward the node that opened the stream, nil on that node
+	forward net.Conn   // Toward the destination, nil on the destination
+	local   *routeConn // The end of the stream on this node, nil on the nodes between
+}
+
+// SetRouting sets what gives the address of the TCP service of the next
+// node on the way to a destination. Streams to this node are addressed to
+// the node ID SetIdentity sets.
+func (tm *TCPManager) SetRouting(nextHop func(destination string) (string, error)) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	tm.nextHop = nextHop
+}
+
+// OnRoutedConnection sets what takes the streams other nodes open to this
+// one, with the local port they asked for. An error refuses the stream and
+// is passed back to the node that opened it.
+func (tm *TCPManager) OnRoutedConnection(handler func(conn net.Conn, port int) error) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	tm.onRouted = handler
+}
+
+// DialRoute opens a stream to port on the node destination, through the
+// nodes on the way to it
+func (tm *TCPManager) DialRoute(ctx context.Context, destination string, port int) (net.Conn, error) {
+	tm.mutex.RLock()
+	self, nextHop := tm.nodeID, tm.nextHop
+	tm.mutex.RUnlock()
+	if nextHop == nil {
+		return nil, ErrNoRouting
+	}
+
+	address, err := nextHop(destination)
+	if err != nil {
+		return nil, &RouteError{Node: self, Reason: err.Error()}
+	}
+	via, err := tm.connectTo(address)
+	if err != nil {
+		return nil, &RouteError{Node: self, Reason: err.Error()}
+	}
+
+	stream, err := newStreamID()
+	if err != nil {
+		return nil, err
+	}
+	conn := newRouteConn(tm, stream, via, self, destination)
+	conn.opened = make(chan error, 1)
+	tm.addStream(stream, &routedStream{forward: via, local: conn})
+
+	open := routeFrame{Kind: routeOpen, Stream: stream, Source: self, Destination: destination, Port: port, Hops: 1}
+	if err := tm.sendFrame(via, open); err != nil {
+		tm.removeStream(stream)
+		return nil, &RouteError{Node: self, Reason: err.Error()}
+	}
+
+	ctx, cancel := context.WithTimeout(contextOrBackground(ctx), routeOpenTimeout)
+	defer cancel()
+	select {
+	case err := <-conn.opened:
+		if err != nil {
+			tm.removeStream(stream)
+			return nil, err
+		}
+		return conn, nil
+	case <-ctx.Done():
+		// Closing lets the nodes on the way forget the stream
+		conn.Close()
+		return nil, fmt.Errorf("no answer from %s: %w", destination, ctx.Err())
+	}
+}
+
+// handleRouteFrame takes a MESH_ROUTE frame that came in on from
+func (tm *TCPManager) handleRouteFrame(from net.Conn, frame routeFrame) {
+	switch {
+	case frame.Kind == routeOpen:
+		// Passing it on may take a new connection
+		go tm.openStream(from, frame)
+		return
+	case frame.Kind == routeSend:
+		go tm.passMessage(from, frame)
+		return
+	case frame.Kind == routeError && tm.messageFailed(frame):
+		return
+	}
+
+	tm.mutex.RLock()
+	stream := tm.streams[frame.Stream]
+	tm.mutex.RUnlock()
+	if stream == nil || (from != stream.back && from != stream.forward) {
+		return
+	}
+
+	ending := frame.Kind == routeClose || frame.Kind == routeError
+	if ending {
+		tm.removeStream(frame.Stream)
+	}
+	if stream.local != nil {
+		stream.local.receive(frame)
+		return
+	}
+
+	to := stream.forward
+	if from == stream.forward {
+		to = stream.back
+	}
+	if err := tm.sendFrame(to, frame); err != nil && !ending {
+		tm.removeStream(frame.Stream)
+		tm.failStream(from, frame.Stream, fmt.Sprintf("could not pass the stream on: %v", err))
+	}
+}
+
+// openStream takes a request for a stream, or passes it on toward its destination
+func (tm *TCPManager) openStream(from net.Conn, frame routeFrame) {
+	tm.mutex.RLock()
+	self, nextHop, handler := tm.nodeID, tm.nextHop, tm.onRouted
+	_, exists := tm.streams[frame.Stream]
+	tm.mutex.RUnlock()
+	if frame.Stream == "" {
+		return
+	}
+	if exists {
+		// The stream came back around to a node it already runs through
+		tm.failStream(from, frame.Stream, fmt.Sprintf("routes to %s run in a loop", frame.Destination))
+		return
+	}
+
+	if frame.Destination == self {
+		if handler == nil {
+			tm.failStream(from, frame.Stream, "not taking routed connections")
+			return
+		}
+		conn := newRouteConn(tm, frame.Stream, from, self, frame.Source)
+		tm.addStream(frame.Stream, &routedStream{back: from, local: conn})
+		if err := handler(conn, frame.Port); err != nil {
+			tm.removeStream(frame.Stream)
+			tm.failStream(from, frame.Stream, err.Error())
+			return
+		}
+		tm.sendFrame(from, routeFrame{Kind: routeOpened, Stream: frame.Stream})
+		return
+	}
+
+	if nextHop == nil {
+		tm.failStream(from, frame.Stream, "not routing")
+		return
+	}
+	if frame.Hops >= MaxRouteHops {
+		tm.failStream(from, frame.Stream, fmt.Sprintf("%s is more than %d hops away", frame.Destination, MaxRouteHops))
+		return
+	}
+	address, err := nextHop(frame.Destination)
+	if err != nil {
+		tm.failStream(from, frame.Stream, err.Error())
+		return
+	}
+	via, err := tm.connectTo(address)
+	if err != nil {
+		tm.failStream(from, frame.Stream, err.Error())
+		return
+	}
+
+	tm.addStream(frame.Stream, &routedStream{back: from, forward: via})
+	frame.Hops++
+	if err := tm.sendFrame(via, frame); err != nil {
+		tm.removeStream(frame.Stream)
+		tm.failStream(from, frame.Stream, fmt.Sprintf("could not reach the next hop: %v", err))
+	}
+}
+
+// failStream tells the node at the other end of conn that a stream failed here
+func (tm *TCPManager) failStream(conn net.Conn, stream, reason string) {
+	tm.mutex.RLock()
+	self := tm.nodeID
+	tm.mutex.RUnlock()
+	tm.sendFrame(conn, routeFrame{Kind: routeError, Stream: stream, Node: self, Error: reason})
+}
+
+// dropStreams fails the streams that ran over a connection that was lost
+func (tm *TCPManager) dropStreams(conn net.Conn) {
+	const reason = "lost the connection to the next node"
+
+	tm.mutex.Lock()
+	self := tm.nodeID
+	var dropped []*routedStream
+	var ids []string
+	for id, stream := range tm.streams {
+		if stream.back == conn || stream.forward == conn {
+			delete(tm.streams, id)
+			dropped = append(dropped, stream)
+			ids = append(ids, id)
+		}
+	}
+	tm.mutex.Unlock()
+
+	for i, stream := range dropped {
+		if stream.local != nil {
+			stream.local.receive(routeFrame{Kind: routeError, Node: self, Error: reason})
+			continue
+		}
+		other := stream.back
+		if other == conn {
+			other = stream.forward
+		}
+		go tm.failStream(other, ids[i], reason)
+	}
+}
+
+func (tm *TCPManager) addStream(id string, stream *routedStream) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	if tm.streams == nil {
+		tm.streams = make(map[string]*routedStream)
+	}
+	tm.streams[id] = stream
+}
+
+func (tm *TCPManager) removeStream(id string) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	delete(tm.streams, id)
+}
+
+// connectTo returns the connection to the TCP service at address, opening
+// one if there is none yet
+func (tm *TCPManager) connectTo(address string) (net.Conn, error) {
+	host, portText, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portText)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in %s", address)
+	}
+
+	if conn := tm.dialedConn(net.JoinHostPort(host, strconv.Itoa(port))); conn != nil {
+		return conn, nil
+	}
+	if err := tm.Connect(host, port); err != nil {
+		return nil, err
+	}
+	if conn := tm.dialedConn(net.JoinHostPort(host, strconv.Itoa(port))); conn != nil {
+		return conn, nil
+	}
+	return nil, fmt.Errorf("connection to %s closed", address)
+}
+
+// dialedConn returns the connection Connect opened to address, if it is
+// still open
+func (tm *TCPManager) dialedConn(address string) net.Conn {
+	tm.mutex.RLock()
+	defer tm.mutex.RUnlock()
+	for _, peer := range tm.connectedPeers {
+		if peer.dialed == address {
+			return peer.Conn
+		}
+	}
+	return nil
+}
+
+// sendFrame sends a MESH_ROUTE frame over conn, through the send queue of
+// its peer while it is connected
+func (tm *TCPManager) sendFrame(conn net.Conn, frame routeFrame) error {
+	frame.Type = "MESH_ROUTE"
+	data, err := json.Marshal(frame)
+	if err != nil {
+		return err
+	}
+	if peer := tm.peerForConn(conn); peer != nil {
+		return peer.send(data)
+	}
+	_, err = conn.Write(packMessage(data))
+	return err
+}
+
+// peerForConn returns the connected peer whose connection conn is
+func (tm *TCPManager) peerForConn(conn net.Conn) *TCPPeer {
+	tm.mutex.RLock()
+	defer tm.mutex.RUnlock()
+	for _, peer := range tm.connectedPeers {
+		if peer.Conn == conn {
+			return peer
+		}
+	}
+	return nil
+}
+
+func newStreamID() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+func contextOrBackground(ctx context.Context) context.Context {
+	if ctx == nil {
+		return context.Background()
+	}
+	return ctx
+}
+
+// routeConn is the end of a routed stream on this node. Reads wait for data
+// frames; writes go out at the pace of the connection to the next node, so
+// write deadlines have no effect.
+type routeConn struct {
+	tm     *TCPManager
+	stream string
+	via    net.Conn // Toward the other end
+	local  routeAddr
+	remote routeAddr
+	opened chan error // The answer to opening the stream, on the node that opened it
+
+	mutex    sync.Mutex
+	readable *sync.Cond
+	buffer   bytes.Buffer
+	err      error // Why nothing more will come in once buffer is read
+	closed   bool
+	deadline time.Time
+	timer    *time.Timer
+}
+
+func newRouteConn(tm *TCPManager, stream string, via net.Conn, local, remote string) *routeConn {
+	c := &routeConn{tm: tm, stream: stream, via: via, local: routeAddr(local), remote: routeAddr(remote)}
+	c.readable = sync.NewCond(&c.mutex)
+	return c
+}
+
+// receive takes a frame of the stream from the other end
+func (c *routeConn) receive(frame routeFrame) {
+	var err error
+	switch frame.Kind {
+	case routeOpened:
+		c.answer(nil)
+		return
+	case routeData:
+		c.mutex.Lock()
+		if !c.closed {
+			c.buffer.Write(frame.Data)
+		}
+		c.readable.Broadcast()
+		c.mutex.Unlock()
+		return
+	case routeClose:
+		err = io.EOF
+	case routeError:
+		err = &RouteError{Node: frame.Node, Reason: frame.Error}
+		c.answer(err)
+	default:
+		return
+	}
+
+	c.mutex.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.readable.Broadcast()
+	c.mutex.Unlock()
+}
+
+// answer passes on the answer to opening the stream, if anyone waits for one
+func (c *routeConn) answer(err error) {
+	select {
+	case c.opened <- err:
+	default:
+	}
+}
+
+func (c *routeConn) Read(p []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for c.buffer.Len() == 0 {
+		switch {
+		case c.closed:
+			return 0, net.ErrClosed
+		case c.err != nil:
+			return 0, c.err
+		case !c.deadline.IsZero() && !time.Now().Before(c.deadline):
+			return 0, os.ErrDeadlineExceeded
+		}
+		c.readable.Wait()
+	}
+	return c.buffer.Read(p)
+}
+
+func (c *routeConn) Write(p []byte) (int, error) {
+	c.mutex.Lock()
+	closed, err := c.closed, c.err
+	c.mutex.Unlock()
+	switch {
+	case closed:
+		return 0, net.ErrClosed
+	case err == io.EOF:
+		return 0, io.ErrClosedPipe
+	case err != nil:
+		return 0, err
+	}
+
+	written := 0
+	for written < len(p) {
+		n := min(len(p)-written, maxRouteFrameData)
+		if err := c.tm.sendFrame(c.via, routeFrame{Kind: routeData, Stream: c.stream, Data: p[written : written+n]}); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// Close ends the stream at both ends
+func (c *routeConn) Close() error {
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return nil
+	}
+	c.closed = true
+	ended := c.err != nil
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	c.readable.Broadcast()
+	c.mutex.Unlock()
+
+	c.tm.removeStream(c.stream)
+	if ended {
+		return nil
+	}
+	return c.tm.sendFrame(c.via, routeFrame{Kind: routeClose, Stream: c.stream})
+}
+
+func (c *routeConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *routeConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *routeConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *routeConn) SetReadDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.deadline = t
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if !t.IsZero() {
+		c.timer = time.AfterFunc(time.Until(t), func() {
+			c.mutex.Lock()
+			c.readable.Broadcast()
+			c.mutex.Unlock()
+		})
+	}
+	c.readable.Broadcast()
+	return nil
+}
+
+func (c *routeConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// routeAddr is a node reached through a routed stream, by node ID
+type routeAddr string
+
+func (a routeAddr) Network() string {
+	return "mesh"
+}
+
+func (a routeAddr) String() string {
+	return string(a)
+}
@@ -0,0 +1,205 @@
+package p2p
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"fileshare/internal/access"
+)
+
+// testNode is a TCP service on loopback, with routes set by the test
+type testNode struct {
+	*TCPManager
+	id      string
+	address string // Of its TCP service
+
+	routesMutex sync.Mutex
+	routes      map[string]string // Next hop address by destination
+}
+
+// freePort returns a TCP port on loopback that nothing listens on
+func freePort(t *testing.T) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// startTestNode starts a TCP service on loopback, with a key of its own
+func startTestNode(t *testing.T, name string) *testNode {
+	t.Helper()
+	public, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := freePort(t)
+	tm := &TCPManager{
+		connectedPeers: make(map[string]*TCPPeer),
+		streams:        make(map[string]*routedStream),
+		discoveryAddr:  broadcastAddr(port),
+		listenPort:     port,
+		limiter:        access.NewLimiter(DefaultMaxTCPConnections, DefaultMaxTCPConnectionsPerIP),
+		mdnsDisabled:   true,
+	}
+	tm.SetKey(key)
+	tm.SetIdentity(NodeIDForKey(public), name)
+	tm.SetReconnect(-1)
+	node := &testNode{
+		TCPManager: tm,
+		id:         NodeIDForKey(public),
+		address:    net.JoinHostPort("127.0.0.1", strconv.Itoa(port)),
+		routes:     make(map[string]string),
+	}
+	tm.SetRouting(node.nextHop)
+	if err := tm.Start(port); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tm.Stop() })
+	return node
+}
+
+// route sends what node has for destination to the node via
+func (n *testNode) route(destination, via *testNode) {
+	n.routesMutex.Lock()
+	defer n.routesMutex.Unlock()
+	n.routes[destination.id] = via.address
+}
+
+func (n *testNode) nextHop(destination string) (string, error) {
+	n.routesMutex.Lock()
+	defer n.routesMutex.Unlock()
+	address, ok := n.routes[destination]
+	if !ok {
+		return "", fmt.Errorf("no route to %s", destination)
+	}
+	return address, nil
+}
+
+// startLine starts three nodes where a reaches c only through b
+func startLine(t *testing.T) (a, b, c *testNode) {
+	t.Helper()
+	a, b, c = startTestNode(t, "a"), startTestNode(t, "b"), startTestNode(t, "c")
+	a.route(c, b)
+	b.route(c, c)
+	c.route(a, b)
+	b.route(a, a)
+	return a, b, c
+}
+
+// streamCount returns how many routed streams run through the node
+func (n *testNode) streamCount() int {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	return len(n.streams)
+}
+
+func TestDialRoute(t *testing.T) {
+	a, b, c := startLine(t)
+
+	// c echoes what comes on streams to port 7
+	ports := make(chan int, 1)
+	c.OnRoutedConnection(func(conn net.Conn, port int) error {
+		ports <- port
+		go func() {
+			defer conn.Close()
+			io.Copy(conn, conn)
+		}()
+		return nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := a.DialRoute(ctx, c.id, 7)
+	if err != nil {
+		t.Fatalf("DialRoute: %v", err)
+	}
+	defer conn.Close()
+	if port := <-ports; port != 7 {
+		t.Errorf("c got a stream to port %d, want 7", port)
+	}
+	if b.streamCount() != 1 {
+		t.Errorf("b forwards %d streams, want 1", b.streamCount())
+	}
+
+	// More than a frame's worth goes through b both ways
+	sent := make([]byte, 3*maxRouteFrameData+17)
+	rand.Read(sent)
+	go conn.Write(sent)
+	got := make([]byte, len(sent))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("reading the echo: %v", err)
+	}
+	if string(got) != string(sent) {
+		t.Error("echo through b differs from what was sent")
+	}
+
+	// Closing lets b forget the stream
+	conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for b.streamCount() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if b.streamCount() != 0 {
+		t.Errorf("b still forwards %d streams after the close", b.streamCount())
+	}
+}
+
+func TestDialRouteErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		setup  func(a, b, c *testNode)
+		failAt func(a, b, c *testNode) string // Node ID the error is reported by
+	}{
+		{
+			name:   "no route at the middle node",
+			setup:  func(a, b, c *testNode) { b.routesMutex.Lock(); delete(b.routes, c.id); b.routesMutex.Unlock() },
+			failAt: func(a, b, c *testNode) string { return b.id },
+		},
+		{
+			name: "destination refuses the stream",
+			setup: func(a, b, c *testNode) {
+				c.OnRoutedConnection(func(net.Conn, int) error { return errors.New("port closed") })
+			},
+			failAt: func(a, b, c *testNode) string { return c.id },
+		},
+		{
+			name:   "destination takes no streams",
+			setup:  func(a, b, c *testNode) {},
+			failAt: func(a, b, c *testNode) string { return c.id },
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, b, c := startLine(t)
+			test.setup(a, b, c)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			conn, err := a.DialRoute(ctx, c.id, 7)
+			if err == nil {
+				conn.Close()
+				t.Fatal("DialRoute succeeded")
+			}
+			var routeErr *RouteError
+			if !errors.As(err, &routeErr) {
+				t.Fatalf("got %v, want a RouteError", err)
+			}
+			if want := test.failAt(a, b, c); routeErr.Node != want {
+				t.Errorf("failed at %s (%v), want %s", routeErr.Node, err, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package p2p
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Routed messages
+//
+// SendRouted sends a message to a node there may be no connection to, in a
+// MESH_ROUTE send frame naming its destination, which each node on the way
+// passes to its own next hop there, as with the open frame of a routed
+// stream (see route.go). The destination hands the payload to the handler
+// registered for the message type, as if the source had sent it with
+// SendMessage. A message crosses at most MaxRouteHops links: every node
+// that passes it on takes one off its TTL.
+//
+// Nodes remember the messages they passed on for a while, by ID, so one that
+// comes back around is dropped instead of circling until its TTL runs out.
+// A node that drops a message, for a loop, a TTL run out, no route or no
+// handler, sends an error frame back the way it came, which the source logs.
+
+// routedMemory is how long nodes remember the messages they passed on
+const routedMemory = time.Minute
+
+// routedMessage is what a node remembers of a message it sent or passed on
+type routedMessage struct {
+	back        net.Conn // Toward the source, nil on the source
+	msgType     string
+	destination string
+	at          time.Time
+}
+
+// SendRouted sends payload, as JSON, as a message of msgType to the node
+// destination, through the nodes on the way to it, for the handler the node
+// registered for msgType. That the message was sent doesn't mean it arrived;
+// nodes that drop it report why in the log of this one, see above.
+func (tm *TCPManager) SendRouted(destination, msgType string, payload any) error {
+	if err := reservedType(msgType); err != nil {
+		return err
+	}
+	frame := routeFrame{Kind: routeSend, Destination: destination, MessageType: msgType, TTL: MaxRouteHops}
+	if payload != nil {
+		var err error
+		if frame.Payload, err = json.Marshal(payload); err != nil {
+			return fmt.Errorf("failed to encode %s message: %w", msgType, err)
+		}
+	}
+
+	tm.mutex.RLock()
+	self, nextHop, handler := tm.nodeID, tm.nextHop, tm.handlers[msgType]
+	tm.mutex.RUnlock()
+	frame.Source = self
+	if destination == self {
+		if handler == nil {
+			return fmt.Errorf("not taking %s messages", msgType)
+		}
+		handler(ConnectedPeer{ID: self}, frame.Payload)
+		return nil
+	}
+	if nextHop == nil {
+		return ErrNoRouting
+	}
+
+	address, err := nextHop(destination)
+	if err != nil {
+		return &RouteError{Node: self, Reason: err.Error()}
+	}
+	via, err := tm.connectTo(address)
+	if err != nil {
+		return &RouteError{Node: self, Reason: err.Error()}
+	}
+	if frame.Stream, err = newStreamID(); err != nil {
+		return err
+	}
+	tm.rememberMessage(frame.Stream, &routedMessage{msgType: msgType, destination: destination})
+	if err := tm.sendFrame(via, frame); err != nil {
+		return &RouteError{Node: self, Reason: err.Error()}
+	}
+	return nil
+}
+
+// passMessage takes a message for this node, or passes it on toward its
+// destination
+func (tm *TCPManager) passMessage(from net.Conn, frame routeFrame) {
+	tm.mutex.RLock()
+	self, nextHop, handler := tm.nodeID, tm.nextHop, tm.handlers[frame.MessageType]
+	tm.mutex.RUnlock()
+	if frame.Stream == "" {
+		return
+	}
+	if !tm.rememberMessage(frame.Stream, &routedMessage{back: from, msgType: frame.MessageType, destination: frame.Destination}) {
+		// The message came back around to a node it already went through
+		tm.failStream(from, frame.Stream, fmt.Sprintf("routes to %s run in a loop", frame.Destination))
+		return
+	}
+
+	if frame.Destination == self {
+		if handler == nil || reservedType(frame.MessageType) != nil {
+			tm.failStream(from, frame.Stream, fmt.Sprintf("not taking %s messages", frame.MessageType))
+			return
+		}
+		handler(ConnectedPeer{ID: frame.Source}, frame.Payload)
+		return
+	}
+
+	if nextHop == nil {
+		tm.failStream(from, frame.Stream, "not routing")
+		return
+	}
+	if frame.TTL <= 1 {
+		tm.failStream(from, frame.Stream, fmt.Sprintf("%s is more than %d hops away", frame.Destination, MaxRouteHops))
+		return
+	}
+	address, err := nextHop(frame.Destination)
+	if err != nil {
+		tm.failStream(from, frame.Stream, err.Error())
+		return
+	}
+	via, err := tm.connectTo(address)
+	if err != nil {
+		tm.failStream(from, frame.Stream, err.Error())
+		return
+	}
+	frame.TTL--
+	if err := tm.sendFrame(via, frame); err != nil {
+		tm.failStream(from, frame.Stream, fmt.Sprintf("could not reach the next hop: %v", err))
+	}
+}
+
+// messageFailed passes an error frame about a message this node sent or
+// passed on back toward its source, or logs it on the source. It reports
+// false for error frames about anything else, such as streams.
+func (tm *TCPManager) messageFailed(frame routeFrame) bool {
+	tm.mutex.Lock()
+	message := tm.routed[frame.Stream]
+	delete(tm.routed, frame.Stream)
+	tm.mutex.Unlock()
+	if message == nil {
+		return false
+	}
+
+	if message.back != nil {
+		tm.sendFrame(message.back, frame)
+		return true
+	}
+	fmt.Printf("[TCP] %s message to %s was dropped at %s: %s\n", message.msgType, message.destination, frame.Node, frame.Error)
+	return true
+}
+
+// rememberMessage remembers the message with id for routedMemory, unless it
+// already is remembered, forgetting older ones; it reports whether it was new
+func (tm *TCPManager) rememberMessage(id string, message *routedMessage) bool {
+	now := time.Now()
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	for known, m := range tm.routed {
+		if now.Sub(m.at) > routedMemory {
+			delete(tm.routed, known)
+		}
+	}
+	if _, seen := tm.routed[id]; seen {
+		return false
+	}
+	if tm.routed == nil {
+		tm.routed = make(map[string]*routedMessage)
+	}
+	message.at = now
+	tm.routed[id] = message
+	return true
+}
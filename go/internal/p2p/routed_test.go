@@ -0,0 +1,117 @@
+package p2p
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// routedCount returns how many routed messages the node remembers
+func (n *testNode) routedCount() int {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	return len(n.routed)
+}
+
+// waitFor polls until done reports true or the wait runs out
+func waitFor(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+type routedPayload struct {
+	Text string `json:"text"`
+}
+
+func TestSendRouted(t *testing.T) {
+	a, b, c := startLine(t)
+
+	type delivery struct {
+		from    string
+		payload routedPayload
+	}
+	delivered := make(chan delivery, 1)
+	c.RegisterHandler("TEST_ROUTED", func(peer ConnectedPeer, payload json.RawMessage) {
+		var p routedPayload
+		json.Unmarshal(payload, &p)
+		delivered <- delivery{peer.ID, p}
+	})
+
+	if err := a.SendRouted(c.id, "TEST_ROUTED", routedPayload{Text: "through b"}); err != nil {
+		t.Fatalf("SendRouted: %v", err)
+	}
+	select {
+	case got := <-delivered:
+		if got.from != a.id || got.payload.Text != "through b" {
+			t.Errorf("c got %q from %s, want %q from %s", got.payload.Text, got.from, "through b", a.id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the message didn't reach c")
+	}
+	if b.routedCount() != 1 {
+		t.Errorf("b remembers %d messages passed on, want 1", b.routedCount())
+	}
+}
+
+func TestSendRoutedDropped(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(a, b, c *testNode)
+	}{
+		{"no handler at the destination", func(a, b, c *testNode) {}},
+		{"routes in a loop", func(a, b, c *testNode) { b.route(c, a) }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, b, c := startLine(t)
+			test.setup(a, b, c)
+
+			if err := a.SendRouted(c.id, "TEST_ROUTED", routedPayload{Text: "dropped"}); err != nil {
+				t.Fatalf("SendRouted: %v", err)
+			}
+			// The error frame coming back makes a forget the message
+			waitFor(t, "the drop to be reported back to a", func() bool { return a.routedCount() == 0 })
+		})
+	}
+}
+
+func TestDataTransferMessage(t *testing.T) {
+	a, b, _ := startLine(t)
+	received := make(chan ConnectedPeer, 1)
+	data := make(chan []byte, 1)
+	a.OnData(func(peer ConnectedPeer, payload []byte) {
+		received <- peer
+		data <- payload
+	})
+
+	conn, err := b.connectTo(a.address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "a to learn who b is", func() bool {
+		a.mutex.RLock()
+		defer a.mutex.RUnlock()
+		return a.connectedPeers[b.id] != nil
+	})
+	message, _ := json.Marshal(map[string]any{"type": "DATA_TRANSFER", "data": []byte("wrapped by an older node")})
+	if err := b.peerForConn(conn).send(message); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case peer := <-received:
+		if got := string(<-data); got != "wrapped by an older node" {
+			t.Errorf("a got %q", got)
+		}
+		if peer.ID != b.id {
+			t.Errorf("data came from %s, want %s", peer.ID, b.id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the data didn't reach the OnData handler")
+	}
+}
@@ -0,0 +1,292 @@
+package p2p
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"time"
+)
+
+// Encrypted connections
+//
+// Connections to the TCP service run over TLS 1.3, whether they come
+// straight from a peer, through a relay or through other nodes, so the
+// messages on them and the streams spliced onto them can't be read or
+// altered on the way. Each end shows a self-signed certificate for its node
+// key (see identity.go), and a node that proves its ID over the connection
+// has to prove it with the key of its certificate, so the channel is known
+// to end at that node.
+//
+// The first byte of a connection tells TLS from the plain protocol of
+// releases before encryption. Plain connections get an ENCRYPTION_REQUIRED
+// answer unless SetAllowPlaintext lets them in, for networks still running
+// those releases; then plain connections are taken, and Secure connects
+// again without TLS to a peer that closes the connection on the handshake,
+// with a warning each time. A host or node ID that has spoken TLS once is
+// never talked to in plain again, so that whoever sits in between can't
+// make it fall back by breaking the handshake.
+
+// Security of a connection, see TCPPeer.Security
+const (
+	SecurityTLS       = "tls"
+	SecurityPlaintext = "plaintext"
+)
+
+const (
+	// tlsRecordHandshake is the first byte of a TLS ClientHello
+	tlsRecordHandshake = 0x16
+
+	// secureHandshakeTimeout bounds the TLS handshake of connections the
+	// TCP service takes
+	secureHandshakeTimeout = 10 * time.Second
+)
+
+var (
+	// ErrEncryptionRequired is returned when a peer refuses a plain
+	// connection
+	ErrEncryptionRequired = errors.New("the peer only takes encrypted connections")
+
+	// ErrPlaintextRefused is returned when a peer doesn't speak TLS and this
+	// node doesn't take plain connections
+	ErrPlaintextRefused = errors.New("the peer doesn't encrypt connections and plaintext peers are turned off")
+
+	// ErrDowngrade is returned when a peer that has spoken TLS before comes
+	// without it
+	ErrDowngrade = errors.New("the peer encrypted connections before and now doesn't")
+)
+
+// SetAllowPlaintext sets whether peers that don't encrypt connections are
+// taken and connected to, see above. They aren't unless turned on.
+func (tm *TCPManager) SetAllowPlaintext(allowed bool) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	tm.plaintextAllowed = allowed
+}
+
+// noteTLS remembers that the hosts or node IDs spoke TLS
+func (tm *TCPManager) noteTLS(names ...string) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	if tm.spokeTLS == nil {
+		tm.spokeTLS = make(map[string]bool)
+	}
+	for _, name := range names {
+		if name != "" {
+			tm.spokeTLS[name] = true
+		}
+	}
+}
+
+// checkPlaintext returns why a plain connection with the hosts or node IDs
+// may not be used, or nil
+func (tm *TCPManager) checkPlaintext(names ...string) error {
+	tm.mutex.RLock()
+	defer tm.mutex.RUnlock()
+	if !tm.plaintextAllowed {
+		return ErrPlaintextRefused
+	}
+	for _, name := range names {
+		if tm.spokeTLS[name] {
+			return ErrDowngrade
+		}
+	}
+	return nil
+}
+
+// remoteHost returns the host at the other end of conn
+func remoteHost(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// certificate returns the self-signed certificate for the node key, made
+// the first time. Without a key it is for a key of its own.
+func (tm *TCPManager) certificate() (tls.Certificate, error) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	if tm.cert != nil {
+		return *tm.cert, nil
+	}
+
+	key := tm.key
+	if key == nil {
+		var err error
+		if _, key, err = ed25519.GenerateKey(rand.Reader); err != nil {
+			return tls.Certificate{}, err
+		}
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: tm.nodeID},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to make the TLS certificate: %w", err)
+	}
+	tm.cert = &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return *tm.cert, nil
+}
+
+// tlsConfig is the TLS configuration of both ends of a connection
+func (tm *TCPManager) tlsConfig() (*tls.Config, error) {
+	cert, err := tm.certificate()
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS13,
+		ClientAuth:   tls.RequireAnyClientCert,
+		// The certificates are self-signed; what vouches for them is the
+		// node ID proved with their key
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: verifyNodeCertificate,
+	}, nil
+}
+
+// verifyNodeCertificate takes a certificate for an Ed25519 key, as nodes
+// show, and nothing else
+func verifyNodeCertificate(raw [][]byte, _ [][]*x509.Certificate) error {
+	if len(raw) == 0 {
+		return errors.New("the peer showed no certificate")
+	}
+	cert, err := x509.ParseCertificate(raw[0])
+	if err != nil {
+		return err
+	}
+	if _, ok := cert.PublicKey.(ed25519.PublicKey); !ok {
+		return errors.New("the peer's certificate isn't for a node key")
+	}
+	return nil
+}
+
+// certificateKey returns the key of the certificate the other end of conn
+// showed, or nil for a plain connection
+func certificateKey(conn net.Conn) ed25519.PublicKey {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil
+	}
+	key, _ := certs[0].PublicKey.(ed25519.PublicKey)
+	return key
+}
+
+// connSecurity returns how conn is protected, SecurityTLS or
+// SecurityPlaintext
+func connSecurity(conn net.Conn) string {
+	if _, ok := conn.(*tls.Conn); ok {
+		return SecurityTLS
+	}
+	return SecurityPlaintext
+}
+
+// Secure connects with dial to a TCP service and runs TLS over the
+// connection, with a handshake of up to timeout. A peer that closes the
+// connection on the handshake, as releases before encryption do, is
+// connected to again without it while plaintext peers are allowed and it
+// hasn't spoken TLS before, see above.
+func (tm *TCPManager) Secure(dial func() (net.Conn, error), timeout time.Duration) (net.Conn, error) {
+	conn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	config, err := tm.tlsConfig()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, config)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err = tlsConn.HandshakeContext(ctx)
+	host := remoteHost(conn)
+	if err == nil {
+		tm.noteTLS(host)
+		return tlsConn, nil
+	}
+	conn.Close()
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return nil, fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	if refused := tm.checkPlaintext(host); refused != nil {
+		return nil, fmt.Errorf("%w (%v)", refused, err)
+	}
+	fmt.Printf("⚠️  %s doesn't speak TLS (%v), connecting without encryption\n", host, err)
+	return dial()
+}
+
+// peekedConn lets the first bytes of a connection be looked at before
+// deciding whether it speaks TLS
+type peekedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// acceptSecure sets up a connection the TCP service took, as TLS or plain
+// from its first byte, see above
+func (tm *TCPManager) acceptSecure(conn net.Conn) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(secureHandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	peeked := &peekedConn{Conn: conn, reader: bufio.NewReader(conn)}
+	first, err := peeked.reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	host := remoteHost(conn)
+	if first[0] != tlsRecordHandshake {
+		if err := tm.checkPlaintext(host); err != nil {
+			refusePlaintext(peeked)
+			return nil, fmt.Errorf("refused an unencrypted connection: %w", err)
+		}
+		fmt.Printf("⚠️  Taking an unencrypted connection from %s\n", host)
+		return peeked, nil
+	}
+
+	config, err := tm.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Server(peeked, config)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	tm.noteTLS(host)
+	return tlsConn, nil
+}
+
+// refusePlaintext tells the other end of a plain connection that this node
+// only takes encrypted ones
+func refusePlaintext(conn net.Conn) {
+	answer, err := json.Marshal(map[string]string{"type": "ENCRYPTION_REQUIRED", "error": ErrEncryptionRequired.Error()})
+	if err != nil {
+		return
+	}
+	conn.Write(packMessage(answer))
+}
@@ -0,0 +1,157 @@
+package p2p
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// plainListener takes connections and closes them on the first bytes, as
+// releases before encryption do on a TLS handshake
+func plainListener(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				buf := make([]byte, 1)
+				conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+				conn.Read(buf)
+				conn.Close()
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestSecureFallback(t *testing.T) {
+	tests := []struct {
+		name      string
+		allow     bool
+		spokeTLS  bool
+		wantError error
+	}{
+		{"plaintext refused by default", false, false, ErrPlaintextRefused},
+		{"plaintext allowed", true, false, nil},
+		{"no downgrade of a TLS host", true, true, ErrDowngrade},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			address := plainListener(t)
+			tm := &TCPManager{}
+			tm.SetAllowPlaintext(test.allow)
+			if test.spokeTLS {
+				tm.noteTLS("127.0.0.1")
+			}
+
+			conn, err := tm.Secure(func() (net.Conn, error) {
+				return net.Dial("tcp", address)
+			}, time.Second)
+			if test.wantError == nil {
+				if err != nil {
+					t.Fatalf("Secure: %v", err)
+				}
+				defer conn.Close()
+				if security := connSecurity(conn); security != SecurityPlaintext {
+					t.Errorf("connection is %s, want %s", security, SecurityPlaintext)
+				}
+				return
+			}
+			if !errors.Is(err, test.wantError) {
+				t.Fatalf("Secure returned %v, want %v", err, test.wantError)
+			}
+		})
+	}
+}
+
+func TestAcceptSecure(t *testing.T) {
+	tests := []struct {
+		name     string
+		allow    bool
+		tls      bool
+		spokeTLS bool
+		want     string // Security of the accepted connection, empty when refused
+	}{
+		{"TLS", false, true, false, SecurityTLS},
+		{"plaintext refused by default", false, false, false, ""},
+		{"plaintext allowed", true, false, false, SecurityPlaintext},
+		{"no downgrade of a TLS host", true, false, true, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+
+			server := &TCPManager{}
+			server.SetAllowPlaintext(test.allow)
+			if test.spokeTLS {
+				server.noteTLS("127.0.0.1")
+			}
+			type accepted struct {
+				conn net.Conn
+				err  error
+			}
+			result := make(chan accepted, 1)
+			go func() {
+				conn, err := listener.Accept()
+				if err != nil {
+					result <- accepted{err: err}
+					return
+				}
+				secured, err := server.acceptSecure(conn)
+				if err != nil {
+					conn.Close()
+				}
+				result <- accepted{secured, err}
+			}()
+
+			client := &TCPManager{}
+			dial := func() (net.Conn, error) { return net.Dial("tcp", listener.Addr().String()) }
+			var conn net.Conn
+			if test.tls {
+				conn, err = client.Secure(dial, time.Second)
+			} else {
+				conn, err = dial()
+				if err == nil {
+					conn.Write(packMessage([]byte(`{"type":"HELLO"}`)))
+				}
+			}
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			defer conn.Close()
+
+			got := <-result
+			if test.want == "" {
+				if got.err == nil {
+					got.conn.Close()
+					t.Fatal("plain connection was taken")
+				}
+				return
+			}
+			if got.err != nil {
+				t.Fatalf("acceptSecure: %v", got.err)
+			}
+			defer got.conn.Close()
+			if security := connSecurity(got.conn); security != test.want {
+				t.Errorf("connection is %s, want %s", security, test.want)
+			}
+			server.SetAllowPlaintext(true)
+			if test.tls && !errors.Is(server.checkPlaintext("127.0.0.1"), ErrDowngrade) {
+				t.Error("host that spoke TLS may still connect in plain")
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Send queues
+//
+// Every connection of the TCP service has a queue of the messages going out
+// on it and one writer, a goroutine that writes them in order, each whole
+// (see writeMessage). So messages sent at the same time never interleave on
+// the connection, and a slow peer only holds up what is sent to it: senders
+// wait up to sendQueueTimeout for room in its queue and then get
+// ErrSendQueueFull.
+//
+// Stopping a queue is final. When its connection ends, what is still queued
+// is written if the connection takes it, so the INCOMPATIBLE answer of a
+// failed handshake gets out, and fails with ErrPeerClosed once a write
+// failed; a connection handed over by a SPLICE gets what is queued written
+// before it is. Senders waiting for their message learn which it was, and
+// messages sent once the queue stopped fail with ErrPeerClosed at once.
+
+const (
+	// sendQueueSize is how many messages may wait to go out to a peer
+	sendQueueSize = 64
+
+	// sendQueueTimeout is how long a sender waits for room in a full queue
+	sendQueueTimeout = 5 * time.Second
+)
+
+var (
+	// ErrSendQueueFull is returned when a peer doesn't take messages as fast
+	// as they are sent to it
+	ErrSendQueueFull = errors.New("peer send queue full")
+
+	// ErrPeerClosed is returned for messages to a connection that ended
+	ErrPeerClosed = errors.New("peer connection closed")
+)
+
+// outbound is a message waiting in a send queue
+type outbound struct {
+	data    []byte
+	written chan error // Told how the write went, nil if nobody waits
+}
+
+// sendQueue is the queue of messages going out on one connection
+type sendQueue struct {
+	messages chan outbound
+	stopping chan struct{} // Closed by stop
+	stopped  chan struct{} // Closed when the writer returned
+	once     sync.Once
+	mutex    sync.RWMutex // Held by senders while they queue a message
+}
+
+// startSendQueue gives peer its send queue and starts its writer
+func (peer *TCPPeer) startSendQueue() {
+	peer.queue = &sendQueue{
+		messages: make(chan outbound, sendQueueSize),
+		stopping: make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go peer.writeQueued()
+}
+
+// send queues data as a message to peer, see above
+func (peer *TCPPeer) send(data []byte) error {
+	return peer.enqueue(outbound{data: data}, sendQueueTimeout)
+}
+
+// sendWithin queues data as a message to peer and waits for it to be
+// written, giving up at deadline
+func (peer *TCPPeer) sendWithin(data []byte, deadline time.Time) error {
+	message := outbound{data: data, written: make(chan error, 1)}
+	if err := peer.enqueue(message, time.Until(deadline)); err != nil {
+		return err
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case err := <-message.written:
+		return err
+	case <-timer.C:
+		return fmt.Errorf("message to %s not written in time", peer.Address)
+	}
+}
+
+func (peer *TCPPeer) enqueue(message outbound, timeout time.Duration) error {
+	q := peer.queue
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+	select {
+	case <-q.stopping:
+		return ErrPeerClosed
+	default:
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case q.messages <- message:
+		return nil
+	case <-q.stopping:
+		return ErrPeerClosed
+	case <-timer.C:
+		return ErrSendQueueFull
+	}
+}
+
+// stopSendQueue stops the queue of peer, writing what is queued first, and returns
+// once the writer did, see above
+func (peer *TCPPeer) stopSendQueue() {
+	q := peer.queue
+	q.once.Do(func() { close(q.stopping) })
+	<-q.stopped
+}
+
+// writeQueued writes the messages queued for peer until the queue stops
+func (peer *TCPPeer) writeQueued() {
+	q := peer.queue
+	defer close(q.stopped)
+
+	var failed error
+	write := func(message outbound) {
+		err := failed
+		if err == nil {
+			if err = peer.writeMessage(message.data); err != nil {
+				// A message partly written leaves the stream unreadable to
+				// the other end, and what follows would fail anyway
+				failed = ErrPeerClosed
+				peer.Conn.Close()
+			}
+		}
+		if message.written != nil {
+			message.written <- err
+		}
+	}
+
+	for {
+		select {
+		case message := <-q.messages:
+			write(message)
+			continue
+		case <-q.stopping:
+		}
+
+		// Once the senders already at it are done, nothing more is queued
+		q.mutex.Lock()
+		q.mutex.Unlock()
+		for {
+			select {
+			case message := <-q.messages:
+				write(message)
+			default:
+				return
+			}
+		}
+	}
+}
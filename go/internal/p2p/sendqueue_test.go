@@ -0,0 +1,136 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// queuedPeer returns a peer with a running send queue writing to one end
+// of a pipe, and the other end
+func queuedPeer(t *testing.T) (*TCPPeer, net.Conn) {
+	t.Helper()
+	local, remote := net.Pipe()
+	peer := &TCPPeer{ID: "peer", Address: "pipe", Conn: local}
+	peer.startSendQueue()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+		peer.stopSendQueue()
+	})
+	return peer, remote
+}
+
+// readFrame reads one message the way peers frame them
+func readFrame(r io.Reader) ([]byte, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint32(length[:]))
+	_, err := io.ReadFull(r, data)
+	return data, err
+}
+
+type queuedMessage struct {
+	Sender int    `json:"sender"`
+	Seq    int    `json:"seq"`
+	Pad    []byte `json:"pad"`
+}
+
+func TestSendQueueOrder(t *testing.T) {
+	peer, remote := queuedPeer(t)
+	const senders, each = 8, 20
+
+	var wg sync.WaitGroup
+	for s := 0; s < senders; s++ {
+		wg.Add(1)
+		go func(s int) {
+			defer wg.Done()
+			for i := 0; i < each; i++ {
+				// Large enough to take several writes, so interleaving would show
+				data, _ := json.Marshal(queuedMessage{Sender: s, Seq: i, Pad: make([]byte, writeChunk)})
+				if err := peer.send(data); err != nil {
+					t.Errorf("send: %v", err)
+					return
+				}
+			}
+		}(s)
+	}
+
+	next := make([]int, senders)
+	for n := 0; n < senders*each; n++ {
+		data, err := readFrame(remote)
+		if err != nil {
+			t.Fatalf("reading message %d: %v", n, err)
+		}
+		var message queuedMessage
+		if err := json.Unmarshal(data, &message); err != nil {
+			t.Fatalf("message %d is garbled: %v", n, err)
+		}
+		if message.Seq != next[message.Sender] {
+			t.Fatalf("sender %d's message %d came when %d was due", message.Sender, message.Seq, next[message.Sender])
+		}
+		next[message.Sender]++
+	}
+	wg.Wait()
+}
+
+func TestSendQueueFull(t *testing.T) {
+	peer, remote := queuedPeer(t)
+
+	// Nothing reads, so the writer blocks on the first message and the
+	// queue fills behind it
+	for i := 0; i <= sendQueueSize; i++ {
+		if err := peer.enqueue(outbound{data: []byte(`{"type":"FILL"}`)}, time.Second); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+	}
+	if err := peer.enqueue(outbound{data: []byte(`{"type":"OVER"}`)}, 50*time.Millisecond); !errors.Is(err, ErrSendQueueFull) {
+		t.Fatalf("got %v, want %v", err, ErrSendQueueFull)
+	}
+
+	// Reading makes room again
+	if _, err := readFrame(remote); err != nil {
+		t.Fatal(err)
+	}
+	if err := peer.enqueue(outbound{data: []byte(`{"type":"ROOM"}`)}, time.Second); err != nil {
+		t.Fatalf("after reading: %v", err)
+	}
+}
+
+func TestSendQueueCloseWhileSending(t *testing.T) {
+	peer, remote := queuedPeer(t)
+	go io.Copy(io.Discard, remote)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 400)
+	for s := 0; s < 4; s++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				errs <- peer.sendWithin([]byte(`{"type":"TEST"}`), time.Now().Add(time.Second))
+			}
+		}()
+	}
+	time.Sleep(time.Millisecond)
+	peer.Conn.Close()
+	peer.stopSendQueue()
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil && !errors.Is(err, ErrPeerClosed) && !errors.Is(err, io.ErrClosedPipe) {
+			t.Errorf("send failed with %v, want nil or %v", err, ErrPeerClosed)
+		}
+	}
+	if err := peer.send([]byte(`{"type":"LATE"}`)); !errors.Is(err, ErrPeerClosed) {
+		t.Errorf("send after the stop got %v, want %v", err, ErrPeerClosed)
+	}
+}
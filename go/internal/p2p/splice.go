@@ -0,0 +1,136 @@
+package p2p
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Spliced connections
+//
+// A connection to the TCP service can be handed over to a local port of the
+// node. SPLICE asks for it, and once the node answers SPLICED the rest of
+// the connection runs straight to whatever listens on the port, such as a
+// receiver. A node that already has a connection to a peer, directly,
+// through a relay or through other nodes, so sends over it instead of
+// connecting again. The port is connected by the OnRoutedConnection
+// handler, as for routed streams; when it fails the answer says why and
+// the connection stays with the TCP service.
+
+// spliceMessage asks to hand a connection over to a local port, and answers
+type spliceMessage struct {
+	Type  string `json:"type"` // SPLICE or SPLICED
+	Port  int    `json:"port,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// errSpliced ends the message loop of a connection that was handed over
+var errSpliced = errors.New("connection handed over to a local port")
+
+// Splice asks the node at the other end of conn, a connection to its TCP
+// service, to hand the connection over to its local port, and waits up to
+// timeout for it to. From then on conn carries what the port sends and
+// receives.
+func Splice(conn net.Conn, port int, timeout time.Duration) error {
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	request, err := json.Marshal(spliceMessage{Type: "SPLICE", Port: port})
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(packMessage(request)); err != nil {
+		return err
+	}
+
+	answer, err := readAnswer(conn, 64*1024)
+	if err != nil {
+		return err
+	}
+	var spliced spliceMessage
+	if err := json.Unmarshal(answer, &spliced); err != nil || spliced.Type != "SPLICED" {
+		return errors.New("peer didn't hand the connection over")
+	}
+	if spliced.Error != "" {
+		return fmt.Errorf("peer couldn't hand the connection over: %s", spliced.Error)
+	}
+	return nil
+}
+
+// splice hands the connection of peer over to the local port a SPLICE
+// asks for, returning errSpliced when it did
+func (tm *TCPManager) splice(peer *TCPPeer, message []byte) error {
+	var request spliceMessage
+	if err := json.Unmarshal(message, &request); err != nil {
+		return err
+	}
+	tm.mutex.RLock()
+	handler := tm.onRouted
+	tm.mutex.RUnlock()
+
+	conn := &splicedConn{Conn: peer.Conn, reader: peer.reader}
+	switch {
+	case handler == nil:
+		return conn.answer(errors.New("not taking spliced connections"))
+	case request.Port <= 0:
+		return conn.answer(errors.New("no port to hand the connection over to"))
+	}
+
+	// No PINGs may follow the answer into the port's stream
+	peer.keepalive.end()
+	peer.stopSendQueue()
+	peer.Conn.SetDeadline(time.Time{})
+	if err := handler(conn, request.Port); err != nil {
+		return conn.answer(err)
+	}
+	if err := conn.answer(nil); err != nil {
+		return err
+	}
+	return errSpliced
+}
+
+// splicedConn is a connection handed over to a local port. Its reads start
+// with what the TCP service had buffered, and the SPLICED answer goes out
+// before anything the port writes.
+type splicedConn struct {
+	net.Conn
+	reader   *bufio.Reader
+	once     sync.Once
+	answered error
+}
+
+// answer sends the SPLICED answer, with the error refusing the connection
+// if err is set, unless it went out already
+func (c *splicedConn) answer(err error) error {
+	c.once.Do(func() {
+		message := spliceMessage{Type: "SPLICED"}
+		if err != nil {
+			message.Error = err.Error()
+		}
+		data, marshalErr := json.Marshal(message)
+		if marshalErr != nil {
+			c.answered = marshalErr
+			return
+		}
+		_, c.answered = c.Conn.Write(packMessage(data))
+	})
+	return c.answered
+}
+
+func (c *splicedConn) Read(p []byte) (int, error) {
+	if c.reader == nil {
+		return c.Conn.Read(p)
+	}
+	return c.reader.Read(p)
+}
+
+func (c *splicedConn) Write(p []byte) (int, error) {
+	if err := c.answer(nil); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(p)
+}
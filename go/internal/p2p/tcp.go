@@ -2,33 +2,126 @@ package p2p
 
 import (
 	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
+
+	"fileshare/internal/access"
+	"fileshare/internal/utils"
 )
 
 // TCPManager handles TCP/IP connections
 type TCPManager struct {
-	isRunning      bool
-	listener       net.Listener
-	connectedPeers map[string]*TCPPeer
-	discoveryAddr  string
-	listenPort     int
-	mutex          sync.RWMutex
+	isRunning         bool
+	listener          net.Listener
+	connectedPeers    map[string]*TCPPeer
+	discoveryAddr     string
+	broadcastVia      string               // Where discovery last went out, see logBroadcastInterfaces
+	discoveryConns    []*net.UDPConn       // IPv4 and, per interface, the discovery groups
+	discoveryMode     string               // Set by SetDiscoveryMode, see multicast.go
+	multicastTTL      int                  // Set by SetDiscoveryMode
+	answered          map[string]time.Time // Discovery queries answered lately, see firstQuery
+	keepaliveInterval time.Duration        // Set by SetKeepalive, see keepalive.go
+	keepaliveMisses   int
+	mdns              *mdnsResponder           // Advertises the service while running, see mdns.go
+	mdnsDisabled      bool                     // Set by SetMDNS
+	plaintextAllowed  bool                     // Set by SetAllowPlaintext, see secure.go
+	spokeTLS          map[string]bool          // Hosts and node IDs seen over TLS, see secure.go
+	provenIDs         map[string]bool          // Node IDs that proved their key, see identity.go
+	keyCheck          func(nodeID string) bool // Set by SetKeyCheck
+	cert              *tls.Certificate         // For key, made when first needed
+	listenPort        int
+	limiter           *access.Limiter
+	onDeparture       func(nodeID, address string)
+	onConnectionLost  func(peerID, address string)
+	onAnnounce        func(peer PeerInfo)
+	onHandshake       func(peer PeerInfo)
+	onNeighbors       func(from string, lists []NeighborList)
+	onPeerExchange    func(from string, peers []PeerRecord)
+	onBroadcast       func(msg BroadcastMessage, address string)
+	onData            func(peer ConnectedPeer, data []byte)
+	handlers          map[string]MessageHandler                // Set by RegisterHandler, see messages.go
+	network           network                                  // Set by SetNetwork, see network.go
+	nodeID            string                                   // Set by SetIdentity
+	nodeName          string                                   // Set by SetIdentity
+	capabilities      []string                                 // Set by SetCapabilities
+	key               ed25519.PrivateKey                       // Set by SetKey, see identity.go
+	nextHop           func(destination string) (string, error) // Set by SetRouting
+	onRouted          func(conn net.Conn, port int) error
+	reconnectAttempts int                            // Set by SetReconnect, see reconnect.go
+	reconnectCheck    func(peerID, host string) bool // Set by SetReconnectCheck
+	onReconnect       func(peerID, address string)
+	reconnecting      map[string]bool           // Addresses being connected to again
+	stopped           chan struct{}             // Closed by Stop
+	streams           map[string]*routedStream  // Routed streams running through or ending at this node
+	routed            map[string]*routedMessage // Routed messages sent or passed on lately, see routed.go
+	mutex             sync.RWMutex
 }
 
-// TCPPeer represents a peer connected via TCP/IP
+// DefaultTCPPort is where the TCP service listens unless Start says
+// otherwise, and where peers that didn't say where theirs listens are dialed
+const DefaultTCPPort = 9002
+
+// Connection limits of the TCP service unless SetConnectionLimits says otherwise
+const (
+	DefaultMaxTCPConnections      = 64
+	DefaultMaxTCPConnectionsPerIP = 4
+)
+
+// TCPPeer represents a peer connected via TCP/IP. ID and Name are made up
+// until the handshake says who the peer is, see handshake.go.
 type TCPPeer struct {
-	ID       string
-	Name     string
-	Address  string
-	Conn     net.Conn
-	LastSeen time.Time
+	ID           string
+	Name         string
+	Address      string
+	Conn         net.Conn
+	LastSeen     time.Time     // Guarded by the manager's mutex, like what the handshake changes
+	Version      int           // Protocol version both ends speak, 0 until the handshake
+	Security     string        // SecurityTLS or SecurityPlaintext, see secure.go
+	Capabilities []string      // What the peer said it can do in the handshake
+	dialed       string        // host:port Connect dialed, empty for accepted connections
+	challenge    string        // Of the HELLO this node sent
+	reader       *bufio.Reader // What the TCP service reads Conn through
+	keepalive    *keepalive
+	queue        *sendQueue // Messages going out, see sendqueue.go
+}
+
+// departureMessage tells connected peers a node is leaving the network
+type departureMessage struct {
+	Type   string `json:"type"` // "DEPART"
+	NodeID string `json:"node_id"`
+}
+
+// Neighbor is a peer a node reaches directly
+type Neighbor struct {
+	ID      string `json:"id"`
+	Name    string `json:"name,omitempty"`
+	Quality int    `json:"quality"` // 0-100%
+}
+
+// NeighborList is the peers one node reaches directly, as it reported them
+type NeighborList struct {
+	NodeID    string     `json:"node_id"`
+	Neighbors []Neighbor `json:"neighbors"`
+	Age       int        `json:"age"` // Seconds since NodeID reported it
+}
+
+// neighborsMessage shares the neighbor lists a node knows, its own included
+type neighborsMessage struct {
+	Type   string         `json:"type"` // "NEIGHBORS"
+	NodeID string         `json:"node_id"`
+	Lists  []NeighborList `json:"lists"`
 }
 
 // TCPDiscoveryMessage is used for peer discovery
@@ -38,6 +131,11 @@ type TCPDiscoveryMessage struct {
 	NodeName     string   `json:"node_name"`
 	Port         int      `json:"port"`
 	Capabilities []string `json:"capabilities"`
+	Challenge    string   `json:"challenge,omitempty"`  // In requests, for answers to sign
+	PublicKey    []byte   `json:"public_key,omitempty"` // In answers, see identity.go
+	Signature    []byte   `json:"signature,omitempty"`
+	Network      string   `json:"network,omitempty"`       // See network.go
+	NetworkProof []byte   `json:"network_proof,omitempty"` // In answers and announcements
 }
 
 var (
@@ -51,14 +149,17 @@ func GetTCPManager() *TCPManager {
 		tcpManager = &TCPManager{
 			isRunning:      false,
 			connectedPeers: make(map[string]*TCPPeer),
-			discoveryAddr:  "255.255.255.255:9876", // Broadcast address for discovery
-			listenPort:     9002,                   // Default port for TCP connections
+			streams:        make(map[string]*routedStream),
+			discoveryAddr:  broadcastAddr(DefaultTCPPort),
+			listenPort:     DefaultTCPPort,
+			limiter:        access.NewLimiter(DefaultMaxTCPConnections, DefaultMaxTCPConnectionsPerIP),
 		}
 	})
 	return tcpManager
 }
 
-// Start initializes and starts the TCP service
+// Start initializes and starts the TCP service, as the node SetIdentity
+// names
 func (tm *TCPManager) Start(port int) error {
 	tm.mutex.Lock()
 	defer tm.mutex.Unlock()
@@ -66,9 +167,13 @@ func (tm *TCPManager) Start(port int) error {
 	if tm.isRunning {
 		return errors.New("TCP service is already running")
 	}
+	if tm.nodeID == "" {
+		return errors.New("node identity is not set")
+	}
 
 	if port > 0 {
 		tm.listenPort = port
+		tm.discoveryAddr = broadcastAddr(port)
 	}
 
 	// Start listening on the specified port
@@ -79,16 +184,253 @@ func (tm *TCPManager) Start(port int) error {
 	tm.listener = listener
 
 	tm.isRunning = true
+	tm.stopped = make(chan struct{})
 
 	// Start accepting connections
-	go tm.acceptConnections()
+	go tm.acceptConnections(listener)
 
-	// Start discovery service
-	go tm.startDiscoveryService()
+	tm.listenDiscovery()
+	if !tm.mdnsDisabled {
+		tm.mdns = startMDNSResponder(tm)
+	}
 
 	return nil
 }
 
+// listenDiscovery starts the discovery service, on IPv4 for broadcasts and
+// on every interface for the discovery groups. The caller holds tm.mutex.
+func (tm *TCPManager) listenDiscovery() {
+	if conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: tm.listenPort + 1}); err != nil {
+		fmt.Printf("Failed to create UDP listener for discovery: %v\n", err)
+	} else {
+		tm.discoveryConns = append(tm.discoveryConns, conn)
+		go tm.startDiscoveryService(conn)
+	}
+	for _, ifi := range multicastInterfaces() {
+		if !hasIPv6(ifi) {
+			continue
+		}
+		ifi := ifi
+		conn, err := net.ListenMulticastUDP("udp6", &ifi, &net.UDPAddr{IP: discoveryGroup6, Port: tm.listenPort + 1})
+		if err != nil {
+			continue
+		}
+		tm.discoveryConns = append(tm.discoveryConns, conn)
+		go tm.startDiscoveryService(conn)
+	}
+	if tm.discoveryMode != DiscoveryBroadcast {
+		tm.joinDiscoveryGroup()
+	}
+}
+
+// Rebind moves the running TCP service and its discovery service to port,
+// keeping the connected peers. If nothing can listen on port the service
+// stays where it was.
+func (tm *TCPManager) Rebind(port int) error {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+
+	if !tm.isRunning {
+		return errors.New("TCP service is not running")
+	}
+	if port == tm.listenPort {
+		return nil
+	}
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return fmt.Errorf("failed to listen on port %d: %w", port, err)
+	}
+
+	// The old sockets are closed first, acceptConnections and the discovery
+	// service end when theirs is
+	tm.listener.Close()
+	for _, conn := range tm.discoveryConns {
+		conn.Close()
+	}
+	tm.discoveryConns = nil
+
+	tm.listenPort = port
+	tm.discoveryAddr = broadcastAddr(port)
+	tm.listener = listener
+	go tm.acceptConnections(listener)
+	tm.listenDiscovery()
+	return nil
+}
+
+// broadcastAddr is where discovery messages go over IPv4 for nodes whose TCP
+// service is on port: their discovery service listens on the port after it
+func broadcastAddr(port int) string {
+	return fmt.Sprintf("255.255.255.255:%d", port+1)
+}
+
+// discoveryGroup6 is the link-local multicast group discovery messages go
+// to over IPv6, which has no broadcast; the group ID spells "bits"
+var discoveryGroup6 = net.ParseIP("ff02::6269:7473")
+
+// sendDiscovery sends data to the discovery service of the nodes on the
+// local networks: over IPv4 to the broadcast address of every interface's
+// subnet, from a socket bound to the interface's address so it leaves
+// through that interface, or to the IPv4 discovery group, or both, as
+// SetDiscoveryMode says, and to the IPv6 discovery group on every
+// interface. The limited broadcast, 255.255.255.255, which many systems
+// only send out of the default interface, is the fallback when no subnet
+// takes broadcasts. It returns the sockets it went out from, which answers
+// come back to.
+func (tm *TCPManager) sendDiscovery(data []byte) ([]*net.UDPConn, error) {
+	tm.mutex.RLock()
+	discoveryAddr, port := tm.discoveryAddr, tm.listenPort
+	tm.mutex.RUnlock()
+	mode, ttl := tm.discoverySettings()
+
+	var conns []*net.UDPConn
+	var sendErr error
+	var used []string
+	var subnets []utils.BroadcastSubnet
+	if mode != DiscoveryMulticast {
+		subnets, _ = utils.GetBroadcastSubnets()
+	}
+	for _, subnet := range subnets {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: subnet.IP})
+		if err != nil {
+			sendErr = err
+			continue
+		}
+		if _, err := conn.WriteToUDP(data, &net.UDPAddr{IP: subnet.Broadcast, Port: port + 1}); err != nil {
+			conn.Close()
+			sendErr = err
+			continue
+		}
+		conns = append(conns, conn)
+		used = append(used, fmt.Sprintf("%s (%s)", subnet.Interface, subnet.Broadcast))
+	}
+
+	if len(used) == 0 && mode != DiscoveryMulticast {
+		if target, err := net.ResolveUDPAddr("udp4", discoveryAddr); err != nil {
+			sendErr = err
+		} else if conn, err := net.ListenUDP("udp4", nil); err != nil {
+			sendErr = err
+		} else if _, err := conn.WriteToUDP(data, target); err != nil {
+			conn.Close()
+			sendErr = err
+		} else {
+			conns = append(conns, conn)
+			used = append(used, target.IP.String())
+		}
+	}
+	if mode != DiscoveryBroadcast {
+		multicast, via, err := sendMulticast(data, ttl)
+		if err != nil {
+			sendErr = err
+		}
+		conns = append(conns, multicast...)
+		used = append(used, via...)
+	}
+	tm.logBroadcastInterfaces(used)
+
+	if conn, err := net.ListenUDP("udp6", nil); err == nil {
+		sent := false
+		for _, ifi := range multicastInterfaces() {
+			if !hasIPv6(ifi) {
+				continue
+			}
+			// Link-local groups need the interface as the zone
+			if _, err := conn.WriteToUDP(data, &net.UDPAddr{IP: discoveryGroup6, Port: port + 1, Zone: ifi.Name}); err == nil {
+				sent = true
+			}
+		}
+		if sent {
+			conns = append(conns, conn)
+		} else {
+			conn.Close()
+		}
+	}
+
+	if len(conns) == 0 {
+		return nil, fmt.Errorf("failed to send discovery message: %w", sendErr)
+	}
+	return conns, nil
+}
+
+// logBroadcastInterfaces tells which interfaces discovery goes out of, and
+// to which addresses, when they changed since the last time
+func (tm *TCPManager) logBroadcastInterfaces(used []string) {
+	list := strings.Join(used, ", ")
+	tm.mutex.Lock()
+	changed := list != tm.broadcastVia
+	tm.broadcastVia = list
+	tm.mutex.Unlock()
+
+	if changed && list != "" {
+		fmt.Printf("Discovery goes out on %s\n", list)
+	}
+}
+
+// udpHost returns the host of addr, with the zone of link-local IPv6
+// addresses, which can't be reached without it
+func udpHost(addr *net.UDPAddr) string {
+	if addr.Zone != "" {
+		return addr.IP.String() + "%" + addr.Zone
+	}
+	return addr.IP.String()
+}
+
+// SetConnectionLimits sets how many connections the TCP service takes at
+// once, in total and from one address; 0 means no limit. Connections already
+// open are kept.
+func (tm *TCPManager) SetConnectionLimits(max, maxPerIP int) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	tm.limiter = access.NewLimiter(max, maxPerIP)
+}
+
+// ConnectionStats returns how many connections the TCP service has open, how
+// many it takes at once (0 for no limit) and whether it is running
+func (tm *TCPManager) ConnectionStats() (open, max int, running bool) {
+	tm.mutex.RLock()
+	limiter, running := tm.limiter, tm.isRunning
+	tm.mutex.RUnlock()
+	open, max = limiter.Stats()
+	return open, max, running
+}
+
+// ConnectedPeer is a connection of the TCP service, as ConnectedPeers
+// lists it
+type ConnectedPeer struct {
+	ID       string // The node ID once the handshake said it, see TCPPeer
+	Name     string
+	Address  string
+	Version  int    // Protocol version both ends speak, 0 until the handshake
+	Security string // SecurityTLS or SecurityPlaintext
+	LastRead time.Time
+}
+
+// ConnectedPeers lists the open connections of the TCP service
+func (tm *TCPManager) ConnectedPeers() []ConnectedPeer {
+	tm.mutex.RLock()
+	defer tm.mutex.RUnlock()
+	peers := make([]ConnectedPeer, 0, len(tm.connectedPeers))
+	for _, peer := range tm.connectedPeers {
+		peers = append(peers, peer.info())
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Address < peers[j].Address
+	})
+	return peers
+}
+
+// info describes the connection of peer; the caller holds tm.mutex, which
+// guards what the handshake changes
+func (peer *TCPPeer) info() ConnectedPeer {
+	return ConnectedPeer{
+		ID:       peer.ID,
+		Name:     peer.Name,
+		Address:  peer.Address,
+		Version:  peer.Version,
+		Security: peer.Security,
+		LastRead: time.Unix(0, peer.keepalive.lastRead.Load()),
+	}
+}
+
 // Stop stops the TCP service
 func (tm *TCPManager) Stop() error {
 	tm.mutex.Lock()
@@ -102,6 +444,14 @@ func (tm *TCPManager) Stop() error {
 	if tm.listener != nil {
 		tm.listener.Close()
 	}
+	for _, conn := range tm.discoveryConns {
+		conn.Close()
+	}
+	tm.discoveryConns = nil
+	if tm.mdns != nil {
+		tm.mdns.stop()
+		tm.mdns = nil
+	}
 
 	// Close all connections
 	for _, peer := range tm.connectedPeers {
@@ -109,133 +459,547 @@ func (tm *TCPManager) Stop() error {
 	}
 
 	tm.isRunning = false
+	close(tm.stopped)
 	return nil
 }
 
-// Discover scans the local network for BitShare TCP peers
-func (tm *TCPManager) Discover(timeout time.Duration) ([]PeerInfo, error) {
-	results := make([]PeerInfo, 0)
-	resultsChan := make(chan PeerInfo)
-	errorChan := make(chan error)
-	doneChan := make(chan bool)
+// OnDeparture sets what is told when a peer announces it is leaving, with
+// the node ID it gave and the address the announcement came from
+func (tm *TCPManager) OnDeparture(handler func(nodeID, address string)) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	tm.onDeparture = handler
+}
 
-	// Send broadcast discovery message
-	go func() {
-		conn, err := net.Dial("udp", tm.discoveryAddr)
-		if err != nil {
-			errorChan <- fmt.Errorf("failed to create UDP connection: %w", err)
-			return
+// BroadcastDeparture tells every connected peer, and the local network over
+// the discovery channel, that nodeID is leaving. The discovery channel's
+// departure is signed like an announcement. Peers that don't take the
+// message within timeout are skipped.
+func (tm *TCPManager) BroadcastDeparture(nodeID string, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+
+	var wg sync.WaitGroup
+	if data, err := json.Marshal(departureMessage{Type: "DEPART", NodeID: nodeID}); err == nil {
+		tm.mutex.RLock()
+		for _, peer := range tm.connectedPeers {
+			wg.Add(1)
+			go func(peer *TCPPeer) {
+				defer wg.Done()
+				peer.sendWithin(data, deadline)
+			}(peer)
 		}
-		defer conn.Close()
+		tm.mutex.RUnlock()
+	}
 
-		// Create discovery message
-		msg := TCPDiscoveryMessage{
-			MessageType:  "DISCOVER",
-			NodeID:       "local-node", // Should be replaced with actual node ID
-			NodeName:     "BitShare Node",
-			Port:         tm.listenPort,
-			Capabilities: []string{"transfer", "mesh"},
+	if data, err := json.Marshal(tm.signedDiscoveryMessage("DEPART", departPrefix)); err == nil {
+		if conns, err := tm.sendDiscovery(data); err == nil {
+			for _, conn := range conns {
+				conn.Close()
+			}
 		}
+	}
+	wg.Wait()
+}
 
-		jsonMsg, err := json.Marshal(msg)
-		if err != nil {
-			errorChan <- fmt.Errorf("failed to marshal discovery message: %w", err)
-			return
+// announceMaxAge is how far from now the time an announcement or departure
+// was signed at may be, so old ones can't be replayed
+const announceMaxAge = 5 * time.Minute
+
+// departPrefix starts the time a departure is signed at, so the signature
+// of an announcement can't be passed off as a departure's
+const departPrefix = "depart:"
+
+// OnAnnounce sets what is told about peers announcing a change to what
+// discovery would find about them
+func (tm *TCPManager) OnAnnounce(handler func(peer PeerInfo)) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	tm.onAnnounce = handler
+}
+
+// Announce tells the local network over the discovery channel what
+// discovery would find about this node, such as a new name, without
+// waiting to be asked. It is signed like discovery answers, over the time
+// it is sent at.
+func (tm *TCPManager) Announce() error {
+	data, err := json.Marshal(tm.signedDiscoveryMessage("ANNOUNCE", ""))
+	if err != nil {
+		return err
+	}
+	conns, err := tm.sendDiscovery(data)
+	if err != nil {
+		return err
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+	return nil
+}
+
+// signedDiscoveryMessage is a discovery message of msgType about this node,
+// signed like discovery answers over prefix and the time it is made at
+func (tm *TCPManager) signedDiscoveryMessage(msgType, prefix string) TCPDiscoveryMessage {
+	tm.mutex.RLock()
+	port := tm.listenPort
+	tm.mutex.RUnlock()
+	nodeID, nodeName := tm.identity()
+	signedAt := prefix + strconv.FormatInt(time.Now().Unix(), 10)
+	public, signature := tm.prove(signedAt)
+	n := tm.currentNetwork()
+	return TCPDiscoveryMessage{
+		MessageType:  msgType,
+		NodeID:       nodeID,
+		NodeName:     nodeName,
+		Port:         port,
+		Capabilities: tm.currentCapabilities(),
+		Challenge:    signedAt,
+		PublicKey:    public,
+		Signature:    signature,
+		Network:      n.id,
+		NetworkProof: n.proof(signedAt, nodeID),
+	}
+}
+
+// checkSigned checks a message a node sent from address about itself, an
+// announcement or, signed after departPrefix, a departure: it has to come
+// from this node's network, and when it carries a key or the network has a
+// passphrase, be signed lately. It returns the key the node proved, and
+// whether to take the message.
+func (tm *TCPManager) checkSigned(msg TCPDiscoveryMessage, address, prefix string) (ed25519.PublicKey, bool) {
+	nodeID, _ := tm.identity()
+	if msg.NodeID == "" || msg.NodeID == nodeID {
+		return nil, false
+	}
+
+	n := tm.currentNetwork()
+	if err := n.check(msg.Network, msg.NetworkProof, msg.Challenge, msg.NodeID); err != nil {
+		if errors.Is(err, ErrNetworkAuth) {
+			n.warnNetworkAuth(address, msg.NodeName)
 		}
+		return nil, false
+	}
 
-		_, err = conn.Write(jsonMsg)
-		if err != nil {
-			errorChan <- fmt.Errorf("failed to send discovery message: %w", err)
+	what := "an announcement"
+	if prefix == departPrefix {
+		what = "a departure"
+	}
+	var key ed25519.PublicKey
+	if msg.PublicKey != nil || n.id != "" {
+		stamp, prefixed := strings.CutPrefix(msg.Challenge, prefix)
+		signedAt, err := strconv.ParseInt(stamp, 10, 64)
+		if !prefixed || err != nil || time.Since(time.Unix(signedAt, 0)).Abs() > announceMaxAge {
+			return nil, false
 		}
-		doneChan <- true
-	}()
+	}
+	if msg.PublicKey != nil {
+		var err error
+		if key, err = verifyIdentity(msg.NodeID, msg.PublicKey, msg.Signature, msg.Challenge); err != nil {
+			fmt.Printf("⚠️ Ignored %s from %s claiming to be %s: %v\n", what, address, msg.NodeID, err)
+			return nil, false
+		}
+		tm.noteKey(msg.NodeID)
+	} else if tm.keyKnown(msg.NodeID) {
+		fmt.Printf("⚠️ Ignored %s from %s claiming to be %s without its key\n", what, address, msg.NodeID)
+		return nil, false
+	}
+	return key, true
+}
+
+// announced passes an announcement from address on to the OnAnnounce
+// handler, once it checks out
+func (tm *TCPManager) announced(msg TCPDiscoveryMessage, address string) {
+	tm.mutex.RLock()
+	handler := tm.onAnnounce
+	tm.mutex.RUnlock()
+	if handler == nil {
+		return
+	}
+	key, ok := tm.checkSigned(msg, address, "")
+	if !ok {
+		return
+	}
+	handler(PeerInfo{
+		ID:             msg.NodeID,
+		Name:           msg.NodeName,
+		Address:        address,
+		Protocol:       "tcp",
+		Port:           msg.Port,
+		SignalStrength: 100,
+		LastSeen:       time.Now(),
+		Capabilities:   msg.Capabilities,
+		PublicKey:      key,
+	})
+}
+
+// OnNeighbors sets what is given the neighbor lists connected peers share,
+// with the node ID of the peer that sent them
+func (tm *TCPManager) OnNeighbors(handler func(from string, lists []NeighborList)) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	tm.onNeighbors = handler
+}
+
+// BroadcastNeighbors shares neighbor lists with every connected peer.
+// Peers that don't take them within timeout are skipped.
+func (tm *TCPManager) BroadcastNeighbors(nodeID string, lists []NeighborList, timeout time.Duration) {
+	data, err := json.Marshal(neighborsMessage{Type: "NEIGHBORS", NodeID: nodeID, Lists: lists})
+	if err != nil {
+		return
+	}
+	tm.sendToConnected(data, timeout)
+}
+
+// sendToConnected sends a message to every connected peer, skipping those
+// that don't take it within timeout
+func (tm *TCPManager) sendToConnected(data []byte, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+
+	var wg sync.WaitGroup
+	tm.mutex.RLock()
+	for _, peer := range tm.connectedPeers {
+		wg.Add(1)
+		go func(peer *TCPPeer) {
+			defer wg.Done()
+			peer.sendWithin(data, deadline)
+		}(peer)
+	}
+	tm.mutex.RUnlock()
+	wg.Wait()
+}
+
+// departed passes a departure announcement on to the OnDeparture handler
+func (tm *TCPManager) departed(nodeID, address string) {
+	tm.mutex.RLock()
+	handler := tm.onDeparture
+	tm.mutex.RUnlock()
+	if handler != nil && nodeID != "" {
+		handler(nodeID, address)
+	}
+}
+
+// DefaultCapabilities are what a node advertises unless SetCapabilities
+// says otherwise
+var DefaultCapabilities = []string{"transfer", "mesh"}
+
+// SetIdentity sets the node ID and name discovery messages and handshakes
+// carry. Until it is called they carry none, and the TCP service doesn't
+// start.
+func (tm *TCPManager) SetIdentity(nodeID, name string) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	tm.nodeID = nodeID
+	tm.nodeName = name
+}
+
+// SetCapabilities sets what discovery messages say the node can do
+func (tm *TCPManager) SetCapabilities(capabilities []string) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	tm.capabilities = append([]string(nil), capabilities...)
+}
 
-	// Listen for responses
+// identity returns what SetIdentity set
+func (tm *TCPManager) identity() (string, string) {
+	tm.mutex.RLock()
+	defer tm.mutex.RUnlock()
+	return tm.nodeID, tm.nodeName
+}
+
+// currentCapabilities returns what SetCapabilities set, or DefaultCapabilities
+func (tm *TCPManager) currentCapabilities() []string {
+	tm.mutex.RLock()
+	defer tm.mutex.RUnlock()
+	if tm.capabilities == nil {
+		return DefaultCapabilities
+	}
+	return tm.capabilities
+}
+
+// Discover scans the local network for BitShare TCP peers, with a UDP
+// broadcast and, unless SetMDNS turned it off, multicast DNS. Peers found
+// both ways are listed once; this node is left out. Only peers of this
+// node's network are found.
+func (tm *TCPManager) Discover(timeout time.Duration) ([]PeerInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return tm.DiscoverContext(ctx)
+}
+
+// DiscoverContext is Discover gathering answers until ctx is done, or for
+// protocolScanTimeout when ctx has no deadline. What was found by then is
+// returned, also when ctx was cancelled.
+func (tm *TCPManager) DiscoverContext(ctx context.Context) ([]PeerInfo, error) {
+	return tm.discover(ctx, tm.currentNetwork(), &authFailures{})
+}
+
+// DiscoverNetwork is Discover for the peers of the network called name,
+// with its passphrase, whatever network this node is on. Nodes of that
+// network that don't prove they know the passphrase are left out, and when
+// no other node answered it fails with ErrNetworkAuth.
+func (tm *TCPManager) DiscoverNetwork(name, passphrase string, timeout time.Duration) ([]PeerInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	failed := &authFailures{}
+	peers, err := tm.discover(ctx, newNetwork(name, passphrase), failed)
+	if err == nil && len(peers) == 0 && failed.count() > 0 {
+		return nil, fmt.Errorf("%w: %d node(s) of network '%s' answered with another passphrase", ErrNetworkAuth, failed.count(), name)
+	}
+	return peers, err
+}
+
+// discover is DiscoverContext as a node of network n, adding the nodes that
+// fail to prove they know its passphrase to failed
+func (tm *TCPManager) discover(ctx context.Context, n network, failed *authFailures) ([]PeerInfo, error) {
+	tm.mutex.RLock()
+	useMDNS := !tm.mdnsDisabled
+	tm.mutex.RUnlock()
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, protocolScanTimeout)
+		defer cancel()
+	}
+
+	var wg sync.WaitGroup
+	var broadcastPeers, mdnsPeers []PeerInfo
+	var broadcastErr, mdnsErr error
+	wg.Add(1)
 	go func() {
-		// Create UDP listener for discovery responses
-		udpAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf(":%d", tm.listenPort+1))
-		if err != nil {
-			errorChan <- fmt.Errorf("failed to resolve UDP address: %w", err)
-			return
+		defer wg.Done()
+		broadcastPeers, broadcastErr = tm.discoverBroadcast(ctx, n, failed)
+	}()
+	if useMDNS {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if n.id == "" {
+				mdnsPeers, mdnsErr = browseMDNS(ctx, n.id)
+				return
+			}
+			// The nodes found have to prove they are on the network in the
+			// time left, see verifyMDNSPeers
+			deadline, _ := ctx.Deadline()
+			browse, cancel := context.WithDeadline(ctx, deadline.Add(-time.Until(deadline)/3))
+			mdnsPeers, mdnsErr = browseMDNS(browse, n.id)
+			cancel()
+			mdnsPeers = tm.verifyMDNSPeers(ctx, mdnsPeers, n, failed)
+		}()
+	}
+	wg.Wait()
+
+	if broadcastErr != nil && (!useMDNS || mdnsErr != nil) {
+		if mdnsErr != nil {
+			return nil, fmt.Errorf("%w; mDNS: %v", broadcastErr, mdnsErr)
 		}
+		return nil, broadcastErr
+	}
 
-		conn, err := net.ListenUDP("udp", udpAddr)
-		if err != nil {
-			errorChan <- fmt.Errorf("failed to create UDP listener: %w", err)
-			return
+	nodeID, _ := tm.identity()
+	results := make([]PeerInfo, 0)
+	seen := make(map[string]bool)
+	for _, peer := range append(broadcastPeers, mdnsPeers...) {
+		if peer.ID == "" || peer.ID == nodeID || seen[peer.ID] {
+			continue
+		}
+		if peer.PublicKey != nil {
+			tm.noteKey(peer.ID)
+		} else if tm.keyKnown(peer.ID) {
+			// Someone else answering for a node that has a key
+			continue
 		}
-		defer conn.Close()
+		seen[peer.ID] = true
+		results = append(results, peer)
+	}
+	return results, nil
+}
 
-		conn.SetReadDeadline(time.Now().Add(timeout))
+// discoverBroadcast sends a DISCOVER for network n to the local networks and
+// gathers the answers until ctx is done. They come back to the sockets it
+// was sent from.
+func (tm *TCPManager) discoverBroadcast(ctx context.Context, n network, failed *authFailures) ([]PeerInfo, error) {
+	msg, jsonMsg, err := tm.discoverRequest(n)
+	if err != nil {
+		return nil, err
+	}
+	conns, err := tm.sendDiscovery(jsonMsg)
+	if err != nil {
+		return nil, err
+	}
 
-		buffer := make([]byte, 1024)
-		for {
-			n, addr, err := conn.ReadFromUDP(buffer)
-			if err != nil {
-				if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
-					break
+	// Collect responses until ctx is done
+	results := make([]PeerInfo, 0)
+	var resultsMutex sync.Mutex
+	var wg sync.WaitGroup
+	deadline, _ := ctx.Deadline()
+	for _, conn := range conns {
+		wg.Add(1)
+		go func(conn *net.UDPConn) {
+			defer wg.Done()
+			defer conn.Close()
+			conn.SetReadDeadline(deadline)
+			stop := context.AfterFunc(ctx, func() {
+				conn.SetReadDeadline(time.Now())
+			})
+			defer stop()
+			buffer := make([]byte, 1024)
+			for {
+				size, addr, err := conn.ReadFromUDP(buffer)
+				if err != nil {
+					if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+						return
+					}
+					continue
 				}
-				continue
-			}
 
-			var msg TCPDiscoveryMessage
-			err = json.Unmarshal(buffer[:n], &msg)
-			if err != nil {
-				continue
-			}
-
-			if msg.MessageType == "DISCOVER_RESPONSE" {
-				resultsChan <- PeerInfo{
-					ID:             msg.NodeID,
-					Name:           msg.NodeName,
-					Address:        addr.IP.String(),
-					Protocol:       "tcp",
-					SignalStrength: 100, // Not applicable for TCP, use maximum
-					LastSeen:       time.Now(),
-					Capabilities:   msg.Capabilities,
+				peer, err := discoverAnswer(buffer[:size], msg.Challenge, n, udpHost(addr))
+				switch {
+				case errors.Is(err, ErrNetworkAuth):
+					failed.add(peer.ID)
+					n.warnNetworkAuth(peer.Address, peer.Name)
+					continue
+				case errors.Is(err, ErrIdentityMismatch):
+					fmt.Printf("⚠️ Ignored a discovery answer from %s claiming to be %s: %v\n", peer.Address, peer.ID, err)
+					continue
+				case err != nil:
+					continue
 				}
+				resultsMutex.Lock()
+				results = append(results, peer)
+				resultsMutex.Unlock()
 			}
+		}(conn)
+	}
+	wg.Wait()
+	return results, nil
+}
+
+// QueryPeer sends a DISCOVER to the node at address alone, at the discovery
+// port of a TCP service on port, and returns its answer once it checks out
+func (tm *TCPManager) QueryPeer(address string, port int, timeout time.Duration) (PeerInfo, error) {
+	if port == 0 {
+		port = DefaultTCPPort
+	}
+	n := tm.currentNetwork()
+	msg, jsonMsg, err := tm.discoverRequest(n)
+	if err != nil {
+		return PeerInfo{}, err
+	}
+	conn, err := net.DialTimeout("udp", net.JoinHostPort(address, strconv.Itoa(port+1)), timeout)
+	if err != nil {
+		return PeerInfo{}, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(jsonMsg); err != nil {
+		return PeerInfo{}, err
+	}
+
+	buffer := make([]byte, 1024)
+	for {
+		size, err := conn.Read(buffer)
+		if err != nil {
+			return PeerInfo{}, err
 		}
-		doneChan <- true
-	}()
+		peer, err := discoverAnswer(buffer[:size], msg.Challenge, n, address)
+		if err == errNoAnswer {
+			continue
+		}
+		return peer, err
+	}
+}
+
+// errNoAnswer is returned by discoverAnswer for what isn't an answer
+var errNoAnswer = errors.New("not a discovery answer")
 
-	// Collect results with timeout
-	timer := time.NewTimer(timeout)
-	defer timer.Stop()
+// discoverRequest returns a DISCOVER for network n, and its encoding
+func (tm *TCPManager) discoverRequest(n network) (TCPDiscoveryMessage, []byte, error) {
+	tm.mutex.RLock()
+	port := tm.listenPort
+	tm.mutex.RUnlock()
 
-	// Wait for discovery message to be sent
-	<-doneChan
+	nodeID, nodeName := tm.identity()
+	msg := TCPDiscoveryMessage{
+		MessageType:  "DISCOVER",
+		NodeID:       nodeID,
+		NodeName:     nodeName,
+		Port:         port,
+		Capabilities: tm.currentCapabilities(),
+		Challenge:    newChallenge(),
+		Network:      n.id,
+	}
+	jsonMsg, err := json.Marshal(msg)
+	if err != nil {
+		return msg, nil, fmt.Errorf("failed to marshal discovery message: %w", err)
+	}
+	return msg, jsonMsg, nil
+}
 
-	// Collect responses until timeout
-	collectingResponses := true
-	for collectingResponses {
-		select {
-		case peer := <-resultsChan:
-			results = append(results, peer)
-		case err := <-errorChan:
-			return nil, err
-		case <-timer.C:
-			collectingResponses = false
+// discoverAnswer checks data, received from address, is an answer to a
+// DISCOVER for network n with challenge and returns the peer it describes.
+// The peer has its ID, name and address even when the checks fail.
+func discoverAnswer(data []byte, challenge string, n network, address string) (PeerInfo, error) {
+	var answer TCPDiscoveryMessage
+	if err := json.Unmarshal(data, &answer); err != nil || answer.MessageType != "DISCOVER_RESPONSE" {
+		return PeerInfo{}, errNoAnswer
+	}
+	peer := PeerInfo{
+		ID:             answer.NodeID,
+		Name:           answer.NodeName,
+		Address:        address,
+		Protocol:       "tcp",
+		Port:           answer.Port,
+		SignalStrength: 100, // Not applicable for TCP, use maximum
+		LastSeen:       time.Now(),
+		Capabilities:   answer.Capabilities,
+	}
+	if err := n.check(answer.Network, answer.NetworkProof, challenge, answer.NodeID); err != nil {
+		return peer, err
+	}
+	if answer.PublicKey != nil {
+		key, err := verifyIdentity(answer.NodeID, answer.PublicKey, answer.Signature, challenge)
+		if err != nil {
+			return peer, err
 		}
+		peer.PublicKey = key
 	}
-
-	return results, nil
+	return peer, nil
 }
 
-// Connect establishes a connection to a TCP peer
+// Connect establishes a connection to a TCP peer, which is tried again in
+// the background when it fails or later drops, see reconnect.go
 func (tm *TCPManager) Connect(peerAddress string, port int) error {
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", peerAddress, port))
+	if err := tm.dial(peerAddress, port); err != nil {
+		tm.reconnect("", peerAddress, port)
+		return err
+	}
+	return nil
+}
+
+// dial is Connect without trying again
+func (tm *TCPManager) dial(peerAddress string, port int) error {
+	conn, err := tm.Secure(func() (net.Conn, error) {
+		return net.DialTimeout("tcp", net.JoinHostPort(peerAddress, strconv.Itoa(port)), secureHandshakeTimeout)
+	}, secureHandshakeTimeout)
 	if err != nil {
 		return fmt.Errorf("failed to connect to peer: %w", err)
 	}
 
-	// Create a new peer
+	// Create a new peer, which the handshake names
 	peer := &TCPPeer{
-		ID:       fmt.Sprintf("tcp-%s-%d", peerAddress, port),
-		Name:     fmt.Sprintf("Peer-%s", peerAddress),
-		Address:  peerAddress,
-		Conn:     conn,
-		LastSeen: time.Now(),
+		ID:        fmt.Sprintf("tcp-%s-%d", peerAddress, port),
+		Name:      fmt.Sprintf("Peer-%s", peerAddress),
+		Address:   peerAddress,
+		Conn:      conn,
+		LastSeen:  time.Now(),
+		Security:  connSecurity(conn),
+		dialed:    net.JoinHostPort(peerAddress, strconv.Itoa(port)),
+		keepalive: newKeepalive(),
+	}
+	peer.startSendQueue()
+	if err := tm.sendHello(peer); err != nil {
+		peer.stopSendQueue()
+		conn.Close()
+		return fmt.Errorf("failed to greet peer: %w", err)
 	}
 
 	// Add to connected peers
@@ -249,30 +1013,16 @@ func (tm *TCPManager) Connect(peerAddress string, port int) error {
 	return nil
 }
 
-// SendData sends data to a connected peer
-func (tm *TCPManager) SendData(peerID string, data []byte) error {
-	tm.mutex.RLock()
-	peer, exists := tm.connectedPeers[peerID]
-	tm.mutex.RUnlock()
-
-	if !exists {
-		return fmt.Errorf("peer not connected: %s", peerID)
-	}
-
-	_, err := peer.Conn.Write(data)
-	return err
-}
-
 // Helper methods
-func (tm *TCPManager) acceptConnections() {
-	for tm.isRunning {
-		conn, err := tm.listener.Accept()
+func (tm *TCPManager) acceptConnections(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
 		if err != nil {
-			// Check if we're shutting down
+			// Check if we're shutting down or Rebind moved on
 			tm.mutex.RLock()
-			running := tm.isRunning
+			current := tm.isRunning && tm.listener == listener
 			tm.mutex.RUnlock()
-			if !running {
+			if !current {
 				return
 			}
 
@@ -280,25 +1030,88 @@ func (tm *TCPManager) acceptConnections() {
 			continue
 		}
 
+		// Blocked peers are turned away without a word, see access.Blocklist
+		if access.RefuseBlocked(conn.RemoteAddr()) != nil {
+			conn.Close()
+			continue
+		}
+
+		// The access lists are read for each connection so changes apply
+		// without restarting the node
+		rules, err := access.Load()
+		if err == nil {
+			err = rules.Check(conn.RemoteAddr())
+		}
+		if err != nil {
+			fmt.Printf("Refused TCP connection from %s: %v\n", conn.RemoteAddr(), err)
+			conn.Close()
+			continue
+		}
+
+		tm.mutex.RLock()
+		limiter := tm.limiter
+		tm.mutex.RUnlock()
+		release, err := limiter.Acquire(conn.RemoteAddr())
+		if err != nil {
+			fmt.Printf("Turned away TCP connection from %s: %v\n", conn.RemoteAddr(), err)
+			tm.sendBusy(conn, err)
+			continue
+		}
+
 		// Handle the connection in a new goroutine
-		go tm.handleConnection(conn)
+		go func() {
+			defer release()
+			tm.handleConnection(conn)
+		}()
+	}
+}
+
+// ServeConn handles conn as if the listener had accepted it, for
+// connections that arrive some other way, such as sessions through a relay.
+// It returns when the connection is closed.
+func (tm *TCPManager) ServeConn(conn net.Conn) {
+	tm.mutex.RLock()
+	limiter, running := tm.limiter, tm.isRunning
+	tm.mutex.RUnlock()
+	if !running {
+		conn.Close()
+		return
+	}
+
+	release, err := limiter.Acquire(conn.RemoteAddr())
+	if err != nil {
+		fmt.Printf("Turned away TCP connection from %s: %v\n", conn.RemoteAddr(), err)
+		tm.sendBusy(conn, err)
+		return
 	}
+	defer release()
+	tm.handleConnection(conn)
 }
 
+// handleConnection secures an accepted connection and serves the node at
+// the other end, which the handshake names, until it goes
 func (tm *TCPManager) handleConnection(conn net.Conn) {
-	// In a real implementation, this would handle the connection protocol
-	// For now, just log the connection
 	remoteAddr := conn.RemoteAddr().String()
-	fmt.Printf("New TCP connection from: %s\n", remoteAddr)
+	secured, err := tm.acceptSecure(conn)
+	if err != nil {
+		fmt.Printf("Dropped TCP connection from %s: %v\n", remoteAddr, err)
+		conn.Close()
+		return
+	}
+	conn = secured
+	fmt.Printf("New TCP connection from: %s (%s)\n", remoteAddr, connSecurity(conn))
 
 	// Create a new peer
 	peer := &TCPPeer{
-		ID:       fmt.Sprintf("tcp-%x", time.Now().UnixNano()),
-		Name:     fmt.Sprintf("Peer-%s", remoteAddr),
-		Address:  remoteAddr,
-		Conn:     conn,
-		LastSeen: time.Now(),
+		ID:        fmt.Sprintf("tcp-%x", time.Now().UnixNano()),
+		Name:      fmt.Sprintf("Peer-%s", remoteAddr),
+		Address:   remoteAddr,
+		Conn:      conn,
+		LastSeen:  time.Now(),
+		Security:  connSecurity(conn),
+		keepalive: newKeepalive(),
 	}
+	peer.startSendQueue()
 
 	// Add to connected peers
 	tm.mutex.Lock()
@@ -310,9 +1123,13 @@ func (tm *TCPManager) handleConnection(conn net.Conn) {
 }
 
 func (tm *TCPManager) handlePeer(peer *TCPPeer) {
-	reader := bufio.NewReader(peer.Conn)
+	defer peer.keepalive.end()
+	go tm.keepAlive(peer)
+	reader := bufio.NewReader(activityReader{peer.Conn, peer.keepalive})
+	peer.reader = reader
 
 	const maxMessageSize = 100 * 1024 * 1024 // 100MB maximum message size
+	failed := false                          // The handshake failed
 
 	// Set read timeout to prevent hanging connections
 	peer.Conn.SetReadDeadline(time.Now().Add(5 * time.Minute))
@@ -326,7 +1143,7 @@ func (tm *TCPManager) handlePeer(peer *TCPPeer) {
 		// Read message length
 		lengthBytes := make([]byte, 4)
 		if _, err := io.ReadFull(reader, lengthBytes); err != nil {
-			if err != io.EOF {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
 				logError("Read error: %v", err)
 			}
 			break
@@ -352,51 +1169,69 @@ func (tm *TCPManager) handlePeer(peer *TCPPeer) {
 			break
 		}
 
-		// Update last seen time (only necessary field update)
+		// Read under the lock by the keepalive and GetConnectedPeers
+		tm.mutex.Lock()
 		peer.LastSeen = time.Now()
+		tm.mutex.Unlock()
 
 		// Process message (only log errors, not every message)
 		if err := tm.processMessage(peer, message); err != nil {
+			if errors.Is(err, errSpliced) {
+				// The connection belongs to a local port now, see splice.go
+				tm.forget(peer)
+				return
+			}
 			logError("Processing error: %v", err)
 			// Only break on fatal errors
 			if isFatalError(err) {
+				failed = true
 				break
 			}
 		}
 	}
 
 	// Clean up peer connection
-	tm.mutex.Lock()
-	delete(tm.connectedPeers, peer.ID)
-	tm.mutex.Unlock()
+	tm.forget(peer)
+	peer.stopSendQueue()
 	peer.Conn.Close()
+	tm.dropStreams(peer.Conn)
+
+	// Connections this node opened are opened again, see reconnect.go
+	if host, port, err := net.SplitHostPort(peer.dialed); err == nil && !failed {
+		tm.mutex.RLock()
+		id := peer.ID
+		tm.mutex.RUnlock()
+		if number, err := strconv.Atoi(port); err == nil {
+			tm.reconnect(id, host, number)
+		}
+	}
+}
+
+// forget takes peer off the connected peers, unless another connection
+// took its place
+func (tm *TCPManager) forget(peer *TCPPeer) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	if tm.connectedPeers[peer.ID] == peer {
+		delete(tm.connectedPeers, peer.ID)
+	}
 }
 
 // isFatalError determines if an error should cause connection termination
 func isFatalError(err error) bool {
-	// Check for specific error types that warrant disconnection
-	// For example: protocol violations, authentication failures
-	return false // Default to non-fatal
+	// Failed handshakes, see handshake.go
+	return errors.Is(err, errHandshake)
 }
 
-// processMessage handles different message types more efficiently
+// processMessage hands a message to its handler, see messages.go
 func (tm *TCPManager) processMessage(peer *TCPPeer, message []byte) error {
-	// Only log occasional messages or specific events, not every message
 	if len(message) > 0 && message[0] == '{' {
-		// Try parsing as JSON
 		var msgHeader struct {
 			Type string `json:"type"`
 		}
 
-		if err := json.Unmarshal(message, &msgHeader); err == nil {
-			// Process based on message type with a more efficient switch
-			switch msgHeader.Type {
-			case "PING":
-				return tm.sendPong(peer)
-			case "DATA_TRANSFER", "MESH_ROUTE":
-				return tm.routeMessage(peer, msgHeader.Type, message)
-			}
-			return nil
+		if err := json.Unmarshal(message, &msgHeader); err == nil && msgHeader.Type != "" {
+			return tm.dispatch(peer, msgHeader.Type, message)
 		}
 	}
 
@@ -408,28 +1243,82 @@ func (tm *TCPManager) processMessage(peer *TCPPeer, message []byte) error {
 func (tm *TCPManager) sendPong(peer *TCPPeer) error {
 	// Send a simple pong response
 	response := []byte(`{"type":"PONG","time":` + fmt.Sprint(time.Now().Unix()) + `}`)
-	_, err := peer.Conn.Write(packMessage(response))
-	return err
+	return peer.send(response)
 }
 
-func (tm *TCPManager) routeMessage(peer *TCPPeer, msgType string, data []byte) error {
-	// Currently a stub - mark unused parameters to avoid linter warnings
-	// but keep the parameters for future implementation
-	_ = msgType
-	_ = data
+// Ping sends a PING over conn, a connection to another node's TCP service,
+// and waits up to timeout for the PONG
+func Ping(conn net.Conn, timeout time.Duration) error {
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
 
-	// Log that we received a message of this type
-	fmt.Printf("[TCP:%s] Received %s message (%d bytes)\n", peer.ID, msgType, len(data))
+	if _, err := conn.Write(packMessage([]byte(`{"type":"PING"}`))); err != nil {
+		return err
+	}
+	answer, err := readAnswer(conn, 64*1024)
+	if err != nil {
+		return err
+	}
+	var header struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(answer, &header); err != nil || header.Type != "PONG" {
+		return errors.New("peer didn't answer the ping")
+	}
 	return nil
 }
 
+// sendBusy tells a peer over the connection limits why it is turned away
+// and closes its connection
+func (tm *TCPManager) sendBusy(conn net.Conn, reason error) {
+	defer conn.Close()
+	response, err := json.Marshal(map[string]string{"type": "BUSY", "error": reason.Error()})
+	if err != nil {
+		return
+	}
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	conn.Write(packMessage(response))
+}
+
+// routeMessage takes the MESH_ROUTE frames of routed streams and messages
+// (see route.go and routed.go), and DATA_TRANSFER messages, data wrapped in
+// JSON by older nodes, which goes to the OnData handler as if sent raw.
+// Transfers themselves run over connections of their own, see
+// transfer.SendFileChunked.
+func (tm *TCPManager) routeMessage(peer *TCPPeer, msgType string, data []byte) error {
+	if msgType == "MESH_ROUTE" {
+		var frame routeFrame
+		if err := json.Unmarshal(data, &frame); err != nil {
+			return err
+		}
+		tm.handleRouteFrame(peer.Conn, frame)
+		return nil
+	}
+
+	var transfer struct {
+		Data []byte `json:"data"`
+	}
+	if err := json.Unmarshal(data, &transfer); err != nil {
+		return err
+	}
+	if len(transfer.Data) == 0 {
+		return nil
+	}
+	return tm.processBinaryMessage(peer, transfer.Data)
+}
+
+// processBinaryMessage hands raw data to the OnData handler
 func (tm *TCPManager) processBinaryMessage(peer *TCPPeer, data []byte) error {
-	// Currently a stub - mark unused parameters to avoid linter warnings
-	// but keep the parameters for future implementation
-	_ = data
+	tm.mutex.RLock()
+	handler := tm.onData
+	info := peer.info()
+	tm.mutex.RUnlock()
 
-	// Just log the binary message for now
-	fmt.Printf("[TCP:%s] Received binary message (%d bytes)\n", peer.ID, len(data))
+	if handler == nil {
+		fmt.Printf("[TCP:%s] Received binary message (%d bytes)\n", info.ID, len(data))
+		return nil
+	}
+	handler(info, data)
 	return nil
 }
 
@@ -440,24 +1329,18 @@ func packMessage(data []byte) []byte {
 	return append(length, data...)
 }
 
-func (tm *TCPManager) startDiscoveryService() {
-	// Listen for discovery messages
-	udpAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf(":%d", tm.listenPort+1))
-	if err != nil {
-		fmt.Printf("Failed to resolve UDP address for discovery: %v\n", err)
-		return
-	}
-
-	conn, err := net.ListenUDP("udp", udpAddr)
-	if err != nil {
-		fmt.Printf("Failed to create UDP listener for discovery: %v\n", err)
-		return
-	}
-	defer conn.Close()
+func (tm *TCPManager) startDiscoveryService(conn *net.UDPConn) {
+	// Listen for discovery messages until Stop closes conn
+	tm.mutex.RLock()
+	port := tm.listenPort
+	tm.mutex.RUnlock()
 
 	buffer := make([]byte, 1024)
-	for tm.isRunning {
+	for {
 		n, addr, err := conn.ReadFromUDP(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			continue
 		}
@@ -468,14 +1351,43 @@ func (tm *TCPManager) startDiscoveryService() {
 			continue
 		}
 
+		if msg.MessageType == "DEPART" {
+			if _, ok := tm.checkSigned(msg, udpHost(addr), departPrefix); ok {
+				tm.departed(msg.NodeID, udpHost(addr))
+			}
+			continue
+		}
+		if msg.MessageType == "ANNOUNCE" {
+			tm.announced(msg, udpHost(addr))
+			continue
+		}
+
 		if msg.MessageType == "DISCOVER" {
-			// Send response
+			// Nodes of other networks aren't answered at all, nor this
+			// node's own discovery
+			n := tm.currentNetwork()
+			nodeID, nodeName := tm.identity()
+			if msg.Network != n.id || nodeID == "" || msg.NodeID == nodeID {
+				continue
+			}
+			if !tm.firstQuery(msg.NodeID, msg.Challenge) {
+				continue
+			}
+
+			// Send response, with the ID peers know this node by across
+			// restarts and the proofs that it is this node's and that it
+			// knows the network's passphrase
+			public, signature := tm.prove(msg.Challenge)
 			response := TCPDiscoveryMessage{
 				MessageType:  "DISCOVER_RESPONSE",
-				NodeID:       "local-node", // Should be replaced with actual node ID
-				NodeName:     "BitShare Node",
-				Port:         tm.listenPort,
-				Capabilities: []string{"transfer", "mesh"},
+				NodeID:       nodeID,
+				NodeName:     nodeName,
+				Port:         port,
+				Capabilities: tm.currentCapabilities(),
+				PublicKey:    public,
+				Signature:    signature,
+				Network:      n.id,
+				NetworkProof: n.proof(msg.Challenge, nodeID),
 			}
 
 			jsonResponse, err := json.Marshal(response)
@@ -0,0 +1,212 @@
+package p2p
+
+import (
+	"encoding/json"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// ipv6Loopback skips the test on machines without IPv6 on loopback
+func ipv6Loopback(t *testing.T) {
+	t.Helper()
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	listener.Close()
+}
+
+// TestConnectIPv6 connects two nodes over [::1] and checks the address the
+// peer is known by dials it again
+func TestConnectIPv6(t *testing.T) {
+	ipv6Loopback(t)
+	a, b := startTestNode(t, "a"), startTestNode(t, "b")
+
+	if err := a.dial("::1", b.listenPort); err != nil {
+		t.Fatal(err)
+	}
+	var peer TCPPeer
+	waitFor(t, "a to learn who b is", func() bool {
+		a.mutex.RLock()
+		defer a.mutex.RUnlock()
+		if known := a.connectedPeers[b.id]; known != nil {
+			peer = TCPPeer{Address: known.Address, dialed: known.dialed}
+			return true
+		}
+		return false
+	})
+	if want := net.JoinHostPort("::1", strconv.Itoa(b.listenPort)); peer.dialed != want || peer.Address != "::1" {
+		t.Fatalf("peer known at %q, dialed %q, want ::1 and %q", peer.Address, peer.dialed, want)
+	}
+	conn, err := net.Dial("tcp", peer.dialed)
+	if err != nil {
+		t.Fatalf("dialing %s again: %v", peer.dialed, err)
+	}
+	conn.Close()
+}
+
+func TestUDPHost(t *testing.T) {
+	tests := []struct {
+		addr net.UDPAddr
+		want string
+	}{
+		{net.UDPAddr{IP: net.ParseIP("192.168.1.20"), Port: 9001}, "192.168.1.20"},
+		{net.UDPAddr{IP: net.ParseIP("::1"), Port: 9001}, "::1"},
+		{net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 9001, Zone: "eth0"}, "fe80::1%eth0"},
+	}
+	for _, test := range tests {
+		got := udpHost(&test.addr)
+		if got != test.want {
+			t.Errorf("udpHost(%v) = %q, want %q", &test.addr, got, test.want)
+		}
+		// It joins with a port into an address that resolves back to addr
+		resolved, err := net.ResolveUDPAddr("udp", net.JoinHostPort(got, "9001"))
+		if err != nil || !resolved.IP.Equal(test.addr.IP) || resolved.Zone != test.addr.Zone {
+			t.Errorf("%q resolves to %v (%v)", got, resolved, err)
+		}
+	}
+}
+
+// TestDepartOverConnection checks a connected peer can only say it is
+// leaving itself, not another node
+func TestDepartOverConnection(t *testing.T) {
+	a, b := startTestNode(t, "a"), startTestNode(t, "b")
+	departures := make(chan string, 2)
+	a.OnDeparture(func(nodeID, _ string) { departures <- nodeID })
+
+	if err := b.dial("127.0.0.1", a.listenPort); err != nil {
+		t.Fatal(err)
+	}
+	var toA *TCPPeer
+	waitFor(t, "b and a to know who each other are", func() bool {
+		a.mutex.RLock()
+		known := a.connectedPeers[b.id] != nil
+		a.mutex.RUnlock()
+		b.mutex.RLock()
+		defer b.mutex.RUnlock()
+		toA = b.connectedPeers[a.id]
+		return known && toA != nil
+	})
+
+	for _, nodeID := range []string{"someone-else", b.id} {
+		data, err := json.Marshal(departureMessage{Type: "DEPART", NodeID: nodeID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := toA.send(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case departed := <-departures:
+		if departed != b.id {
+			t.Fatalf("a took %s as departed, want only b", departed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a never took b's departure")
+	}
+}
+
+// TestDepartOverDiscovery checks departures over the discovery channel are
+// only taken from the node's network and signed by the node
+func TestDepartOverDiscovery(t *testing.T) {
+	a, b, c := startTestNode(t, "a"), startTestNode(t, "b"), startTestNode(t, "c")
+	departures := make(chan string, 8)
+	a.OnDeparture(func(nodeID, _ string) { departures <- nodeID })
+	a.noteKey(b.id)
+
+	tests := []struct {
+		name string
+		msg  func() TCPDiscoveryMessage
+		take bool
+	}{
+		{"unsigned", func() TCPDiscoveryMessage {
+			return TCPDiscoveryMessage{MessageType: "DEPART", NodeID: b.id}
+		}, false},
+		{"announcement passed off as a departure", func() TCPDiscoveryMessage {
+			msg := b.signedDiscoveryMessage("ANNOUNCE", "")
+			msg.MessageType = "DEPART"
+			return msg
+		}, false},
+		{"from another network", func() TCPDiscoveryMessage {
+			b.SetNetwork("other", "other passphrase")
+			defer b.SetNetwork("", "")
+			return b.signedDiscoveryMessage("DEPART", departPrefix)
+		}, false},
+		{"signed", func() TCPDiscoveryMessage {
+			return b.signedDiscoveryMessage("DEPART", departPrefix)
+		}, true},
+	}
+	send := func(msg TCPDiscoveryMessage) {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := net.Dial("udp", net.JoinHostPort("127.0.0.1", strconv.Itoa(a.listenPort+1)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if _, err := conn.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			send(test.msg())
+			// c's departure, which a takes, shows a read b's
+			send(c.signedDiscoveryMessage("DEPART", departPrefix))
+			var taken []string
+			for len(taken) == 0 || taken[len(taken)-1] != c.id {
+				select {
+				case departed := <-departures:
+					taken = append(taken, departed)
+				case <-time.After(5 * time.Second):
+					t.Fatalf("a never took c's departure, took %v", taken)
+				}
+			}
+			if tookB := len(taken) == 2 && taken[0] == b.id; tookB != test.take || len(taken) > 2 {
+				t.Errorf("a took departures %v, want b's taken %t", taken, test.take)
+			}
+		})
+	}
+}
+
+// TestRebind checks a node moved to another port is reached there, not at
+// the old one, and keeps the peers it had
+func TestRebind(t *testing.T) {
+	a, b, c := startTestNode(t, "a"), startTestNode(t, "b"), startTestNode(t, "c")
+	if err := b.dial("127.0.0.1", a.listenPort); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "a to learn who b is", func() bool {
+		a.mutex.RLock()
+		defer a.mutex.RUnlock()
+		return a.connectedPeers[b.id] != nil
+	})
+
+	old, port := a.listenPort, freePort(t)
+	if err := a.Rebind(port); err != nil {
+		t.Fatal(err)
+	}
+	if conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(old)), time.Second); err == nil {
+		conn.Close()
+		t.Errorf("a still listens at its old port %d", old)
+	}
+	if err := c.dial("127.0.0.1", port); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "a to learn who c is", func() bool {
+		a.mutex.RLock()
+		defer a.mutex.RUnlock()
+		return a.connectedPeers[c.id] != nil
+	})
+	a.mutex.RLock()
+	kept := a.connectedPeers[b.id] != nil
+	a.mutex.RUnlock()
+	if !kept {
+		t.Error("a dropped b when it moved")
+	}
+}
@@ -0,0 +1,135 @@
+package p2p
+
+import (
+	"sort"
+	"time"
+)
+
+// Transports
+//
+// A node may be found over several protocols at once, over TCP on the local
+// network and over WiFi Direct, say. Since its node ID is the same on all
+// of them (see identity.go), the sightings are merged into one PeerInfo,
+// which keeps a Transport for each protocol, best first, and takes its
+// Address, Protocol and SignalStrength from the best one. The mesh merges
+// the peers it knows the same way.
+//
+// Transports seen lately beat ones that weren't, then the stronger signal
+// wins, then the protocol that carries the most, in the order of
+// transportRank.
+
+// Transport is one way a peer was found and can be reached
+type Transport struct {
+	Protocol       string    `json:"protocol"`
+	Address        string    `json:"address"`
+	SignalStrength int       `json:"signal"` // 0-100%
+	LastSeen       time.Time `json:"last_seen"`
+}
+
+// transportRank orders protocols of equal signal, lower first
+var transportRank = map[string]int{
+	"tcp":         0,
+	"wifi-direct": 1,
+	"bluetooth":   2,
+}
+
+// Transport returns the way info says the peer was found
+func (info PeerInfo) Transport() Transport {
+	return Transport{
+		Protocol:       info.Protocol,
+		Address:        info.Address,
+		SignalStrength: info.SignalStrength,
+		LastSeen:       info.LastSeen,
+	}
+}
+
+// MergeTransports returns transports with the sightings added, each in place
+// of the one of its protocol, best first, see above. Transports not seen for
+// staleAfter count as stale; zero means none do. transports isn't changed.
+func MergeTransports(transports []Transport, staleAfter time.Duration, sightings ...Transport) []Transport {
+	merged := make([]Transport, 0, len(transports)+len(sightings))
+	merged = append(merged, transports...)
+	for _, sighting := range sightings {
+		if sighting.Protocol == "" || sighting.Address == "" {
+			continue
+		}
+		replaced := false
+		for i, t := range merged {
+			if t.Protocol == sighting.Protocol {
+				if !sighting.LastSeen.Before(t.LastSeen) {
+					merged[i] = sighting
+				}
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			merged = append(merged, sighting)
+		}
+	}
+
+	now := time.Now()
+	stale := func(t Transport) bool {
+		return staleAfter > 0 && now.Sub(t.LastSeen) > staleAfter
+	}
+	sort.SliceStable(merged, func(i, j int) bool {
+		a, b := merged[i], merged[j]
+		if stale(a) != stale(b) {
+			return !stale(a)
+		}
+		if a.SignalStrength != b.SignalStrength {
+			return a.SignalStrength > b.SignalStrength
+		}
+		return rank(a.Protocol) < rank(b.Protocol)
+	})
+	return merged
+}
+
+// rank is the place of protocol in transportRank, unknown ones last
+func rank(protocol string) int {
+	if r, ok := transportRank[protocol]; ok {
+		return r
+	}
+	return len(transportRank)
+}
+
+// mergePeerInfos merges the peers found several times, over different
+// protocols, into one each, see above
+func mergePeerInfos(peers []PeerInfo) []PeerInfo {
+	merged := make([]PeerInfo, 0, len(peers))
+	index := make(map[string]int)
+	for _, peer := range peers {
+		i, seen := index[peer.ID]
+		if !seen {
+			index[peer.ID] = len(merged)
+			peer.Transports = MergeTransports(nil, 0, peer.Transport())
+			merged = append(merged, peer)
+			continue
+		}
+
+		// What only one protocol tells, such as the key and the port of
+		// the TCP service, is kept whichever is best
+		existing := &merged[i]
+		if existing.PublicKey == nil {
+			existing.PublicKey = peer.PublicKey
+		}
+		if existing.Port == 0 {
+			existing.Port = peer.Port
+		}
+		if existing.Version == "" {
+			existing.Version = peer.Version
+		}
+		if len(existing.Capabilities) == 0 {
+			existing.Capabilities = peer.Capabilities
+		}
+		existing.Transports = MergeTransports(existing.Transports, 0, peer.Transport())
+		if len(existing.Transports) > 0 {
+			best := existing.Transports[0]
+			existing.Address, existing.Protocol, existing.SignalStrength = best.Address, best.Protocol, best.SignalStrength
+		}
+		if peer.LastSeen.After(existing.LastSeen) {
+			existing.LastSeen = peer.LastSeen
+		}
+	}
+	return merged
+}
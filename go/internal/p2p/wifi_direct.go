@@ -8,6 +8,15 @@ import (
 	"time"
 )
 
+// WiFi Direct
+//
+// WiFi Direct links devices without a router: one of them owns a group,
+// which the others join like an access point. The WiFi Direct stack of the
+// OS does the radio part through a wifiDirectDriver (see
+// wifi_direct_<os>.go); the manager listens for connections over the group
+// and finds devices with the driver. Devices without a stack the manager
+// can drive aren't supported, and Start says so.
+
 // WiFiDirectManager handles WiFi Direct connections
 type WiFiDirectManager struct {
 	isRunning      bool
@@ -15,6 +24,35 @@ type WiFiDirectManager struct {
 	connectedPeers map[string]*WiFiDirectPeer
 	mutex          sync.RWMutex
 	config         WiFiDirectConfig
+	driver         wifiDirectDriver // Set while running
+	group          string           // Interface of the group this device owns or joined
+	nodeID         string           // Set by SetIdentity
+	onLinked       func(address string)
+}
+
+// wifiDirectDriver is the WiFi Direct stack of the OS
+type wifiDirectDriver interface {
+	// advertise has what other devices find of this one carry the
+	// advertisement, see wifi_direct_groups.go
+	advertise(serviceName, nodeID string) error
+
+	// startGroup creates a group this device owns, named from the service
+	// name advertised, and returns its interface once it has an address.
+	// Drivers that learn of the devices joining it tell the manager, see
+	// linked.
+	startGroup() (string, error)
+
+	// joinGroup joins the group owner owns, and returns the interface once
+	// it has an address, and the address of the owner on the group
+	joinGroup(owner PeerInfo) (iface, ownerAddress string, err error)
+
+	// stopGroup removes the group on iface, or leaves it
+	stopGroup(iface string) error
+
+	// discover searches for devices for timeout and returns those found
+	discover(timeout time.Duration) ([]PeerInfo, error)
+
+	close() error
 }
 
 // WiFiDirectConfig contains WiFi Direct configuration
@@ -75,16 +113,21 @@ func (wdm *WiFiDirectManager) Start() error {
 		return errors.New("WiFi Direct is not supported on this device")
 	}
 
-	// Start the WiFi Direct service
-	if wdm.config.GroupOwner {
-		// Start as group owner (acts like an access point)
-		err = wdm.startAsGroupOwner()
-	} else {
-		// Start as client
-		err = wdm.startAsClient()
+	wdm.driver, err = newWiFiDirectDriver()
+	if err != nil {
+		return fmt.Errorf("failed to start WiFi Direct: %w", err)
+	}
+
+	// Start the WiFi Direct service, as the owner of a group unless another
+	// node is to own it, see wifi_direct_groups.go
+	err = wdm.driver.advertise(wdm.config.ServiceName, wdm.nodeID)
+	if err == nil {
+		err = wdm.startGroupOrJoin()
 	}
 
 	if err != nil {
+		wdm.driver.close()
+		wdm.driver = nil
 		return fmt.Errorf("failed to start WiFi Direct: %w", err)
 	}
 
@@ -110,46 +153,39 @@ func (wdm *WiFiDirectManager) Stop() error {
 
 	// Close all connections
 	for _, peer := range wdm.connectedPeers {
-		peer.Conn.Close()
+		if peer.Conn != nil {
+			peer.Conn.Close()
+		}
+	}
+
+	var err error
+	if wdm.group != "" {
+		err = wdm.driver.stopGroup(wdm.group)
+		wdm.group = ""
 	}
+	wdm.driver.close()
+	wdm.driver = nil
 
 	wdm.isRunning = false
-	return nil
+	return err
+}
+
+// IsRunning reports whether the WiFi Direct service is running, in a group
+func (wdm *WiFiDirectManager) IsRunning() bool {
+	wdm.mutex.RLock()
+	defer wdm.mutex.RUnlock()
+	return wdm.isRunning
 }
 
 // Discover scans for nearby WiFi Direct devices
 func (wdm *WiFiDirectManager) Discover(timeout time.Duration) ([]PeerInfo, error) {
-	// Implementation would use platform-specific APIs to discover WiFi Direct devices
-	// This is a placeholder implementation
-
-	// On real implementation, this would use:
-	// - Windows: WiFi Direct API via Windows.Devices.WiFiDirect namespace
-	// - Linux: wpa_supplicant and nl80211 interfaces
-	// - Android: WifiP2pManager API
-	// - iOS: MultipeerConnectivity framework
-
-	peers := []PeerInfo{
-		{
-			ID:             "wd-device1",
-			Name:           "Laptop-ABC",
-			Address:        "192.168.49.10",
-			Protocol:       "wifi-direct",
-			SignalStrength: 85,
-			LastSeen:       time.Now(),
-			Capabilities:   []string{"transfer", "mesh"},
-		},
-		{
-			ID:             "wd-device2",
-			Name:           "Tablet-XYZ",
-			Address:        "192.168.49.11",
-			Protocol:       "wifi-direct",
-			SignalStrength: 70,
-			LastSeen:       time.Now(),
-			Capabilities:   []string{"transfer"},
-		},
+	wdm.mutex.RLock()
+	running, driver := wdm.isRunning, wdm.driver
+	wdm.mutex.RUnlock()
+	if !running {
+		return nil, fmt.Errorf("WiFi Direct %w", ErrNotRunning)
 	}
-
-	return peers, nil
+	return driver.discover(timeout)
 }
 
 // Connect establishes a connection to a WiFi Direct peer
@@ -165,7 +201,7 @@ func (wdm *WiFiDirectManager) SendData(peerID string, data []byte) error {
 	peer, exists := wdm.connectedPeers[peerID]
 	wdm.mutex.RUnlock()
 
-	if !exists {
+	if !exists || peer.Conn == nil {
 		return fmt.Errorf("peer not connected: %s", peerID)
 	}
 
@@ -180,18 +216,18 @@ func (wdm *WiFiDirectManager) startAsGroupOwner() error {
 	if err != nil {
 		return err
 	}
-	wdm.listener = listener
 
-	// In a real implementation, this would advertise the service using platform-specific APIs
-	fmt.Printf("Started WiFi Direct group with service name: %s\n", wdm.config.ServiceName)
+	group, err := wdm.driver.startGroup()
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	wdm.listener = listener
+	wdm.group = group
+	fmt.Printf("Started WiFi Direct group on %s with service name: %s\n", group, wdm.config.ServiceName)
 	return nil
 }
 
-func (wdm *WiFiDirectManager) startAsClient() error {
-	// In a real implementation, this would join an existing group
-	return errors.New("client mode not implemented")
-}
-
 func (wdm *WiFiDirectManager) acceptConnections() {
 	for wdm.isRunning {
 		conn, err := wdm.listener.Accept()
@@ -213,9 +249,9 @@ func (wdm *WiFiDirectManager) acceptConnections() {
 	}
 }
 
+// handleConnection keeps track of a device connected to the listener until
+// its connection closes
 func (wdm *WiFiDirectManager) handleConnection(conn net.Conn) {
-	// In a real implementation, this would handle the connection protocol
-	// For now, just log the connection
 	remoteAddr := conn.RemoteAddr().String()
 	fmt.Printf("New connection from: %s\n", remoteAddr)
 
@@ -261,9 +297,33 @@ func (wdm *WiFiDirectManager) handleConnection(conn net.Conn) {
 	conn.Close()
 }
 
-// Helper functions for platform detection and support
-func isWiFiDirectSupported() (bool, error) {
-	// In a real implementation, this would check if WiFi Direct is supported on this device
-	// For now, just return true
-	return true, nil
+// linked adds a device the driver saw join the group, before it connects
+// to the listener, with the address it has on the link
+func (wdm *WiFiDirectManager) linked(peer *WiFiDirectPeer) {
+	wdm.mutex.Lock()
+	defer wdm.mutex.Unlock()
+	if !wdm.isRunning {
+		return
+	}
+	wdm.connectedPeers[peer.ID] = peer
+	fmt.Printf("WiFi Direct device %s joined at %s\n", peer.Name, peer.Address)
+	if wdm.onLinked != nil {
+		go wdm.onLinked(peer.Address)
+	}
+}
+
+// unlinked drops a device the driver saw leave the group
+func (wdm *WiFiDirectManager) unlinked(peerID string) {
+	wdm.mutex.Lock()
+	defer wdm.mutex.Unlock()
+	if peer, ok := wdm.connectedPeers[peerID]; ok {
+		delete(wdm.connectedPeers, peerID)
+		fmt.Printf("WiFi Direct device %s left\n", peer.Name)
+	}
+}
+
+// signalPercent maps a signal in dBm to 0-100%, -100 dBm and less being
+// nothing and -50 dBm and more full
+func signalPercent(dbm int) int {
+	return min(max(2*(dbm+100), 0), 100)
 }
@@ -0,0 +1,208 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strings"
+	"time"
+)
+
+// WiFi Direct groups
+//
+// A device is in one WiFi Direct group at a time, so two nodes that both own
+// a group can't reach each other. Nodes find out about each other in WiFi
+// Direct discovery instead: each advertises its service name and node ID
+// (see advertisement), and drivers file the devices that carry one under the
+// node ID instead of their device address. Starting, a node searches for
+// negotiateTimeout, and when it finds nodes with a greater node ID than its
+// own, the greatest of them is to own the group and this one joins it;
+// otherwise it owns one itself. Nodes started the same way so end up in the
+// group of the greatest one around. A node set not to own groups joins that
+// of the greatest node it finds.
+//
+// The owner of a group is at wifiDirectOwnerIP on it. Clients get their
+// address on the group's subnet from the owner if it hands them out, or else
+// take one of their own from their node ID (see clientAddress). Once joined,
+// the OnLinked handler is told where the owner is, as it is of the devices
+// drivers see join a group this node owns.
+
+const (
+	// negotiateTimeout is how long a node searches for others before
+	// starting a group
+	negotiateTimeout = 5 * time.Second
+
+	// joinTimeout bounds how long joining a group may take, the owner
+	// perhaps still starting it
+	joinTimeout = 30 * time.Second
+
+	// joinRetryDelay is how long to wait before trying to join again
+	joinRetryDelay = 2 * time.Second
+
+	// wifiDirectDevicePrefix starts the IDs of devices found that aren't
+	// nodes, followed by their device address
+	wifiDirectDevicePrefix = "wd-"
+
+	// wifiDirectOwnerIP is the address of the owner on a group, where WiFi
+	// Direct group owners usually are
+	wifiDirectOwnerIP = "192.168.49.1"
+)
+
+// bitShareOUI and bitShareOUIType mark the vendor information element that
+// carries the advertisement, locally administered
+var bitShareOUI = []byte{0x02, 0x42, 0x53}
+
+const bitShareOUIType = 1
+
+// SetIdentity sets the node ID the manager advertises, see above
+func (wdm *WiFiDirectManager) SetIdentity(nodeID string) {
+	wdm.mutex.Lock()
+	defer wdm.mutex.Unlock()
+	wdm.nodeID = nodeID
+}
+
+// OnLinked sets the handler told the address of the other end of each link
+// to a node over WiFi Direct: the owner of a group this node joined, or a
+// device that joined the group it owns
+func (wdm *WiFiDirectManager) OnLinked(handler func(address string)) {
+	wdm.mutex.Lock()
+	defer wdm.mutex.Unlock()
+	wdm.onLinked = handler
+}
+
+// advertisement is what a node carries in WiFi Direct discovery
+func advertisement(serviceName, nodeID string) string {
+	return serviceName + " " + nodeID
+}
+
+// parseAdvertisement returns the node ID in an advertisement for serviceName
+func parseAdvertisement(value, serviceName string) (string, bool) {
+	name, nodeID, ok := strings.Cut(value, " ")
+	if !ok || name != serviceName || nodeID == "" {
+		return "", false
+	}
+	return nodeID, true
+}
+
+// vendorElement returns the vendor information element carrying value,
+// tag, length, OUI, OUI type and value
+func vendorElement(value string) ([]byte, error) {
+	length := len(bitShareOUI) + 1 + len(value)
+	if length > 255 {
+		return nil, errors.New("advertisement too long")
+	}
+	element := append([]byte{0xdd, byte(length)}, bitShareOUI...)
+	element = append(element, bitShareOUIType)
+	return append(element, value...), nil
+}
+
+// parseVendorElements returns the value of the vendor information element
+// carrying an advertisement among elements
+func parseVendorElements(elements []byte) (string, bool) {
+	for len(elements) >= 2 {
+		tag, length := elements[0], int(elements[1])
+		if len(elements) < 2+length {
+			break
+		}
+		body := elements[2 : 2+length]
+		elements = elements[2+length:]
+		if tag == 0xdd && length >= len(bitShareOUI)+1 &&
+			string(body[:len(bitShareOUI)]) == string(bitShareOUI) && body[len(bitShareOUI)] == bitShareOUIType {
+			return string(body[len(bitShareOUI)+1:]), true
+		}
+	}
+	return "", false
+}
+
+// clientAddress is the address a client takes on a group whose owner hands
+// out none, in 192.168.49.2-254 by its node ID
+func clientAddress(nodeID string) string {
+	hash := fnv.New32a()
+	hash.Write([]byte(nodeID))
+	return fmt.Sprintf("192.168.49.%d", 2+hash.Sum32()%253)
+}
+
+// startGroupOrJoin starts this node's part in WiFi Direct, see above
+func (wdm *WiFiDirectManager) startGroupOrJoin() error {
+	if !wdm.config.GroupOwner {
+		return wdm.startAsClient()
+	}
+
+	owner, found, err := wdm.greatestNode(negotiateTimeout, wdm.nodeID)
+	if err != nil {
+		return err
+	}
+	if !found {
+		// Start as group owner (acts like an access point)
+		return wdm.startAsGroupOwner()
+	}
+	fmt.Printf("WiFi Direct: %s is to own the group, joining it\n", owner.Name)
+	return wdm.joinGroup(owner)
+}
+
+// startAsClient joins the group of the greatest node found within joinTimeout
+func (wdm *WiFiDirectManager) startAsClient() error {
+	deadline := time.Now().Add(joinTimeout)
+	for time.Now().Before(deadline) {
+		owner, found, err := wdm.greatestNode(negotiateTimeout, "")
+		if err != nil {
+			return err
+		}
+		if found {
+			return wdm.joinGroup(owner)
+		}
+	}
+	return errors.New("found no group to join")
+}
+
+// greatestNode searches for timeout and returns the node found with the
+// greatest node ID, if it is greater than above
+func (wdm *WiFiDirectManager) greatestNode(timeout time.Duration, above string) (PeerInfo, bool, error) {
+	devices, err := wdm.driver.discover(timeout)
+	if err != nil {
+		return PeerInfo{}, false, err
+	}
+	var greatest PeerInfo
+	found := false
+	for _, device := range devices {
+		if strings.HasPrefix(device.ID, wifiDirectDevicePrefix) || device.ID <= above {
+			continue
+		}
+		if !found || device.ID > greatest.ID {
+			greatest, found = device, true
+		}
+	}
+	return greatest, found, nil
+}
+
+// joinGroup joins the group of owner, trying again while it may still be
+// starting it, and tells the OnLinked handler
+func (wdm *WiFiDirectManager) joinGroup(owner PeerInfo) error {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", wdm.config.ListenPort))
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(joinTimeout)
+	var iface, ownerAddress string
+	for {
+		iface, ownerAddress, err = wdm.driver.joinGroup(owner)
+		if err == nil || time.Now().Add(joinRetryDelay).After(deadline) {
+			break
+		}
+		time.Sleep(joinRetryDelay)
+	}
+	if err != nil {
+		listener.Close()
+		return fmt.Errorf("could not join the group of %s: %w", owner.Name, err)
+	}
+
+	wdm.listener = listener
+	wdm.group = iface
+	fmt.Printf("Joined the WiFi Direct group of %s on %s\n", owner.Name, iface)
+	if wdm.onLinked != nil {
+		go wdm.onLinked(ownerAddress)
+	}
+	return nil
+}
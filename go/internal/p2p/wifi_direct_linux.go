@@ -0,0 +1,479 @@
+package p2p
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WiFi Direct on Linux
+//
+// wpa_supplicant runs WiFi Direct on Linux. The driver talks to it over its
+// control interface, a Unix datagram socket per network interface in
+// /run/wpa_supplicant, with the commands wpa_cli sends: P2P_FIND searches
+// for devices, P2P_PEER tells what was found, with the signal level, and
+// P2P_GROUP_ADD starts a group this device owns and P2P_CONNECT with join
+// joins one. wpa_supplicant announces the group's interface on a second
+// socket attached for events, and since it doesn't address the group, the
+// owner takes wifiDirectOwnerIP, and a client that gets no address from the
+// owner its own, unless something else addressed them. The owner keeps push
+// button WPS on for the group, so the nodes negotiating can join without
+// anyone pressing anything. The advertisement goes in a vendor element of
+// the probe responses and beacons, which P2P_PEER shows of other devices.
+//
+// WiFi Direct is supported when wpa_supplicant runs with P2P on one of the
+// interfaces: the control interface of the P2P device, p2p-dev-wlan0 for
+// wlan0, or of an interface whose STATUS has a P2P device address.
+
+var wpaControlDirs = []string{"/run/wpa_supplicant", "/var/run/wpa_supplicant"}
+
+const (
+	// wpaRequestTimeout bounds how long wpa_supplicant may take to answer
+	wpaRequestTimeout = 5 * time.Second
+
+	// groupStartTimeout bounds how long starting a group may take
+	groupStartTimeout = 20 * time.Second
+
+	// dhcpTimeout is how long a client waits for an address from the owner
+	dhcpTimeout = 10 * time.Second
+
+	// wpsWindow is how often the owner turns push button WPS on again, a
+	// little under the two minutes it stays on
+	wpsWindow = 110 * time.Second
+)
+
+// vendorElementFrames are the frames the advertisement goes in: P2P probe
+// requests and responses, those of a group owner and its beacons
+var vendorElementFrames = []int{0, 1, 2, 3}
+
+// errNoP2PInterface is returned when no interface does WiFi Direct
+var errNoP2PInterface = errors.New("no wpa_supplicant interface with WiFi Direct (P2P) support")
+
+func isWiFiDirectSupported() (bool, error) {
+	control, err := openP2PControl()
+	if errors.Is(err, errNoP2PInterface) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	control.close()
+	return true, nil
+}
+
+func newWiFiDirectDriver() (wifiDirectDriver, error) {
+	control, err := openP2PControl()
+	if err != nil {
+		return nil, err
+	}
+	return &wpaDriver{control: control}, nil
+}
+
+// wpaDriver drives WiFi Direct through wpa_supplicant, see above
+type wpaDriver struct {
+	control     *wpaControl
+	serviceName string
+	nodeID      string
+	element     string        // Hex of the vendor element advertised, if any
+	stopWPS     chan struct{} // Closed to stop keeping WPS on for the owned group
+}
+
+func (d *wpaDriver) advertise(serviceName, nodeID string) error {
+	d.serviceName, d.nodeID = serviceName, nodeID
+	if nodeID == "" {
+		return nil
+	}
+	element, err := vendorElement(advertisement(serviceName, nodeID))
+	if err != nil {
+		return err
+	}
+	d.element = hex.EncodeToString(element)
+	for _, frame := range vendorElementFrames {
+		if _, err := d.control.expectOK(fmt.Sprintf("VENDOR_ELEM_ADD %d %s", frame, d.element)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *wpaDriver) startGroup() (string, error) {
+	// Groups are named DIRECT-xy-<serviceName>
+	if _, err := d.control.expectOK("P2P_SET ssid_postfix -" + d.serviceName); err != nil {
+		return "", err
+	}
+	iface, role, err := d.formGroup("P2P_GROUP_ADD")
+	if err != nil {
+		return "", err
+	}
+	if role != "GO" {
+		d.stopGroup(iface)
+		return "", fmt.Errorf("group started as %s", role)
+	}
+
+	if err := addressGroup(iface, wifiDirectOwnerIP, 0); err != nil {
+		d.stopGroup(iface)
+		return "", err
+	}
+	d.stopWPS = make(chan struct{})
+	go d.keepWPS(iface, d.stopWPS)
+	return iface, nil
+}
+
+func (d *wpaDriver) joinGroup(owner PeerInfo) (string, string, error) {
+	iface, role, err := d.formGroup("P2P_CONNECT " + owner.Address + " pbc join")
+	if err != nil {
+		return "", "", err
+	}
+	if role != "client" {
+		d.stopGroup(iface)
+		return "", "", fmt.Errorf("group started as %s", role)
+	}
+	if err := addressGroup(iface, clientAddress(d.nodeID), dhcpTimeout); err != nil {
+		d.stopGroup(iface)
+		return "", "", err
+	}
+	return iface, wifiDirectOwnerIP, nil
+}
+
+// formGroup sends command, which starts or joins a group, and returns the
+// group's interface and this device's role in it once it started
+func (d *wpaDriver) formGroup(command string) (string, string, error) {
+	events, err := openWPAControl(d.control.path)
+	if err != nil {
+		return "", "", err
+	}
+	defer events.close()
+	if _, err := events.expectOK("ATTACH"); err != nil {
+		return "", "", err
+	}
+	defer events.request("DETACH")
+
+	if _, err := d.control.expectOK(command); err != nil {
+		return "", "", err
+	}
+	started, err := events.waitFor("P2P-GROUP-STARTED", time.Now().Add(groupStartTimeout))
+	if err != nil {
+		return "", "", fmt.Errorf("group didn't start: %w", err)
+	}
+	// P2P-GROUP-STARTED <interface> GO|client ssid="..." ...
+	fields := strings.Fields(started)
+	if len(fields) < 2 {
+		return "", "", fmt.Errorf("group started without an interface: %s", started)
+	}
+	return fields[0], fields[1], nil
+}
+
+// keepWPS keeps push button WPS on for the group on iface until stop closes
+func (d *wpaDriver) keepWPS(iface string, stop <-chan struct{}) {
+	group, err := openWPAControl(filepath.Join(filepath.Dir(d.control.path), iface))
+	if err != nil {
+		fmt.Printf("WiFi Direct: no control over the group %s: %v\n", iface, err)
+		return
+	}
+	defer group.close()
+
+	ticker := time.NewTicker(wpsWindow)
+	defer ticker.Stop()
+	for {
+		if _, err := group.expectOK("WPS_PBC"); err != nil {
+			fmt.Printf("WiFi Direct: devices can't join %s: %v\n", iface, err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (d *wpaDriver) stopGroup(iface string) error {
+	if d.stopWPS != nil {
+		close(d.stopWPS)
+		d.stopWPS = nil
+	}
+	_, err := d.control.expectOK("P2P_GROUP_REMOVE " + iface)
+	return err
+}
+
+func (d *wpaDriver) discover(timeout time.Duration) ([]PeerInfo, error) {
+	started := time.Now()
+	seconds := max(int(math.Ceil(timeout.Seconds())), 1)
+	if _, err := d.control.expectOK("P2P_FIND " + strconv.Itoa(seconds)); err != nil {
+		return nil, err
+	}
+	time.Sleep(timeout)
+	d.control.request("P2P_STOP_FIND")
+
+	var peers []PeerInfo
+	for command := "P2P_PEER FIRST"; ; {
+		answer, err := d.control.request(command)
+		if err != nil {
+			return peers, err
+		}
+		peer, ok := parseP2PPeer(answer, d.serviceName)
+		if !ok {
+			break
+		}
+		command = "P2P_PEER NEXT-" + peer.Address
+		// Devices remembered from earlier searches weren't found now
+		if time.Since(peer.LastSeen) <= time.Since(started)+time.Second {
+			peers = append(peers, peer)
+		}
+	}
+	return peers, nil
+}
+
+func (d *wpaDriver) close() error {
+	if d.element != "" {
+		for _, frame := range vendorElementFrames {
+			d.control.request(fmt.Sprintf("VENDOR_ELEM_REMOVE %d %s", frame, d.element))
+		}
+	}
+	return d.control.close()
+}
+
+// parseP2PPeer reads the answer to P2P_PEER: the device address, then a
+// line of key=value for each of what wpa_supplicant knows about it. Nodes
+// advertising for serviceName get their node ID for ID.
+func parseP2PPeer(answer, serviceName string) (PeerInfo, bool) {
+	lines := bufio.NewScanner(strings.NewReader(answer))
+	if !lines.Scan() {
+		return PeerInfo{}, false
+	}
+	address := strings.TrimSpace(lines.Text())
+	if _, err := net.ParseMAC(address); err != nil {
+		// FAIL, after the last one
+		return PeerInfo{}, false
+	}
+
+	peer := PeerInfo{
+		ID:       wifiDirectDevicePrefix + address,
+		Name:     address,
+		Address:  address,
+		Protocol: "wifi-direct",
+		LastSeen: time.Now(),
+	}
+	for lines.Scan() {
+		key, value, ok := strings.Cut(lines.Text(), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "device_name":
+			if value != "" {
+				peer.Name = value
+			}
+		case "level":
+			if level, err := strconv.Atoi(value); err == nil {
+				peer.SignalStrength = signalPercent(level)
+			}
+		case "age":
+			if age, err := strconv.Atoi(value); err == nil {
+				peer.LastSeen = time.Now().Add(-time.Duration(age) * time.Second)
+			}
+		case "vendor_elems":
+			elements, err := hex.DecodeString(value)
+			if err != nil {
+				continue
+			}
+			if advertised, ok := parseVendorElements(elements); ok {
+				if nodeID, ok := parseAdvertisement(advertised, serviceName); ok {
+					peer.ID = nodeID
+				}
+			}
+		}
+	}
+	return peer, true
+}
+
+// addressGroup gives the group interface iface the address ip unless it
+// has one, or gets one within wait
+func addressGroup(iface, ip string, wait time.Duration) error {
+	deadline := time.Now().Add(wait)
+	for {
+		addressed, err := hasIPv4(iface)
+		if err != nil || addressed {
+			return err
+		}
+		if time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	if out, err := exec.Command("ip", "addr", "add", ip+"/24", "dev", iface).CombinedOutput(); err != nil {
+		return fmt.Errorf("could not address %s: %v %s", iface, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// hasIPv4 reports whether iface has an IPv4 address
+func hasIPv4(iface string) (bool, error) {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return false, err
+	}
+	addresses, err := ifi.Addrs()
+	if err != nil {
+		return false, err
+	}
+	for _, address := range addresses {
+		if ipNet, ok := address.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// openP2PControl opens the control interface of wpa_supplicant for the
+// first interface that does WiFi Direct, the P2P devices first
+func openP2PControl() (*wpaControl, error) {
+	var candidates []string
+	for _, dir := range wpaControlDirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if entry.Type()&os.ModeSocket == 0 || (strings.HasPrefix(name, "p2p-") && !strings.HasPrefix(name, "p2p-dev-")) {
+				// Not a control interface, or that of a group
+				continue
+			}
+			path := filepath.Join(dir, name)
+			if strings.HasPrefix(name, "p2p-dev-") {
+				candidates = append([]string{path}, candidates...)
+			} else {
+				candidates = append(candidates, path)
+			}
+		}
+		if len(candidates) > 0 {
+			// The other directory is usually the same one
+			break
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("%w: wpa_supplicant isn't running", errNoP2PInterface)
+	}
+
+	var firstErr error
+	for _, path := range candidates {
+		control, err := openWPAControl(path)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if status, err := control.request("STATUS"); err == nil && strings.Contains(status, "p2p_device_address=") {
+			return control, nil
+		}
+		control.close()
+	}
+	if firstErr != nil && errors.Is(firstErr, os.ErrPermission) {
+		return nil, fmt.Errorf("no access to wpa_supplicant: %w", firstErr)
+	}
+	return nil, errNoP2PInterface
+}
+
+// wpaControl is a connection to the control interface of wpa_supplicant
+type wpaControl struct {
+	path  string // Of the control interface
+	conn  *net.UnixConn
+	local string // Of this end, which wpa_supplicant answers to
+	mutex sync.Mutex
+}
+
+var wpaClients atomic.Int64
+
+func openWPAControl(path string) (*wpaControl, error) {
+	local := filepath.Join(os.TempDir(), fmt.Sprintf("bitshare-wpa-%d-%d", os.Getpid(), wpaClients.Add(1)))
+	conn, err := net.DialUnix("unixgram",
+		&net.UnixAddr{Name: local, Net: "unixgram"},
+		&net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		os.Remove(local)
+		return nil, err
+	}
+	return &wpaControl{path: path, conn: conn, local: local}, nil
+}
+
+// request sends command and returns the answer, skipping events
+func (c *wpaControl) request(command string) (string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	deadline := time.Now().Add(wpaRequestTimeout)
+	c.conn.SetDeadline(deadline)
+	if _, err := c.conn.Write([]byte(command)); err != nil {
+		return "", err
+	}
+	buffer := make([]byte, 4096)
+	for {
+		n, err := c.conn.Read(buffer)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", command, err)
+		}
+		answer := string(buffer[:n])
+		if !strings.HasPrefix(answer, "<") {
+			return answer, nil
+		}
+	}
+}
+
+// expectOK sends command and returns an error unless it answers OK, or
+// what it returns for commands that answer with something else
+func (c *wpaControl) expectOK(command string) (string, error) {
+	answer, err := c.request(command)
+	if err != nil {
+		return "", err
+	}
+	answer = strings.TrimSpace(answer)
+	if answer == "FAIL" || strings.HasPrefix(answer, "FAIL-") || answer == "UNKNOWN COMMAND" {
+		return "", fmt.Errorf("wpa_supplicant refused %s: %s", strings.Fields(command)[0], answer)
+	}
+	return answer, nil
+}
+
+// waitFor reads events until one of kind, and returns the rest of it; the
+// connection must be attached
+func (c *wpaControl) waitFor(kind string, deadline time.Time) (string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.conn.SetDeadline(deadline)
+	buffer := make([]byte, 4096)
+	for {
+		n, err := c.conn.Read(buffer)
+		if err != nil {
+			return "", err
+		}
+		// Events start with their level, as in <3>
+		event := string(buffer[:n])
+		if end := strings.IndexByte(event, '>'); strings.HasPrefix(event, "<") && end > 0 {
+			event = event[end+1:]
+		}
+		if rest, ok := strings.CutPrefix(event, kind); ok && (rest == "" || rest[0] == ' ') {
+			return strings.TrimSpace(rest), nil
+		}
+		for _, failure := range []string{"P2P-GROUP-FORMATION-FAILURE", "P2P-GO-NEG-FAILURE", "WPS-TIMEOUT", "WPS-FAIL"} {
+			if strings.HasPrefix(event, failure) {
+				return "", errors.New(event)
+			}
+		}
+	}
+}
+
+func (c *wpaControl) close() error {
+	err := c.conn.Close()
+	os.Remove(c.local)
+	return err
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !windows
+
+package p2p
+
+import "errors"
+
+func isWiFiDirectSupported() (bool, error) {
+	return false, nil
+}
+
+func newWiFiDirectDriver() (wifiDirectDriver, error) {
+	return nil, errors.New("WiFi Direct is not supported on this OS")
+}
@@ -0,0 +1,416 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WiFi Direct on Windows
+//
+// Windows runs WiFi Direct through the WinRT API in Windows.Devices.WiFiDirect.
+// The driver calls it from PowerShell, see winrt_windows.go.
+//
+// A script that keeps running publishes a WiFiDirectAdvertisement carrying
+// the advertisement in an information element, as an autonomous group owner
+// once startGroup asks for it, accepts the connection requests of a
+// WiFiDirectConnectionListener and reports the devices that connect, with
+// their addresses, and those that leave. Joining a group is another one,
+// which pairs with the owner, asking to be the client, and holds the link
+// until it is killed; Windows addresses the link itself. Discover runs a
+// DeviceWatcher over the WiFi Direct devices around for its timeout.
+//
+// WiFi Direct is supported when PowerShell loads the WinRT types and there
+// is a Wi-Fi Direct virtual adapter.
+
+const (
+	// publisherStartTimeout bounds how long starting the advertisement may take
+	publisherStartTimeout = 20 * time.Second
+
+	// pairTimeout bounds how long pairing with an owner and linking may take
+	pairTimeout = 20 * time.Second
+
+	// publisherGroup and joinedGroup name the groups to stopGroup, the OS
+	// picking the interface of each link itself
+	publisherGroup = "wifi-direct-publisher"
+	joinedGroup    = "wifi-direct-link"
+)
+
+// wifiDirectPrelude is winrtPrelude with the WinRT types the scripts use,
+// see winrt_windows.go
+const wifiDirectPrelude = winrtPrelude + `
+$null = [Windows.Devices.WiFiDirect.WiFiDirectDevice, Windows.Devices.WiFiDirect, ContentType = WindowsRuntime]
+$null = [Windows.Devices.WiFiDirect.WiFiDirectAdvertisementPublisher, Windows.Devices.WiFiDirect, ContentType = WindowsRuntime]
+$null = [Windows.Devices.WiFiDirect.WiFiDirectConnectionListener, Windows.Devices.WiFiDirect, ContentType = WindowsRuntime]
+$null = [Windows.Devices.WiFiDirect.WiFiDirectInformationElement, Windows.Devices.WiFiDirect, ContentType = WindowsRuntime]
+$null = [Windows.Devices.WiFiDirect.WiFiDirectConnectionParameters, Windows.Devices.WiFiDirect, ContentType = WindowsRuntime]
+$null = [Windows.Devices.Enumeration.DeviceInformation, Windows.Devices.Enumeration, ContentType = WindowsRuntime]
+$null = [Windows.Devices.Enumeration.DevicePairingResult, Windows.Devices.Enumeration, ContentType = WindowsRuntime]
+$null = [Windows.Security.Cryptography.CryptographicBuffer, Windows.Security.Cryptography, ContentType = WindowsRuntime]
+`
+
+// supportScript prints yes when WiFi Direct can be used
+const supportScript = `
+$null = [Windows.Devices.WiFiDirect.WiFiDirectDevice]::GetDeviceSelector()
+$adapter = Get-NetAdapter -IncludeHidden -ErrorAction SilentlyContinue | Where-Object { $_.InterfaceDescription -like '*Wi-Fi Direct*' }
+if ($adapter) { 'yes' } else { 'no' }
+`
+
+// publishScript advertises this device, see above; $advertised, $oui,
+// $ouiType and $autonomous are set before it
+const publishScript = `
+$publisher = [Windows.Devices.WiFiDirect.WiFiDirectAdvertisementPublisher]::new()
+$advertisement = $publisher.Advertisement
+$advertisement.IsAutonomousGroupOwnerEnabled = $autonomous
+$advertisement.ListenStateDiscoverability = [Windows.Devices.WiFiDirect.WiFiDirectAdvertisementListenStateDiscoverability]::Normal
+if ($advertised) {
+	$element = [Windows.Devices.WiFiDirect.WiFiDirectInformationElement]::new()
+	$element.Oui = [Windows.Security.Cryptography.CryptographicBuffer]::CreateFromByteArray([byte[]]$oui)
+	$element.OuiType = $ouiType
+	$element.Value = [Windows.Security.Cryptography.CryptographicBuffer]::ConvertStringToBinary($advertised, [Windows.Security.Cryptography.BinaryStringEncoding]::Utf8)
+	$advertisement.InformationElements.Add($element)
+}
+
+$listener = [Windows.Devices.WiFiDirect.WiFiDirectConnectionListener]::new()
+$null = Register-ObjectEvent -InputObject $listener -EventName ConnectionRequested -SourceIdentifier Requested
+$publisher.Start()
+if ($publisher.Status -ne [Windows.Devices.WiFiDirect.WiFiDirectAdvertisementPublisherStatus]::Started) {
+	Emit @{ event = 'error'; error = "advertisement is $($publisher.Status)" }
+	exit 1
+}
+Emit @{ event = 'started' }
+
+$devices = @{}
+while ($true) {
+	$raised = Wait-Event
+	Remove-Event -EventIdentifier $raised.EventIdentifier
+	if ($raised.SourceIdentifier -like 'Status-*') {
+		$id = $raised.SourceIdentifier.Substring(7)
+		$device = $devices[$id]
+		if ($device -and $device.ConnectionStatus -eq [Windows.Devices.WiFiDirect.WiFiDirectConnectionStatus]::Disconnected) {
+			Unregister-Event -SourceIdentifier $raised.SourceIdentifier
+			$devices.Remove($id)
+			$device.Dispose()
+			Emit @{ event = 'disconnected'; id = $id }
+		}
+		continue
+	}
+
+	$request = $raised.SourceEventArgs.GetConnectionRequest()
+	$info = $request.DeviceInformation
+	try {
+		$device = Await ([Windows.Devices.WiFiDirect.WiFiDirectDevice]::FromIdAsync($info.Id)) ([Windows.Devices.WiFiDirect.WiFiDirectDevice])
+		$pairs = $device.GetConnectionEndpointPairs()
+		if ($pairs.Count -eq 0) { throw 'no address on the link' }
+		$devices[$info.Id] = $device
+		$null = Register-ObjectEvent -InputObject $device -EventName ConnectionStatusChanged -SourceIdentifier ('Status-' + $info.Id)
+		Emit @{ event = 'connected'; id = $info.Id; name = $info.Name; address = $pairs[0].RemoteHostName.DisplayName }
+	} catch {
+		Emit @{ event = 'error'; error = "connection from $($info.Name) failed: $_" }
+	} finally {
+		$request.Dispose()
+	}
+}
+`
+
+// joinScript joins the group of the device with the information ID $id and
+// holds the link, see above
+const joinScript = `
+$info = Await ([Windows.Devices.Enumeration.DeviceInformation]::CreateFromIdAsync($id)) ([Windows.Devices.Enumeration.DeviceInformation])
+if (-not $info.Pairing.IsPaired) {
+	$custom = $info.Pairing.Custom
+	$null = Register-ObjectEvent -InputObject $custom -EventName PairingRequested -Action { $EventArgs.Accept() }
+	$parameters = [Windows.Devices.WiFiDirect.WiFiDirectConnectionParameters]::new()
+	$parameters.GroupOwnerIntent = 0
+	$pairing = $custom.PairAsync([Windows.Devices.Enumeration.DevicePairingKinds]::ConfirmOnly, [Windows.Devices.Enumeration.DevicePairingProtectionLevel]::Default, $parameters)
+	$result = Await $pairing ([Windows.Devices.Enumeration.DevicePairingResult])
+	if ($result.Status -ne 'Paired' -and $result.Status -ne 'AlreadyPaired') {
+		Emit @{ event = 'error'; error = "pairing with $($info.Name) failed: $($result.Status)" }
+		exit 1
+	}
+}
+try {
+	$device = Await ([Windows.Devices.WiFiDirect.WiFiDirectDevice]::FromIdAsync($id)) ([Windows.Devices.WiFiDirect.WiFiDirectDevice])
+	$pairs = $device.GetConnectionEndpointPairs()
+	if ($pairs.Count -eq 0) { throw 'no address on the link' }
+} catch {
+	Emit @{ event = 'error'; error = "connecting to $($info.Name) failed: $_" }
+	exit 1
+}
+Emit @{ event = 'connected'; id = $id; name = $info.Name; address = $pairs[0].RemoteHostName.DisplayName }
+
+$null = Register-ObjectEvent -InputObject $device -EventName ConnectionStatusChanged -SourceIdentifier Status
+while ($device.ConnectionStatus -ne [Windows.Devices.WiFiDirect.WiFiDirectConnectionStatus]::Disconnected) {
+	$null = Wait-Event -SourceIdentifier Status -Timeout 5
+	Remove-Event -SourceIdentifier Status -ErrorAction SilentlyContinue
+}
+Emit @{ event = 'disconnected'; id = $id }
+`
+
+// watchScript reports the WiFi Direct devices a DeviceWatcher finds in
+// $seconds, with the advertisement of those that carry one in the element
+// of $oui and $ouiType
+const watchScript = `
+$selector = [Windows.Devices.WiFiDirect.WiFiDirectDevice]::GetDeviceSelector([Windows.Devices.WiFiDirect.WiFiDirectDeviceSelectorType]::AssociationEndpoint)
+$properties = [string[]]@('System.Devices.Aep.DeviceAddress', 'System.Devices.Aep.SignalStrength')
+$watcher = [Windows.Devices.Enumeration.DeviceInformation]::CreateWatcher($selector, $properties, [Windows.Devices.Enumeration.DeviceInformationKind]::AssociationEndpoint)
+$found = @{}
+$null = Register-ObjectEvent -InputObject $watcher -EventName Added -SourceIdentifier Added -MessageData $found -Action {
+	$Event.MessageData[$EventArgs.Id] = $EventArgs
+}
+$null = Register-ObjectEvent -InputObject $watcher -EventName Updated -SourceIdentifier Updated -MessageData $found -Action {
+	if ($Event.MessageData.ContainsKey($EventArgs.Id)) { $Event.MessageData[$EventArgs.Id].Update($EventArgs) }
+}
+$watcher.Start()
+Start-Sleep -Milliseconds ([int]($seconds * 1000))
+$watcher.Stop()
+foreach ($info in @($found.Values)) {
+	$signal = $info.Properties['System.Devices.Aep.SignalStrength']
+	$advertised = $null
+	try {
+		foreach ($element in [Windows.Devices.WiFiDirect.WiFiDirectInformationElement]::CreateFromDeviceInformation($info)) {
+			$bytes = $null
+			[Windows.Security.Cryptography.CryptographicBuffer]::CopyToByteArray($element.Oui, [ref]$bytes)
+			if ((Compare-Object $bytes ([byte[]]$oui) -SyncWindow 0) -eq $null -and $element.OuiType -eq $ouiType) {
+				$advertised = [Windows.Security.Cryptography.CryptographicBuffer]::ConvertBinaryToString([Windows.Security.Cryptography.BinaryStringEncoding]::Utf8, $element.Value)
+			}
+		}
+	} catch {
+		# Devices that carry no elements
+	}
+	Emit @{
+		event = 'found'
+		id = $info.Id
+		name = $info.Name
+		address = $info.Properties['System.Devices.Aep.DeviceAddress']
+		signal = $(if ($signal -ne $null) { [int]$signal } else { $null })
+		advertised = $advertised
+	}
+}
+`
+
+func isWiFiDirectSupported() (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), scriptStartSlack)
+	defer cancel()
+	out, err := powershell(ctx, wifiDirectPrelude+supportScript).Output()
+	if err != nil {
+		// No PowerShell or no WinRT
+		return false, nil
+	}
+	return strings.TrimSpace(string(out)) == "yes", nil
+}
+
+func newWiFiDirectDriver() (wifiDirectDriver, error) {
+	return &winrtDriver{devices: make(map[string]string)}, nil
+}
+
+// winrtDriver drives WiFi Direct through WinRT, see above
+type winrtDriver struct {
+	mutex         sync.Mutex
+	serviceName   string
+	advertisement string
+	publisher     *exec.Cmd         // The script advertising this device
+	owner         bool              // Whether the publisher owns a group
+	joined        *exec.Cmd         // The script holding the link to a group joined
+	devices       map[string]string // Device information IDs by device address, as last found
+}
+
+func (d *winrtDriver) advertise(serviceName, nodeID string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.serviceName = serviceName
+	if nodeID != "" {
+		d.advertisement = advertisement(serviceName, nodeID)
+	}
+	// Found, but not owning a group until startGroup
+	return d.publish(false)
+}
+
+func (d *winrtDriver) startGroup() (string, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.owner {
+		return "", errors.New("WiFi Direct group already started")
+	}
+	if err := d.publish(true); err != nil {
+		return "", err
+	}
+	return publisherGroup, nil
+}
+
+// publish starts the script advertising this device in place of the one
+// running, owning a group if owner is set
+func (d *winrtDriver) publish(owner bool) error {
+	if d.publisher != nil {
+		d.publisher.Process.Kill()
+		d.publisher = nil
+	}
+
+	oui := make([]string, len(bitShareOUI))
+	for i, b := range bitShareOUI {
+		oui[i] = fmt.Sprint(b)
+	}
+	script := fmt.Sprintf("$advertised = %s\n$oui = @(%s)\n$ouiType = %d\n$autonomous = $%t\n",
+		psQuote(d.advertisement), strings.Join(oui, ","), bitShareOUIType, owner) + wifiDirectPrelude + publishScript
+	cmd, events, err := startScript(script, "started", publisherStartTimeout)
+	if err != nil {
+		return fmt.Errorf("advertisement didn't start: %w", err)
+	}
+	d.publisher, d.owner = cmd, owner
+	go d.followGroup(cmd, events)
+	return nil
+}
+
+// followGroup hands the devices that connect to this one, and leave, to the
+// manager until the script ends
+func (d *winrtDriver) followGroup(cmd *exec.Cmd, events <-chan winrtEvent) {
+	wdm := GetWiFiDirectManager()
+	for event := range events {
+		switch event.Event {
+		case "connected":
+			wdm.linked(&WiFiDirectPeer{
+				ID:       wifiDirectDevicePrefix + event.ID,
+				Name:     event.Name,
+				Address:  event.Address,
+				LastSeen: time.Now(),
+			})
+		case "disconnected":
+			wdm.unlinked(wifiDirectDevicePrefix + event.ID)
+		case "error":
+			fmt.Printf("WiFi Direct: %s\n", event.Error)
+		}
+	}
+	cmd.Wait()
+
+	d.mutex.Lock()
+	if d.publisher == cmd {
+		d.publisher, d.owner = nil, false
+		fmt.Println("WiFi Direct advertisement stopped")
+	}
+	d.mutex.Unlock()
+}
+
+func (d *winrtDriver) joinGroup(owner PeerInfo) (string, string, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	id, ok := d.devices[owner.Address]
+	if !ok {
+		return "", "", fmt.Errorf("%s wasn't found", owner.Name)
+	}
+	if d.joined != nil {
+		return "", "", errors.New("already in a WiFi Direct group")
+	}
+
+	script := fmt.Sprintf("$id = %s\n", psQuote(id)) + wifiDirectPrelude + joinScript
+	cmd, events, err := startScript(script, "connected", pairTimeout)
+	if err != nil {
+		return "", "", err
+	}
+	connected := <-events
+	d.joined = cmd
+	go func() {
+		for event := range events {
+			if event.Event == "disconnected" {
+				fmt.Printf("WiFi Direct: lost the link to %s\n", owner.Name)
+			}
+		}
+		cmd.Wait()
+		d.mutex.Lock()
+		if d.joined == cmd {
+			d.joined = nil
+		}
+		d.mutex.Unlock()
+	}()
+	return joinedGroup, connected.Address, nil
+}
+
+func (d *winrtDriver) stopGroup(group string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if group == joinedGroup {
+		cmd := d.joined
+		d.joined = nil
+		if cmd == nil {
+			return nil
+		}
+		return cmd.Process.Kill()
+	}
+	cmd := d.publisher
+	d.publisher, d.owner = nil, false
+	if cmd == nil {
+		return nil
+	}
+	return cmd.Process.Kill()
+}
+
+func (d *winrtDriver) discover(timeout time.Duration) ([]PeerInfo, error) {
+	oui := make([]string, len(bitShareOUI))
+	for i, b := range bitShareOUI {
+		oui[i] = fmt.Sprint(b)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout+scriptStartSlack)
+	defer cancel()
+	script := fmt.Sprintf("$seconds = %f\n$oui = @(%s)\n$ouiType = %d\n",
+		timeout.Seconds(), strings.Join(oui, ","), bitShareOUIType) + wifiDirectPrelude + watchScript
+	cmd := powershell(ctx, script)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("could not run PowerShell: %w", err)
+	}
+
+	events := make(chan winrtEvent)
+	go readEvents(stdout, events)
+	var peers []PeerInfo
+	d.mutex.Lock()
+	serviceName := d.serviceName
+	d.mutex.Unlock()
+	for event := range events {
+		if event.Event != "found" {
+			continue
+		}
+		address := event.Address
+		if address == "" {
+			address = event.ID
+		}
+		peer := PeerInfo{
+			ID:       wifiDirectDevicePrefix + address,
+			Name:     event.Name,
+			Address:  address,
+			Protocol: "wifi-direct",
+			LastSeen: time.Now(),
+		}
+		if nodeID, ok := parseAdvertisement(event.Advertised, serviceName); ok {
+			peer.ID = nodeID
+		}
+		if event.Signal != nil {
+			peer.SignalStrength = signalPercent(*event.Signal)
+		}
+		peers = append(peers, peer)
+		d.mutex.Lock()
+		d.devices[address] = event.ID
+		d.mutex.Unlock()
+	}
+	if err := cmd.Wait(); err != nil && len(peers) == 0 {
+		return nil, fmt.Errorf("WiFi Direct scan failed: %w", err)
+	}
+	return peers, nil
+}
+
+func (d *winrtDriver) close() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for _, cmd := range []*exec.Cmd{d.publisher, d.joined} {
+		if cmd != nil {
+			cmd.Process.Kill()
+		}
+	}
+	d.publisher, d.joined, d.owner = nil, nil, false
+	return nil
+}
@@ -0,0 +1,133 @@
+package p2p
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// WinRT from PowerShell
+//
+// The Windows drivers, for WiFi Direct and Bluetooth, run WinRT APIs without
+// cgo or a WinRT binding: PowerShell loads WinRT types, and the scripts it
+// runs report what happens as lines of JSON, which the drivers read as
+// winrtEvents. Scripts that keep running, such as those advertising, are
+// started with startScript and killed to stop them.
+
+// scriptStartSlack is what PowerShell takes to start, on top of timeouts
+const scriptStartSlack = 10 * time.Second
+
+// winrtPrelude loads WinRT and defines Await, which waits for a WinRT async
+// operation, and Emit, which reports a line of JSON; scripts load the WinRT
+// types they use after it
+const winrtPrelude = `
+$ErrorActionPreference = 'Stop'
+Add-Type -AssemblyName System.Runtime.WindowsRuntime
+$asTask = [System.WindowsRuntimeSystemExtensions].GetMethods() | Where-Object {
+	$_.Name -eq 'AsTask' -and $_.GetParameters().Count -eq 1 -and $_.GetParameters()[0].ParameterType.Name -like 'IAsyncOperation*'
+} | Select-Object -First 1
+function Await($operation, [Type]$type) {
+	$task = $asTask.MakeGenericMethod($type).Invoke($null, @($operation))
+	$null = $task.Wait(-1)
+	$task.Result
+}
+function Emit($fields) {
+	[Console]::Out.WriteLine(($fields | ConvertTo-Json -Compress))
+	[Console]::Out.Flush()
+}
+`
+
+// winrtEvent is a line of JSON a script reports
+type winrtEvent struct {
+	Event      string `json:"event"`
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Address    string `json:"address"`
+	Signal     *int   `json:"signal"`     // In dBm
+	Advertised string `json:"advertised"` // See wifi_direct_windows.go
+	Error      string `json:"error"`
+}
+
+// startScript runs script and waits up to timeout for it to report want,
+// which it returns first on the events, or an error
+func startScript(script, want string, timeout time.Duration) (*exec.Cmd, <-chan winrtEvent, error) {
+	cmd := powershell(context.Background(), script)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, nil, fmt.Errorf("could not run PowerShell: %w", err)
+	}
+
+	events := make(chan winrtEvent)
+	go readEvents(stdout, events)
+	abort := func() {
+		cmd.Process.Kill()
+		for range events {
+		}
+		cmd.Wait()
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case event, ok := <-events:
+		if !ok || event.Event != want {
+			abort()
+			if event.Error == "" {
+				event.Error = "the script ended"
+			}
+			return nil, nil, errors.New(event.Error)
+		}
+		// Hand the event on ahead of the rest
+		first := make(chan winrtEvent)
+		go func() {
+			defer close(first)
+			first <- event
+			for event := range events {
+				first <- event
+			}
+		}()
+		return cmd, first, nil
+	case <-timer.C:
+		abort()
+		return nil, nil, errors.New("no answer in time")
+	}
+}
+
+// readEvents reads the lines of JSON a script reports until it ends
+func readEvents(r io.Reader, events chan<- winrtEvent) {
+	defer close(events)
+	lines := bufio.NewScanner(r)
+	for lines.Scan() {
+		var event winrtEvent
+		if json.Unmarshal(lines.Bytes(), &event) == nil && event.Event != "" {
+			events <- event
+		}
+	}
+}
+
+// powershell returns the command running script in Windows PowerShell
+func powershell(ctx context.Context, script string) *exec.Cmd {
+	// -EncodedCommand takes UTF-16LE in base64, which no quoting can break
+	units := utf16.Encode([]rune(script))
+	encoded := make([]byte, 2*len(units))
+	for i, u := range units {
+		encoded[2*i], encoded[2*i+1] = byte(u), byte(u>>8)
+	}
+	return exec.CommandContext(ctx, "powershell.exe", "-NoProfile", "-NonInteractive",
+		"-ExecutionPolicy", "Bypass", "-EncodedCommand", base64.StdEncoding.EncodeToString(encoded))
+}
+
+// psQuote quotes s as a PowerShell string literal
+func psQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
@@ -0,0 +1,275 @@
+package portmap
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// PCP (RFC 6887) and NAT-PMP (RFC 6886) are asked on UDP port 5351 of the
+// default gateway. A router that only speaks NAT-PMP answers a PCP request
+// with an unsupported version error, after which NAT-PMP is used.
+
+const (
+	pcpPort         = 5351
+	pcpVersion      = 2
+	natpmpVersion   = 0
+	pcpOpAnnounce   = 0
+	pcpOpMap        = 1
+	natpmpOpAddress = 0
+	natpmpOpMapTCP  = 2
+	protocolTCP     = 6
+
+	resultSuccess            = 0
+	resultUnsupportedVersion = 1
+
+	firstRetransmit = 250 * time.Millisecond
+)
+
+// pcpMapper asks the gateway with PCP, or NAT-PMP when legacy is set
+type pcpMapper struct {
+	gateway    *net.UDPAddr
+	internalIP net.IP
+	nonce      []byte // Identifies this machine's mappings to a PCP server
+	legacy     bool
+}
+
+func findPCP() (mapper, error) {
+	gateway, err := defaultGateway()
+	if err != nil {
+		return nil, err
+	}
+	internalIP, err := localAddressTo(gateway.String())
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	m := &pcpMapper{gateway: &net.UDPAddr{IP: gateway, Port: pcpPort}, internalIP: internalIP, nonce: nonce}
+
+	// Find out which of the two the gateway speaks
+	err = m.announce()
+	var unsupported *versionError
+	switch {
+	case errors.As(err, &unsupported):
+		m.legacy = true
+	case errors.Is(err, errNoAnswer):
+		return nil, fmt.Errorf("gateway %s doesn't answer", gateway)
+	case err != nil:
+		return nil, err
+	}
+	return m, nil
+}
+
+// announce sends a PCP ANNOUNCE, which only asks whether the gateway speaks PCP
+func (m *pcpMapper) announce() error {
+	request := make([]byte, 24)
+	request[0] = pcpVersion
+	request[1] = pcpOpAnnounce
+	copy(request[8:24], m.internalIP.To16())
+	answer, err := m.exchange(request, isPCPAnswer(pcpOpAnnounce))
+	if err != nil {
+		return err
+	}
+	if answer[0] != pcpVersion || answer[3] == resultUnsupportedVersion {
+		return &versionError{}
+	}
+	return nil
+}
+
+// isPCPAnswer matches answers to a PCP request with opcode, including the
+// unsupported version errors of NAT-PMP gateways
+func isPCPAnswer(opcode byte) func([]byte) bool {
+	return func(answer []byte) bool {
+		if len(answer) >= 4 && answer[0] == natpmpVersion {
+			return true
+		}
+		return len(answer) >= 24 && answer[0] == pcpVersion && answer[1] == 0x80|opcode
+	}
+}
+
+func (m *pcpMapper) add(internalPort, externalPort int, lifetime time.Duration) (net.IP, int, time.Duration, error) {
+	if m.legacy {
+		return m.mapNATPMP(internalPort, externalPort, lifetime)
+	}
+	return m.mapPCP(internalPort, externalPort, lifetime)
+}
+
+func (m *pcpMapper) remove(internalPort, externalPort int) error {
+	var err error
+	if m.legacy {
+		_, _, _, err = m.mapNATPMP(internalPort, 0, 0)
+	} else {
+		_, _, _, err = m.mapPCP(internalPort, 0, 0)
+	}
+	return err
+}
+
+// mapPCP sends a MAP request. A lifetime of 0 deletes the mapping.
+func (m *pcpMapper) mapPCP(internalPort, externalPort int, lifetime time.Duration) (net.IP, int, time.Duration, error) {
+	request := make([]byte, 60)
+	request[0] = pcpVersion
+	request[1] = pcpOpMap
+	binary.BigEndian.PutUint32(request[4:], uint32(lifetime.Seconds()))
+	copy(request[8:24], m.internalIP.To16())
+	copy(request[24:36], m.nonce)
+	request[36] = protocolTCP
+	binary.BigEndian.PutUint16(request[40:], uint16(internalPort))
+	binary.BigEndian.PutUint16(request[42:], uint16(externalPort))
+	copy(request[44:60], net.IPv4zero.To16())
+
+	answer, err := m.exchange(request, isPCPAnswer(pcpOpMap))
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if answer[0] != pcpVersion || answer[3] == resultUnsupportedVersion {
+		return nil, 0, 0, &versionError{}
+	}
+	if result := answer[3]; result != resultSuccess {
+		return nil, 0, 0, fmt.Errorf("gateway refused with PCP result %d", result)
+	}
+	if len(answer) < 60 {
+		return nil, 0, 0, errors.New("short PCP answer")
+	}
+	granted := time.Duration(binary.BigEndian.Uint32(answer[4:])) * time.Second
+	port := int(binary.BigEndian.Uint16(answer[42:]))
+	ip := net.IP(append([]byte(nil), answer[44:60]...))
+	return ip, port, granted, nil
+}
+
+// mapNATPMP sends a NAT-PMP mapping request and asks for the public address.
+// A lifetime of 0 deletes the mapping.
+func (m *pcpMapper) mapNATPMP(internalPort, externalPort int, lifetime time.Duration) (net.IP, int, time.Duration, error) {
+	request := make([]byte, 12)
+	request[0] = natpmpVersion
+	request[1] = natpmpOpMapTCP
+	binary.BigEndian.PutUint16(request[4:], uint16(internalPort))
+	binary.BigEndian.PutUint16(request[6:], uint16(externalPort))
+	binary.BigEndian.PutUint32(request[8:], uint32(lifetime.Seconds()))
+	answer, err := m.exchange(request, func(answer []byte) bool {
+		return len(answer) >= 16 && answer[1] == 0x80|natpmpOpMapTCP
+	})
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if result := binary.BigEndian.Uint16(answer[2:]); result != resultSuccess {
+		return nil, 0, 0, fmt.Errorf("gateway refused with NAT-PMP result %d", result)
+	}
+	port := int(binary.BigEndian.Uint16(answer[10:]))
+	granted := time.Duration(binary.BigEndian.Uint32(answer[12:])) * time.Second
+	if lifetime == 0 {
+		return nil, port, 0, nil
+	}
+
+	answer, err = m.exchange([]byte{natpmpVersion, natpmpOpAddress}, func(answer []byte) bool {
+		return len(answer) >= 12 && answer[1] == 0x80|natpmpOpAddress
+	})
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if result := binary.BigEndian.Uint16(answer[2:]); result != resultSuccess {
+		return nil, 0, 0, fmt.Errorf("gateway refused with NAT-PMP result %d", result)
+	}
+	return net.IP(append([]byte(nil), answer[8:12]...)), port, granted, nil
+}
+
+// errNoAnswer is returned when the gateway doesn't answer at all
+var errNoAnswer = errors.New("gateway didn't answer")
+
+// versionError is a gateway saying it doesn't speak PCP
+type versionError struct{}
+
+func (*versionError) Error() string { return "gateway doesn't speak PCP" }
+
+// exchange sends request to the gateway until an answer matches, waiting
+// twice as long after every try as the RFCs say, up to requestTimeout
+func (m *pcpMapper) exchange(request []byte, matches func([]byte) bool) ([]byte, error) {
+	conn, err := net.DialUDP("udp4", nil, m.gateway)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(requestTimeout)
+	wait := firstRetransmit
+	buffer := make([]byte, 1100)
+	for time.Now().Before(deadline) {
+		if _, err := conn.Write(request); err != nil {
+			return nil, err
+		}
+		until := time.Now().Add(wait)
+		if until.After(deadline) {
+			until = deadline
+		}
+		wait *= 2
+		conn.SetReadDeadline(until)
+		for {
+			n, err := conn.Read(buffer)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			if matches(buffer[:n]) {
+				return append([]byte(nil), buffer[:n]...), nil
+			}
+		}
+	}
+	return nil, errNoAnswer
+}
+
+// defaultGateway returns the IPv4 address of the default gateway. It is
+// read from the routing table on Linux; elsewhere the .1 address of this
+// machine's network is the usual guess.
+func defaultGateway() (net.IP, error) {
+	if gateway, err := linuxGateway(); err == nil {
+		return gateway, nil
+	}
+
+	local, err := localAddressTo("198.51.100.1")
+	if err != nil || local.To4() == nil {
+		return nil, errors.New("no default gateway")
+	}
+	gateway := append(net.IP(nil), local.To4()...)
+	gateway[3] = 1
+	return gateway, nil
+}
+
+// linuxGateway reads the default route from /proc/net/route, whose addresses
+// are hexadecimal in host (little-endian) order
+func linuxGateway() (net.IP, error) {
+	file, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Scan() // Header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		raw, err := hex.DecodeString(fields[2])
+		if err != nil || len(raw) != 4 {
+			continue
+		}
+		gateway := net.IPv4(raw[3], raw[2], raw[1], raw[0])
+		if !gateway.IsUnspecified() {
+			return gateway, nil
+		}
+	}
+	return nil, errors.New("no default route")
+}
@@ -0,0 +1,134 @@
+package portmap
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Port mapping
+//
+// Home routers that speak UPnP IGD, PCP or NAT-PMP forward a port from
+// their public address to a machine behind them when asked, so peers on
+// other networks can connect directly instead of through a relay. Map asks
+// the router with UPnP first and then with PCP, falling back to NAT-PMP on
+// routers that only speak that. Mappings are leases: they are renewed with
+// Refresh before they run out and given back with Remove.
+
+// Methods a Mapping can be made with
+const (
+	MethodUPnP   = "UPnP"
+	MethodPCP    = "PCP"
+	MethodNATPMP = "NAT-PMP"
+)
+
+// DefaultLifetime is how long mappings are asked for
+const DefaultLifetime = time.Hour
+
+// requestTimeout bounds how long one protocol may take to answer
+const requestTimeout = 3 * time.Second
+
+// Mapping is a port the router forwards to this machine
+type Mapping struct {
+	Method       string
+	ExternalIP   net.IP
+	ExternalPort int
+	InternalPort int
+	Lifetime     time.Duration // What the router granted, 0 for a mapping that doesn't expire
+
+	mapper  mapper
+	removed bool       // Set by Remove, after which the mapping can't be refreshed
+	mutex   sync.Mutex // Keeps requests for the mapping from overlapping
+}
+
+// mapper is a way of asking a router for mappings
+type mapper interface {
+	// add maps a TCP port, returning the external address and the lifetime granted
+	add(internalPort, externalPort int, lifetime time.Duration) (net.IP, int, time.Duration, error)
+	remove(internalPort, externalPort int) error
+}
+
+// Map asks the router to forward TCP port on its public address to port on
+// this machine for lifetime
+func Map(port int, lifetime time.Duration) (*Mapping, error) {
+	var reasons []string
+	for _, try := range []struct {
+		method string
+		find   func() (mapper, error)
+	}{
+		{MethodUPnP, findUPnP},
+		{MethodPCP, findPCP},
+	} {
+		m, err := try.find()
+		if err != nil {
+			reasons = append(reasons, fmt.Sprintf("%s: %v", try.method, err))
+			continue
+		}
+		mapping := &Mapping{Method: try.method, InternalPort: port, mapper: m}
+		if pcp, ok := m.(*pcpMapper); ok && pcp.legacy {
+			mapping.Method = MethodNATPMP
+		}
+		if err := mapping.request(port, lifetime); err != nil {
+			reasons = append(reasons, fmt.Sprintf("%s: %v", mapping.Method, err))
+			continue
+		}
+		return mapping, nil
+	}
+	return nil, errors.New(strings.Join(reasons, "; "))
+}
+
+// External returns the public address peers reach the port at
+func (m *Mapping) External() string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return net.JoinHostPort(m.ExternalIP.String(), strconv.Itoa(m.ExternalPort))
+}
+
+// Refresh renews the lease for lifetime, keeping the external port if the
+// router allows
+func (m *Mapping) Refresh(lifetime time.Duration) error {
+	m.mutex.Lock()
+	port := m.ExternalPort
+	m.mutex.Unlock()
+	return m.request(port, lifetime)
+}
+
+// Remove gives the mapping back
+func (m *Mapping) Remove() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.removed = true
+	return m.mapper.remove(m.InternalPort, m.ExternalPort)
+}
+
+func (m *Mapping) request(externalPort int, lifetime time.Duration) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.removed {
+		return errors.New("the mapping was removed")
+	}
+	ip, port, granted, err := m.mapper.add(m.InternalPort, externalPort, lifetime)
+	if err != nil {
+		return err
+	}
+	if ip == nil || ip.IsUnspecified() {
+		return errors.New("router didn't report its public address")
+	}
+	m.ExternalIP, m.ExternalPort, m.Lifetime = ip, port, granted
+	return nil
+}
+
+// localAddressTo returns the address of this machine that reaches host
+func localAddressTo(host string) (net.IP, error) {
+	// Nothing is sent, connecting a UDP socket only picks the route
+	conn, err := net.Dial("udp4", net.JoinHostPort(host, "9"))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
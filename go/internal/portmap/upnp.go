@@ -0,0 +1,313 @@
+package portmap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UPnP IGD: the router is found with an SSDP search, its description names
+// the WANIPConnection (or WANPPPConnection) service and mappings are made
+// with SOAP calls to that service's control URL.
+
+const (
+	ssdpAddress       = "239.255.255.250:1900"
+	ssdpSearchTime    = 2 * time.Second
+	mappingName       = "BitShare"
+	upnpOnlyPermanent = 725 // OnlyPermanentLeasesSupported
+)
+
+// The device types an SSDP search asks for, newest first
+var gatewayDeviceTypes = []string{
+	"urn:schemas-upnp-org:device:InternetGatewayDevice:2",
+	"urn:schemas-upnp-org:device:InternetGatewayDevice:1",
+}
+
+// upnpMapper calls the connection service of one router
+type upnpMapper struct {
+	controlURL  string
+	serviceType string
+	internalIP  net.IP // This machine's address as the router sees it
+	client      *http.Client
+}
+
+// upnpError is a fault a router answered a SOAP call with
+type upnpError struct {
+	Code        int
+	Description string
+}
+
+func (e *upnpError) Error() string {
+	return fmt.Sprintf("router refused: %s (%d)", e.Description, e.Code)
+}
+
+func findUPnP() (mapper, error) {
+	locations, err := searchGateways()
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Timeout: requestTimeout}
+	var lastErr error
+	for _, location := range locations {
+		m, err := describeGateway(client, location)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return m, nil
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no UPnP router found")
+	}
+	return nil, lastErr
+}
+
+// searchGateways returns the description URLs of the routers that answer
+// an SSDP search
+func searchGateways() ([]string, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	target, err := net.ResolveUDPAddr("udp4", ssdpAddress)
+	if err != nil {
+		return nil, err
+	}
+	for _, deviceType := range gatewayDeviceTypes {
+		search := "M-SEARCH * HTTP/1.1\r\n" +
+			"HOST: " + ssdpAddress + "\r\n" +
+			"ST: " + deviceType + "\r\n" +
+			"MAN: \"ssdp:discover\"\r\n" +
+			"MX: 2\r\n\r\n"
+		if _, err := conn.WriteToUDP([]byte(search), target); err != nil {
+			return nil, err
+		}
+	}
+
+	var locations []string
+	conn.SetReadDeadline(time.Now().Add(ssdpSearchTime))
+	buffer := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			break
+		}
+		response, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buffer[:n])), nil)
+		if err != nil {
+			continue
+		}
+		location := response.Header.Get("Location")
+		if location != "" && !containsString(locations, location) {
+			locations = append(locations, location)
+		}
+	}
+	if len(locations) == 0 {
+		return nil, errors.New("no UPnP router answered")
+	}
+	return locations, nil
+}
+
+// upnpDevice is a device in a router's description, with its services and
+// embedded devices
+type upnpDevice struct {
+	Services []struct {
+		ServiceType string `xml:"serviceType"`
+		ControlURL  string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []upnpDevice `xml:"deviceList>device"`
+}
+
+// describeGateway reads a router's description and finds its connection service
+func describeGateway(client *http.Client, location string) (*upnpMapper, error) {
+	response, err := client.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("router description: %s", response.Status)
+	}
+
+	var description struct {
+		URLBase string     `xml:"URLBase"`
+		Device  upnpDevice `xml:"device"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(response.Body, 1<<20)).Decode(&description); err != nil {
+		return nil, fmt.Errorf("router description: %v", err)
+	}
+
+	serviceType, controlURL := findConnectionService(description.Device)
+	if controlURL == "" {
+		return nil, errors.New("router has no WAN connection service")
+	}
+	base := location
+	if description.URLBase != "" {
+		base = description.URLBase
+	}
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+	control, err := baseURL.Parse(controlURL)
+	if err != nil {
+		return nil, err
+	}
+
+	internalIP, err := localAddressTo(control.Hostname())
+	if err != nil {
+		return nil, err
+	}
+	return &upnpMapper{controlURL: control.String(), serviceType: serviceType, internalIP: internalIP, client: client}, nil
+}
+
+// findConnectionService looks through device and the devices in it for the
+// service that makes mappings
+func findConnectionService(device upnpDevice) (string, string) {
+	for _, service := range device.Services {
+		if strings.HasPrefix(service.ServiceType, "urn:schemas-upnp-org:service:WANIPConnection:") ||
+			strings.HasPrefix(service.ServiceType, "urn:schemas-upnp-org:service:WANPPPConnection:") {
+			return service.ServiceType, service.ControlURL
+		}
+	}
+	for _, embedded := range device.Devices {
+		if serviceType, controlURL := findConnectionService(embedded); controlURL != "" {
+			return serviceType, controlURL
+		}
+	}
+	return "", ""
+}
+
+func (m *upnpMapper) add(internalPort, externalPort int, lifetime time.Duration) (net.IP, int, time.Duration, error) {
+	if externalPort == 0 {
+		externalPort = internalPort
+	}
+	args := func(lease time.Duration) [][2]string {
+		return [][2]string{
+			{"NewRemoteHost", ""},
+			{"NewExternalPort", strconv.Itoa(externalPort)},
+			{"NewProtocol", "TCP"},
+			{"NewInternalPort", strconv.Itoa(internalPort)},
+			{"NewInternalClient", m.internalIP.String()},
+			{"NewEnabled", "1"},
+			{"NewPortMappingDescription", mappingName},
+			{"NewLeaseDuration", strconv.Itoa(int(lease.Seconds()))},
+		}
+	}
+
+	_, err := m.call("AddPortMapping", args(lifetime))
+	var refused *upnpError
+	if errors.As(err, &refused) && refused.Code == upnpOnlyPermanent {
+		// Older routers only take mappings that don't expire
+		lifetime = 0
+		_, err = m.call("AddPortMapping", args(0))
+	}
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	values, err := m.call("GetExternalIPAddress", nil)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return net.ParseIP(values["NewExternalIPAddress"]), externalPort, lifetime, nil
+}
+
+func (m *upnpMapper) remove(internalPort, externalPort int) error {
+	_, err := m.call("DeletePortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(externalPort)},
+		{"NewProtocol", "TCP"},
+	})
+	return err
+}
+
+// call makes a SOAP call to the connection service and returns the values
+// in the answer
+func (m *upnpMapper) call(action string, args [][2]string) (map[string]string, error) {
+	var body strings.Builder
+	body.WriteString(`<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body><u:` + action + ` xmlns:u="` + m.serviceType + `">`)
+	for _, arg := range args {
+		body.WriteString("<" + arg[0] + ">")
+		xml.EscapeText(&body, []byte(arg[1]))
+		body.WriteString("</" + arg[0] + ">")
+	}
+	body.WriteString(`</u:` + action + `></s:Body></s:Envelope>`)
+
+	request, err := http.NewRequest(http.MethodPost, m.controlURL, strings.NewReader(body.String()))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	request.Header.Set("SOAPAction", `"`+m.serviceType+"#"+action+`"`)
+	response, err := m.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	values, err := soapValues(io.LimitReader(response.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", action, err)
+	}
+	if response.StatusCode != http.StatusOK {
+		code, _ := strconv.Atoi(values["errorCode"])
+		if code == 0 {
+			return nil, fmt.Errorf("%s: %s", action, response.Status)
+		}
+		return nil, &upnpError{Code: code, Description: values["errorDescription"]}
+	}
+	return values, nil
+}
+
+// soapValues returns the text of every element without children in a SOAP
+// answer by name, which covers both results and faults
+func soapValues(r io.Reader) (map[string]string, error) {
+	values := make(map[string]string)
+	decoder := xml.NewDecoder(r)
+	var name string
+	var text strings.Builder
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return values, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			name = t.Name.Local
+			text.Reset()
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			if name == t.Name.Local {
+				values[name] = strings.TrimSpace(text.String())
+			}
+			name = ""
+		}
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,131 @@
+package relay
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Relay protocol
+//
+// Nodes that can't reach each other directly, typically behind client
+// isolation, meet through a relay server. A node keeps a connection open to
+// the relay, registered under its node ID and kept alive with pings. To reach
+// a peer a node opens another connection and asks for a session with the
+// peer's ID. The relay tells the peer on its registration connection, the
+// peer opens a connection of its own to accept the session, and from then on
+// the relay copies bytes between the two.
+//
+// A node proves it holds the key its ID derives from before the relay
+// registers it: the relay answers register with a challenge, and the node
+// sends back prove with its public key and its signature over the challenge
+// and its ID. Nobody else can then take over a node's registration and the
+// sessions meant for it.
+//
+// Messages are JSON, each preceded by its length as 4 big endian bytes, so
+// nothing past the relay's last message is read before the connection turns
+// into the stream.
+
+// Types of Message
+const (
+	TypeRegister   = "register"   // Node to relay: keep me reachable under NodeID
+	TypeChallenge  = "challenge"  // Relay to node: sign Challenge to prove NodeID is yours
+	TypeProve      = "prove"      // Node to relay: PublicKey and Signature, answering challenge
+	TypeRegistered = "registered" // Relay to node: registration accepted
+	TypePing       = "ping"       // Node to relay, on the registration connection
+	TypePong       = "pong"       // Relay to node, answering a ping
+	TypeConnect    = "connect"    // Node to relay: start a session with Target
+	TypeIncoming   = "incoming"   // Relay to node: From wants a session
+	TypeAccept     = "accept"     // Node to relay: take the session, on a new connection
+	TypeConnected  = "connected"  // Relay to node: the connection is now the session
+	TypeError      = "error"      // Relay to node: the request failed
+)
+
+// Codes of relay errors
+const (
+	CodeOffline = "offline" // The target is not registered with the relay
+	CodeAuth    = "auth"    // The relay refused the node's token
+	CodeLimit   = "limit"   // The relay is relaying as many sessions as it takes
+	CodeTimeout = "timeout" // The target didn't accept the session in time
+	CodeProof   = "proof"   // The node didn't prove it holds the key of its ID
+)
+
+const (
+	// RegistrationTTL is how long a relay keeps a registration without a ping
+	RegistrationTTL = 10 * time.Minute
+
+	// MaxMessageSize bounds a message, the stream after it is not limited
+	MaxMessageSize = 64 * 1024
+)
+
+// Message is everything said between a node and a relay before a session starts
+type Message struct {
+	Type    string `json:"type"`
+	NodeID  string `json:"node_id,omitempty"`
+	Token   string `json:"token,omitempty"`
+	Target  string `json:"target,omitempty"`  // For connect
+	Session string `json:"session,omitempty"` // For incoming and accept
+	From    string `json:"from,omitempty"`    // For incoming
+	Code    string `json:"code,omitempty"`    // For error
+	Error   string `json:"error,omitempty"`
+
+	Challenge string `json:"challenge,omitempty"`  // For challenge
+	PublicKey []byte `json:"public_key,omitempty"` // For prove
+	Signature []byte `json:"signature,omitempty"`  // For prove
+}
+
+// SignRegistration returns the signature a node proves its ID nodeID with,
+// answering challenge
+func SignRegistration(key ed25519.PrivateKey, nodeID, challenge string) []byte {
+	return ed25519.Sign(key, registrationProof(challenge, nodeID))
+}
+
+// registrationProof is what a node signs to register, set apart from what
+// nodes sign for each other so neither signature passes for the other
+func registrationProof(challenge, nodeID string) []byte {
+	return []byte("bitshare-relay-register\x00" + challenge + "\x00" + nodeID)
+}
+
+// Exchange sends request and reads the reply
+func Exchange(conn net.Conn, request Message) (Message, error) {
+	var reply Message
+	if err := WriteMessage(conn, request); err != nil {
+		return reply, err
+	}
+	err := ReadMessage(conn, &reply)
+	return reply, err
+}
+
+// WriteMessage sends one message
+func WriteMessage(w io.Writer, message Message) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[4:], data)
+	_, err = w.Write(frame)
+	return err
+}
+
+// ReadMessage reads one message, and nothing after it
+func ReadMessage(r io.Reader, message *Message) error {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return err
+	}
+	size := binary.BigEndian.Uint32(length[:])
+	if size > MaxMessageSize {
+		return fmt.Errorf("relay message of %d bytes is too large", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, message)
+}
@@ -0,0 +1,520 @@
+package relay
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fileshare/internal/p2p"
+)
+
+// Relay server
+//
+// The server keeps the registration connection of every node, brokers
+// sessions between two registered nodes and copies bytes between the two
+// connections of a session until either side closes, the session goes idle
+// or it runs into one of the limits in Config. Nodes register only with
+// the key their ID derives from, see protocol.go.
+
+const (
+	// handshakeTimeout bounds how long a new connection may take to say what it wants
+	handshakeTimeout = 15 * time.Second
+
+	// acceptTimeout is how long the target of a session has to accept it,
+	// shorter than nodes wait for the session
+	acceptTimeout = 10 * time.Second
+
+	copyBufferSize = 32 * 1024
+)
+
+// Config sets who a Server serves and how much
+type Config struct {
+	Tokens             []string      // Accepted node tokens, every node is served when empty
+	MaxNodes           int           // Nodes registered at once, 0 for no limit
+	MaxSessions        int           // Sessions relayed at once, 0 for no limit
+	MaxSessionBytes    int64         // Bytes one session may relay both ways together, 0 for no limit
+	MaxSessionDuration time.Duration // How long a session may last, 0 for no limit
+	IdleTimeout        time.Duration // Sessions without traffic this long are closed, 0 to keep them
+	Logger             *log.Logger   // Where registrations and sessions are logged, nil for nowhere
+}
+
+// Stats are the counters of a Server
+type Stats struct {
+	Nodes          int   `json:"nodes"`           // Registered now
+	ActiveSessions int   `json:"active_sessions"` // Being relayed now
+	Sessions       int64 `json:"sessions"`        // Relayed since the server started
+	Refused        int64 `json:"refused"`         // Requests answered with an error
+	BytesRelayed   int64 `json:"bytes_relayed"`   // Both ways, over every session
+}
+
+// Server is a relay server
+type Server struct {
+	config Config
+
+	mutex     sync.Mutex
+	nodes     map[string]*registration
+	pending   map[string]*pendingSession
+	active    int
+	listeners map[net.Listener]bool
+	conns     map[net.Conn]bool
+	closed    bool
+
+	sessions     atomic.Int64
+	refused      atomic.Int64
+	bytesRelayed atomic.Int64
+}
+
+// registration is the connection a node is reachable on
+type registration struct {
+	nodeID string
+	conn   net.Conn
+	mutex  sync.Mutex // Pongs and incoming sessions are written from different goroutines
+}
+
+func (r *registration) send(message Message) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.conn.SetWriteDeadline(time.Now().Add(handshakeTimeout))
+	return WriteMessage(r.conn, message)
+}
+
+// pendingSession is a session its target was told about and hasn't accepted yet
+type pendingSession struct {
+	target   string
+	accepted chan net.Conn // Gets the target's connection, buffered
+}
+
+// ErrServerClosed is returned by Serve after Close
+var ErrServerClosed = errors.New("relay server closed")
+
+// NewServer returns a server that serves as config says
+func NewServer(config Config) *Server {
+	return &Server{
+		config:    config,
+		nodes:     make(map[string]*registration),
+		pending:   make(map[string]*pendingSession),
+		listeners: make(map[net.Listener]bool),
+		conns:     make(map[net.Conn]bool),
+	}
+}
+
+// ListenAndServe serves on the TCP address addr
+func (s *Server) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// Serve serves the connections listener accepts until the server is closed
+func (s *Server) Serve(listener net.Listener) error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	}
+	s.listeners[listener] = true
+	s.mutex.Unlock()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.listeners, listener)
+		s.mutex.Unlock()
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			s.mutex.Lock()
+			closed := s.closed
+			s.mutex.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		if !s.track(conn) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		go s.handleConnection(conn)
+	}
+}
+
+// Close stops every listener and drops every registration and session
+func (s *Server) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closed = true
+	for listener := range s.listeners {
+		listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return nil
+}
+
+// Stats returns the server's counters
+func (s *Server) Stats() Stats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return Stats{
+		Nodes:          len(s.nodes),
+		ActiveSessions: s.active,
+		Sessions:       s.sessions.Load(),
+		Refused:        s.refused.Load(),
+		BytesRelayed:   s.bytesRelayed.Load(),
+	}
+}
+
+// track remembers conn so Close can drop it, unless the server is closed
+func (s *Server) track(conn net.Conn) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = true
+	return true
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.conns, conn)
+}
+
+// handleConnection reads what a new connection wants. The connection is
+// closed when done with, except an accepted session's, which the node that
+// asked for the session takes over.
+func (s *Server) handleConnection(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	var request Message
+	if err := ReadMessage(conn, &request); err != nil {
+		s.closeConnection(conn)
+		return
+	}
+
+	switch {
+	case !s.authorized(request.Token):
+		s.refuse(conn, CodeAuth, "unknown token")
+	case request.NodeID == "":
+		s.refuse(conn, "", "no node ID")
+	case request.Type == TypeRegister:
+		s.serveRegistration(conn, request.NodeID)
+	case request.Type == TypeConnect:
+		s.startSession(conn, request)
+	case request.Type == TypeAccept:
+		s.acceptSession(conn, request)
+	default:
+		s.refuse(conn, "", fmt.Sprintf("unexpected %q", request.Type))
+	}
+}
+
+func (s *Server) closeConnection(conn net.Conn) {
+	conn.Close()
+	s.untrack(conn)
+}
+
+// refuse answers a request with an error and closes the connection
+func (s *Server) refuse(conn net.Conn, code, reason string) {
+	s.refused.Add(1)
+	conn.SetWriteDeadline(time.Now().Add(handshakeTimeout))
+	WriteMessage(conn, Message{Type: TypeError, Code: code, Error: reason})
+	s.closeConnection(conn)
+}
+
+func (s *Server) authorized(token string) bool {
+	if len(s.config.Tokens) == 0 {
+		return true
+	}
+	for _, accepted := range s.config.Tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(accepted)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// serveRegistration keeps nodeID reachable on conn, once the node proved
+// the ID is its own, and answers its pings until the node goes away or
+// stays silent for RegistrationTTL
+func (s *Server) serveRegistration(conn net.Conn, nodeID string) {
+	if err := s.challenge(conn, nodeID); err != nil {
+		s.logf("Refused to register %s from %s: %v", nodeID, conn.RemoteAddr(), err)
+		s.refuse(conn, CodeProof, err.Error())
+		return
+	}
+
+	reg := &registration{nodeID: nodeID, conn: conn}
+	s.mutex.Lock()
+	previous := s.nodes[nodeID]
+	full := previous == nil && s.config.MaxNodes > 0 && len(s.nodes) >= s.config.MaxNodes
+	if !full {
+		s.nodes[nodeID] = reg
+	}
+	s.mutex.Unlock()
+	if full {
+		s.refuse(conn, CodeLimit, "too many nodes registered")
+		return
+	}
+	if previous != nil {
+		// The node registered again, most likely after losing the old connection
+		previous.conn.Close()
+	}
+	defer func() {
+		s.mutex.Lock()
+		if s.nodes[nodeID] == reg {
+			delete(s.nodes, nodeID)
+		}
+		s.mutex.Unlock()
+		s.closeConnection(conn)
+		s.logf("%s unregistered", nodeID)
+	}()
+
+	if err := reg.send(Message{Type: TypeRegistered}); err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	s.logf("%s registered from %s", nodeID, conn.RemoteAddr())
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(RegistrationTTL))
+		var message Message
+		if err := ReadMessage(conn, &message); err != nil {
+			return
+		}
+		if message.Type == TypePing {
+			if err := reg.send(Message{Type: TypePong}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// challenge has the node registering on conn prove it holds the key nodeID
+// derives from
+func (s *Server) challenge(conn net.Conn, nodeID string) error {
+	challenge, err := newSessionID()
+	if err != nil {
+		return errors.New("could not make a challenge")
+	}
+	proof, err := Exchange(conn, Message{Type: TypeChallenge, Challenge: challenge})
+	if err != nil {
+		return err
+	}
+	if proof.Type != TypeProve {
+		return fmt.Errorf("answered the challenge with %q", proof.Type)
+	}
+	if len(proof.PublicKey) != ed25519.PublicKeySize || p2p.NodeIDForKey(proof.PublicKey) != nodeID {
+		return errors.New("the node ID isn't the one of the key")
+	}
+	if !ed25519.Verify(proof.PublicKey, registrationProof(challenge, nodeID), proof.Signature) {
+		return errors.New("wrong signature")
+	}
+	return nil
+}
+
+// startSession asks the target of request to accept a session and, once it
+// does, relays between conn and the target's connection
+func (s *Server) startSession(conn net.Conn, request Message) {
+	id, err := newSessionID()
+	if err != nil {
+		s.refuse(conn, "", "could not start a session")
+		return
+	}
+
+	s.mutex.Lock()
+	target := s.nodes[request.Target]
+	full := s.config.MaxSessions > 0 && s.active+len(s.pending) >= s.config.MaxSessions
+	session := &pendingSession{target: request.Target, accepted: make(chan net.Conn, 1)}
+	if target != nil && !full {
+		s.pending[id] = session
+	}
+	s.mutex.Unlock()
+
+	switch {
+	case target == nil:
+		s.refuse(conn, CodeOffline, request.Target+" is not registered")
+		return
+	case full:
+		s.refuse(conn, CodeLimit, "too many sessions")
+		return
+	}
+
+	var other net.Conn
+	if err := target.send(Message{Type: TypeIncoming, Session: id, From: request.NodeID}); err == nil {
+		select {
+		case other = <-session.accepted:
+		case <-time.After(acceptTimeout):
+		}
+	}
+	if other == nil {
+		s.mutex.Lock()
+		_, waiting := s.pending[id]
+		delete(s.pending, id)
+		s.mutex.Unlock()
+		if !waiting {
+			// Accepted just as the wait ran out
+			other = <-session.accepted
+		}
+	}
+	if other == nil {
+		s.refuse(conn, CodeTimeout, request.Target+" didn't accept the session")
+		return
+	}
+
+	for _, c := range []net.Conn{conn, other} {
+		c.SetWriteDeadline(time.Now().Add(handshakeTimeout))
+		if err := WriteMessage(c, Message{Type: TypeConnected}); err != nil {
+			s.closeConnection(conn)
+			s.closeConnection(other)
+			return
+		}
+		c.SetDeadline(time.Time{})
+	}
+	s.relay(conn, other, request.NodeID, request.Target)
+}
+
+// acceptSession hands conn to the node waiting for the session it accepts
+func (s *Server) acceptSession(conn net.Conn, request Message) {
+	s.mutex.Lock()
+	session := s.pending[request.Session]
+	if session != nil && session.target == request.NodeID {
+		delete(s.pending, request.Session)
+	} else {
+		session = nil
+	}
+	s.mutex.Unlock()
+
+	if session == nil {
+		s.refuse(conn, "", "no such session")
+		return
+	}
+	session.accepted <- conn
+}
+
+// relay copies between the two connections of a session until both sides
+// are done or a limit is hit
+func (s *Server) relay(a, b net.Conn, from, to string) {
+	s.mutex.Lock()
+	s.active++
+	s.mutex.Unlock()
+	s.sessions.Add(1)
+	s.logf("Relaying %s -> %s", from, to)
+
+	started := time.Now()
+	var relayed, lastActive atomic.Int64
+	lastActive.Store(started.UnixNano())
+
+	var once sync.Once
+	var reason string
+	stop := func(why string) {
+		once.Do(func() {
+			reason = why
+			a.Close()
+			b.Close()
+		})
+	}
+
+	copyHalf := func(dst, src net.Conn, done chan<- struct{}) {
+		defer close(done)
+		buffer := make([]byte, copyBufferSize)
+		for {
+			n, err := src.Read(buffer)
+			if n > 0 {
+				lastActive.Store(time.Now().UnixNano())
+				s.bytesRelayed.Add(int64(n))
+				if total := relayed.Add(int64(n)); s.config.MaxSessionBytes > 0 && total > s.config.MaxSessionBytes {
+					stop("byte limit")
+					return
+				}
+				if _, err := dst.Write(buffer[:n]); err != nil {
+					stop("")
+					return
+				}
+			}
+			if err == io.EOF {
+				// Pass the half close on, the other way may still have data
+				if tcp, ok := dst.(*net.TCPConn); ok {
+					tcp.CloseWrite()
+					return
+				}
+			}
+			if err != nil {
+				stop("")
+				return
+			}
+		}
+	}
+	aDone, bDone := make(chan struct{}), make(chan struct{})
+	go copyHalf(b, a, aDone)
+	go copyHalf(a, b, bDone)
+
+	// Watch the idle and duration limits until both halves are done
+	check := time.Second
+	if s.config.IdleTimeout > 0 && s.config.IdleTimeout/4 < check {
+		check = s.config.IdleTimeout / 4
+	}
+	ticker := time.NewTicker(check)
+	defer ticker.Stop()
+	for aDone != nil || bDone != nil {
+		select {
+		case <-aDone:
+			aDone = nil
+		case <-bDone:
+			bDone = nil
+		case now := <-ticker.C:
+			idle := now.Sub(time.Unix(0, lastActive.Load()))
+			switch {
+			case s.config.IdleTimeout > 0 && idle > s.config.IdleTimeout:
+				stop("idle")
+			case s.config.MaxSessionDuration > 0 && now.Sub(started) > s.config.MaxSessionDuration:
+				stop("duration limit")
+			}
+		}
+	}
+	stop("")
+
+	s.untrack(a)
+	s.untrack(b)
+	s.mutex.Lock()
+	s.active--
+	s.mutex.Unlock()
+	if reason != "" {
+		s.logf("Closed %s -> %s after %s, %d bytes (%s)", from, to, time.Since(started).Round(time.Second), relayed.Load(), reason)
+	} else {
+		s.logf("Closed %s -> %s after %s, %d bytes", from, to, time.Since(started).Round(time.Second), relayed.Load())
+	}
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.config.Logger != nil {
+		s.config.Logger.Printf(format, args...)
+	}
+}
+
+func newSessionID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
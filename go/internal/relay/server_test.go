@@ -0,0 +1,191 @@
+package relay
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"fileshare/internal/p2p"
+)
+
+// startServer runs a relay on loopback for the test
+func startServer(t *testing.T, config Config) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(config)
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+	return listener.Addr().String()
+}
+
+// testNode is a node key and the ID it derives
+type testNode struct {
+	id  string
+	key ed25519.PrivateKey
+}
+
+func newTestNode(t *testing.T) testNode {
+	t.Helper()
+	public, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testNode{id: p2p.NodeIDForKey(public), key: key}
+}
+
+// register registers node with the relay at address, proving its ID with
+// key, and returns the registration connection and the final reply
+func register(t *testing.T, address, nodeID string, key ed25519.PrivateKey) (net.Conn, Message) {
+	t.Helper()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	reply, err := Exchange(conn, Message{Type: TypeRegister, NodeID: nodeID})
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	if reply.Type != TypeChallenge {
+		return conn, reply
+	}
+	reply, err = Exchange(conn, Message{
+		Type:      TypeProve,
+		PublicKey: key.Public().(ed25519.PublicKey),
+		Signature: SignRegistration(key, nodeID, reply.Challenge),
+	})
+	if err != nil {
+		t.Fatalf("prove: %v", err)
+	}
+	return conn, reply
+}
+
+func TestRelaySession(t *testing.T) {
+	address := startServer(t, Config{})
+	a, b := newTestNode(t), newTestNode(t)
+
+	if _, reply := register(t, address, a.id, a.key); reply.Type != TypeRegistered {
+		t.Fatalf("a got %+v, want registered", reply)
+	}
+	registration, reply := register(t, address, b.id, b.key)
+	if reply.Type != TypeRegistered {
+		t.Fatalf("b got %+v, want registered", reply)
+	}
+
+	// b accepts the session a asks for, as the mesh does
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		var incoming Message
+		if err := ReadMessage(registration, &incoming); err != nil || incoming.Type != TypeIncoming || incoming.From != a.id {
+			accepted <- nil
+			return
+		}
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		reply, err := Exchange(conn, Message{Type: TypeAccept, NodeID: b.id, Session: incoming.Session})
+		if err != nil || reply.Type != TypeConnected {
+			conn.Close()
+			accepted <- nil
+			return
+		}
+		accepted <- conn
+	}()
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if reply, err := Exchange(conn, Message{Type: TypeConnect, NodeID: a.id, Target: b.id}); err != nil || reply.Type != TypeConnected {
+		t.Fatalf("connect: %+v, %v", reply, err)
+	}
+	other := <-accepted
+	if other == nil {
+		t.Fatal("b didn't get the session")
+	}
+	defer other.Close()
+	other.SetDeadline(time.Now().Add(5 * time.Second))
+
+	for _, direction := range []struct {
+		from, to net.Conn
+		text     string
+	}{
+		{conn, other, "from a to b"},
+		{other, conn, "from b to a"},
+	} {
+		if _, err := direction.from.Write([]byte(direction.text)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(direction.text))
+		if _, err := io.ReadFull(direction.to, buf); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != direction.text {
+			t.Errorf("relayed %q, want %q", buf, direction.text)
+		}
+	}
+}
+
+func TestRegistrationProof(t *testing.T) {
+	node, other := newTestNode(t), newTestNode(t)
+	tests := []struct {
+		name   string
+		nodeID string
+		key    ed25519.PrivateKey
+		code   string // Of the error, empty when registered
+	}{
+		{"own key", node.id, node.key, ""},
+		{"another node's ID", node.id, other.key, CodeProof},
+		{"ID of no key", "node-0123456789abcdef", node.key, CodeProof},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			address := startServer(t, Config{})
+			_, reply := register(t, address, test.nodeID, test.key)
+			if test.code == "" {
+				if reply.Type != TypeRegistered {
+					t.Fatalf("got %+v, want registered", reply)
+				}
+				return
+			}
+			if reply.Type != TypeError || reply.Code != test.code {
+				t.Fatalf("got %+v, want error %s", reply, test.code)
+			}
+		})
+	}
+}
+
+func TestMaxNodes(t *testing.T) {
+	address := startServer(t, Config{MaxNodes: 2})
+	first := newTestNode(t)
+	for i, node := range []testNode{first, newTestNode(t)} {
+		if _, reply := register(t, address, node.id, node.key); reply.Type != TypeRegistered {
+			t.Fatalf("node %d got %+v, want registered", i, reply)
+		}
+	}
+
+	if _, reply := register(t, address, newTestNode(t).id, newTestNode(t).key); reply.Type != TypeError || reply.Code != CodeProof {
+		// A node that can't prove its ID is refused before the limit counts
+		t.Fatalf("got %+v, want error %s", reply, CodeProof)
+	}
+	third := newTestNode(t)
+	if _, reply := register(t, address, third.id, third.key); reply.Type != TypeError || reply.Code != CodeLimit {
+		t.Fatalf("third node got %+v, want error %s", reply, CodeLimit)
+	}
+	// Registering again replaces the registration, which the limit allows
+	if _, reply := register(t, address, first.id, first.key); reply.Type != TypeRegistered {
+		t.Fatalf("registering again got %+v, want registered", reply)
+	}
+}
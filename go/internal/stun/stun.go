@@ -0,0 +1,324 @@
+package stun
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// STUN client
+//
+// Binding requests (RFC 5389) tell a node the address its packets leave the
+// NAT with. DetectNAT classifies the NAT from a few of them sent from one
+// UDP socket, as in RFC 3489 but with the CHANGE-REQUEST attribute of RFC
+// 5780:
+//
+//   - No answer at all: UDP is blocked.
+//   - The mapped address is the socket's own: no NAT, the node is open.
+//   - A second server sees another mapped address: the NAT is symmetric and
+//     peers can't reach the node at the address STUN reports.
+//   - An answer from another IP and port gets through: full cone.
+//   - An answer from another port only gets through: restricted, else
+//     port-restricted.
+//
+// Many public servers ignore CHANGE-REQUEST. Their answers come from the
+// address asked, so they tell nothing about filtering and the NAT is taken
+// to be port-restricted, the most common and most cautious guess.
+
+// DefaultServers are asked when no servers are configured. The first
+// answers CHANGE-REQUEST.
+var DefaultServers = []string{
+	"stun.stunprotocol.org:3478",
+	"stun.l.google.com:19302",
+	"stun1.l.google.com:19302",
+}
+
+// NAT types DetectNAT reports
+const (
+	NATOpen           = "open"
+	NATFullCone       = "full cone"
+	NATRestricted     = "restricted"
+	NATPortRestricted = "port-restricted"
+	NATSymmetric      = "symmetric"
+	NATBlocked        = "UDP blocked"
+	NATUnknown        = "unknown"
+)
+
+// Result is what DetectNAT found out
+type Result struct {
+	NATType    string
+	MappedAddr *net.UDPAddr // The address the first server saw, nil when none answered
+}
+
+const (
+	magicCookie = 0x2112A442
+	headerSize  = 20
+
+	bindingRequest  = 0x0001
+	bindingSuccess  = 0x0101
+	bindingError    = 0x0111
+	attrMapped      = 0x0001
+	attrChange      = 0x0003
+	attrXORMapped   = 0x0020
+	changeIP        = 0x04
+	changePort      = 0x02
+	familyIPv4      = 0x01
+	familyIPv6      = 0x02
+	maxMessageSize  = 1500
+	firstRetransmit = 250 * time.Millisecond
+)
+
+// ErrNoResponse is returned when a server doesn't answer in time
+var ErrNoResponse = errors.New("no response from STUN server")
+
+// errRefused is an error response, typically to a CHANGE-REQUEST the server
+// doesn't take
+var errRefused = errors.New("STUN server refused the request")
+
+// response is an answer to a binding request
+type response struct {
+	mapped *net.UDPAddr
+	from   *net.UDPAddr // Where the answer came from
+}
+
+// DetectNAT classifies the NAT between this node and the internet, asking
+// the servers in order. Each request waits up to timeout for an answer.
+func DetectNAT(servers []string, timeout time.Duration) (Result, error) {
+	if len(servers) == 0 {
+		servers = DefaultServers
+	}
+
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return Result{NATType: NATUnknown}, err
+	}
+	defer conn.Close()
+
+	// Find a server that answers
+	var first *response
+	var server *net.UDPAddr
+	var lastErr error
+	rest := servers
+	for len(rest) > 0 && first == nil {
+		server, lastErr = net.ResolveUDPAddr("udp4", rest[0])
+		rest = rest[1:]
+		if lastErr == nil {
+			first, lastErr = request(conn, server, 0, timeout)
+		}
+	}
+	if first == nil {
+		if errors.Is(lastErr, ErrNoResponse) {
+			return Result{NATType: NATBlocked}, nil
+		}
+		return Result{NATType: NATUnknown}, lastErr
+	}
+	result := Result{NATType: NATUnknown, MappedAddr: first.mapped}
+
+	if isLocal(first.mapped) {
+		result.NATType = NATOpen
+		return result, nil
+	}
+
+	// Whether another server sees the same mapping
+	for _, other := range rest {
+		otherAddr, err := net.ResolveUDPAddr("udp4", other)
+		if err != nil || otherAddr.IP.Equal(server.IP) {
+			continue
+		}
+		second, err := request(conn, otherAddr, 0, timeout)
+		if err != nil {
+			continue
+		}
+		if !sameAddr(second.mapped, first.mapped) {
+			result.NATType = NATSymmetric
+			return result, nil
+		}
+		break
+	}
+
+	// What the NAT lets in
+	answer, err := request(conn, server, changeIP|changePort, timeout)
+	switch {
+	case err == nil && !answer.from.IP.Equal(server.IP):
+		result.NATType = NATFullCone
+		return result, nil
+	case err == nil || errors.Is(err, errRefused):
+		// The server doesn't change addresses
+		result.NATType = NATPortRestricted
+		return result, nil
+	}
+	if answer, err := request(conn, server, changePort, timeout); err == nil && answer.from.Port != server.Port {
+		result.NATType = NATRestricted
+		return result, nil
+	}
+	result.NATType = NATPortRestricted
+	return result, nil
+}
+
+// request sends a binding request to server, asking it to answer from
+// another IP or port when change says so, and waits for the answer
+func request(conn *net.UDPConn, server *net.UDPAddr, change byte, timeout time.Duration) (*response, error) {
+	transaction := make([]byte, 12)
+	if _, err := rand.Read(transaction); err != nil {
+		return nil, err
+	}
+	message := newBindingRequest(transaction, change)
+
+	deadline := time.Now().Add(timeout)
+	retransmit := firstRetransmit
+	buffer := make([]byte, maxMessageSize)
+	for time.Now().Before(deadline) {
+		if _, err := conn.WriteToUDP(message, server); err != nil {
+			return nil, err
+		}
+
+		// Wait for the answer, sending again with growing pauses as RFC 5389 does
+		wait := time.Now().Add(retransmit)
+		if wait.After(deadline) {
+			wait = deadline
+		}
+		retransmit *= 2
+		conn.SetReadDeadline(wait)
+		for {
+			n, from, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			mapped, err := parseResponse(buffer[:n], transaction)
+			if errors.Is(err, errRefused) {
+				return nil, err
+			}
+			if err != nil {
+				// Not an answer to this request, perhaps a late one to an earlier
+				continue
+			}
+			return &response{mapped: mapped, from: from}, nil
+		}
+	}
+	return nil, ErrNoResponse
+}
+
+// newBindingRequest builds a binding request, with a CHANGE-REQUEST
+// attribute when change has flags
+func newBindingRequest(transaction []byte, change byte) []byte {
+	var attributes []byte
+	if change != 0 {
+		attributes = []byte{0, attrChange, 0, 4, 0, 0, 0, change}
+	}
+
+	message := make([]byte, headerSize, headerSize+len(attributes))
+	binary.BigEndian.PutUint16(message[0:], bindingRequest)
+	binary.BigEndian.PutUint16(message[2:], uint16(len(attributes)))
+	binary.BigEndian.PutUint32(message[4:], magicCookie)
+	copy(message[8:], transaction)
+	return append(message, attributes...)
+}
+
+// parseResponse returns the mapped address of a binding response to the
+// request with the given transaction ID
+func parseResponse(message, transaction []byte) (*net.UDPAddr, error) {
+	if len(message) < headerSize || binary.BigEndian.Uint32(message[4:]) != magicCookie || !bytes.Equal(message[8:20], transaction) {
+		return nil, errors.New("not a STUN response to this request")
+	}
+	switch binary.BigEndian.Uint16(message[0:]) {
+	case bindingSuccess:
+	case bindingError:
+		return nil, errRefused
+	default:
+		return nil, errors.New("not a binding response")
+	}
+
+	length := int(binary.BigEndian.Uint16(message[2:]))
+	if headerSize+length > len(message) {
+		return nil, errors.New("truncated STUN response")
+	}
+	attributes := message[headerSize : headerSize+length]
+
+	var mapped *net.UDPAddr
+	for len(attributes) >= 4 {
+		kind := binary.BigEndian.Uint16(attributes[0:])
+		size := int(binary.BigEndian.Uint16(attributes[2:]))
+		if 4+size > len(attributes) {
+			return nil, errors.New("truncated STUN attribute")
+		}
+		value := attributes[4 : 4+size]
+		switch kind {
+		case attrXORMapped:
+			// Preferred, NATs that rewrite addresses in packets leave it alone
+			if addr, err := parseAddress(value, message[4:20]); err == nil {
+				return addr, nil
+			}
+		case attrMapped:
+			if addr, err := parseAddress(value, nil); err == nil {
+				mapped = addr
+			}
+		}
+		// Attributes are padded to 4 bytes
+		padded := (size + 3) &^ 3
+		if 4+padded > len(attributes) {
+			break
+		}
+		attributes = attributes[4+padded:]
+	}
+	if mapped == nil {
+		return nil, errors.New("STUN response has no mapped address")
+	}
+	return mapped, nil
+}
+
+// parseAddress reads a (XOR-)MAPPED-ADDRESS value. For XOR-MAPPED-ADDRESS
+// key is the magic cookie and transaction ID the address is XORed with.
+func parseAddress(value, key []byte) (*net.UDPAddr, error) {
+	if len(value) < 4 {
+		return nil, errors.New("short address")
+	}
+	var size int
+	switch value[1] {
+	case familyIPv4:
+		size = net.IPv4len
+	case familyIPv6:
+		size = net.IPv6len
+	default:
+		return nil, fmt.Errorf("unknown address family %d", value[1])
+	}
+	if len(value) < 4+size {
+		return nil, errors.New("short address")
+	}
+
+	port := binary.BigEndian.Uint16(value[2:])
+	ip := make(net.IP, size)
+	copy(ip, value[4:4+size])
+	if key != nil {
+		port ^= uint16(magicCookie >> 16)
+		for i := range ip {
+			ip[i] ^= key[i]
+		}
+	}
+	return &net.UDPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// isLocal reports whether addr is an address of this machine
+func isLocal(addr *net.UDPAddr) bool {
+	addresses, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, address := range addresses {
+		if network, ok := address.(*net.IPNet); ok && network.IP.Equal(addr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func sameAddr(a, b *net.UDPAddr) bool {
+	return a.IP.Equal(b.IP) && a.Port == b.Port
+}
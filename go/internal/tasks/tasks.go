@@ -0,0 +1,114 @@
+package tasks
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Task is a background operation started from the interactive shell
+type Task struct {
+	ID      int
+	Name    string
+	Started time.Time
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+var (
+	tasks      = make(map[int]*Task)
+	nextTaskID = 1
+	tasksMutex sync.Mutex
+)
+
+// Start runs fn in the background as a named task. The context passed to fn
+// is cancelled by Cancel or CancelAll; onDone, if set, is called with fn's
+// error once it returns.
+func Start(name string, fn func(ctx context.Context) error, onDone func(error)) *Task {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	tasksMutex.Lock()
+	task := &Task{
+		ID:      nextTaskID,
+		Name:    name,
+		Started: time.Now(),
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	nextTaskID++
+	tasks[task.ID] = task
+	tasksMutex.Unlock()
+
+	go func() {
+		defer func() {
+			cancel()
+			tasksMutex.Lock()
+			delete(tasks, task.ID)
+			tasksMutex.Unlock()
+			close(task.done)
+		}()
+
+		err := fn(ctx)
+		if onDone != nil {
+			onDone(err)
+		}
+	}()
+
+	return task
+}
+
+// List returns the running tasks, oldest first
+func List() []Task {
+	tasksMutex.Lock()
+	defer tasksMutex.Unlock()
+
+	list := make([]Task, 0, len(tasks))
+	for _, task := range tasks {
+		list = append(list, Task{ID: task.ID, Name: task.Name, Started: task.Started})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// Cancel stops a single task by ID
+func Cancel(id int) error {
+	tasksMutex.Lock()
+	task, exists := tasks[id]
+	tasksMutex.Unlock()
+
+	if !exists {
+		return fmt.Errorf("no running task with ID %d", id)
+	}
+	task.cancel()
+	return nil
+}
+
+// CancelAll cancels every task and waits up to timeout for them to finish.
+// It returns how many tasks were still running when it gave up.
+func CancelAll(timeout time.Duration) int {
+	tasksMutex.Lock()
+	running := make([]*Task, 0, len(tasks))
+	for _, task := range tasks {
+		running = append(running, task)
+	}
+	tasksMutex.Unlock()
+
+	for _, task := range running {
+		task.cancel()
+	}
+
+	deadline := time.After(timeout)
+	remaining := len(running)
+	for _, task := range running {
+		select {
+		case <-task.done:
+			remaining--
+		case <-deadline:
+			return remaining
+		}
+	}
+	return remaining
+}
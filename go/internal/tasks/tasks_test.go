@@ -0,0 +1,135 @@
+package tasks
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// blockUntilCancelled is a task that runs until it is cancelled
+func blockUntilCancelled(ctx context.Context) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// waitGone waits for the task to finish and leave the list
+func waitGone(t *testing.T, task *Task) {
+	t.Helper()
+	select {
+	case <-task.done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("task %d (%s) didn't finish", task.ID, task.Name)
+	}
+}
+
+func TestTasks(t *testing.T) {
+	tests := []struct {
+		name    string
+		fn      func(ctx context.Context) error
+		cancel  bool  // Cancel the task by ID
+		wantErr error // Passed to onDone
+	}{
+		{"finishes on its own", func(context.Context) error { return nil }, false, nil},
+		{"fails on its own", func(context.Context) error { return errors.New("broken") }, false, errors.New("broken")},
+		{"cancelled", blockUntilCancelled, true, context.Canceled},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			done := make(chan error, 1)
+			task := Start(test.name, test.fn, func(err error) { done <- err })
+			if test.cancel {
+				found := false
+				for _, listed := range List() {
+					found = found || listed.ID == task.ID
+				}
+				if !found {
+					t.Fatalf("task %d isn't listed while running", task.ID)
+				}
+				if err := Cancel(task.ID); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var err error
+			select {
+			case err = <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("onDone wasn't called")
+			}
+			if (err == nil) != (test.wantErr == nil) || (err != nil && err.Error() != test.wantErr.Error()) {
+				t.Errorf("onDone got %v, want %v", err, test.wantErr)
+			}
+			waitGone(t, task)
+			for _, listed := range List() {
+				if listed.ID == task.ID {
+					t.Errorf("task %d is still listed after it finished", task.ID)
+				}
+			}
+			if err := Cancel(task.ID); err == nil {
+				t.Error("cancelling a finished task succeeded")
+			}
+		})
+	}
+}
+
+func TestListOrder(t *testing.T) {
+	first := Start("first", blockUntilCancelled, nil)
+	second := Start("second", blockUntilCancelled, nil)
+	defer CancelAll(time.Second)
+
+	list := List()
+	if len(list) != 2 || list[0].ID != first.ID || list[1].ID != second.ID {
+		t.Fatalf("listed %+v, want first then second", list)
+	}
+}
+
+func TestCancelAll(t *testing.T) {
+	tests := []struct {
+		name      string
+		fn        func(ctx context.Context) error
+		remaining int
+	}{
+		{"cancellable tasks", blockUntilCancelled, 0},
+		{"tasks ignoring cancellation", func(context.Context) error { time.Sleep(time.Second); return nil }, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			started := make([]*Task, 3)
+			for i := range started {
+				started[i] = Start(test.name, test.fn, nil)
+			}
+			if remaining := CancelAll(50 * time.Millisecond); remaining != test.remaining {
+				t.Errorf("CancelAll left %d tasks running, want %d", remaining, test.remaining)
+			}
+			for _, task := range started {
+				waitGone(t, task)
+			}
+		})
+	}
+}
+
+// TestNoLeaks checks the goroutines of finished and cancelled tasks end
+func TestNoLeaks(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+
+	for i := 0; i < 50; i++ {
+		Start("blocking", blockUntilCancelled, nil)
+		Start("quick", func(context.Context) error { return nil }, func(error) {})
+	}
+	if remaining := CancelAll(5 * time.Second); remaining != 0 {
+		t.Fatalf("%d tasks still running", remaining)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > baseline {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines running, %d before the tasks started", runtime.NumGoroutine(), baseline)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(List()) != 0 {
+		t.Errorf("%d tasks still listed", len(List()))
+	}
+}
@@ -0,0 +1,146 @@
+package transfer
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// PIN authentication
+//
+// A sender that has a PIN sets Auth in its batch header and then reads an
+// authChallenge. If the receiver has no PIN the challenge says so and the
+// transfer goes on. Otherwise the sender answers the nonce with
+// HMAC-SHA256(PIN, nonce) and the receiver replies with an authResult. The
+// receiver gives up after maxPINAttempts wrong answers on one connection.
+//
+// The PIN itself never crosses the wire, but a short PIN can be guessed
+// offline from a captured exchange, so on untrusted networks combine it with TLS.
+
+const (
+	// maxPINAttempts is how many wrong answers a connection gets
+	maxPINAttempts = 3
+
+	// authNonceSize is the length of a challenge nonce in bytes
+	authNonceSize = 32
+)
+
+var (
+	// ErrPINRejected is returned to a sender whose PIN the receiver did not accept
+	ErrPINRejected = errors.New("receiver rejected PIN")
+
+	// ErrPINRequired is returned to a sender without a PIN by a receiver that requires one
+	ErrPINRequired = errors.New("the receiver requires a PIN, send again with --pin")
+)
+
+// authChallenge is the receiver's answer to a batch header announcing a PIN
+type authChallenge struct {
+	Required bool   `json:"required"`
+	Nonce    string `json:"nonce,omitempty"` // Hex encoded, set when Required
+}
+
+// authResponse is the sender's answer to a challenge
+type authResponse struct {
+	MAC string `json:"mac"` // Hex encoded HMAC-SHA256 of the nonce, keyed with the PIN
+}
+
+// authResult tells the sender whether its answer was accepted
+type authResult struct {
+	OK           bool `json:"ok"`
+	AttemptsLeft int  `json:"attempts_left,omitempty"`
+}
+
+// pinMAC computes the answer to a challenge nonce
+func pinMAC(pin string, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(pin))
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
+
+// authenticateSender proves knowledge of the PIN to the receiver and
+// reports whether the receiver asked for it at all
+func authenticateSender(conn net.Conn, pin string) (bool, error) {
+	var challenge authChallenge
+	if err := readMessage(conn, &challenge); err != nil {
+		return false, fmt.Errorf("failed to read PIN challenge: %w", err)
+	}
+	if !challenge.Required {
+		return false, nil
+	}
+
+	nonce, err := hex.DecodeString(challenge.Nonce)
+	if err != nil || len(nonce) != authNonceSize {
+		return true, errors.New("receiver sent an invalid PIN challenge")
+	}
+	if err := writeMessage(conn, authResponse{MAC: hex.EncodeToString(pinMAC(pin, nonce))}); err != nil {
+		return true, fmt.Errorf("failed to answer PIN challenge: %v", err)
+	}
+
+	var result authResult
+	if err := readMessage(conn, &result); err != nil {
+		return true, fmt.Errorf("failed to read PIN result: %v", err)
+	}
+	if !result.OK {
+		return true, ErrPINRejected
+	}
+	return true, nil
+}
+
+// authenticateReceiver checks the sender's PIN, if this receiver requires one
+func authenticateReceiver(conn net.Conn, batch batchHeader, pin string) error {
+	if !batch.Auth {
+		if pin == "" {
+			return nil
+		}
+		return turnAway(conn, resumeOffer{Declined: ErrPINRequired.Error(), AuthRequired: true},
+			errors.New("sender did not supply a PIN"))
+	}
+
+	if pin == "" {
+		return writeMessage(conn, authChallenge{Required: false})
+	}
+
+	for attempt := 1; attempt <= maxPINAttempts; attempt++ {
+		nonce := make([]byte, authNonceSize)
+		if _, err := rand.Read(nonce); err != nil {
+			return fmt.Errorf("failed to create PIN challenge: %v", err)
+		}
+		if err := writeMessage(conn, authChallenge{Required: true, Nonce: hex.EncodeToString(nonce)}); err != nil {
+			return fmt.Errorf("failed to send PIN challenge: %v", err)
+		}
+
+		var response authResponse
+		if err := readMessage(conn, &response); err != nil {
+			if attempt > 1 {
+				return errors.New("wrong PIN, the sender gave up")
+			}
+			return fmt.Errorf("PIN check failed: %v", err)
+		}
+		mac, err := hex.DecodeString(response.MAC)
+		if err == nil && hmac.Equal(mac, pinMAC(pin, nonce)) {
+			return writeMessage(conn, authResult{OK: true})
+		}
+
+		if err := writeMessage(conn, authResult{AttemptsLeft: maxPINAttempts - attempt}); err != nil {
+			return fmt.Errorf("failed to send PIN result: %v", err)
+		}
+	}
+
+	return fmt.Errorf("wrong PIN %d times, connection dropped", maxPINAttempts)
+}
+
+// turnAway refuses a sender with an explanation. The sender reads a resume
+// offer after its first file header, so that is where the reason goes.
+func turnAway(conn net.Conn, offer resumeOffer, reason error) error {
+	var header fileHeader
+	if err := readMessage(conn, &header); err != nil {
+		return fmt.Errorf("%v: %v", reason, err)
+	}
+	writeMessage(conn, offer)
+
+	return reason
+}
@@ -0,0 +1,60 @@
+package transfer
+
+import (
+	"io"
+	"sync"
+)
+
+// Copy buffers
+//
+// File data moves between the connection and the disk through a buffer of
+// TransferOptions.BufferSize bytes. The 32 KiB io.Copy uses on its own means
+// a system call for every few packets, which caps throughput well below a
+// gigabit link. Buffers of the default size are pooled, since checksumming
+// needs one for every file and chunk.
+
+// DefaultBufferSize is the copy buffer used when TransferOptions.BufferSize is not set
+const DefaultBufferSize = 1024 * 1024
+
+// Buffer sizes a caller may ask for
+const (
+	minBufferSize = 4 * 1024
+	maxBufferSize = 64 * 1024 * 1024
+)
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		buffer := make([]byte, DefaultBufferSize)
+		return &buffer
+	},
+}
+
+// bufferSize returns the configured copy buffer size, within sensible bounds
+func (options TransferOptions) bufferSize() int {
+	if options.BufferSize <= 0 {
+		return DefaultBufferSize
+	}
+	return min(max(options.BufferSize, minBufferSize), maxBufferSize)
+}
+
+// getBuffer returns a buffer of size bytes and a function that releases it
+func getBuffer(size int) ([]byte, func()) {
+	if size != DefaultBufferSize {
+		return make([]byte, size), func() {}
+	}
+	buffer := bufferPool.Get().(*[]byte)
+	return *buffer, func() { bufferPool.Put(buffer) }
+}
+
+// copyBuffered copies n bytes from src to dst through a buffer of size
+// bytes. Like io.CopyN it returns io.EOF when src ends early.
+func copyBuffered(dst io.Writer, src io.Reader, n int64, size int) (int64, error) {
+	buffer, release := getBuffer(size)
+	defer release()
+
+	written, err := io.CopyBuffer(dst, io.LimitReader(src, n), buffer)
+	if written < n && err == nil {
+		err = io.EOF
+	}
+	return written, err
+}
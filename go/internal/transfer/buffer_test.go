@@ -0,0 +1,82 @@
+package transfer
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+)
+
+// benchmarkFileSize is the size of the file the copy benchmarks send
+const benchmarkFileSize = 64 * 1024 * 1024
+
+// loopbackSink returns a loopback TCP connection whose other end discards
+// what it reads, and a function that waits for the other end to see the
+// connection close
+func loopbackSink(b *testing.B) (*net.TCPConn, func()) {
+	b.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer listener.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(io.Discard, conn)
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	return conn.(*net.TCPConn), func() {
+		conn.Close()
+		<-done
+	}
+}
+
+// benchmarkFile writes a file of benchmarkFileSize bytes
+func benchmarkFile(b *testing.B) *os.File {
+	b.Helper()
+	file, err := os.CreateTemp(b.TempDir(), "benchmark")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { file.Close() })
+	if err := file.Truncate(benchmarkFileSize); err != nil {
+		b.Fatal(err)
+	}
+	return file
+}
+
+// BenchmarkCopyBuffered sends a file over loopback through buffers of
+// several sizes, io.Copy's own among them
+func BenchmarkCopyBuffered(b *testing.B) {
+	file := benchmarkFile(b)
+	for _, size := range []int{32 * 1024, 256 * 1024, DefaultBufferSize, 4 * 1024 * 1024} {
+		b.Run(fmt.Sprintf("%dKiB", size/1024), func(b *testing.B) {
+			conn, wait := loopbackSink(b)
+			defer wait()
+			// Hide ReadFrom so the buffer is used rather than sendfile
+			dst := struct{ io.Writer }{conn}
+
+			b.SetBytes(benchmarkFileSize)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := file.Seek(0, io.SeekStart); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := copyBuffered(dst, file, benchmarkFileSize, size); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
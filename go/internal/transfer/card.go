@@ -0,0 +1,304 @@
+package transfer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fileshare/internal/utils"
+)
+
+// Connection cards
+//
+// A receiver listens on every address, but a machine with WiFi, ethernet and
+// a VPN has several and senders used to pick the wrong one. Once listening,
+// the receiver connects to itself on each address to confirm the listener
+// answers there, then sums up how to reach it in a ConnectionCard: one
+// recommended address, the alternates and a warning when only VPN or
+// link-local addresses exist. Cards of running receivers are kept in
+// DataDir so 'status' and the node's control API can show them later.
+
+const (
+	// receiversFile lists the cards of running receivers in DataDir
+	receiversFile = "receivers.json"
+
+	// URIScheme prefixes connection URIs, bitshare://host:port
+	URIScheme = "bitshare"
+
+	selfCheckTimeout = time.Second
+)
+
+// CardAddress is one address a receiver can be reached on
+type CardAddress struct {
+	Address   string `json:"address"` // host:port
+	Interface string `json:"interface"`
+	Kind      string `json:"kind"`      // One of the utils.Address kinds
+	Reachable bool   `json:"reachable"` // A connection to it reached the listener
+}
+
+// ConnectionCard tells senders how to reach a receiver
+type ConnectionCard struct {
+	Port        int           `json:"port"`
+	Recommended string        `json:"recommended,omitempty"` // host:port, empty when nothing is reachable
+	URI         string        `json:"uri,omitempty"`         // Encodes the recommended address
+	Alternates  []CardAddress `json:"alternates,omitempty"`
+	Warning     string        `json:"warning,omitempty"`
+	TLS         bool          `json:"tls"`
+	Fingerprint string        `json:"fingerprint,omitempty"`
+	PIN         bool          `json:"pin"`
+	PID         int           `json:"pid"`
+	StartedAt   time.Time     `json:"started_at"`
+}
+
+var receiversMutex sync.Mutex
+
+// selfChecks remembers the connections a receiver makes to itself, so the
+// accept loop can drop them without treating them as senders
+type selfChecks struct {
+	mutex sync.Mutex
+	addrs map[string]bool
+	done  chan struct{} // Closed once every check has been made
+}
+
+func newSelfChecks() *selfChecks {
+	return &selfChecks{addrs: make(map[string]bool), done: make(chan struct{})}
+}
+
+func (s *selfChecks) add(addr string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.addrs[addr] = true
+}
+
+// claim reports whether conn is a self check, forgetting it if so. A check
+// can be accepted before its dialer has recorded it, so connections from
+// this host wait for the checks to finish.
+func (s *selfChecks) claim(conn net.Conn) bool {
+	remote, ok := conn.RemoteAddr().(*net.TCPAddr)
+	local, _ := conn.LocalAddr().(*net.TCPAddr)
+	if !ok || local == nil || !remote.IP.Equal(local.IP) {
+		return false
+	}
+	<-s.done
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	addr := remote.String()
+	if !s.addrs[addr] {
+		return false
+	}
+	delete(s.addrs, addr)
+	return true
+}
+
+// check connects to the listener on address, reporting whether it answered
+func (s *selfChecks) check(address string) bool {
+	conn, err := net.DialTimeout("tcp", address, selfCheckTimeout)
+	if err != nil {
+		return false
+	}
+	s.add(conn.LocalAddr().String())
+	conn.Close()
+	return true
+}
+
+// newConnectionCard ranks the local addresses and checks that the listener
+// on port answers on each of them
+func newConnectionCard(port int, options TransferOptions, fingerprint string, checks *selfChecks) ConnectionCard {
+	defer close(checks.done)
+
+	card := ConnectionCard{
+		Port:        port,
+		TLS:         options.TLS,
+		Fingerprint: fingerprint,
+		PIN:         options.PIN != "",
+		PID:         os.Getpid(),
+		StartedAt:   time.Now(),
+	}
+
+	local, err := utils.GetLocalAddresses()
+	if err != nil {
+		card.Warning = "No network address found - other devices cannot connect. Check your network connection."
+		return card
+	}
+
+	addresses := make([]CardAddress, len(local))
+	var wg sync.WaitGroup
+	for i, address := range local {
+		addresses[i] = CardAddress{
+			Address:   net.JoinHostPort(address.IP, strconv.Itoa(port)),
+			Interface: address.Interface,
+			Kind:      address.Kind,
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			addresses[i].Reachable = checks.check(addresses[i].Address)
+		}(i)
+	}
+	wg.Wait()
+
+	// Addresses are ranked already, so the first reachable one is the best
+	best := -1
+	for i, address := range addresses {
+		if address.Reachable {
+			best = i
+			break
+		}
+	}
+	if best < 0 {
+		card.Warning = "The receiver did not answer on any network address - check your firewall and network connection."
+		card.Alternates = addresses
+		return card
+	}
+
+	card.Recommended = addresses[best].Address
+	host, _, _ := net.SplitHostPort(card.Recommended)
+	card.URI = ConnectionURI(host, port, options.TLS)
+	card.Alternates = append(addresses[:best:best], addresses[best+1:]...)
+
+	switch addresses[best].Kind {
+	case utils.AddressVPN:
+		card.Warning = "Only VPN addresses are available - senders must be connected to the same VPN."
+	case utils.AddressVirtual:
+		card.Warning = "Only virtual machine or container addresses are available - other devices on your network cannot connect."
+	case utils.AddressLinkLocal:
+		card.Warning = "Only link-local (169.254.x.x or fe80::) addresses are available. Your computer may not be connected to the network correctly - check your network connection."
+	}
+	return card
+}
+
+// ConnectionURI encodes a receiver address as bitshare://host:port
+func ConnectionURI(host string, port int, useTLS bool) string {
+	uri := url.URL{Scheme: URIScheme, Host: net.JoinHostPort(host, strconv.Itoa(port))}
+	if useTLS {
+		uri.RawQuery = "tls=1"
+	}
+	return uri.String()
+}
+
+// ParseConnectionURI decodes a URI made by ConnectionURI
+func ParseConnectionURI(uri string) (host string, port int, useTLS bool, err error) {
+	parsed, err := url.Parse(uri)
+	if err != nil || parsed.Scheme != URIScheme {
+		return "", 0, false, fmt.Errorf("not a %s:// address: %q", URIScheme, uri)
+	}
+	host = parsed.Hostname()
+	port, err = strconv.Atoi(parsed.Port())
+	if host == "" || err != nil || port <= 0 || port > 65535 {
+		return "", 0, false, fmt.Errorf("invalid address in %q, expected %s://host:port", uri, URIScheme)
+	}
+	useTLS = parsed.Query().Get("tls") == "1"
+	return host, port, useTLS, nil
+}
+
+// IsConnectionURI reports whether s looks like a connection URI
+func IsConnectionURI(s string) bool {
+	return strings.HasPrefix(strings.ToLower(s), URIScheme+"://")
+}
+
+func receiversPath() (string, error) {
+	dir, err := utils.DataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, receiversFile), nil
+}
+
+func loadReceivers() []ConnectionCard {
+	var cards []ConnectionCard
+
+	path, err := receiversPath()
+	if err != nil {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	json.Unmarshal(data, &cards)
+	return cards
+}
+
+func saveReceivers(cards []ConnectionCard) error {
+	path, err := receiversPath()
+	if err != nil {
+		return err
+	}
+	if len(cards) == 0 {
+		err := os.Remove(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	data, err := json.MarshalIndent(cards, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// publishConnectionCard records the card of a receiver that started listening
+func publishConnectionCard(card ConnectionCard) error {
+	receiversMutex.Lock()
+	defer receiversMutex.Unlock()
+
+	cards := []ConnectionCard{card}
+	for _, other := range loadReceivers() {
+		if other.Port != card.Port {
+			cards = append(cards, other)
+		}
+	}
+	return saveReceivers(cards)
+}
+
+// WithdrawConnectionCard forgets the card of a receiver of this process that stopped
+func WithdrawConnectionCard(port int) error {
+	receiversMutex.Lock()
+	defer receiversMutex.Unlock()
+
+	var cards []ConnectionCard
+	for _, card := range loadReceivers() {
+		if card.Port != port || card.PID != os.Getpid() {
+			cards = append(cards, card)
+		}
+	}
+	return saveReceivers(cards)
+}
+
+// ConnectionCards returns the cards of the receivers that are listening,
+// most recently started first. A receiver that was killed leaves its card
+// behind until another one takes the port, so each port is checked.
+func ConnectionCards() []ConnectionCard {
+	receiversMutex.Lock()
+	defer receiversMutex.Unlock()
+
+	var listening []ConnectionCard
+	for _, card := range loadReceivers() {
+		if portInUse(card.Port) {
+			listening = append(listening, card)
+		}
+	}
+	return listening
+}
+
+// portInUse reports whether something is listening on port, by trying to take it
+func portInUse(port int) bool {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return true
+	}
+	listener.Close()
+	return false
+}
@@ -0,0 +1,113 @@
+package transfer
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// Chunk encryption
+//
+// With TransferOptions.EncryptionKey set, a chunked transfer encrypts every
+// chunk with AES-256-GCM under that key, which sender and receiver must
+// already share. The nonce is derived from the file ID and the chunk index,
+// which are also authenticated with the data, so a chunk can't be replayed
+// into another file or position. The receiver authenticates and decrypts a
+// chunk before checking its checksum and writing it.
+//
+// The metadata carries a check value of the key rather than the key itself,
+// so a sender and receiver with different keys, or with a key on only one
+// side, find out before any chunk is sent. The receiver confirms in its
+// reply that it will decrypt, since one predating encryption would not.
+// Only the chunk data is encrypted: the file name, size and checksums in the
+// metadata travel as before.
+
+// EncryptionKeySize is the length of TransferOptions.EncryptionKey
+const EncryptionKeySize = 32
+
+// ErrEncryptionKey is wrapped by errors refusing a transfer because sender and
+// receiver don't hold the same encryption key
+var ErrEncryptionKey = errors.New("encryption key mismatch")
+
+// ErrChunkAuthentication is wrapped by errors rejecting a chunk whose
+// encrypted data was not produced with the receiver's key for that chunk
+var ErrChunkAuthentication = errors.New("chunk failed authentication")
+
+// newChunkCipher returns the cipher chunks are encrypted with under key
+func newChunkCipher(key []byte) (cipher.AEAD, error) {
+	if len(key) != EncryptionKeySize {
+		return nil, fmt.Errorf("encryption key must be %d bytes, not %d", EncryptionKeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptionFor returns the cipher for key, or nil when there is no key
+func encryptionFor(key []byte) (cipher.AEAD, error) {
+	if len(key) == 0 {
+		return nil, nil
+	}
+	return newChunkCipher(key)
+}
+
+// keyCheck returns a value telling whether two peers hold the same key for
+// a file without revealing the key
+func keyCheck(key []byte, fileID string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("BitShare chunk key check\x00" + fileID))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// checkEncryption compares how the sender encrypts the chunks with the
+// receiver's key
+func (m chunkMetadata) checkEncryption(key []byte) error {
+	switch {
+	case m.KeyCheck == "" && len(key) == 0:
+		return nil
+	case m.KeyCheck == "":
+		return fmt.Errorf("%w: this receiver only takes encrypted chunks and the sender has no key", ErrEncryptionKey)
+	case len(key) == 0:
+		return fmt.Errorf("%w: the sender encrypts its chunks and this receiver has no key", ErrEncryptionKey)
+	case !hmac.Equal([]byte(m.KeyCheck), []byte(keyCheck(key, m.FileID))):
+		return fmt.Errorf("%w: the sender's key is not the one this receiver has", ErrEncryptionKey)
+	}
+	return nil
+}
+
+// chunkNonce derives the nonce of a chunk: the chunk index followed by the
+// start of a hash of the file ID. File IDs differ between transfers, and a
+// chunk sent again under the same ID has the same data.
+func chunkNonce(aead cipher.AEAD, fileID string, index int) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint32(nonce, uint32(index))
+	sum := sha256.Sum256([]byte(fileID))
+	copy(nonce[4:], sum[:])
+	return nonce
+}
+
+// chunkAdditionalData is what each encrypted chunk is bound to
+func chunkAdditionalData(fileID string, index int) []byte {
+	return []byte(fmt.Sprintf("%s:%d", fileID, index))
+}
+
+// sealChunk encrypts the data of a chunk
+func sealChunk(aead cipher.AEAD, fileID string, index int, data []byte) []byte {
+	return aead.Seal(nil, chunkNonce(aead, fileID, index), data, chunkAdditionalData(fileID, index))
+}
+
+// openChunk authenticates and decrypts what sealChunk produced
+func openChunk(aead cipher.AEAD, fileID string, index int, sealed []byte) ([]byte, error) {
+	data, err := aead.Open(nil, chunkNonce(aead, fileID, index), sealed, chunkAdditionalData(fileID, index))
+	if err != nil {
+		return nil, fmt.Errorf("%w: wrong key or tampered data", ErrChunkAuthentication)
+	}
+	return data, nil
+}
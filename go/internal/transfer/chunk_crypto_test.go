@@ -0,0 +1,144 @@
+package transfer
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testKey returns an encryption key filled with b
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, EncryptionKeySize)
+}
+
+func TestOpenChunk(t *testing.T) {
+	data := []byte("the data of chunk 3")
+	aead, err := newChunkCipher(testKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed := sealChunk(aead, "file-a", 3, data)
+
+	flipped := append([]byte(nil), sealed...)
+	flipped[0] ^= 0x01
+	tag := append([]byte(nil), sealed...)
+	tag[len(tag)-1] ^= 0x80
+
+	tests := []struct {
+		name   string
+		sealed []byte
+		fileID string
+		index  int
+		key    byte // Of the receiver
+	}{
+		{"intact", sealed, "file-a", 3, 1},
+		{"flipped ciphertext byte", flipped, "file-a", 3, 1},
+		{"flipped tag byte", tag, "file-a", 3, 1},
+		{"wrong key", sealed, "file-a", 3, 2},
+		{"moved to another index", sealed, "file-a", 4, 1},
+		{"moved to another file", sealed, "file-b", 3, 1},
+		{"truncated", sealed[:len(sealed)-1], "file-a", 3, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opener, err := newChunkCipher(testKey(test.key))
+			if err != nil {
+				t.Fatal(err)
+			}
+			opened, err := openChunk(opener, test.fileID, test.index, test.sealed)
+			if test.name == "intact" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(opened, data) {
+					t.Errorf("opened %q, want %q", opened, data)
+				}
+				return
+			}
+			if !errors.Is(err, ErrChunkAuthentication) {
+				t.Fatalf("got %v, want %v", err, ErrChunkAuthentication)
+			}
+		})
+	}
+}
+
+func TestCheckEncryption(t *testing.T) {
+	tests := []struct {
+		name     string
+		sender   []byte
+		receiver []byte
+		mismatch bool
+	}{
+		{"no keys", nil, nil, false},
+		{"same key", testKey(1), testKey(1), false},
+		{"different keys", testKey(1), testKey(2), true},
+		{"sender only", testKey(1), nil, true},
+		{"receiver only", nil, testKey(1), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			metadata := chunkMetadata{FileID: "file-a"}
+			if test.sender != nil {
+				metadata.KeyCheck = keyCheck(test.sender, metadata.FileID)
+			}
+			err := metadata.checkEncryption(test.receiver)
+			if test.mismatch != errors.Is(err, ErrEncryptionKey) {
+				t.Fatalf("got %v, want mismatch %t", err, test.mismatch)
+			}
+		})
+	}
+}
+
+// TestEncryptedTransfer sends a file over loopback with keys on one, both or
+// neither side
+func TestEncryptedTransfer(t *testing.T) {
+	source, data := writeTestFile(t, t.TempDir(), "secret.bin", 100*1024)
+	tests := []struct {
+		name     string
+		sender   []byte
+		receiver []byte
+		mismatch bool
+	}{
+		{"encrypted", testKey(1), testKey(1), false},
+		{"wrong key", testKey(1), testKey(2), true},
+		{"key on the sender only", testKey(1), nil, true},
+		{"key on the receiver only", nil, testKey(1), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			address, dir := freeAddress(t), t.TempDir()
+			receiverOptions := testOptions()
+			receiverOptions.EncryptionKey = test.receiver
+			received := make(chan error, 1)
+			go func() { received <- ReceiveFileChunked(address, dir, receiverOptions) }()
+			time.Sleep(50 * time.Millisecond)
+
+			senderOptions := testOptions()
+			senderOptions.EncryptionKey = test.sender
+			err := SendFileChunked(source, address, senderOptions)
+			receiveErr := <-received
+			if test.mismatch {
+				if !errors.Is(err, ErrEncryptionKey) && !errors.Is(receiveErr, ErrEncryptionKey) {
+					t.Fatalf("sent with %v and received with %v, want %v", err, receiveErr, ErrEncryptionKey)
+				}
+				if _, err := os.Stat(filepath.Join(dir, "secret.bin")); err == nil {
+					t.Error("file was saved despite the key mismatch")
+				}
+				return
+			}
+			if err != nil || receiveErr != nil {
+				t.Fatalf("sent with %v and received with %v", err, receiveErr)
+			}
+			got, err := os.ReadFile(filepath.Join(dir, "secret.bin"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Error("received file differs from the one sent")
+			}
+		})
+	}
+}
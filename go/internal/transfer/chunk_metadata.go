@@ -0,0 +1,283 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"time"
+)
+
+// Chunked transfer metadata
+//
+// Before any chunk is sent the sender connects to the receiver and describes
+// the file in a chunkMetadata frame. The per-chunk checksums don't fit in a
+// single control message for large files, so they follow in chunkChecksums
+// frames of at most checksumsPerFrame each, in chunk order. The receiver
+// checks that the description is consistent, prepares the file and answers
+// with a chunkMetadataReply: either a rejection with the reason, or an
+// acceptance listing the chunks it already holds, which the sender skips.
+// The chunk connections described in chunked_transfer.go follow.
+
+const (
+	// Chunk sizes a receiver accepts
+	minChunkSize = 4 * 1024
+	maxChunkSize = 64 * 1024 * 1024
+
+	// maxChunkCount bounds how many chunks a file may be split into
+	maxChunkCount = 1 << 20
+
+	// checksumsPerFrame keeps each chunkChecksums frame under maxMessageSize
+	checksumsPerFrame = 512
+
+	// maxFileIDLength bounds the file ID, which generateFileID makes 16 characters long
+	maxFileIDLength = 64
+)
+
+// chunkMetadata describes a file before its chunks are sent
+type chunkMetadata struct {
+	FileID      string   `json:"file_id"`
+	FileName    string   `json:"file_name"`
+	FileSize    int64    `json:"file_size"`
+	ChunkSize   int64    `json:"chunk_size"`
+	TotalChunks int      `json:"total_chunks"`
+	KeyCheck    string   `json:"key_check,omitempty"` // Set when the chunks are encrypted (see chunk_crypto.go)
+	Swarm       bool     `json:"swarm,omitempty"`     // Sent to several receivers at once (see swarm.go)
+	Checksums   []string `json:"-"`                   // Sent in chunkChecksums frames after the metadata
+}
+
+// chunkChecksums carries the next checksums of a chunkMetadata, in chunk order
+type chunkChecksums struct {
+	Checksums []string `json:"checksums"`
+}
+
+// chunkMetadataReply is the receiver's answer to a chunkMetadata
+type chunkMetadataReply struct {
+	Accepted bool   `json:"accepted"`
+	Error    string `json:"error,omitempty"` // Why the file was rejected
+	Have     []int  `json:"have,omitempty"`  // Chunks the receiver already holds and verified
+
+	// Encrypted confirms the receiver will decrypt the chunks
+	Encrypted bool `json:"encrypted,omitempty"`
+}
+
+// newChunkMetadata describes a transfer for the receiver
+func newChunkMetadata(info *FileTransferInfo) chunkMetadata {
+	info.Mutex.Lock()
+	defer info.Mutex.Unlock()
+
+	checksums := make([]string, len(info.Chunks))
+	for i, chunk := range info.Chunks {
+		checksums[i] = chunk.Checksum
+	}
+	return chunkMetadata{
+		FileID:      info.FileID,
+		FileName:    info.FileName,
+		FileSize:    info.FileSize,
+		ChunkSize:   info.ChunkSize,
+		TotalChunks: info.TotalChunks,
+		Swarm:       info.swarm,
+		Checksums:   checksums,
+	}
+}
+
+// transferInfo lays out the chunks of the file the metadata describes
+func (m chunkMetadata) transferInfo() *FileTransferInfo {
+	info := &FileTransferInfo{
+		FileID:      m.FileID,
+		FileName:    m.FileName,
+		FileSize:    m.FileSize,
+		ChunkSize:   m.ChunkSize,
+		TotalChunks: m.TotalChunks,
+		Chunks:      make([]ChunkInfo, m.TotalChunks),
+		StartTime:   time.Now(),
+		Status:      "preparing",
+		swarm:       m.Swarm,
+	}
+	for i := range info.Chunks {
+		offset := int64(i) * m.ChunkSize
+		info.Chunks[i] = ChunkInfo{
+			Index:    i,
+			Offset:   offset,
+			Size:     min(m.ChunkSize, m.FileSize-offset),
+			Checksum: m.Checksums[i],
+		}
+	}
+	return info
+}
+
+// validate rejects metadata a well-behaved sender would never produce
+func (m chunkMetadata) validate(maxFileSize int64) error {
+	if m.FileID == "" || len(m.FileID) > maxFileIDLength {
+		return fmt.Errorf("invalid file ID length: %d bytes", len(m.FileID))
+	}
+	if err := validateFileName(m.FileName); err != nil {
+		return err
+	}
+	if filepath.Base(m.FileName) != m.FileName {
+		return fmt.Errorf("file name %q contains a path", m.FileName)
+	}
+	if m.FileSize <= 0 {
+		return fmt.Errorf("invalid file size: %d bytes", m.FileSize)
+	}
+	if err := checkFileSize(m.FileSize, maxFileSize); err != nil {
+		return err
+	}
+	if m.ChunkSize < minChunkSize || m.ChunkSize > maxChunkSize {
+		return fmt.Errorf("chunk size %d is outside %d to %d bytes", m.ChunkSize, minChunkSize, maxChunkSize)
+	}
+	if m.TotalChunks <= 0 || m.TotalChunks > maxChunkCount {
+		return fmt.Errorf("invalid chunk count: %d", m.TotalChunks)
+	}
+	if expected := (m.FileSize + m.ChunkSize - 1) / m.ChunkSize; int64(m.TotalChunks) != expected {
+		return fmt.Errorf("%d chunks of %d bytes don't make a file of %d bytes", m.TotalChunks, m.ChunkSize, m.FileSize)
+	}
+	if len(m.Checksums) != m.TotalChunks {
+		return fmt.Errorf("%d checksums for %d chunks", len(m.Checksums), m.TotalChunks)
+	}
+	for i, checksum := range m.Checksums {
+		if !validChecksum(checksum) {
+			return fmt.Errorf("chunk %d has no valid checksum", i)
+		}
+	}
+	return nil
+}
+
+// writeChunkMetadata sends the metadata frame followed by its checksums
+func writeChunkMetadata(conn net.Conn, m chunkMetadata) error {
+	if err := writeMessage(conn, m); err != nil {
+		return err
+	}
+	for start := 0; start < len(m.Checksums); start += checksumsPerFrame {
+		end := min(start+checksumsPerFrame, len(m.Checksums))
+		if err := writeMessage(conn, chunkChecksums{Checksums: m.Checksums[start:end]}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readChunkMetadata reads what writeChunkMetadata sent
+func readChunkMetadata(conn net.Conn) (chunkMetadata, error) {
+	var m chunkMetadata
+	if err := readMessage(conn, &m); err != nil {
+		return m, err
+	}
+	if m.TotalChunks <= 0 || m.TotalChunks > maxChunkCount {
+		return m, fmt.Errorf("invalid chunk count: %d", m.TotalChunks)
+	}
+
+	m.Checksums = make([]string, 0, m.TotalChunks)
+	for len(m.Checksums) < m.TotalChunks {
+		var frame chunkChecksums
+		if err := readMessage(conn, &frame); err != nil {
+			return m, err
+		}
+		if len(frame.Checksums) == 0 || len(m.Checksums)+len(frame.Checksums) > m.TotalChunks {
+			return m, errors.New("checksums don't match the chunk count")
+		}
+		m.Checksums = append(m.Checksums, frame.Checksums...)
+	}
+	return m, nil
+}
+
+// sendFileMetadata describes the file to the receiver at peerID and marks the
+// chunks the receiver already holds as completed
+func sendFileMetadata(info *FileTransferInfo, peerID string, options TransferOptions) error {
+	conn, err := options.dial(options.Context, peerID)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %v", peerID, err)
+	}
+	defer conn.Close()
+	defer closeOnCancel(options.Context, conn)()
+
+	metadata := newChunkMetadata(info)
+	if info.aead != nil {
+		metadata.KeyCheck = keyCheck(options.EncryptionKey, info.FileID)
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(chunkTimeout))
+	if err := writeChunkMetadata(conn, metadata); err != nil {
+		return fmt.Errorf("failed to send file metadata: %v", err)
+	}
+
+	// The receiver may be waiting for disk space before it answers
+	var reply chunkMetadataReply
+	if err := readMessage(conn, &reply); err != nil {
+		return fmt.Errorf("failed to read the receiver's answer: %v", err)
+	}
+	if !reply.Accepted {
+		return fmt.Errorf("receiver declined %s: %s", info.FileName, reply.Error)
+	}
+	if info.aead != nil && !reply.Encrypted {
+		return fmt.Errorf("%w: the receiver does not support encrypted chunks", ErrEncryptionKey)
+	}
+
+	info.Mutex.Lock()
+	defer info.Mutex.Unlock()
+	for _, index := range reply.Have {
+		if index >= 0 && index < len(info.Chunks) && !info.Chunks[index].Completed {
+			info.Chunks[index].Completed = true
+			info.Completed++
+		}
+	}
+	return nil
+}
+
+// receiveFileMetadata waits for a sender to describe its file. Invalid
+// metadata is rejected here; otherwise the caller answers on the returned
+// connection with a chunkMetadataReply once it is ready for the chunks.
+func receiveFileMetadata(listener net.Listener, options TransferOptions) (*FileTransferInfo, net.Conn, error) {
+	ctx := contextOrBackground(options.Context)
+	for {
+		conn, err := acceptContext(ctx, listener)
+		if err != nil {
+			return nil, nil, err
+		}
+		if refused(conn, options.Access) {
+			continue
+		}
+
+		conn.SetReadDeadline(time.Now().Add(chunkTimeout))
+		m, err := readChunkMetadata(conn)
+		conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			// Not a sender speaking the chunked protocol, wait for the next one
+			fmt.Printf("Ignored connection from %s: %v\n", conn.RemoteAddr(), err)
+			conn.Close()
+			continue
+		}
+		if err := m.validate(options.MaxFileSize); err != nil {
+			writeMessage(conn, chunkMetadataReply{Error: err.Error()})
+			conn.Close()
+			return nil, nil, fmt.Errorf("rejected file metadata from %s: %v", conn.RemoteAddr(), err)
+		}
+		if err := m.checkEncryption(options.EncryptionKey); err != nil {
+			writeMessage(conn, chunkMetadataReply{Error: err.Error()})
+			conn.Close()
+			return nil, nil, fmt.Errorf("rejected %s from %s: %w", m.FileName, conn.RemoteAddr(), err)
+		}
+
+		info := m.transferInfo()
+		if info.aead, err = encryptionFor(options.EncryptionKey); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		return info, conn, nil
+	}
+}
+
+// acceptContext accepts a connection, giving up when ctx is cancelled
+func acceptContext(ctx context.Context, listener net.Listener) (net.Conn, error) {
+	stop := closeOnCancel(ctx, listener)
+	conn, err := listener.Accept()
+	stop()
+	if ctx.Err() != nil {
+		if conn != nil {
+			conn.Close()
+		}
+		return nil, errCancelled
+	}
+	return conn, err
+}
@@ -0,0 +1,184 @@
+package transfer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testMetadata describes a file of size bytes in chunks of chunkSize
+func testMetadata(size, chunkSize int64) chunkMetadata {
+	total := int((size + chunkSize - 1) / chunkSize)
+	checksums := make([]string, total)
+	for i := range checksums {
+		sum := sha256.Sum256([]byte(fmt.Sprint(i)))
+		checksums[i] = hex.EncodeToString(sum[:])
+	}
+	return chunkMetadata{
+		FileID:      "0123456789abcdef",
+		FileName:    "data.bin",
+		FileSize:    size,
+		ChunkSize:   chunkSize,
+		TotalChunks: total,
+		Checksums:   checksums,
+	}
+}
+
+// exchange writes frames with write on one end of a pipe and reads them back with readChunkMetadata
+func exchange(write func(conn net.Conn) error) (chunkMetadata, error) {
+	sender, receiver := net.Pipe()
+	defer receiver.Close()
+	go func() {
+		defer sender.Close()
+		write(sender)
+	}()
+	return readChunkMetadata(receiver)
+}
+
+func TestChunkMetadataRoundTrip(t *testing.T) {
+	encrypted := testMetadata(10*minChunkSize, minChunkSize)
+	encrypted.KeyCheck = keyCheck(testKey(1), encrypted.FileID)
+	swarm := testMetadata(10*minChunkSize, minChunkSize)
+	swarm.Swarm = true
+
+	tests := []struct {
+		name     string
+		metadata chunkMetadata
+	}{
+		{"one chunk", testMetadata(100, minChunkSize)},
+		{"exact chunks", testMetadata(4*minChunkSize, minChunkSize)},
+		{"short last chunk", testMetadata(4*minChunkSize+1, minChunkSize)},
+		{"one full checksum frame", testMetadata(checksumsPerFrame*minChunkSize, minChunkSize)},
+		{"one checksum over a frame", testMetadata((checksumsPerFrame+1)*minChunkSize, minChunkSize)},
+		{"several checksum frames", testMetadata(3*checksumsPerFrame*minChunkSize-7, minChunkSize)},
+		{"encrypted", encrypted},
+		{"swarm", swarm},
+		{"unicode name", func() chunkMetadata {
+			m := testMetadata(100, minChunkSize)
+			m.FileName = "résumé 履歴書.pdf"
+			return m
+		}()},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.metadata.validate(0); err != nil {
+				t.Fatalf("sample metadata is invalid: %v", err)
+			}
+			got, err := exchange(func(conn net.Conn) error { return writeChunkMetadata(conn, test.metadata) })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.metadata) {
+				t.Fatalf("got %+v, want %+v", got, test.metadata)
+			}
+			if err := got.validate(0); err != nil {
+				t.Errorf("received metadata is invalid: %v", err)
+			}
+
+			// The receiver's chunk layout covers the file exactly
+			info := got.transferInfo()
+			var covered int64
+			for i, chunk := range info.Chunks {
+				if chunk.Index != i || chunk.Offset != covered || chunk.Size <= 0 || chunk.Checksum != test.metadata.Checksums[i] {
+					t.Fatalf("chunk %d is laid out as %+v", i, chunk)
+				}
+				covered += chunk.Size
+			}
+			if covered != test.metadata.FileSize || info.swarm != test.metadata.Swarm {
+				t.Errorf("chunks cover %d of %d bytes, swarm %t", covered, test.metadata.FileSize, info.swarm)
+			}
+
+			// And describes the same file again
+			again := newChunkMetadata(info)
+			again.KeyCheck = test.metadata.KeyCheck
+			if !reflect.DeepEqual(again, test.metadata) {
+				t.Errorf("described again as %+v", again)
+			}
+		})
+	}
+}
+
+func TestReadChunkMetadataMalformed(t *testing.T) {
+	m := testMetadata(3*minChunkSize, minChunkSize)
+	tests := []struct {
+		name  string
+		write func(conn net.Conn) error
+		want  string
+	}{
+		{"no chunks", func(conn net.Conn) error {
+			bad := m
+			bad.TotalChunks = 0
+			return writeMessage(conn, bad)
+		}, "invalid chunk count"},
+		{"too many chunks", func(conn net.Conn) error {
+			bad := m
+			bad.TotalChunks = maxChunkCount + 1
+			return writeMessage(conn, bad)
+		}, "invalid chunk count"},
+		{"empty checksum frame", func(conn net.Conn) error {
+			writeMessage(conn, m)
+			return writeMessage(conn, chunkChecksums{})
+		}, "don't match"},
+		{"more checksums than chunks", func(conn net.Conn) error {
+			writeMessage(conn, m)
+			return writeMessage(conn, chunkChecksums{Checksums: append(m.Checksums, m.Checksums[0])})
+		}, "don't match"},
+		{"checksums cut short", func(conn net.Conn) error {
+			writeMessage(conn, m)
+			return writeMessage(conn, chunkChecksums{Checksums: m.Checksums[:1]})
+		}, "EOF"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := exchange(test.write)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Fatalf("got %v, want an error containing %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestChunkMetadataValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(m *chunkMetadata)
+		max    int64
+		want   string
+	}{
+		{"valid", func(m *chunkMetadata) {}, 0, ""},
+		{"no file ID", func(m *chunkMetadata) { m.FileID = "" }, 0, "file ID"},
+		{"long file ID", func(m *chunkMetadata) { m.FileID = strings.Repeat("a", maxFileIDLength+1) }, 0, "file ID"},
+		{"path in name", func(m *chunkMetadata) { m.FileName = "../data.bin" }, 0, "contains a path"},
+		{"control character in name", func(m *chunkMetadata) { m.FileName = "data\n.bin" }, 0, "control character"},
+		{"empty file", func(m *chunkMetadata) { m.FileSize = 0 }, 0, "file size"},
+		{"over the size limit", func(m *chunkMetadata) {}, minChunkSize, ""},
+		{"tiny chunks", func(m *chunkMetadata) { m.ChunkSize = minChunkSize - 1 }, 0, "chunk size"},
+		{"huge chunks", func(m *chunkMetadata) { m.ChunkSize = maxChunkSize + 1 }, 0, "chunk size"},
+		{"chunk count off by one", func(m *chunkMetadata) { m.TotalChunks++ }, 0, "don't make a file"},
+		{"missing checksum", func(m *chunkMetadata) { m.Checksums = m.Checksums[1:] }, 0, "checksums for"},
+		{"bad checksum", func(m *chunkMetadata) { m.Checksums[1] = "not hex" }, 0, "chunk 1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := testMetadata(3*minChunkSize, minChunkSize)
+			test.change(&m)
+			err := m.validate(test.max)
+			switch {
+			case test.max > 0:
+				if err == nil {
+					t.Fatalf("accepted %d bytes with a limit of %d", m.FileSize, test.max)
+				}
+			case test.want == "":
+				if err != nil {
+					t.Fatal(err)
+				}
+			case err == nil || !strings.Contains(err.Error(), test.want):
+				t.Fatalf("got %v, want an error containing %q", err, test.want)
+			}
+		})
+	}
+}
@@ -1,14 +1,20 @@
 package transfer
 
 import (
+	"context"
+	"crypto/cipher"
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/hex"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"path/filepath"
 	"sync"
 	"time"
+
+	"fileshare/internal/access"
 )
 
 // ChunkInfo represents information about a file chunk
@@ -35,6 +41,65 @@ type FileTransferInfo struct {
 	Status       string
 	Error        error
 	Mutex        sync.Mutex
+
+	events *transferEvents // See events.go
+	aead   cipher.AEAD     // Encrypts the chunks when set, see chunk_crypto.go
+	swarm  bool            // Sent to several receivers at once, see swarm.go
+}
+
+// Chunk connections
+//
+// Chunked transfers send their chunks over several connections at once, one
+// per worker. On each connection a chunkHeader is followed by the chunk's
+// bytes and the receiver answers with a chunkAck once the chunk is verified
+// and written, so a worker has one chunk in flight at a time. Chunks that
+// fail are sent again, on a new connection, up to RetryCount times.
+//
+// Once every chunk has been acknowledged the sender sends a header with index
+// chunkIndexDone and the receiver answers with a chunkRequest listing the
+// chunks it still lacks. The sender sends those again, and the exchange
+// repeats until nothing is missing or RetryCount rounds have passed.
+//
+// Receivers of a swarm also take the headers described in swarm.go.
+
+const (
+	// chunkTimeout bounds how long a single chunk may take to go out and be acknowledged
+	chunkTimeout = 60 * time.Second
+
+	// chunkIndexDone in a chunk header asks the receiver which chunks it is missing
+	chunkIndexDone = -1
+
+	// chunkIndexAdvert in a chunk header asks a receiver in a swarm for its
+	// SwarmAdvert
+	chunkIndexAdvert = -2
+)
+
+// chunkHeader precedes the data of a chunk on a chunk connection
+type chunkHeader struct {
+	FileID   string `json:"file_id"`
+	Index    int    `json:"index"`
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum"` // Hex encoded SHA-256 of the chunk
+
+	// From, in a swarm, tells the receiver to fetch the chunk from the
+	// receiver at that address instead of data following
+	From string `json:"from,omitempty"`
+
+	// Fetch asks a receiver in a swarm for a chunk it holds, which it
+	// answers with a chunkAck followed by the chunk's data when OK
+	Fetch bool `json:"fetch,omitempty"`
+}
+
+// chunkAck is the receiver's answer to a chunk
+type chunkAck struct {
+	Index int    `json:"index"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"` // Why the chunk was not accepted
+}
+
+// chunkRequest answers chunkIndexDone with the chunks the receiver still needs
+type chunkRequest struct {
+	Missing []int `json:"missing"`
 }
 
 // TransferOptions configures the behavior of file transfers
@@ -43,20 +108,111 @@ type TransferOptions struct {
 	Parallelism      int           // Number of parallel transfers (default: 5)
 	RetryCount       int           // Number of retries per chunk (default: 3)
 	RetryDelay       time.Duration // Delay between retries (default: 1s)
-	CompressData     bool          // Whether to compress data (default: true)
+	CompressData     bool          // Whether to offer or accept compression (default: true)
 	VerifyChecksums  bool          // Whether to verify checksums (default: true)
 	ProgressCallback func(*FileTransferInfo)
+	MaxFileSize      int64       // Largest file accepted, 0 for unlimited (default: DefaultMaxFileSize)
+	CollisionPolicy  string      // What to do when a received file already exists (default: CollisionRename)
+	Routes           []RouteRule // Send received files to other directories by type (see LoadRoutes)
+	PreserveMetadata bool        // Whether received files keep the sender's mtime and permissions (default: true)
+	Resume           bool        // Whether receivers pick up interrupted transfers where they stopped (default: true)
+	BufferSize       int         // Size of the buffer file data is copied through (default: DefaultBufferSize)
+
+	// MaxConcurrentReceives bounds how many senders ReceiveLoop serves at once (default: 4)
+	MaxConcurrentReceives int
+
+	// MaxConnections and MaxConnectionsPerIP bound how many connections a
+	// receiver keeps open at once, in total and from one address; 0 means no
+	// limit (default: DefaultMaxConnections, DefaultMaxConnectionsPerIP)
+	MaxConnections      int
+	MaxConnectionsPerIP int
+
+	// Context cancels a transfer or receiver when done; nil means never
+	Context context.Context
+
+	// PIN, when set, must match on sender and receiver (see auth.go)
+	PIN string
+
+	// EncryptionKey, when set, encrypts the chunks of chunked transfers with
+	// AES-256-GCM. It is EncryptionKeySize bytes long and sender and receiver
+	// must hold the same one (see chunk_crypto.go).
+	EncryptionKey []byte
+
+	// Access limits which addresses a receiver takes connections from
+	// (see access.Load)
+	Access access.Rules
+
+	// SkipQuery sends without first asking the receiver whether it takes
+	// the files (see query.go)
+	SkipQuery bool
+
+	// Dial, when set, opens the sender's connections to the receiver at
+	// address in place of TCP, e.g. through other mesh nodes
+	Dial func(ctx context.Context, address string) (net.Conn, error)
+
+	// ResendIdentical sends files even when the receiver already has an
+	// identical copy (see query.go)
+	ResendIdentical bool
+
+	// AllowDowngrade lets a send go ahead with less security than the
+	// receiver had before (see security.go)
+	AllowDowngrade bool
+
+	// TLS encrypts transfers. Receivers use the certificate from
+	// LocalCertificate, senders show the receiver's certificate fingerprint.
+	TLS bool
+
+	tlsConfig *tls.Config // Receiver side TLS configuration, set up by receive
+	output    io.Writer   // Where ReceiveToWriter puts the file instead of the disk
+
+	// StateFunc is told when a sender or receiver changes state, such as
+	// connecting or finishing a file
+	StateFunc func(TransferState)
+
+	// AcceptFunc lets the receiver accept or reject each incoming file.
+	// Returning a non-empty saveAs stores the file under that name instead.
+	// When nil every file is accepted.
+	AcceptFunc func(file IncomingFile) (accept bool, saveAs string)
+
+	// PeerName is how the user named the receiver, recorded in the history
+	// when it isn't just an address
+	PeerName string
+
+	// ForwardedFrom marks a send as passing on a file received from that
+	// peer, so the history records it as forwarded
+	ForwardedFrom string
+
+	// ListeningFunc is given the receiver's connection card once it is
+	// listening and has checked which of its addresses answer
+	ListeningFunc func(ConnectionCard)
+
+	// ProgressFunc is called during SendFile/SendFiles and on the receiving
+	// side at most every 200ms. Senders report bytes across the whole batch,
+	// receivers report bytes of the file currently being received.
+	ProgressFunc func(bytesDone, total int64)
+
+	// ProgressStatsFunc is called alongside ProgressFunc with the current and
+	// average speed and the estimated time remaining
+	ProgressStatsFunc func(TransferStats)
 }
 
 // DefaultTransferOptions returns the default transfer configuration
 func DefaultTransferOptions() TransferOptions {
 	return TransferOptions{
-		ChunkSize:       1 * 1024 * 1024, // 1MB
-		Parallelism:     5,
-		RetryCount:      3,
-		RetryDelay:      time.Second,
-		CompressData:    true,
-		VerifyChecksums: true,
+		ChunkSize:             1 * 1024 * 1024, // 1MB
+		Parallelism:           5,
+		RetryCount:            3,
+		RetryDelay:            time.Second,
+		CompressData:          true,
+		PreserveMetadata:      true,
+		Resume:                true,
+		VerifyChecksums:       true,
+		MaxFileSize:           DefaultMaxFileSize,
+		CollisionPolicy:       CollisionRename,
+		MaxConcurrentReceives: 4,
+		MaxConnections:        DefaultMaxConnections,
+		MaxConnectionsPerIP:   DefaultMaxConnectionsPerIP,
+		BufferSize:            DefaultBufferSize,
 		ProgressCallback: func(info *FileTransferInfo) {
 			// Default progress reporting
 			progress := float64(info.Completed) / float64(info.TotalChunks) * 100
@@ -66,19 +222,55 @@ func DefaultTransferOptions() TransferOptions {
 	}
 }
 
-// SendFileChunked sends a file using the chunked transfer protocol
+// SendFileChunked sends a file using the chunked transfer protocol. peerID is
+// the receiver's address, host:port.
 func SendFileChunked(filePath, peerID string, options TransferOptions) error {
+	file, transferInfo, err := prepareChunkedFile(filePath, options)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Send file metadata to peer
+	err = sendFileMetadata(transferInfo, peerID, options)
+	if err != nil {
+		return fmt.Errorf("failed to send file metadata: %w", err)
+	}
+
+	// Start the transfer
+	transferInfo.Status = "transferring"
+	transferInfo.events = startTransfer(DirectionSent, peerID, transferInfo.FileName, transferInfo.FileSize)
+	err = sendFileChunks(file, transferInfo, peerID, options)
+	transferInfo.endEvents(err, options)
+	if err != nil {
+		transferInfo.Status = "failed"
+		transferInfo.Error = err
+		return fmt.Errorf("failed to send file chunks: %w", err)
+	}
+
+	transferInfo.Status = "completed"
+	return nil
+}
+
+// prepareChunkedFile opens a file to send in chunks and lays out its chunks,
+// with their checksums
+func prepareChunkedFile(filePath string, options TransferOptions) (*os.File, *FileTransferInfo, error) {
+	aead, err := encryptionFor(options.EncryptionKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	// Open file
 	file, err := os.Open(filePath)
 	if err != nil {
-		return fmt.Errorf("failed to open file: %w", err)
+		return nil, nil, fmt.Errorf("failed to open file: %w", err)
 	}
-	defer file.Close()
 
 	// Get file info
 	fileInfo, err := file.Stat()
 	if err != nil {
-		return fmt.Errorf("failed to get file info: %w", err)
+		file.Close()
+		return nil, nil, fmt.Errorf("failed to get file info: %w", err)
 	}
 
 	// Generate file ID
@@ -100,6 +292,7 @@ func SendFileChunked(filePath, peerID string, options TransferOptions) error {
 		Chunks:      make([]ChunkInfo, totalChunks),
 		StartTime:   time.Now(),
 		Status:      "preparing",
+		aead:        aead,
 	}
 
 	// Prepare chunk info
@@ -113,7 +306,8 @@ func SendFileChunked(filePath, peerID string, options TransferOptions) error {
 		// Calculate checksum for this chunk
 		checksum, err := calculateChunkChecksum(file, offset, size)
 		if err != nil {
-			return fmt.Errorf("failed to calculate checksum: %w", err)
+			file.Close()
+			return nil, nil, fmt.Errorf("failed to calculate checksum: %w", err)
 		}
 
 		transferInfo.Chunks[i] = ChunkInfo{
@@ -124,61 +318,147 @@ func SendFileChunked(filePath, peerID string, options TransferOptions) error {
 			Completed: false,
 		}
 	}
+	return file, transferInfo, nil
+}
 
-	// Send file metadata to peer
-	err = sendFileMetadata(transferInfo, peerID)
-	if err != nil {
-		return fmt.Errorf("failed to send file metadata: %w", err)
+// ReceiveFileChunked receives a file using the chunked transfer protocol,
+// accepting the sender's connections on address (host:port, host may be empty)
+func ReceiveFileChunked(address, destDir string, options TransferOptions) (err error) {
+	if _, err := encryptionFor(options.EncryptionKey); err != nil {
+		return err
 	}
 
-	// Start the transfer
-	transferInfo.Status = "transferring"
-	err = sendFileChunks(file, transferInfo, peerID, options)
+	listener, err := net.Listen("tcp", address)
 	if err != nil {
-		transferInfo.Status = "failed"
-		transferInfo.Error = err
-		return fmt.Errorf("failed to send file chunks: %w", err)
+		return fmt.Errorf("failed to listen on %s: %w", address, err)
 	}
+	defer listener.Close()
 
-	transferInfo.Status = "completed"
-	return nil
-}
-
-// ReceiveFileChunked receives a file using the chunked transfer protocol
-func ReceiveFileChunked(peerID, destDir string, options TransferOptions) error {
 	// Receive file metadata
-	transferInfo, err := receiveFileMetadata(peerID)
+	transferInfo, control, err := receiveFileMetadata(listener, options)
 	if err != nil {
 		return fmt.Errorf("failed to receive file metadata: %w", err)
 	}
+	defer control.Close()
 
-	// Create destination file
-	destPath := filepath.Join(destDir, transferInfo.FileName)
-	file, err := os.Create(destPath)
+	// Tell the sender why the file can't be taken
+	decline := func(err error) error {
+		writeMessage(control, chunkMetadataReply{Error: err.Error()})
+		return err
+	}
+
+	// Leave any file with the same name alone, as the collision policy says
+	destPath, declined, err := resolveCollision(filepath.Join(destDir, transferInfo.FileName), options.CollisionPolicy)
 	if err != nil {
-		return fmt.Errorf("failed to create file: %w", err)
+		return decline(err)
+	}
+	if declined != "" {
+		return decline(fmt.Errorf("declined %s: %s", transferInfo.FileName, declined))
+	}
+	defer releasePath(destPath)
+
+	// The chunks go into a partial file that only takes the final name once
+	// complete. Pick up an interrupted transfer of the same file, or start over.
+	partPath := partialPath(destPath, options.Resume)
+	removeStaleManifests(destDir)
+	var have []int
+	var file *os.File
+	if manifest, err := loadManifest(manifestPath(partPath)); err == nil && options.Resume && manifest.matches(transferInfo) {
+		if file, err = os.OpenFile(partPath, os.O_RDWR, 0644); err == nil {
+			have = resumeFromManifest(file, transferInfo, manifest)
+			fmt.Printf("Resuming %s, %d of %d chunks already received\n", transferInfo.FileName, len(have), transferInfo.TotalChunks)
+		}
+	}
+	if file == nil {
+		os.Remove(manifestPath(partPath))
+		if file, err = os.Create(partPath); err != nil {
+			return decline(fmt.Errorf("failed to create file: %w", err))
+		}
 	}
 	defer file.Close()
+	if !options.Resume {
+		// Partial data that won't be resumed is of no use
+		defer func() {
+			if err != nil {
+				file.Close()
+				os.Remove(partPath)
+			}
+		}()
+	}
+
+	// Make sure the file fits before reserving space for it, and wait for
+	// space rather than failing if the disk fills up in the meantime. A
+	// resumed file has its size already.
+	for len(have) == 0 {
+		if err := waitForDiskSpace(options.Context, destDir, transferInfo.FileSize, transferInfo); err != nil {
+			return decline(err)
+		}
 
-	// Pre-allocate file size if possible
-	err = file.Truncate(transferInfo.FileSize)
+		err = preallocate(file, transferInfo.FileSize)
+		if !isDiskFull(err) {
+			break
+		}
+		file.Truncate(0)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to pre-allocate file: %w", err)
+		// FAT32, exFAT and some network filesystems can't extend a file
+		// without writing it. Chunks written past the end grow it instead,
+		// and the chunk table tracks which parts have been written.
+		fmt.Printf("⚠️  Could not reserve space for %s (%v), the file will grow as chunks arrive\n", transferInfo.FileName, err)
 	}
 
+	reply := chunkMetadataReply{Accepted: true, Have: have, Encrypted: transferInfo.aead != nil}
+	if err := writeMessage(control, reply); err != nil {
+		return fmt.Errorf("failed to accept file metadata: %w", err)
+	}
+	peer := control.RemoteAddr().String()
+	control.Close()
+
 	// Start receiving chunks
 	transferInfo.Status = "receiving"
-	err = receiveFileChunks(file, transferInfo, peerID, options)
+	transferInfo.StartTime = time.Now()
+	transferInfo.events = startTransfer(DirectionReceived, peer, transferInfo.FileName, transferInfo.FileSize)
+	defer func() { transferInfo.endEvents(err, options) }()
+	err = receiveFileChunks(file, transferInfo, listener, options)
 	if err != nil {
 		transferInfo.Status = "failed"
 		transferInfo.Error = err
+		if options.Resume {
+			saveManifest(manifestPath(partPath), newChunkManifest(transferInfo))
+		}
 		return fmt.Errorf("failed to receive file chunks: %w", err)
 	}
 
+	// Every chunk is verified, give the file its final name once its data is on disk
+	if err = file.Sync(); err != nil {
+		return fmt.Errorf("failed to write received file to disk: %w", err)
+	}
+	file.Close()
+	if err = os.Rename(partPath, destPath); err != nil {
+		return fmt.Errorf("failed to move received file into place: %w", err)
+	}
+	os.Remove(manifestPath(partPath))
+
 	transferInfo.Status = "completed"
 	return nil
 }
 
+// writeChunk writes a received chunk at its offset. If the disk fills up the
+// transfer pauses until enough space is free for the rest of the file, so
+// that it resumes where it stopped instead of failing.
+func writeChunk(file *os.File, info *FileTransferInfo, options TransferOptions, data []byte, offset int64) error {
+	for {
+		_, err := file.WriteAt(data, offset)
+		if !isDiskFull(err) {
+			return err
+		}
+
+		if err := waitForDiskSpace(options.Context, filepath.Dir(file.Name()), info.FileSize-offset, info); err != nil {
+			return err
+		}
+	}
+}
+
 // Helper functions
 func generateFileID(filePath string) string {
 	// Generate a unique ID for this file
@@ -189,7 +469,8 @@ func generateFileID(filePath string) string {
 func calculateChunkChecksum(file *os.File, offset, size int64) (string, error) {
 	// Calculate SHA-256 checksum of the chunk
 	hasher := sha256.New()
-	buffer := make([]byte, 64*1024) // Use a smaller buffer for reading
+	buffer, release := getBuffer(DefaultBufferSize)
+	defer release()
 
 	// Move to the correct offset
 	_, err := file.Seek(offset, io.SeekStart)
@@ -224,26 +505,469 @@ func calculateChunkChecksum(file *os.File, offset, size int64) (string, error) {
 	return hex.EncodeToString(hasher.Sum(nil)), nil
 }
 
-func sendFileMetadata(info *FileTransferInfo, peerID string) error {
-	// Send file metadata to the peer
-	// This is a placeholder for the actual implementation
-	return nil
+// sendFileChunks sends every chunk, then sends again whatever the receiver
+// reports missing, for up to RetryCount more rounds
+func sendFileChunks(file *os.File, info *FileTransferInfo, peerID string, options TransferOptions) error {
+	for round := 0; ; round++ {
+		if err := sendChunkRound(file, info, peerID, options); err != nil {
+			return err
+		}
+
+		missing, err := requestMissingChunks(info, peerID, options)
+		if err != nil {
+			return err
+		}
+		if len(missing) == 0 {
+			return nil
+		}
+		if round >= options.RetryCount {
+			return fmt.Errorf("receiver is still missing %d chunks after %d rounds", len(missing), round+1)
+		}
+
+		info.Mutex.Lock()
+		for _, index := range missing {
+			if index >= 0 && index < len(info.Chunks) && info.Chunks[index].Completed {
+				info.Chunks[index].Completed = false
+				info.Completed--
+			}
+		}
+		info.Mutex.Unlock()
+	}
 }
 
-func receiveFileMetadata(peerID string) (*FileTransferInfo, error) {
-	// Receive file metadata from the peer
-	// This is a placeholder for the actual implementation
-	return &FileTransferInfo{}, nil
+// requestMissingChunks asks the receiver which chunks it hasn't verified
+func requestMissingChunks(info *FileTransferInfo, peerID string, options TransferOptions) ([]int, error) {
+	conn, err := options.dial(options.Context, peerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %v", peerID, err)
+	}
+	defer conn.Close()
+	defer closeOnCancel(options.Context, conn)()
+	conn.SetDeadline(time.Now().Add(chunkTimeout))
+
+	if err := writeMessage(conn, chunkHeader{FileID: info.FileID, Index: chunkIndexDone}); err != nil {
+		return nil, fmt.Errorf("failed to ask for missing chunks: %v", err)
+	}
+	var request chunkRequest
+	if err := readMessage(conn, &request); err != nil {
+		return nil, fmt.Errorf("failed to read missing chunks: %v", err)
+	}
+	return request.Missing, nil
 }
 
-func sendFileChunks(file *os.File, info *FileTransferInfo, peerID string, options TransferOptions) error {
-	// Send file chunks to the peer
-	// This is a placeholder for the actual implementation
+// sendChunkRound sends every chunk not yet completed, Parallelism at a time,
+// stopping at the first chunk that can't be sent within its retries
+func sendChunkRound(file *os.File, info *FileTransferInfo, peerID string, options TransferOptions) error {
+	info.Mutex.Lock()
+	indices := make(chan int, len(info.Chunks))
+	for i, chunk := range info.Chunks {
+		if !chunk.Completed {
+			indices <- i
+		}
+	}
+	info.Mutex.Unlock()
+	close(indices)
+
+	workers := options.Parallelism
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(indices) {
+		workers = len(indices)
+	}
+
+	// The first failure stops the other workers
+	ctx, cancel := context.WithCancel(contextOrBackground(options.Context))
+	defer cancel()
+
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := sendChunkWorker(ctx, file, info, peerID, indices, options); err != nil {
+				errs <- err
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	if cancelled(options.Context) {
+		return errCancelled
+	}
+	return <-errs
+}
+
+// sendChunkWorker sends the chunks it pulls from indices over its own
+// connection, retrying each one up to RetryCount times
+func sendChunkWorker(ctx context.Context, file *os.File, info *FileTransferInfo, peerID string, indices <-chan int, options TransferOptions) error {
+	var conn net.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	for index := range indices {
+		var err error
+		for attempt := 0; attempt <= options.RetryCount; attempt++ {
+			if attempt > 0 {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(options.RetryDelay):
+				}
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			if conn == nil {
+				if conn, err = options.dial(ctx, peerID); err != nil {
+					conn = nil
+					err = fmt.Errorf("failed to connect to %s: %v", peerID, err)
+					continue
+				}
+			}
+			if err = sendChunk(ctx, conn, file, info, index); err == nil {
+				break
+			}
+			// Start over on a fresh connection, this one may be out of sync
+			conn.Close()
+			conn = nil
+		}
+		if err != nil {
+			return fmt.Errorf("chunk %d failed after %d attempts: %w", index, options.RetryCount+1, err)
+		}
+		info.completeChunk(index, options)
+	}
 	return nil
 }
 
-func receiveFileChunks(file *os.File, info *FileTransferInfo, peerID string, options TransferOptions) error {
-	// Receive file chunks from the peer
-	// This is a placeholder for the actual implementation
+// sendChunk sends one chunk on conn and waits for the receiver to accept it
+func sendChunk(ctx context.Context, conn net.Conn, file *os.File, info *FileTransferInfo, index int) error {
+	info.Mutex.Lock()
+	chunk := info.Chunks[index]
+	info.Mutex.Unlock()
+
+	data := make([]byte, chunk.Size)
+	if _, err := file.ReadAt(data, chunk.Offset); err != nil {
+		return fmt.Errorf("failed to read chunk: %v", err)
+	}
+	if info.aead != nil {
+		data = sealChunk(info.aead, info.FileID, index, data)
+	}
+
+	defer closeOnCancel(ctx, conn)()
+	conn.SetDeadline(time.Now().Add(chunkTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	header := chunkHeader{FileID: info.FileID, Index: index, Size: chunk.Size, Checksum: chunk.Checksum}
+	if err := writeMessage(conn, header); err != nil {
+		return fmt.Errorf("failed to send chunk header: %v", err)
+	}
+	if _, err := conn.Write(data); err != nil {
+		return fmt.Errorf("failed to send chunk data: %v", err)
+	}
+
+	var ack chunkAck
+	if err := readMessage(conn, &ack); err != nil {
+		return fmt.Errorf("failed to read chunk acknowledgement: %v", err)
+	}
+	if ack.Index != index {
+		return fmt.Errorf("receiver acknowledged chunk %d instead of %d", ack.Index, index)
+	}
+	if !ack.OK {
+		return fmt.Errorf("receiver rejected the chunk: %s", ack.Error)
+	}
+	return nil
+}
+
+// completeChunk marks a chunk done, updates the transfer rate and reports
+// progress. ProgressCallback runs with info.Mutex held, so it sees a
+// consistent state while other chunks complete.
+func (info *FileTransferInfo) completeChunk(index int, options TransferOptions) {
+	info.Mutex.Lock()
+	defer info.Mutex.Unlock()
+
+	if info.Chunks[index].Completed {
+		return
+	}
+	info.Chunks[index].Completed = true
+	info.Completed++
+
+	var done int64
+	for _, chunk := range info.Chunks {
+		if chunk.Completed {
+			done += chunk.Size
+		}
+	}
+	if elapsed := time.Since(info.StartTime).Seconds(); elapsed > 0 {
+		info.TransferRate = int64(float64(done) / elapsed)
+	}
+
+	if options.ProgressCallback != nil {
+		options.ProgressCallback(info)
+	}
+	if info.events != nil {
+		info.events.chunk(index, done, info.TransferRate)
+	}
+}
+
+// endEvents publishes how the transfer of info ended
+func (info *FileTransferInfo) endEvents(err error, options TransferOptions) {
+	info.Mutex.Lock()
+	defer info.Mutex.Unlock()
+
+	var done int64
+	for _, chunk := range info.Chunks {
+		if chunk.Completed {
+			done += chunk.Size
+		}
+	}
+	info.events.end(err, options.Context, TransferStats{
+		BytesDone:   done,
+		Total:       info.FileSize,
+		AverageRate: info.TransferRate,
+		Elapsed:     time.Since(info.StartTime),
+	})
+}
+
+// chunkReceiver collects the chunks of one file from any number of connections
+type chunkReceiver struct {
+	file     *os.File
+	info     *FileTransferInfo
+	options  TransferOptions
+	mutex    sync.Mutex
+	failures map[int]int // Failed attempts per chunk
+	rounds   int         // Times the sender asked for missing chunks and some were
+	saved    time.Time   // When the manifest was last written
+	done     chan struct{}
+	fatal    chan error
+	once     sync.Once
+}
+
+// receiveFileChunks accepts chunk connections until every chunk of the file
+// has been verified and written, in whatever order the chunks arrive
+func receiveFileChunks(file *os.File, info *FileTransferInfo, listener net.Listener, options TransferOptions) error {
+	r := &chunkReceiver{
+		file:     file,
+		info:     info,
+		options:  options,
+		failures: make(map[int]int),
+		done:     make(chan struct{}),
+		fatal:    make(chan error, 1),
+	}
+
+	// Connections still open when the transfer ends are closed with it
+	var connsMutex sync.Mutex
+	conns := make(map[net.Conn]bool)
+	defer func() {
+		connsMutex.Lock()
+		defer connsMutex.Unlock()
+		for conn := range conns {
+			conn.Close()
+		}
+		conns = nil
+	}()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				r.fail(fmt.Errorf("failed to accept chunk connection: %v", err))
+				return
+			}
+			if refused(conn, options.Access) {
+				continue
+			}
+			connsMutex.Lock()
+			if conns == nil {
+				connsMutex.Unlock()
+				conn.Close()
+				return
+			}
+			conns[conn] = true
+			connsMutex.Unlock()
+
+			go func() {
+				r.serve(conn)
+				connsMutex.Lock()
+				delete(conns, conn)
+				connsMutex.Unlock()
+				conn.Close()
+			}()
+		}
+	}()
+
+	var ctxDone <-chan struct{}
+	if options.Context != nil {
+		ctxDone = options.Context.Done()
+	}
+	select {
+	case <-r.done:
+		return nil
+	case err := <-r.fatal:
+		return err
+	case <-ctxDone:
+		return errCancelled
+	}
+}
+
+// serve reads chunks from one connection until the sender closes it
+func (r *chunkReceiver) serve(conn net.Conn) {
+	for {
+		conn.SetDeadline(time.Now().Add(chunkTimeout))
+
+		var header chunkHeader
+		if err := readMessage(conn, &header); err != nil {
+			return
+		}
+		if header.FileID != r.info.FileID {
+			writeMessage(conn, chunkAck{Index: header.Index, Error: "unknown file ID"})
+			return
+		}
+
+		if header.Index == chunkIndexAdvert && r.info.swarm {
+			if err := writeMessage(conn, r.advert(conn)); err != nil {
+				return
+			}
+			continue
+		}
+
+		if header.Index == chunkIndexDone {
+			missing := r.missing()
+			if err := writeMessage(conn, chunkRequest{Missing: missing}); err != nil {
+				return
+			}
+			if len(missing) == 0 {
+				r.once.Do(func() { close(r.done) })
+			}
+			continue
+		}
+
+		// A header that doesn't match the metadata leaves the data length
+		// unknown, so the connection can't be used any further
+		if header.Index < 0 || header.Index >= len(r.info.Chunks) || header.Size != r.info.Chunks[header.Index].Size {
+			writeMessage(conn, chunkAck{Index: header.Index, Error: "chunk does not match the file metadata"})
+			return
+		}
+
+		if r.info.swarm && (header.Fetch || header.From != "") {
+			if !r.serveSwarm(conn, header) {
+				return
+			}
+			continue
+		}
+
+		size := header.Size
+		if r.info.aead != nil {
+			size += int64(r.info.aead.Overhead())
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(conn, data); err != nil {
+			return
+		}
+
+		ack := chunkAck{Index: header.Index, OK: true}
+		if err := r.accept(header, data); err != nil {
+			ack.OK, ack.Error = false, err.Error()
+		}
+		if err := writeMessage(conn, ack); err != nil {
+			return
+		}
+	}
+}
+
+// accept verifies a chunk against the metadata and writes it in place. A
+// chunk that fails more than RetryCount times fails the whole transfer.
+func (r *chunkReceiver) accept(header chunkHeader, data []byte) error {
+	r.info.Mutex.Lock()
+	chunk := r.info.Chunks[header.Index]
+	r.info.Mutex.Unlock()
+	if chunk.Completed {
+		return nil
+	}
+
+	var err error
+	if r.info.aead != nil {
+		data, err = openChunk(r.info.aead, r.info.FileID, header.Index, data)
+	}
+	if err == nil && r.options.VerifyChecksums {
+		sum := sha256.Sum256(data)
+		if actual := hex.EncodeToString(sum[:]); actual != chunk.Checksum {
+			err = fmt.Errorf("checksum mismatch (expected %s, got %s)", chunk.Checksum, actual)
+		}
+	}
+	if err == nil {
+		if err = writeChunk(r.file, r.info, r.options, data, chunk.Offset); err != nil {
+			err = fmt.Errorf("failed to write chunk: %v", err)
+		}
+	}
+	if err != nil {
+		r.mutex.Lock()
+		r.failures[header.Index]++
+		failures := r.failures[header.Index]
+		r.mutex.Unlock()
+		if failures > r.options.RetryCount {
+			r.fail(fmt.Errorf("chunk %d failed %d times: %v", header.Index, failures, err))
+		}
+		return err
+	}
+
+	r.info.completeChunk(header.Index, r.options)
+	r.saveManifest()
 	return nil
 }
+
+// saveManifest records the chunks written so far, at most every
+// manifestSaveInterval, so an interrupted transfer can be resumed
+func (r *chunkReceiver) saveManifest() {
+	if !r.options.Resume {
+		return
+	}
+	r.mutex.Lock()
+	if time.Since(r.saved) < manifestSaveInterval {
+		r.mutex.Unlock()
+		return
+	}
+	r.saved = time.Now()
+	r.mutex.Unlock()
+
+	saveManifest(manifestPath(r.file.Name()), newChunkManifest(r.info))
+}
+
+// missing lists the chunks not verified yet. Once the sender has asked more
+// than RetryCount times and still some are missing, the transfer fails.
+func (r *chunkReceiver) missing() []int {
+	r.info.Mutex.Lock()
+	missing := []int{}
+	for i, chunk := range r.info.Chunks {
+		if !chunk.Completed {
+			missing = append(missing, i)
+		}
+	}
+	r.info.Mutex.Unlock()
+
+	if len(missing) > 0 {
+		r.mutex.Lock()
+		r.rounds++
+		rounds := r.rounds
+		r.mutex.Unlock()
+		if rounds > r.options.RetryCount {
+			r.fail(fmt.Errorf("%d chunks still missing after %d rounds", len(missing), rounds))
+		}
+	}
+	return missing
+}
+
+// fail ends the transfer with err, unless it already ended
+func (r *chunkReceiver) fail(err error) {
+	select {
+	case r.fatal <- err:
+	default:
+	}
+}
@@ -0,0 +1,91 @@
+package transfer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// What the receiver does when a file with the incoming name already exists
+const (
+	CollisionOverwrite = "overwrite" // Replace the existing file
+	CollisionRename    = "rename"    // Save as "name (1).ext", "name (2).ext", ...
+	CollisionSkip      = "skip"      // Decline the file and keep the existing one
+	CollisionFail      = "fail"      // Decline the file and report an error
+)
+
+// maxRenameAttempts bounds the search for a free "name (n).ext"
+const maxRenameAttempts = 10000
+
+// ValidCollisionPolicy reports whether policy is one of the Collision* values
+func ValidCollisionPolicy(policy string) bool {
+	switch policy {
+	case CollisionOverwrite, CollisionRename, CollisionSkip, CollisionFail:
+		return true
+	}
+	return false
+}
+
+// Paths currently being received, so that concurrent transfers of the same
+// name don't write to the same .part file
+var (
+	receivingPaths = make(map[string]bool)
+	receivingMutex sync.Mutex
+)
+
+// resolveCollision returns the path an incoming file should be saved to and
+// claims it until releasePath is called. If the file must be declined
+// instead, the reason for the sender is returned.
+func resolveCollision(outputPath, policy string) (string, string, error) {
+	receivingMutex.Lock()
+	defer receivingMutex.Unlock()
+
+	if !pathTaken(outputPath) {
+		receivingPaths[outputPath] = true
+		return outputPath, "", nil
+	}
+
+	switch policy {
+	case CollisionOverwrite:
+		if receivingPaths[outputPath] {
+			return "", "the same file is already being received", nil
+		}
+		receivingPaths[outputPath] = true
+		return outputPath, "", nil
+	case CollisionSkip, CollisionFail:
+		return "", "file exists", nil
+	case CollisionRename, "":
+		ext := filepath.Ext(outputPath)
+		base := strings.TrimSuffix(outputPath, ext)
+		for n := 1; n <= maxRenameAttempts; n++ {
+			candidate := fmt.Sprintf("%s (%d)%s", base, n, ext)
+			if !pathTaken(candidate) {
+				receivingPaths[candidate] = true
+				return candidate, "", nil
+			}
+		}
+		return "", "", fmt.Errorf("no free name found for %s", filepath.Base(outputPath))
+	default:
+		return "", "", fmt.Errorf("unknown collision policy: %s", policy)
+	}
+}
+
+// releasePath ends the claim taken by resolveCollision
+func releasePath(path string) {
+	receivingMutex.Lock()
+	defer receivingMutex.Unlock()
+
+	delete(receivingPaths, path)
+}
+
+// pathTaken reports whether a file exists at path or is being received there.
+// The caller must hold receivingMutex.
+func pathTaken(path string) bool {
+	if receivingPaths[path] {
+		return true
+	}
+	_, err := os.Stat(path)
+	return !os.IsNotExist(err)
+}
@@ -0,0 +1,68 @@
+package transfer
+
+import (
+	"compress/gzip"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// Compression
+//
+// A sender offers compression in the file header and the receiver accepts it
+// in its resume offer, so older peers that ignore the field transfer the file
+// uncompressed. When accepted, the file bytes from the resume offset are sent
+// as a single gzip member. Checksums and progress always refer to the
+// uncompressed bytes.
+
+// compressionGzip is the only compression method so far
+const compressionGzip = "gzip"
+
+// incompressibleExtensions are formats that are already compressed, where
+// gzip would only cost CPU time
+var incompressibleExtensions = map[string]bool{
+	".zip": true, ".gz": true, ".tgz": true, ".bz2": true, ".xz": true, ".zst": true,
+	".7z": true, ".rar": true, ".jar": true, ".apk": true,
+	".docx": true, ".xlsx": true, ".pptx": true, ".odt": true, ".pdf": true,
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".heic": true,
+	".mp3": true, ".aac": true, ".ogg": true, ".flac": true, ".m4a": true, ".opus": true,
+	".mp4": true, ".mkv": true, ".mov": true, ".avi": true, ".webm": true, ".m4v": true,
+}
+
+// worthCompressing reports whether a file is likely to shrink with gzip
+func worthCompressing(filename string) bool {
+	return !incompressibleExtensions[strings.ToLower(filepath.Ext(filename))]
+}
+
+// compressedCopy sends n bytes of src to dst as one gzip member
+func compressedCopy(dst io.Writer, src io.Reader, n int64, progress *progressTracker) error {
+	gz, err := gzip.NewWriterLevel(dst, gzip.BestSpeed)
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(progress.writer(gz), src, n); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// decompressedCopy reads one gzip member from src and writes its n bytes to dst
+func decompressedCopy(dst io.Writer, src io.Reader, n int64) (int64, error) {
+	gz, err := gzip.NewReader(src)
+	if err != nil {
+		return 0, err
+	}
+	// The sender waits for our result after the member, so don't look for another
+	gz.Multistream(false)
+
+	written, err := io.CopyN(dst, gz, n)
+	if err != nil {
+		return written, err
+	}
+
+	// Reading to the end checks the gzip trailer
+	if _, err := io.Copy(io.Discard, gz); err != nil {
+		return written, err
+	}
+	return written, nil
+}
@@ -0,0 +1,102 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"fileshare/internal/utils"
+)
+
+const (
+	// diskSpaceMargin is kept free on top of the incoming file so the disk doesn't fill completely
+	diskSpaceMargin = 64 * 1024 * 1024
+
+	// diskSpacePollInterval is how often a paused transfer checks for free space again
+	diskSpacePollInterval = 10 * time.Second
+)
+
+// errAllocateUnsupported means the platform or filesystem can't reserve space up front
+var errAllocateUnsupported = errors.New("preallocation not supported")
+
+// checkDiskSpace returns an error describing the shortfall if dir can't hold size more bytes
+func checkDiskSpace(dir string, size int64) error {
+	free, err := freeSpace(dir)
+	if err != nil {
+		// Not knowing is not a reason to refuse, the write will tell
+		return nil
+	}
+
+	if needed := uint64(size) + diskSpaceMargin; free < needed {
+		return fmt.Errorf("not enough disk space: need %s, %s free",
+			utils.FormatBytes(int64(needed)), utils.FormatBytes(int64(free)))
+	}
+	return nil
+}
+
+// waitForDiskSpace pauses until dir can hold size more bytes, telling the
+// user once, or until ctx is cancelled
+func waitForDiskSpace(ctx context.Context, dir string, size int64, info *FileTransferInfo) error {
+	err := checkDiskSpace(dir, size)
+	if err == nil {
+		return nil
+	}
+
+	info.Mutex.Lock()
+	previousStatus := info.Status
+	info.Status = "waiting for disk space"
+	info.Mutex.Unlock()
+
+	fmt.Printf("⏸️  %s paused: %v. Free up space in %s and the transfer will continue.\n", info.FileName, err, dir)
+
+	ticker := time.NewTicker(diskSpacePollInterval)
+	defer ticker.Stop()
+
+	for checkDiskSpace(dir, size) != nil {
+		select {
+		case <-ticker.C:
+		case <-contextOrBackground(ctx).Done():
+			return errCancelled
+		}
+	}
+
+	info.Mutex.Lock()
+	info.Status = previousStatus
+	info.Mutex.Unlock()
+
+	fmt.Printf("▶️  Disk space available again, resuming %s\n", info.FileName)
+	return nil
+}
+
+// preallocate reserves size bytes for file, really allocating the blocks
+// where the platform supports it and falling back to a sparse file otherwise
+func preallocate(file *os.File, size int64) error {
+	err := allocate(file, size)
+	if err == nil {
+		return nil
+	}
+	if isDiskFull(err) {
+		return err
+	}
+
+	// Sparse fallback: the size is set but blocks are only used as data arrives
+	return file.Truncate(size)
+}
+
+// isDiskFull reports whether err means the disk or quota is full
+func isDiskFull(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, syscall.ENOSPC) {
+		return true
+	}
+
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "no space left") || strings.Contains(msg, "not enough space") ||
+		strings.Contains(msg, "disk quota exceeded")
+}
@@ -0,0 +1,15 @@
+package transfer
+
+import (
+	"os"
+	"syscall"
+)
+
+// allocate reserves real blocks for the file with fallocate
+func allocate(file *os.File, size int64) error {
+	err := syscall.Fallocate(int(file.Fd()), 0, 0, size)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return errAllocateUnsupported
+	}
+	return err
+}
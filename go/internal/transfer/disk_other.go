@@ -0,0 +1,10 @@
+//go:build !linux
+
+package transfer
+
+import "os"
+
+// allocate is only implemented on Linux; elsewhere files are extended sparsely
+func allocate(file *os.File, size int64) error {
+	return errAllocateUnsupported
+}
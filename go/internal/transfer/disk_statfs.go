@@ -0,0 +1,14 @@
+//go:build !windows
+
+package transfer
+
+import "syscall"
+
+// freeSpace returns the bytes available to this user on the filesystem holding dir
+func freeSpace(dir string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,312 @@
+package transfer
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Transfer events
+//
+// Subscribe hands programs embedding this package the events of every
+// transfer in the process on one channel, instead of callbacks set on each
+// transfer's options; the terminal UI reads them the same way. Each file sent
+// or received is a transfer with its own ID, and its events come in order:
+// Started, any number of Progress or, for chunked transfers, ChunkCompleted,
+// then one of Completed, Failed or Cancelled.
+//
+// Publishing never blocks a transfer. Every subscriber has a queue that is
+// drained into its channel; a Progress or ChunkCompleted event still queued
+// when the next one of the same transfer arrives is replaced by it, so a slow
+// subscriber sees fewer of them, each with the latest counters, but never
+// misses the start or end of a transfer.
+
+// Types of TransferEvent
+const (
+	EventStarted        = "started"
+	EventProgress       = "progress"
+	EventChunkCompleted = "chunk_completed"
+	EventCompleted      = "completed"
+	EventFailed         = "failed"
+	EventCancelled      = "cancelled"
+)
+
+const (
+	// subscriberBuffer is how many events a subscriber's channel holds
+	// before the rest wait in its queue
+	subscriberBuffer = 64
+
+	// settleTimeout bounds how long the end of a file waits for subscribers
+	// to take its events
+	settleTimeout = 50 * time.Millisecond
+)
+
+// TransferEvent is something that happened to a transfer. The embedded
+// TransferStats are the counters of the file as of the event.
+type TransferEvent struct {
+	Type      string
+	ID        uint64 // The same for every event of a transfer
+	Direction string // DirectionSent, DirectionForwarded or DirectionReceived
+	FileName  string
+	Time      time.Time
+	Chunk     int   // Index of the chunk, for ChunkCompleted
+	Err       error // Why the transfer failed, for Failed
+	TransferStats
+}
+
+// subscriber is one Subscribe call
+type subscriber struct {
+	mutex  sync.Mutex
+	queue  []TransferEvent
+	wake   chan struct{} // Signalled when the queue grows
+	done   chan struct{} // Closed by unsubscribing
+	events chan TransferEvent
+}
+
+var eventBus = struct {
+	sync.Mutex
+	subscribers []*subscriber
+}{}
+
+var (
+	// subscribed counts the subscribers, so publishing without any is cheap
+	subscribed int32
+
+	lastTransferID uint64
+)
+
+// Subscribe returns a channel carrying the events of every transfer in the
+// process from now on, and a function that stops them and closes the channel
+func Subscribe() (<-chan TransferEvent, func()) {
+	s := &subscriber{
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+		events: make(chan TransferEvent, subscriberBuffer),
+	}
+
+	eventBus.Lock()
+	eventBus.subscribers = append(eventBus.subscribers, s)
+	atomic.AddInt32(&subscribed, 1)
+	eventBus.Unlock()
+
+	go s.run()
+
+	var once sync.Once
+	return s.events, func() {
+		once.Do(func() {
+			eventBus.Lock()
+			for i, other := range eventBus.subscribers {
+				if other == s {
+					eventBus.subscribers = append(eventBus.subscribers[:i], eventBus.subscribers[i+1:]...)
+					break
+				}
+			}
+			atomic.AddInt32(&subscribed, -1)
+			eventBus.Unlock()
+			close(s.done)
+		})
+	}
+}
+
+// run moves queued events into the subscriber's channel until it unsubscribes
+func (s *subscriber) run() {
+	defer close(s.events)
+	for {
+		s.mutex.Lock()
+		if len(s.queue) == 0 {
+			s.mutex.Unlock()
+			select {
+			case <-s.wake:
+				continue
+			case <-s.done:
+				return
+			}
+		}
+		event := s.queue[0]
+		s.queue = s.queue[1:]
+		s.mutex.Unlock()
+
+		select {
+		case s.events <- event:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// add queues event, replacing a queued event it makes stale
+func (s *subscriber) add(event TransferEvent) {
+	s.mutex.Lock()
+	replaced := false
+	if event.Type == EventProgress || event.Type == EventChunkCompleted {
+		for i := range s.queue {
+			if s.queue[i].ID == event.ID && s.queue[i].Type == event.Type {
+				s.queue[i] = event
+				replaced = true
+				break
+			}
+		}
+	}
+	if !replaced {
+		s.queue = append(s.queue, event)
+	}
+	s.mutex.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// publish hands event to every subscriber without waiting for any of them
+func publish(event TransferEvent) {
+	if atomic.LoadInt32(&subscribed) == 0 {
+		return
+	}
+	event.Time = time.Now()
+
+	eventBus.Lock()
+	defer eventBus.Unlock()
+	for _, s := range eventBus.subscribers {
+		s.add(event)
+	}
+}
+
+// settleEvents gives subscribers a moment to take the events published so
+// far. A terminal drawing progress from them is then done with a file before
+// anything else about it is printed. Slow subscribers are not waited for.
+func settleEvents() {
+	if atomic.LoadInt32(&subscribed) == 0 {
+		return
+	}
+	for deadline := time.Now().Add(settleTimeout); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if eventsTaken() {
+			return
+		}
+	}
+}
+
+// eventsTaken reports whether every subscriber has received every event
+func eventsTaken() bool {
+	eventBus.Lock()
+	defer eventBus.Unlock()
+	for _, s := range eventBus.subscribers {
+		s.mutex.Lock()
+		waiting := len(s.queue) + len(s.events)
+		s.mutex.Unlock()
+		if waiting > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// transferEvents publishes the events of one transfer
+type transferEvents struct {
+	id        uint64
+	direction string
+	peer      string
+	file      string
+	total     int64
+	started   time.Time
+	base      TransferStats // Counters of a batch's progress tracker when the file started
+	ended     bool
+}
+
+// startTransfer gives a transfer of file an ID and publishes its start
+func startTransfer(direction, peer, file string, total int64) *transferEvents {
+	e := &transferEvents{
+		id:        atomic.AddUint64(&lastTransferID, 1),
+		direction: direction,
+		peer:      peer,
+		file:      file,
+		total:     total,
+		started:   time.Now(),
+	}
+	e.publish(EventStarted, TransferStats{Total: total})
+	return e
+}
+
+// track has progress publish the transfer's progress, counting from what
+// progress has already seen when it spans a batch of files
+func (e *transferEvents) track(progress *progressTracker) {
+	e.base = TransferStats{BytesDone: progress.done, Resumed: progress.resumed, WireBytes: progress.wire}
+	progress.events = e
+}
+
+// done reports whether progress has seen all of the transfer's bytes
+func (e *transferEvents) done(progress *progressTracker) bool {
+	return e.total >= 0 && progress.done-e.base.BytesDone >= e.total
+}
+
+// statsOf returns the counters of the transfer as progress has them now
+func (e *transferEvents) statsOf(progress *progressTracker) TransferStats {
+	return e.stats(progress.stats(time.Now()), progress.total >= 0)
+}
+
+// stats turns the counters of a batch into those of the transfer. finished
+// is set once the length of a stream is known.
+func (e *transferEvents) stats(batch TransferStats, finished bool) TransferStats {
+	stats := TransferStats{
+		BytesDone:   batch.BytesDone - e.base.BytesDone,
+		Total:       e.total,
+		Resumed:     batch.Resumed - e.base.Resumed,
+		WireBytes:   batch.WireBytes - e.base.WireBytes,
+		CurrentRate: batch.CurrentRate,
+		Elapsed:     time.Since(e.started),
+	}
+	if stats.Total < 0 && finished {
+		// A stream whose length is known now that it ended
+		stats.Total = stats.BytesDone
+	}
+	if seconds := stats.Elapsed.Seconds(); seconds > 0 {
+		stats.AverageRate = int64(float64(stats.BytesDone-stats.Resumed) / seconds)
+	}
+	rate := stats.CurrentRate
+	if rate == 0 {
+		rate = stats.AverageRate
+	}
+	if rate > 0 && stats.BytesDone < stats.Total {
+		stats.ETA = time.Duration(float64(stats.Total-stats.BytesDone) / float64(rate) * float64(time.Second))
+	}
+	return stats
+}
+
+// chunk publishes that a chunk of a chunked transfer was written or acknowledged
+func (e *transferEvents) chunk(index int, done, rate int64) {
+	event := e.event(EventChunkCompleted, TransferStats{
+		BytesDone:   done,
+		Total:       e.total,
+		AverageRate: rate,
+		Elapsed:     time.Since(e.started),
+	})
+	event.Chunk = index
+	publish(event)
+}
+
+// end publishes how the transfer ended; only the first call counts
+func (e *transferEvents) end(err error, ctx context.Context, final TransferStats) {
+	if e.ended {
+		return
+	}
+	e.ended = true
+
+	event := e.event(EventCompleted, final)
+	switch {
+	case cancelled(ctx):
+		event.Type = EventCancelled
+	case err != nil:
+		event.Type, event.Err = EventFailed, err
+	}
+	publish(event)
+}
+
+func (e *transferEvents) publish(eventType string, stats TransferStats) {
+	publish(e.event(eventType, stats))
+}
+
+func (e *transferEvents) event(eventType string, stats TransferStats) TransferEvent {
+	stats.Peer = e.peer
+	return TransferEvent{Type: eventType, ID: e.id, Direction: e.direction, FileName: e.file, TransferStats: stats}
+}
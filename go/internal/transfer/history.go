@@ -0,0 +1,273 @@
+package transfer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fileshare/internal/utils"
+)
+
+// The transfer history is kept in DataDir and read again before every
+// change, so receivers and senders running in different terminals add to
+// the same list. A lock file keeps two processes from changing it at once.
+// Only the most recent maxHistoryEntries are kept.
+
+// Transfer directions recorded in history
+const (
+	DirectionReceived  = "received"
+	DirectionSent      = "sent"
+	DirectionForwarded = "forwarded"
+)
+
+// Transfer results recorded in history
+const (
+	ResultOK        = "ok"
+	ResultFailed    = "failed"
+	ResultCancelled = "cancelled"
+	ResultUpToDate  = "up-to-date" // Not sent, the receiver already had an identical copy
+)
+
+const (
+	historyFile       = "history.json"
+	maxHistoryEntries = 1000
+
+	// A lock older than historyLockStale was left behind by a process that died
+	historyLockWait  = 2 * time.Second
+	historyLockStale = 10 * time.Second
+)
+
+// HistoryEntry records a transfer of one file, successful or not
+type HistoryEntry struct {
+	ID           int           `json:"id"`
+	Direction    string        `json:"direction"`
+	Peer         string        `json:"peer"`                // Remote address the file came from or went to
+	PeerName     string        `json:"peer_name,omitempty"` // Name the peer was addressed by, if not an address
+	FileName     string        `json:"file_name"`
+	FilePath     string        `json:"file_path,omitempty"`
+	FileSize     int64         `json:"file_size"`
+	Checksum     string        `json:"checksum,omitempty"` // Hex encoded SHA-256 of the file contents
+	ModTime      time.Time     `json:"mod_time,omitempty"`
+	Time         time.Time     `json:"time"`
+	Duration     time.Duration `json:"duration"`
+	Result       string        `json:"result"`                  // ResultOK, ResultFailed or ResultCancelled
+	Error        string        `json:"error,omitempty"`         // Why the transfer did not succeed
+	ReceivedFrom string        `json:"received_from,omitempty"` // Original sender when the file was forwarded
+	ForwardedTo  []string      `json:"forwarded_to,omitempty"`  // Peers this file has been forwarded to
+}
+
+var (
+	history      []HistoryEntry // Kept in memory as well, in case DataDir can't be written
+	historyMutex sync.Mutex
+)
+
+func historyPath() (string, error) {
+	dir, err := utils.DataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, historyFile), nil
+}
+
+// lockHistoryFile takes the lock file shared by all processes, returning the
+// function that releases it. Changes go ahead unlocked if it can't be taken.
+func lockHistoryFile() func() {
+	path, err := historyPath()
+	if err != nil {
+		return func() {}
+	}
+	lockPath := path + ".lock"
+
+	deadline := time.Now().Add(historyLockWait)
+	for {
+		lock, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			lock.Close()
+			return func() { os.Remove(lockPath) }
+		}
+		if info, statErr := os.Stat(lockPath); statErr == nil && time.Since(info.ModTime()) > historyLockStale {
+			os.Remove(lockPath)
+			continue
+		}
+		if !os.IsExist(err) || time.Now().After(deadline) {
+			return func() {}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// loadHistory refreshes the history from disk to pick up other processes' transfers
+func loadHistory() {
+	path, err := historyPath()
+	if err != nil {
+		return
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		history = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	var entries []HistoryEntry
+	if err := json.Unmarshal(data, &entries); err == nil {
+		history = entries
+	}
+}
+
+// saveHistory writes the history atomically, dropping the oldest entries beyond the limit
+func saveHistory() error {
+	if len(history) > maxHistoryEntries {
+		history = append([]HistoryEntry(nil), history[len(history)-maxHistoryEntries:]...)
+	}
+
+	path, err := historyPath()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(history, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// RecordTransfer appends an entry to the transfer history and returns it with its assigned ID
+func RecordTransfer(entry HistoryEntry) HistoryEntry {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+	defer lockHistoryFile()()
+
+	loadHistory()
+
+	entry.ID = 1
+	if len(history) > 0 {
+		entry.ID = history[len(history)-1].ID + 1
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	if entry.Result == "" {
+		entry.Result = ResultOK
+	}
+
+	history = append(history, entry)
+	if err := saveHistory(); err != nil {
+		fmt.Printf("⚠️  Could not save transfer history: %v\n", err)
+	}
+	return entry
+}
+
+// recordOutcome adds a history entry for a file whose transfer ended with err
+func recordOutcome(entry HistoryEntry, err error, ctx context.Context) {
+	switch {
+	case cancelled(ctx):
+		entry.Result = ResultCancelled
+	case err != nil:
+		entry.Result = ResultFailed
+		entry.Error = err.Error()
+	}
+	RecordTransfer(entry)
+}
+
+// GetHistory returns the recorded transfers, newest first
+func GetHistory() []HistoryEntry {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+
+	loadHistory()
+
+	entries := make([]HistoryEntry, len(history))
+	for i, entry := range history {
+		entry.ForwardedTo = append([]string(nil), entry.ForwardedTo...)
+		entries[len(history)-1-i] = entry
+	}
+	return entries
+}
+
+// ClearHistory forgets every recorded transfer
+func ClearHistory() error {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+	defer lockHistoryFile()()
+
+	history = nil
+
+	path, err := historyPath()
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// FindReceivedEntry looks up a received transfer by history ID, or the most recent one for "last"
+func FindReceivedEntry(ref string) (HistoryEntry, error) {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+
+	loadHistory()
+
+	if strings.EqualFold(ref, "last") {
+		for i := len(history) - 1; i >= 0; i-- {
+			if history[i].Direction == DirectionReceived && history[i].Result == ResultOK {
+				return history[i], nil
+			}
+		}
+		return HistoryEntry{}, fmt.Errorf("no received files in the history")
+	}
+
+	id, err := strconv.Atoi(strings.TrimPrefix(ref, "#"))
+	if err != nil {
+		return HistoryEntry{}, fmt.Errorf("invalid history ID: %s", ref)
+	}
+
+	for _, entry := range history {
+		if entry.ID != id {
+			continue
+		}
+		if entry.Direction != DirectionReceived {
+			return HistoryEntry{}, fmt.Errorf("history entry %d is not a received file (%s)", id, entry.Direction)
+		}
+		if entry.Result != ResultOK {
+			return HistoryEntry{}, fmt.Errorf("history entry %d was not received completely (%s)", id, entry.Result)
+		}
+		return entry, nil
+	}
+
+	return HistoryEntry{}, fmt.Errorf("no history entry with ID %d", id)
+}
+
+// AddForwardedTo records that a received file has been forwarded to another peer
+func AddForwardedTo(id int, peer string) {
+	historyMutex.Lock()
+	defer historyMutex.Unlock()
+	defer lockHistoryFile()()
+
+	loadHistory()
+
+	for i := range history {
+		if history[i].ID == id {
+			history[i].ForwardedTo = append(history[i].ForwardedTo, peer)
+			if err := saveHistory(); err != nil {
+				fmt.Printf("⚠️  Could not save transfer history: %v\n", err)
+			}
+			return
+		}
+	}
+}
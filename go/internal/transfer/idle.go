@@ -0,0 +1,35 @@
+package transfer
+
+import (
+	"net"
+	"time"
+)
+
+// senderIdleTimeout is how long a sender waits without any bytes moving
+const senderIdleTimeout = 30 * time.Second
+
+// idleConn pushes the connection deadline forward before every read and
+// write, so a transfer only times out when no data has moved for the idle
+// period, however long the whole transfer takes
+type idleConn struct {
+	net.Conn
+	idle time.Duration
+}
+
+// withIdleTimeout wraps conn with an idle timeout. An idle period of zero or less disables it.
+func withIdleTimeout(conn net.Conn, idle time.Duration) net.Conn {
+	if idle <= 0 {
+		return conn
+	}
+	return &idleConn{Conn: conn, idle: idle}
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(c.idle))
+	return c.Conn.Read(p)
+}
+
+func (c *idleConn) Write(p []byte) (int, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.idle))
+	return c.Conn.Write(p)
+}
@@ -0,0 +1,121 @@
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fileshare/internal/access"
+)
+
+// Receiver connection limits
+//
+// A receiver keeps at most MaxConnections connections open at once, counting
+// those waiting for a free MaxConcurrentReceives slot, and at most
+// MaxConnectionsPerIP from any one address. A connection over a limit gets a
+// busy reply before anything is read from it and is closed; senders report
+// it as ErrReceiverBusy whatever message they were waiting for.
+
+// Connection limits of a receiver unless TransferOptions say otherwise
+const (
+	DefaultMaxConnections      = 16
+	DefaultMaxConnectionsPerIP = 4
+)
+
+const (
+	// busyLinger bounds how long a turned away connection is kept open so
+	// the sender gets the busy reply
+	busyLinger = 2 * time.Second
+
+	// maxLingering bounds how many turned away connections linger at once;
+	// beyond it they are closed straight away
+	maxLingering = 32
+)
+
+// ErrReceiverBusy is returned when the receiver turned the connection away
+// for being over its connection limits
+var ErrReceiverBusy = errors.New("receiver is busy")
+
+// busyReply is all a receiver sends on a connection it turns away
+type busyReply struct {
+	Busy string `json:"busy"` // Why the connection was turned away
+}
+
+// lingering counts the turned away connections not yet closed
+var lingering int32
+
+// sendBusy tells the sender of conn why it is turned away and closes it.
+// What the sender already wrote is read and discarded first, since closing
+// a connection with unread data resets it and can lose the reply.
+func sendBusy(conn net.Conn, reason error) {
+	fmt.Printf("⛔ Turned away connection from %s: %v\n", conn.RemoteAddr(), reason)
+	if atomic.AddInt32(&lingering, 1) > maxLingering {
+		atomic.AddInt32(&lingering, -1)
+		conn.Close()
+		return
+	}
+
+	go func() {
+		defer atomic.AddInt32(&lingering, -1)
+		defer conn.Close()
+
+		conn.SetDeadline(time.Now().Add(busyLinger))
+		if err := writeMessage(conn, busyReply{Busy: reason.Error()}); err != nil {
+			return
+		}
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			tcpConn.CloseWrite()
+		}
+		io.Copy(io.Discard, io.LimitReader(conn, maxMessageSize))
+	}()
+}
+
+// ConnectionStats is how many connections a receiver in this process has open
+type ConnectionStats struct {
+	Port int
+	Open int
+	Max  int // 0 for no limit
+}
+
+var receiverLimiters = struct {
+	sync.Mutex
+	ports map[int]*access.Limiter
+}{ports: make(map[int]*access.Limiter)}
+
+// newReceiverLimiter returns the connection limiter of a receiver on port,
+// registered for ReceiverConnections until the returned function is called
+func newReceiverLimiter(port int, options TransferOptions) (*access.Limiter, func()) {
+	limiter := access.NewLimiter(options.MaxConnections, options.MaxConnectionsPerIP)
+
+	receiverLimiters.Lock()
+	receiverLimiters.ports[port] = limiter
+	receiverLimiters.Unlock()
+
+	return limiter, func() {
+		receiverLimiters.Lock()
+		defer receiverLimiters.Unlock()
+		if receiverLimiters.ports[port] == limiter {
+			delete(receiverLimiters.ports, port)
+		}
+	}
+}
+
+// ReceiverConnections returns the connection counts of the receivers running
+// in this process, by port
+func ReceiverConnections() []ConnectionStats {
+	receiverLimiters.Lock()
+	defer receiverLimiters.Unlock()
+
+	stats := make([]ConnectionStats, 0, len(receiverLimiters.ports))
+	for port, limiter := range receiverLimiters.ports {
+		open, max := limiter.Stats()
+		stats = append(stats, ConnectionStats{Port: port, Open: open, Max: max})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Port < stats[j].Port })
+	return stats
+}
@@ -0,0 +1,151 @@
+package transfer
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Chunk manifests
+//
+// While a chunked transfer is received, a manifest next to the .part file
+// records its metadata and which chunks have been written. If the transfer
+// breaks off and the same file is sent again, recognised by its name, size,
+// chunk size and chunk checksums, the receiver checks the chunks the manifest
+// lists against the data on disk and tells the sender to skip the good ones.
+// The manifest is removed once the file is complete and renamed. Manifests untouched for
+// manifestExpiry are abandoned transfers and are removed, with their partial
+// file, the next time a chunked transfer is received into the directory.
+
+const (
+	manifestSuffix = ".bsmanifest"
+
+	// manifestExpiry is how long an interrupted transfer can be resumed
+	manifestExpiry = 7 * 24 * time.Hour
+
+	// manifestSaveInterval limits how often the manifest is rewritten while chunks arrive
+	manifestSaveInterval = 2 * time.Second
+)
+
+// chunkManifest is the state of a partially received chunked transfer
+type chunkManifest struct {
+	FileID    string    `json:"file_id"`
+	FileName  string    `json:"file_name"`
+	FileSize  int64     `json:"file_size"`
+	ChunkSize int64     `json:"chunk_size"`
+	Checksums []string  `json:"checksums"`
+	Completed []byte    `json:"completed"` // Bitmap of written chunks, bit i%8 of byte i/8
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func manifestPath(filePath string) string {
+	return filePath + manifestSuffix
+}
+
+// newChunkManifest captures the current state of a transfer
+func newChunkManifest(info *FileTransferInfo) chunkManifest {
+	info.Mutex.Lock()
+	defer info.Mutex.Unlock()
+
+	m := chunkManifest{
+		FileID:    info.FileID,
+		FileName:  info.FileName,
+		FileSize:  info.FileSize,
+		ChunkSize: info.ChunkSize,
+		Checksums: make([]string, len(info.Chunks)),
+		Completed: make([]byte, (len(info.Chunks)+7)/8),
+		UpdatedAt: time.Now(),
+	}
+	for i, chunk := range info.Chunks {
+		m.Checksums[i] = chunk.Checksum
+		if chunk.Completed {
+			m.Completed[i/8] |= 1 << (i % 8)
+		}
+	}
+	return m
+}
+
+// completed reports whether the manifest lists chunk i as written
+func (m chunkManifest) completed(i int) bool {
+	return i/8 < len(m.Completed) && m.Completed[i/8]&(1<<(i%8)) != 0
+}
+
+// matches reports whether the manifest is of the same file as info, even
+// when the sender gave it a new file ID
+func (m chunkManifest) matches(info *FileTransferInfo) bool {
+	if m.FileName != info.FileName || m.FileSize != info.FileSize || m.ChunkSize != info.ChunkSize || len(m.Checksums) != len(info.Chunks) {
+		return false
+	}
+	for i, chunk := range info.Chunks {
+		if m.Checksums[i] != chunk.Checksum {
+			return false
+		}
+	}
+	return true
+}
+
+// saveManifest writes the manifest atomically
+func saveManifest(path string, m chunkManifest) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func loadManifest(path string) (chunkManifest, error) {
+	var m chunkManifest
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return m, err
+	}
+	err = json.Unmarshal(data, &m)
+	return m, err
+}
+
+// resumeFromManifest marks the chunks of info that a matching manifest
+// lists and that still verify on disk as completed, returning their indices
+func resumeFromManifest(file *os.File, info *FileTransferInfo, m chunkManifest) []int {
+	var have []int
+	for i := range info.Chunks {
+		if !m.completed(i) {
+			continue
+		}
+		chunk := info.Chunks[i]
+		checksum, err := calculateChunkChecksum(file, chunk.Offset, chunk.Size)
+		if err != nil || checksum != chunk.Checksum {
+			continue
+		}
+		info.Chunks[i].Completed = true
+		info.Completed++
+		have = append(have, i)
+	}
+	return have
+}
+
+// removeStaleManifests deletes the manifests in dir older than
+// manifestExpiry along with the partial files they describe
+func removeStaleManifests(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), manifestSuffix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < manifestExpiry {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		os.Remove(strings.TrimSuffix(path, manifestSuffix))
+		os.Remove(path)
+	}
+}
@@ -0,0 +1,41 @@
+package transfer
+
+import (
+	"os"
+	"time"
+)
+
+// File metadata
+//
+// Senders put the file's modification time and permission bits in its
+// header and receivers apply them once the file is in place, unless
+// TransferOptions.PreserveMetadata is off. Group and world write bits are
+// never applied. On Windows only the owner write bit is used, as the
+// read-only attribute, so a read-only file stays read-only either way.
+
+// preservedModeBits are the permission bits a receiver applies
+const preservedModeBits = os.ModePerm &^ 0022
+
+// setMetadata fills in the metadata fields of a header from the file's info
+func (h *fileHeader) setMetadata(info os.FileInfo) {
+	h.ModTime = info.ModTime().UnixNano()
+	h.Mode = uint32(info.Mode().Perm())
+}
+
+// applyMetadata gives a received file the sender's modification time and
+// permissions. Senders that predate metadata leave both unset.
+func applyMetadata(path string, header fileHeader) error {
+	if header.ModTime != 0 {
+		modTime := time.Unix(0, header.ModTime)
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			return err
+		}
+	}
+	// Permissions last, a read-only file can't have its times changed on every system
+	if header.Mode != 0 {
+		if err := os.Chmod(path, os.FileMode(header.Mode)&preservedModeBits); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package transfer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"time"
+
+	"fileshare/internal/utils"
+)
+
+// Receiving to a writer
+//
+// ReceiveToWriter takes a single file and writes its data to a writer, such
+// as stdout piped into another program, instead of saving it. Nothing is
+// written to disk, so there is no .part file to resume from and batches of
+// more than one file are turned away. The data is checked against the
+// sender's size and checksum as usual, but by the time a mismatch shows it
+// has already been written, so the error is the only sign of it.
+
+// ReceiveToWriter waits for one incoming file and writes its contents to w
+func ReceiveToWriter(port int, timeout time.Duration, w io.Writer, options TransferOptions) error {
+	options.output = w
+	return receive(port, timeout, "", options, false)
+}
+
+// receiveToWriter receives the one file of a batch into options.output
+func receiveToWriter(conn net.Conn, batch batchHeader, options TransferOptions) (err error) {
+	if batch.Count != 1 {
+		// Decline each file so the sender gets the reason for all of them
+		reason := fmt.Sprintf("this receiver writes to a pipe and takes a single file, not %d", batch.Count)
+		for i := 0; i < batch.Count; i++ {
+			var header fileHeader
+			if err := readMessage(conn, &header); err != nil {
+				break
+			}
+			if err := writeMessage(conn, resumeOffer{Declined: reason}); err != nil {
+				break
+			}
+		}
+		return fmt.Errorf("refused a batch of %d files: only a single file can be received to stdout", batch.Count)
+	}
+
+	var header fileHeader
+	if err := readMessage(conn, &header); err != nil {
+		return fmt.Errorf("failed to read file metadata: %v", err)
+	}
+	if err := header.validate(); err != nil {
+		return fmt.Errorf("rejected file metadata: %v", err)
+	}
+	filename := filepath.Base(header.Name)
+	fileSize := header.Size
+	streaming := fileSize == streamSize
+
+	if fileSize <= 0 && !streaming {
+		return fmt.Errorf("invalid file size: %d bytes", fileSize)
+	}
+	if err := checkFileSize(fileSize, options.MaxFileSize); err != nil {
+		writeMessage(conn, resumeOffer{Declined: err.Error()})
+		return fmt.Errorf("declined %s: %v", filename, err)
+	}
+
+	peer := conn.RemoteAddr().String()
+	if options.AcceptFunc != nil {
+		// There is no file to name, so only the answer counts
+		if accept, _ := options.AcceptFunc(IncomingFile{Name: filename, Size: fileSize, Peer: peer}); !accept {
+			writeMessage(conn, resumeOffer{Declined: "rejected by the receiver"})
+			return fmt.Errorf("rejected %s", filename)
+		}
+	}
+
+	options.notify(StateReceiving, filename, peer, nil)
+	started := time.Now()
+	var bytesReceived int64
+	progress := newProgressTracker(fileSize, options)
+	progress.peer = peer
+	events := startTransfer(DirectionReceived, peer, filename, fileSize)
+	events.track(progress)
+	defer func() {
+		events.end(err, options.Context, events.statsOf(progress))
+		if err != nil {
+			options.notify(StateFileFailed, filename, peer, err)
+		} else {
+			options.notify(StateFileDone, filename, peer, nil)
+		}
+		recordOutcome(HistoryEntry{
+			Direction: DirectionReceived,
+			Peer:      peer,
+			FileName:  filename,
+			FileSize:  bytesReceived,
+			Checksum:  header.Checksum,
+			Duration:  time.Since(started),
+		}, err, options.Context)
+	}()
+
+	if streaming {
+		connPrintf(conn, "Receiving stream: %s -> stdout\n", filename)
+	} else {
+		connPrintf(conn, "Receiving file: %s (%s) -> stdout\n", filename, utils.FormatBytes(fileSize))
+	}
+
+	offer := resumeOffer{}
+	if header.Compression == compressionGzip && options.CompressData {
+		offer.Compression = compressionGzip
+	}
+	if err := writeMessage(conn, offer); err != nil {
+		return fmt.Errorf("failed to send resume offer: %v", err)
+	}
+	// Offering nothing to resume from, so the sender starts at the beginning
+	var decision resumeDecision
+	if err := readMessage(conn, &decision); err != nil {
+		return fmt.Errorf("failed to read resume decision: %v", err)
+	}
+
+	hasher := sha256.New()
+	bytesReceived, err = receiveContent(conn, progress.writer(io.MultiWriter(options.output, hasher)), progress, &header, offer.Compression != "", fileSize, options.MaxFileSize, options.bufferSize())
+	if err != nil {
+		reportFailure(conn, err)
+		return fmt.Errorf("failed to receive file content: %v", err)
+	}
+	if bytesReceived != header.Size {
+		return fmt.Errorf("incomplete transfer: received %d bytes, expected %d bytes", bytesReceived, header.Size)
+	}
+
+	result := transferResult{BytesWritten: bytesReceived, Checksum: hex.EncodeToString(hasher.Sum(nil))}
+	if result.Checksum != header.Checksum {
+		result.Error = fmt.Sprintf("checksum mismatch (expected %s, got %s)", header.Checksum, result.Checksum)
+		writeMessage(conn, result)
+		return fmt.Errorf("received data is corrupt, discard the output: %s", result.Error)
+	}
+
+	result.OK = true
+	if err := writeMessage(conn, result); err != nil {
+		connPrintf(conn, "Warning: could not confirm receipt to sender: %v\n", err)
+	}
+	connPrintf(conn, "Successfully received %s (%s) to stdout\n", filename, utils.FormatBytes(bytesReceived))
+	return nil
+}
@@ -0,0 +1,163 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"fileshare/internal/version"
+)
+
+// Outcomes of the two stages of a probe
+const (
+	ProbeOK             = "ok"
+	ProbeRefused        = "refused"
+	ProbeTimedOut       = "timed out"
+	ProbeUnreachable    = "unreachable"
+	ProbeWrongProtocol  = "wrong protocol"
+	ProbeNoResponse     = "no response"
+	ProbeAuthRequired   = "auth required"
+	ProbeBusy           = "busy"
+	ProbeNotAttempted   = "not attempted"
+	probeDefaultTimeout = 5 * time.Second
+)
+
+// ProbeResult describes what happened when probing a remote receiver
+type ProbeResult struct {
+	Address    string
+	Connect    string // ProbeOK, ProbeRefused, ProbeTimedOut or ProbeUnreachable
+	Handshake  string // ProbeOK, ProbeWrongProtocol, ProbeNoResponse, ProbeAuthRequired, ProbeBusy or ProbeNotAttempted
+	Version    int    // Protocol version reported by the receiver
+	AppVersion string // BitShare release reported by the receiver, if any
+	TLS        bool   // Whether the receiver only accepts encrypted transfers
+	Latency    time.Duration
+	Detail     error
+}
+
+// probeReply is a receiver's answer to a probe
+type probeReply struct {
+	Protocol     string `json:"protocol"`
+	Version      int    `json:"version"`
+	AppVersion   string `json:"app_version,omitempty"`
+	AuthRequired bool   `json:"auth_required"`
+	TLSRequired  bool   `json:"tls_required,omitempty"`
+
+	// Answers to a query, see query.go
+	Verdicts     []fileVerdict `json:"verdicts,omitempty"`
+	Capabilities []string      `json:"capabilities,omitempty"`
+}
+
+// errProbeAnswered tells the accept loop that a connection was only a probe
+var errProbeAnswered = errors.New("probe answered")
+
+// Probe attempts a BitShare handshake against a remote receiver without sending a file
+func Probe(host string, port int, timeout time.Duration) ProbeResult {
+	if timeout <= 0 {
+		timeout = probeDefaultTimeout
+	}
+
+	result := ProbeResult{
+		Address:   net.JoinHostPort(host, fmt.Sprintf("%d", port)),
+		Handshake: ProbeNotAttempted,
+	}
+
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", result.Address, timeout)
+	if err != nil {
+		result.Detail = err
+		var netErr net.Error
+		switch {
+		case errors.Is(err, syscall.ECONNREFUSED):
+			result.Connect = ProbeRefused
+		case errors.As(err, &netErr) && netErr.Timeout():
+			result.Connect = ProbeTimedOut
+		default:
+			result.Connect = ProbeUnreachable
+		}
+		return result
+	}
+	defer conn.Close()
+
+	result.Connect = ProbeOK
+	result.Latency = time.Since(start)
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := writeMessage(conn, batchHeader{Probe: true, AppVersion: version.Current}); err != nil {
+		result.Handshake = ProbeNoResponse
+		result.Detail = err
+		return result
+	}
+
+	var reply probeReply
+	if err := readMessage(conn, &reply); err != nil {
+		result.Detail = err
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			result.Handshake = ProbeNoResponse
+		} else if errors.Is(err, ErrReceiverBusy) {
+			result.Handshake = ProbeBusy
+		} else {
+			result.Handshake = ProbeWrongProtocol
+		}
+		return result
+	}
+
+	result.Version = reply.Version
+	result.AppVersion = reply.AppVersion
+	result.TLS = reply.TLSRequired
+	switch {
+	case reply.Protocol != protocolName:
+		result.Handshake = ProbeWrongProtocol
+		result.Detail = fmt.Errorf("remote speaks %q", reply.Protocol)
+	case reply.AuthRequired:
+		result.Handshake = ProbeAuthRequired
+	default:
+		result.Handshake = ProbeOK
+	}
+
+	return result
+}
+
+// answerProbe replies to a probe and logs it distinctly from real transfers
+func answerProbe(conn net.Conn, authRequired bool) error {
+	fmt.Printf("🔎 Probe from %s answered - this receiver is reachable\n", conn.RemoteAddr())
+	return writeMessage(conn, probeReply{Protocol: protocolName, Version: ProtocolVersion, AppVersion: version.Current, AuthRequired: authRequired})
+}
+
+// ProbeListen answers probes on a port until the listener fails or ctx is
+// cancelled, so that reachability can be checked before starting a real receiver
+func ProbeListen(ctx context.Context, port int) error {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return fmt.Errorf("failed to start listener: %v", err)
+	}
+	defer listener.Close()
+	defer closeOnCancel(ctx, listener)()
+
+	fmt.Printf("Waiting for probes on port %d...\n", port)
+
+	for {
+		conn, err := listener.Accept()
+		if cancelled(ctx) {
+			return errCancelled
+		}
+		if err != nil {
+			return fmt.Errorf("failed to accept connection: %v", err)
+		}
+
+		go func(conn net.Conn) {
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(probeDefaultTimeout))
+
+			var batch batchHeader
+			if err := readMessage(conn, &batch); err != nil || !batch.Probe {
+				fmt.Printf("🔌 Connection from %s reached this port, but it was not a BitShare probe\n", conn.RemoteAddr())
+				return
+			}
+			answerProbe(conn, false)
+		}(conn)
+	}
+}
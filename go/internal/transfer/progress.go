@@ -0,0 +1,185 @@
+package transfer
+
+import (
+	"io"
+	"time"
+)
+
+const (
+	// progressInterval throttles progress callbacks so large transfers don't flood the terminal
+	progressInterval = 200 * time.Millisecond
+
+	// rateWindow is how far back the current transfer speed is averaged over
+	rateWindow = 5 * time.Second
+)
+
+// TransferStats describes how a transfer is progressing
+type TransferStats struct {
+	BytesDone   int64
+	Total       int64 // Negative while the length of a stream is unknown
+	CurrentRate int64 // Bytes per second over the last few seconds
+	AverageRate int64 // Bytes per second since the transfer started
+	Elapsed     time.Duration
+	ETA         time.Duration // Zero when unknown or finished
+	Peer        string        // Remote address, set on the receiving side
+	Resumed     int64         // Bytes the receiver already had, not transferred again
+	WireBytes   int64         // File bytes that crossed the network, after compression
+}
+
+type progressSample struct {
+	at   time.Time
+	done int64
+}
+
+// progressTracker counts bytes moved during a transfer and reports them
+// through the TransferOptions progress callbacks at a throttled interval
+type progressTracker struct {
+	done       int64
+	resumed    int64 // Bytes skipped by resuming, not counted towards speed
+	wire       int64 // File bytes sent or received on the connection
+	total      int64
+	peer       string
+	start      time.Time
+	lastReport time.Time
+	samples    []progressSample
+	report     func(bytesDone, total int64)
+	reportAll  func(TransferStats)
+	events     *transferEvents // The file being transferred, see events.go
+}
+
+func newProgressTracker(total int64, options TransferOptions) *progressTracker {
+	return &progressTracker{
+		total:     total,
+		start:     time.Now(),
+		report:    options.ProgressFunc,
+		reportAll: options.ProgressStatsFunc,
+	}
+}
+
+// skip records bytes that were already present on the receiver
+func (pt *progressTracker) skip(n int64) {
+	pt.resumed += n
+	pt.add(n)
+}
+
+// add records n more bytes, reporting if the interval has passed or the transfer is done
+func (pt *progressTracker) add(n int64) {
+	pt.done += n
+
+	// The end of each file of a batch is reported too
+	now := time.Now()
+	fileDone := pt.events != nil && pt.events.done(pt)
+	if (pt.total < 0 || pt.done < pt.total) && !fileDone && now.Sub(pt.lastReport) < progressInterval {
+		return
+	}
+	pt.lastReport = now
+
+	// Keep samples covering the rate window for the current speed
+	pt.samples = append(pt.samples, progressSample{at: now, done: pt.done})
+	for len(pt.samples) > 2 && now.Sub(pt.samples[1].at) > rateWindow {
+		pt.samples = pt.samples[1:]
+	}
+
+	if pt.report != nil {
+		pt.report(pt.done, pt.total)
+	}
+	if pt.reportAll == nil && pt.events == nil {
+		return
+	}
+	stats := pt.stats(now)
+	if pt.reportAll != nil {
+		pt.reportAll(stats)
+	}
+	if pt.events != nil {
+		pt.events.publish(EventProgress, pt.events.stats(stats, pt.total >= 0))
+		if fileDone || (pt.total >= 0 && pt.done >= pt.total) {
+			settleEvents()
+		}
+	}
+}
+
+// finish reports the end of a stream, whose total is only known now
+func (pt *progressTracker) finish() {
+	pt.total = pt.done
+	pt.add(0)
+}
+
+// stats computes the current and average speed and the time remaining
+func (pt *progressTracker) stats(now time.Time) TransferStats {
+	stats := TransferStats{
+		BytesDone: pt.done,
+		Total:     pt.total,
+		Peer:      pt.peer,
+		Elapsed:   now.Sub(pt.start),
+		Resumed:   pt.resumed,
+		WireBytes: pt.wire,
+	}
+
+	if seconds := stats.Elapsed.Seconds(); seconds > 0 {
+		stats.AverageRate = int64(float64(pt.done-pt.resumed) / seconds)
+	}
+
+	if len(pt.samples) > 1 {
+		first, last := pt.samples[0], pt.samples[len(pt.samples)-1]
+		if seconds := last.at.Sub(first.at).Seconds(); seconds > 0 {
+			stats.CurrentRate = int64(float64(last.done-first.done) / seconds)
+		}
+	}
+
+	rate := stats.CurrentRate
+	if rate == 0 {
+		rate = stats.AverageRate
+	}
+	if rate > 0 && pt.done < pt.total {
+		stats.ETA = time.Duration(float64(pt.total-pt.done) / float64(rate) * float64(time.Second))
+	}
+
+	return stats
+}
+
+// writer wraps w so that everything written through it is counted
+func (pt *progressTracker) writer(w io.Writer) io.Writer {
+	if pt.report == nil && pt.reportAll == nil && pt.events == nil {
+		return w
+	}
+	return &progressWriter{w: w, tracker: pt}
+}
+
+// wireWriter and wireReader wrap the connection to count the file bytes that
+// actually cross it, which differs from the file size when compressing
+func (pt *progressTracker) wireWriter(w io.Writer) io.Writer {
+	return &wireCounter{w: w, tracker: pt}
+}
+
+func (pt *progressTracker) wireReader(r io.Reader) io.Reader {
+	return &wireCounter{r: r, tracker: pt}
+}
+
+type wireCounter struct {
+	w       io.Writer
+	r       io.Reader
+	tracker *progressTracker
+}
+
+func (wc *wireCounter) Write(p []byte) (int, error) {
+	n, err := wc.w.Write(p)
+	wc.tracker.wire += int64(n)
+	return n, err
+}
+
+func (wc *wireCounter) Read(p []byte) (int, error) {
+	n, err := wc.r.Read(p)
+	wc.tracker.wire += int64(n)
+	return n, err
+}
+
+type progressWriter struct {
+	w       io.Writer
+	tracker *progressTracker
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	n, err := pw.w.Write(p)
+	pw.tracker.add(int64(n))
+	return n, err
+}
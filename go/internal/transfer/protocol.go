@@ -0,0 +1,327 @@
+package transfer
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"unicode"
+	"unicode/utf8"
+
+	"fileshare/internal/version"
+)
+
+// Wire format
+//
+// Every control message (batch header, file header, resume offer and
+// decision, transfer result, probe reply) travels in a frame:
+//
+//	offset  size  field
+//	0       2     magic, the bytes "BS" (0x42 0x53)
+//	2       4     payload length n, big-endian uint32, 1 <= n <= 65536
+//	6       n     payload, a UTF-8 JSON object
+//	6+n     4     CRC-32 (IEEE) of the payload, big-endian uint32
+//
+// A connection starts with a batch header frame, followed by the PIN
+// exchange described in auth.go if the header announces one. For each announced file the
+// sender writes a file header frame, the receiver answers with a resume offer
+// (or declines the file, in which case the next file header follows), the
+// sender answers with a resume decision and then writes the raw file bytes
+// from the decided offset, unframed. The receiver closes each file with a
+// transfer result frame. A receiver must reject a frame with a wrong magic,
+// an out of range length or a CRC mismatch and drop the connection, since the
+// stream can no longer be trusted.
+
+const (
+	// protocolName and ProtocolVersion identify the transfer protocol to probes
+	protocolName    = "bitshare"
+	ProtocolVersion = 2
+
+	// frameMagic starts every control message frame
+	frameMagic = "BS"
+
+	// maxFileNameLength matches the limit of common filesystems
+	maxFileNameLength = 255
+
+	// maxMessageSize bounds control messages so a bad peer can't make us allocate huge buffers
+	maxMessageSize = 64 * 1024
+
+	// resumeVerifySize is how much of the partial data is checksummed before resuming
+	resumeVerifySize = 1024 * 1024
+
+	// maxBatchFiles bounds how many files a sender may announce in one batch
+	maxBatchFiles = 10000
+)
+
+// Protocol features that peers running older releases may lack
+const (
+	FeatureFramedHeaders = "checksummed headers"
+	FeatureResume        = "resumable transfers"
+	FeatureBatch         = "multi-file transfers"
+	FeatureSwarm         = "swarm distribution"
+)
+
+// featureMinVersion is the first release supporting each feature
+var featureMinVersion = map[string]string{
+	FeatureFramedHeaders: "1.1.0",
+	FeatureResume:        "1.1.0",
+	FeatureBatch:         "1.1.0",
+	FeatureSwarm:         "1.1.0",
+}
+
+// FeatureMinVersion returns the first release that supports a feature
+func FeatureMinVersion(feature string) string {
+	return featureMinVersion[feature]
+}
+
+// MissingFeatures returns which of the given features a peer's release lacks
+func MissingFeatures(peerVersion string, features ...string) []string {
+	var missing []string
+	for _, feature := range features {
+		if min, known := featureMinVersion[feature]; known && !version.AtLeast(peerVersion, min) {
+			missing = append(missing, feature)
+		}
+	}
+	return missing
+}
+
+// batchHeader opens every connection and announces how many files follow.
+// A probe carries no files and only asks the receiver to identify itself.
+type batchHeader struct {
+	Count      int    `json:"count"`
+	Probe      bool   `json:"probe,omitempty"`
+	AppVersion string `json:"app_version,omitempty"` // BitShare release of the sender
+	Auth       bool   `json:"auth,omitempty"`        // The sender has a PIN and expects an authChallenge
+
+	// A probe can ask whether files would be accepted, see query.go
+	Query    []fileQuery `json:"query,omitempty"`
+	Features []string    `json:"features,omitempty"` // Capabilities the sender means to use
+}
+
+// fileHeader is sent by the sender before the file content
+type fileHeader struct {
+	Name        string `json:"name"`
+	Size        int64  `json:"size"`                  // streamSize for a stream, see stream.go
+	Checksum    string `json:"checksum"`              // Hex encoded SHA-256 of the whole file, empty for a stream
+	Compression string `json:"compression,omitempty"` // Compression the sender offers, see compress.go
+	ModTime     int64  `json:"mod_time,omitempty"`    // Modification time in Unix nanoseconds, see metadata.go
+	Mode        uint32 `json:"mode,omitempty"`        // Unix permission bits
+}
+
+// resumeOffer is the receiver's reply to a fileHeader, telling the sender
+// how much of the file it already holds in a .part file
+type resumeOffer struct {
+	Offset       int64  `json:"offset"`
+	TailChecksum string `json:"tail_checksum,omitempty"` // SHA-256 of the resumeVerifySize bytes before Offset
+	Declined     string `json:"declined,omitempty"`      // Set when the receiver refuses the file; no data or decision follows
+	TLSRequired  bool   `json:"tls_required,omitempty"`  // Set with Declined when a TLS receiver refuses a plain connection
+	AuthRequired bool   `json:"auth_required,omitempty"` // Set with Declined when a receiver refuses a sender without a PIN
+	Compression  string `json:"compression,omitempty"`   // Compression the receiver accepts from the offered one
+}
+
+// resumeDecision is the sender's answer to a resumeOffer. An offset of zero
+// means the receiver must discard its partial data and take the full file.
+type resumeDecision struct {
+	Offset int64 `json:"offset"`
+}
+
+// transferResult is sent by the receiver once the file content has been
+// written and verified, so the sender knows the file really landed
+type transferResult struct {
+	OK           bool   `json:"ok"`
+	Error        string `json:"error,omitempty"`
+	BytesWritten int64  `json:"bytes_written"`
+	Checksum     string `json:"checksum,omitempty"`
+	SavedAs      string `json:"saved_as,omitempty"` // Name the file was saved under, if it had to be renamed
+}
+
+// fileError reports the failure of a single file in a batch that leaves the
+// connection usable for the remaining files
+type fileError struct {
+	err error
+}
+
+func (e *fileError) Error() string {
+	return e.err.Error()
+}
+
+func (e *fileError) Unwrap() error {
+	return e.err
+}
+
+// errCorruptFrame is returned when a control message frame fails validation
+var errCorruptFrame = errors.New("corrupt control message")
+
+// writeMessage sends a control message as a frame (see Wire format above)
+func writeMessage(w io.Writer, msg interface{}) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if len(data) > maxMessageSize {
+		return fmt.Errorf("control message too large: %d bytes", len(data))
+	}
+
+	frame := make([]byte, 6+len(data)+4)
+	copy(frame, frameMagic)
+	binary.BigEndian.PutUint32(frame[2:], uint32(len(data)))
+	copy(frame[6:], data)
+	binary.BigEndian.PutUint32(frame[6+len(data):], crc32.ChecksumIEEE(data))
+
+	_, err = w.Write(frame)
+	return err
+}
+
+// readMessage reads a control message written by writeMessage
+func readMessage(r io.Reader, msg interface{}) error {
+	prefix := make([]byte, 6)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return err
+	}
+
+	if string(prefix[:2]) != frameMagic {
+		return fmt.Errorf("%w: bad magic", errCorruptFrame)
+	}
+
+	length := binary.BigEndian.Uint32(prefix[2:])
+	if length == 0 || length > maxMessageSize {
+		return fmt.Errorf("%w: invalid length %d", errCorruptFrame, length)
+	}
+
+	data := make([]byte, length+4)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+
+	payload := data[:length]
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(data[length:]) {
+		return fmt.Errorf("%w: checksum mismatch", errCorruptFrame)
+	}
+
+	// A receiver over its connection limits sends nothing but a busyReply
+	var busy busyReply
+	if json.Unmarshal(payload, &busy) == nil && busy.Busy != "" {
+		return fmt.Errorf("%w: %s", ErrReceiverBusy, busy.Busy)
+	}
+	return json.Unmarshal(payload, msg)
+}
+
+// validate rejects file headers a well-behaved sender would never produce
+func (h fileHeader) validate() error {
+	if err := validateFileName(h.Name); err != nil {
+		return err
+	}
+
+	// A stream's checksum comes in its trailer
+	if h.Size == streamSize {
+		if h.Checksum != "" {
+			return errors.New("stream metadata carries a checksum")
+		}
+		return nil
+	}
+	if !validChecksum(h.Checksum) {
+		return errors.New("file metadata is missing a valid checksum")
+	}
+
+	return nil
+}
+
+// validateFileName rejects names a well-behaved sender would never send
+func validateFileName(name string) error {
+	if name == "" || len(name) > maxFileNameLength {
+		return fmt.Errorf("invalid filename length: %d bytes", len(name))
+	}
+	if !utf8.ValidString(name) {
+		return errors.New("filename is not valid UTF-8")
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("filename contains control character %U", r)
+		}
+	}
+	return nil
+}
+
+// validChecksum reports whether s is a hex encoded SHA-256
+func validChecksum(s string) bool {
+	if len(s) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// tailChecksum returns the SHA-256 of the resumeVerifySize bytes (or fewer) preceding offset
+func tailChecksum(file *os.File, offset int64) (string, error) {
+	start := offset - resumeVerifySize
+	if start < 0 {
+		start = 0
+	}
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, io.NewSectionReader(file, start, offset-start)); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// negotiateResume decides which offset to resume from given the receiver's offer
+func negotiateResume(file *os.File, fileSize int64, offer resumeOffer) int64 {
+	if offer.Offset <= 0 || offer.Offset > fileSize {
+		return 0
+	}
+
+	checksum, err := tailChecksum(file, offer.Offset)
+	if err != nil || checksum != offer.TailChecksum {
+		fmt.Println("Partial data on the receiver does not match this file, sending the full file")
+		return 0
+	}
+
+	return offer.Offset
+}
+
+// tempPrefix starts the hidden names of files received without resume
+const tempPrefix = ".bitshare-tmp-"
+
+// partialPath returns where an incoming file is written until it is
+// complete. With resume that is a .part file found again by name, otherwise
+// a hidden name in the same directory that nobody mistakes for the file.
+func partialPath(outputPath string, resume bool) string {
+	if resume {
+		return outputPath + ".part"
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	return filepath.Join(filepath.Dir(outputPath), tempPrefix+hex.EncodeToString(id))
+}
+
+// openPartialFile opens (or creates) the .part file for an incoming transfer
+// and returns how many bytes of it can be offered for resuming
+func openPartialFile(partPath string, fileSize int64) (*os.File, int64, error) {
+	file, err := os.OpenFile(partPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+
+	offset := info.Size()
+	if offset > fileSize {
+		// Leftover from a different, larger file - start over
+		offset = 0
+	}
+
+	return file, offset, nil
+}
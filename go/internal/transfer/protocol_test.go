@@ -0,0 +1,115 @@
+package transfer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// frame builds a frame by hand, with the given magic, length and CRC
+func frame(magic string, length uint32, payload []byte, crc uint32) []byte {
+	var b bytes.Buffer
+	b.WriteString(magic)
+	binary.Write(&b, binary.BigEndian, length)
+	b.Write(payload)
+	binary.Write(&b, binary.BigEndian, crc)
+	return b.Bytes()
+}
+
+// validFrame frames payload as writeMessage does
+func validFrame(payload []byte) []byte {
+	return frame(frameMagic, uint32(len(payload)), payload, crc32.ChecksumIEEE(payload))
+}
+
+func TestReadMessage(t *testing.T) {
+	payload := []byte(`{"name":"a.txt","size":3,"checksum":"abc"}`)
+	tests := []struct {
+		name    string
+		data    []byte
+		corrupt bool // errCorruptFrame expected
+		fails   bool // Some other error expected
+	}{
+		{"valid", validFrame(payload), false, false},
+		{"bad magic", frame("XX", uint32(len(payload)), payload, crc32.ChecksumIEEE(payload)), true, false},
+		{"zero length", frame(frameMagic, 0, nil, 0), true, false},
+		{"length over the limit", frame(frameMagic, maxMessageSize+1, nil, 0), true, false},
+		{"checksum mismatch", frame(frameMagic, uint32(len(payload)), payload, crc32.ChecksumIEEE(payload)+1), true, false},
+		{"truncated prefix", validFrame(payload)[:4], false, true},
+		{"truncated payload", validFrame(payload)[:10], false, true},
+		{"not JSON", validFrame([]byte("not json")), false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var header fileHeader
+			err := readMessage(bytes.NewReader(test.data), &header)
+			switch {
+			case test.corrupt:
+				if !errors.Is(err, errCorruptFrame) {
+					t.Fatalf("got %v, want a corrupt frame", err)
+				}
+			case test.fails:
+				if err == nil || errors.Is(err, errCorruptFrame) {
+					t.Fatalf("got %v, want a read or decoding error", err)
+				}
+			default:
+				if err != nil {
+					t.Fatal(err)
+				}
+				if header.Name != "a.txt" || header.Size != 3 {
+					t.Errorf("decoded %+v", header)
+				}
+			}
+		})
+	}
+}
+
+func FuzzReadMessage(f *testing.F) {
+	payload := []byte(`{"name":"a.txt","size":3,"checksum":"abc"}`)
+	f.Add(validFrame(payload))
+	f.Add(frame("XX", uint32(len(payload)), payload, crc32.ChecksumIEEE(payload)))
+	f.Add(frame(frameMagic, 0, nil, 0))
+	f.Add(frame(frameMagic, maxMessageSize+1, payload, 0))
+	f.Add(frame(frameMagic, uint32(len(payload)), payload, 0))
+	f.Add(validFrame([]byte(`{"busy":"full"}`)))
+	f.Add(validFrame(payload)[:7])
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var header fileHeader
+		err := readMessage(bytes.NewReader(data), &header)
+		if err != nil {
+			return
+		}
+
+		// Only a well-formed frame is taken
+		if len(data) < 10 || string(data[:2]) != frameMagic {
+			t.Fatalf("took a frame with a bad magic: %x", data)
+		}
+		length := binary.BigEndian.Uint32(data[2:6])
+		if length == 0 || length > maxMessageSize || uint64(len(data)) < 10+uint64(length) {
+			t.Fatalf("took a frame with a bad length %d: %x", length, data)
+		}
+		if crc32.ChecksumIEEE(data[6:6+length]) != binary.BigEndian.Uint32(data[6+length:]) {
+			t.Fatalf("took a frame with a bad checksum: %x", data)
+		}
+
+		// What was read survives writing it again
+		var b bytes.Buffer
+		if err := writeMessage(&b, header); err != nil {
+			t.Fatal(err)
+		}
+		var again fileHeader
+		if err := readMessage(&b, &again); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(header, again) {
+			t.Fatalf("read %+v back as %+v", header, again)
+		}
+		if _, err := b.ReadByte(); err != io.EOF {
+			t.Fatal("readMessage left part of the frame unread")
+		}
+	})
+}
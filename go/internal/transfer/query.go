@@ -0,0 +1,276 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"fileshare/internal/version"
+)
+
+// Pre-transfer query
+//
+// Before connecting for real, a sender asks the receiver whether it will
+// take the files: a probe whose batch header lists each file's name and size
+// and the features the sender means to use. The receiver answers with its
+// usual probe reply plus a verdict per file (declined for being over the size
+// limit, not fitting on the disk or already existing under the skip or fail
+// policy) and the features it supports. Declined files are never sent.
+//
+// Unless ResendIdentical is set, the query carries each file's checksum,
+// and a receiver that already has a file of the same name, size and
+// checksum says so in the verdict: the sender skips the file as up to date.
+// The receiver only answers yes or no, never the checksums of its own files,
+// as whoever asks needn't be a sender it trusts. It remembers the checksums
+// by path, size and modification time, so asking again about an unchanged
+// file doesn't read it again; so does the sender, which sends the checksum
+// along with the file.
+//
+// Receivers that predate the query answer it as a plain probe, without
+// verdicts, and the sender goes ahead as before. Receivers that want a PIN
+// don't tell unauthenticated senders about their disk. Encrypted sends make
+// the query over TLS as well, to a receiver with the certificate the send
+// will check, so file names never travel in the clear.
+
+// Features a sender may use and a receiver may support
+const (
+	CapabilityCompression = "compression"
+	CapabilityResume      = "resume"
+	CapabilityStream      = "stream"
+)
+
+// ErrDeclined is returned when the receiver answered a query by declining every file
+var ErrDeclined = errors.New("receiver declined")
+
+const (
+	// queryTimeout bounds the whole query; a slow answer is no reason to delay the transfer
+	queryTimeout = 5 * time.Second
+
+	// queryHashRate is the slowest the receiver is expected to checksum the
+	// files it already has, which extends how long the sender waits
+	queryHashRate = 100 * 1024 * 1024
+
+	// checksumCacheSize bounds how many checksums of existing files a receiver remembers
+	checksumCacheSize = 256
+)
+
+// fileQuery asks whether one file would be accepted
+type fileQuery struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`               // streamSize when unknown
+	Checksum string `json:"checksum,omitempty"` // Of the sender's file, to ask whether the receiver has it
+}
+
+// fileVerdict is the receiver's answer to a fileQuery
+type fileVerdict struct {
+	Accept    bool   `json:"accept"`
+	Reason    string `json:"reason,omitempty"`    // Why the file would be declined
+	Identical bool   `json:"identical,omitempty"` // The receiver has the file with the queried name, size and checksum
+
+	// Checksum is the one queried, kept by the sender for the history
+	Checksum string `json:"-"`
+}
+
+// queryReceiver asks the receiver at address which items it would take,
+// returning a verdict for each. Any problem with the query itself means no
+// verdicts, so the transfer goes ahead and reports it. known is what is
+// remembered of the receiver's security, see security.go.
+func queryReceiver(address string, items []sendItem, options TransferOptions, known PeerSecurity) []fileVerdict {
+	// Checksummed before the query's time starts, and remembered for the send
+	checksums := make([]string, len(items))
+	if !options.ResendIdentical {
+		for i, item := range items {
+			if item.path == "" {
+				continue
+			}
+			if info, err := os.Stat(item.path); err == nil {
+				checksums[i], _ = cachedChecksum(item.path, info)
+			}
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(contextOrBackground(options.Context), queryTimeout)
+	defer cancel()
+	conn, err := options.dial(ctx, address)
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	defer closeOnCancel(options.Context, conn)()
+	conn.SetDeadline(time.Now().Add(queryTimeout))
+	if options.TLS {
+		tlsConn, fingerprint, err := handshakeTLS(ctx, conn, address)
+		if err != nil || (known.Fingerprint != "" && known.Fingerprint != fingerprint) {
+			// The send tells the user
+			return nil
+		}
+		conn = tlsConn
+	}
+
+	batch := batchHeader{Probe: true, AppVersion: version.Current, Features: []string{CapabilityResume}}
+	if options.CompressData {
+		batch.Features = append(batch.Features, CapabilityCompression)
+	}
+	for i, item := range items {
+		batch.Query = append(batch.Query, fileQuery{Name: item.name, Size: item.size, Checksum: checksums[i]})
+		if item.stream != nil && !contains(batch.Features, CapabilityStream) {
+			batch.Features = append(batch.Features, CapabilityStream)
+		}
+	}
+	if err := writeMessage(conn, batch); err != nil {
+		return nil
+	}
+
+	// The receiver may checksum files it already has before it answers
+	var size int64
+	for _, item := range items {
+		size += max(item.size, 0)
+	}
+	conn.SetDeadline(time.Now().Add(queryTimeout + time.Duration(size/queryHashRate)*time.Second))
+
+	var reply probeReply
+	if err := readMessage(conn, &reply); err != nil || reply.Protocol != protocolName || len(reply.Verdicts) != len(items) {
+		return nil
+	}
+
+	for _, feature := range batch.Features {
+		if !contains(reply.Capabilities, feature) {
+			fmt.Printf("The receiver does not support %s, sending without it\n", feature)
+		}
+	}
+
+	for i := range reply.Verdicts {
+		reply.Verdicts[i].Identical = reply.Verdicts[i].Identical && checksums[i] != ""
+		reply.Verdicts[i].Checksum = checksums[i]
+	}
+	return reply.Verdicts
+}
+
+// answerQuery tells a sender which of the queried files this receiver would take
+func answerQuery(conn net.Conn, batch batchHeader, destDir string, options TransferOptions) error {
+	fmt.Printf("🔎 %s asked whether %d file(s) can be received\n", conn.RemoteAddr(), len(batch.Query))
+
+	reply := probeReply{
+		Protocol:     protocolName,
+		Version:      ProtocolVersion,
+		AppVersion:   version.Current,
+		Capabilities: []string{CapabilityStream},
+		Verdicts:     make([]fileVerdict, len(batch.Query)),
+	}
+	if options.CompressData {
+		reply.Capabilities = append(reply.Capabilities, CapabilityCompression)
+	}
+	if options.Resume && options.output == nil {
+		reply.Capabilities = append(reply.Capabilities, CapabilityResume)
+	}
+
+	// Files going to the same directory have to fit on its disk together
+	needed := make(map[string]int64)
+	for i, query := range batch.Query {
+		reply.Verdicts[i] = checkIncoming(query, len(batch.Query), destDir, options, needed)
+	}
+	return writeMessage(conn, reply)
+}
+
+// checkIncoming returns the verdict on a queried file, adding its size to
+// what its directory needs if it would be accepted
+func checkIncoming(query fileQuery, count int, destDir string, options TransferOptions, needed map[string]int64) fileVerdict {
+	decline := func(reason string) fileVerdict {
+		return fileVerdict{Reason: reason}
+	}
+
+	name := filepath.Base(query.Name)
+	if err := validateFileName(name); err != nil {
+		return decline(err.Error())
+	}
+	if query.Size != streamSize {
+		if err := checkFileSize(query.Size, options.MaxFileSize); err != nil {
+			return decline(err.Error())
+		}
+	}
+	if options.output != nil {
+		if count != 1 {
+			return decline(fmt.Sprintf("this receiver writes to a pipe and takes a single file, not %d", count))
+		}
+		return fileVerdict{Accept: true}
+	}
+
+	// A copy the sender may not need to send, whatever the collision policy
+	dir, _ := routeFile(name, destDir, options.Routes)
+	path := filepath.Join(dir, name)
+	verdict := fileVerdict{Accept: true}
+	if info, err := os.Stat(path); err == nil {
+		if query.Checksum != "" && info.Mode().IsRegular() && info.Size() == query.Size {
+			checksum, err := cachedChecksum(path, info)
+			verdict.Identical = err == nil && checksum == query.Checksum
+		}
+		if options.CollisionPolicy == CollisionSkip || options.CollisionPolicy == CollisionFail {
+			verdict.Accept, verdict.Reason = false, "a file with that name already exists"
+			return verdict
+		}
+	}
+	if query.Size > 0 {
+		needed[dir] += query.Size
+		if err := checkDiskSpace(dir, needed[dir]); err != nil {
+			verdict.Accept, verdict.Reason = false, err.Error()
+		}
+	}
+	return verdict
+}
+
+// checksumKey identifies a version of a file; a change to it gives a new key
+type checksumKey struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+var checksumCache = struct {
+	sync.Mutex
+	checksums map[checksumKey]string
+	order     []checksumKey // Oldest first, for eviction
+}{checksums: make(map[checksumKey]string)}
+
+// cachedChecksum returns the checksum of the file at path, described by
+// info, reading the file only if it changed since it was last checksummed
+func cachedChecksum(path string, info os.FileInfo) (string, error) {
+	key := checksumKey{path: path, size: info.Size(), modTime: info.ModTime()}
+
+	checksumCache.Lock()
+	checksum, ok := checksumCache.checksums[key]
+	checksumCache.Unlock()
+	if ok {
+		return checksum, nil
+	}
+
+	checksum, err := FileChecksum(path)
+	if err != nil {
+		return "", err
+	}
+
+	checksumCache.Lock()
+	defer checksumCache.Unlock()
+	if _, ok := checksumCache.checksums[key]; !ok {
+		if len(checksumCache.order) >= checksumCacheSize {
+			delete(checksumCache.checksums, checksumCache.order[0])
+			checksumCache.order = checksumCache.order[1:]
+		}
+		checksumCache.checksums[key] = checksum
+		checksumCache.order = append(checksumCache.order, key)
+	}
+	return checksum, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+package transfer
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// TestQueryUpToDate sends a file of the same name and size as one the
+// receiver has, with and without TLS, and checks only an identical copy is
+// found up to date
+func TestQueryUpToDate(t *testing.T) {
+	isolateDataDir(t)
+	if _, _, err := LocalCertificate(); err != nil {
+		t.Fatal(err)
+	}
+	source, data := writeTestFile(t, t.TempDir(), "same.bin", 32*1024)
+	changed := append([]byte(nil), data...)
+	changed[0] ^= 0xff
+
+	tests := []struct {
+		name string
+		tls  bool
+		has  []byte // What the receiver has under the name
+		want string
+	}{
+		{"identical", false, data, ResultUpToDate},
+		{"identical over TLS", true, data, ResultUpToDate},
+		{"changed", false, changed, ResultOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			options := testOptions()
+			options.TLS = test.tls
+			address, dir := startLoopReceiver(t, options)
+			if err := os.WriteFile(filepath.Join(dir, "same.bin"), test.has, 0644); err != nil {
+				t.Fatal(err)
+			}
+			host, portText, _ := net.SplitHostPort(address)
+			port, _ := strconv.Atoi(portText)
+
+			if err := SendFilesWithOptions([]string{source}, host, port, options); err != nil {
+				t.Fatal(err)
+			}
+			history := GetHistory()
+			if len(history) == 0 || history[0].Result != test.want {
+				t.Errorf("history records the send as %+v, want %s", history[:min(len(history), 1)], test.want)
+			}
+		})
+	}
+}
+
+// TestAnswerQueryKeepsChecksums checks a receiver never tells whoever asks
+// the checksums of its files, only whether it has the one offered
+func TestAnswerQueryKeepsChecksums(t *testing.T) {
+	dir := t.TempDir()
+	path, _ := writeTestFile(t, dir, "private.bin", 4096)
+	checksum, err := FileChecksum(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		query     fileQuery
+		identical bool
+	}{
+		{"no checksum", fileQuery{Name: "private.bin", Size: 4096}, false},
+		{"other checksum", fileQuery{Name: "private.bin", Size: 4096, Checksum: "0123"}, false},
+		{"same checksum", fileQuery{Name: "private.bin", Size: 4096, Checksum: checksum}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			go func() {
+				defer server.Close()
+				answerQuery(server, batchHeader{Probe: true, Query: []fileQuery{test.query}}, dir, testOptions())
+			}()
+			var raw json.RawMessage
+			if err := readMessage(client, &raw); err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Contains(raw, []byte(checksum)) {
+				t.Errorf("answer carries the file's checksum: %s", raw)
+			}
+			var reply probeReply
+			if err := json.Unmarshal(raw, &reply); err != nil {
+				t.Fatal(err)
+			}
+			if len(reply.Verdicts) != 1 || reply.Verdicts[0].Identical != test.identical {
+				t.Errorf("got verdicts %+v, want identical %t", reply.Verdicts, test.identical)
+			}
+		})
+	}
+}
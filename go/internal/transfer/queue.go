@@ -0,0 +1,273 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Send queue
+//
+// Sends go through a queue so several of them don't fight over the link: at
+// most a few run at once and the rest wait with status queued, higher
+// priority first and otherwise in the order they were queued. A send frees
+// its slot however it ends, so a failure never holds up the ones behind it.
+// Queued sends can be moved or removed; removing a running one cancels it.
+
+// DefaultMaxActiveSends is how many queued sends run at once by default
+const DefaultMaxActiveSends = 2
+
+// Status of a queued send
+const (
+	QueueStatusQueued  = "queued"
+	QueueStatusRunning = "running"
+)
+
+// ErrRemovedFromQueue is returned by QueueTransfer for a send taken out of the queue
+var ErrRemovedFromQueue = errors.New("removed from the queue")
+
+// QueuedSend describes a send in the queue
+type QueuedSend struct {
+	ID       int
+	Name     string
+	Priority int // Higher runs first
+	Status   string
+	Queued   time.Time
+	Started  time.Time // Zero while queued
+}
+
+type queueEntry struct {
+	QueuedSend
+	ready   chan struct{} // Closed when the send may start or was removed
+	removed bool
+	cancel  context.CancelFunc
+}
+
+var sendQueue = struct {
+	mutex     sync.Mutex
+	waiting   []*queueEntry // In the order they will start
+	running   []*queueEntry
+	maxActive int
+	nextID    int
+}{maxActive: DefaultMaxActiveSends, nextID: 1}
+
+// QueueTransfer queues a send called name and runs it once a slot is free,
+// returning its error. ctx cancels the send whether it is waiting or running.
+func QueueTransfer(ctx context.Context, name string, priority int, send func(ctx context.Context) error) error {
+	ctx, cancel := context.WithCancel(contextOrBackground(ctx))
+	defer cancel()
+
+	entry := &queueEntry{
+		QueuedSend: QueuedSend{Name: name, Priority: priority, Status: QueueStatusQueued, Queued: time.Now()},
+		ready:      make(chan struct{}),
+		cancel:     cancel,
+	}
+	ahead := enqueue(entry)
+	if ahead > 0 {
+		fmt.Printf("⏳ %s is queued behind %d other transfer(s), see 'transfers'\n", name, ahead)
+	}
+
+	select {
+	case <-entry.ready:
+	case <-ctx.Done():
+	}
+
+	sendQueue.mutex.Lock()
+	switch {
+	case entry.removed:
+		sendQueue.mutex.Unlock()
+		return ErrRemovedFromQueue
+	case entry.Status == QueueStatusQueued:
+		// Cancelled while waiting
+		removeWaiting(entry)
+		sendQueue.mutex.Unlock()
+		return errCancelled
+	}
+	sendQueue.mutex.Unlock()
+	defer finish(entry)
+
+	if ctx.Err() != nil {
+		return errCancelled
+	}
+	err := send(ctx)
+
+	sendQueue.mutex.Lock()
+	defer sendQueue.mutex.Unlock()
+	if entry.removed {
+		return ErrRemovedFromQueue
+	}
+	return err
+}
+
+// enqueue adds entry behind those of the same or higher priority and starts
+// what can be started, returning how many sends are ahead of it
+func enqueue(entry *queueEntry) int {
+	sendQueue.mutex.Lock()
+	defer sendQueue.mutex.Unlock()
+
+	entry.ID = sendQueue.nextID
+	sendQueue.nextID++
+
+	position := len(sendQueue.waiting)
+	for i, other := range sendQueue.waiting {
+		if other.Priority < entry.Priority {
+			position = i
+			break
+		}
+	}
+	sendQueue.waiting = append(sendQueue.waiting, nil)
+	copy(sendQueue.waiting[position+1:], sendQueue.waiting[position:])
+	sendQueue.waiting[position] = entry
+
+	startWaiting()
+	if entry.Status == QueueStatusRunning {
+		return 0
+	}
+	return len(sendQueue.running) + position
+}
+
+// startWaiting starts waiting sends while slots are free. The caller must
+// hold the queue's mutex.
+func startWaiting() {
+	for len(sendQueue.running) < sendQueue.maxActive && len(sendQueue.waiting) > 0 {
+		entry := sendQueue.waiting[0]
+		sendQueue.waiting = sendQueue.waiting[1:]
+		entry.Status = QueueStatusRunning
+		entry.Started = time.Now()
+		sendQueue.running = append(sendQueue.running, entry)
+		close(entry.ready)
+	}
+}
+
+// finish frees the slot of a send that ended
+func finish(entry *queueEntry) {
+	sendQueue.mutex.Lock()
+	defer sendQueue.mutex.Unlock()
+
+	for i, other := range sendQueue.running {
+		if other == entry {
+			sendQueue.running = append(sendQueue.running[:i], sendQueue.running[i+1:]...)
+			break
+		}
+	}
+	startWaiting()
+}
+
+// removeWaiting takes entry out of the waiting list. The caller must hold
+// the queue's mutex.
+func removeWaiting(entry *queueEntry) bool {
+	for i, other := range sendQueue.waiting {
+		if other == entry {
+			sendQueue.waiting = append(sendQueue.waiting[:i], sendQueue.waiting[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// ListQueue returns the running sends, oldest first, followed by the
+// waiting ones in the order they will start
+func ListQueue() []QueuedSend {
+	sendQueue.mutex.Lock()
+	defer sendQueue.mutex.Unlock()
+
+	list := make([]QueuedSend, 0, len(sendQueue.running)+len(sendQueue.waiting))
+	for _, entry := range sendQueue.running {
+		list = append(list, entry.QueuedSend)
+	}
+	for _, entry := range sendQueue.waiting {
+		list = append(list, entry.QueuedSend)
+	}
+	return list
+}
+
+// ReorderQueue moves a waiting send to position (1 is next to start) among the
+// waiting sends, taking the priority of the send it lands next to so that
+// later sends queue around it as expected
+func ReorderQueue(id, position int) error {
+	sendQueue.mutex.Lock()
+	defer sendQueue.mutex.Unlock()
+
+	entry := findEntry(id)
+	if entry == nil {
+		return fmt.Errorf("no transfer with ID %d in the queue", id)
+	}
+	if entry.Status != QueueStatusQueued {
+		return fmt.Errorf("transfer %d is already running", id)
+	}
+	if position < 1 || position > len(sendQueue.waiting) {
+		return fmt.Errorf("position must be between 1 and %d", len(sendQueue.waiting))
+	}
+
+	removeWaiting(entry)
+	index := position - 1
+	sendQueue.waiting = append(sendQueue.waiting, nil)
+	copy(sendQueue.waiting[index+1:], sendQueue.waiting[index:])
+	sendQueue.waiting[index] = entry
+
+	if index+1 < len(sendQueue.waiting) {
+		entry.Priority = max(entry.Priority, sendQueue.waiting[index+1].Priority)
+	}
+	if index > 0 {
+		entry.Priority = min(entry.Priority, sendQueue.waiting[index-1].Priority)
+	}
+	return nil
+}
+
+// RemoveFromQueue takes a send out of the queue, cancelling it if it is running
+func RemoveFromQueue(id int) error {
+	sendQueue.mutex.Lock()
+	defer sendQueue.mutex.Unlock()
+
+	entry := findEntry(id)
+	if entry == nil {
+		return fmt.Errorf("no transfer with ID %d in the queue", id)
+	}
+	entry.removed = true
+	if entry.Status == QueueStatusRunning {
+		entry.cancel()
+		return nil
+	}
+	removeWaiting(entry)
+	close(entry.ready)
+	return nil
+}
+
+// SetMaxActiveSends sets how many sends run at once
+func SetMaxActiveSends(n int) error {
+	if n < 1 {
+		return fmt.Errorf("at least one transfer has to be able to run")
+	}
+	sendQueue.mutex.Lock()
+	defer sendQueue.mutex.Unlock()
+
+	sendQueue.maxActive = n
+	startWaiting()
+	return nil
+}
+
+// MaxActiveSends returns how many sends run at once
+func MaxActiveSends() int {
+	sendQueue.mutex.Lock()
+	defer sendQueue.mutex.Unlock()
+
+	return sendQueue.maxActive
+}
+
+// findEntry returns the running or waiting send with id. The caller must
+// hold the queue's mutex.
+func findEntry(id int) *queueEntry {
+	for _, entry := range sendQueue.running {
+		if entry.ID == id {
+			return entry
+		}
+	}
+	for _, entry := range sendQueue.waiting {
+		if entry.ID == id {
+			return entry
+		}
+	}
+	return nil
+}
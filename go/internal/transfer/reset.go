@@ -0,0 +1,48 @@
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// resetRetries and resetRetryDelay give a receiver time to answer a firewall prompt
+	resetRetries = 3
+
+	// firstConnectionWindow is how long a receiver waits for a connection before giving advice
+	firstConnectionWindow = 30 * time.Second
+)
+
+// resetRetryDelay is a variable so tests don't wait for a person
+var resetRetryDelay = 5 * time.Second
+
+// isConnectionReset reports whether err is a connection reset by the remote side.
+// Errors are often wrapped as text, so the message is checked as well.
+func isConnectionReset(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "connection reset") ||
+		strings.Contains(msg, "forcibly closed by the remote host")
+}
+
+// printNoConnectionAdvice explains the usual reasons a receiver sees no connections
+func printNoConnectionAdvice(port int) {
+	fmt.Printf("⏳ No connection has arrived on port %d in %s.\n", port, firstConnectionWindow)
+	if runtime.GOOS == "windows" {
+		fmt.Println("   Windows may be showing a firewall prompt for BitShare - click 'Allow access'")
+		fmt.Println("   (check behind other windows). The sender will retry if its connection was reset.")
+	} else {
+		fmt.Printf("   Check that a firewall allows incoming TCP connections on port %d.\n", port)
+	}
+	fmt.Printf("   From the sending machine, run: bitshare probe <this-ip> %d\n", port)
+}
@@ -0,0 +1,138 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// isolateDataDir keeps the history and peer profiles a test writes out of the user's
+func isolateDataDir(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	t.Setenv("HOME", dir)
+	t.Setenv("AppData", dir)
+}
+
+// resetConn is a connection the receiver resets as soon as it is read from
+type resetConn struct {
+	net.Conn
+	err error
+}
+
+func (c resetConn) Read([]byte) (int, error)    { return 0, c.err }
+func (c resetConn) Write(b []byte) (int, error) { return len(b), nil }
+
+// econnreset is how a reset surfaces on Linux and macOS
+var econnreset = &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+
+func TestIsConnectionReset(t *testing.T) {
+	tests := []struct {
+		name  string
+		err   error
+		reset bool
+	}{
+		{"nil", nil, false},
+		{"ECONNRESET", econnreset, true},
+		{"wrapped", fmt.Errorf("failed to read reply: %w", econnreset), true},
+		{"flattened to text", fmt.Errorf("failed to read reply: %v", econnreset), true},
+		{"windows", errors.New("wsarecv: An existing connection was forcibly closed by the remote host."), true},
+		{"refused", &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, false},
+		{"timeout", errors.New("i/o timeout"), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isConnectionReset(test.err); got != test.reset {
+				t.Errorf("isConnectionReset(%v) = %t, want %t", test.err, got, test.reset)
+			}
+		})
+	}
+}
+
+// TestSendResetRetries has the first connections of a send reset, as Windows
+// does while its firewall prompt is open, then lets them reach a receiver
+func TestSendResetRetries(t *testing.T) {
+	isolateDataDir(t)
+	defer func(delay time.Duration) { resetRetryDelay = delay }(resetRetryDelay)
+	resetRetryDelay = 10 * time.Millisecond
+	source, data := writeTestFile(t, t.TempDir(), "prompt.bin", 64*1024)
+
+	windows := errors.New("wsarecv: An existing connection was forcibly closed by the remote host.")
+	refused := errors.New("connectex: No connection could be made because the target machine actively refused it.")
+	tests := []struct {
+		name      string
+		resets    int   // Connections that fail before reaching the receiver
+		failure   error // How they fail
+		dials     int
+		delivered bool
+	}{
+		{"no reset", 0, econnreset, 1, true},
+		{"one reset", 1, econnreset, 2, true},
+		{"reset on windows", 1, windows, 2, true},
+		{"reset until the last retry", resetRetries, econnreset, resetRetries + 1, true},
+		{"reset after the last retry", resetRetries + 1, econnreset, resetRetries + 1, false},
+		{"not a reset", 1, refused, 1, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			address, dir := freeAddress(t), t.TempDir()
+			_, portText, _ := net.SplitHostPort(address)
+			port, _ := strconv.Atoi(portText)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			receiverOptions := testOptions()
+			receiverOptions.Context = ctx
+			received := make(chan error, 1)
+			go func() { received <- ReceiveFileWithOptions(port, 10*time.Second, dir, receiverOptions) }()
+			time.Sleep(50 * time.Millisecond)
+
+			dials := 0
+			options := testOptions()
+			options.SkipQuery = true
+			options.Dial = func(ctx context.Context, address string) (net.Conn, error) {
+				dials++
+				if dials <= test.resets {
+					local, remote := net.Pipe()
+					remote.Close()
+					return resetConn{local, test.failure}, nil
+				}
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "tcp", address)
+			}
+
+			err := SendFilesWithOptions([]string{source}, "127.0.0.1", port, options)
+			if dials != test.dials {
+				t.Errorf("dialled %d times, want %d", dials, test.dials)
+			}
+			if !test.delivered {
+				if err == nil {
+					t.Fatal("send succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := <-received; err != nil {
+				t.Fatal(err)
+			}
+			got, err := os.ReadFile(filepath.Join(dir, "prompt.bin"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Error("received file differs from the one sent")
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package transfer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"fileshare/internal/utils"
+)
+
+// Receive routes send incoming files to different directories by type, e.g.
+// videos to a large disk and documents to the SSD. They are kept in
+// routes.json in the data directory as an ordered list; the first matching
+// rule wins. A pattern is either a filename glob ("*.mkv") or a MIME type
+// guessed from the extension ("video/*", "application/pdf"). The special
+// pattern "default" names the directory for files no rule matches.
+
+// RouteDefault is the pattern of the fallback route
+const RouteDefault = "default"
+
+const routesFile = "routes.json"
+
+// RouteRule sends files matching Pattern to Dir
+type RouteRule struct {
+	Pattern string `json:"pattern"`
+	Dir     string `json:"dir"`
+}
+
+// LoadRoutes reads the receive routes from the data directory. No file means no routes.
+func LoadRoutes() ([]RouteRule, error) {
+	path, err := routesPath()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []RouteRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", path, err)
+	}
+	for i := range rules {
+		rules[i].Dir = expandHome(rules[i].Dir)
+	}
+	return rules, nil
+}
+
+// SaveRoutes writes the receive routes to the data directory
+func SaveRoutes(rules []RouteRule) error {
+	path, err := routesPath()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(rules, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// ValidateRoutes checks every rule has a valid pattern and a writable directory
+func ValidateRoutes(rules []RouteRule) error {
+	var problems []string
+	for _, rule := range rules {
+		if rule.Pattern != RouteDefault && !strings.Contains(rule.Pattern, "/") {
+			if _, err := filepath.Match(rule.Pattern, ""); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: invalid pattern", rule.Pattern))
+				continue
+			}
+		}
+		if err := checkWritableDir(rule.Dir); err != nil {
+			problems = append(problems, fmt.Sprintf("%s -> %s: %v", rule.Pattern, rule.Dir, err))
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid receive routes:\n  " + strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// DefaultRoute returns the directory of the "default" rule, if there is one
+func DefaultRoute(rules []RouteRule) (string, bool) {
+	for _, rule := range rules {
+		if rule.Pattern == RouteDefault {
+			return rule.Dir, true
+		}
+	}
+	return "", false
+}
+
+// routeFile picks the destination directory for a sanitized filename and
+// returns the pattern that chose it, or "" when destDir is used
+func routeFile(filename, destDir string, rules []RouteRule) (string, string) {
+	name := strings.ToLower(filename)
+	mimeType := mime.TypeByExtension(strings.ToLower(filepath.Ext(filename)))
+	if i := strings.Index(mimeType, ";"); i >= 0 {
+		mimeType = mimeType[:i]
+	}
+
+	for _, rule := range rules {
+		if rule.Pattern == RouteDefault {
+			continue
+		}
+		if strings.Contains(rule.Pattern, "/") {
+			if mimeType != "" && matchMIME(strings.ToLower(rule.Pattern), mimeType) {
+				return rule.Dir, rule.Pattern
+			}
+			continue
+		}
+		if matched, _ := filepath.Match(strings.ToLower(rule.Pattern), name); matched {
+			return rule.Dir, rule.Pattern
+		}
+	}
+
+	return destDir, ""
+}
+
+// matchMIME matches a MIME type against "type/subtype" or "type/*"
+func matchMIME(pattern, mimeType string) bool {
+	if strings.HasSuffix(pattern, "/*") {
+		return strings.HasPrefix(mimeType, strings.TrimSuffix(pattern, "*"))
+	}
+	return pattern == mimeType
+}
+
+// checkWritableDir verifies a directory exists and files can be created in it
+func checkWritableDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return errors.New("directory does not exist")
+	}
+	if !info.IsDir() {
+		return errors.New("not a directory")
+	}
+
+	probe, err := os.CreateTemp(dir, ".bitshare-write-test-*")
+	if err != nil {
+		return errors.New("directory is not writable")
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+	return nil
+}
+
+func expandHome(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") || strings.HasPrefix(path, `~\`) {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, path[1:])
+		}
+	}
+	return path
+}
+
+func routesPath() (string, error) {
+	dir, err := utils.DataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, routesFile), nil
+}
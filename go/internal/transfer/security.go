@@ -0,0 +1,127 @@
+package transfer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"fileshare/internal/utils"
+)
+
+// Downgrade protection
+//
+// After every successful send the receiver's security profile is remembered:
+// whether it used TLS, its certificate fingerprint and whether it asked for
+// a PIN. A later send to the same address keeps at least that level. It
+// switches to TLS on its own, and refuses to continue if the receiver no
+// longer completes a TLS handshake, presents a different certificate or
+// stops asking for the PIN - all things a middlebox stripping security would
+// cause. TransferOptions.AllowDowngrade skips the checks and records the new,
+// weaker profile.
+//
+// There are no long-term identity keys to sign a handshake transcript with.
+// Inside TLS every control message, including the PIN exchange, is covered
+// by the session's integrity protection, and the pinned fingerprint is what
+// ties that session to the receiver seen before.
+
+// peerSecurityFile holds the remembered profiles in DataDir
+const peerSecurityFile = "peer_security.json"
+
+// PeerSecurity is what a sender remembers about a receiver's security
+type PeerSecurity struct {
+	TLS         bool      `json:"tls"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	PIN         bool      `json:"pin"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+// ErrDowngrade is wrapped by errors refusing a transfer whose security is weaker than before
+var ErrDowngrade = errors.New("possible downgrade attack - refusing; use --allow-downgrade to override")
+
+var peerSecurityMutex sync.Mutex
+
+func peerSecurityPath() (string, error) {
+	dir, err := utils.DataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, peerSecurityFile), nil
+}
+
+// loadPeerSecurity reads every remembered profile, keyed by host:port
+func loadPeerSecurity() map[string]PeerSecurity {
+	profiles := make(map[string]PeerSecurity)
+
+	path, err := peerSecurityPath()
+	if err != nil {
+		return profiles
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return profiles
+	}
+	json.Unmarshal(data, &profiles)
+	return profiles
+}
+
+// LookupPeerSecurity returns the remembered profile of the receiver at address
+func LookupPeerSecurity(address string) (PeerSecurity, bool) {
+	peerSecurityMutex.Lock()
+	defer peerSecurityMutex.Unlock()
+
+	profile, known := loadPeerSecurity()[address]
+	return profile, known
+}
+
+// rememberPeerSecurity stores the profile observed during a successful send
+func rememberPeerSecurity(address string, profile PeerSecurity) error {
+	peerSecurityMutex.Lock()
+	defer peerSecurityMutex.Unlock()
+
+	path, err := peerSecurityPath()
+	if err != nil {
+		return err
+	}
+
+	profiles := loadPeerSecurity()
+	profile.LastSeen = time.Now()
+	profiles[address] = profile
+
+	data, err := json.MarshalIndent(profiles, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// checkTLSDowngrade explains a failed TLS handshake with a receiver that used TLS before
+func checkTLSDowngrade(address string, known PeerSecurity, err error) error {
+	if !known.TLS {
+		return err
+	}
+	return fmt.Errorf("%v\n%s accepted encrypted connections before: %w", err, address, ErrDowngrade)
+}
+
+// checkFingerprint refuses a receiver whose certificate differs from the pinned one
+func checkFingerprint(address string, known PeerSecurity, fingerprint string) error {
+	if known.Fingerprint == "" || known.Fingerprint == fingerprint {
+		return nil
+	}
+	fmt.Printf("⚠️  The certificate of %s has CHANGED\n", address)
+	fmt.Printf("   Previously: %s\n", known.Fingerprint)
+	fmt.Printf("   Now:        %s\n", fingerprint)
+	return fmt.Errorf("the receiver's certificate changed, someone may be intercepting the connection. "+
+		"If the receiver was reinstalled, confirm the new fingerprint with its owner.\n%w", ErrDowngrade)
+}
+
+// checkPINDowngrade refuses a receiver that asked for a PIN before but no longer does
+func checkPINDowngrade(address string, known PeerSecurity, required bool) error {
+	if !known.PIN || required {
+		return nil
+	}
+	return fmt.Errorf("%s required a PIN before but no longer asks for one.\n%w", address, ErrDowngrade)
+}
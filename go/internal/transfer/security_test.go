@@ -0,0 +1,198 @@
+package transfer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// middlebox sits between a sender and a receiver. It either passes the bytes
+// through untouched or, with a certificate, terminates the sender's TLS
+// itself and talks plaintext to the receiver behind it.
+type middlebox struct {
+	listener net.Listener
+
+	mutex  sync.Mutex
+	target string
+	cert   *tls.Certificate
+}
+
+func startMiddlebox(t *testing.T) *middlebox {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	box := &middlebox{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go box.relay(conn)
+		}
+	}()
+	return box
+}
+
+// route sends later connections to target, intercepting TLS with cert if it is set
+func (box *middlebox) route(target string, cert *tls.Certificate) {
+	box.mutex.Lock()
+	defer box.mutex.Unlock()
+	box.target, box.cert = target, cert
+}
+
+func (box *middlebox) relay(conn net.Conn) {
+	defer conn.Close()
+	box.mutex.Lock()
+	target, cert := box.target, box.cert
+	box.mutex.Unlock()
+
+	if cert != nil {
+		conn = tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{*cert}})
+	}
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		return
+	}
+	defer upstream.Close()
+
+	go io.Copy(upstream, conn)
+	io.Copy(conn, upstream)
+}
+
+func (box *middlebox) port() int {
+	return box.listener.Addr().(*net.TCPAddr).Port
+}
+
+// startLoopReceiver runs a receiver until the test ends, returning its address and folder
+func startLoopReceiver(t *testing.T, options TransferOptions) (string, string) {
+	t.Helper()
+	address, dir := freeAddress(t), t.TempDir()
+	_, portText, _ := net.SplitHostPort(address)
+	port, _ := strconv.Atoi(portText)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	options.Context = ctx
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ReceiveLoop(port, dir, options)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-stopped
+	})
+	time.Sleep(50 * time.Millisecond)
+	return address, dir
+}
+
+// otherCertificate is a certificate that isn't the receivers'
+func otherCertificate(t *testing.T) *tls.Certificate {
+	t.Helper()
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := createCertificate(certPath, keyPath); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &cert
+}
+
+// TestStrippingMiddlebox sends through a middlebox once with TLS and a PIN,
+// then has it weaken the connection and checks the sender refuses to go on
+func TestStrippingMiddlebox(t *testing.T) {
+	isolateDataDir(t)
+	if _, _, err := LocalCertificate(); err != nil {
+		t.Fatal(err)
+	}
+	source, _ := writeTestFile(t, t.TempDir(), "secret.txt", 4096)
+	const pin = "4821"
+
+	secure := testOptions()
+	secure.TLS, secure.PIN = true, pin
+	secureAddress, _ := startLoopReceiver(t, secure)
+	plainAddress, plainDir := startLoopReceiver(t, testOptions())
+	noPIN := testOptions()
+	noPIN.TLS = true
+	noPINAddress, noPINDir := startLoopReceiver(t, noPIN)
+
+	box := startMiddlebox(t)
+	boxAddress := net.JoinHostPort("127.0.0.1", strconv.Itoa(box.port()))
+
+	tests := []struct {
+		name      string
+		target    string
+		cert      *tls.Certificate
+		allow     bool // AllowDowngrade
+		downgrade bool
+		dir       string // Where a refused file must not turn up
+		want      PeerSecurity
+	}{
+		{"unchanged", secureAddress, nil, false, false, "", PeerSecurity{TLS: true, PIN: true}},
+		{"strips TLS", plainAddress, nil, false, true, plainDir, PeerSecurity{}},
+		{"replaces the certificate", plainAddress, otherCertificate(t), false, true, plainDir, PeerSecurity{}},
+		{"drops the PIN", noPINAddress, nil, false, true, noPINDir, PeerSecurity{}},
+		{"strips TLS with downgrades allowed", plainAddress, nil, true, false, "", PeerSecurity{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path, err := peerSecurityPath()
+			if err != nil {
+				t.Fatal(err)
+			}
+			os.Remove(path)
+
+			// Learn the receiver's profile through an honest middlebox
+			box.route(secureAddress, nil)
+			first := testOptions()
+			first.SkipQuery, first.TLS, first.PIN = true, true, pin
+			if err := SendFilesWithOptions([]string{source}, "127.0.0.1", box.port(), first); err != nil {
+				t.Fatal(err)
+			}
+			learned, _ := LookupPeerSecurity(boxAddress)
+
+			// The next send doesn't ask for TLS, the remembered profile should
+			box.route(test.target, test.cert)
+			options := testOptions()
+			options.SkipQuery, options.PIN, options.AllowDowngrade = true, pin, test.allow
+			err = SendFilesWithOptions([]string{source}, "127.0.0.1", box.port(), options)
+			if test.downgrade {
+				if !errors.Is(err, ErrDowngrade) {
+					t.Fatalf("got %v, want %v", err, ErrDowngrade)
+				}
+				if _, err := os.Stat(filepath.Join(test.dir, "secret.txt")); err == nil {
+					t.Error("file was delivered despite the downgrade")
+				}
+				if profile, _ := LookupPeerSecurity(boxAddress); profile != learned {
+					t.Errorf("profile changed to %+v after a refused send", profile)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			profile, _ := LookupPeerSecurity(boxAddress)
+			if profile.TLS != test.want.TLS || profile.PIN != test.want.PIN {
+				t.Errorf("remembered %+v, want TLS %t and PIN %t", profile, test.want.TLS, test.want.PIN)
+			}
+			if test.want.TLS && profile.Fingerprint != learned.Fingerprint {
+				t.Errorf("fingerprint changed from %s to %s", learned.Fingerprint, profile.Fingerprint)
+			}
+		})
+	}
+}
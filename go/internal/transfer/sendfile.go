@@ -0,0 +1,56 @@
+package transfer
+
+import (
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+// Zero-copy sends
+//
+// Where the platform supports it, net.TCPConn.ReadFrom hands a file to the
+// kernel with sendfile, so its bytes go from the page cache to the socket
+// without being copied through this process. Any wrapper around the
+// connection, such as the byte counters used for progress, defeats that, so
+// an uncompressed file on a plain TCP connection is sent in pieces straight
+// to the socket instead, with progress and the idle deadline updated between
+// pieces. TLS connections and compressed files use the buffered copy.
+
+// sendfilePiece is how much is handed to the kernel between progress updates
+const sendfilePiece = 8 * 1024 * 1024
+
+// directConn returns the TCP connection under conn and its idle timeout
+// when nothing but the idle timeout sits in between
+func directConn(conn net.Conn) (*net.TCPConn, time.Duration, bool) {
+	if !zeroCopySupported {
+		return nil, 0, false
+	}
+	var idle time.Duration
+	if c, ok := conn.(*idleConn); ok {
+		conn, idle = c.Conn, c.idle
+	}
+	tcp, ok := conn.(*net.TCPConn)
+	return tcp, idle, ok
+}
+
+// sendFileDirect sends n bytes of file from its current offset to conn
+func sendFileDirect(conn *net.TCPConn, idle time.Duration, file *os.File, n int64, progress *progressTracker) error {
+	for sent := int64(0); sent < n; {
+		if idle > 0 {
+			conn.SetWriteDeadline(time.Now().Add(idle))
+		}
+		piece, err := conn.ReadFrom(io.LimitReader(file, min(sendfilePiece, n-sent)))
+		sent += piece
+		progress.wire += piece
+		progress.add(piece)
+		if err != nil {
+			return err
+		}
+		if piece == 0 {
+			// The file got shorter since it was opened
+			return io.ErrUnexpectedEOF
+		}
+	}
+	return nil
+}
@@ -0,0 +1,4 @@
+package transfer
+
+// zeroCopySupported is set where net.TCPConn.ReadFrom uses sendfile for files
+const zeroCopySupported = true
@@ -0,0 +1,6 @@
+//go:build !linux
+
+package transfer
+
+// zeroCopySupported is only set on Linux, elsewhere files go through the copy buffer
+const zeroCopySupported = false
@@ -0,0 +1,30 @@
+package transfer
+
+import (
+	"io"
+	"testing"
+)
+
+// BenchmarkSendFileDirect sends a file over loopback the way uncompressed
+// files go on plain connections, with sendfile where it is supported
+func BenchmarkSendFileDirect(b *testing.B) {
+	file := benchmarkFile(b)
+	conn, wait := loopbackSink(b)
+	defer wait()
+	tcp, idle, ok := directConn(conn)
+	if !ok {
+		b.Skip("no zero-copy sends on this platform")
+	}
+
+	b.SetBytes(benchmarkFileSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			b.Fatal(err)
+		}
+		progress := newProgressTracker(benchmarkFileSize, TransferOptions{})
+		if err := sendFileDirect(tcp, idle, file, benchmarkFileSize, progress); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package transfer
+
+// Transfer states reported through TransferOptions.StateFunc
+const (
+	StateListening  = "listening"
+	StateConnected  = "connected"
+	StateSending    = "sending"
+	StateReceiving  = "receiving"
+	StateFileDone   = "file_done"
+	StateFileFailed = "file_failed"
+)
+
+// TransferState describes a state transition of a sender or receiver
+type TransferState struct {
+	State string
+	File  string // File the state applies to, if any
+	Peer  string // Remote address, once connected
+	Error string // Why a file failed
+}
+
+// IncomingFile is a file a sender offers, passed to TransferOptions.AcceptFunc
+type IncomingFile struct {
+	Name string
+	Size int64
+	Peer string
+}
+
+// notify reports a state transition if the caller asked for them
+func (o TransferOptions) notify(state, file, peer string, err error) {
+	if o.StateFunc == nil {
+		return
+	}
+
+	event := TransferState{State: state, File: file, Peer: peer}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	o.StateFunc(event)
+}
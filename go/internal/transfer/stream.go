@@ -0,0 +1,198 @@
+package transfer
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Streams
+//
+// Data of unknown length, such as a pipe into stdin, is sent with Size set
+// to streamSize and no checksum in the file header. After the resume
+// decision the data follows in chunks, each a 4-byte big-endian length and
+// that many bytes, ended by a chunk of length zero. A streamTrailer with the
+// total size and the checksum, computed as the bytes went out, comes last.
+// With compression the chunks carry one gzip member. Streams always start
+// from the beginning, there is nothing to resume from.
+
+const (
+	// streamSize in a file header announces a stream
+	streamSize = -1
+
+	// maxStreamChunk is the largest chunk a receiver accepts
+	maxStreamChunk = 1 << 20
+
+	// streamBufferSize is how much a sender collects before writing a chunk
+	streamBufferSize = 64 * 1024
+)
+
+// streamTrailer follows the last chunk of a stream
+type streamTrailer struct {
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum"` // Hex encoded SHA-256 of the uncompressed data
+}
+
+// chunkWriter frames everything written to it as stream chunks
+type chunkWriter struct {
+	w      io.Writer
+	header [4]byte
+}
+
+func (cw *chunkWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > maxStreamChunk {
+			chunk = chunk[:maxStreamChunk]
+		}
+		binary.BigEndian.PutUint32(cw.header[:], uint32(len(chunk)))
+		if _, err := cw.w.Write(cw.header[:]); err != nil {
+			return written, err
+		}
+		n, err := cw.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// end writes the zero-length chunk that ends the stream
+func (cw *chunkWriter) end() error {
+	binary.BigEndian.PutUint32(cw.header[:], 0)
+	_, err := cw.w.Write(cw.header[:])
+	return err
+}
+
+// chunkReader reads the data of stream chunks, returning io.EOF at the end
+// marker. It never reads past the marker, so messages can follow.
+type chunkReader struct {
+	r         io.Reader
+	remaining uint32
+	done      bool
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	if cr.done {
+		return 0, io.EOF
+	}
+	if cr.remaining == 0 {
+		var header [4]byte
+		if _, err := io.ReadFull(cr.r, header[:]); err != nil {
+			return 0, unexpectedEOF(err)
+		}
+		cr.remaining = binary.BigEndian.Uint32(header[:])
+		if cr.remaining == 0 {
+			cr.done = true
+			return 0, io.EOF
+		}
+		if cr.remaining > maxStreamChunk {
+			return 0, fmt.Errorf("stream chunk of %d bytes is larger than %d", cr.remaining, maxStreamChunk)
+		}
+	}
+
+	if uint32(len(p)) > cr.remaining {
+		p = p[:cr.remaining]
+	}
+	n, err := cr.r.Read(p)
+	cr.remaining -= uint32(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// sendStreamData copies src to w as chunks, compressed if asked, and
+// returns how many bytes of src were sent
+func sendStreamData(w io.Writer, src io.Reader, compress bool, progress *progressTracker) (int64, error) {
+	chunks := &chunkWriter{w: w}
+	buffered := bufio.NewWriterSize(chunks, streamBufferSize)
+
+	var dst io.Writer = buffered
+	var gz *gzip.Writer
+	if compress {
+		var err error
+		if gz, err = gzip.NewWriterLevel(buffered, gzip.BestSpeed); err != nil {
+			return 0, err
+		}
+		dst = gz
+	}
+
+	n, err := io.Copy(progress.writer(dst), src)
+	if err != nil {
+		return n, err
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return n, err
+		}
+	}
+	if err := buffered.Flush(); err != nil {
+		return n, err
+	}
+	return n, chunks.end()
+}
+
+// receiveStreamData reads a stream's chunks from r into dst, refusing to
+// take more than limit bytes when limit is set
+func receiveStreamData(dst io.Writer, r io.Reader, compressed bool, limit int64) (int64, error) {
+	chunks := &chunkReader{r: r}
+
+	var src io.Reader = chunks
+	if compressed {
+		gz, err := gzip.NewReader(chunks)
+		if err != nil {
+			return 0, err
+		}
+		gz.Multistream(false)
+		src = gz
+	}
+
+	var n int64
+	var err error
+	if limit > 0 {
+		n, err = io.CopyN(dst, src, limit+1)
+		if err == io.EOF {
+			err = nil
+		} else if err == nil {
+			return n, checkFileSize(n, limit)
+		}
+	} else {
+		n, err = io.Copy(dst, src)
+	}
+	if err != nil {
+		return n, err
+	}
+
+	// Consume the end marker, which follows the gzip trailer
+	if _, err := io.Copy(io.Discard, chunks); err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+// readStreamTrailer reads the trailer after a stream's data, checks it
+// against the bytes received and puts the size and checksum in the header
+func readStreamTrailer(r io.Reader, header *fileHeader, received int64) error {
+	var trailer streamTrailer
+	if err := readMessage(r, &trailer); err != nil {
+		return fmt.Errorf("failed to read end of stream: %v", err)
+	}
+	if trailer.Size != received {
+		return fmt.Errorf("incomplete stream: received %d bytes, sender sent %d bytes", received, trailer.Size)
+	}
+	header.Size, header.Checksum = trailer.Size, trailer.Checksum
+	return nil
+}
@@ -0,0 +1,688 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Swarm distribution
+//
+// SendFileSwarm sends one file to several receivers at once, so that they
+// pass chunks on to each other instead of all taking them from the source.
+// The source coordinates: it describes the file to every receiver as for
+// SendFileChunked, marked as a swarm, and asks each with a chunkIndexAdvert
+// header which chunks it holds, which the receiver answers with a
+// SwarmAdvert. Workers for each receiver then take assignments from the
+// Swarm. A chunk no other receiver holds is sent by the source as usual;
+// one that another receiver holds is handed out as a chunkHeader naming
+// that receiver in From and carrying no data, and the receiver fetches the
+// chunk from it with a Fetch header, checks it against the manifest as any
+// chunk and acknowledges it to the source. A fetch that fails is given to
+// the source again. Receivers keep serving each other until every one holds
+// the whole file; only then does the source ask each for missing chunks, as
+// SendFileChunked does, which ends their transfers.
+//
+// Receivers serve chunks only for a file described as a swarm, and reach
+// each other at the addresses the source knows them by, so swarms suit
+// receivers on the same network.
+
+// swarmOrigin is the member ID of the source in the swarms SendFileSwarm runs
+const swarmOrigin = "source"
+
+// swarmWait is how long a worker waits when every chunk its receiver lacks
+// is already on its way
+const swarmWait = 50 * time.Millisecond
+
+// SwarmAdvert is what a receiver in a swarm tells the source about which
+// chunks it already holds, see above
+type SwarmAdvert struct {
+	FileID string `json:"file_id"`
+	NodeID string `json:"node_id"`
+	Chunks []int  `json:"chunks"`
+}
+
+// ChunkAssignment tells a receiver which chunk to fetch next and from whom
+type ChunkAssignment struct {
+	ChunkIndex int
+	SourceID   string // The origin or a sibling receiver that holds the chunk
+}
+
+// Swarm coordinates distribution of one file to several receivers. The origin
+// holds every chunk; receivers that have verified a chunk can serve it to
+// their siblings, so the origin's uplink is no longer the bottleneck.
+type Swarm struct {
+	FileID   string
+	OriginID string
+	manifest []ChunkInfo
+
+	holders  map[string][]bool       // Which chunks each member holds
+	inFlight map[string]map[int]bool // Chunks each receiver is currently fetching
+	uploads  map[string]int          // Active uploads per source
+	served   map[string]int          // Chunks each member has passed on
+	mutex    sync.Mutex
+}
+
+var (
+	swarms      = make(map[string]*Swarm)
+	swarmsMutex sync.Mutex
+)
+
+var (
+	// ErrSwarmComplete is returned by NextAssignment when the receiver holds every chunk
+	ErrSwarmComplete = errors.New("all chunks received")
+
+	// ErrSwarmBusy is returned by NextAssignment when every chunk the
+	// receiver lacks is already on its way to it
+	ErrSwarmBusy = errors.New("no unassigned chunks available, wait for in-flight chunks")
+)
+
+// StartSwarm registers a swarm for a chunked transfer, with the local node as origin
+func StartSwarm(info *FileTransferInfo, originID string) *Swarm {
+	swarmsMutex.Lock()
+	defer swarmsMutex.Unlock()
+
+	if swarm, exists := swarms[info.FileID]; exists {
+		return swarm
+	}
+
+	info.Mutex.Lock()
+	manifest := append([]ChunkInfo(nil), info.Chunks...)
+	info.Mutex.Unlock()
+
+	all := make([]bool, len(manifest))
+	for i := range all {
+		all[i] = true
+	}
+
+	swarm := &Swarm{
+		FileID:   info.FileID,
+		OriginID: originID,
+		manifest: manifest,
+		holders:  map[string][]bool{originID: all},
+		inFlight: make(map[string]map[int]bool),
+		uploads:  make(map[string]int),
+		served:   make(map[string]int),
+	}
+	swarms[info.FileID] = swarm
+	return swarm
+}
+
+// GetSwarm returns the swarm for a file ID, if one is running
+func GetSwarm(fileID string) (*Swarm, bool) {
+	swarmsMutex.Lock()
+	defer swarmsMutex.Unlock()
+
+	swarm, exists := swarms[fileID]
+	return swarm, exists
+}
+
+// StopSwarm forgets the swarm for a file ID
+func StopSwarm(fileID string) {
+	swarmsMutex.Lock()
+	defer swarmsMutex.Unlock()
+
+	delete(swarms, fileID)
+}
+
+// Join adds a receiver to the swarm
+func (s *Swarm) Join(nodeID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.holders[nodeID]; !exists {
+		s.holders[nodeID] = make([]bool, len(s.manifest))
+	}
+}
+
+// Leave removes a receiver, returning its in-flight chunks to the pool
+func (s *Swarm) Leave(nodeID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.holders, nodeID)
+	delete(s.inFlight, nodeID)
+	delete(s.uploads, nodeID)
+}
+
+// Advertise merges a member's chunk availability into the swarm
+func (s *Swarm) Advertise(advert SwarmAdvert) error {
+	if advert.FileID != s.FileID {
+		return fmt.Errorf("advert for file %s sent to swarm %s", advert.FileID, s.FileID)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	have, exists := s.holders[advert.NodeID]
+	if !exists {
+		have = make([]bool, len(s.manifest))
+		s.holders[advert.NodeID] = have
+	}
+
+	for _, index := range advert.Chunks {
+		if index < 0 || index >= len(have) {
+			return fmt.Errorf("invalid chunk index %d in advert from %s", index, advert.NodeID)
+		}
+		have[index] = true
+	}
+
+	return nil
+}
+
+// NextAssignment picks the next chunk for a receiver and the least busy
+// member holding it. Chunks another receiver holds come first, rarest
+// first, so the source's uplink goes to chunks only it has; of those, the
+// ones no other receiver is fetching come first, so that receivers soon
+// have different chunks to trade. The origin is only used when no sibling
+// has the chunk.
+func (s *Swarm) NextAssignment(receiverID string) (ChunkAssignment, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	have, exists := s.holders[receiverID]
+	if !exists {
+		return ChunkAssignment{}, fmt.Errorf("%s has not joined swarm %s", receiverID, s.FileID)
+	}
+
+	pending := s.inFlight[receiverID]
+	best, bestScore := -1, 0
+	missing := 0
+
+	for index := range s.manifest {
+		if have[index] {
+			continue
+		}
+		missing++
+		if pending[index] {
+			continue
+		}
+
+		// Scored lowest first: siblings holding it, then origin only, by
+		// how many other receivers are fetching it
+		siblings, fetching := 0, 0
+		for member, chunks := range s.holders {
+			if member != receiverID && member != s.OriginID && chunks[index] {
+				siblings++
+			}
+		}
+		for member, chunks := range s.inFlight {
+			if member != receiverID && chunks[index] {
+				fetching++
+			}
+		}
+		score := siblings
+		if siblings == 0 {
+			score = len(s.holders) + fetching
+		}
+		if best == -1 || score < bestScore {
+			best, bestScore = index, score
+		}
+	}
+
+	if missing == 0 {
+		return ChunkAssignment{}, ErrSwarmComplete
+	}
+	if best == -1 {
+		return ChunkAssignment{}, ErrSwarmBusy
+	}
+
+	source := ""
+	for member, chunks := range s.holders {
+		if member == receiverID || member == s.OriginID || !chunks[best] {
+			continue
+		}
+		if source == "" || s.uploads[member] < s.uploads[source] {
+			source = member
+		}
+	}
+	if source == "" {
+		source = s.OriginID
+	}
+
+	if pending == nil {
+		pending = make(map[int]bool)
+		s.inFlight[receiverID] = pending
+	}
+	pending[best] = true
+	s.uploads[source]++
+
+	return ChunkAssignment{ChunkIndex: best, SourceID: source}, nil
+}
+
+// CompleteChunk marks a chunk as held by the receiver, which verified it
+// against the manifest, whichever member it came from
+func (s *Swarm) CompleteChunk(receiverID string, assignment ChunkAssignment) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.release(receiverID, assignment)
+	if have, exists := s.holders[receiverID]; exists && assignment.ChunkIndex >= 0 && assignment.ChunkIndex < len(have) {
+		have[assignment.ChunkIndex] = true
+		s.served[assignment.SourceID]++
+	}
+}
+
+// FailChunk returns a chunk to the pool after a failed fetch. A sibling the
+// chunk couldn't be had from is no longer counted as holding it.
+func (s *Swarm) FailChunk(receiverID string, assignment ChunkAssignment) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.release(receiverID, assignment)
+	if assignment.SourceID == s.OriginID {
+		return
+	}
+	if have, exists := s.holders[assignment.SourceID]; exists && assignment.ChunkIndex >= 0 && assignment.ChunkIndex < len(have) {
+		have[assignment.ChunkIndex] = false
+	}
+}
+
+// Served returns how many chunks a member has passed on to receivers
+func (s *Swarm) Served(memberID string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.served[memberID]
+}
+
+// Progress returns how many chunks a member holds out of the total
+func (s *Swarm) Progress(nodeID string) (int, int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	held := 0
+	for _, has := range s.holders[nodeID] {
+		if has {
+			held++
+		}
+	}
+	return held, len(s.manifest)
+}
+
+func (s *Swarm) release(receiverID string, assignment ChunkAssignment) {
+	if pending, exists := s.inFlight[receiverID]; exists {
+		delete(pending, assignment.ChunkIndex)
+	}
+	if s.uploads[assignment.SourceID] > 0 {
+		s.uploads[assignment.SourceID]--
+	}
+}
+
+// SendFileSwarm sends a file to several receivers at once, each address
+// host:port of a ReceiveFileChunked, with the receivers passing chunks on
+// to each other, see above. Receivers that fail drop out of the swarm while
+// the others carry on; the error lists them.
+func SendFileSwarm(filePath string, receivers []string, options TransferOptions) error {
+	if len(receivers) == 0 {
+		return errors.New("no receivers to send to")
+	}
+
+	file, info, err := prepareChunkedFile(filePath, options)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info.swarm = true
+
+	swarm := StartSwarm(info, swarmOrigin)
+	defer StopSwarm(info.FileID)
+
+	// Each receiver has chunks of its own completed
+	members := make([]*FileTransferInfo, len(receivers))
+	failures := make([]error, len(receivers))
+	for i, address := range receivers {
+		member := info.member()
+		if err := sendFileMetadata(member, address, options); err != nil {
+			failures[i] = fmt.Errorf("failed to send file metadata: %w", err)
+			continue
+		}
+		advert, err := requestAdvert(member, address, options)
+		if err != nil {
+			failures[i] = err
+			continue
+		}
+		advert.NodeID = address
+		swarm.Join(address)
+		if err := swarm.Advertise(advert); err != nil {
+			swarm.Leave(address)
+			failures[i] = err
+			continue
+		}
+		member.Status = "transferring"
+		member.events = startTransfer(DirectionSent, address, member.FileName, member.FileSize)
+		members[i] = member
+	}
+
+	// Receivers serve each other until every one holds the file, so none
+	// ends its transfer before then
+	var wg sync.WaitGroup
+	for i, member := range members {
+		if member == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, member *FileTransferInfo) {
+			defer wg.Done()
+			if err := sendSwarmChunks(file, swarm, member, receivers[i], options); err != nil {
+				failures[i] = err
+				swarm.Leave(receivers[i])
+			}
+		}(i, member)
+	}
+	wg.Wait()
+
+	for i, member := range members {
+		if member == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, member *FileTransferInfo) {
+			defer wg.Done()
+			err := failures[i]
+			if err == nil {
+				// Asks for whatever is missing, which ends the transfer
+				err = sendFileChunks(file, member, receivers[i], options)
+			}
+			member.endEvents(err, options)
+			if err != nil {
+				member.Status, member.Error = "failed", err
+				failures[i] = fmt.Errorf("failed to send file chunks: %w", err)
+				return
+			}
+			member.Status = "completed"
+		}(i, member)
+	}
+	wg.Wait()
+
+	if cancelled(options.Context) {
+		return errCancelled
+	}
+	var errs []error
+	for i, err := range failures {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", receivers[i], err))
+		}
+	}
+	if len(errs) < len(receivers) {
+		fmt.Printf("Swarm sent %s: %d of %d chunk transfers came from other receivers\n",
+			info.FileName, swarm.servedBySiblings(), len(info.Chunks)*len(receivers))
+	}
+	return errors.Join(errs...)
+}
+
+// member copies a transfer to a swarm for one of its receivers, with no
+// chunks completed
+func (info *FileTransferInfo) member() *FileTransferInfo {
+	info.Mutex.Lock()
+	defer info.Mutex.Unlock()
+
+	chunks := make([]ChunkInfo, len(info.Chunks))
+	copy(chunks, info.Chunks)
+	return &FileTransferInfo{
+		FileID:      info.FileID,
+		FileName:    info.FileName,
+		FilePath:    info.FilePath,
+		FileSize:    info.FileSize,
+		ChunkSize:   info.ChunkSize,
+		Chunks:      chunks,
+		TotalChunks: info.TotalChunks,
+		StartTime:   time.Now(),
+		Status:      "preparing",
+		aead:        info.aead,
+		swarm:       info.swarm,
+	}
+}
+
+// servedBySiblings counts the chunks receivers passed on to each other
+func (s *Swarm) servedBySiblings() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	total := 0
+	for member, served := range s.served {
+		if member != s.OriginID {
+			total += served
+		}
+	}
+	return total
+}
+
+// requestAdvert asks the receiver at address which chunks it holds
+func requestAdvert(info *FileTransferInfo, address string, options TransferOptions) (SwarmAdvert, error) {
+	var advert SwarmAdvert
+	conn, err := options.dial(options.Context, address)
+	if err != nil {
+		return advert, fmt.Errorf("failed to connect to %s: %v", address, err)
+	}
+	defer conn.Close()
+	defer closeOnCancel(options.Context, conn)()
+	conn.SetDeadline(time.Now().Add(chunkTimeout))
+
+	if err := writeMessage(conn, chunkHeader{FileID: info.FileID, Index: chunkIndexAdvert}); err != nil {
+		return advert, fmt.Errorf("failed to ask for held chunks: %v", err)
+	}
+	if err := readMessage(conn, &advert); err != nil {
+		return advert, fmt.Errorf("receiver doesn't take part in swarms: %v", err)
+	}
+	if advert.FileID != info.FileID {
+		return advert, fmt.Errorf("receiver advertised chunks of file %s", advert.FileID)
+	}
+	return advert, nil
+}
+
+// sendSwarmChunks has the receiver at address get every chunk it lacks,
+// from the source or another receiver, Parallelism at a time
+func sendSwarmChunks(file *os.File, swarm *Swarm, info *FileTransferInfo, address string, options TransferOptions) error {
+	workers := max(options.Parallelism, 1)
+
+	// The first failure stops the other workers
+	ctx, cancel := context.WithCancel(contextOrBackground(options.Context))
+	defer cancel()
+
+	var failuresMutex sync.Mutex
+	failures := make(map[int]int) // Failed attempts per chunk sent by the source
+
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var conn net.Conn
+			defer func() {
+				if conn != nil {
+					conn.Close()
+				}
+			}()
+
+			for ctx.Err() == nil {
+				assignment, err := swarm.NextAssignment(address)
+				if errors.Is(err, ErrSwarmComplete) {
+					return
+				}
+				if errors.Is(err, ErrSwarmBusy) {
+					sleepContext(ctx, swarmWait)
+					continue
+				}
+				if err != nil {
+					errs <- err
+					cancel()
+					return
+				}
+
+				if conn == nil {
+					if conn, err = options.dial(ctx, address); err != nil {
+						conn = nil
+						err = fmt.Errorf("failed to connect to %s: %v", address, err)
+					}
+				}
+				if err == nil {
+					if assignment.SourceID == swarm.OriginID {
+						err = sendChunk(ctx, conn, file, info, assignment.ChunkIndex)
+					} else {
+						err = handOnChunk(ctx, conn, info, assignment)
+					}
+				}
+				if err == nil {
+					swarm.CompleteChunk(address, assignment)
+					info.completeChunk(assignment.ChunkIndex, options)
+					continue
+				}
+
+				// Start over on a fresh connection, this one may be out of sync
+				swarm.FailChunk(address, assignment)
+				if conn != nil {
+					conn.Close()
+					conn = nil
+				}
+				if assignment.SourceID != swarm.OriginID {
+					// The source sends it next time
+					continue
+				}
+				failuresMutex.Lock()
+				failures[assignment.ChunkIndex]++
+				attempts := failures[assignment.ChunkIndex]
+				failuresMutex.Unlock()
+				if attempts > options.RetryCount {
+					errs <- fmt.Errorf("chunk %d failed after %d attempts: %w", assignment.ChunkIndex, attempts, err)
+					cancel()
+					return
+				}
+				sleepContext(ctx, options.RetryDelay)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	if cancelled(options.Context) {
+		return errCancelled
+	}
+	return <-errs
+}
+
+// handOnChunk tells the receiver on conn to fetch a chunk from the other
+// receiver holding it and waits for it to accept the chunk
+func handOnChunk(ctx context.Context, conn net.Conn, info *FileTransferInfo, assignment ChunkAssignment) error {
+	info.Mutex.Lock()
+	chunk := info.Chunks[assignment.ChunkIndex]
+	info.Mutex.Unlock()
+
+	defer closeOnCancel(ctx, conn)()
+	// The receiver takes up to chunkTimeout to fetch the chunk
+	conn.SetDeadline(time.Now().Add(2 * chunkTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	header := chunkHeader{FileID: info.FileID, Index: chunk.Index, Size: chunk.Size, Checksum: chunk.Checksum, From: assignment.SourceID}
+	if err := writeMessage(conn, header); err != nil {
+		return fmt.Errorf("failed to send chunk header: %v", err)
+	}
+	var ack chunkAck
+	if err := readMessage(conn, &ack); err != nil {
+		return fmt.Errorf("failed to read chunk acknowledgement: %v", err)
+	}
+	if ack.Index != chunk.Index {
+		return fmt.Errorf("receiver acknowledged chunk %d instead of %d", ack.Index, chunk.Index)
+	}
+	if !ack.OK {
+		return fmt.Errorf("receiver couldn't get the chunk from %s: %s", assignment.SourceID, ack.Error)
+	}
+	return nil
+}
+
+// sleepContext waits for d or until ctx is done
+func sleepContext(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+// advert lists the chunks the receiver holds
+func (r *chunkReceiver) advert(conn net.Conn) SwarmAdvert {
+	r.info.Mutex.Lock()
+	defer r.info.Mutex.Unlock()
+
+	advert := SwarmAdvert{FileID: r.info.FileID, NodeID: conn.LocalAddr().String(), Chunks: []int{}}
+	for i, chunk := range r.info.Chunks {
+		if chunk.Completed {
+			advert.Chunks = append(advert.Chunks, i)
+		}
+	}
+	return advert
+}
+
+// serveSwarm answers a Fetch header from another receiver with the chunk,
+// or fetches the chunk a From header names and acknowledges it to the
+// source. It returns false when the connection can't be used any further.
+func (r *chunkReceiver) serveSwarm(conn net.Conn, header chunkHeader) bool {
+	if header.From != "" {
+		ack := chunkAck{Index: header.Index, OK: true}
+		if err := r.fetch(header); err != nil {
+			ack.OK, ack.Error = false, err.Error()
+		}
+		return writeMessage(conn, ack) == nil
+	}
+
+	r.info.Mutex.Lock()
+	chunk := r.info.Chunks[header.Index]
+	r.info.Mutex.Unlock()
+	if !chunk.Completed {
+		return writeMessage(conn, chunkAck{Index: header.Index, Error: "chunk not held"}) == nil
+	}
+
+	data := make([]byte, chunk.Size)
+	if _, err := r.file.ReadAt(data, chunk.Offset); err != nil {
+		return writeMessage(conn, chunkAck{Index: header.Index, Error: "failed to read chunk"}) == nil
+	}
+	if r.info.aead != nil {
+		data = sealChunk(r.info.aead, r.info.FileID, header.Index, data)
+	}
+	if err := writeMessage(conn, chunkAck{Index: header.Index, OK: true}); err != nil {
+		return false
+	}
+	_, err := conn.Write(data)
+	return err == nil
+}
+
+// fetch gets a chunk from the receiver the header names and accepts it as
+// if the source had sent it, checksum and all
+func (r *chunkReceiver) fetch(header chunkHeader) error {
+	ctx := contextOrBackground(r.options.Context)
+	conn, err := r.options.dial(ctx, header.From)
+	if err != nil {
+		return fmt.Errorf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	defer closeOnCancel(ctx, conn)()
+	conn.SetDeadline(time.Now().Add(chunkTimeout))
+
+	request := chunkHeader{FileID: r.info.FileID, Index: header.Index, Size: header.Size, Checksum: header.Checksum, Fetch: true}
+	if err := writeMessage(conn, request); err != nil {
+		return err
+	}
+	var ack chunkAck
+	if err := readMessage(conn, &ack); err != nil {
+		return err
+	}
+	if !ack.OK || ack.Index != header.Index {
+		return fmt.Errorf("chunk refused: %s", ack.Error)
+	}
+
+	size := header.Size
+	if r.info.aead != nil {
+		size += int64(r.info.aead.Overhead())
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(conn, data); err != nil {
+		return err
+	}
+	return r.accept(header, data)
+}
@@ -0,0 +1,132 @@
+package transfer
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// freeAddress returns a loopback address nothing listens on
+func freeAddress(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+// testOptions are options for transfers over loopback, with small chunks
+func testOptions() TransferOptions {
+	options := DefaultTransferOptions()
+	options.ChunkSize = 16 * 1024
+	options.Parallelism = 3
+	options.RetryDelay = 10 * time.Millisecond
+	options.Resume = false
+	return options
+}
+
+// writeTestFile writes size random bytes to a file in dir
+func writeTestFile(t *testing.T, dir, name string, size int) (string, []byte) {
+	t.Helper()
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path, data
+}
+
+func TestSendFileSwarm(t *testing.T) {
+	source, data := writeTestFile(t, t.TempDir(), "swarm.bin", 1<<20)
+	options := testOptions()
+
+	const receivers = 3
+	addresses := make([]string, receivers)
+	dirs := make([]string, receivers)
+	results := make(chan error, receivers)
+	for i := range addresses {
+		addresses[i], dirs[i] = freeAddress(t), t.TempDir()
+		go func(address, dir string) {
+			results <- ReceiveFileChunked(address, dir, options)
+		}(addresses[i], dirs[i])
+	}
+	// Let the receivers start listening
+	time.Sleep(100 * time.Millisecond)
+
+	if err := SendFileSwarm(source, addresses, options); err != nil {
+		t.Fatalf("SendFileSwarm: %v", err)
+	}
+	for range addresses {
+		if err := <-results; err != nil {
+			t.Fatalf("ReceiveFileChunked: %v", err)
+		}
+	}
+	for _, dir := range dirs {
+		received, err := os.ReadFile(filepath.Join(dir, "swarm.bin"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(received, data) {
+			t.Errorf("file received in %s differs from the one sent", dir)
+		}
+	}
+}
+
+func TestSwarmAssignments(t *testing.T) {
+	info := &FileTransferInfo{FileID: "swarm-assignments", Chunks: make([]ChunkInfo, 4)}
+	for i := range info.Chunks {
+		info.Chunks[i] = ChunkInfo{Index: i, Size: 1}
+	}
+	swarm := StartSwarm(info, swarmOrigin)
+	defer StopSwarm(info.FileID)
+	swarm.Join("a")
+	swarm.Join("b")
+
+	// a holds chunk 2, so b gets it from a rather than from the source
+	if err := swarm.Advertise(SwarmAdvert{FileID: info.FileID, NodeID: "a", Chunks: []int{2}}); err != nil {
+		t.Fatal(err)
+	}
+	assignment, err := swarm.NextAssignment("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assignment.ChunkIndex != 2 || assignment.SourceID != "a" {
+		t.Fatalf("b got chunk %d from %s, want chunk 2 from a", assignment.ChunkIndex, assignment.SourceID)
+	}
+
+	// A failed fetch goes back to the source
+	swarm.FailChunk("b", assignment)
+	assignment, err = swarm.NextAssignment("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assignment.SourceID != swarmOrigin {
+		t.Fatalf("b got chunk %d from %s after a failed, want the source", assignment.ChunkIndex, assignment.SourceID)
+	}
+	swarm.CompleteChunk("b", assignment)
+
+	for {
+		assignment, err := swarm.NextAssignment("a")
+		if errors.Is(err, ErrSwarmComplete) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		swarm.CompleteChunk("a", assignment)
+	}
+	if done, total := swarm.Progress("a"); done != total {
+		t.Errorf("a holds %d of %d chunks after the swarm completed", done, total)
+	}
+	if swarm.Served("b") == 0 && swarm.servedBySiblings() == 0 {
+		t.Errorf("no chunks were passed between receivers")
+	}
+}
@@ -0,0 +1,216 @@
+package transfer
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"fileshare/internal/utils"
+	"fileshare/internal/version"
+)
+
+// TLS mode wraps the whole connection, control frames and file bytes alike,
+// in TLS. The receiver uses a self-signed certificate kept in DataDir, so
+// there is no certificate authority to vouch for it: both ends print the
+// certificate fingerprint and users compare them out of band.
+
+const (
+	// tlsCertFile and tlsKeyFile hold the receiver's certificate in DataDir
+	tlsCertFile = "tls_cert.pem"
+	tlsKeyFile  = "tls_key.pem"
+
+	// tlsRecordHandshake is the first byte of a TLS ClientHello
+	tlsRecordHandshake = 0x16
+
+	// tlsHandshakeTimeout bounds the TLS handshake on both ends
+	tlsHandshakeTimeout = 30 * time.Second
+)
+
+var (
+	// ErrTLSRequired is returned to a plain sender by a receiver running in TLS mode
+	ErrTLSRequired = errors.New("the receiver only accepts encrypted transfers, send again with --tls")
+
+	// errTLSNotEnabled is returned by a plain receiver when a TLS sender connects
+	errTLSNotEnabled = errors.New("the sender is using TLS but this receiver is not, restart it with --tls")
+)
+
+// LocalCertificate loads the receiver certificate from DataDir, creating a
+// new self-signed one the first time, and returns it with its fingerprint
+func LocalCertificate() (tls.Certificate, string, error) {
+	dir, err := utils.DataDir()
+	if err != nil {
+		return tls.Certificate{}, "", fmt.Errorf("failed to locate data directory: %v", err)
+	}
+	certPath := filepath.Join(dir, tlsCertFile)
+	keyPath := filepath.Join(dir, tlsKeyFile)
+
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if os.IsNotExist(err) {
+		err = createCertificate(certPath, keyPath)
+		if err == nil {
+			cert, err = tls.LoadX509KeyPair(certPath, keyPath)
+		}
+	}
+	if err != nil {
+		return tls.Certificate{}, "", fmt.Errorf("failed to load TLS certificate: %v", err)
+	}
+
+	return cert, Fingerprint(cert.Certificate[0]), nil
+}
+
+// createCertificate writes a new self-signed certificate and its key
+func createCertificate(certPath, keyPath string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	hostname, _ := os.Hostname()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "BitShare " + hostname},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// Fingerprint returns the SHA-256 fingerprint of a DER encoded certificate
+// in the usual colon separated form
+func Fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// handshakeTLS runs the client side of the handshake on conn and returns
+// the receiver's fingerprint. The certificate is self-signed, so it is not
+// verified against a CA; comparing fingerprints is what authenticates it.
+func handshakeTLS(ctx context.Context, conn net.Conn, address string) (net.Conn, string, error) {
+	tlsConn := tls.Client(conn, &tls.Config{
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS12,
+	})
+
+	ctx, cancel := context.WithTimeout(contextOrBackground(ctx), tlsHandshakeTimeout)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, "", fmt.Errorf("TLS handshake with %s failed, is the receiver running with --tls? (%v)", address, err)
+	}
+
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, "", fmt.Errorf("receiver %s sent no TLS certificate", address)
+	}
+	return tlsConn, Fingerprint(certs[0].Raw), nil
+}
+
+// dialTLS is handshakeTLS telling the user the receiver's fingerprint
+func dialTLS(ctx context.Context, conn net.Conn, address string) (net.Conn, string, error) {
+	tlsConn, fingerprint, err := handshakeTLS(ctx, conn, address)
+	if err != nil {
+		return nil, "", err
+	}
+	fmt.Printf("🔒 Encrypted connection to %s\n", address)
+	fmt.Printf("   Receiver certificate fingerprint: %s\n", fingerprint)
+	fmt.Println("   Compare it with the fingerprint shown on the receiver")
+
+	return tlsConn, fingerprint, nil
+}
+
+// peekedConn lets the first bytes of a connection be inspected before
+// deciding whether it speaks TLS
+type peekedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// acceptTLS prepares an incoming connection according to the receiver's TLS
+// mode. A plain sender reaching a TLS receiver, or the other way round, gets
+// an error naming the mismatch instead of a stream of unreadable bytes.
+func acceptTLS(conn net.Conn, config *tls.Config) (net.Conn, error) {
+	peeked := &peekedConn{Conn: conn, reader: bufio.NewReader(conn)}
+	first, err := peeked.reader.Peek(1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from sender: %v", err)
+	}
+	isTLS := first[0] == tlsRecordHandshake
+
+	switch {
+	case config == nil && isTLS:
+		return nil, errTLSNotEnabled
+	case config == nil:
+		return peeked, nil
+	case !isTLS:
+		return nil, refusePlainSender(peeked)
+	}
+
+	tlsConn := tls.Server(peeked, config)
+	ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, fmt.Errorf("TLS handshake failed: %v", err)
+	}
+	return tlsConn, nil
+}
+
+// refusePlainSender tells a sender that connected without TLS why it is
+// turned away. Probes still get an answer, marked as requiring TLS.
+func refusePlainSender(conn net.Conn) error {
+	var batch batchHeader
+	if err := readMessage(conn, &batch); err != nil {
+		return fmt.Errorf("refused unencrypted connection: %v", err)
+	}
+	if batch.Probe {
+		if err := writeMessage(conn, probeReply{Protocol: protocolName, Version: ProtocolVersion, AppVersion: version.Current, TLSRequired: true}); err != nil {
+			return fmt.Errorf("failed to answer probe: %v", err)
+		}
+		return errProbeAnswered
+	}
+
+	return turnAway(conn, resumeOffer{Declined: ErrTLSRequired.Error(), TLSRequired: true},
+		errors.New("refused unencrypted connection, the sender must use --tls"))
+}
@@ -1,75 +1,510 @@
 package transfer
 
 import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fileshare/internal/access"
 	"fileshare/internal/utils"
+	"fileshare/internal/version"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	MaxFileSize = 10 * 1024 * 1024 * 1024 // 10GB limit
+	// DefaultMaxFileSize is the file size limit unless TransferOptions.MaxFileSize says otherwise
+	DefaultMaxFileSize = 10 * 1024 * 1024 * 1024 // 10GB limit
+
+	// connectionTimeout is how long a connection handled by ReceiveLoop may sit idle
+	connectionTimeout = 300 * time.Second
+
+	// receiverFailureWait bounds the exchange of a receiver's reason for failing mid-transfer
+	receiverFailureWait = 2 * time.Second
 )
 
 // SendFile connects to a receiver and sends a file
 func SendFile(filePath, receiverIP string, port int) error {
-	// Check if file exists
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		return fmt.Errorf("file does not exist: %s", filePath)
+	return SendFiles([]string{filePath}, receiverIP, port)
+}
+
+// SendFiles connects to a receiver and sends several files, one after
+// another, over a single connection
+func SendFiles(filePaths []string, receiverIP string, port int) error {
+	return SendFilesWithOptions(filePaths, receiverIP, port, DefaultTransferOptions())
+}
+
+// SendFilesWithOptions is SendFiles with progress reporting and other options
+func SendFilesWithOptions(filePaths []string, receiverIP string, port int, options TransferOptions) error {
+	if len(filePaths) == 0 {
+		return errors.New("no files to send")
+	}
+
+	// Check every file before connecting so a typo doesn't abort the batch halfway
+	items := make([]sendItem, len(filePaths))
+	for i, filePath := range filePaths {
+		fileInfo, err := os.Stat(filePath)
+		if os.IsNotExist(err) {
+			return fmt.Errorf("file does not exist: %s", filePath)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get file info: %v", err)
+		}
+		if fileInfo.IsDir() {
+			return fmt.Errorf("%s is a directory", filePath)
+		}
+
+		// Check file size limit
+		if err := checkFileSize(fileInfo.Size(), options.MaxFileSize); err != nil {
+			return fmt.Errorf("%s: %v", filePath, err)
+		}
+		items[i] = sendItem{path: filePath, name: filepath.Base(filePath), size: fileInfo.Size()}
+	}
+
+	return sendItems(items, receiverIP, port, options)
+}
+
+// SendStreamWithOptions sends everything read from r, until EOF, as a file
+// called name. The length doesn't need to be known in advance (see stream.go).
+func SendStreamWithOptions(r io.Reader, name string, receiverIP string, port int, options TransferOptions) error {
+	if name == "" || filepath.Base(name) != name {
+		return fmt.Errorf("invalid name for the stream: %q", name)
+	}
+	return sendItems([]sendItem{{name: name, size: streamSize, stream: r}}, receiverIP, port, options)
+}
+
+// sendItem is one file of a batch, or a stream
+type sendItem struct {
+	path   string    // File to send, empty for a stream
+	name   string    // Name the receiver saves it under
+	size   int64     // streamSize for a stream
+	stream io.Reader // Data of a stream
+}
+
+// sendItems sends a batch, retrying if the receiver resets the connection
+// before anything was sent, and records every item in the history
+func sendItems(items []sendItem, receiverIP string, port int, options TransferOptions) error {
+	address := net.JoinHostPort(receiverIP, fmt.Sprintf("%d", port))
+
+	// Keep at least the security this receiver had last time
+	known, _ := LookupPeerSecurity(address)
+	if options.AllowDowngrade {
+		known = PeerSecurity{}
+	}
+	if known.TLS && !options.TLS {
+		fmt.Printf("🔒 %s used encryption before, connecting with TLS\n", address)
+		options.TLS = true
+	}
+	if known.PIN && options.PIN == "" {
+		return fmt.Errorf("%s required a PIN before, send again with --pin", address)
+	}
+
+	// Leave out the files the receiver says it won't take or already has
+	total, declined := len(items), 0
+	if !options.SkipQuery {
+		if verdicts := queryReceiver(address, items, options, known); verdicts != nil {
+			var accepted []sendItem
+			var reason string
+			for i, item := range items {
+				if verdicts[i].Identical {
+					fmt.Printf("✓ %s is already up to date on the receiver, not sending it\n", item.name)
+					entry := sentEntry(item, address, options)
+					entry.Checksum, entry.Result = verdicts[i].Checksum, ResultUpToDate
+					RecordTransfer(entry)
+					continue
+				}
+				if verdicts[i].Accept {
+					accepted = append(accepted, item)
+					continue
+				}
+				reason = verdicts[i].Reason
+				if len(items) > 1 {
+					fmt.Printf("Not sending %s: the receiver declined it (%s)\n", item.name, reason)
+				}
+				recordOutcome(sentEntry(item, address, options), &fileError{errors.New(reason)}, options.Context)
+				declined++
+			}
+			switch {
+			case len(accepted) > 0:
+				items = accepted
+			case declined == 0:
+				return nil
+			case len(items) == 1:
+				return fmt.Errorf("%w %s: %s", ErrDeclined, items[0].name, reason)
+			case declined == len(items):
+				return fmt.Errorf("%w all %d files", ErrDeclined, len(items))
+			default:
+				return fmt.Errorf("%d of %d files failed", declined, total)
+			}
+		}
+	}
+
+	var totalSize int64
+	for _, item := range items {
+		if item.size == streamSize {
+			totalSize = streamSize
+			break
+		}
+		totalSize += item.size
+	}
+	progress := newProgressTracker(totalSize, options)
+
+	for attempt := 1; ; attempt++ {
+		var observed PeerSecurity
+		started := time.Now()
+		completed, failures, err := sendBatch(items, address, options, progress, known, &observed)
+
+		// A reset before the receiver has answered anything is usually Windows
+		// dropping the connection while its firewall prompt is still open
+		if err != nil && attempt <= resetRetries && progress.done == 0 && completed == 0 && isConnectionReset(err) {
+			fmt.Printf("Connection was reset by %s. The receiver may be approving a firewall prompt - retrying in %s (%d/%d)...\n",
+				address, resetRetryDelay, attempt, resetRetries)
+			select {
+			case <-time.After(resetRetryDelay):
+				continue
+			case <-contextOrBackground(options.Context).Done():
+				err = errCancelled
+			}
+		}
+		if err != nil {
+			// The item that was in flight and the ones after it were not sent
+			for i := completed; i < len(items); i++ {
+				entry := sentEntry(items[i], address, options)
+				if i == completed {
+					entry.Duration = time.Since(started)
+				}
+				recordOutcome(entry, err, options.Context)
+			}
+			return err
+		}
+
+		if err := rememberPeerSecurity(address, observed); err != nil {
+			fmt.Printf("⚠️  Could not remember the security settings of %s: %v\n", address, err)
+		}
+		if len(items) == 1 && len(failures) == 1 {
+			// sendBatch only names the failed file when there are others
+			if total == 1 {
+				return failures[0]
+			}
+			fmt.Printf("Failed to send %s: %v\n", items[0].name, failures[0])
+		}
+		if len(failures)+declined > 0 {
+			return fmt.Errorf("%d of %d files failed", len(failures)+declined, total)
+		}
+		return nil
+	}
+}
+
+// sentEntry starts the history entry of an item sent to address
+func sentEntry(item sendItem, address string, options TransferOptions) HistoryEntry {
+	entry := HistoryEntry{
+		Direction: DirectionSent,
+		Peer:      address,
+		PeerName:  options.PeerName,
+		FileName:  item.name,
+		FilePath:  item.path,
+	}
+	if item.size != streamSize {
+		entry.FileSize = item.size
+	}
+	if options.ForwardedFrom != "" {
+		entry.Direction = DirectionForwarded
+		entry.ReceivedFrom = options.ForwardedFrom
+	}
+	if item.path != "" {
+		if absPath, err := filepath.Abs(item.path); err == nil {
+			entry.FilePath = absPath
+		}
+	}
+	return entry
+}
+
+// sendBatch connects to a receiver and sends every item over the connection.
+// It returns how many items were dealt with, each recorded in the history,
+// and why the receiver rejected those it did. The receiver's security is
+// checked against what is known about it and recorded in observed.
+func sendBatch(items []sendItem, address string, options TransferOptions, progress *progressTracker, known PeerSecurity, observed *PeerSecurity) (int, []error, error) {
+	conn, err := options.dial(options.Context, address)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to connect to receiver: %v", err)
+	}
+	defer conn.Close()
+	defer closeOnCancel(options.Context, conn)()
+
+	// Only give up when nothing has moved for a while, not after a fixed time
+	conn = withIdleTimeout(conn, senderIdleTimeout)
+
+	if options.TLS {
+		var fingerprint string
+		if conn, fingerprint, err = dialTLS(options.Context, conn, address); err != nil {
+			return 0, nil, checkTLSDowngrade(address, known, err)
+		}
+		if err := checkFingerprint(address, known, fingerprint); err != nil {
+			return 0, nil, err
+		}
+		observed.TLS, observed.Fingerprint = true, fingerprint
+	}
+	options.notify(StateConnected, "", address, nil)
+
+	if err := writeMessage(conn, batchHeader{Count: len(items), AppVersion: version.Current, Auth: options.PIN != ""}); err != nil {
+		return 0, nil, fmt.Errorf("failed to send batch header: %v", err)
+	}
+	if options.PIN != "" {
+		required, err := authenticateSender(conn, options.PIN)
+		if err != nil {
+			return 0, nil, err
+		}
+		if err := checkPINDowngrade(address, known, required); err != nil {
+			return 0, nil, err
+		}
+		observed.PIN = required
+	}
+
+	direction := DirectionSent
+	if options.ForwardedFrom != "" {
+		direction = DirectionForwarded
+	}
+
+	var failures []error
+	for i, item := range items {
+		if len(items) > 1 {
+			fmt.Printf("File %d of %d:\n", i+1, len(items))
+		}
+
+		options.notify(StateSending, item.name, address, nil)
+		started := time.Now()
+		events := startTransfer(direction, address, item.name, item.size)
+		events.track(progress)
+		var checksum string
+		var size int64
+		if item.stream != nil {
+			checksum, size, err = sendStreamOverConnection(conn, item, options.CompressData, progress)
+		} else {
+			checksum, size, err = sendFileOverConnection(conn, item.path, options.CompressData, options.bufferSize(), progress)
+		}
+		progress.events = nil
+		events.end(err, options.Context, events.statsOf(progress))
+		if cancelled(options.Context) {
+			return i, failures, errCancelled
+		}
+		if err != nil {
+			options.notify(StateFileFailed, item.name, address, err)
+		}
+		var fe *fileError
+		if err != nil && !errors.As(err, &fe) {
+			return i, failures, err
+		}
+
+		entry := sentEntry(item, address, options)
+		entry.FileSize = size
+		entry.Checksum = checksum
+		entry.Duration = time.Since(started)
+		recordOutcome(entry, err, options.Context)
+
+		if err != nil {
+			// The receiver rejected this file but the connection is still usable
+			if len(items) > 1 {
+				fmt.Printf("Failed to send %s: %v\n", item.name, err)
+			}
+			failures = append(failures, err)
+			continue
+		}
+		options.notify(StateFileDone, item.name, address, nil)
 	}
 
+	return len(items), failures, nil
+}
+
+// sendFileOverConnection sends one file of a batch on an established
+// connection, returning its checksum and size
+func sendFileOverConnection(conn net.Conn, filePath string, compress bool, bufferSize int, progress *progressTracker) (string, int64, error) {
 	// Open the file
 	file, err := os.Open(filePath)
 	if err != nil {
-		return fmt.Errorf("failed to open file: %v", err)
+		return "", 0, fmt.Errorf("failed to open file: %v", err)
 	}
 	defer file.Close()
 
 	// Get file info
 	fileInfo, err := file.Stat()
 	if err != nil {
-		return fmt.Errorf("failed to get file info: %v", err)
+		return "", 0, fmt.Errorf("failed to get file info: %v", err)
 	}
+	size := fileInfo.Size()
 
-	// Check file size limit
-	if fileInfo.Size() > MaxFileSize {
-		return fmt.Errorf("file too large: %d bytes (max: %d bytes)", fileInfo.Size(), MaxFileSize)
+	// Checksum the file so the receiver can verify what it got, usually
+	// already done for the query
+	checksum, err := cachedChecksum(filePath, fileInfo)
+	if err != nil {
+		return "", size, fmt.Errorf("failed to calculate checksum: %v", err)
 	}
 
-	// Connect to receiver
-	address := net.JoinHostPort(receiverIP, fmt.Sprintf("%d", port))
-	conn, err := net.Dial("tcp", address)
+	// Send filename and size first
+	filename := filepath.Base(filePath)
+	fmt.Printf("Sending file: %s (%s)\n", filename, utils.FormatBytes(size))
+
+	header := fileHeader{Name: filename, Size: size, Checksum: checksum}
+	header.setMetadata(fileInfo)
+	if compress && worthCompressing(filename) {
+		header.Compression = compressionGzip
+	}
+	err = writeMessage(conn, header)
 	if err != nil {
-		return fmt.Errorf("failed to connect to receiver: %v", err)
+		return checksum, size, fmt.Errorf("failed to send file metadata: %v", err)
 	}
-	defer conn.Close()
 
-	// Set connection timeout
-	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	// Find out whether the receiver already holds part of this file
+	offer, err := readResumeOffer(conn, filename)
+	if err != nil {
+		return checksum, size, err
+	}
 
-	// Send filename first
-	filename := filepath.Base(filePath)
-	fmt.Printf("Sending file: %s (%s)\n", filename, utils.FormatBytes(fileInfo.Size()))
+	offset := negotiateResume(file, size, offer)
+	if err := writeMessage(conn, resumeDecision{Offset: offset}); err != nil {
+		return checksum, size, fmt.Errorf("failed to send resume decision: %v", err)
+	}
+
+	if offset > 0 {
+		fmt.Printf("Resuming %s from %s\n", filename, utils.FormatBytes(offset))
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			return checksum, size, fmt.Errorf("failed to seek to resume offset: %v", err)
+		}
+		progress.skip(offset)
+	}
+
+	// Send file content, compressed if the receiver agreed to it
+	if header.Compression != "" && offer.Compression == header.Compression {
+		err = compressedCopy(progress.wireWriter(conn), file, size-offset, progress)
+	} else if tcp, idle, ok := directConn(conn); ok {
+		err = sendFileDirect(tcp, idle, file, size-offset, progress)
+	} else {
+		_, err = copyBuffered(progress.writer(progress.wireWriter(conn)), file, size-offset, bufferSize)
+	}
+	if err != nil {
+		if reason := receiverFailure(conn); reason != nil {
+			return checksum, size, reason
+		}
+		return checksum, size, fmt.Errorf("failed to send file content: %v", err)
+	}
+
+	return checksum, size, confirmReceipt(conn, filename, checksum, size)
+}
+
+// sendStreamOverConnection sends a stream of unknown length on an
+// established connection, returning its checksum and size
+func sendStreamOverConnection(conn net.Conn, item sendItem, compress bool, progress *progressTracker) (string, int64, error) {
+	fmt.Printf("Streaming %s\n", item.name)
+
+	header := fileHeader{Name: item.name, Size: streamSize}
+	if compress && worthCompressing(item.name) {
+		header.Compression = compressionGzip
+	}
+	if err := writeMessage(conn, header); err != nil {
+		return "", 0, fmt.Errorf("failed to send stream metadata: %v", err)
+	}
 
-	_, err = fmt.Fprintf(conn, "%s\n%d\n", filename, fileInfo.Size())
+	offer, err := readResumeOffer(conn, item.name)
 	if err != nil {
-		return fmt.Errorf("failed to send file metadata: %v", err)
+		return "", 0, err
+	}
+	if err := writeMessage(conn, resumeDecision{}); err != nil {
+		return "", 0, fmt.Errorf("failed to send resume decision: %v", err)
 	}
 
-	// Send file content
-	_, err = io.Copy(conn, file)
+	// Hash the data on its way out, it can't be read twice
+	hasher := sha256.New()
+	compressed := header.Compression != "" && offer.Compression == header.Compression
+	size, err := sendStreamData(progress.wireWriter(conn), io.TeeReader(item.stream, hasher), compressed, progress)
 	if err != nil {
-		return fmt.Errorf("failed to send file content: %v", err)
+		if reason := receiverFailure(conn); reason != nil {
+			return "", size, reason
+		}
+		return "", size, fmt.Errorf("failed to send stream: %v", err)
+	}
+	progress.finish()
+
+	checksum := hex.EncodeToString(hasher.Sum(nil))
+	if err := writeMessage(conn, streamTrailer{Size: size, Checksum: checksum}); err != nil {
+		return checksum, size, fmt.Errorf("failed to end stream: %v", err)
+	}
+
+	return checksum, size, confirmReceipt(conn, item.name, checksum, size)
+}
+
+// readResumeOffer reads the receiver's answer to a file header
+func readResumeOffer(conn net.Conn, filename string) (resumeOffer, error) {
+	var offer resumeOffer
+	if err := readMessage(conn, &offer); err != nil {
+		return offer, fmt.Errorf("failed to read receiver response: %w", err)
+	}
+	if offer.TLSRequired {
+		return offer, ErrTLSRequired
+	}
+	if offer.AuthRequired {
+		return offer, ErrPINRequired
+	}
+	if offer.Declined != "" {
+		return offer, &fileError{fmt.Errorf("%w %s: %s", ErrDeclined, filename, offer.Declined)}
+	}
+	return offer, nil
+}
+
+// confirmReceipt waits for the receiver to confirm it got the file intact.
+// The wait is bounded by the connection's idle timeout, so a receiver that
+// never answers fails the send instead of hanging it.
+func confirmReceipt(conn net.Conn, filename, checksum string, size int64) error {
+	var result transferResult
+	if err := readMessage(conn, &result); err != nil {
+		return fmt.Errorf("no confirmation from receiver: %v", err)
+	}
+	if !result.OK {
+		return &fileError{fmt.Errorf("receiver reported an error: %s", result.Error)}
+	}
+	if result.BytesWritten != size {
+		return &fileError{fmt.Errorf("receiver wrote %d bytes, expected %d", result.BytesWritten, size)}
+	}
+	if result.Checksum != checksum {
+		return &fileError{fmt.Errorf("checksum mismatch: receiver has %s, expected %s", result.Checksum, checksum)}
+	}
+	if result.SavedAs != "" && result.SavedAs != filename {
+		fmt.Printf("The receiver saved %s as %s\n", filename, result.SavedAs)
 	}
 
 	return nil
 }
 
+// receiverFailure returns the reason a receiver gave for stopping part way
+// through the data, if it sent one before the connection broke
+func receiverFailure(conn net.Conn) error {
+	results := make(chan transferResult, 1)
+	go func() {
+		var result transferResult
+		readMessage(conn, &result)
+		results <- result
+	}()
+
+	select {
+	case result := <-results:
+		if !result.OK && result.Error != "" {
+			return fmt.Errorf("receiver failed: %s", result.Error)
+		}
+	case <-time.After(receiverFailureWait):
+		conn.Close()
+	}
+	return nil
+}
+
 // ReceiveFile starts a TCP listener and receives a file
 func ReceiveFile(port int, destDir string) error {
+	options := DefaultTransferOptions()
 	// Start TCP listener
 	listener, err := net.Listen("tcp", net.JoinHostPort("", fmt.Sprintf("%d", port)))
 	if err != nil {
@@ -79,62 +514,337 @@ func ReceiveFile(port int, destDir string) error {
 
 	fmt.Printf("Listening on port %d...\n", port)
 
-	// Accept connection
-	conn, err := listener.Accept()
-	if err != nil {
-		return fmt.Errorf("failed to accept connection: %v", err)
+	for {
+		// Accept connection
+		conn, err := listener.Accept()
+		if err != nil {
+			return fmt.Errorf("failed to accept connection: %v", err)
+		}
+
+		err = receiveFileFromConnection(conn, destDir, options)
+		conn.Close()
+		if err != errProbeAnswered {
+			return err
+		}
 	}
-	defer conn.Close()
+}
 
-	fmt.Printf("Connection established with %s\n", conn.RemoteAddr())
+// ReceiveFileWithTimeout receives a file, waiting up to timeout for a sender
+// and dropping the connection if it is idle for as long. Zero means no timeout.
+func ReceiveFileWithTimeout(port int, timeout time.Duration, destDir string) error {
+	return ReceiveFileWithOptions(port, timeout, destDir, DefaultTransferOptions())
+}
 
-	return receiveFileFromConnection(conn, destDir)
+// ReceiveFileWithOptions is ReceiveFileWithTimeout with progress reporting and other options
+func ReceiveFileWithOptions(port int, timeout time.Duration, destDir string, options TransferOptions) error {
+	return receive(port, timeout, destDir, options, false)
 }
 
-// ReceiveFileWithTimeout receives a file with connection timeout
-func ReceiveFileWithTimeout(port int, timeout time.Duration, destDir string) error {
+// ReceiveLoop keeps the listener open and receives one transfer after another
+// until options.Context is cancelled. A failed transfer is reported and the
+// loop carries on with the next connection.
+func ReceiveLoop(port int, destDir string, options TransferOptions) error {
+	return receive(port, connectionTimeout, destDir, options, true)
+}
+
+// receive runs a listener and handles its connections. With loop unset it
+// returns after the first connection that is not a probe.
+func receive(port int, timeout time.Duration, destDir string, options TransferOptions, loop bool) error {
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
 		return fmt.Errorf("failed to start listener: %v", err)
 	}
 	defer listener.Close()
+	defer closeOnCancel(options.Context, listener)()
 
 	fmt.Printf("Listening on port %d...\n", port)
 
+	var fingerprint string
+	if options.TLS {
+		cert, certFingerprint, err := LocalCertificate()
+		if err != nil {
+			return err
+		}
+		fingerprint = certFingerprint
+		options.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+		fmt.Println("🔒 TLS enabled, only encrypted transfers are accepted")
+		fmt.Printf("   Certificate fingerprint: %s\n", fingerprint)
+		fmt.Println("   Senders should see the same fingerprint when they connect")
+	}
+
+	// The self checks are answered by the accept loop, so they are made in
+	// the background and show up there before any real sender
+	checks := newSelfChecks()
+	go func() {
+		card := newConnectionCard(port, options, fingerprint, checks)
+		if err := publishConnectionCard(card); err != nil {
+			fmt.Printf("⚠️  Could not save connection card: %v\n", err)
+		}
+		if options.ListeningFunc != nil {
+			options.ListeningFunc(card)
+		}
+	}()
+	defer WithdrawConnectionCard(port)
+
+	options.notify(StateListening, "", "", nil)
+
 	// Set accept timeout
-	if tcpListener, ok := listener.(*net.TCPListener); ok {
+	if tcpListener, ok := listener.(*net.TCPListener); ok && !loop && timeout > 0 {
 		tcpListener.SetDeadline(time.Now().Add(timeout))
 	}
 
-	conn, err := listener.Accept()
-	if err != nil {
-		return fmt.Errorf("failed to accept connection: %v", err)
+	// Give targeted advice if nothing ever connects, typically a firewall
+	adviceTimer := time.AfterFunc(firstConnectionWindow, func() { printNoConnectionAdvice(port) })
+	defer adviceTimer.Stop()
+
+	limiter, unregister := newReceiverLimiter(port, options)
+	defer unregister()
+
+	if loop {
+		return acceptConcurrently(listener, port, timeout, destDir, options, adviceTimer, checks, limiter)
 	}
-	defer conn.Close()
 
-	fmt.Printf("Connection established with %s\n", conn.RemoteAddr())
+	for {
+		conn, err := listener.Accept()
+		if cancelled(options.Context) {
+			return errCancelled
+		}
+		if err != nil {
+			return fmt.Errorf("failed to accept connection: %v", err)
+		}
+		if checks.claim(conn) {
+			conn.Close()
+			continue
+		}
+		if refused(conn, options.Access) {
+			continue
+		}
+		release, err := limiter.Acquire(conn.RemoteAddr())
+		if err != nil {
+			sendBusy(conn, err)
+			continue
+		}
+		adviceTimer.Stop()
+
+		err = handleConnection(conn, timeout, destDir, options)
+		release()
+		if cancelled(options.Context) {
+			return errCancelled
+		}
+		if err != errProbeAnswered {
+			return err
+		}
+	}
+}
+
+// acceptConcurrently handles each connection in its own goroutine, at most
+// options.MaxConcurrentReceives at a time, until the listener is closed.
+// Connections within the limiter's limits wait for a free slot; the rest
+// are turned away.
+func acceptConcurrently(listener net.Listener, port int, timeout time.Duration, destDir string, options TransferOptions, adviceTimer *time.Timer, checks *selfChecks, limiter *access.Limiter) error {
+	limit := options.MaxConcurrentReceives
+	if limit <= 0 {
+		limit = 1
+	}
+	slots := make(chan struct{}, limit)
+
+	var handlers sync.WaitGroup
+	defer handlers.Wait()
+	var active int32 // Connections being handled
+
+	var ctxDone <-chan struct{}
+	if options.Context != nil {
+		ctxDone = options.Context.Done()
+	}
+
+	for {
+		conn, err := listener.Accept()
+		if cancelled(options.Context) {
+			return errCancelled
+		}
+		if err != nil {
+			return fmt.Errorf("failed to accept connection: %v", err)
+		}
+		if checks.claim(conn) {
+			conn.Close()
+			continue
+		}
+		if refused(conn, options.Access) {
+			continue
+		}
+		release, err := limiter.Acquire(conn.RemoteAddr())
+		if err != nil {
+			sendBusy(conn, err)
+			continue
+		}
+		adviceTimer.Stop()
+
+		handlers.Add(1)
+		go func() {
+			defer handlers.Done()
+			defer release()
 
-	// Set read/write timeouts for security
-	conn.SetReadDeadline(time.Now().Add(timeout))
-	conn.SetWriteDeadline(time.Now().Add(timeout))
+			select {
+			case slots <- struct{}{}:
+			case <-ctxDone:
+				conn.Close()
+				return
+			}
+			defer func() { <-slots }()
+			atomic.AddInt32(&active, 1)
 
-	return receiveFileFromConnection(conn, destDir)
+			err := handleConnection(conn, timeout, destDir, options)
+			if err != nil && err != errProbeAnswered && !cancelled(options.Context) {
+				connPrintf(conn, "Transfer failed: %v\n", err)
+			}
+			if atomic.AddInt32(&active, -1) == 0 && !cancelled(options.Context) {
+				fmt.Printf("Waiting for the next transfer on port %d...\n", port)
+			}
+		}()
+	}
+}
+
+// refused closes conn and logs it if the access rules don't let its address
+// in, before anything has been read from it. Blocked peers are closed
+// without a word, see access.Blocklist.
+func refused(conn net.Conn, rules access.Rules) bool {
+	if access.RefuseBlocked(conn.RemoteAddr()) != nil {
+		conn.Close()
+		return true
+	}
+	if err := rules.Check(conn.RemoteAddr()); err != nil {
+		fmt.Printf("🚫 Refused connection from %s: %v\n", conn.RemoteAddr(), err)
+		conn.Close()
+		return true
+	}
+	return false
+}
+
+// handleConnection receives a batch from one connection and closes it
+func handleConnection(conn net.Conn, timeout time.Duration, destDir string, options TransferOptions) error {
+	defer conn.Close()
+
+	defer closeOnCancel(options.Context, conn)()
+
+	// Drop connections that stall for the timeout, however long the transfer runs
+	conn, err := acceptTLS(withIdleTimeout(conn, timeout), options.tlsConfig)
+	if err != nil {
+		return err
+	}
+	return receiveFileFromConnection(conn, destDir, options)
 }
 
 // receiveFileFromConnection handles the file reception from an established connection
-func receiveFileFromConnection(conn net.Conn, destDir string) error {
+func receiveFileFromConnection(conn net.Conn, destDir string, options TransferOptions) error {
+	var batch batchHeader
+	if err := readMessage(conn, &batch); err != nil {
+		return fmt.Errorf("failed to read batch header: %v", err)
+	}
+	if batch.Probe {
+		var err error
+		if len(batch.Query) > 0 && options.PIN == "" {
+			err = answerQuery(conn, batch, destDir, options)
+		} else {
+			err = answerProbe(conn, options.PIN != "")
+		}
+		if err != nil {
+			return fmt.Errorf("failed to answer probe: %v", err)
+		}
+		return errProbeAnswered
+	}
+
+	if err := authenticateReceiver(conn, batch, options.PIN); err != nil {
+		return err
+	}
+
+	peer := conn.RemoteAddr().String()
+	options.notify(StateConnected, "", peer, nil)
+	if batch.AppVersion != "" {
+		connPrintf(conn, "Connection established (BitShare %s)\n", batch.AppVersion)
+	} else {
+		connPrintf(conn, "Connection established\n")
+	}
+	if batch.Count <= 0 || batch.Count > maxBatchFiles {
+		return fmt.Errorf("invalid file count: %d", batch.Count)
+	}
+	if options.output != nil {
+		return receiveToWriter(conn, batch, options)
+	}
+
+	failed := 0
+	for i := 0; i < batch.Count; i++ {
+		if batch.Count > 1 {
+			connPrintf(conn, "File %d of %d:\n", i+1, batch.Count)
+		}
+
+		err := receiveSingleFile(conn, destDir, options)
+		var fe *fileError
+		if errors.As(err, &fe) {
+			// This file failed but the connection is still in sync for the rest
+			connPrintf(conn, "Error: %v\n", err)
+			failed++
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if batch.Count > 1 {
+		connPrintf(conn, "Received %d of %d files\n", batch.Count-failed, batch.Count)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files failed", failed, batch.Count)
+	}
+	return nil
+}
+
+// receiveContent reads a file's data from conn into dst, remaining bytes of
+// it or, for a stream, up to limit bytes followed by the trailer, which
+// fills in the header's size and checksum
+func receiveContent(conn net.Conn, dst io.Writer, progress *progressTracker, header *fileHeader, compressed bool, remaining, limit int64, bufferSize int) (int64, error) {
+	if header.Size == streamSize {
+		n, err := receiveStreamData(dst, progress.wireReader(conn), compressed, limit)
+		if err != nil {
+			return n, err
+		}
+		if err := readStreamTrailer(conn, header, n); err != nil {
+			return n, err
+		}
+		progress.finish()
+		return n, nil
+	}
+	if compressed {
+		return decompressedCopy(dst, progress.wireReader(conn), remaining)
+	}
+	return copyBuffered(dst, progress.wireReader(conn), remaining, bufferSize)
+}
+
+// receiveSingleFile receives one file of a batch from an established connection
+func receiveSingleFile(conn net.Conn, destDir string, options TransferOptions) (err error) {
 	// Read filename and size
-	var filename string
-	var fileSize int64
-	_, err := fmt.Fscanf(conn, "%s\n%d\n", &filename, &fileSize)
-	if err != nil {
+	var header fileHeader
+	if err := readMessage(conn, &header); err != nil {
 		return fmt.Errorf("failed to read file metadata: %v", err)
 	}
+	if err := header.validate(); err != nil {
+		return fmt.Errorf("rejected file metadata: %v", err)
+	}
+	filename := header.Name
+	fileSize := header.Size
+	streaming := fileSize == streamSize
 
 	// Security checks
-	if fileSize <= 0 || fileSize > MaxFileSize {
+	if fileSize <= 0 && !streaming {
 		return fmt.Errorf("invalid file size: %d bytes", fileSize)
 	}
+	if err := checkFileSize(fileSize, options.MaxFileSize); err != nil {
+		// Tell the sender why, so it can move on to the next file in the batch
+		if err := writeMessage(conn, resumeOffer{Declined: err.Error()}); err != nil {
+			return fmt.Errorf("failed to decline file: %v", err)
+		}
+		return &fileError{fmt.Errorf("declined %s: %v", filepath.Base(filename), err)}
+	}
 
 	// Sanitize filename to prevent path traversal
 	filename = filepath.Base(filename)
@@ -142,6 +852,46 @@ func receiveFileFromConnection(conn net.Conn, destDir string) error {
 		return fmt.Errorf("invalid filename: %s", filename)
 	}
 
+	peer := conn.RemoteAddr().String()
+	if options.AcceptFunc != nil {
+		accept, saveAs := options.AcceptFunc(IncomingFile{Name: filename, Size: fileSize, Peer: peer})
+		if !accept {
+			if err := writeMessage(conn, resumeOffer{Declined: "rejected by the receiver"}); err != nil {
+				return fmt.Errorf("failed to decline file: %v", err)
+			}
+			return &fileError{fmt.Errorf("rejected %s", filename)}
+		}
+		if saveAs = filepath.Base(saveAs); saveAs != "" && saveAs != "." && saveAs != ".." && saveAs != string(filepath.Separator) {
+			filename = saveAs
+		}
+	}
+
+	options.notify(StateReceiving, filename, peer, nil)
+	started := time.Now()
+	var events *transferEvents
+	var progress *progressTracker
+	defer func() {
+		if events != nil {
+			events.end(err, options.Context, events.statsOf(progress))
+		}
+		if err != nil {
+			options.notify(StateFileFailed, filename, peer, err)
+			recordOutcome(HistoryEntry{
+				Direction: DirectionReceived,
+				Peer:      peer,
+				FileName:  filename,
+				FileSize:  max(fileSize, 0),
+				Checksum:  header.Checksum,
+				Duration:  time.Since(started),
+			}, err, options.Context)
+		} else {
+			options.notify(StateFileDone, filename, peer, nil)
+		}
+	}()
+
+	// Pick the destination by file type before anything touches the disk
+	destDir, routedBy := routeFile(filename, destDir, options.Routes)
+
 	// Ensure destination directory exists
 	if destDir != "" {
 		if err := os.MkdirAll(destDir, 0755); err != nil {
@@ -149,8 +899,24 @@ func receiveFileFromConnection(conn net.Conn, destDir string) error {
 		}
 	}
 
-	// Create output file with original filename in the destination directory
-	outputPath := filepath.Join(destDir, filename)
+	// Create output file with original filename in the destination directory,
+	// unless a file of that name is already there
+	outputPath, declined, err := resolveCollision(filepath.Join(destDir, filename), options.CollisionPolicy)
+	if err != nil {
+		return err
+	}
+	if declined == "" {
+		defer releasePath(outputPath)
+	}
+	if declined != "" {
+		if err := writeMessage(conn, resumeOffer{Declined: declined}); err != nil {
+			return fmt.Errorf("failed to decline file: %v", err)
+		}
+		if options.CollisionPolicy == CollisionSkip {
+			return &fileError{fmt.Errorf("skipped %s: %s", filename, declined)}
+		}
+		return &fileError{fmt.Errorf("declined %s: %s", filename, declined)}
+	}
 
 	// Get absolute path for user-friendly output
 	absPath, err := filepath.Abs(outputPath)
@@ -159,24 +925,263 @@ func receiveFileFromConnection(conn net.Conn, destDir string) error {
 		// This is not a fatal error for the transfer itself.
 		absPath = outputPath
 	}
-	fmt.Printf("Receiving file: %s (%s) -> %s\n", filename, utils.FormatBytes(fileSize), absPath)
+	if streaming {
+		connPrintf(conn, "Receiving stream: %s -> %s\n", filename, absPath)
+	} else {
+		connPrintf(conn, "Receiving file: %s (%s) -> %s\n", filename, utils.FormatBytes(fileSize), absPath)
+	}
+	if routedBy != "" {
+		connPrintf(conn, "Routed to %s by rule %s\n", destDir, routedBy)
+	}
 
-	outputFile, err := os.Create(outputPath)
+	// Write into a .part file so an interrupted transfer can be resumed, and
+	// so the final name only ever holds a complete file
+	partPath := partialPath(outputPath, options.Resume && !streaming)
+	partFile, offset, err := openPartialFile(partPath, fileSize)
 	if err != nil {
 		return fmt.Errorf("failed to create output file: %v", err)
 	}
-	defer outputFile.Close()
+	defer partFile.Close()
+	if streaming || !options.Resume {
+		// Partial data that won't be resumed is of no use
+		defer func() {
+			if err != nil {
+				partFile.Close()
+				os.Remove(partPath)
+			}
+		}()
+	}
+
+	// Refuse up front rather than filling the disk part way through. For a
+	// stream only the safety margin can be checked.
+	if err := checkDiskSpace(destDir, max(fileSize-offset, 0)); err != nil {
+		partFile.Close()
+		if offset == 0 {
+			os.Remove(partPath)
+		}
+		if err := writeMessage(conn, resumeOffer{Declined: err.Error()}); err != nil {
+			return fmt.Errorf("failed to decline file: %v", err)
+		}
+		return &fileError{fmt.Errorf("declined %s: %v", filename, err)}
+	}
+
+	offer := resumeOffer{Offset: offset}
+	if header.Compression == compressionGzip && options.CompressData {
+		offer.Compression = compressionGzip
+	}
+	if offset > 0 {
+		offer.TailChecksum, err = tailChecksum(partFile, offset)
+		if err != nil {
+			return fmt.Errorf("failed to read partial file: %v", err)
+		}
+	}
+	if err := writeMessage(conn, offer); err != nil {
+		return fmt.Errorf("failed to send resume offer: %v", err)
+	}
+
+	var decision resumeDecision
+	if err := readMessage(conn, &decision); err != nil {
+		return fmt.Errorf("failed to read resume decision: %v", err)
+	}
+
+	hasher := sha256.New()
+	if decision.Offset > 0 && decision.Offset == offset {
+		connPrintf(conn, "Resuming %s from %s\n", filename, utils.FormatBytes(offset))
+		// Hash the data we already have so the checksum covers the whole file
+		if _, err := io.Copy(hasher, io.NewSectionReader(partFile, 0, offset)); err != nil {
+			return fmt.Errorf("failed to read partial file: %v", err)
+		}
+	} else {
+		offset = 0
+		if err := partFile.Truncate(0); err != nil {
+			return fmt.Errorf("failed to reset partial file: %v", err)
+		}
+	}
 
-	// Receive file content
-	bytesReceived, err := io.CopyN(outputFile, conn, fileSize)
+	if _, err := partFile.Seek(offset, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek in partial file: %v", err)
+	}
+
+	// Receive file content, hashing it as it is written
+	progress = newProgressTracker(fileSize, options)
+	progress.peer = conn.RemoteAddr().String()
+	events = startTransfer(DirectionReceived, peer, filename, fileSize)
+	events.track(progress)
+	if offset > 0 {
+		progress.skip(offset)
+	}
+	buffered := bufio.NewWriterSize(partFile, options.bufferSize())
+	bytesReceived, err := receiveContent(conn, progress.writer(io.MultiWriter(buffered, hasher)), progress, &header, offer.Compression != "", fileSize-offset, options.MaxFileSize, options.bufferSize())
+	if flushErr := buffered.Flush(); err == nil {
+		err = flushErr
+	}
 	if err != nil {
+		// Tell the sender why, in case the problem is on this side
+		reportFailure(conn, err)
+	}
+	if streaming {
+		if err != nil {
+			return fmt.Errorf("failed to receive stream: %v", err)
+		}
+		fileSize = header.Size
+	}
+	bytesReceived += offset
+	if err != nil && !options.Resume {
 		return fmt.Errorf("failed to receive file content: %v", err)
 	}
+	if isDiskFull(err) {
+		return fmt.Errorf("disk full while receiving %s (partial data kept in %s, free up space and send again to resume): %v", filename, partPath, err)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to receive file content (partial data kept in %s, send again to resume): %v", partPath, err)
+	}
 
 	if bytesReceived != fileSize {
 		return fmt.Errorf("incomplete transfer: received %d bytes, expected %d bytes", bytesReceived, fileSize)
 	}
 
-	fmt.Printf("Successfully received %s (%s) at %s\n", filename, utils.FormatBytes(bytesReceived), absPath)
+	result := transferResult{BytesWritten: bytesReceived, Checksum: hex.EncodeToString(hasher.Sum(nil))}
+	if result.Checksum != header.Checksum {
+		partFile.Close()
+		os.Remove(partPath)
+		result.Error = fmt.Sprintf("checksum mismatch (expected %s, got %s)", header.Checksum, result.Checksum)
+		writeMessage(conn, result)
+		return &fileError{fmt.Errorf("received file is corrupt and was deleted: %s", result.Error)}
+	}
+
+	// The transfer is complete, give the file its final name once its data
+	// is on disk
+	if err := partFile.Sync(); err != nil {
+		result.Error = fmt.Sprintf("failed to write received file to disk: %v", err)
+		writeMessage(conn, result)
+		return errors.New(result.Error)
+	}
+	partFile.Close()
+	if err := os.Rename(partPath, outputPath); err != nil {
+		result.Error = fmt.Sprintf("failed to move received file into place: %v", err)
+		writeMessage(conn, result)
+		return &fileError{errors.New(result.Error)}
+	}
+	if options.PreserveMetadata {
+		if err := applyMetadata(outputPath, header); err != nil {
+			connPrintf(conn, "Warning: could not keep the modification time and permissions of %s: %v\n", filename, err)
+		}
+	}
+
+	result.OK = true
+	result.SavedAs = filepath.Base(outputPath)
+	if err := writeMessage(conn, result); err != nil {
+		connPrintf(conn, "Warning: could not confirm receipt to sender: %v\n", err)
+	}
+
+	var modTime time.Time
+	if info, err := os.Stat(outputPath); err == nil {
+		modTime = info.ModTime()
+	}
+
+	entry := RecordTransfer(HistoryEntry{
+		Direction: DirectionReceived,
+		Peer:      conn.RemoteAddr().String(),
+		FileName:  filepath.Base(outputPath),
+		FilePath:  absPath,
+		FileSize:  bytesReceived,
+		Checksum:  result.Checksum,
+		ModTime:   modTime,
+		Duration:  time.Since(started),
+	})
+
+	connPrintf(conn, "Successfully received %s (%s) at %s [history #%d]\n", filename, utils.FormatBytes(bytesReceived), absPath, entry.ID)
+	if savedAs := filepath.Base(outputPath); savedAs != filename {
+		connPrintf(conn, "A file named %s already existed, saved as %s\n", filename, savedAs)
+	}
 	return nil
 }
+
+// reportFailure tells the sender why the data stopped being taken. The
+// sender is still writing, so it only reads this once its writes fail.
+func reportFailure(conn net.Conn, err error) {
+	reason := err.Error()
+	if isDiskFull(err) {
+		reason = "the receiver's disk is full"
+	}
+	conn.SetWriteDeadline(time.Now().Add(receiverFailureWait))
+	writeMessage(conn, transferResult{Error: reason})
+	conn.SetWriteDeadline(time.Time{})
+}
+
+// connPrintf prints a line about a connection, prefixed with the remote
+// address so output from concurrent transfers can be told apart
+func connPrintf(conn net.Conn, format string, args ...interface{}) {
+	fmt.Printf("[%s] "+format, append([]interface{}{conn.RemoteAddr()}, args...)...)
+}
+
+// errCancelled is returned when a transfer is stopped through its context
+var errCancelled = errors.New("cancelled")
+
+// closeOnCancel closes c when ctx is cancelled so that blocked accepts, reads
+// and writes return. The returned function stops watching ctx.
+func closeOnCancel(ctx context.Context, c io.Closer) func() {
+	if ctx == nil {
+		return func() {}
+	}
+
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-stop:
+		}
+	}()
+	return func() { close(stop) }
+}
+
+// cancelled reports whether ctx, which may be nil, has been cancelled
+func cancelled(ctx context.Context) bool {
+	return ctx != nil && ctx.Err() != nil
+}
+
+// dial connects to the receiver at address, with options.Dial if set
+func (options TransferOptions) dial(ctx context.Context, address string) (net.Conn, error) {
+	ctx = contextOrBackground(ctx)
+	if options.Dial != nil {
+		return options.Dial(ctx, address)
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", address)
+}
+
+func contextOrBackground(ctx context.Context) context.Context {
+	if ctx == nil {
+		return context.Background()
+	}
+	return ctx
+}
+
+// checkFileSize enforces a file size limit, where a limit of 0 means unlimited
+func checkFileSize(size, limit int64) error {
+	if limit > 0 && size > limit {
+		return fmt.Errorf("file too large: %s exceeds the configured limit of %s",
+			utils.FormatBytes(size), utils.FormatBytes(limit))
+	}
+	return nil
+}
+
+// FileChecksum calculates the hex encoded SHA-256 checksum of a file
+func FileChecksum(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	buffer, release := getBuffer(DefaultBufferSize)
+	defer release()
+
+	hasher := sha256.New()
+	if _, err := io.CopyBuffer(hasher, file, buffer); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
@@ -0,0 +1,61 @@
+package transfer
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"fileshare/internal/utils"
+)
+
+// TestSendIPv6 sends to a receiver over IPv6 loopback, given the address
+// the way a user writes it
+func TestSendIPv6(t *testing.T) {
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	isolateDataDir(t)
+	source, data := writeTestFile(t, t.TempDir(), "six.bin", 64*1024)
+
+	for _, written := range []string{"::1", "[::1]"} {
+		t.Run(written, func(t *testing.T) {
+			dir := t.TempDir()
+			received := make(chan error, 1)
+			go func() { received <- ReceiveFileWithOptions(port, 10*time.Second, dir, testOptions()) }()
+			time.Sleep(50 * time.Millisecond)
+
+			host, ok := utils.ParseIPHost(written)
+			if !ok {
+				t.Fatalf("%q isn't taken as an IP address", written)
+			}
+			options := testOptions()
+			options.SkipQuery = true
+			if err := SendFilesWithOptions([]string{source}, host, port, options); err != nil {
+				t.Fatal(err)
+			}
+			if err := <-received; err != nil {
+				t.Fatal(err)
+			}
+			got, err := os.ReadFile(filepath.Join(dir, "six.bin"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Error("received file differs from the one sent")
+			}
+
+			// The send is recorded against the address in its usual form
+			history := GetHistory()
+			if len(history) == 0 || history[0].Direction != DirectionSent || history[0].Peer != net.JoinHostPort("::1", strconv.Itoa(port)) {
+				t.Errorf("history records the send as %+v", history)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package ui
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Line editing
+//
+// The interactive shell reads its commands with a LineReader. On a terminal
+// it can put in raw mode (see makeRaw) it echoes and edits the line itself,
+// so Tab can complete the word being typed with what a Completer offers: a
+// single choice is filled in, several are filled in as far as they agree and
+// listed when that adds nothing. Backspace, Ctrl+W and Ctrl+U delete a
+// character, a word and the line. Elsewhere, such as on Windows or when the
+// input is a pipe, lines are read whole as they come.
+//
+// Raw mode here only turns off echo and line buffering, so what other
+// goroutines print while a line is typed still comes out right and Ctrl+C
+// still interrupts.
+
+// Completer returns the words that can go where the last word of line, what
+// was typed so far, is; those that don't start with that word are left out
+type Completer func(line string) []string
+
+// LineReader reads the lines typed at the shell, see above
+type LineReader struct {
+	in       *os.File
+	out      io.Writer
+	buffered *bufio.Reader
+	complete Completer
+	saved    *termState // The terminal's mode while a line is read in raw mode
+	mutex    sync.Mutex
+}
+
+// NewLineReader returns a LineReader reading from in and echoing to out,
+// completing words with complete, which may be nil
+func NewLineReader(in *os.File, out io.Writer, complete Completer) *LineReader {
+	return &LineReader{
+		in:       in,
+		out:      out,
+		buffered: bufio.NewReader(in),
+		complete: complete,
+	}
+}
+
+// ReadLine prints prompt and returns the line typed after it, without the
+// line break
+func (r *LineReader) ReadLine(prompt string) (string, error) {
+	fmt.Fprint(r.out, prompt)
+	state, err := makeRaw(r.in)
+	if err != nil {
+		line, err := r.buffered.ReadString('\n')
+		return strings.TrimRight(line, "\r\n"), err
+	}
+	r.mutex.Lock()
+	r.saved = state
+	r.mutex.Unlock()
+	defer r.Restore()
+
+	return editLine(r.buffered, r.out, prompt, r.complete)
+}
+
+// Restore puts the terminal back in the mode it was in before ReadLine, for
+// when the program exits while a line is read
+func (r *LineReader) Restore() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.saved != nil {
+		restoreTerminal(r.in, r.saved)
+		r.saved = nil
+	}
+}
+
+// Keys editLine handles
+const (
+	keyCtrlD     = 4
+	keyBackspace = 8
+	keyTab       = '\t'
+	keyCtrlU     = 21
+	keyCtrlW     = 23
+	keyEscape    = 27
+	keyDelete    = 127
+)
+
+// editLine reads a line from in a key at a time, echoing it and its edits
+// to out after prompt, see above
+func editLine(in io.RuneReader, out io.Writer, prompt string, complete Completer) (string, error) {
+	var line []rune
+	redraw := func() {
+		fmt.Fprintf(out, "\r\033[K%s%s", prompt, string(line))
+	}
+	for {
+		key, _, err := in.ReadRune()
+		if err != nil {
+			return string(line), err
+		}
+		switch key {
+		case '\r', '\n':
+			fmt.Fprint(out, "\r\n")
+			return string(line), nil
+		case keyCtrlD:
+			if len(line) == 0 {
+				fmt.Fprint(out, "\r\n")
+				return "", io.EOF
+			}
+		case keyBackspace, keyDelete:
+			if len(line) > 0 {
+				line = line[:len(line)-1]
+				redraw()
+			}
+		case keyCtrlW:
+			end := len(line)
+			for end > 0 && line[end-1] == ' ' {
+				end--
+			}
+			for end > 0 && line[end-1] != ' ' {
+				end--
+			}
+			line = line[:end]
+			redraw()
+		case keyCtrlU:
+			line = line[:0]
+			redraw()
+		case keyTab:
+			if complete == nil {
+				continue
+			}
+			completed, choices := completeWord(string(line), complete(string(line)))
+			switch {
+			case choices != nil:
+				fmt.Fprintf(out, "\r\n%s\r\n", strings.Join(choices, "  "))
+				redraw()
+			case completed != string(line):
+				line = []rune(completed)
+				redraw()
+			default:
+				fmt.Fprint(out, "\a")
+			}
+		case keyEscape:
+			skipEscapeSequence(in)
+		default:
+			if key < ' ' {
+				continue
+			}
+			line = append(line, key)
+			fmt.Fprint(out, string(key))
+		}
+	}
+}
+
+// skipEscapeSequence reads the rest of a sequence the terminal sends for a
+// key such as an arrow, which editLine doesn't handle
+func skipEscapeSequence(in io.RuneReader) {
+	key, _, err := in.ReadRune()
+	if err != nil || key != '[' && key != 'O' {
+		return
+	}
+	for {
+		key, _, err := in.ReadRune()
+		if err != nil || key >= 0x40 && key <= 0x7e {
+			return
+		}
+	}
+}
+
+// completeWord completes the last word of line with the choices that start
+// with it: it returns line with the word filled in as far as they agree,
+// and, when that adds nothing and there are several, the choices to list
+func completeWord(line string, choices []string) (string, []string) {
+	word := line[strings.LastIndexByte(line, ' ')+1:]
+	var matches []string
+	for _, choice := range choices {
+		if strings.HasPrefix(choice, word) {
+			matches = append(matches, choice)
+		}
+	}
+	if len(matches) == 0 {
+		return line, nil
+	}
+	stem := line[:len(line)-len(word)]
+	if len(matches) == 1 {
+		return stem + matches[0] + " ", nil
+	}
+
+	common := matches[0]
+	for _, match := range matches[1:] {
+		for !strings.HasPrefix(match, common) {
+			common = common[:len(common)-1]
+		}
+	}
+	if len(common) > len(word) {
+		return stem + common, nil
+	}
+	return line, matches
+}
@@ -0,0 +1,64 @@
+package ui
+
+import (
+	"io"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCompleteWord(t *testing.T) {
+	choices := []string{"last", "12", "125", "7"}
+	tests := []struct {
+		line      string
+		completed string
+		listed    []string
+	}{
+		{"forward ", "forward ", []string{"last", "12", "125", "7"}},
+		{"forward l", "forward last ", nil},
+		{"forward 1", "forward 12", nil},
+		{"forward 12", "forward 12", []string{"12", "125"}},
+		{"forward 9", "forward 9", nil},
+	}
+	for _, test := range tests {
+		completed, listed := completeWord(test.line, choices)
+		if completed != test.completed || !slices.Equal(listed, test.listed) {
+			t.Errorf("completeWord(%q) = %q, %q, want %q, %q", test.line, completed, listed, test.completed, test.listed)
+		}
+	}
+}
+
+// TestEditLine checks the keys typed are edited into the line read
+func TestEditLine(t *testing.T) {
+	complete := func(line string) []string {
+		if strings.HasPrefix(line, "forward ") {
+			return []string{"last", "42"}
+		}
+		return nil
+	}
+	tests := []struct {
+		name  string
+		keys  string
+		line  string
+		isEOF bool
+	}{
+		{"typed", "status\r", "status", false},
+		{"backspace", "statuz\x7fs\r", "status", false},
+		{"word deleted", "forward last\x17peer\r", "forward peer", false},
+		{"line deleted", "junk\x15peers\r", "peers", false},
+		{"completed", "forward l\tbob\r", "forward last bob", false},
+		{"arrow ignored", "pe\x1b[Ders\r", "peers", false},
+		{"end of input", "\x04", "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			line, err := editLine(strings.NewReader(test.keys), io.Discard, "> ", complete)
+			if (err == io.EOF) != test.isEOF || err != nil && err != io.EOF {
+				t.Fatalf("got error %v", err)
+			}
+			if line != test.line {
+				t.Errorf("read %q, want %q", line, test.line)
+			}
+		})
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+
+package ui
+
+import (
+	"errors"
+	"os"
+)
+
+// termState is a terminal's mode, which there is no way to change here
+type termState struct{}
+
+// makeRaw is only implemented where termios is; elsewhere lines are read
+// whole, without completion
+func makeRaw(file *os.File) (*termState, error) {
+	return nil, errors.New("raw mode is not supported on this system")
+}
+
+func restoreTerminal(file *os.File, state *termState) error {
+	return nil
+}
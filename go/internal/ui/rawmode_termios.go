@@ -0,0 +1,45 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package ui
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// termState is a terminal's mode, to restore after makeRaw
+type termState struct {
+	termios syscall.Termios
+}
+
+// makeRaw turns off echo and line buffering on the terminal file is, see
+// lineeditor.go, and returns the mode it was in. It fails when file isn't a
+// terminal.
+func makeRaw(file *os.File) (*termState, error) {
+	var state termState
+	if err := ioctlTermios(file, ioctlGetTermios, &state.termios); err != nil {
+		return nil, err
+	}
+	raw := state.termios
+	raw.Lflag &^= syscall.ICANON | syscall.ECHO
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+	if err := ioctlTermios(file, ioctlSetTermios, &raw); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// restoreTerminal puts the terminal file is back in state
+func restoreTerminal(file *os.File, state *termState) error {
+	return ioctlTermios(file, ioctlSetTermios, &state.termios)
+}
+
+func ioctlTermios(file *os.File, request uintptr, termios *syscall.Termios) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), request, uintptr(unsafe.Pointer(termios)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -7,15 +7,19 @@ import (
 	"time"
 
 	"fileshare/internal/mesh"
+	"fileshare/internal/utils"
 )
 
-// TerminalUI manages terminal-based user interface
+// TerminalUI manages terminal-based user interface. The active screen is
+// redrawn when it changes and when the mesh reports a change (see
+// mesh.Subscribe).
 type TerminalUI struct {
 	isRunning    bool
-	refreshRate  time.Duration
 	width        int
 	height       int
 	activeScreen string
+	redraw       chan struct{} // Asks for a redraw after the screen changed
+	unsubscribe  func()        // Ends the mesh event subscription of the refresh loop
 	mutex        sync.RWMutex
 }
 
@@ -27,6 +31,7 @@ type TransferProgress struct {
 	StartTime     time.Time
 	Status        string // "pending", "transferring", "complete", "failed"
 	SpeedBps      int64  // Bytes per second
+	ETA           time.Duration
 	Error         error
 }
 
@@ -40,10 +45,10 @@ func GetTerminalUI() *TerminalUI {
 	uiOnce.Do(func() {
 		termUI = &TerminalUI{
 			isRunning:    false,
-			refreshRate:  time.Second,
 			width:        80,
 			height:       24,
 			activeScreen: "dashboard",
+			redraw:       make(chan struct{}, 1),
 		}
 	})
 	return termUI
@@ -68,7 +73,9 @@ func (ui *TerminalUI) Start() error {
 	ui.isRunning = true
 
 	// Start UI refresh goroutine
-	go ui.refreshLoop()
+	events, unsubscribe := mesh.Subscribe()
+	ui.unsubscribe = unsubscribe
+	go ui.refreshLoop(events)
 
 	return nil
 }
@@ -79,34 +86,42 @@ func (ui *TerminalUI) Stop() {
 	defer ui.mutex.Unlock()
 
 	ui.isRunning = false
+	if ui.unsubscribe != nil {
+		ui.unsubscribe()
+		ui.unsubscribe = nil
+	}
 }
 
 // ShowDashboard displays the main dashboard
 func (ui *TerminalUI) ShowDashboard() {
-	ui.mutex.Lock()
-	ui.activeScreen = "dashboard"
-	ui.mutex.Unlock()
+	ui.showScreen("dashboard")
 }
 
 // ShowPeerList displays the list of peers
 func (ui *TerminalUI) ShowPeerList() {
-	ui.mutex.Lock()
-	ui.activeScreen = "peers"
-	ui.mutex.Unlock()
+	ui.showScreen("peers")
 }
 
 // ShowTransferStatus displays file transfer status
 func (ui *TerminalUI) ShowTransferStatus() {
-	ui.mutex.Lock()
-	ui.activeScreen = "transfers"
-	ui.mutex.Unlock()
+	ui.showScreen("transfers")
 }
 
 // ShowNetworkMap displays the mesh network topology
 func (ui *TerminalUI) ShowNetworkMap() {
+	ui.showScreen("network")
+}
+
+// showScreen makes screen the active one and redraws it
+func (ui *TerminalUI) showScreen(screen string) {
 	ui.mutex.Lock()
-	ui.activeScreen = "network"
+	ui.activeScreen = screen
 	ui.mutex.Unlock()
+
+	select {
+	case ui.redraw <- struct{}{}:
+	default: // A redraw is already pending
+	}
 }
 
 // UpdateTransferProgress updates the progress of a file transfer
@@ -115,7 +130,7 @@ func (ui *TerminalUI) UpdateTransferProgress(progress TransferProgress) {
 	// For this placeholder, just print progress to console
 	percentComplete := float64(progress.BytesComplete) / float64(progress.FileSize) * 100
 
-	if progress.Status == "transferring" {
+	if progress.Status == "transferring" && progress.SpeedBps == 0 {
 		elapsed := time.Since(progress.StartTime).Seconds()
 		if elapsed > 0 {
 			progress.SpeedBps = int64(float64(progress.BytesComplete) / elapsed)
@@ -124,16 +139,37 @@ func (ui *TerminalUI) UpdateTransferProgress(progress TransferProgress) {
 
 	speedMBps := float64(progress.SpeedBps) / (1024 * 1024)
 
-	fmt.Printf("\rTransfer: %s - %.1f%% complete (%.2f MB/s)",
-		progress.FileName, percentComplete, speedMBps)
+	eta := "--"
+	if progress.ETA > 0 {
+		eta = utils.FormatDuration(progress.ETA)
+	}
+
+	// Trailing spaces clear what is left of a longer previous line
+	if progress.FileSize < 0 {
+		fmt.Printf("\rTransfer: %s - %s so far — %.1f MB/s    ",
+			progress.FileName, utils.FormatBytes(progress.BytesComplete), speedMBps)
+		return
+	}
+	fmt.Printf("\rTransfer: %s - %s / %s (%.0f%%) — %.1f MB/s — ETA %s    ",
+		progress.FileName, utils.FormatBytes(progress.BytesComplete), utils.FormatBytes(progress.FileSize),
+		percentComplete, speedMBps, eta)
 }
 
 // Helper methods
-func (ui *TerminalUI) refreshLoop() {
-	ticker := time.NewTicker(ui.refreshRate)
-	defer ticker.Stop()
+func (ui *TerminalUI) refreshLoop(events <-chan mesh.Event) {
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				// Stop ended the subscription
+				return
+			}
+			if !ui.affects(event) {
+				continue
+			}
+		case <-ui.redraw:
+		}
 
-	for range ticker.C {
 		ui.mutex.RLock()
 		if !ui.isRunning {
 			ui.mutex.RUnlock()
@@ -161,6 +197,22 @@ func (ui *TerminalUI) refreshLoop() {
 	}
 }
 
+// affects reports whether event changes what the active screen shows
+func (ui *TerminalUI) affects(event mesh.Event) bool {
+	ui.mutex.RLock()
+	screen := ui.activeScreen
+	ui.mutex.RUnlock()
+
+	switch screen {
+	case "dashboard":
+		return true
+	case "peers", "network":
+		return event.Peer != nil
+	default:
+		return false
+	}
+}
+
 func (ui *TerminalUI) renderDashboard(width, height int) {
 	// Render dashboard layout
 	title := "BitShare P2P Mesh Network"
@@ -171,13 +223,23 @@ func (ui *TerminalUI) renderDashboard(width, height int) {
 	fmt.Println(divider)
 
 	// Node status
-	nodeInfo := "Node: Unknown"
+	nodeInfo := "Node: Not running"
+	if mesh.IsNodeRunning() {
+		nodeInfo = fmt.Sprintf("Node: %s (%s)", mesh.GetNodeName(), networkModeName(mesh.GetNetworkMode()))
+	}
 	fmt.Println(nodeInfo)
 	fmt.Println()
 
 	// Network summary
+	peers, _ := mesh.GetKnownPeers()
+	online := 0
+	for _, peer := range peers {
+		if peer.IsOnline {
+			online++
+		}
+	}
 	fmt.Println("Network Status:")
-	fmt.Println("  Peers: 0 online, 0 total")
+	fmt.Printf("  Peers: %d online, %d total\n", online, len(peers))
 	fmt.Println("  Protocols: WiFi Direct, TCP/IP, Bluetooth")
 	fmt.Println()
 
@@ -260,9 +322,12 @@ func (ui *TerminalUI) renderNetworkMap(width, height int) {
 	fmt.Println(header)
 	fmt.Println(divider)
 
-	// This would show a text-based visualization of the network topology
-	fmt.Println("Network visualization not available in terminal mode.")
-	fmt.Println("Use 'list' command to see connected peers.")
+	topology, err := mesh.GetNetworkTopology()
+	if err != nil {
+		fmt.Println("Error retrieving the network map:", err)
+	} else {
+		PrintTopology(topology, width)
+	}
 
 	fmt.Println()
 	fmt.Println(divider)
@@ -270,6 +335,19 @@ func (ui *TerminalUI) renderNetworkMap(width, height int) {
 }
 
 // Helper functions
+func networkModeName(mode mesh.NetworkMode) string {
+	switch mode {
+	case mesh.DirectMode:
+		return "direct"
+	case mesh.RelayMode:
+		return "relayed"
+	case mesh.MixedMode:
+		return "direct and relayed"
+	default:
+		return "unknown network"
+	}
+}
+
 func centerText(text string, width int) string {
 	if len(text) >= width {
 		return text
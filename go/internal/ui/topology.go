@@ -0,0 +1,80 @@
+package ui
+
+import (
+	"fmt"
+	"strings"
+
+	"fileshare/internal/mesh"
+)
+
+// PrintTopology lists the nodes of topology grouped by how many hops away
+// they are, each with the nodes it links to, in lines up to width wide
+func PrintTopology(topology mesh.Topology, width int) {
+	names := make(map[string]string, len(topology.Nodes))
+	for _, node := range topology.Nodes {
+		names[node.ID] = nodeLabel(node)
+	}
+	links := make(map[string][]string)
+	for _, edge := range topology.Edges {
+		kind := fmt.Sprintf("%d%%", edge.Quality)
+		if edge.Relayed {
+			kind = "relayed"
+		}
+		links[edge.From] = append(links[edge.From], fmt.Sprintf("%s (%s)", linkedName(names, edge.To), kind))
+		links[edge.To] = append(links[edge.To], fmt.Sprintf("%s (%s)", linkedName(names, edge.From), kind))
+	}
+
+	group := -2
+	for _, node := range topology.Nodes {
+		if node.HopCount != group {
+			group = node.HopCount
+			switch {
+			case node.Local:
+				fmt.Println("This node:")
+			case group < 0:
+				fmt.Println("Unreachable:")
+			case group == 1:
+				fmt.Println("1 hop:")
+			default:
+				fmt.Printf("%d hops:\n", group)
+			}
+		}
+
+		state := "offline"
+		if node.Online {
+			state = "online"
+		}
+		if len(node.Protocols) > 0 {
+			state += ", " + strings.Join(node.Protocols, "/")
+		}
+		if node.Local {
+			state = "local"
+		}
+		fmt.Println(truncateString(fmt.Sprintf("  %s - %s", names[node.ID], state), width))
+		for _, link := range links[node.ID] {
+			fmt.Println(truncateString("      ↔ "+link, width))
+		}
+	}
+	if len(topology.Edges) == 0 {
+		fmt.Println("No links known yet, run 'scan' to discover nearby peers.")
+	}
+}
+
+// nodeLabel is the name of node with the start of its ID
+func nodeLabel(node mesh.TopologyNode) string {
+	id := node.ID
+	if len(id) > 8 {
+		id = id[:8]
+	}
+	if node.Name == "" {
+		return id
+	}
+	return fmt.Sprintf("%s (%s)", node.Name, id)
+}
+
+func linkedName(names map[string]string, id string) string {
+	if name, ok := names[id]; ok {
+		return name
+	}
+	return id
+}
@@ -1,15 +1,22 @@
 package updater
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
 	"time"
+
+	"fileshare/internal/utils"
+	"fileshare/internal/version"
 )
 
 const (
@@ -20,7 +27,14 @@ const (
 	ReleaseURL = "https://api.github.com/repos/yourusername/bitshare/releases/latest"
 
 	// Current version
-	Version = "1.0.0"
+	Version = version.Current
+
+	// Timeouts for talking to the release server
+	apiTimeout      = 30 * time.Second
+	downloadTimeout = 30 * time.Minute
+
+	// First retry delay after a failed background check, doubled on each failure
+	retryBackoff = time.Hour
 )
 
 var (
@@ -35,6 +49,9 @@ type UpdateSettings struct {
 	UpdateAvailable bool      `json:"update_available"`
 	NewVersion      string    `json:"new_version"`
 	DownloadURL     string    `json:"download_url"`
+	CABundle        string    `json:"ca_bundle,omitempty"`     // Extra CA certificates for TLS-intercepting proxies
+	FailureCount    int       `json:"failure_count,omitempty"` // Consecutive failed background checks
+	NextRetry       time.Time `json:"next_retry,omitempty"`
 }
 
 // ReleaseInfo stores information about a GitHub release
@@ -89,11 +106,14 @@ func CheckForUpdates(force bool) (*UpdateSettings, bool, error) {
 	settings.LastCheck = time.Now()
 
 	// Check for updates
-	release, err := getLatestRelease()
+	release, err := getLatestRelease(settings)
 	if err != nil {
-		return settings, false, err
+		return settings, false, diagnose(err)
 	}
 
+	settings.FailureCount = 0
+	settings.NextRetry = time.Time{}
+
 	// Check if version is newer
 	newVersion := strings.TrimPrefix(release.TagName, "v")
 	if isNewer(newVersion, Version) {
@@ -114,6 +134,63 @@ func CheckForUpdates(force bool) (*UpdateSettings, bool, error) {
 	return settings, settings.UpdateAvailable, err
 }
 
+// CheckForUpdatesQuietly runs the startup update check. Repeated failures are
+// collapsed into a single log line and retried with backoff instead of being
+// reported on every launch.
+func CheckForUpdatesQuietly() (*UpdateSettings, bool) {
+	settings, err := loadSettings()
+	if err != nil {
+		return nil, false
+	}
+
+	if time.Now().Before(settings.NextRetry) {
+		return settings, settings.UpdateAvailable
+	}
+
+	updated, available, err := CheckForUpdates(false)
+	if err == nil {
+		return updated, available
+	}
+
+	settings.FailureCount++
+	delay := retryBackoff << (settings.FailureCount - 1)
+	if delay <= 0 || delay > UpdateCheckInterval {
+		delay = UpdateCheckInterval
+	}
+	settings.NextRetry = time.Now().Add(delay)
+
+	if settings.FailureCount == 1 {
+		fmt.Printf("\nUpdate check failed, will retry %s (run 'bitshare update check' for details)\n",
+			utils.FormatTime(settings.NextRetry))
+	}
+
+	saveSettings(settings)
+	return settings, false
+}
+
+// SetCABundle configures an extra CA bundle used to verify the update server,
+// for networks with TLS-intercepting proxies. An empty path clears it.
+func SetCABundle(path string) error {
+	settings, err := loadSettings()
+	if err != nil {
+		return err
+	}
+
+	if path != "" {
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		if _, err := loadCertPool(absPath); err != nil {
+			return err
+		}
+		path = absPath
+	}
+
+	settings.CABundle = path
+	return saveSettings(settings)
+}
+
 // InstallUpdate downloads and installs the latest version
 func InstallUpdate() error {
 	settings, err := loadSettings()
@@ -132,9 +209,9 @@ func InstallUpdate() error {
 	// Download the update
 	fmt.Println("Downloading update...")
 	downloadPath := filepath.Join(os.TempDir(), "bitshare-update.zip")
-	err = downloadFile(settings.DownloadURL, downloadPath)
+	err = downloadFile(settings, settings.DownloadURL, downloadPath)
 	if err != nil {
-		return fmt.Errorf("failed to download update: %w", err)
+		return fmt.Errorf("failed to download update: %w", diagnose(err))
 	}
 
 	// Extract and install the update
@@ -195,8 +272,77 @@ func saveSettings(settings *UpdateSettings) error {
 	return os.WriteFile(settingsPath, data, 0644)
 }
 
-func getLatestRelease() (*ReleaseInfo, error) {
-	resp, err := http.Get(ReleaseURL)
+// newHTTPClient returns a client that honors HTTP_PROXY/HTTPS_PROXY/NO_PROXY
+// and trusts the configured CA bundle in addition to the system roots
+func newHTTPClient(settings *UpdateSettings, timeout time.Duration) (*http.Client, error) {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 15 * time.Second,
+	}
+
+	if settings.CABundle != "" {
+		pool, err := loadCertPool(settings.CABundle)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	return &http.Client{Transport: transport, Timeout: timeout}, nil
+}
+
+// loadCertPool returns the system roots plus the certificates in a PEM bundle
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in CA bundle %s", path)
+	}
+
+	return pool, nil
+}
+
+// diagnose adds hints for the network errors people hit behind proxies
+func diagnose(err error) error {
+	var unknownAuthority x509.UnknownAuthorityError
+	if errors.As(err, &unknownAuthority) {
+		return fmt.Errorf("%w\nhint: if you are behind a TLS-intercepting proxy, run 'bitshare update ca <bundle.pem>' with your proxy's CA certificate", err)
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		proxy := os.Getenv("HTTPS_PROXY")
+		if proxy == "" {
+			proxy = os.Getenv("https_proxy")
+		}
+		if proxy != "" {
+			return fmt.Errorf("%w\nhint: the request went through proxy %s", err, proxy)
+		}
+		return fmt.Errorf("%w\nhint: if your network requires a proxy, set HTTPS_PROXY", err)
+	}
+
+	return err
+}
+
+func getLatestRelease(settings *UpdateSettings) (*ReleaseInfo, error) {
+	client, err := newHTTPClient(settings, apiTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Get(ReleaseURL)
 	if err != nil {
 		return nil, err
 	}
@@ -220,9 +366,8 @@ func getLatestRelease() (*ReleaseInfo, error) {
 	return &release, nil
 }
 
-func isNewer(version, currentVersion string) bool {
-	// Simple version comparison - in a real implementation, use proper semver comparison
-	return version > currentVersion
+func isNewer(newVersion, currentVersion string) bool {
+	return version.Compare(newVersion, currentVersion) > 0
 }
 
 func findDownloadURL(release *ReleaseInfo) string {
@@ -248,8 +393,13 @@ func findDownloadURL(release *ReleaseInfo) string {
 	return ""
 }
 
-func downloadFile(url, destPath string) error {
-	resp, err := http.Get(url)
+func downloadFile(settings *UpdateSettings, url, destPath string) error {
+	client, err := newHTTPClient(settings, downloadTimeout)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Get(url)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,223 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+// Kinds of local address, from most to least likely to be the one a sender wants
+const (
+	AddressLAN       = "lan"        // A regular network interface
+	AddressVPN       = "vpn"        // A tunnel, only reachable from the same VPN
+	AddressVirtual   = "virtual"    // Containers and virtual machines on this host
+	AddressLinkLocal = "link-local" // APIPA (169.254.x.x) or IPv6 fe80::, only reaches the same link
+)
+
+// LocalAddress is an address of this machine and what kind of network it is on
+type LocalAddress struct {
+	IP           string `json:"ip"` // With the zone for link-local IPv6, e.g. fe80::1%eth0
+	Interface    string `json:"interface"`
+	Kind         string `json:"kind"`
+	DefaultRoute bool   `json:"default_route"` // Traffic to the internet leaves from this address
+}
+
+// Interface name prefixes of tunnels and virtual switches. Names are matched
+// case-insensitively; Windows uses descriptive names such as "Tailscale".
+var (
+	vpnInterfacePrefixes     = []string{"tun", "tap", "utun", "wg", "ppp", "ipsec", "zt", "tailscale", "nordlynx", "proton", "wireguard", "openvpn"}
+	virtualInterfacePrefixes = []string{"docker", "br-", "veth", "virbr", "vmnet", "vboxnet", "vethernet", "lxc", "lxd", "cni", "flannel", "podman"}
+)
+
+// GetLocalAddresses returns the non-loopback addresses of this machine, best
+// candidates first: LAN before VPN before virtual before link-local, within a
+// kind IPv4 before IPv6, and then the address of the default route first
+func GetLocalAddresses() ([]LocalAddress, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	routeIPs := []string{defaultRouteIP("udp4", "192.0.2.1:9"), defaultRouteIP("udp6", "[2001:db8::1]:9")}
+
+	var addresses []LocalAddress
+	for _, i := range interfaces {
+		if i.Flags&net.FlagUp == 0 || i.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := i.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			ip := ipNet.IP
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			if ip.IsLoopback() {
+				continue
+			}
+			addresses = append(addresses, LocalAddress{
+				IP:           hostWithZone(ip, i.Name),
+				Interface:    i.Name,
+				Kind:         classifyAddress(i, ip),
+				DefaultRoute: ip.String() == routeIPs[0] || ip.String() == routeIPs[1],
+			})
+		}
+	}
+
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("no network interfaces found")
+	}
+
+	sort.SliceStable(addresses, func(a, b int) bool {
+		if rankA, rankB := kindRank(addresses[a].Kind), kindRank(addresses[b].Kind); rankA != rankB {
+			return rankA < rankB
+		}
+		if v6A, v6B := strings.Contains(addresses[a].IP, ":"), strings.Contains(addresses[b].IP, ":"); v6A != v6B {
+			return v6B
+		}
+		return addresses[a].DefaultRoute && !addresses[b].DefaultRoute
+	})
+	return addresses, nil
+}
+
+// classifyAddress guesses what kind of network an interface address is on
+func classifyAddress(i net.Interface, ip net.IP) string {
+	name := strings.ToLower(i.Name)
+	switch {
+	case ip.IsLinkLocalUnicast():
+		return AddressLinkLocal
+	case i.Flags&net.FlagPointToPoint != 0, hasAnyPrefix(name, vpnInterfacePrefixes), isCGNAT(ip):
+		// Tailscale and other overlay networks hand out addresses from 100.64.0.0/10
+		return AddressVPN
+	case hasAnyPrefix(name, virtualInterfacePrefixes):
+		return AddressVirtual
+	default:
+		return AddressLAN
+	}
+}
+
+func kindRank(kind string) int {
+	switch kind {
+	case AddressLAN:
+		return 0
+	case AddressVPN:
+		return 1
+	case AddressVirtual:
+		return 2
+	default:
+		return 3
+	}
+}
+
+func isCGNAT(ip net.IP) bool {
+	ip4 := ip.To4()
+	return ip4 != nil && ip4[0] == 100 && ip4[1]&0xC0 == 64
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultRouteIP returns the source address the system would use to reach
+// the internet over network, udp4 or udp6, given an address out there.
+// Connecting a UDP socket picks a route without sending anything.
+func defaultRouteIP(network, outside string) string {
+	conn, err := net.Dial(network, outside)
+	if err != nil {
+		return ""
+	}
+	defer conn.Close()
+
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		return addr.IP.String()
+	}
+	return ""
+}
+
+// hostWithZone writes ip as a host, with the zone of the interface named
+// iface for link-local IPv6 addresses, which mean nothing without it
+func hostWithZone(ip net.IP, iface string) string {
+	if ip.To4() == nil && (ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast()) {
+		return ip.String() + "%" + iface
+	}
+	return ip.String()
+}
+
+// ParseIPHost reports whether host is an IP address as a user may write it:
+// IPv6 with or without brackets and with a zone, e.g. fe80::1%eth0. It
+// returns the address the way net.JoinHostPort takes it.
+func ParseIPHost(host string) (string, bool) {
+	bracketed := strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]")
+	trimmed := host
+	if bracketed {
+		trimmed = host[1 : len(host)-1]
+	}
+	addr, err := netip.ParseAddr(trimmed)
+	if err != nil || (bracketed && !addr.Is6()) {
+		// Brackets only go around IPv6 addresses, and in pairs
+		return host, false
+	}
+	return addr.String(), true
+}
+
+// BroadcastSubnet is an IPv4 network of a local interface that takes broadcasts
+type BroadcastSubnet struct {
+	Interface string
+	IP        net.IP // This machine's address on it
+	Broadcast net.IP // Its directed broadcast address, e.g. 192.168.1.255
+}
+
+// GetBroadcastSubnets returns the IPv4 networks of the interfaces that are
+// up and can broadcast, each with its directed broadcast address. Networks
+// too small to have one, /31 and /32, are left out.
+func GetBroadcastSubnets() ([]BroadcastSubnet, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	var subnets []BroadcastSubnet
+	for _, i := range interfaces {
+		if i.Flags&net.FlagUp == 0 || i.Flags&net.FlagBroadcast == 0 || i.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := i.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			ip4, mask := ipNet.IP.To4(), ipNet.Mask
+			if len(mask) == net.IPv6len {
+				mask = mask[12:]
+			}
+			if ip4 == nil || len(mask) != net.IPv4len {
+				continue
+			}
+			if ones, _ := mask.Size(); ones > 30 {
+				continue
+			}
+			broadcast := make(net.IP, net.IPv4len)
+			for b := range broadcast {
+				broadcast[b] = ip4[b] | ^mask[b]
+			}
+			subnets = append(subnets, BroadcastSubnet{Interface: i.Name, IP: ip4, Broadcast: broadcast})
+		}
+	}
+	return subnets, nil
+}
@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseIPHost(t *testing.T) {
+	tests := []struct {
+		host string
+		want string
+		ok   bool
+	}{
+		{"192.168.1.20", "192.168.1.20", true},
+		{"::1", "::1", true},
+		{"[::1]", "::1", true},
+		{"[2001:DB8::0001]", "2001:db8::1", true},
+		{"fe80::1%eth0", "fe80::1%eth0", true},
+		{"[fe80::1%eth0]", "fe80::1%eth0", true},
+		{"[::ffff:192.168.1.20]", "::ffff:192.168.1.20", true},
+
+		{"", "", false},
+		{"laptop", "laptop", false},
+		{"a1b2c3d4", "a1b2c3d4", false},
+		{"[::1", "[::1", false},
+		{"::1]", "::1]", false},
+		{"[]", "[]", false},
+		{"[192.168.1.20]", "[192.168.1.20]", false},
+		{"[::1]:9000", "[::1]:9000", false},
+		{"192.168.1.20:9000", "192.168.1.20:9000", false},
+		{"192.168.1.20%eth0", "192.168.1.20%eth0", false},
+	}
+	for _, test := range tests {
+		got, ok := ParseIPHost(test.host)
+		if got != test.want || ok != test.ok {
+			t.Errorf("ParseIPHost(%q) = %q, %t, want %q, %t", test.host, got, ok, test.want, test.ok)
+		}
+		if ok {
+			// What it returns is what JoinHostPort and the dialers take
+			if _, _, err := net.SplitHostPort(net.JoinHostPort(got, "9000")); err != nil {
+				t.Errorf("%q doesn't join with a port: %v", got, err)
+			}
+		}
+	}
+}
+
+func TestHostWithZone(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"192.168.1.20", "192.168.1.20"},
+		{"169.254.1.1", "169.254.1.1"},
+		{"2001:db8::1", "2001:db8::1"},
+		{"fe80::1", "fe80::1%eth0"},
+		{"ff02::6269:7473", "ff02::6269:7473%eth0"},
+	}
+	for _, test := range tests {
+		if got := hostWithZone(net.ParseIP(test.ip), "eth0"); got != test.want {
+			t.Errorf("hostWithZone(%s) = %q, want %q", test.ip, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package utils
+
+import (
+	"fmt"
+	"time"
+)
+
+// Times are shown in the local timezone, relative to now where that is
+// easier to read ("3m ago", "yesterday 14:02"), with the absolute time
+// available for verbose output. Only numeric dates are used so the output
+// reads the same whatever the system locale.
+
+const (
+	absoluteLayout = "2006-01-02 15:04:05 MST"
+	clockLayout    = "15:04"
+	dateLayout     = "2006-01-02"
+)
+
+// FormatDuration formats a duration compactly: "350ms", "42s", "1m42s", "2h05m" or "3d04h"
+func FormatDuration(d time.Duration) string {
+	if d < 0 {
+		return "-" + FormatDuration(-d)
+	}
+
+	// Units are picked after rounding, so 59.6s is "1m00s" rather than "60s"
+	if d < time.Second {
+		return fmt.Sprintf("%dms", d.Milliseconds())
+	}
+	if s := d.Round(time.Second); s < time.Minute {
+		return fmt.Sprintf("%ds", int(s.Seconds()))
+	} else if s < time.Hour {
+		return fmt.Sprintf("%dm%02ds", int(s/time.Minute), int(s%time.Minute/time.Second))
+	}
+	if m := d.Round(time.Minute); m < 24*time.Hour {
+		return fmt.Sprintf("%dh%02dm", int(m/time.Hour), int(m%time.Hour/time.Minute))
+	}
+	d = d.Round(time.Hour)
+	return fmt.Sprintf("%dd%02dh", int(d/(24*time.Hour)), int(d%(24*time.Hour)/time.Hour))
+}
+
+// FormatTime describes a time relative to now, in the local timezone
+func FormatTime(t time.Time) string {
+	return formatTimeAt(t, time.Now())
+}
+
+// FormatTimeAbsolute formats a time in full, in the local timezone
+func FormatTimeAbsolute(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Local().Format(absoluteLayout)
+}
+
+// FormatTimestamp formats a time relative to now, adding the absolute time when verbose
+func FormatTimestamp(t time.Time, verbose bool) string {
+	if !verbose || t.IsZero() {
+		return FormatTime(t)
+	}
+	return fmt.Sprintf("%s (%s)", FormatTimeAbsolute(t), FormatTime(t))
+}
+
+func formatTimeAt(t, now time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	t, now = t.Local(), now.Local()
+
+	diff := now.Sub(t)
+	switch {
+	case diff < 0 && -diff < time.Minute:
+		// Peers' clocks are rarely in perfect agreement
+		return "just now"
+	case diff < 0 && -diff < 24*time.Hour:
+		return "in " + FormatDuration(-diff)
+	case diff < 0:
+		return t.Format(dateLayout + " " + clockLayout)
+	case diff < time.Minute:
+		return "just now"
+	case diff < time.Hour:
+		return fmt.Sprintf("%dm ago", int(diff/time.Minute))
+	}
+
+	switch days := calendarDaysBetween(t, now); {
+	case days == 0:
+		return fmt.Sprintf("%dh ago", int(diff/time.Hour))
+	case days == 1:
+		return "yesterday " + t.Format(clockLayout)
+	case days < 7:
+		return fmt.Sprintf("%d days ago", days)
+	default:
+		return t.Format(dateLayout)
+	}
+}
+
+// calendarDaysBetween counts midnights between two local times, so that
+// 23:59 and 00:01 are a day apart even though only minutes have passed
+func calendarDaysBetween(earlier, later time.Time) int {
+	y1, m1, d1 := earlier.Date()
+	y2, m2, d2 := later.Date()
+	start := time.Date(y1, m1, d1, 12, 0, 0, 0, time.UTC)
+	end := time.Date(y2, m2, d2, 12, 0, 0, 0, time.UTC)
+	return int(end.Sub(start).Hours() / 24)
+}
@@ -0,0 +1,139 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+// inZone runs the test with loc as the local timezone
+func inZone(t *testing.T, loc *time.Location) {
+	t.Helper()
+	saved := time.Local
+	time.Local = loc
+	t.Cleanup(func() { time.Local = saved })
+}
+
+func TestFormatDuration(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{0, "0ms"},
+		{350 * time.Millisecond, "350ms"},
+		{999 * time.Millisecond, "999ms"},
+		{time.Second, "1s"},
+		{59*time.Second + 400*time.Millisecond, "59s"},
+		{59*time.Second + 600*time.Millisecond, "1m00s"},
+		{102 * time.Second, "1m42s"},
+		{time.Hour - 400*time.Millisecond, "1h00m"},
+		{2*time.Hour + 5*time.Minute + 20*time.Second, "2h05m"},
+		{24*time.Hour - time.Second, "1d00h"},
+		{3*24*time.Hour + 4*time.Hour, "3d04h"},
+		{-102 * time.Second, "-1m42s"},
+	}
+	for _, test := range tests {
+		if got := FormatDuration(test.d); got != test.want {
+			t.Errorf("FormatDuration(%v) = %q, want %q", test.d, got, test.want)
+		}
+	}
+}
+
+func TestFormatTimeAt(t *testing.T) {
+	zone := time.FixedZone("UTC+2", 2*60*60)
+	inZone(t, zone)
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2026, time.October, day, hour, minute, 0, 0, zone)
+	}
+
+	tests := []struct {
+		name string
+		t    time.Time
+		now  time.Time
+		want string
+	}{
+		{"zero", time.Time{}, at(16, 12, 0), "never"},
+		{"same moment", at(16, 12, 0), at(16, 12, 0), "just now"},
+		{"seconds ago", at(16, 12, 0), at(16, 12, 0).Add(59 * time.Second), "just now"},
+		{"minutes ago", at(16, 11, 18), at(16, 12, 0), "42m ago"},
+		{"hours ago", at(16, 9, 0), at(16, 12, 30), "3h ago"},
+
+		// Day boundaries follow the calendar, not 24 hour periods
+		{"across midnight by minutes", at(15, 23, 59), at(16, 0, 1), "2m ago"},
+		{"across midnight by hours", at(15, 23, 0), at(16, 0, 30), "yesterday 23:00"},
+		{"start of yesterday", at(15, 0, 0), at(16, 23, 59), "yesterday 00:00"},
+		{"two midnights", at(14, 23, 59), at(16, 0, 1), "2 days ago"},
+		{"six days", at(10, 12, 0), at(16, 12, 0), "6 days ago"},
+		{"a week", at(9, 12, 0), at(16, 12, 0), "2026-10-09"},
+		{"across a month", time.Date(2026, time.September, 30, 22, 0, 0, 0, zone), at(1, 1, 0), "yesterday 22:00"},
+		{"across a year", time.Date(2025, time.December, 31, 20, 0, 0, 0, zone), time.Date(2026, time.January, 1, 8, 0, 0, 0, zone), "yesterday 20:00"},
+
+		// A peer whose clock runs ahead reports times in the future
+		{"skew under a minute", at(16, 12, 0).Add(30 * time.Second), at(16, 12, 0), "just now"},
+		{"skew of minutes", at(16, 12, 5), at(16, 12, 0), "in 5m00s"},
+		{"skew of hours", at(16, 14, 0), at(16, 12, 0), "in 2h00m"},
+		{"skew of days", at(18, 12, 0), at(16, 12, 0), "2026-10-18 12:00"},
+
+		// Times from another zone are shown in the local one
+		{"other zone", time.Date(2026, time.October, 16, 9, 0, 0, 0, time.UTC), at(16, 11, 30), "30m ago"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := formatTimeAt(test.t, test.now); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+// TestFormatTimeAtDST checks days are counted by the calendar when a day
+// is 23 or 25 hours long
+func TestFormatTimeAtDST(t *testing.T) {
+	zone, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("no timezone database: %v", err)
+	}
+	inZone(t, zone)
+
+	tests := []struct {
+		name string
+		t    time.Time
+		now  time.Time
+		want string
+	}{
+		// Clocks went forward on 8 March 2026 and back on 1 November 2026
+		{"day after spring forward", time.Date(2026, time.March, 8, 0, 30, 0, 0, zone), time.Date(2026, time.March, 9, 0, 10, 0, 0, zone), "yesterday 00:30"},
+		{"same day as spring forward", time.Date(2026, time.March, 8, 0, 30, 0, 0, zone), time.Date(2026, time.March, 8, 23, 50, 0, 0, zone), "22h ago"},
+		{"day after fall back", time.Date(2026, time.November, 1, 23, 30, 0, 0, zone), time.Date(2026, time.November, 2, 0, 45, 0, 0, zone), "yesterday 23:30"},
+		{"same day as fall back", time.Date(2026, time.November, 1, 0, 5, 0, 0, zone), time.Date(2026, time.November, 1, 23, 55, 0, 0, zone), "24h ago"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := formatTimeAt(test.t, test.now); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFormatTimestamp(t *testing.T) {
+	inZone(t, time.UTC)
+	when := time.Now().Add(-5 * time.Minute).Truncate(time.Second)
+
+	tests := []struct {
+		name    string
+		t       time.Time
+		verbose bool
+		want    string
+	}{
+		{"relative", when, false, "5m ago"},
+		{"verbose", when, true, when.Format(absoluteLayout) + " (5m ago)"},
+		{"zero verbose", time.Time{}, true, "never"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := FormatTimestamp(test.t, test.verbose); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -2,13 +2,16 @@ package utils
 
 import (
 	"fmt"
+	"math"
 	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 )
 
-// GetAllLocalIPs returns a slice of all non-loopback local IP addresses.
+// GetAllLocalIPs returns a slice of all non-loopback local IP addresses,
+// IPv4 and IPv6. Link-local IPv6 addresses carry their zone, e.g. fe80::1%eth0.
 func GetAllLocalIPs() ([]string, error) {
 	var ips []string
 	interfaces, err := net.Interfaces()
@@ -33,11 +36,7 @@ func GetAllLocalIPs() ([]string, error) {
 			if ip == nil || ip.IsLoopback() {
 				continue
 			}
-			ip = ip.To4()
-			if ip == nil {
-				continue // not an ipv4 address
-			}
-			ips = append(ips, ip.String())
+			ips = append(ips, hostWithZone(ip, i.Name))
 		}
 	}
 
@@ -70,6 +69,45 @@ func FormatBytes(b int64) string {
 	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
 }
 
+// ParseBytes parses a size such as "512", "700MB", "20G" or "1.5TiB" into bytes.
+// Units are powers of 1024, matching FormatBytes.
+func ParseBytes(input string) (int64, error) {
+	s := strings.TrimSpace(strings.ToUpper(input))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+
+	multiplier := float64(1)
+	if n := len(s); n > 0 {
+		if exp := strings.IndexByte("KMGTPE", s[n-1]); exp >= 0 {
+			s = s[:n-1]
+			multiplier = math.Pow(1024, float64(exp+1))
+		}
+	}
+
+	value, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size: %q", input)
+	}
+
+	bytes := value * multiplier
+	if bytes >= math.MaxInt64 {
+		return 0, fmt.Errorf("size too large: %q", input)
+	}
+	return int64(bytes), nil
+}
+
+// DataDir returns the directory BitShare keeps its state in, creating it if needed.
+func DataDir() (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(configDir, "BitShare")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
 // FindFileInCommonDirs searches for a file in standard user directories (Desktop, Documents, Downloads).
 func FindFileInCommonDirs(filename string) (string, error) {
 	homeDir, err := os.UserHomeDir()
@@ -106,3 +144,26 @@ func GenerateNodeName() string {
 
 	return cleanName
 }
+
+// EditDistance returns the number of single character insertions,
+// deletions and substitutions that turn a into b, ignoring case.
+func EditDistance(a, b string) int {
+	s, t := []rune(strings.ToLower(a)), []rune(strings.ToLower(b))
+	previous := make([]int, len(t)+1)
+	current := make([]int, len(t)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(s); i++ {
+		current[0] = i
+		for j := 1; j <= len(t); j++ {
+			cost := 1
+			if s[i-1] == t[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(t)]
+}
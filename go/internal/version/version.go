@@ -0,0 +1,51 @@
+package version
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Current is the BitShare release this binary was built from
+const Current = "1.1.0"
+
+// Compare compares two dotted versions like "1.2.0" numerically, returning
+// -1, 0 or 1. A leading "v" and any pre-release suffix ("-beta") are ignored,
+// and missing or unparsable parts count as zero.
+func Compare(a, b string) int {
+	partsA, partsB := parse(a), parse(b)
+	for i := 0; i < len(partsA) || i < len(partsB); i++ {
+		var x, y int
+		if i < len(partsA) {
+			x = partsA[i]
+		}
+		if i < len(partsB) {
+			y = partsB[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// AtLeast reports whether version v is the same as or newer than min
+func AtLeast(v, min string) bool {
+	return Compare(v, min) >= 0
+}
+
+func parse(v string) []int {
+	v = strings.TrimPrefix(strings.TrimSpace(v), "v")
+	if i := strings.IndexAny(v, "-+"); i >= 0 {
+		v = v[:i]
+	}
+
+	var parts []int
+	for _, field := range strings.Split(v, ".") {
+		n, _ := strconv.Atoi(field)
+		parts = append(parts, n)
+	}
+	return parts
+}
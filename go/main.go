@@ -1,22 +1,35 @@
 package main
 
 import (
-	"bufio"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
+	"unicode"
 
+	"fileshare/internal/access"
+	"fileshare/internal/config"
+	"fileshare/internal/events"
 	"fileshare/internal/firewall"
 	"fileshare/internal/mesh"
 	"fileshare/internal/p2p"
+	"fileshare/internal/stun"
+	"fileshare/internal/tasks"
 	"fileshare/internal/transfer"
+	"fileshare/internal/ui"
 	"fileshare/internal/updater"
 	"fileshare/internal/utils"
 )
@@ -36,7 +49,7 @@ func init() {
 	go func() {
 		autoUpdate, _ := updater.ShouldAutoUpdate()
 		if autoUpdate {
-			settings, updateAvailable, _ := updater.CheckForUpdates(false)
+			settings, updateAvailable := updater.CheckForUpdatesQuietly()
 			if updateAvailable {
 				fmt.Printf("\nA new version of BitShare is available: %s\n", settings.NewVersion)
 				fmt.Println("Run 'bitshare update install' to update")
@@ -45,6 +58,10 @@ func init() {
 	}()
 }
 
+// interactiveMode is set while the BitShare shell is running, where long
+// running commands go to the background instead of blocking the prompt
+var interactiveMode bool
+
 // Constants for terminal colors
 var (
 	colorReset = "\033[0m"
@@ -67,13 +84,21 @@ func supportsColors() bool {
 }
 
 func main() {
+	args, err := extractEventStream(os.Args[1:])
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	showTransfers()
+	mesh.HandleBroadcast(sayBroadcast, showSaid)
+
 	// If no arguments are provided, start interactive mode by default
-	if len(os.Args) == 1 {
+	if len(args) == 0 {
 		startInteractiveMode()
 		return
 	}
 
-	command := os.Args[1]
+	command := args[0]
 
 	// Handle special case for interactive mode
 	if command == "interactive" || command == "shell" || command == "terminal" {
@@ -81,7 +106,7 @@ func main() {
 		return
 	}
 
-	executeCommand(os.Args[1:])
+	executeCommand(args)
 }
 
 // startInteractiveMode launches BitShare as an interactive terminal application
@@ -90,48 +115,54 @@ func startInteractiveMode() {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
-	// Handle Ctrl+C gracefully
+	// Commands are typed with history IDs completed, see ui.LineReader
+	reader := ui.NewLineReader(os.Stdin, os.Stdout, completeCommand)
+
+	// Handle Ctrl+C gracefully, leaving the terminal as it was
 	go func() {
 		<-sigChan
+		reader.Restore()
 		fmt.Println("\n🛑 Exiting BitShare terminal...")
+		shutdownTasks()
+		mesh.StopMeshNode()
 		os.Exit(0)
 	}()
 
-	// Start mesh node in background
-	config := mesh.Config{
-		NodeName:         utils.GenerateNodeName(),
-		ListenPort:       9000, // Default port
-		EnableWiFiDirect: true,
-		EnableBluetooth:  true,
-		EnableTCP:        true,
-		EnableRelay:      true, // Enable relay by default in interactive mode
-	}
+	interactiveMode = true
 
+	// Start mesh node in background, as config.json says
 	fmt.Println("🌐 Starting BitShare in interactive mode...")
-	err := mesh.StartMeshNode(config)
+	settings, err := config.Load()
 	if err != nil {
-		fmt.Printf("❌ Warning: Failed to start mesh node: %v\n", err)
-		fmt.Println("Some functionality may be limited.")
+		fmt.Printf("❌ %v\n", err)
+		fmt.Println("Fix the setting and type 'start', or run 'config init --force' to start over.")
 	} else {
-		fmt.Printf("✅ Node started successfully as '%s'\n", config.NodeName)
+		meshConfig := settings.MeshConfig()
+		meshConfig.PeerStateFunc = emitPeerState
+		if err := mesh.StartMeshNode(meshConfig); err != nil {
+			fmt.Printf("❌ Warning: Failed to start mesh node: %v\n", err)
+			explainStartFailure(err)
+			fmt.Println("Some functionality may be limited.")
+		} else {
+			fmt.Printf("✅ Node started successfully as '%s'\n", meshConfig.NodeName)
+		}
 	}
 
 	// Display welcome message and instructions
 	displayWelcomeMessage()
 
 	// Start the command prompt loop
-	reader := bufio.NewReader(os.Stdin)
 	for {
-		fmt.Print("\033[1;36mbitshare> \033[0m") // Cyan prompt
-		cmdString, err := reader.ReadString('\n')
+		cmdString, err := reader.ReadLine("\033[1;36mbitshare> \033[0m") // Cyan prompt
 		if err != nil {
 			fmt.Println("Error reading command:", err)
 			continue
 		}
+		mesh.NoteActivity()
 
-		// Process the command
+		// Process the command, unless it answers a question from a background task
 		cmdString = strings.TrimSpace(cmdString)
-		if cmdString == "" {
+		if answerShell(cmdString) || cmdString == "" {
 			continue
 		}
 
@@ -200,6 +231,7 @@ func handleBuiltinCommand(cmd string) bool {
 	switch cmd {
 	case "exit", "quit", "bye":
 		fmt.Println("Exiting BitShare terminal. Goodbye!")
+		shutdownTasks()
 		// Stop mesh node if running
 		mesh.StopMeshNode()
 		os.Exit(0)
@@ -232,22 +264,171 @@ func executeCommand(args []string) {
 
 	switch command {
 	case "start":
-		startMeshNode()
+		startMeshNode(args[1:])
+
+	case "config":
+		if len(args) < 2 || args[1] != "init" {
+			fmt.Println("Usage: config init [--force]")
+			return
+		}
+		_, force := extractSwitch(args[2:], "--force")
+		path, err := config.WriteTemplate(force)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			fmt.Println("Use 'config init --force' to replace it with the defaults")
+			return
+		}
+		fmt.Printf("Wrote %s, edit it to change what the node and transfers start with\n", path)
 
 	case "scan":
-		scanNetwork()
+		var passphrase string
+		args, network, _, err := extractFlag(args[1:], "--network")
+		if err == nil {
+			args, passphrase, _, err = extractFlag(args, "--passphrase")
+		}
+		if err != nil || len(args) != 0 {
+			fmt.Println("Usage: scan [--network <name> [--passphrase <passphrase>]]")
+			return
+		}
+		if passphrase == "" {
+			passphrase = os.Getenv("BITSHARE_NETWORK_PASSPHRASE")
+		}
+		if network != "" && passphrase == "" {
+			fmt.Printf("Error: network '%s' needs its passphrase, with --passphrase or BITSHARE_NETWORK_PASSPHRASE\n", network)
+			return
+		}
+		scanNetwork(network, passphrase)
 
 	case "list":
-		listPeers()
+		_, verbose := extractSwitch(args[1:], "--verbose")
+		listPeers(verbose)
+
+	case "status":
+		args, topology := extractSwitch(args[1:], "--topology")
+		args, asJSON := extractSwitch(args, "--json")
+		if len(args) > 0 || asJSON && !topology {
+			fmt.Println("Usage: status [--topology [--json]]")
+			return
+		}
+		if topology {
+			printTopology(asJSON)
+			return
+		}
+		printNodeStatus()
+
+	case "peer":
+		args, verbose := extractSwitch(args, "--verbose")
+		if len(args) != 2 {
+			fmt.Println("Usage: peer <peer_id_name_or_handle> [--verbose]")
+			return
+		}
+		showPeer(args[1], verbose)
+
+	case "pin", "unpin":
+		if len(args) != 2 {
+			fmt.Printf("Usage: %s <peer_id_name_or_handle>\n", command)
+			return
+		}
+		pinPeer(args[1], command == "pin")
+
+	case "alias":
+		args, remove := extractSwitch(args, "--delete")
+		switch {
+		case remove && len(args) == 2:
+			deleteAlias(args[1])
+		case !remove && len(args) == 3:
+			setAlias(args[1], args[2])
+		case !remove && len(args) == 1:
+			listAliases()
+		default:
+			fmt.Println("Usage: alias <peer_id_name_or_handle> <alias>")
+			fmt.Println("       alias --delete <alias>")
+			fmt.Println("       alias   (lists the aliases)")
+		}
+
+	case "block":
+		args, list := extractSwitch(args, "--list")
+		switch {
+		case len(args) == 1:
+			listBlocked()
+		case !list && len(args) == 2:
+			blockPeer(args[1])
+		default:
+			fmt.Println("Usage: block <peer_id_name_or_ip>")
+			fmt.Println("       block --list   (lists the blocked peers)")
+		}
+
+	case "unblock":
+		if len(args) != 2 {
+			fmt.Println("Usage: unblock <peer_id_name_or_ip>")
+			return
+		}
+		unblockPeer(args[1])
 
 	case "install", "--install":
 		showInstallationInfo()
 
 	case "receive":
+		defaults, err := transferDefaults()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		args, maxSize, err := extractMaxSize(args, defaults.MaxFileSize)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		args, onExists, err := extractCollisionPolicy(args, defaults.CollisionPolicy)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		args, once := extractSwitch(args, "--once")
+		args, useTLS := extractSwitch(args, "--tls")
+		args, noPreserve := extractSwitch(args, "--no-preserve")
+		args, toStdout := extractSwitch(args, "--stdout")
+		args, noResume := extractSwitch(args, "--no-resume")
+		args, autoAccept := extractSwitch(args, "--auto-accept")
+		args, acceptTimeout, err := extractAcceptTimeout(args)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		args, pin, err := extractPIN(args)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		args, extraRules, err := extractAccessRules(args)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		args, maxConnections, maxPerIP, err := extractConnectionLimits(args)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
 		if len(args) < 2 || len(args) > 3 {
-			fmt.Println("Usage: receive <port_no> [destination_directory]")
+			fmt.Println("Usage: receive <port_no> [destination_directory] [--once] [--tls] [--pin <pin>] [--no-preserve] [--no-resume] [--max-size <size>] [--on-exists overwrite|rename|skip|fail] [--auto-accept] [--accept-timeout <duration>] [--allow <ips>] [--deny <ips>] [--max-connections <n>] [--max-per-ip <n>]")
+			fmt.Println("       receive <port_no> --stdout [--tls] [--pin <pin>] [--max-size <size>]   (writes one file to stdout)")
 			return
 		}
+		// The received data takes stdout, so everything else goes to stderr
+		var output io.Writer
+		if toStdout {
+			switch {
+			case interactiveMode:
+				fmt.Println("Error: receiving to stdout only works from the command line, e.g. bitshare receive 9000 --stdout | tar xz")
+				return
+			case len(args) == 3:
+				fmt.Println("Error: --stdout doesn't save files, leave out the destination directory")
+				return
+			}
+			output = os.Stdout
+			os.Stdout = os.Stderr
+		}
 		port, err := strconv.Atoi(args[1])
 		if err != nil {
 			fmt.Printf("Invalid port number: %v\n", err)
@@ -257,21 +438,107 @@ func executeCommand(args []string) {
 			fmt.Println("Port number must be between 1 and 65535")
 			return
 		}
-		destDir := "." // Default to current directory
+		// Receive routes are checked up front so a typo doesn't surface mid-transfer
+		routes, err := transfer.LoadRoutes()
+		if err == nil {
+			err = transfer.ValidateRoutes(routes)
+		}
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			fmt.Println("Fix the directories or remove the rules with 'route remove <pattern>'")
+			return
+		}
+
+		rules, err := access.Load()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			fmt.Println("Fix the entry or delete the file to let any address connect")
+			return
+		}
+		rules = rules.Merge(extraRules)
+		if !rules.Empty() {
+			printAccessRules(rules)
+		}
+
+		destDir := "." // Default to current directory, or the default route
+		if dir, ok := transfer.DefaultRoute(routes); ok {
+			destDir = dir
+		}
 		if len(args) == 3 {
 			destDir = args[2]
 		}
 
+		options := defaults
+		options.MaxFileSize = maxSize
+		options.CollisionPolicy = onExists
+		options.Routes = routes
+		options.Access = rules
+		options.MaxConnections = maxConnections
+		options.MaxConnectionsPerIP = maxPerIP
+		options.TLS = options.TLS || useTLS
+		options.PIN = pin
+		options.PreserveMetadata = options.PreserveMetadata && !noPreserve
+		options.Resume = options.Resume && !noResume
+		if interactiveMode && !autoAccept {
+			// Ask at the prompt rather than writing whatever anyone sends
+			options.AcceptFunc = promptAccept(acceptTimeout)
+		}
+
 		// Start receiver in non-blocking mode
-		go func() {
-			startReceiver(port, destDir)
-		}()
-		fmt.Printf("Receiver started on port %d. Files will be saved to %s\n", port, destDir)
-		fmt.Println("You can continue using other commands while receiving.")
+		runCommand(fmt.Sprintf("receive on port %d", port), func(ctx context.Context) {
+			err := startReceiver(ctx, port, destDir, output, options, once)
+			if output != nil && err != nil {
+				// Whatever reads the pipe must not take partial or corrupt data for the real thing
+				os.Exit(1)
+			}
+		})
+		if interactiveMode {
+			fmt.Printf("Receiver started on port %d. Files will be saved to %s\n", port, destDir)
+			fmt.Println("You can continue using other commands while receiving. Use 'tasks' to see it.")
+		}
 
 	case "send":
-		if len(args) != 4 {
-			fmt.Println("Usage: send <peer_id_or_ip> <port_no> <file_path>")
+		defaults, err := transferDefaults()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		args, maxSize, err := extractMaxSize(args, defaults.MaxFileSize)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		args, useTLS := extractSwitch(args, "--tls")
+		args, allowDowngrade := extractSwitch(args, "--allow-downgrade")
+		args, force := extractSwitch(args, "--force")
+		args, pin, err := extractPIN(args)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		// A connection URI from a receiver stands for both the peer and the port
+		if len(args) > 1 && transfer.IsConnectionURI(args[1]) {
+			host, port, uriTLS, err := transfer.ParseConnectionURI(args[1])
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+			args = append([]string{args[0], host, strconv.Itoa(port)}, args[2:]...)
+			useTLS = useTLS || uriTLS
+		}
+		args, streamName, _, err := extractFlag(args, "--name")
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		args, priority, err := extractPriority(args)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		if len(args) < 4 {
+			fmt.Println("Usage: send <peer_id_or_ip> <port_no> <file_path> [more files or globs...] [--tls] [--pin <pin>] [--allow-downgrade] [--max-size <size>] [--priority <n>] [--force]")
+			fmt.Println("       send <peer_id_or_ip> <port_no> - [--name <file_name>]   (sends what is piped into stdin)")
 			return
 		}
 		ip := args[1]
@@ -282,82 +549,204 @@ func executeCommand(args []string) {
 			return
 		}
 
-		filePath := args[3]
+		patterns := args[3:]
+		streaming := false
+		for _, pattern := range patterns {
+			if pattern == "-" {
+				streaming = true
+			}
+		}
+		if streaming {
+			switch {
+			case len(patterns) > 1:
+				fmt.Println("Error: stdin (-) can't be sent together with files")
+				return
+			case interactiveMode:
+				fmt.Println("Error: sending stdin only works from the command line, e.g. pg_dump mydb | bitshare send laptop 9000 - --name backup.sql")
+				return
+			case streamName == "":
+				streamName = "stdin"
+			}
+		} else if streamName != "" {
+			fmt.Println("Error: --name only applies when sending stdin (-)")
+			return
+		}
 
-		// Start sender in a goroutine so it doesn't block the terminal
-		go func() {
-			if net.ParseIP(ip) == nil {
-				// This might be a peer ID or name, try to resolve it
-				fmt.Printf("Looking up peer: %s\n", ip)
-				peer, err := mesh.FindPeerByIdOrName(ip)
-				if err != nil {
-					fmt.Printf("Error finding peer: %v\n", err)
-					return
-				}
+		// Start sender in the background so it doesn't block the terminal
+		runCommand("send to "+net.JoinHostPort(ip, strconv.Itoa(port)), func(ctx context.Context) {
+			var err error
+			defer func() { emitResult(ctx, "send", err) }()
 
-				if peer != nil {
-					fmt.Printf("Found peer %s (%s)\n", peer.Name, peer.ID)
-					// Use the peer's address
-					if len(peer.Routes) > 0 {
-						bestRoute := findBestRoute(peer.Routes)
-						fmt.Printf("Using route via: %s\n", bestRoute.NextHop)
-						ip = bestRoute.NextHop
-					} else if peer.Address != "" {
-						ip = peer.Address
-						fmt.Printf("Using direct connection to: %s\n", ip)
-					} else {
-						fmt.Printf("Error: Peer found but no address information available\n")
-						return
-					}
-				} else {
-					fmt.Printf("Error: Could not find peer named '%s'\n", ip)
-					fmt.Println("Run 'scan' to discover available peers.")
-					return
-				}
+			ip, viaMesh, err := resolvePeerAddress(ip)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
 			}
 
 			// Now we have a valid IP to connect to
-			if !utils.FileExists(filePath) {
-				fmt.Printf("File not found at '%s'. Searching in common directories...\n", filePath)
-				foundPath, err := utils.FindFileInCommonDirs(filePath)
+			var filePaths []string
+			if !streaming {
+				filePaths, err = expandSendPaths(patterns)
 				if err != nil {
 					fmt.Printf("Error: %v\n", err)
-					absPath, _ := filepath.Abs(filePath)
-					fmt.Printf("Looked for file at: %s\n", absPath)
 					return
 				}
-				fmt.Printf("File found: %s\n", foundPath)
-				filePath = foundPath
 			}
 
-			// Check if file is readable
-			file, err := os.Open(filePath)
-			if err != nil {
-				fmt.Printf("Cannot read file: %v\n", err)
-				return
+			target := net.JoinHostPort(ip, strconv.Itoa(port))
+			switch {
+			case streaming:
+				fmt.Printf("Sending stdin as %s to %s...\n", streamName, target)
+			case len(filePaths) == 1:
+				fmt.Printf("Sending %s to %s...\n", filepath.Base(filePaths[0]), target)
+			default:
+				fmt.Printf("Sending %d files to %s...\n", len(filePaths), target)
 			}
-			file.Close()
-
-			fmt.Printf("Sending %s to %s:%d...\n", filepath.Base(filePath), ip, port)
-			err = transfer.SendFile(filePath, ip, port)
+			options := defaults
+			options.MaxFileSize = maxSize
+			options.TLS = options.TLS || useTLS
+			options.PIN = pin
+			options.AllowDowngrade = allowDowngrade
+			options.ResendIdentical = force
+			options.Context = ctx
+			if viaMesh {
+				options.Dial = mesh.DialPeer
+			}
+			if _, isIP := utils.ParseIPHost(args[1]); !isIP {
+				options.PeerName = args[1]
+			}
+			var label string
+			switch {
+			case streaming:
+				label = streamName
+			case len(filePaths) == 1:
+				label = filepath.Base(filePaths[0])
+			default:
+				label = fmt.Sprintf("%d files", len(filePaths))
+			}
+			reportEvents(&options)
+			err = transfer.QueueTransfer(ctx, label+" to "+target, priority, func(ctx context.Context) error {
+				options.Context = ctx
+				if streaming {
+					return transfer.SendStreamWithOptions(os.Stdin, streamName, ip, port, options)
+				}
+				return transfer.SendFilesWithOptions(filePaths, ip, port, options)
+			})
 			if err != nil {
 				fmt.Printf("Error sending file: %v\n", err)
+				if errors.Is(err, transfer.ErrDeclined) || errors.Is(err, transfer.ErrReceiverBusy) || errors.Is(err, transfer.ErrRemovedFromQueue) || viaMesh || ctx.Err() != nil {
+					return
+				}
+				if !explainSendFailure(ip, port, max(len(filePaths), 1)) {
+					fmt.Printf("💡 To diagnose the connection, run: bitshare probe %s %d\n", ip, port)
+				}
 				return
 			}
 
-			fmt.Println("File sent successfully!")
-		}()
-		fmt.Println("Transfer started in background. You can continue using other commands.")
+			if len(filePaths) <= 1 {
+				fmt.Println("File sent successfully!")
+			} else {
+				fmt.Printf("All %d files sent successfully!\n", len(filePaths))
+			}
+		})
+		if interactiveMode {
+			fmt.Println("Transfer started in background. You can continue using other commands.")
+		}
+
+	case "forward":
+		forwardFile(args[1:])
+
+	case "tasks":
+		listTasks()
+
+	case "transfers":
+		manageTransfers(args[1:])
+
+	case "route":
+		manageRoutes(args[1:])
+
+	case "access":
+		manageAccess(args[1:])
+
+	case "power":
+		managePower(args[1:])
+
+	case "set":
+		if len(args) != 3 {
+			fmt.Println("Usage: set <name|port|relay|relay-servers|offline|mdns> <value>")
+			return
+		}
+		setNodeOption(args[1], args[2])
+
+	case "say":
+		if len(args) < 2 {
+			fmt.Println("Usage: say <text>")
+			return
+		}
+		say(strings.Join(args[1:], " "))
+
+	case "id":
+		manageIdentity(args[1:])
+
+	case "history":
+		showHistory(args[1:])
+
+	case "cancel":
+		if len(args) != 2 {
+			fmt.Println("Usage: cancel <task_id>")
+			return
+		}
+		id, err := strconv.Atoi(args[1])
+		if err != nil {
+			fmt.Printf("Invalid task ID: %s\n", args[1])
+			return
+		}
+		if err := tasks.Cancel(id); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		fmt.Printf("Cancelling task %d...\n", id)
+
+	case "probe":
+		if len(args) != 3 {
+			fmt.Println("Usage: probe <host> <port_no>")
+			return
+		}
+		port, err := strconv.Atoi(args[2])
+		if err != nil || port < 1 || port > 65535 {
+			fmt.Println("Port number must be between 1 and 65535")
+			return
+		}
+		host, _ := utils.ParseIPHost(args[1])
+		probeReceiver(host, port)
+
+	case "probe-listen":
+		if len(args) != 2 {
+			fmt.Println("Usage: probe-listen <port_no>")
+			return
+		}
+		port, err := strconv.Atoi(args[1])
+		if err != nil || port < 1 || port > 65535 {
+			fmt.Println("Port number must be between 1 and 65535")
+			return
+		}
+		runCommand(fmt.Sprintf("probe-listen on port %d", port), func(ctx context.Context) {
+			printProbeHint(port)
+			if err := transfer.ProbeListen(ctx, port); err != nil {
+				fmt.Printf("Error: %v\n", err)
+			}
+		})
 
 	case "help":
 		printInteractiveHelp()
 
 	case "update":
 		if len(args) < 2 {
-			fmt.Println("Usage: update <check|install|auto>")
+			fmt.Println("Usage: update <check|install|auto|ca>")
 			fmt.Println("  - check: Check for available updates")
 			fmt.Println("  - install: Install the latest update")
 			fmt.Println("  - auto: Configure automatic updates")
+			fmt.Println("  - ca: Trust an extra CA bundle (for TLS-intercepting proxies)")
 			return
 		}
 
@@ -404,9 +793,30 @@ func executeCommand(args []string) {
 				fmt.Println("Automatic updates disabled")
 			}
 
+		case "ca":
+			if len(args) != 3 {
+				fmt.Println("Usage: update ca <bundle.pem>|--clear")
+				return
+			}
+
+			path := args[2]
+			if path == "--clear" {
+				path = ""
+			}
+			if err := updater.SetCABundle(path); err != nil {
+				fmt.Printf("Error configuring CA bundle: %v\n", err)
+				return
+			}
+
+			if path == "" {
+				fmt.Println("Extra CA bundle removed")
+			} else {
+				fmt.Printf("Update checks will also trust certificates in %s\n", path)
+			}
+
 		default:
 			fmt.Printf("Unknown update subcommand: %s\n", updateSubcommand)
-			fmt.Println("Valid subcommands: check, install, auto")
+			fmt.Println("Valid subcommands: check, install, auto, ca")
 		}
 
 	case "download":
@@ -440,15 +850,61 @@ func printInteractiveHelp() {
 	fmt.Println("\n\033[1mBitShare Terminal Commands:\033[0m")
 	fmt.Println("\n\033[1;34mCore Commands:\033[0m")
 	fmt.Println("  \033[1mscan\033[0m                    - Scan for nearby peers")
+	fmt.Println("  \033[1mscan --network <name>\033[0m   - Scan for the peers of a private network (--passphrase <passphrase>)")
 	fmt.Println("  \033[1mlist\033[0m                    - List known peers in the network")
+	fmt.Println("  \033[1mpeer <peer>\033[0m             - Show details of a peer (name, ID or handle like #1)")
+	fmt.Println("  \033[1mpin <peer>\033[0m, \033[1munpin <peer>\033[0m - Keep a peer listed however long it is unseen, or not")
+	fmt.Println("  \033[1malias <peer> <alias>\033[0m    - Call a peer by a name of your own (--delete <alias> to remove it)")
+	fmt.Println("  \033[1mblock <peer-or-ip>\033[0m      - Ignore a peer, IP address or CIDR range (--list shows them and refused attempts)")
+	fmt.Println("  \033[1munblock <peer-or-ip>\033[0m    - Let a blocked peer back in")
 	fmt.Println("  \033[1mreceive <port> [dir]\033[0m    - Start receiving files on specified port")
-	fmt.Println("  \033[1msend <peer> <port> <file>\033[0m - Send a file to a peer")
+	fmt.Println("      --once                    - Stop after one transfer instead of waiting for more")
+	fmt.Println("      --tls                     - Only accept encrypted transfers (senders must use --tls too)")
+	fmt.Println("      --pin <pin>               - Only accept senders that know the PIN")
+	fmt.Println("      --no-preserve             - Give received files a fresh modification time and default permissions")
+	fmt.Println("      --stdout                  - Write one received file to stdout instead of saving it, from the command line only")
+	fmt.Println("      --no-resume               - Start interrupted transfers over instead of continuing them")
+	fmt.Println("      --max-size <size>         - Largest file to accept, e.g. 50GB (default 10GB, 0 for unlimited)")
+	fmt.Println("      --on-exists <policy>      - overwrite, rename (default), skip or fail when a file already exists")
+	fmt.Println("      --auto-accept             - Take every file without asking, for unattended receivers")
+	fmt.Println("      --accept-timeout <time>   - How long to wait for an answer before rejecting a file (default 20s, at most 30s)")
+	fmt.Println("      --allow <ips>             - Only take connections from these IPs or CIDR ranges, comma separated")
+	fmt.Println("      --deny <ips>              - Refuse connections from these IPs or CIDR ranges, comma separated")
+	fmt.Println("      --max-connections <n>     - Connections to keep open at once, the rest are told to try later (default 16, 0 for no limit)")
+	fmt.Println("      --max-per-ip <n>          - Connections to keep open at once from one address (default 4, 0 for no limit)")
+	fmt.Println("  \033[1msend <peer> <port> <file...>\033[0m - Send one or more files (globs allowed) to a peer")
+	fmt.Println("  \033[1msend <bitshare://...> <file...>\033[0m - Send to the address shown by the receiver")
+	fmt.Println("      --tls                     - Encrypt the transfer; compare the fingerprint with the receiver's")
+	fmt.Println("      --pin <pin>               - PIN the receiver asks for")
+	fmt.Println("      --allow-downgrade         - Send even if the receiver is less secure than last time")
+	fmt.Println("      --priority <n>            - Start before queued sends of lower priority (default 0)")
+	fmt.Println("      --force                   - Send files even if the receiver already has an identical copy")
+	fmt.Println("      -  --name <file_name>     - Send what is piped into stdin, from the command line only")
+	fmt.Println("  \033[1mroute [add|remove]\033[0m      - Route received files to directories by type, e.g. route add *.mkv /mnt/media")
+	fmt.Println("  \033[1maccess [allow|deny|remove]\033[0m - Limit who can connect, e.g. access allow 192.168.1.0/24")
+	fmt.Println("  \033[1mforward <id|last> <peer> [port] [--force]\033[0m - Forward a received file to another peer")
+	fmt.Println("  \033[1mhistory [clear] [--all] [--json]\033[0m - List sent and received files, newest first")
 
 	fmt.Println("\n\033[1;34mNetwork Commands:\033[0m")
-	fmt.Println("  \033[1mstart\033[0m                   - Restart the mesh network node")
+	fmt.Println("  \033[1mprobe <host> <port>\033[0m     - Check whether a remote receiver is reachable")
+	fmt.Println("  \033[1mprobe-listen <port>\033[0m     - Answer and log probes from another machine")
+	fmt.Println("  \033[1mstart [--name <name>] [--port <port>]\033[0m - Restart the mesh network node")
+	fmt.Println("  \033[1mconfig init [--force]\033[0m   - Write config.json with the defaults to edit")
 	fmt.Println("  \033[1mstatus\033[0m                  - Show current node and network status")
+	fmt.Println("  \033[1mstatus --topology [--json]\033[0m - Show the mesh as a graph of nodes and links")
+	fmt.Println("  \033[1mid [--reset]\033[0m            - Show the node ID peers know this node by, or make a new one")
+	fmt.Println("  \033[1mpower [idle-after <duration|off>] [slowdown <n>]\033[0m - Show or set when the node goes idle")
+	fmt.Println("  \033[1mset <option> <value>\033[0m    - Change the running node without restarting it, until it stops")
+	fmt.Println("      name <name>, port <port>, relay on|off, relay-servers <host:port,...>, offline on|off")
+	fmt.Println("  \033[1msay <text>\033[0m              - Tell every peer on the mesh something")
 
 	fmt.Println("\n\033[1;34mTerminal Commands:\033[0m")
+	fmt.Println("  \033[1mtasks\033[0m                   - List background transfers and receivers")
+	fmt.Println("  \033[1mtransfers\033[0m               - List running and queued sends")
+	fmt.Println("      move <id> <position>      - Change when a queued send starts, 1 is next")
+	fmt.Println("      remove <id>               - Take a send out of the queue, stopping it if running")
+	fmt.Println("      limit <n>                 - Run up to n sends at once (default 2)")
+	fmt.Println("  \033[1mcancel <id>\033[0m             - Stop a background task")
 	fmt.Println("  \033[1mhelp\033[0m                    - Show this help information")
 	fmt.Println("  \033[1mclear\033[0m                   - Clear the terminal screen")
 	fmt.Println("  \033[1mquit\033[0m, \033[1mexit\033[0m, \033[1mbye\033[0m        - Exit BitShare")
@@ -458,75 +914,376 @@ func printInteractiveHelp() {
 	fmt.Println("  \033[1mdownload\033[0m                 - Show download instructions")
 	fmt.Println("  \033[1mupdate check\033[0m             - Check for updates")
 	fmt.Println("  \033[1mupdate install\033[0m           - Install available updates")
+	fmt.Println("  \033[1mupdate ca <bundle.pem>\033[0m   - Trust an extra CA bundle for update checks")
 
 	fmt.Println("\n\033[1mExamples:\033[0m")
 	fmt.Println("  scan")
 	fmt.Println("  receive 9000 C:\\Downloads")
 	fmt.Println("  send bob-laptop 9000 report.pdf")
 	fmt.Println("  send 192.168.1.10 9000 \"My Document.docx\"")
+	fmt.Println("  send bob-laptop 9000 photos/*.jpg notes.txt")
+	fmt.Println("  forward last bob-laptop")
 }
 
 // printNodeStatus shows the current status of the mesh node
 func printNodeStatus() {
 	fmt.Println("\n\033[1mBitShare Node Status:\033[0m")
 
-	// Check if mesh node is running
-	isRunning := mesh.IsNodeRunning()
-	if isRunning {
-		fmt.Println("  Mesh Node: \033[1;32mRunning\033[0m")
+	// Use the node in this process if there is one, otherwise ask a node
+	// running in another terminal, otherwise show what was cached
+	snapshot, source, err := mesh.GetNodeSnapshot()
+	if err != nil {
+		fmt.Println("  Mesh Node: \033[1;31mNot Running\033[0m")
+		fmt.Println("  Type 'start' to start the mesh node")
+		printReceiverStatus()
+		printRouteStatus()
+		printAccessStatus()
+		return
+	}
 
-		// Get node info
-		nodeName := mesh.GetNodeName()
-		nodeID := mesh.GetNodeID()
-		fmt.Printf("  Node Name: %s\n", nodeName)
-		fmt.Printf("  Node ID: %s\n", nodeID)
+	switch source {
+	case mesh.SourceLocal:
+		fmt.Println("  Mesh Node: \033[1;32mRunning\033[0m")
+	case mesh.SourceNode:
+		fmt.Println("  Mesh Node: \033[1;32mRunning\033[0m (in another process)")
+	case mesh.SourceCache:
+		fmt.Println("  Mesh Node: \033[1;31mNot Running\033[0m")
+		fmt.Printf("  Showing cached state from %s (cached, node not running)\n", utils.FormatTime(snapshot.UpdatedAt))
+	}
 
-		// Get connection info
-		connInfo := mesh.GetConnectionInfo()
-		fmt.Printf("  Network Mode: %s\n", getNetworkModeString(connInfo.Mode))
-		fmt.Printf("  Client Isolation: %v\n", connInfo.ClientIsolation)
+	fmt.Printf("  Node Name: %s\n", snapshot.NodeName)
+	fmt.Printf("  Node ID: %s\n", snapshot.NodeID)
+	if snapshot.NodeFingerprint != "" {
+		fmt.Printf("  Fingerprint: %s\n", snapshot.NodeFingerprint)
+	}
+	if snapshot.Network != "" {
+		fmt.Printf("  Network: %s (private)\n", snapshot.Network)
+	} else {
+		fmt.Println("  Network: public")
+	}
+	fmt.Printf("  Network Mode: %s\n", getNetworkModeString(snapshot.Connection.Mode))
+	fmt.Printf("  Client Isolation: %s\n", displayIsolation(snapshot.Connection))
+	if nat := snapshot.Connection.NATType; nat != "" {
+		fmt.Printf("  NAT Type: %s\n", nat)
+		switch nat {
+		case stun.NATSymmetric:
+			fmt.Println("  💡 Peers outside this network are unlikely to connect directly, transfers with them go through relays")
+		case stun.NATBlocked:
+			fmt.Println("  💡 UDP is blocked here, peers outside this network can only be reached through relays")
+		}
+	}
+	if snapshot.Connection.PublicIP != "" {
+		fmt.Printf("  Public IP: %s\n", snapshot.Connection.PublicIP)
+	}
+	if mapping := snapshot.Connection.PortMapping; mapping.External != "" {
+		fmt.Printf("  External: %s (%s)\n", mapping.External, mapping.Method)
+	}
+	if relay := snapshot.Connection.Relay; relay.Active != "" {
+		state := "registered"
+		if !relay.Registered {
+			state = "connecting"
+		}
+		fmt.Printf("  Relay: %s (%s, %s)\n", relay.Active, relay.Latency.Round(time.Millisecond), state)
+		if relay.Backup != "" {
+			fmt.Printf("  Backup Relay: %s (%s)\n", relay.Backup, relay.BackupLatency.Round(time.Millisecond))
+		}
+	} else if source == mesh.SourceLocal && mesh.GetConfig().EnableRelay {
+		fmt.Println("  Relay: none reachable")
+	}
 
-		// Get peer count
-		peers, _ := mesh.GetKnownPeers()
-		onlinePeers := 0
-		for _, peer := range peers {
-			if peer.IsOnline {
-				onlinePeers++
-			}
+	onlinePeers := 0
+	for _, peer := range snapshot.Peers {
+		if peer.IsOnline {
+			onlinePeers++
+		}
+	}
+	fmt.Printf("  Peers: %d online, %d total\n", onlinePeers, len(snapshot.Peers))
+	if open, max, running := p2p.GetTCPManager().ConnectionStats(); running && source == mesh.SourceLocal {
+		fmt.Printf("  TCP service: %s\n", formatConnectionStats(open, max))
+		for _, peer := range p2p.GetTCPManager().ConnectedPeers() {
+			fmt.Printf("    %s (%s): %s\n", peer.Name, peer.Address, peer.Security)
 		}
-		fmt.Printf("  Peers: %d online, %d total\n", onlinePeers, len(peers))
+	}
+	if source != mesh.SourceCache {
+		printPowerStatus(snapshot.Power)
+	}
 
-	} else {
-		fmt.Println("  Mesh Node: \033[1;31mNot Running\033[0m")
+	if source == mesh.SourceCache {
 		fmt.Println("  Type 'start' to start the mesh node")
 	}
+
+	printReceiverStatus()
+	printRouteStatus()
+	printAccessStatus()
+}
+
+// printTopology shows the mesh as a graph, for 'status --topology'
+func printTopology(asJSON bool) {
+	snapshot, source, err := mesh.GetNodeSnapshot()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	if asJSON {
+		data, err := json.MarshalIndent(snapshot.Topology, "", "  ")
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		fmt.Println(string(data))
+		return
+	}
+
+	fmt.Println("\n\033[1mMesh Network Map:\033[0m")
+	if source == mesh.SourceCache {
+		fmt.Printf("Showing cached state from %s (cached, node not running)\n", utils.FormatTime(snapshot.UpdatedAt))
+	}
+	ui.PrintTopology(snapshot.Topology, 100)
 }
 
-// getNetworkModeString converts the network mode enum to a human-readable string
-func getNetworkModeString(mode mesh.NetworkMode) string {
-	switch mode {
-	case mesh.DirectMode:
-		return "Direct (P2P connections available)"
-	case mesh.RelayMode:
-		return "Relay (Using relay servers)"
-	case mesh.MixedMode:
-		return "Mixed (Some direct, some relayed)"
+// printPowerStatus shows whether the node has gone idle as part of 'status'
+func printPowerStatus(power mesh.PowerStatus) {
+	quiet := utils.FormatDuration(time.Since(power.LastActivity))
+	switch {
+	case power.State == mesh.PowerIdle:
+		fmt.Printf("  Power: idle, no activity for %s (background work slowed down)\n", quiet)
+	case power.IdleAfter > 0:
+		fmt.Printf("  Power: normal, goes idle after %s without activity\n", utils.FormatDuration(power.IdleAfter))
 	default:
-		return "Unknown"
+		fmt.Println("  Power: normal, idle mode off")
 	}
 }
 
-// startReceiver starts a file receiver on the given port and directory
-func startReceiver(port int, destDir string) {
-	// Setup signal handling for graceful shutdown
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+// manageIdentity shows the node ID peers know this node by, or replaces it
+// with a new one
+func manageIdentity(args []string) {
+	args, reset := extractSwitch(args, "--reset")
+	if len(args) > 0 {
+		fmt.Println("Usage: id [--reset]")
+		return
+	}
 
-	// On Windows, firewall rules are often necessary. We will always try to add one.
-	rule, err := firewall.AddTempRule(port)
-	if err != nil {
+	if !reset {
+		id, err := mesh.NodeIdentity()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		fmt.Printf("Node ID: %s\n", id)
+		if key, err := mesh.NodeKey(); err == nil {
+			fmt.Printf("Fingerprint: %s\n", p2p.Fingerprint(key.Public().(ed25519.PublicKey)))
+		}
+		if mesh.IsNodeRunning() && mesh.GetNodeID() != id {
+			fmt.Printf("The running node uses %s until it restarts\n", mesh.GetNodeID())
+		}
+		return
+	}
+
+	id, err := mesh.ResetIdentity()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Printf("New node ID: %s\n", id)
+	fmt.Println("Peers will know this node by the new ID from now on.")
+	if mesh.IsNodeRunning() {
+		fmt.Println("The running node keeps its old ID until it restarts.")
+	}
+}
+
+// setNodeOption changes one setting of the running node, for as long as it
+// runs. Settings that need a restart are refused by mesh.Reconfigure.
+func setNodeOption(option, value string) {
+	config := mesh.GetConfig()
+	switch option {
+	case "name":
+		config.NodeName = value
+	case "port":
+		// The TCP service takes the ports above it, as config.Validate says
+		maxPort := 65535 - mesh.ServicePort(0) - 1
+		port, err := strconv.Atoi(value)
+		if err != nil || port < 1 || port > maxPort {
+			fmt.Printf("Port number must be between 1 and %d\n", maxPort)
+			return
+		}
+		config.ListenPort = port
+	case "relay", "offline", "mdns":
+		var on bool
+		switch strings.ToLower(value) {
+		case "on", "true", "yes":
+			on = true
+		case "off", "false", "no":
+		default:
+			fmt.Printf("Error: %s takes on or off, not %q\n", option, value)
+			return
+		}
+		switch option {
+		case "relay":
+			config.EnableRelay = on
+		case "offline":
+			config.Offline = on
+		case "mdns":
+			config.EnableMDNS = on
+		}
+	case "relay-servers":
+		config.RelayServers = nil
+		for _, server := range strings.Split(value, ",") {
+			if server = strings.TrimSpace(server); server != "" {
+				config.RelayServers = append(config.RelayServers, server)
+			}
+		}
+	default:
+		fmt.Printf("Error: unknown option %q, use name, port, relay, relay-servers, offline or mdns\n", option)
+		return
+	}
+
+	if err := mesh.Reconfigure(config); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		if errors.Is(err, mesh.ErrRestartRequired) {
+			fmt.Println("💡 Change it in config.json or with the start flags and restart the node")
+		}
+		return
+	}
+	fmt.Printf("✅ %s set to %s until the node stops\n", option, value)
+}
+
+// sayBroadcast is the broadcast type of the say command
+const sayBroadcast = "say"
+
+// say broadcasts text to the peers on the mesh
+func say(text string) {
+	sent, err := mesh.Broadcast(sayBroadcast, []byte(text))
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Printf("💬 Sent to %d peer(s), who pass it on to theirs\n", sent)
+}
+
+// showSaid prints what another node said with the say command
+func showSaid(msg mesh.BroadcastMessage) {
+	name := msg.FromName
+	if name == "" {
+		name = msg.From
+	}
+	if alias := mesh.AliasOf(msg.From); alias != "" {
+		name = alias
+	}
+	// Another node's text shouldn't drive the terminal
+	text := strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, string(msg.Payload))
+	fmt.Printf("\n💬 %s: %s\n", name, text)
+}
+
+// managePower shows or changes the idle mode thresholds
+func managePower(args []string) {
+	settings, err := mesh.LoadPowerSettings()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	if len(args) == 0 {
+		if settings.IdleAfter > 0 {
+			fmt.Printf("Idle after: %s without transfers or input\n", utils.FormatDuration(settings.IdleAfter))
+		} else {
+			fmt.Println("Idle after: never (idle mode off)")
+		}
+		fmt.Printf("Slowdown while idle: %dx\n", settings.IdleSlowdown)
+		if mesh.IsNodeRunning() {
+			printPowerStatus(mesh.GetPowerStatus())
+		}
+		return
+	}
+
+	if len(args)%2 != 0 {
+		fmt.Println("Usage: power [idle-after <duration|off>] [slowdown <n>]")
+		return
+	}
+	for i := 0; i < len(args); i += 2 {
+		switch args[i] {
+		case "idle-after":
+			if args[i+1] == "off" {
+				settings.IdleAfter = 0
+				continue
+			}
+			d, err := time.ParseDuration(args[i+1])
+			if err != nil || d < time.Minute {
+				fmt.Println("idle-after needs a duration of at least 1m, e.g. 15m or 1h, or 'off'")
+				return
+			}
+			settings.IdleAfter = d
+		case "slowdown":
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 1 {
+				fmt.Println("slowdown needs a whole number of at least 1")
+				return
+			}
+			settings.IdleSlowdown = n
+		default:
+			fmt.Println("Usage: power [idle-after <duration|off>] [slowdown <n>]")
+			return
+		}
+	}
+
+	if err := mesh.SavePowerSettings(settings); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Println("✓ Power settings saved")
+}
+
+// printRouteStatus shows the configured receive routes as part of 'status'
+func printRouteStatus() {
+	if routes, err := transfer.LoadRoutes(); err != nil {
+		fmt.Printf("  Receive routes: %v\n", err)
+	} else {
+		printRoutes(routes)
+	}
+}
+
+// printAccessStatus shows the saved access lists as part of 'status'
+func printAccessStatus() {
+	if rules, err := access.Load(); err != nil {
+		fmt.Printf("  Access lists: %v\n", err)
+	} else {
+		printAccessRules(rules)
+	}
+}
+
+// getNetworkModeString converts the network mode enum to a human-readable string
+func getNetworkModeString(mode mesh.NetworkMode) string {
+	switch mode {
+	case mesh.DirectMode:
+		return "Direct (P2P connections available)"
+	case mesh.RelayMode:
+		return "Relay (Using relay servers)"
+	case mesh.MixedMode:
+		return "Mixed (Some direct, some relayed)"
+	default:
+		return "Unknown"
+	}
+}
+
+// startReceiver starts a file receiver on the given port and directory. With
+// an output writer the one file received is written there instead.
+func startReceiver(ctx context.Context, port int, destDir string, output io.Writer, options transfer.TransferOptions, once bool) error {
+	// Setup signal handling for graceful shutdown
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigChan)
+
+	// On Windows, firewall rules are often necessary. We will always try to add one.
+	rule, err := firewall.AddTempRule(port)
+	if err != nil {
 		fmt.Printf("⚠️  Firewall rule not added: %v\n", err)
 		fmt.Printf("💡 If connection fails, manually allow port %d or run as administrator\n", port)
+		printProbeHint(port)
 	} else {
 		fmt.Printf("✓ Temporary firewall rule added for port %d\n", port)
 		// Ensure rule is removed on exit
@@ -539,39 +1296,919 @@ func startReceiver(port int, destDir string) {
 		}()
 	}
 
-	// Handle graceful shutdown
-	go func() {
-		<-sigChan
-		fmt.Println("\n🛑 Shutting down receiver...")
-		// The deferred cleanup will run when os.Exit is called.
-		os.Exit(0)
-	}()
+	// Handle graceful shutdown, until the receiver returns
+	receiverDone := make(chan struct{})
+	defer close(receiverDone)
+	go func() {
+		select {
+		case <-sigChan:
+			fmt.Println("\n🛑 Shutting down receiver...")
+			transfer.WithdrawConnectionCard(port)
+			// The deferred cleanup will run when os.Exit is called.
+			os.Exit(0)
+		case <-receiverDone:
+		}
+	}()
+
+	fmt.Printf("📡 Receiver: Listening on port %d\n", port)
+	if output != nil {
+		fmt.Println("💾 The received file is written to stdout")
+	} else {
+		fmt.Printf("💾 Files will be saved to: %s\n", destDir)
+	}
+	if options.PIN != "" {
+		fmt.Printf("🔑 PIN: %s - senders must use --pin %s\n", options.PIN, options.PIN)
+	}
+	for _, rule := range options.Routes {
+		if rule.Pattern != transfer.RouteDefault {
+			fmt.Printf("   %s files go to %s\n", rule.Pattern, rule.Dir)
+		}
+	}
+	if interactiveMode {
+		fmt.Println("Use 'tasks' and 'cancel <id>' to stop receiving")
+	} else {
+		fmt.Printf("Press Ctrl+C to stop\n")
+	}
+
+	// Set connection timeout for security (increased for larger files)
+	options.Context = ctx
+	reportEvents(&options)
+	options.ListeningFunc = func(card transfer.ConnectionCard) {
+		printConnectionCard(card, "")
+	}
+	switch {
+	case output != nil:
+		err = transfer.ReceiveToWriter(port, 300*time.Second, output, options)
+	case once:
+		err = transfer.ReceiveFileWithOptions(port, 300*time.Second, destDir, options)
+	default:
+		err = transfer.ReceiveLoop(port, destDir, options)
+	}
+	if err != nil && ctx.Err() == nil {
+		fmt.Printf("Error receiving file: %v\n", err)
+	}
+	emitResult(ctx, "receive", err)
+	return err
+}
+
+// extractFlag removes a "--name <value>" flag from the arguments and returns its value
+func extractFlag(args []string, name string) ([]string, string, bool, error) {
+	var rest []string
+	value, found := "", false
+
+	for i := 0; i < len(args); i++ {
+		if args[i] != name {
+			rest = append(rest, args[i])
+			continue
+		}
+		if i+1 >= len(args) {
+			return nil, "", false, fmt.Errorf("%s needs a value", name)
+		}
+		value, found = args[i+1], true
+		i++
+	}
+
+	return rest, value, found, nil
+}
+
+// extractSwitch removes a flag without a value, like "--once", and reports whether it was present
+func extractSwitch(args []string, name string) ([]string, bool) {
+	var rest []string
+	found := false
+	for _, arg := range args {
+		if arg == name {
+			found = true
+			continue
+		}
+		rest = append(rest, arg)
+	}
+	return rest, found
+}
+
+// extractPIN removes a "--pin <pin>" flag from the arguments and returns the PIN
+func extractPIN(args []string) ([]string, string, error) {
+	rest, pin, found, err := extractFlag(args, "--pin")
+	if err != nil {
+		return nil, "", fmt.Errorf("%v, e.g. --pin 4821", err)
+	}
+	if found && len(pin) < 4 {
+		return nil, "", fmt.Errorf("the PIN must be at least 4 characters long")
+	}
+	return rest, pin, nil
+}
+
+// extractMaxSize removes a "--max-size <size>" flag from the arguments and
+// returns the limit it sets, or fallback when absent. 0 means unlimited.
+func extractMaxSize(args []string, fallback int64) ([]string, int64, error) {
+	rest, value, found, err := extractFlag(args, "--max-size")
+	if err != nil {
+		return nil, 0, fmt.Errorf("%v, e.g. --max-size 50GB or --max-size 0 for unlimited", err)
+	}
+	if !found {
+		return rest, fallback, nil
+	}
+
+	maxSize, err := utils.ParseBytes(value)
+	if err != nil {
+		return nil, 0, err
+	}
+	return rest, maxSize, nil
+}
+
+// extractPriority removes a "--priority <n>" flag from the arguments and
+// returns the queue priority it sets, 0 when absent
+func extractPriority(args []string) ([]string, int, error) {
+	rest, value, found, err := extractFlag(args, "--priority")
+	if err != nil {
+		return nil, 0, fmt.Errorf("%v, e.g. --priority 10", err)
+	}
+	if !found {
+		return rest, 0, nil
+	}
+	priority, err := strconv.Atoi(value)
+	if err != nil {
+		return nil, 0, fmt.Errorf("--priority needs a whole number, got %q", value)
+	}
+	return rest, priority, nil
+}
+
+// extractCollisionPolicy removes an "--on-exists <policy>" flag from the arguments
+// and returns the policy it sets, or fallback when absent
+func extractCollisionPolicy(args []string, fallback string) ([]string, string, error) {
+	rest, policy, found, err := extractFlag(args, "--on-exists")
+	if err != nil {
+		return nil, "", fmt.Errorf("%v: overwrite, rename, skip or fail", err)
+	}
+	if !found {
+		return rest, fallback, nil
+	}
+
+	policy = strings.ToLower(policy)
+	if !transfer.ValidCollisionPolicy(policy) {
+		return nil, "", fmt.Errorf("unknown --on-exists policy %q, use overwrite, rename, skip or fail", policy)
+	}
+	return rest, policy, nil
+}
+
+// extractAccessRules removes "--allow <ips>" and "--deny <ips>" flags from the
+// arguments and returns the rules they add, each a comma separated list of
+// IP addresses and CIDR ranges
+func extractAccessRules(args []string) ([]string, access.Rules, error) {
+	var rules access.Rules
+	for _, name := range []string{"--allow", "--deny"} {
+		rest, value, found, err := extractFlag(args, name)
+		if err != nil {
+			return nil, rules, fmt.Errorf("%v, e.g. %s 192.168.1.0/24,10.0.0.5", err, name)
+		}
+		args = rest
+		if !found {
+			continue
+		}
+		entries, err := access.ParseList(value)
+		if err != nil {
+			return nil, rules, fmt.Errorf("%s: %v", name, err)
+		}
+		if name == "--allow" {
+			rules.Allow = entries
+		} else {
+			rules.Deny = entries
+		}
+	}
+	return args, rules, nil
+}
+
+// extractConnectionLimits removes "--max-connections <n>" and "--max-per-ip <n>"
+// flags from the arguments and returns the limits, or the defaults when absent
+func extractConnectionLimits(args []string) ([]string, int, int, error) {
+	limits := map[string]int{
+		"--max-connections": transfer.DefaultMaxConnections,
+		"--max-per-ip":      transfer.DefaultMaxConnectionsPerIP,
+	}
+	for _, name := range []string{"--max-connections", "--max-per-ip"} {
+		rest, value, found, err := extractFlag(args, name)
+		if err != nil {
+			return nil, 0, 0, fmt.Errorf("%v, e.g. %s 8", err, name)
+		}
+		args = rest
+		if !found {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, 0, 0, fmt.Errorf("%s needs a whole number, or 0 for no limit", name)
+		}
+		limits[name] = n
+	}
+	return args, limits["--max-connections"], limits["--max-per-ip"], nil
+}
+
+// How long the shell asks about an incoming file before rejecting it.
+// Senders give up after maxAcceptTimeout without an answer.
+const (
+	defaultAcceptTimeout = 20 * time.Second
+	maxAcceptTimeout     = 30 * time.Second
+)
+
+// extractAcceptTimeout removes an "--accept-timeout <duration>" flag from the
+// arguments and returns the timeout it sets, or the default when absent
+func extractAcceptTimeout(args []string) ([]string, time.Duration, error) {
+	rest, value, found, err := extractFlag(args, "--accept-timeout")
+	if err != nil {
+		return nil, 0, fmt.Errorf("%v, e.g. --accept-timeout 15s", err)
+	}
+	if !found {
+		return rest, defaultAcceptTimeout, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 || timeout > maxAcceptTimeout {
+		return nil, 0, fmt.Errorf("--accept-timeout needs a duration up to %s, e.g. 15s", maxAcceptTimeout)
+	}
+	return rest, timeout, nil
+}
+
+// promptAccept returns an AcceptFunc that asks at the shell prompt whether
+// to take each incoming file, rejecting it when nobody answers in time
+func promptAccept(timeout time.Duration) func(transfer.IncomingFile) (bool, string) {
+	return func(file transfer.IncomingFile) (bool, string) {
+		from, _, err := net.SplitHostPort(file.Peer)
+		if err != nil {
+			from = file.Peer
+		}
+		if peer, ok := mesh.FindPeerByAddress(file.Peer); ok && peer.Name != "" {
+			from = fmt.Sprintf("%s (%s)", from, peer.Name)
+		}
+		size := "stream"
+		if file.Size >= 0 {
+			size = utils.FormatBytes(file.Size)
+		}
+
+		accept, answered := askShell(fmt.Sprintf("📥 Incoming: %s (%s) from %s — accept? [y/N]", file.Name, size, from), timeout)
+		switch {
+		case !answered:
+			fmt.Printf("No answer within %s, rejected %s\n", utils.FormatDuration(timeout), file.Name)
+		case !accept:
+			fmt.Printf("Rejected %s\n", file.Name)
+		}
+		return accept, ""
+	}
+}
+
+// A question from a background task is answered by the next yes or no typed
+// at the shell prompt. Only one question is open at a time.
+var (
+	questionSlot  = make(chan struct{}, 1)
+	answerMutex   sync.Mutex
+	pendingAnswer chan bool
+)
+
+// askShell asks a yes or no question at the shell and waits up to timeout
+// for the answer, reporting whether one came. Other input still runs as
+// commands while it waits.
+func askShell(question string, timeout time.Duration) (accept, answered bool) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	// Wait for the question before this one to be answered
+	select {
+	case questionSlot <- struct{}{}:
+		defer func() { <-questionSlot }()
+	case <-timer.C:
+		return false, false
+	}
+
+	answer := make(chan bool, 1)
+	answerMutex.Lock()
+	pendingAnswer = answer
+	answerMutex.Unlock()
+	defer func() {
+		answerMutex.Lock()
+		pendingAnswer = nil
+		answerMutex.Unlock()
+	}()
+
+	fmt.Printf("\n%s ", question)
+	select {
+	case accept := <-answer:
+		return accept, true
+	case <-timer.C:
+		fmt.Println()
+		return false, false
+	}
+}
+
+// answerShell passes a line typed at the shell to the open question, if
+// there is one and the line answers it. An empty line means no.
+func answerShell(line string) bool {
+	answerMutex.Lock()
+	defer answerMutex.Unlock()
+
+	if pendingAnswer == nil {
+		return false
+	}
+	switch strings.ToLower(line) {
+	case "y", "yes":
+		pendingAnswer <- true
+	case "", "n", "no":
+		pendingAnswer <- false
+	default:
+		fmt.Println("(Answer y or n to the question above)")
+		return false
+	}
+	pendingAnswer = nil
+	return true
+}
+
+// showTransfers draws a progress line for every transfer in the process from
+// the transfer events, and prints the total time and average speed of each
+// file once it completes
+func showTransfers() {
+	updates, _ := transfer.Subscribe()
+	go func() {
+		for event := range updates {
+			mesh.NoteActivity()
+			if event.Type == transfer.EventProgress {
+				showProgress(event)
+			}
+		}
+	}()
+}
+
+// showProgress draws the progress line of a transfer
+func showProgress(event transfer.TransferEvent) {
+	if event.Total == 0 {
+		return
+	}
+	events.Emit(events.Event{
+		Type:        events.TypeProgress,
+		Label:       event.FileName,
+		Peer:        event.Peer,
+		BytesDone:   event.BytesDone,
+		Total:       event.Total,
+		Rate:        event.CurrentRate,
+		AverageRate: event.AverageRate,
+		ETASeconds:  event.ETA.Seconds(),
+	})
+	name := event.FileName
+	if event.Direction == transfer.DirectionReceived {
+		// Receivers may serve several senders at once
+		name = fmt.Sprintf("%s from %s", name, event.Peer)
+	}
+	ui.GetTerminalUI().UpdateTransferProgress(ui.TransferProgress{
+		FileName:      name,
+		FileSize:      event.Total,
+		BytesComplete: event.BytesDone,
+		StartTime:     event.Time.Add(-event.Elapsed),
+		Status:        "transferring",
+		SpeedBps:      event.CurrentRate,
+		ETA:           event.ETA,
+	})
+	if event.Total > 0 && event.BytesDone >= event.Total {
+		fmt.Printf("\n%s transferred in %s (average %s/s)\n", utils.FormatBytes(event.Total),
+			utils.FormatDuration(event.Elapsed), utils.FormatBytes(event.AverageRate))
+		if logical := event.BytesDone - event.Resumed; event.WireBytes > 0 && event.WireBytes < logical {
+			fmt.Printf("Compressed: %s of data, %s on the wire (%.0f%%)\n", utils.FormatBytes(logical),
+				utils.FormatBytes(event.WireBytes), float64(event.WireBytes)*100/float64(logical))
+		}
+	}
+}
+
+// extractEventStream removes the "--progress-fd <n>" and "--progress-json"
+// flags from the arguments and starts the machine-readable event stream they
+// ask for, on descriptor n or on stderr
+func extractEventStream(args []string) ([]string, error) {
+	args, toStderr := extractSwitch(args, "--progress-json")
+	args, value, found, err := extractFlag(args, "--progress-fd")
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case found:
+		fd, err := strconv.Atoi(value)
+		if err != nil || fd < 0 {
+			return nil, fmt.Errorf("invalid --progress-fd %q, expected a file descriptor number", value)
+		}
+		events.Enable(os.NewFile(uintptr(fd), "progress"))
+	case toStderr:
+		events.Enable(os.Stderr)
+	}
+	return args, nil
+}
+
+// reportEvents sends a transfer's state changes to the event stream and asks
+// the program reading it to accept, reject or rename each incoming file
+func reportEvents(options *transfer.TransferOptions) {
+	if !events.Enabled() {
+		return
+	}
+
+	options.StateFunc = func(state transfer.TransferState) {
+		events.Emit(events.Event{Type: events.TypeState, State: state.State, File: state.File, Peer: state.Peer, Error: state.Error})
+	}
+	options.AcceptFunc = func(file transfer.IncomingFile) (bool, string) {
+		message := fmt.Sprintf("Accept %s (%s) from %s?", file.Name, utils.FormatBytes(file.Size), file.Peer)
+		response, err := events.Prompt("accept", message, []string{"accept", "reject", "rename"})
+		if err != nil {
+			return true, ""
+		}
+		switch response.Answer {
+		case "reject":
+			return false, ""
+		case "rename":
+			return true, response.Value
+		}
+		return true, ""
+	}
+}
+
+// emitPeerState reports a peer coming online, going offline or being
+// forgotten on the event stream
+func emitPeerState(peer mesh.Peer, state string) {
+	events.Emit(events.Event{Type: events.TypePeer, State: state, Peer: peer.ID, Name: peer.Name})
+}
+
+// emitResult reports how a command ended on the event stream
+func emitResult(ctx context.Context, command string, err error) {
+	event := events.Event{Type: events.TypeResult, Command: command, State: "ok"}
+	switch {
+	case ctx.Err() != nil:
+		event.State = "cancelled"
+	case err != nil:
+		event.State = "failed"
+		event.Error = err.Error()
+	}
+	events.Emit(event)
+}
+
+// runCommand runs a long running command as a background task in interactive
+// mode, and in the foreground when invoked from the command line
+func runCommand(name string, fn func(ctx context.Context)) {
+	if !interactiveMode {
+		fn(context.Background())
+		return
+	}
+
+	tasks.Start(name, func(ctx context.Context) error {
+		fn(ctx)
+		return ctx.Err()
+	}, func(err error) {
+		if err != nil {
+			fmt.Printf("Task '%s' cancelled\n", name)
+		}
+	})
+}
+
+// manageRoutes lists, adds and removes the rules that route received files by type
+func manageRoutes(args []string) {
+	routes, err := transfer.LoadRoutes()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	if len(args) == 0 || args[0] == "list" {
+		printRoutes(routes)
+		return
+	}
+
+	switch args[0] {
+	case "add":
+		if len(args) != 3 {
+			fmt.Println("Usage: route add <pattern|default> <directory>")
+			return
+		}
+		rule := transfer.RouteRule{Pattern: args[1], Dir: args[2]}
+		if abs, err := filepath.Abs(rule.Dir); err == nil {
+			rule.Dir = abs
+		}
+		if err := transfer.ValidateRoutes([]transfer.RouteRule{rule}); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+
+		// Replace an existing rule for the same pattern, keeping its position
+		replaced := false
+		for i := range routes {
+			if routes[i].Pattern == rule.Pattern {
+				routes[i] = rule
+				replaced = true
+			}
+		}
+		if !replaced {
+			routes = append(routes, rule)
+		}
+
+		if err := transfer.SaveRoutes(routes); err != nil {
+			fmt.Printf("Error saving routes: %v\n", err)
+			return
+		}
+		fmt.Printf("✓ %s -> %s\n", rule.Pattern, rule.Dir)
+
+	case "remove":
+		if len(args) != 2 {
+			fmt.Println("Usage: route remove <pattern|default>")
+			return
+		}
+		kept := routes[:0]
+		for _, rule := range routes {
+			if rule.Pattern != args[1] {
+				kept = append(kept, rule)
+			}
+		}
+		if len(kept) == len(routes) {
+			fmt.Printf("No route for %s\n", args[1])
+			return
+		}
+		if err := transfer.SaveRoutes(kept); err != nil {
+			fmt.Printf("Error saving routes: %v\n", err)
+			return
+		}
+		fmt.Printf("✓ Removed route for %s\n", args[1])
+
+	default:
+		fmt.Println("Usage: route [list|add <pattern> <directory>|remove <pattern>]")
+		fmt.Println("  Patterns are filename globs like *.mkv, MIME types like video/* or 'default'")
+	}
+}
+
+// manageAccess lists and edits the saved lists of addresses that may or may
+// not connect to receivers and the mesh node
+func manageAccess(args []string) {
+	rules, err := access.Load()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	if len(args) == 0 || args[0] == "list" {
+		printAccessRules(rules)
+		return
+	}
+	if len(args) != 2 {
+		fmt.Println("Usage: access [list|allow <ip_or_cidr>|deny <ip_or_cidr>|remove <ip_or_cidr>]")
+		return
+	}
+
+	entry := args[1]
+	without := func(entries []string) []string {
+		var kept []string
+		for _, e := range entries {
+			if e != entry {
+				kept = append(kept, e)
+			}
+		}
+		return kept
+	}
+
+	switch args[0] {
+	case "allow", "deny":
+		if _, err := access.ParseEntry(entry); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		// An address is on one list at a time
+		rules.Allow, rules.Deny = without(rules.Allow), without(rules.Deny)
+		if args[0] == "allow" {
+			rules.Allow = append(rules.Allow, entry)
+		} else {
+			rules.Deny = append(rules.Deny, entry)
+		}
+
+	case "remove":
+		allow, deny := without(rules.Allow), without(rules.Deny)
+		if len(allow) == len(rules.Allow) && len(deny) == len(rules.Deny) {
+			fmt.Printf("%s is not on either list\n", entry)
+			return
+		}
+		rules.Allow, rules.Deny = allow, deny
+
+	default:
+		fmt.Println("Usage: access [list|allow <ip_or_cidr>|deny <ip_or_cidr>|remove <ip_or_cidr>]")
+		fmt.Println("  Entries are IP addresses like 192.168.1.20 or CIDR ranges like 192.168.1.0/24")
+		return
+	}
+
+	if err := access.Save(rules); err != nil {
+		fmt.Printf("Error saving access lists: %v\n", err)
+		return
+	}
+	switch args[0] {
+	case "allow":
+		fmt.Printf("✓ Allowed %s\n", entry)
+		if len(rules.Allow) == 1 {
+			fmt.Println("  Only addresses on the allow list can connect now")
+		}
+	case "deny":
+		fmt.Printf("✓ Denied %s\n", entry)
+	case "remove":
+		fmt.Printf("✓ Removed %s\n", entry)
+	}
+	fmt.Println("  Receivers started from now on and the mesh node use the new lists")
+}
+
+// printAccessRules shows the lists of addresses that may or may not connect
+func printAccessRules(rules access.Rules) {
+	if rules.Empty() {
+		fmt.Println("  Access lists: none (any address can connect)")
+		return
+	}
+
+	fmt.Println("  Access lists:")
+	if len(rules.Allow) > 0 {
+		fmt.Printf("    Allowed: %s (nothing else can connect)\n", strings.Join(rules.Allow, ", "))
+	}
+	if len(rules.Deny) > 0 {
+		fmt.Printf("    Denied:  %s\n", strings.Join(rules.Deny, ", "))
+	}
+}
+
+// printRoutes shows the receive routes and whether their directories are usable
+func printRoutes(routes []transfer.RouteRule) {
+	if len(routes) == 0 {
+		fmt.Println("  Receive routes: none (files go to the receive directory)")
+		return
+	}
+
+	fmt.Println("  Receive routes:")
+	for _, rule := range routes {
+		state := "✓"
+		if err := transfer.ValidateRoutes([]transfer.RouteRule{rule}); err != nil {
+			state = "❌ directory missing or not writable"
+		}
+		fmt.Printf("    %-16s -> %s %s\n", rule.Pattern, rule.Dir, state)
+	}
+}
+
+// listTasks prints the background tasks started in this session
+func listTasks() {
+	running := tasks.List()
+	if len(running) == 0 {
+		fmt.Println("No background tasks are running.")
+		return
+	}
+
+	fmt.Println("Background tasks:")
+	for _, task := range running {
+		fmt.Printf("  %-4d %-36s running for %s\n", task.ID, task.Name, utils.FormatDuration(time.Since(task.Started)))
+	}
+	fmt.Println("Use 'cancel <id>' to stop a task.")
+}
+
+// manageTransfers lists the send queue, or moves, removes or limits sends in it
+func manageTransfers(args []string) {
+	if len(args) == 0 {
+		listQueue()
+		return
+	}
+
+	var numbers []int
+	for _, arg := range args[1:] {
+		n, err := strconv.Atoi(arg)
+		if err != nil {
+			fmt.Printf("Not a number: %s\n", arg)
+			return
+		}
+		numbers = append(numbers, n)
+	}
+
+	var err error
+	switch {
+	case args[0] == "move" && len(numbers) == 2:
+		if err = transfer.ReorderQueue(numbers[0], numbers[1]); err == nil {
+			fmt.Printf("✓ Transfer %d moved to position %d\n", numbers[0], numbers[1])
+		}
+	case args[0] == "remove" && len(numbers) == 1:
+		if err = transfer.RemoveFromQueue(numbers[0]); err == nil {
+			fmt.Printf("✓ Transfer %d removed\n", numbers[0])
+		}
+	case args[0] == "limit" && len(numbers) == 1:
+		if err = transfer.SetMaxActiveSends(numbers[0]); err == nil {
+			fmt.Printf("✓ Up to %d sends run at once\n", numbers[0])
+		}
+	default:
+		fmt.Println("Usage: transfers [move <id> <position> | remove <id> | limit <n>]")
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+}
+
+// listQueue shows the running sends and the ones waiting for a slot
+func listQueue() {
+	queue := transfer.ListQueue()
+	if len(queue) == 0 {
+		fmt.Printf("No sends are running or queued (up to %d run at once).\n", transfer.MaxActiveSends())
+		return
+	}
+
+	fmt.Printf("Sends (up to %d run at once):\n", transfer.MaxActiveSends())
+	position := 0
+	for _, send := range queue {
+		if send.Status == transfer.QueueStatusRunning {
+			fmt.Printf("  %-4d %-8s %-40s running for %s\n", send.ID, send.Status, send.Name, utils.FormatDuration(time.Since(send.Started)))
+			continue
+		}
+		position++
+		fmt.Printf("  %-4d %-8s %-40s #%d in line, priority %d, waiting for %s\n", send.ID, send.Status, send.Name, position, send.Priority, utils.FormatDuration(time.Since(send.Queued)))
+	}
+	fmt.Println("Use 'transfers move <id> <position>' or 'transfers remove <id>' to change the queue.")
+}
+
+// shutdownTasks cancels all background tasks before the shell exits
+func shutdownTasks() {
+	if remaining := tasks.CancelAll(2 * time.Second); remaining > 0 {
+		fmt.Printf("⚠️  %d background task(s) did not stop in time\n", remaining)
+	}
+}
+
+// probeReceiver checks whether a remote receiver is reachable and reports each stage
+func probeReceiver(host string, port int) {
+	fmt.Printf("🔎 Probing %s...\n", net.JoinHostPort(host, strconv.Itoa(port)))
+	result := transfer.Probe(host, port, 5*time.Second)
+
+	switch result.Connect {
+	case transfer.ProbeOK:
+		fmt.Printf("  TCP connect: ✓ ok (%v)\n", result.Latency.Round(time.Millisecond))
+	case transfer.ProbeRefused:
+		fmt.Println("  TCP connect: ✗ refused - nothing is listening on that port")
+		fmt.Println("  💡 Start the receiver first, or check the port number")
+	case transfer.ProbeTimedOut:
+		fmt.Println("  TCP connect: ✗ timed out - a firewall is probably dropping the connection")
+		fmt.Printf("  💡 Allow TCP port %d on the receiving machine, or check both devices are on the same network\n", port)
+	default:
+		fmt.Printf("  TCP connect: ✗ failed - %v\n", result.Detail)
+	}
+
+	switch result.Handshake {
+	case transfer.ProbeOK:
+		if result.AppVersion != "" {
+			fmt.Printf("  Handshake:   ✓ ok (BitShare %s, protocol v%d)\n", result.AppVersion, result.Version)
+			mesh.SetPeerVersion(host, result.AppVersion)
+		} else {
+			fmt.Printf("  Handshake:   ✓ ok (BitShare protocol v%d)\n", result.Version)
+		}
+		fmt.Println("✅ Receiver is reachable")
+	case transfer.ProbeWrongProtocol:
+		fmt.Printf("  Handshake:   ✗ wrong protocol - something other than BitShare is on this port (%v)\n", result.Detail)
+	case transfer.ProbeNoResponse:
+		fmt.Println("  Handshake:   ✗ no response - the port is open but nothing answered")
+	case transfer.ProbeAuthRequired:
+		fmt.Println("  Handshake:   ✓ ok, but the receiver requires a PIN (send with --pin)")
+	case transfer.ProbeBusy:
+		fmt.Printf("  Handshake:   ✗ busy - BitShare answered but turned the connection away (%v)\n", result.Detail)
+	}
+	if result.TLS {
+		fmt.Println("  🔒 The receiver only accepts encrypted transfers, send with --tls")
+	}
+}
+
+// explainSendFailure checks whether a send failed because the receiver runs
+// an older release lacking a feature the transfer needs, and if so tells the
+// user how to fix it. It reports whether an explanation was printed.
+func explainSendFailure(ip string, port int, fileCount int) bool {
+	result := transfer.Probe(ip, port, 3*time.Second)
+	if result.AppVersion != "" {
+		mesh.SetPeerVersion(ip, result.AppVersion)
+	}
+
+	name, peerVersion := ip, result.AppVersion
+	if peer, ok := mesh.FindPeerByAddress(ip); ok {
+		name = peer.Name
+		if peerVersion == "" {
+			peerVersion = peer.Version
+		}
+	}
+
+	if peerVersion == "" {
+		// Releases before 1.1.0 don't understand probes at all
+		if result.Connect == transfer.ProbeOK && result.Handshake != transfer.ProbeOK {
+			fmt.Printf("💡 %s did not answer a BitShare handshake. If it runs a release older than %s,\n", name,
+				transfer.FeatureMinVersion(transfer.FeatureFramedHeaders))
+			fmt.Println("   they can run 'bitshare update install' to update")
+			return true
+		}
+		return false
+	}
+
+	features := []string{transfer.FeatureFramedHeaders, transfer.FeatureResume}
+	if fileCount > 1 {
+		features = append(features, transfer.FeatureBatch)
+	}
+	missing := transfer.MissingFeatures(peerVersion, features...)
+	if len(missing) == 0 {
+		return false
+	}
+
+	fmt.Printf("💡 %s runs %s which lacks %s - they can run 'bitshare update install'\n",
+		name, peerVersion, strings.Join(missing, " and "))
+	return true
+}
+
+// displayVersion shows an unknown peer version as such
+func displayVersion(v string) string {
+	if v == "" {
+		return "unknown"
+	}
+	return v
+}
+
+// displayIsolation shows the client isolation verdict and how sure it is
+func displayIsolation(info mesh.ConnectionInfo) string {
+	switch {
+	case info.IsolationConfidence == "" || info.IsolationConfidence == mesh.IsolationUnknown:
+		return "unknown, no peer to try yet"
+	case info.ClientIsolation:
+		return fmt.Sprintf("yes (%s confidence)", info.IsolationConfidence)
+	default:
+		return fmt.Sprintf("no (%s confidence)", info.IsolationConfidence)
+	}
+}
+
+// displayQuality shows the measured quality of the link to a peer
+func displayQuality(peer mesh.Peer) string {
+	if peer.ConnectionQuality == "" {
+		return "not measured"
+	}
+	return peer.ConnectionQuality
+}
+
+// displayProtocols shows the protocols a peer was seen on, best first
+func displayProtocols(peer mesh.Peer) string {
+	protocols := peer.Protocols()
+	if len(protocols) == 0 {
+		return "unknown"
+	}
+	return strings.Join(protocols, ", ")
+}
+
+// printProbeHint shows the command the other machine can use to test reachability
+func printProbeHint(port int) {
+	addresses, _ := utils.GetLocalAddresses()
+	if len(addresses) == 0 {
+		return
+	}
+	fmt.Println("💡 To check that this machine is reachable, run on the sending machine:")
+	fmt.Printf("   bitshare probe %s %d\n", addresses[0].IP, port)
+}
 
-	// Get local IP for user information
-	localIPs, err := utils.GetAllLocalIPs()
-	if err != nil {
-		fmt.Printf("⚠️  Warning: Could not determine local IP addresses: %v\n", err)
+// printConnectionCard shows senders how to reach a receiver, recommending one address
+func printConnectionCard(card transfer.ConnectionCard, indent string) {
+	if card.Recommended != "" {
+		fmt.Printf("%s🔗 Connect to: %s\n", indent, card.Recommended)
+		fmt.Printf("%s   %s\n", indent, card.URI)
+	}
+	if len(card.Alternates) > 0 {
+		var others []string
+		for _, address := range card.Alternates {
+			other := fmt.Sprintf("%s (%s, %s)", address.Address, address.Kind, address.Interface)
+			if !address.Reachable {
+				other += " not answering"
+			}
+			others = append(others, other)
+		}
+		label := "more addresses"
+		if card.Recommended == "" {
+			label = "addresses"
+		}
+		fmt.Printf("%s   %d %s: %s\n", indent, len(others), label, strings.Join(others, ", "))
 	}
+	if card.Warning != "" {
+		fmt.Printf("%s⚠️  %s\n", indent, card.Warning)
+	}
+}
 
-	fmt.Printf("📡 Receiver: Listening on port %d\n", port)
-	if len(localIPs) > 0 {
-		fmt.Println("🌐 Your IP addresses are:")
-		for _, ip := range localIPs {
-			fmt.Printf("  - %s\n", ip)
-			if strings.HasPrefix(ip, "169.254.") {
-				fmt.Println("  ⚠️  Warning: This IP looks like an APIPA address. Your computer may not be connected to the network correctly. Please check your network connection.")
+// printReceiverStatus shows the connection cards of running receivers as part of 'status'
+func printReceiverStatus() {
+	cards := transfer.ConnectionCards()
+	if len(cards) == 0 {
+		fmt.Println("  Receiver: not running")
+		return
+	}
+	for _, card := range cards {
+		security := ""
+		if card.TLS {
+			security += ", TLS"
+		}
+		if card.PIN {
+			security += ", PIN"
+		}
+		fmt.Printf("  Receiver: port %d, started %s%s\n", card.Port, utils.FormatTime(card.StartedAt), security)
+		for _, stats := range transfer.ReceiverConnections() {
+			if stats.Port == card.Port {
+				fmt.Printf("    %s\n", formatConnectionStats(stats.Open, stats.Max))
 			}
 		}
-		fmt.Printf("🔗 Others can connect to: %s:%d\n", localIPs[0], port)
+		printConnectionCard(card, "    ")
 	}
-	fmt.Printf("💾 Files will be saved to: %s\n", destDir)
-	fmt.Printf("Press Ctrl+C to stop\n")
+}
 
-	// Set connection timeout for security (increased for larger files)
-	err = transfer.ReceiveFileWithTimeout(port, 300*time.Second, destDir)
-	if err != nil {
-		fmt.Printf("Error receiving file: %v\n", err)
+// formatConnectionStats describes how many of a listener's connections are in use
+func formatConnectionStats(open, max int) string {
+	if max <= 0 {
+		return fmt.Sprintf("%d connections in use (no limit)", open)
 	}
+	return fmt.Sprintf("%d/%d connections in use", open, max)
 }
 
 // startSender initiates a file transfer to the given IP and port
@@ -612,8 +2249,18 @@ func startSender(ip string, port int, filePath string) {
 	fmt.Println("File sent successfully!")
 }
 
-// startMeshNode starts or restarts the mesh network node
-func startMeshNode() {
+// transferDefaults returns the transfer options config.json sets, before any flags
+func transferDefaults() (transfer.TransferOptions, error) {
+	settings, err := config.Load()
+	if err != nil {
+		return transfer.TransferOptions{}, fmt.Errorf("%v (run 'config init --force' to start over)", err)
+	}
+	return settings.TransferOptions(), nil
+}
+
+// startMeshNode starts or restarts the mesh network node with the settings
+// from config.json, overridden by the flags in args
+func startMeshNode(args []string) {
 	// Setup signal handling for graceful shutdown
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
@@ -627,23 +2274,33 @@ func startMeshNode() {
 	}()
 
 	// Initialize mesh networking
-	config := mesh.Config{
-		NodeName:         utils.GenerateNodeName(),
-		ListenPort:       9000, // Default port
-		EnableWiFiDirect: true,
-		EnableBluetooth:  true,
-		EnableTCP:        true,
-		EnableRelay:      true, // Enable relay by default
+	settings, err := config.Load()
+	if err != nil {
+		fmt.Printf("❌ %v\n", err)
+		fmt.Println("Fix the setting, or run 'config init --force' to start over")
+		return
+	}
+	rest, err := settings.ApplyFlags(args)
+	if err == nil && len(rest) > 0 {
+		err = fmt.Errorf("unknown argument %q", rest[0])
 	}
+	if err != nil {
+		fmt.Printf("❌ %v\n", err)
+		fmt.Println("Usage: start [--name <name>] [--port <port>] [--data-dir <dir>] [--relay|--no-relay] [--offline] [--allow-plaintext]")
+		return
+	}
+	meshConfig := settings.MeshConfig()
+	meshConfig.PeerStateFunc = emitPeerState
 
 	fmt.Println("🌐 Starting BitShare mesh node...")
-	err := mesh.StartMeshNode(config)
+	err = mesh.StartMeshNode(meshConfig)
 	if err != nil {
 		fmt.Printf("❌ Failed to start mesh node: %v\n", err)
+		explainStartFailure(err)
 		return
 	}
 
-	fmt.Printf("✅ Node started successfully as '%s'\n", config.NodeName)
+	fmt.Printf("✅ Node started successfully as '%s'\n", meshConfig.NodeName)
 	fmt.Println("📡 Listening for connections...")
 	fmt.Println("Press Ctrl+C to stop")
 
@@ -651,52 +2308,612 @@ func startMeshNode() {
 	select {}
 }
 
-// scanNetwork scans the local network for peers
-func scanNetwork() {
-	fmt.Println("🔍 Scanning for nearby peers...")
+// explainStartFailure suggests what to do about a node that didn't start
+// because another process runs one on the same data directory
+func explainStartFailure(err error) {
+	var locked *mesh.InstanceLockedError
+	if !errors.As(err, &locked) {
+		return
+	}
+	fmt.Println("💡 Use the BitShare terminal that is already running, or stop it first; 'status' here shows what its node sees.")
+}
+
+// networkScanTimeout is how long 'scan --network' waits for answers
+const networkScanTimeout = 3 * time.Second
+
+// scanNetwork scans the local network for peers, those of the private
+// network called network when it isn't empty
+func scanNetwork(network, passphrase string) {
+	var peers []p2p.PeerInfo
+	var err error
+	if network == "" {
+		fmt.Println("🔍 Scanning for nearby peers...")
 
-	// Scan across all available protocols
-	peers, err := p2p.ScanForPeers()
+		// Scan across all available protocols
+		peers, err = p2p.ScanForPeers()
+	} else {
+		fmt.Printf("🔍 Scanning for nearby peers on network '%s'...\n", network)
+		peers, err = p2p.GetTCPManager().DiscoverNetwork(network, passphrase, networkScanTimeout)
+	}
 	if err != nil {
 		fmt.Printf("❌ Scan error: %v\n", err)
 		return
 	}
 
+	// Leave out blocked peers
+	kept := peers[:0]
+	for _, peer := range peers {
+		if !access.IsBlocked(peer.ID, peer.Address) {
+			kept = append(kept, peer)
+		}
+	}
+	peers = kept
+
 	if len(peers) == 0 {
 		fmt.Println("No peers found. Try again or check connection settings.")
 		return
 	}
 
+	targets := make([]mesh.HandleTarget, len(peers))
+	for i, peer := range peers {
+		targets[i] = mesh.HandleTarget{ID: peer.ID, Name: peer.Name, Address: peer.Address}
+	}
+	handles := mesh.AssignHandles(targets)
+
+	// Remember what was found, so 'list' shows it even after a restart,
+	// unless it is on a network the node isn't on
+	if mesh.IsNodeRunning() && (network == "" || network == mesh.GetConfig().Network) {
+		found := make([]mesh.Peer, len(peers))
+		for i, peer := range peers {
+			found[i] = mesh.Peer{
+				ID:             peer.ID,
+				Name:           peer.Name,
+				Address:        peer.Address,
+				Protocol:       peer.Protocol,
+				LastSeen:       peer.LastSeen,
+				SignalStrength: peer.SignalStrength,
+				Version:        peer.Version,
+				Transports:     peer.Transports,
+			}
+		}
+		mesh.RememberPeers(found...)
+	}
+
 	fmt.Printf("Found %d peers:\n", len(peers))
 	for i, peer := range peers {
-		fmt.Printf("%d. %s (%s) - Protocol: %s, Signal: %d%%\n",
-			i+1, peer.Name, peer.ID, peer.Protocol, peer.SignalStrength)
+		fmt.Printf("%-4s %s (%s) - Protocol: %s, Signal: %d%%\n",
+			handles[i], peer.Name, peer.ID, scanProtocols(peer), peer.SignalStrength)
+	}
+}
+
+// scanProtocols lists the protocols a scan found a peer on, best first
+func scanProtocols(peer p2p.PeerInfo) string {
+	if len(peer.Transports) == 0 {
+		return peer.Protocol
 	}
+	protocols := make([]string, len(peer.Transports))
+	for i, t := range peer.Transports {
+		protocols[i] = t.Protocol
+	}
+	return strings.Join(protocols, ", ")
 }
 
 // listPeers lists all known peers in the mesh network
-func listPeers() {
-	peers, err := mesh.GetKnownPeers()
+func listPeers(verbose bool) {
+	snapshot, source, err := mesh.GetNodeSnapshot()
 	if err != nil {
 		fmt.Printf("❌ Error retrieving peers: %v\n", err)
 		return
 	}
+	peers := snapshot.Peers
+
+	if source == mesh.SourceCache {
+		fmt.Printf("(cached, node not running - last updated %s)\n", utils.FormatTimestamp(snapshot.UpdatedAt, verbose))
+	}
 
 	if len(peers) == 0 {
 		fmt.Println("No known peers. Run 'scan' to discover peers.")
 		return
 	}
 
+	targets := make([]mesh.HandleTarget, len(peers))
+	for i, peer := range peers {
+		targets[i] = mesh.HandleTarget{ID: peer.ID, Name: peer.Name, Address: peer.Address}
+	}
+	handles := mesh.AssignHandles(targets)
+
 	fmt.Println("Known peers in the mesh network:")
 	fmt.Println("--------------------------------")
 	for i, peer := range peers {
 		status := "⚫ Offline"
 		if peer.IsOnline {
 			status = "🟢 Online"
+		} else if !peer.LastSeen.IsZero() {
+			status += ", last seen " + utils.FormatTime(peer.LastSeen)
+		}
+		if peer.Pinned {
+			status += " 📌"
+		}
+		if peer.GossipOrigin != "" {
+			status += " (unverified)"
+		}
+		fmt.Printf("%-4s %s — %s (%s) - %s\n", handles[i], aliasedName(peer), displayProtocols(peer), peer.ID, status)
+		fmt.Printf("     Routes: %d, Quality: %s, Version: %s, Last seen: %s\n",
+			len(peer.Routes), displayQuality(peer), displayVersion(peer.Version), utils.FormatTimestamp(peer.LastSeen, verbose))
+		fmt.Printf("     Key: %s\n", displayFingerprint(peer))
+	}
+	fmt.Println("Use a handle like #1 in place of a peer name, e.g. 'send #1 9000 file.txt'")
+}
+
+// showPeer prints everything known about a single peer
+func showPeer(idOrName string, verbose bool) {
+	peer, err := mesh.FindPeerByIdOrName(idOrName)
+	if err != nil {
+		fmt.Printf("❌ %v\n", err)
+		return
+	}
+
+	status := "⚫ Offline"
+	if peer.IsOnline {
+		status = "🟢 Online"
+	}
+
+	fmt.Printf("\n\033[1m%s\033[0m\n", aliasedName(*peer))
+	fmt.Printf("  ID:       %s\n", peer.ID)
+	fmt.Printf("  Status:   %s\n", status)
+	fmt.Printf("  Address:  %s\n", peer.Address)
+	fmt.Printf("  Protocol: %s\n", displayProtocols(*peer))
+	if len(peer.Transports) > 1 {
+		for _, t := range peer.Transports {
+			fmt.Printf("    %s at %s, signal %d%%, seen %s\n", t.Protocol, t.Address, t.SignalStrength, utils.FormatTime(t.LastSeen))
+		}
+	}
+	fmt.Printf("  Key:      %s\n", displayFingerprint(*peer))
+	if peer.KeyConflict != "" {
+		fmt.Printf("  🚨 Took the name of %s, seen before with another key\n", peer.KeyConflict)
+	}
+	if peer.GossipOrigin != "" {
+		fmt.Printf("  Unverified: heard of from %s, not seen or contacted yet\n", peer.GossipOrigin)
+	}
+	if peer.Version != "" {
+		fmt.Printf("  Version:  %s\n", peer.Version)
+	}
+	if !peer.LastSeen.IsZero() {
+		fmt.Printf("  Last seen: %s\n", utils.FormatTimestamp(peer.LastSeen, verbose))
+	}
+	if peer.Pinned {
+		fmt.Println("  Pinned:   yes, kept however long it is unseen")
+	}
+	fmt.Printf("  Signal:   %d%%\n", peer.SignalStrength)
+	fmt.Printf("  Quality:  %s\n", displayQuality(*peer))
+	fmt.Printf("  Routes:   %d\n", len(peer.Routes))
+	for _, route := range peer.Routes {
+		fmt.Printf("    via %s - %d hops, quality %d%%\n", route.NextHop, route.HopCount, route.Quality)
+	}
+}
+
+// pinPeer keeps a peer in the list however long it goes unseen, or lets it be
+// forgotten again
+func pinPeer(idOrName string, pinned bool) {
+	peer, err := mesh.PinPeer(idOrName, pinned)
+	if err != nil {
+		fmt.Printf("❌ %v\n", err)
+		return
+	}
+	if pinned {
+		fmt.Printf("📌 %s stays in the peer list however long it is unseen\n", peer.Name)
+	} else {
+		fmt.Printf("%s will be forgotten again once it goes unseen long enough\n", peer.Name)
+	}
+}
+
+// displayFingerprint shows the fingerprint of the key a peer proved its ID
+// with, or that it hasn't
+func displayFingerprint(peer mesh.Peer) string {
+	fingerprint := peer.Fingerprint()
+	if fingerprint == "" {
+		fingerprint = "unverified"
+	}
+	if peer.KeyConflict != "" {
+		fingerprint += fmt.Sprintf(" 🚨 not the key of the %s seen before", peer.Name)
+	}
+	return fingerprint
+}
+
+// aliasedName is how a peer is listed: its alias followed by the name it
+// gave itself, or just that name when it has no alias
+func aliasedName(peer mesh.Peer) string {
+	if alias := mesh.AliasOf(peer.ID); alias != "" {
+		return fmt.Sprintf("%s [%s]", alias, peer.Name)
+	}
+	return peer.Name
+}
+
+// setAlias gives a peer a local name that commands accept in place of its ID
+func setAlias(idOrName, alias string) {
+	peer, shadowed, err := mesh.SetAlias(idOrName, alias)
+	if err != nil {
+		fmt.Printf("❌ %v\n", err)
+		return
+	}
+	fmt.Printf("🏷️  %s (%s) is now known as %s\n", peer.Name, peer.ID, alias)
+	for _, other := range shadowed {
+		fmt.Printf("⚠️ Peer %s (%s) also goes by %s, commands will use the alias - use its ID to reach it\n", other.Name, other.ID, alias)
+	}
+}
+
+// deleteAlias removes an alias
+func deleteAlias(alias string) {
+	if err := mesh.DeleteAlias(alias); err != nil {
+		fmt.Printf("❌ %v\n", err)
+		return
+	}
+	fmt.Printf("Removed alias %s\n", alias)
+}
+
+// listAliases prints the aliases and the peers they stand for
+func listAliases() {
+	aliases := mesh.Aliases()
+	if len(aliases) == 0 {
+		fmt.Println("No aliases. Use 'alias <peer> <alias>' to give a peer a name of your own.")
+		return
+	}
+	names := make([]string, 0, len(aliases))
+	for alias := range aliases {
+		names = append(names, alias)
+	}
+	sort.Strings(names)
+	for _, alias := range names {
+		fmt.Printf("%-16s %s\n", alias, aliases[alias])
+	}
+}
+
+// blockPeer blocks a peer, IP address or CIDR range
+func blockPeer(peer string) {
+	block, err := mesh.BlockPeer(peer)
+	if err != nil {
+		fmt.Printf("❌ %v\n", err)
+		return
+	}
+	if block.Name != "" {
+		fmt.Printf("🚫 Blocked %s (%s)\n", block.Name, block.Peer)
+	} else {
+		fmt.Printf("🚫 Blocked %s\n", block.Peer)
+	}
+}
+
+// unblockPeer lets a blocked peer back in
+func unblockPeer(peer string) {
+	block, err := mesh.UnblockPeer(peer)
+	if err != nil {
+		fmt.Printf("❌ %v\n", err)
+		return
+	}
+	fmt.Printf("Unblocked %s\n", block.Peer)
+}
+
+// listBlocked prints the blocked peers and the connections refused from them
+func listBlocked() {
+	blocked, err := mesh.Blocklist()
+	if err != nil {
+		fmt.Printf("❌ %v\n", err)
+		return
+	}
+	if len(blocked) == 0 {
+		fmt.Println("Nobody is blocked. Use 'block <peer-or-ip>' to ignore a peer.")
+		return
+	}
+	for _, block := range blocked {
+		name := block.Name
+		if name == "" {
+			name = "-"
+		}
+		attempts := fmt.Sprintf("%d refused", block.Attempts)
+		if !block.LastAttempt.IsZero() {
+			attempts += ", last " + utils.FormatTime(block.LastAttempt)
+		}
+		fmt.Printf("%-36s %-16s blocked %s, %s\n", block.Peer, name, utils.FormatTime(block.Added), attempts)
+	}
+}
+
+// resolvePeerAddress turns a peer ID, name, or IP address into an address to
+// connect to. Peers are connected to right away with mesh.ConnectToPeer;
+// the address is then the peer's ID and viaMesh is true, so transfers go
+// through mesh.DialPeer and reuse that connection.
+func resolvePeerAddress(target string) (address string, viaMesh bool, err error) {
+	if ip, ok := utils.ParseIPHost(target); ok {
+		return ip, false, nil
+	}
+
+	// This might be a peer ID or name, try to resolve it
+	fmt.Printf("Looking up peer: %s\n", target)
+	conn, err := mesh.ConnectToPeer(target)
+	if err != nil {
+		// Handles from 'scan' can refer to peers the mesh hasn't learned about yet
+		if mesh.IsHandle(target) {
+			if handleTarget, handleErr := mesh.ResolveHandle(target); handleErr == nil && handleTarget.Address != "" {
+				fmt.Printf("Using scanned address of %s: %s\n", handleTarget.Name, handleTarget.Address)
+				return handleTarget.Address, false, nil
+			}
+		}
+		return "", false, fmt.Errorf("error connecting to peer: %v", err)
+	}
+	return conn.Peer.ID, true, nil
+}
+
+// expandSendPaths resolves the file arguments of a send command, expanding
+// globs and falling back to the common user directories for plain names
+func expandSendPaths(patterns []string) ([]string, error) {
+	var filePaths []string
+	for _, pattern := range patterns {
+		if strings.ContainsAny(pattern, "*?[") {
+			matches, err := filepath.Glob(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern '%s': %v", pattern, err)
+			}
+			for _, match := range matches {
+				if utils.FileExists(match) {
+					filePaths = append(filePaths, match)
+				}
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("no files match '%s'", pattern)
+			}
+			continue
+		}
+
+		filePath := pattern
+		if !utils.FileExists(filePath) {
+			fmt.Printf("File not found at '%s'. Searching in common directories...\n", filePath)
+			foundPath, err := utils.FindFileInCommonDirs(filePath)
+			if err != nil {
+				absPath, _ := filepath.Abs(filePath)
+				return nil, fmt.Errorf("%v (looked for file at: %s)", err, absPath)
+			}
+			fmt.Printf("File found: %s\n", foundPath)
+			filePath = foundPath
+		}
+
+		// Check if file is readable
+		file, err := os.Open(filePath)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read file: %v", err)
+		}
+		file.Close()
+
+		filePaths = append(filePaths, filePath)
+	}
+
+	if len(filePaths) == 0 {
+		return nil, fmt.Errorf("no files to send")
+	}
+	return filePaths, nil
+}
+
+// forwardFile sends a file received earlier in this session on to another
+// peer. The shell completes the history ID (see completeCommand), and a
+// forward without one lists the recent ones.
+func forwardFile(args []string) {
+	force := false
+	var positional []string
+	for _, arg := range args {
+		if arg == "--force" {
+			force = true
+			continue
+		}
+		positional = append(positional, arg)
+	}
+
+	if len(positional) < 2 || len(positional) > 3 {
+		fmt.Println("Usage: forward <history_id|last> <peer_id_or_ip> [port_no] [--force]")
+		printRecentReceived()
+		return
+	}
+
+	entry, err := transfer.FindReceivedEntry(positional[0])
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		printRecentReceived()
+		return
+	}
+
+	port := 9000
+	if len(positional) == 3 {
+		port, err = strconv.Atoi(positional[2])
+		if err != nil || port < 1 || port > 65535 {
+			fmt.Println("Port number must be between 1 and 65535")
+			return
+		}
+	}
+
+	if !utils.FileExists(entry.FilePath) {
+		fmt.Printf("Error: %s no longer exists at %s\n", entry.FileName, entry.FilePath)
+		return
+	}
+
+	checksum, err := transfer.FileChecksum(entry.FilePath)
+	if err != nil {
+		fmt.Printf("Cannot read file: %v\n", err)
+		return
+	}
+	if checksum != entry.Checksum {
+		if !force {
+			fmt.Printf("Error: %s has been modified since it was received. Use --force to forward it anyway.\n", entry.FileName)
+			return
+		}
+		fmt.Printf("⚠️  %s has been modified since it was received, forwarding anyway\n", entry.FileName)
+	}
+
+	target := positional[1]
+	runCommand(fmt.Sprintf("forward %s to %s", entry.FileName, target), func(ctx context.Context) {
+		ip, viaMesh, err := resolvePeerAddress(target)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+
+		fmt.Printf("Forwarding %s (received from %s) to %s...\n", entry.FileName, entry.Peer, net.JoinHostPort(ip, strconv.Itoa(port)))
+		defaults, err := transferDefaults()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		options := defaults
+		options.Context = ctx
+		options.ForwardedFrom = entry.Peer
+		if viaMesh {
+			options.Dial = mesh.DialPeer
+		}
+		if _, isIP := utils.ParseIPHost(target); !isIP {
+			options.PeerName = target
+		}
+		err = transfer.QueueTransfer(ctx, fmt.Sprintf("forward %s to %s", entry.FileName, target), 0, func(ctx context.Context) error {
+			options.Context = ctx
+			return transfer.SendFilesWithOptions([]string{entry.FilePath}, ip, port, options)
+		})
+		if err != nil {
+			fmt.Printf("Error forwarding file: %v\n", err)
+			return
+		}
+
+		forwardedTo := net.JoinHostPort(ip, strconv.Itoa(port))
+		transfer.AddForwardedTo(entry.ID, forwardedTo)
+
+		fmt.Printf("File forwarded successfully! [%s -> %s]\n", entry.Peer, forwardedTo)
+	})
+	if interactiveMode {
+		fmt.Println("Transfer started in background. You can continue using other commands.")
+	}
+}
+
+// historyPageSize is how many transfers 'history' shows without --all
+const historyPageSize = 20
+
+// showHistory lists recorded transfers, or clears them
+func showHistory(args []string) {
+	args, all := extractSwitch(args, "--all")
+	args, asJSON := extractSwitch(args, "--json")
+
+	if len(args) == 1 && args[0] == "clear" {
+		if err := transfer.ClearHistory(); err != nil {
+			fmt.Printf("Error clearing history: %v\n", err)
+			return
+		}
+		fmt.Println("Transfer history cleared")
+		return
+	}
+	if len(args) > 0 {
+		fmt.Println("Usage: history [clear] [--all] [--json]")
+		return
+	}
+
+	entries := transfer.GetHistory()
+	older := 0
+	if !all && len(entries) > historyPageSize {
+		older = len(entries) - historyPageSize
+		entries = entries[:historyPageSize]
+	}
+
+	if asJSON {
+		if entries == nil {
+			entries = []transfer.HistoryEntry{}
+		}
+		data, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		fmt.Println(string(data))
+		return
+	}
+
+	if len(entries) == 0 {
+		fmt.Println("No transfers recorded yet")
+		return
+	}
+
+	fmt.Println("Transfer history, newest first:")
+	for _, entry := range entries {
+		peer := entry.Peer
+		if entry.PeerName != "" {
+			peer = fmt.Sprintf("%s (%s)", entry.PeerName, entry.Peer)
+		}
+		direction := "to"
+		if entry.Direction == transfer.DirectionReceived {
+			direction = "from"
+		}
+
+		result := entry.Result
+		switch entry.Result {
+		case transfer.ResultOK:
+			result = "✓"
+		case transfer.ResultFailed:
+			result = "✗ failed"
+		case transfer.ResultCancelled:
+			result = "✗ cancelled"
+		case transfer.ResultUpToDate:
+			result = "✓ already up to date"
+		}
+
+		fmt.Printf("  #%d %s %s %s (%s) %s %s, took %s %s\n", entry.ID, utils.FormatTime(entry.Time), entry.Direction,
+			entry.FileName, utils.FormatBytes(entry.FileSize), direction, peer, utils.FormatDuration(entry.Duration), result)
+		if entry.Error != "" {
+			fmt.Printf("      %s\n", entry.Error)
+		}
+		if entry.ReceivedFrom != "" {
+			fmt.Printf("      originally received from %s\n", entry.ReceivedFrom)
+		}
+	}
+	if older > 0 {
+		fmt.Printf("  ... and %d older transfers, use 'history --all' to see them\n", older)
+	}
+}
+
+// completeCommand offers last and the IDs of recently received files for
+// the first argument of forward, as the shell's Tab completion
+func completeCommand(line string) []string {
+	args := strings.Fields(line)
+	if len(args) > 0 && !strings.HasSuffix(line, " ") {
+		args = args[:len(args)-1] // The word being typed
+	}
+	if len(args) == 0 || args[0] != "forward" {
+		return nil
+	}
+	for _, arg := range args[1:] {
+		if arg != "--force" {
+			return nil
+		}
+	}
+
+	choices := []string{"last"}
+	for _, entry := range transfer.GetHistory() {
+		if entry.Direction != transfer.DirectionReceived || entry.Result != transfer.ResultOK {
+			continue
+		}
+		choices = append(choices, strconv.Itoa(entry.ID))
+		if len(choices) == 10 {
+			break
+		}
+	}
+	return choices
+}
+
+// printRecentReceived lists recently received files that can be forwarded
+func printRecentReceived() {
+	shown := 0
+	for _, entry := range transfer.GetHistory() {
+		if entry.Direction != transfer.DirectionReceived || entry.Result != transfer.ResultOK {
+			continue
+		}
+		if shown == 0 {
+			fmt.Println("Recently received files:")
+		}
+		fmt.Printf("  #%d %s (%s) from %s, %s\n", entry.ID, entry.FileName, utils.FormatBytes(entry.FileSize), entry.Peer,
+			utils.FormatTime(entry.Time))
+		shown++
+		if shown == 5 {
+			break
 		}
-		fmt.Printf("%d. %s (%s) - %s\n", i+1, peer.Name, peer.ID, status)
-		fmt.Printf("   Routes: %d, Connection Quality: %s\n",
-			len(peer.Routes), peer.ConnectionQuality)
 	}
 }
 
@@ -729,15 +2946,37 @@ func printUsage() {
 	fmt.Println("-----------------")
 	fmt.Println("Usage:")
 	fmt.Println("  Start mesh node:")
-	fmt.Println("    bitshare start")
-	fmt.Println("\n  Scan for peers:")
+	fmt.Println("    bitshare start [--name <name>] [--port <port>] [--data-dir <dir>] [--relay|--no-relay] [--offline] [--allow-plaintext]")
+	fmt.Println("\n  Show or replace the node ID peers know this node by:")
+	fmt.Println("    bitshare id [--reset]")
+	fmt.Println("\n  Write a config file with the defaults, to change what the node and transfers start with:")
+	fmt.Println("    bitshare config init [--force]")
+	fmt.Println("\n  Scan for peers, or for those of a private network:")
 	fmt.Println("    bitshare scan")
+	fmt.Println("    bitshare scan --network <name> [--passphrase <passphrase>]")
 	fmt.Println("\n  List known peers:")
 	fmt.Println("    bitshare list")
+	fmt.Println("\n  Call a peer by a name of your own, or remove the alias:")
+	fmt.Println("    bitshare alias <peer_id_or_name> <alias>")
+	fmt.Println("    bitshare alias --delete <alias>")
+	fmt.Println("\n  Block a peer, IP address or CIDR range, list what is blocked, or unblock it:")
+	fmt.Println("    bitshare block <peer_id_name_or_ip>")
+	fmt.Println("    bitshare block --list")
+	fmt.Println("    bitshare unblock <peer_id_name_or_ip>")
+	fmt.Println("\n  Show sent and received files:")
+	fmt.Println("    bitshare history [clear] [--all] [--json]")
 	fmt.Println("\n  Send a file:")
-	fmt.Println("    bitshare send <peer_id_or_name_or_ip> <port_no> \"<file_path_or_name>\"")
+	fmt.Println("    bitshare send <peer_id_or_name_or_ip> <port_no> \"<file_path_or_name>\" [more files...] [--tls] [--pin <pin>]")
+	fmt.Println("    bitshare send bitshare://<ip>:<port> \"<file_path_or_name>\" [more files...]")
+	fmt.Println("    <command> | bitshare send <peer_id_or_name_or_ip> <port_no> - [--name <file_name>]")
 	fmt.Println("\n  Receive a file:")
-	fmt.Println("    bitshare receive <port_no> [destination_directory]")
+	fmt.Println("    bitshare receive <port_no> [destination_directory] [--once] [--tls] [--pin <pin>] [--no-preserve] [--no-resume] [--max-size <size>] [--on-exists <policy>] [--allow <ips>] [--deny <ips>] [--max-connections <n>] [--max-per-ip <n>]")
+	fmt.Println("    bitshare receive <port_no> --stdout | <command>")
+	fmt.Println("\n  Limit who can connect to receivers and the mesh node:")
+	fmt.Println("    bitshare access [list|allow <ip_or_cidr>|deny <ip_or_cidr>|remove <ip_or_cidr>]")
+	fmt.Println("\n  Machine-readable output for wrappers (JSON lines, prompts answered on stdin):")
+	fmt.Println("    bitshare --progress-json <command>    - events on stderr")
+	fmt.Println("    bitshare --progress-fd <n> <command>  - events on file descriptor n")
 	fmt.Println("\n  Start interactive mode:")
 	fmt.Println("    bitshare")
 	fmt.Println("    or")